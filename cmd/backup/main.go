@@ -0,0 +1,298 @@
+// Command backup exports a consistent logical snapshot of the user_svc schema, verifies it and
+// restores it into a fresh database. Snapshots are written to a local path or a pre-signed object
+// storage URL, and carry a per table row count and SHA-256 that every command checks.
+//
+// Restore runs in a single transaction into an already migrated, empty user_svc schema of the same
+// migration version, and compares the restored tables to the snapshot before committing.
+// Tokens and secrets in user_security are not part of snapshots, restored users sign in again.
+//
+//	go run ./cmd/backup export -to https://bucket.s3.amazonaws.com/user-svc.jsonl.gz?X-Amz-Signature=...
+//	go run ./cmd/backup verify -from user-svc.jsonl.gz
+//	go run ./cmd/backup restore -db "host=localhost dbname=restored ..." -from user-svc.jsonl.gz
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	_ "github.com/lib/pq"
+	"golang.org/x/net/context"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const usage = `usage: backup <export|verify|restore> [flags]
+
+  export  -to <path|url>    write a snapshot of the user_svc schema
+  verify  -from <path|url>  check a snapshot is complete and intact
+  restore -from <path|url>  load a snapshot into an empty, migrated database`
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+
+	command, args := os.Args[1], os.Args[2:]
+	switch command {
+	case "export":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		dsn := flags.String("db", defaultDSN(), "postgres connection string")
+		to := flags.String("to", "", "path or url the snapshot is written to")
+		_ = flags.Parse(args)
+		if *to == "" {
+			log.Fatal("export requires -to")
+		}
+
+		db := openDB(*dsn)
+		defer db.Close()
+		if err := exportSnapshot(context.Background(), db, *to); err != nil {
+			log.Fatal(err)
+		}
+	case "verify":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		from := flags.String("from", "", "path or url of the snapshot")
+		_ = flags.Parse(args)
+		if *from == "" {
+			log.Fatal("verify requires -from")
+		}
+
+		if err := verifyLocation(*from); err != nil {
+			log.Fatal(err)
+		}
+	case "restore":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		dsn := flags.String("db", defaultDSN(), "postgres connection string of the restore target")
+		from := flags.String("from", "", "path or url of the snapshot")
+		_ = flags.Parse(args)
+		if *from == "" {
+			log.Fatal("restore requires -from")
+		}
+
+		db := openDB(*dsn)
+		defer db.Close()
+		if err := restoreSnapshot(context.Background(), db, *from); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatal(usage)
+	}
+}
+
+// defaultDSN builds a connection string from the environment variables of the service.
+func defaultDSN() string {
+	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=%s port=%s",
+		os.Getenv("hosts_postgres_host"),
+		os.Getenv("hosts_postgres_user"),
+		os.Getenv("hosts_postgres_password"),
+		os.Getenv("hosts_postgres_db"),
+		os.Getenv("hosts_postgres_sslmode"),
+		os.Getenv("hosts_postgres_port"),
+	)
+}
+
+func openDB(dsn string) *sql.DB {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := db.Ping(); err != nil {
+		log.Fatal(err)
+	}
+
+	return db
+}
+
+// exportSnapshot writes every table of user_svc to location from a single repeatable read transaction,
+// then reads the stored snapshot back and verifies it.
+func exportSnapshot(ctx context.Context, db *sql.DB, location string) error {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	migration, err := migrationVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	tables, err := schemaTables(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	out, err := createSnapshot(location)
+	if err != nil {
+		return err
+	}
+
+	written, err := writeSnapshot(ctx, tx, out, snapshotHeader{Created: time.Now().UTC(), Migration: migration}, tables)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	in, err := openSnapshot(location)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if _, stored, err := verifySnapshot(in); err != nil {
+		return err
+	} else if !equalChecksums(written, stored) {
+		return errChecksumMismatch
+	}
+
+	for _, table := range written {
+		log.Printf("exported %s: %d rows, sha256 %s", table.Name, table.Rows, table.SHA256)
+	}
+	log.Printf("snapshot of migration %d written to %s", migration, location)
+
+	return nil
+}
+
+func writeSnapshot(ctx context.Context, tx *sql.Tx, out io.Writer, header snapshotHeader,
+	tables []string) ([]tableChecksum, error) {
+	snapshot, err := newSnapshotWriter(out, header)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, table := range tables {
+		snapshot.beginTable(table)
+		if err := scanTable(ctx, tx, table, snapshot.writeRow); err != nil {
+			return nil, err
+		}
+	}
+
+	return snapshot.close()
+}
+
+func verifyLocation(location string) error {
+	in, err := openSnapshot(location)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	header, tables, err := verifySnapshot(in)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		log.Printf("verified %s: %d rows", table.Name, table.Rows)
+	}
+	log.Printf("snapshot of migration %d created %s is intact", header.Migration, header.Created.Format(time.RFC3339))
+
+	return nil
+}
+
+// restoreSnapshot loads the snapshot at location in a single transaction.
+// Returns errMigrationMismatch, errTargetNotEmpty or errTableSetMismatch without writing if the target
+// does not fit the snapshot, errChecksumMismatch if the snapshot or the restored tables are not intact.
+func restoreSnapshot(ctx context.Context, db *sql.DB, location string) error {
+	in, err := openSnapshot(location)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	snapshot, err := newSnapshotReader(in)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	migration, err := migrationVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if migration != snapshot.header.Migration {
+		return fmt.Errorf("%s: snapshot %d, database %d",
+			errMigrationMismatch.Error(), snapshot.header.Migration, migration)
+	}
+
+	tables, err := schemaTables(ctx, tx)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(tables))
+	for _, table := range tables {
+		empty, err := isTableEmpty(ctx, tx, table)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fmt.Errorf("%s: table %s has rows", errTargetNotEmpty.Error(), table)
+		}
+		known[table] = true
+	}
+
+	for {
+		row, err := snapshot.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !known[row.Table] {
+			return fmt.Errorf("%s: table %s", errTableSetMismatch.Error(), row.Table)
+		}
+		if err := insertRow(ctx, tx, row.Table, row.Data); err != nil {
+			return err
+		}
+	}
+
+	expected := snapshot.tables()
+	if len(expected) != len(tables) {
+		return errTableSetMismatch
+	}
+	for _, table := range expected {
+		if !known[table.Name] {
+			return fmt.Errorf("%s: table %s", errTableSetMismatch.Error(), table.Name)
+		}
+		if err := resetSequences(ctx, tx, table.Name); err != nil {
+			return err
+		}
+
+		restored, err := checksumTable(ctx, tx, table.Name)
+		if err != nil {
+			return err
+		}
+		if restored != table {
+			return fmt.Errorf("%s: restored table %s", errChecksumMismatch.Error(), table.Name)
+		}
+		log.Printf("restored %s: %d rows", table.Name, table.Rows)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("snapshot of migration %d restored from %s", migration, location)
+
+	return nil
+}
+
+func equalChecksums(a []tableChecksum, b []tableChecksum) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+	"sort"
+)
+
+const snapshotSchema = "user_svc"
+
+// schemaTables returns the tables of snapshotSchema, parents before the tables referencing them.
+func schemaTables(ctx context.Context, tx *sql.Tx) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT tablename FROM pg_tables WHERE schemaname = $1`, snapshotSchema)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT child.relname, parent.relname
+				FROM pg_constraint c
+				JOIN pg_class child ON child.oid = c.conrelid
+				JOIN pg_class parent ON parent.oid = c.confrelid
+				JOIN pg_namespace ns ON ns.oid = parent.relnamespace
+				WHERE c.contype = 'f' AND c.connamespace = $1::regnamespace AND ns.nspname = $1
+				`
+	rows, err = tx.QueryContext(ctx, command, snapshotSchema)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parents := make(map[string][]string)
+	for rows.Next() {
+		var child, parent string
+		if err := rows.Scan(&child, &parent); err != nil {
+			return nil, err
+		}
+		parents[child] = append(parents[child], parent)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orderTables(tables, parents)
+}
+
+// orderTables sorts tables so every table comes after the tables it references, ties are broken by name.
+// Returns error if references form a cycle.
+func orderTables(tables []string, parents map[string][]string) ([]string, error) {
+	pending := make(map[string]int, len(tables))
+	children := make(map[string][]string)
+	for _, table := range tables {
+		pending[table] = 0
+	}
+	for _, table := range tables {
+		for _, parent := range parents[table] {
+			if _, ok := pending[parent]; !ok || parent == table {
+				// references outside the schema and to the table itself do not constrain the order
+				continue
+			}
+			pending[table]++
+			children[parent] = append(children[parent], table)
+		}
+	}
+
+	var ready []string
+	for table, count := range pending {
+		if count == 0 {
+			ready = append(ready, table)
+		}
+	}
+
+	ordered := make([]string, 0, len(tables))
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		table := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, table)
+
+		for _, child := range children[table] {
+			pending[child]--
+			if pending[child] == 0 {
+				ready = append(ready, child)
+			}
+		}
+	}
+
+	if len(ordered) != len(tables) {
+		return nil, fmt.Errorf("foreign keys of %s form a cycle", snapshotSchema)
+	}
+
+	return ordered, nil
+}
+
+// migrationVersion returns the version recorded by golang-migrate, -1 if migrations are not tracked.
+// Returns error if the last migration is dirty.
+func migrationVersion(ctx context.Context, tx *sql.Tx) (int64, error) {
+	var tracked bool
+	if err := tx.QueryRowContext(ctx,
+		`SELECT to_regclass('public.schema_migrations') IS NOT NULL`).Scan(&tracked); err != nil {
+		return 0, err
+	}
+	if !tracked {
+		return -1, nil
+	}
+
+	var version int64
+	var dirty bool
+	err := tx.QueryRowContext(ctx, `SELECT version, dirty FROM public.schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if dirty {
+		return 0, fmt.Errorf("migration %d is dirty", version)
+	}
+
+	return version, nil
+}
+
+// qualifiedTable returns the quoted name of table in snapshotSchema.
+func qualifiedTable(table string) string {
+	return pq.QuoteIdentifier(snapshotSchema) + "." + pq.QuoteIdentifier(table)
+}
+
+// scanTable passes every row of table to fn as JSON, in a stable order so checksums can be compared.
+func scanTable(ctx context.Context, tx *sql.Tx, table string, fn func(data string) error) error {
+	command := fmt.Sprintf(`SELECT row_to_json(t)::TEXT AS data FROM %s t ORDER BY data`, qualifiedTable(table))
+	rows, err := tx.QueryContext(ctx, command)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// checksumTable returns the checksum of table as it would be written to a snapshot.
+func checksumTable(ctx context.Context, tx *sql.Tx, table string) (tableChecksum, error) {
+	digest := newTableDigest(table)
+	err := scanTable(ctx, tx, table, func(data string) error {
+		digest.add(data)
+		return nil
+	})
+
+	return digest.checksum(), err
+}
+
+// isTableEmpty returns true if table has no rows.
+func isTableEmpty(ctx context.Context, tx *sql.Tx, table string) (bool, error) {
+	var exists bool
+	command := fmt.Sprintf(`SELECT EXISTS(SELECT 1 FROM %s)`, qualifiedTable(table))
+	if err := tx.QueryRowContext(ctx, command).Scan(&exists); err != nil {
+		return false, err
+	}
+
+	return !exists, nil
+}
+
+// insertRow inserts a row written by scanTable, every column is restored including serial ones.
+func insertRow(ctx context.Context, tx *sql.Tx, table string, data string) error {
+	command := fmt.Sprintf(`INSERT INTO %[1]s SELECT * FROM json_populate_record(NULL::%[1]s, $1::JSON)`,
+		qualifiedTable(table))
+	_, err := tx.ExecContext(ctx, command, data)
+
+	return err
+}
+
+// resetSequences moves the sequences of table's serial columns past the restored values.
+func resetSequences(ctx context.Context, tx *sql.Tx, table string) error {
+	command := `SELECT column_name
+				FROM information_schema.columns
+				WHERE table_schema = $1 AND table_name = $2 AND column_default LIKE 'nextval(%'
+				`
+	rows, err := tx.QueryContext(ctx, command, snapshotSchema, table)
+	if err != nil {
+		return err
+	}
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, column := range columns {
+		command := fmt.Sprintf(`SELECT setval(pg_get_serial_sequence($1, $2), COALESCE(MAX(%[1]s), 1), MAX(%[1]s) IS NOT NULL)
+								FROM %[2]s`, pq.QuoteIdentifier(column), qualifiedTable(table))
+		if _, err := tx.ExecContext(ctx, command, snapshotSchema+"."+table, column); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
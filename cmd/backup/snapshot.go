@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+)
+
+// A snapshot is a gzip compressed stream of JSON lines: a header line, one line per row, and a trailer
+// line with the row count and SHA-256 of every table. Tables are written parents first, so rows can be
+// restored in file order without breaking foreign keys.
+
+const (
+	snapshotFormat  = "hwsc-user-svc/user_svc"
+	snapshotVersion = 1
+
+	// maxSnapshotLine bounds a single row, the largest rows are lifecycle event envelopes
+	maxSnapshotLine = 16 << 20
+)
+
+var (
+	errNotSnapshot       = errors.New("not a user_svc snapshot")
+	errMissingTrailer    = errors.New("snapshot is truncated, trailer is missing")
+	errUnexpectedLine    = errors.New("snapshot line is not a row")
+	errRowBeforeTable    = errors.New("row written before its table")
+	errChecksumMismatch  = errors.New("snapshot checksum mismatch")
+	errTableSetMismatch  = errors.New("snapshot tables do not match the database")
+	errTargetNotEmpty    = errors.New("restore target is not empty")
+	errMigrationMismatch = errors.New("snapshot and database migration versions differ")
+)
+
+// snapshotHeader describes where a snapshot comes from
+type snapshotHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+
+	// Migration is the golang-migrate version of the exported schema, -1 if it is not tracked
+	Migration int64 `json:"migration"`
+}
+
+// snapshotRow holds a row as the JSON text returned by row_to_json, so checksums match byte for byte
+type snapshotRow struct {
+	Table string `json:"table"`
+	Data  string `json:"data"`
+}
+
+// tableChecksum is the integrity record of one table
+type tableChecksum struct {
+	Name   string `json:"name"`
+	Rows   int64  `json:"rows"`
+	SHA256 string `json:"sha256"`
+}
+
+// snapshotTrailer lists every table in restore order, empty tables included
+type snapshotTrailer struct {
+	Tables []tableChecksum `json:"tables"`
+}
+
+// snapshotLine holds exactly one of its fields
+type snapshotLine struct {
+	Header  *snapshotHeader  `json:"header,omitempty"`
+	Row     *snapshotRow     `json:"row,omitempty"`
+	Trailer *snapshotTrailer `json:"trailer,omitempty"`
+}
+
+// tableDigest accumulates the checksum of a table as its rows go by
+type tableDigest struct {
+	name string
+	rows int64
+	hash hash.Hash
+}
+
+func newTableDigest(name string) *tableDigest {
+	return &tableDigest{name: name, hash: sha256.New()}
+}
+
+func (d *tableDigest) add(data string) {
+	d.rows++
+	_, _ = io.WriteString(d.hash, data)
+	_, _ = io.WriteString(d.hash, "\n")
+}
+
+func (d *tableDigest) checksum() tableChecksum {
+	return tableChecksum{Name: d.name, Rows: d.rows, SHA256: hex.EncodeToString(d.hash.Sum(nil))}
+}
+
+// snapshotWriter writes a snapshot, tables must be begun in restore order
+type snapshotWriter struct {
+	zw      *gzip.Writer
+	encoder *json.Encoder
+	digests []*tableDigest
+}
+
+func newSnapshotWriter(w io.Writer, header snapshotHeader) (*snapshotWriter, error) {
+	header.Format = snapshotFormat
+	header.Version = snapshotVersion
+
+	zw := gzip.NewWriter(w)
+	encoder := json.NewEncoder(zw)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(&snapshotLine{Header: &header}); err != nil {
+		return nil, err
+	}
+
+	return &snapshotWriter{zw: zw, encoder: encoder}, nil
+}
+
+// beginTable starts table, following rows belong to it.
+func (s *snapshotWriter) beginTable(table string) {
+	s.digests = append(s.digests, newTableDigest(table))
+}
+
+// writeRow appends a row of the current table.
+func (s *snapshotWriter) writeRow(data string) error {
+	if len(s.digests) == 0 {
+		return errRowBeforeTable
+	}
+
+	digest := s.digests[len(s.digests)-1]
+	digest.add(data)
+
+	return s.encoder.Encode(&snapshotLine{Row: &snapshotRow{Table: digest.name, Data: data}})
+}
+
+// close writes the trailer and flushes the compressed stream, it does not close the underlying writer.
+// Returns the checksums written to the trailer.
+func (s *snapshotWriter) close() ([]tableChecksum, error) {
+	trailer := &snapshotTrailer{Tables: make([]tableChecksum, 0, len(s.digests))}
+	for _, digest := range s.digests {
+		trailer.Tables = append(trailer.Tables, digest.checksum())
+	}
+
+	if err := s.encoder.Encode(&snapshotLine{Trailer: trailer}); err != nil {
+		return nil, err
+	}
+
+	return trailer.Tables, s.zw.Close()
+}
+
+// snapshotReader reads a snapshot and checks it against its trailer
+type snapshotReader struct {
+	header  snapshotHeader
+	zr      *gzip.Reader
+	scanner *bufio.Scanner
+	digests map[string]*tableDigest
+	trailer *snapshotTrailer
+}
+
+func newSnapshotReader(r io.Reader) (*snapshotReader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errNotSnapshot
+	}
+
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64*1024), maxSnapshotLine)
+
+	reader := &snapshotReader{zr: zr, scanner: scanner, digests: make(map[string]*tableDigest)}
+
+	line, err := reader.nextLine()
+	if err != nil || line.Header == nil || line.Header.Format != snapshotFormat {
+		return nil, errNotSnapshot
+	}
+	if line.Header.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", line.Header.Version)
+	}
+	reader.header = *line.Header
+
+	return reader, nil
+}
+
+func (s *snapshotReader) nextLine() (*snapshotLine, error) {
+	if !s.scanner.Scan() {
+		if err := s.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errMissingTrailer
+	}
+
+	line := &snapshotLine{}
+	if err := json.Unmarshal(s.scanner.Bytes(), line); err != nil {
+		return nil, err
+	}
+
+	return line, nil
+}
+
+// next returns the next row.
+// Returns io.EOF once every row was read and matched the trailer, errChecksumMismatch if they do not match.
+func (s *snapshotReader) next() (*snapshotRow, error) {
+	if s.trailer != nil {
+		return nil, io.EOF
+	}
+
+	line, err := s.nextLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if line.Trailer != nil {
+		if err := s.verify(line.Trailer); err != nil {
+			return nil, err
+		}
+		s.trailer = line.Trailer
+		return nil, io.EOF
+	}
+
+	if line.Row == nil {
+		return nil, errUnexpectedLine
+	}
+
+	digest, ok := s.digests[line.Row.Table]
+	if !ok {
+		digest = newTableDigest(line.Row.Table)
+		s.digests[line.Row.Table] = digest
+	}
+	digest.add(line.Row.Data)
+
+	return line.Row, nil
+}
+
+func (s *snapshotReader) verify(trailer *snapshotTrailer) error {
+	listed := make(map[string]bool, len(trailer.Tables))
+	for _, expected := range trailer.Tables {
+		listed[expected.Name] = true
+
+		actual := newTableDigest(expected.Name).checksum()
+		if digest, ok := s.digests[expected.Name]; ok {
+			actual = digest.checksum()
+		}
+		if actual != expected {
+			return fmt.Errorf("%s: table %s", errChecksumMismatch.Error(), expected.Name)
+		}
+	}
+
+	for table := range s.digests {
+		if !listed[table] {
+			return fmt.Errorf("%s: table %s is not in the trailer", errChecksumMismatch.Error(), table)
+		}
+	}
+
+	return nil
+}
+
+// tables returns the verified trailer, nil until next returned io.EOF.
+func (s *snapshotReader) tables() []tableChecksum {
+	if s.trailer == nil {
+		return nil
+	}
+
+	return s.trailer.Tables
+}
+
+// verifySnapshot reads every row of r.
+// Returns the header and checksums of a complete and intact snapshot.
+func verifySnapshot(r io.Reader) (*snapshotHeader, []tableChecksum, error) {
+	reader, err := newSnapshotReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		if _, err := reader.next(); err == io.EOF {
+			return &reader.header, reader.tables(), nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func unitTestSnapshot(t *testing.T, tables map[string][]string, order []string) []byte {
+	var buf bytes.Buffer
+	snapshot, err := newSnapshotWriter(&buf, snapshotHeader{Created: time.Now().UTC(), Migration: 17})
+	assert.Nil(t, err)
+
+	for _, table := range order {
+		snapshot.beginTable(table)
+		for _, data := range tables[table] {
+			assert.Nil(t, snapshot.writeRow(data))
+		}
+	}
+
+	_, err = snapshot.close()
+	assert.Nil(t, err)
+
+	return buf.Bytes()
+}
+
+// unitTestRewriteSnapshot returns snapshot with its decompressed lines passed through rewrite.
+func unitTestRewriteSnapshot(t *testing.T, snapshot []byte, rewrite func(lines []string) []string) []byte {
+	zr, err := gzip.NewReader(bytes.NewReader(snapshot))
+	assert.Nil(t, err)
+	plain, err := ioutil.ReadAll(zr)
+	assert.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(string(plain), "\n"), "\n")
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = io.WriteString(zw, strings.Join(rewrite(lines), "\n")+"\n")
+	assert.Nil(t, err)
+	assert.Nil(t, zw.Close())
+
+	return buf.Bytes()
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	tables := map[string][]string{
+		"accounts":     {`{"uuid":"01d3x3wm2nnrdxwpvy0eb6mhtk","first_name":"<b>Ann</b> & Ünal"}`, `{"uuid":"01d3x3wm2nnrdxwpvy0eb6mhtm"}`},
+		"email_tokens": {`{"token":"a","uuid":"01d3x3wm2nnrdxwpvy0eb6mhtk"}`},
+		"referrals":    nil,
+	}
+	order := []string{"accounts", "email_tokens", "referrals"}
+
+	snapshot := unitTestSnapshot(t, tables, order)
+
+	reader, err := newSnapshotReader(bytes.NewReader(snapshot))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(17), reader.header.Migration)
+
+	read := make(map[string][]string)
+	for {
+		row, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		read[row.Table] = append(read[row.Table], row.Data)
+	}
+
+	for _, table := range order {
+		assert.Equal(t, tables[table], read[table], table)
+	}
+
+	checksums := reader.tables()
+	assert.Equal(t, 3, len(checksums))
+	for i, table := range order {
+		assert.Equal(t, table, checksums[i].Name)
+		assert.Equal(t, int64(len(tables[table])), checksums[i].Rows)
+	}
+	assert.Equal(t, newTableDigest("referrals").checksum(), checksums[2])
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	tables := map[string][]string{
+		"accounts": {`{"uuid":"a"}`, `{"uuid":"b"}`},
+		"shares":   {`{"uuid":"a"}`},
+	}
+	order := []string{"accounts", "shares"}
+	valid := unitTestSnapshot(t, tables, order)
+
+	cases := []struct {
+		desc     string
+		input    []byte
+		expErr   string
+		isExpErr bool
+	}{
+		{"test valid snapshot", valid, "", false},
+		{"test not compressed", []byte("{}\n"), errNotSnapshot.Error(), true},
+		{"test wrong format", unitTestRewriteSnapshot(t, valid, func(lines []string) []string {
+			lines[0] = strings.Replace(lines[0], snapshotFormat, "pg_dump", 1)
+			return lines
+		}), errNotSnapshot.Error(), true},
+		{"test missing trailer", unitTestRewriteSnapshot(t, valid, func(lines []string) []string {
+			return lines[:len(lines)-1]
+		}), errMissingTrailer.Error(), true},
+		{"test dropped row", unitTestRewriteSnapshot(t, valid, func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		}), errChecksumMismatch.Error() + ": table accounts", true},
+		{"test altered row", unitTestRewriteSnapshot(t, valid, func(lines []string) []string {
+			lines[3] = strings.Replace(lines[3], `\"a\"`, `\"c\"`, 1)
+			return lines
+		}), errChecksumMismatch.Error() + ": table shares", true},
+		{"test row of unlisted table", unitTestRewriteSnapshot(t, valid, func(lines []string) []string {
+			row := strings.Replace(lines[3], `"shares"`, `"tokens"`, 1)
+			return append(lines[:4], row, lines[4])
+		}), errChecksumMismatch.Error() + ": table tokens is not in the trailer", true},
+		{"test header after rows", unitTestRewriteSnapshot(t, valid, func(lines []string) []string {
+			return append(lines[:2], lines[0], lines[2], lines[3], lines[4])
+		}), errUnexpectedLine.Error(), true},
+	}
+
+	for _, c := range cases {
+		header, checksums, err := verifySnapshot(bytes.NewReader(c.input))
+		if c.isExpErr {
+			assert.EqualError(t, err, c.expErr, c.desc)
+			continue
+		}
+		assert.Nil(t, err, c.desc)
+		assert.Equal(t, int64(17), header.Migration, c.desc)
+		assert.Equal(t, 2, len(checksums), c.desc)
+	}
+}
+
+func TestWriteRowBeforeTable(t *testing.T) {
+	snapshot, err := newSnapshotWriter(ioutil.Discard, snapshotHeader{})
+	assert.Nil(t, err)
+	assert.Equal(t, errRowBeforeTable, snapshot.writeRow(`{}`))
+}
+
+func TestOrderTables(t *testing.T) {
+	cases := []struct {
+		desc     string
+		tables   []string
+		parents  map[string][]string
+		expOrder []string
+		isExpErr bool
+	}{
+		{"test no references", []string{"b", "c", "a"}, nil, []string{"a", "b", "c"}, false},
+		{"test parents first",
+			[]string{"shares", "accounts", "email_tokens", "referrals"},
+			map[string][]string{
+				"shares":       {"accounts"},
+				"email_tokens": {"accounts"},
+				"referrals":    {"accounts", "accounts"},
+			},
+			[]string{"accounts", "email_tokens", "referrals", "shares"}, false},
+		{"test chain", []string{"a", "b", "c"},
+			map[string][]string{"a": {"b"}, "b": {"c"}},
+			[]string{"c", "b", "a"}, false},
+		{"test self and outside references", []string{"a", "b"},
+			map[string][]string{"a": {"a", "user_security_tokens"}},
+			[]string{"a", "b"}, false},
+		{"test cycle", []string{"a", "b", "c"},
+			map[string][]string{"a": {"b"}, "b": {"a"}},
+			nil, true},
+	}
+
+	for _, c := range cases {
+		order, err := orderTables(c.tables, c.parents)
+		if c.isExpErr {
+			assert.NotNil(t, err, c.desc)
+			continue
+		}
+		assert.Nil(t, err, c.desc)
+		assert.Equal(t, c.expOrder, order, c.desc)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Snapshots are stored at a location, either a local path or an http(s) URL. URLs are meant to be
+// pre-signed object storage URLs (S3, GCS, Azure Blob), written with PUT and read with GET.
+
+const storageTimeout = 10 * time.Minute
+
+var storageClient = &http.Client{Timeout: storageTimeout}
+
+func isURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// objectWriter buffers a snapshot and uploads it on Close
+type objectWriter struct {
+	url string
+	buf bytes.Buffer
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *objectWriter) Close() error {
+	req, err := http.NewRequest(http.MethodPut, w.url, &w.buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+
+	resp, err := storageClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("upload to object storage failed: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// createSnapshot returns a writer to location, the snapshot is only stored once Close succeeds.
+func createSnapshot(location string) (io.WriteCloser, error) {
+	if isURL(location) {
+		return &objectWriter{url: location}, nil
+	}
+
+	// an existing snapshot is never overwritten
+	return os.OpenFile(location, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+// openSnapshot returns a reader of the snapshot at location.
+func openSnapshot(location string) (io.ReadCloser, error) {
+	if !isURL(location) {
+		return os.Open(location)
+	}
+
+	resp, err := storageClient.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("download from object storage failed: %s", resp.Status)
+	}
+
+	return resp.Body, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestObjectStorage(t *testing.T) {
+	var stored []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/snapshot":
+			if r.Method == http.MethodPut {
+				stored, _ = ioutil.ReadAll(r.Body)
+				return
+			}
+			_, _ = w.Write(stored)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	out, err := createSnapshot(server.URL + "/snapshot")
+	assert.Nil(t, err)
+	_, err = out.Write([]byte("snapshot"))
+	assert.Nil(t, err)
+	assert.Nil(t, out.Close())
+	assert.Equal(t, "snapshot", string(stored))
+
+	in, err := openSnapshot(server.URL + "/snapshot")
+	assert.Nil(t, err)
+	read, err := ioutil.ReadAll(in)
+	assert.Nil(t, err)
+	assert.Nil(t, in.Close())
+	assert.Equal(t, "snapshot", string(read))
+
+	out, err = createSnapshot(server.URL + "/expired")
+	assert.Nil(t, err)
+	assert.EqualError(t, out.Close(), "upload to object storage failed: 403 Forbidden")
+
+	_, err = openSnapshot(server.URL + "/expired")
+	assert.EqualError(t, err, "download from object storage failed: 403 Forbidden")
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, "snapshot.jsonl.gz")
+	out, err := createSnapshot(location)
+	assert.Nil(t, err)
+	_, err = out.Write([]byte("snapshot"))
+	assert.Nil(t, err)
+	assert.Nil(t, out.Close())
+
+	_, err = createSnapshot(location)
+	assert.True(t, os.IsExist(err), "test existing snapshot is not overwritten")
+
+	in, err := openSnapshot(location)
+	assert.Nil(t, err)
+	read, err := ioutil.ReadAll(in)
+	assert.Nil(t, err)
+	assert.Nil(t, in.Close())
+	assert.Equal(t, "snapshot", string(read))
+}
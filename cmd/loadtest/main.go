@@ -0,0 +1,202 @@
+// Command loadtest drives a weighted mix of CreateUser, AuthenticateUser and VerifyAuthToken
+// calls against a running hwsc-user-svc and reports per RPC latency percentiles.
+//
+// CreateUser sends real verification emails, point it at a deployment with a sandboxed smtp host.
+// CreateUser and AuthenticateUser are rate limited per client, run the deployment with hosts_ratelimit_limits=none.
+//
+//	go run ./cmd/loadtest -addr localhost:50052 -email dummy@hwsc.com -password dummy -profile load
+package main
+
+import (
+	"flag"
+	"fmt"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	opCreate       = "create"
+	opAuthenticate = "authenticate"
+	opVerify       = "verify"
+)
+
+// profile is a preset of duration, concurrency and reporting interval
+type profile struct {
+	duration       time.Duration
+	concurrency    int
+	reportInterval time.Duration
+}
+
+var profiles = map[string]profile{
+	"smoke": {duration: 10 * time.Second, concurrency: 2, reportInterval: 0},
+	"load":  {duration: time.Minute, concurrency: 32, reportInterval: 15 * time.Second},
+	"soak":  {duration: time.Hour, concurrency: 16, reportInterval: time.Minute},
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:50052", "user service address")
+	email := flag.String("email", os.Getenv("hosts_dummy_email"), "email of a verified account used by authenticate and verify")
+	password := flag.String("password", os.Getenv("hosts_dummy_password"), "password of the verified account")
+	mixFlag := flag.String("mix", "create=1,authenticate=4,verify=15", "weighted mix of operations")
+	profileName := flag.String("profile", "load", "smoke, load or soak, overridden by -duration and -concurrency")
+	duration := flag.Duration("duration", 0, "how long to run")
+	concurrency := flag.Int("concurrency", 0, "number of concurrent workers")
+	timeout := flag.Duration("timeout", 5*time.Second, "per request timeout")
+	flag.Parse()
+
+	p, ok := profiles[*profileName]
+	if !ok {
+		log.Fatalf("unknown profile %q", *profileName)
+	}
+	if *duration > 0 {
+		p.duration = *duration
+	}
+	if *concurrency > 0 {
+		p.concurrency = *concurrency
+	}
+
+	mix, err := parseMix(*mixFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conn, err := grpc.Dial(*addr, grpc.WithInsecure())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := &runner{
+		client:   pbsvc.NewUserServiceClient(conn),
+		mix:      mix,
+		timeout:  *timeout,
+		email:    *email,
+		password: *password,
+		stats:    newStats(opCreate, opAuthenticate, opVerify),
+	}
+
+	// verify needs a token before the first authenticate is drawn from the mix
+	if mix.weight(opAuthenticate)+mix.weight(opVerify) > 0 {
+		if err := r.authenticate(); err != nil {
+			log.Fatalf("failed to authenticate %s: %s", *email, err.Error())
+		}
+		r.stats.reset()
+	}
+
+	log.Printf("running %s for %s with %d workers against %s", *mixFlag, p.duration, p.concurrency, *addr)
+	r.run(p)
+	fmt.Print(r.stats.report(p.duration))
+}
+
+// runner owns the client and the token shared between workers
+type runner struct {
+	client   pbsvc.UserServiceClient
+	mix      mix
+	timeout  time.Duration
+	email    string
+	password string
+	token    atomic.Value
+	stats    *stats
+	sequence uint64
+}
+
+func (r *runner) run(p profile) {
+	deadline := time.Now().Add(p.duration)
+	done := make(chan struct{})
+
+	if p.reportInterval > 0 {
+		go func() {
+			start := time.Now()
+			ticker := time.NewTicker(p.reportInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					fmt.Print(r.stats.report(time.Since(start)))
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(p.concurrency)
+	for i := 0; i < p.concurrency; i++ {
+		go func(seed int64) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				op := r.mix.pick(random)
+				start := time.Now()
+				err := r.do(op)
+				r.stats.record(op, time.Since(start), err)
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	close(done)
+}
+
+func (r *runner) do(op string) error {
+	switch op {
+	case opCreate:
+		return r.create()
+	case opAuthenticate:
+		return r.authenticate()
+	default:
+		return r.verify()
+	}
+}
+
+func (r *runner) create() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	n := atomic.AddUint64(&r.sequence, 1)
+	_, err := r.client.CreateUser(ctx, &pbsvc.UserRequest{User: &pblib.User{
+		FirstName:    "Load",
+		LastName:     "Test",
+		Email:        fmt.Sprintf("loadtest+%d.%d@hwsc.com", time.Now().UnixNano(), n),
+		Password:     "LoadTest",
+		Organization: "hwsc loadtest",
+	}})
+
+	return err
+}
+
+func (r *runner) authenticate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	response, err := r.client.AuthenticateUser(ctx, &pbsvc.UserRequest{User: &pblib.User{
+		Email:    r.email,
+		Password: r.password,
+	}})
+	if err != nil {
+		return err
+	}
+	r.token.Store(response.GetIdentification().GetToken())
+
+	return nil
+}
+
+func (r *runner) verify() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	token, _ := r.token.Load().(string)
+	_, err := r.client.VerifyAuthToken(ctx, &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: token},
+	})
+
+	return err
+}
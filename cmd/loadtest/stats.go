@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mix is a list of operations with their relative weights
+type mix []weightedOp
+
+type weightedOp struct {
+	op     string
+	weight int
+}
+
+// parseMix parses "create=1,authenticate=4,verify=15".
+func parseMix(s string) (mix, error) {
+	var m mix
+	total := 0
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid mix entry %q", part)
+		}
+
+		op := kv[0]
+		if op != opCreate && op != opAuthenticate && op != opVerify {
+			return nil, fmt.Errorf("unknown operation %q", op)
+		}
+
+		weight, err := strconv.Atoi(kv[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight for %q", op)
+		}
+
+		m = append(m, weightedOp{op: op, weight: weight})
+		total += weight
+	}
+
+	if total == 0 {
+		return nil, fmt.Errorf("mix %q has no weight", s)
+	}
+
+	return m, nil
+}
+
+func (m mix) weight(op string) int {
+	for _, w := range m {
+		if w.op == op {
+			return w.weight
+		}
+	}
+	return 0
+}
+
+func (m mix) pick(random *rand.Rand) string {
+	total := 0
+	for _, w := range m {
+		total += w.weight
+	}
+
+	n := random.Intn(total)
+	for _, w := range m {
+		if n < w.weight {
+			return w.op
+		}
+		n -= w.weight
+	}
+
+	return m[len(m)-1].op
+}
+
+// stats collects latencies and error counts per operation
+type stats struct {
+	lock      sync.Mutex
+	ops       []string
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func newStats(ops ...string) *stats {
+	s := &stats{ops: ops}
+	s.reset()
+	return s
+}
+
+func (s *stats) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.latencies = make(map[string][]time.Duration)
+	s.errors = make(map[string]int)
+}
+
+func (s *stats) record(op string, latency time.Duration, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.latencies[op] = append(s.latencies[op], latency)
+	if err != nil {
+		s.errors[op]++
+	}
+}
+
+// report formats count, errors, throughput and p50/p90/p99/max latencies per operation.
+func (s *stats) report(elapsed time.Duration) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-13s %8s %7s %9s %10s %10s %10s %10s\n",
+		"rpc", "count", "errors", "rps", "p50", "p90", "p99", "max")
+	for _, op := range s.ops {
+		latencies := append([]time.Duration(nil), s.latencies[op]...)
+		if len(latencies) == 0 {
+			continue
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+		fmt.Fprintf(&b, "%-13s %8d %7d %9.1f %10s %10s %10s %10s\n",
+			op, len(latencies), s.errors[op], float64(len(latencies))/elapsed.Seconds(),
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99),
+			latencies[len(latencies)-1])
+	}
+
+	return b.String()
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1].Round(time.Microsecond)
+}
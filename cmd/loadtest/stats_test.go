@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMix(t *testing.T) {
+	cases := []struct {
+		desc     string
+		input    string
+		isExpErr bool
+	}{
+		{"test default mix", "create=1,authenticate=4,verify=15", false},
+		{"test spaces and zero weight", "create=0, verify=1", false},
+		{"test missing weight", "create", true},
+		{"test unknown operation", "delete=1", true},
+		{"test negative weight", "create=-1", true},
+		{"test no weight", "create=0,verify=0", true},
+	}
+
+	for _, c := range cases {
+		m, err := parseMix(c.input)
+		if c.isExpErr {
+			assert.NotNil(t, err, c.desc)
+			assert.Nil(t, m, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.NotEmpty(t, m, c.desc)
+		}
+	}
+}
+
+func TestMixPick(t *testing.T) {
+	m, err := parseMix("create=0,authenticate=1,verify=3")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, m.weight(opVerify))
+
+	counts := make(map[string]int)
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 4000; i++ {
+		counts[m.pick(random)]++
+	}
+
+	assert.Equal(t, 0, counts[opCreate])
+	assert.InDelta(t, 1000, counts[opAuthenticate], 150)
+	assert.InDelta(t, 3000, counts[opVerify], 150)
+}
+
+func TestPercentile(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1; i <= 100; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	assert.Equal(t, time.Duration(0), percentile(nil, 50))
+	assert.Equal(t, 50*time.Millisecond, percentile(latencies, 50))
+	assert.Equal(t, 99*time.Millisecond, percentile(latencies, 99))
+	assert.Equal(t, time.Millisecond, percentile(latencies, 0))
+	assert.Equal(t, time.Millisecond, percentile(latencies[:1], 99))
+}
+
+func TestStatsReport(t *testing.T) {
+	s := newStats(opCreate, opVerify)
+	s.record(opVerify, time.Millisecond, nil)
+	s.record(opVerify, 3*time.Millisecond, errors.New("unauthenticated"))
+
+	report := s.report(time.Second)
+	lines := strings.Split(strings.TrimSpace(report), "\n")
+	assert.Len(t, lines, 2, "operations without samples are omitted")
+	assert.Equal(t, []string{"verify", "2", "1", "2.0", "1ms", "3ms", "3ms", "3ms"}, strings.Fields(lines[1]))
+
+	s.reset()
+	assert.Len(t, strings.Split(strings.TrimSpace(s.report(time.Second)), "\n"), 1)
+}
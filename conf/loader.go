@@ -0,0 +1,107 @@
+package conf
+
+import (
+	"github.com/micro/go-config"
+	"github.com/micro/go-config/source"
+	"github.com/micro/go-config/source/env"
+	"github.com/micro/go-config/source/file"
+	"os"
+)
+
+// section is a struct of the configuration, read from the hosts_<key>_* env vars
+type section struct {
+	key   string
+	name  string
+	value interface{}
+}
+
+const (
+	// configFileVariable names a json, yaml or toml file of the configuration, laid out like the env vars such as
+	// {"hosts": {"postgres": {"host": "localhost"}}}. Env vars take precedence over the file.
+	configFileVariable = "HWSC_USER_SVC_CONFIG"
+)
+
+var (
+	// sections are scanned at startup in order
+	sections = []section{
+		{"user", "grpc", &GRPCHost},
+		{"postgres", "psql", &UserDB},
+		{"smtp", "smtp email", &EmailHost},
+		{"dummy", "dummy account", &DummyAccount},
+		{"mailinglist", "mailing list", &MailingListHost},
+		{"events", "event sink", &EventSinkHost},
+		{"cache", "cache", &Caches},
+		{"redis", "redis", &UserCacheHost},
+		{"validation", "validation", &Validation},
+		{"secret", "secret rotation", &SecretRotation},
+		{"emailchange", "email change", &EmailChange},
+		{"auth", "auth", &Auth},
+		{"debounce", "debounce", &Debounce},
+		{"retention", "retention", &Retention},
+		{"billing", "billing", &BillingHost},
+		{"analytics", "analytics", &AnalyticsHost},
+		{"region", "region", &Region},
+		{"schema", "schema compatibility", &SchemaCompat},
+		{"faults", "fault injection", &Faults},
+		{"geoip", "geoip", &GeoIPHost},
+		{"password", "password expiry", &PasswordExpiry},
+		{"documents", "document", &Documents},
+		{"tls", "tls", &TLS},
+		{"dbpool", "db pool", &DBPool},
+		{"dbretry", "db retry", &DBRetry},
+		{"dbreplicas", "db replica", &DBReplicas},
+		{"emailqueue", "email queue", &EmailQueue},
+		{"templates", "email template", &EmailTemplates},
+		{"verification", "verification", &Verification},
+		{"password", "password policy", &PasswordPolicy},
+		{"email", "email provider", &EmailDelivery},
+		{"export", "export", &Export},
+		{"ratelimit", "rate limit", &RateLimit},
+		{"log", "log", &Log},
+	}
+)
+
+// newConfig loads the file named by HWSC_USER_SVC_CONFIG, if set, then the env vars over it.
+// Returns an error if the file cannot be read or parsed.
+func newConfig() (config.Config, error) {
+	sources := []source.Source{}
+	if path := os.Getenv(configFileVariable); path != "" {
+		sources = append(sources, file.NewSource(file.WithPath(path)))
+	}
+
+	// convert environment variables to json format
+	sources = append(sources, env.NewSource(env.WithPrefix(environmentVariablePrefix)))
+
+	c := config.NewConfig()
+	if err := c.Load(sources...); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload reads the configuration again and replaces Log and RateLimit, the settings applied without a restart.
+// Every other setting keeps its value from startup. Env vars of a running process do not change, Reload picks
+// up the edits of the config file.
+// Returns an error if the configuration cannot be read, Log and RateLimit are left unchanged.
+func Reload() error {
+	c, err := newConfig()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var log LogRules
+	if err := c.Get(environmentVariablePrefix, "log").Scan(&log); err != nil {
+		return err
+	}
+
+	var rateLimit RateLimitRules
+	if err := c.Get(environmentVariablePrefix, "ratelimit").Scan(&rateLimit); err != nil {
+		return err
+	}
+
+	Log, RateLimit = log, rateLimit
+	return nil
+}
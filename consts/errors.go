@@ -30,6 +30,93 @@ const (
 	MsgErrDeletingEmailToken        string = "failed to delete email token:"
 	MsgErrRetrieveEmailTokenRow     string = "failed to retrieve matched email token row"
 	MsgErrUpdatePermLevel           string = "failed to update permission level of user:"
+	MsgErrSyncMailingList           string = "failed to sync user with mailing list:"
+	MsgErrUpdateMarketingOptIn      string = "failed to update marketing opt-in of user:"
+	MsgErrPublishEvent              string = "failed to publish lifecycle event:"
+	MsgErrPersistEvent              string = "failed to persist lifecycle event:"
+	MsgErrReplayEvents              string = "failed to replay lifecycle events:"
+	MsgErrSetResponseHeader         string = "failed to set response header:"
+	MsgErrVerifyEmailToken          string = "failed to verify email token:"
+	MsgErrUserCache                 string = "user cache error:"
+	MsgErrRefreshVerifier           string = "failed to refresh cached secrets and revocations:"
+	MsgErrRevokeAuthTokens          string = "failed to revoke auth tokens:"
+	MsgErrGetUserStats              string = "failed to get user stats:"
+	MsgErrParentalConsent           string = "failed to request parental consent:"
+	MsgErrVerifyParentalConsent     string = "failed to verify parental consent:"
+	MsgErrApplyRetention            string = "failed to apply retention rule:"
+	MsgErrRecordUsage               string = "failed to record seat usage:"
+	MsgErrReportUsage               string = "failed to report seat usage:"
+	MsgErrGetUsageReport            string = "failed to get usage report:"
+	MsgErrRecordEmailDelivery       string = "failed to record email delivery:"
+	MsgErrGetReferralStats          string = "failed to get referral stats:"
+	MsgErrSetOnboardingStep         string = "failed to set onboarding step:"
+	MsgErrGetOnboardingState        string = "failed to get onboarding state:"
+	MsgErrNotificationPreferences   string = "notification preferences error:"
+	MsgErrQueryAdminActivity        string = "failed to query admin activity:"
+	MsgErrRecordAdminAction         string = "failed to record admin action:"
+	MsgErrRecordAudit               string = "failed to record audit entry:"
+	MsgErrGetAuditLog               string = "failed to get audit log:"
+	MsgErrRestoreUser               string = "failed to restore user:"
+	MsgErrVerifyUser                string = "failed to verify user:"
+	MsgErrForgetUser                string = "failed to forget user:"
+	MsgErrDeleteOrganizationUsers   string = "failed to delete users of organization:"
+	MsgErrRequestEmailChange        string = "failed to request email change confirmation:"
+	MsgErrConfirmEmailChange        string = "failed to confirm email change:"
+	MsgErrCancelEmailChange         string = "failed to cancel email change:"
+	MsgErrExportAnalytics           string = "failed to export analytics dataset:"
+	MsgErrLinkAuthMethod            string = "failed to link auth method:"
+	MsgErrListAuthMethods           string = "failed to list auth methods:"
+	MsgErrUnlinkAuthMethod          string = "failed to unlink auth method:"
+	MsgErrEnableTwoFactor           string = "failed to enable two-factor authentication:"
+	MsgErrVerifyTwoFactor           string = "failed to verify two-factor authentication:"
+	MsgErrDisableTwoFactor          string = "failed to disable two-factor authentication:"
+	MsgErrCheckTwoFactor            string = "failed to check two-factor code:"
+	MsgErrCreateAPIKey              string = "failed to create api key:"
+	MsgErrRevokeAPIKey              string = "failed to revoke api key:"
+	MsgErrListAPIKeys               string = "failed to list api keys:"
+	MsgErrVerifyAPIKey              string = "failed to verify api key:"
+	MsgErrLookupLoginCountry        string = "failed to look up login country:"
+	MsgErrRecordLoginCountry        string = "failed to record login country:"
+	MsgErrSendSecurityAlert         string = "failed to send security alert:"
+	MsgErrConfirmLoginCountry       string = "failed to confirm login country:"
+	MsgErrCheckPasswordExpiry       string = "failed to check password expiry:"
+	MsgErrRemindPasswordExpiry      string = "failed to send password expiry reminder:"
+	MsgErrGetProfileHistory         string = "failed to get profile history:"
+	MsgErrFavoriteDocument          string = "failed to favorite document:"
+	MsgErrListFavorites             string = "failed to list favorite documents:"
+	MsgErrUnfavoriteDocument        string = "failed to unfavorite document:"
+	MsgErrRegisterDocument          string = "failed to register document:"
+	MsgErrUnregisterDocument        string = "failed to unregister document:"
+	MsgErrGetDocumentQuota          string = "failed to get document quota:"
+	MsgErrSetDocumentPublic         string = "failed to set document visibility:"
+	MsgErrListPublicDocuments       string = "failed to list public documents:"
+	MsgErrListUserDocuments         string = "failed to list user documents:"
+	MsgErrSetSharePolicy            string = "failed to set share policy:"
+	MsgErrRequestPasswordReset      string = "failed to request password reset:"
+	MsgErrResetPassword             string = "failed to reset password:"
+	MsgErrResendVerificationEmail   string = "failed to resend verification email:"
+	MsgErrIssueRefreshToken         string = "failed to issue refresh token:"
+	MsgErrRefreshAuthToken          string = "failed to refresh auth token:"
+	MsgErrLogoutUser                string = "failed to log out user:"
+	MsgErrRotateSecret              string = "failed to rotate auth secret:"
+	MsgErrGetSharePolicy            string = "failed to get share policy:"
+	MsgErrRecordPresence            string = "failed to record last seen timestamp:"
+	MsgErrGetLastSeen               string = "failed to get last seen timestamp:"
+	MsgErrGetUserNames              string = "failed to get user names:"
+	MsgErrListUsers                 string = "failed to list users:"
+	MsgErrStreamUsers               string = "failed to stream users:"
+	MsgErrShareDocument             string = "failed to share document:"
+	MsgErrUnshareDocument           string = "failed to unshare document:"
+	MsgErrListSharedWithMe          string = "failed to list documents shared with user:"
+	MsgErrGetMigrationVersion       string = "failed to get migration version:"
+	MsgErrDeliverEmail              string = "failed to deliver queued email:"
+	MsgErrEmailDeadLetter           string = "gave up delivering queued email:"
+	MsgErrCreateOrganization        string = "failed to create organization:"
+	MsgErrGetOrganization           string = "failed to get organization:"
+	MsgErrListOrganizationUsers     string = "failed to list organization users:"
+	MsgErrSetOrganizationAdmin      string = "failed to set organization admin:"
+	MsgErrLookupEmailDomain         string = "failed to look up email domain:"
+	MsgErrUnmappedPostgres          string = "unmapped postgres error:"
 )
 
 var (
@@ -39,14 +126,118 @@ var (
 	ErrNilRequest                   = errors.New("nil request object")
 	ErrNilRequestUser               = errors.New("nil request User")
 	ErrNilRequestIdentification     = errors.New("nil request identification")
+	ErrInvalidRequestFields         = errors.New("invalid request fields")
 	ErrEmptyRequestUser             = errors.New("empty fields in request User")
 	ErrInvalidUserFirstName         = errors.New("invalid User first name")
 	ErrInvalidUserLastName          = errors.New("invalid User last name")
+	ErrInvalidUserMiddleName        = errors.New("invalid User middle name")
+	ErrInvalidUserDisplayName       = errors.New("invalid User display name")
 	ErrInvalidUserEmail             = errors.New("invalid User email")
+	ErrUndeliverableEmailDomain     = errors.New("User email domain does not accept email")
 	ErrInvalidPassword              = errors.New("invalid User password")
+	ErrPasswordTooLong              = errors.New("User password exceeds 72 bytes")
+	ErrPasswordTooShort             = errors.New("User password is shorter than the minimum length")
+	ErrPasswordMissingLower         = errors.New("User password requires a lower case letter")
+	ErrPasswordMissingUpper         = errors.New("User password requires an upper case letter")
+	ErrPasswordMissingDigit         = errors.New("User password requires a digit")
+	ErrPasswordMissingSymbol        = errors.New("User password requires a symbol")
+	ErrPasswordCommon               = errors.New("User password is a commonly used password")
+	ErrPasswordTooWeak              = errors.New("User password is too easy to guess")
+	ErrInvalidCronSchedule          = errors.New("invalid cron schedule")
+	ErrInvalidRetentionPeriod       = errors.New("invalid retention period")
+	ErrInvalidSchemaPhase           = errors.New("invalid schema compatibility phase")
+	ErrInvalidPasswordMaxAge        = errors.New("invalid password max age")
+	ErrInvalidFaultInjection        = errors.New("invalid fault injection rate or latency")
+	ErrInjectedFault                = errors.New("injected fault")
+	ErrInjectedSMTPFailure          = errors.New("injected smtp failure")
+	ErrInvalidStartup               = errors.New("invalid email templates or configuration")
+	ErrInvalidClientCA              = errors.New("client ca file has no PEM certificates")
+	ErrInvalidClearField            = errors.New("field cannot be cleared")
+	ErrConflictingClearField        = errors.New("field cannot be both cleared and updated")
+	ErrInvalidMissingUserMode       = errors.New("invalid missing user mode")
+	ErrInvalidUserView              = errors.New("invalid user view")
+	ErrInvalidStatsDays             = errors.New("invalid stats days")
+	ErrInvalidUsageReportRange      = errors.New("invalid usage report date range")
+	ErrInvalidBirthdate             = errors.New("invalid birthdate")
+	ErrInvalidReferralCode          = errors.New("invalid referral code")
+	ErrInvalidOnboardingStep        = errors.New("invalid onboarding step")
+	ErrInvalidOnboardingCompleted   = errors.New("invalid onboarding completed value")
+	ErrTooManyOnboardingSteps       = errors.New("too many onboarding steps")
+	ErrInvalidNotificationSetting   = errors.New("invalid notification preference")
+	ErrInvalidActivityRange         = errors.New("invalid admin activity time range")
+	ErrInvalidAuthMethod            = errors.New("invalid auth method")
+	ErrInvalidCredentialID          = errors.New("invalid auth method credential id")
+	ErrAuthMethodLinked             = errors.New("credential is already linked to an account")
+	ErrAuthMethodNotFound           = errors.New("auth method is not linked to the account")
+	ErrLastAuthMethod               = errors.New("the last auth method of an account cannot be unlinked")
+	ErrLastSignInMethod             = errors.New("the password cannot be unlinked without another method to sign in with")
+	ErrInvalidTOTPKey               = errors.New("invalid totp secret encryption key")
+	ErrTwoFactorUnavailable         = errors.New("two-factor authentication is not configured")
+	ErrTwoFactorEnabled             = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotPending          = errors.New("no pending two-factor enrollment, call Enable2FA first")
+	ErrTwoFactorNotEnabled          = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorRequired            = errors.New("a two-factor code is required to sign in")
+	ErrInvalidTwoFactorCode         = errors.New("invalid or already used two-factor code")
+	ErrInvalidAPIKey                = errors.New("invalid or revoked api key")
+	ErrInvalidAPIKeyID              = errors.New("invalid api key id")
+	ErrInvalidAPIKeyName            = errors.New("invalid api key name")
+	ErrInvalidAPIKeyScope           = errors.New("invalid api key scope")
+	ErrAPIKeyNotFound               = errors.New("api key is not found or already revoked")
+	ErrAPIKeyScopeDenied            = errors.New("api key is not scoped for the method")
+	ErrInvalidDuid                  = errors.New("invalid document duid")
+	ErrDocumentNotFound             = errors.New("document is not found or not shared with the user")
+	ErrFavoriteNotFound             = errors.New("document is not a favorite of the user")
+	ErrTooManyFavorites             = errors.New("too many favorite documents")
+	ErrInvalidDocumentQuota         = errors.New("invalid document quota")
+	ErrInvalidDBPool                = errors.New("invalid db connection pool limits")
+	ErrEmailProviderFailed          = errors.New("email provider request failed")
+	ErrInvalidDocumentVisibility    = errors.New("invalid document public value")
+	ErrDocumentExists               = errors.New("document is registered to another user")
+	ErrDocumentQuotaExceeded        = errors.New("document quota exceeded")
+	ErrInvalidSharePolicy           = errors.New("invalid share policy")
+	ErrInvalidPageToken             = errors.New("invalid page token")
+	ErrInvalidVerifiedFilter        = errors.New("invalid is verified filter")
+	ErrInvalidCreatedDateRange      = errors.New("invalid created date range")
+	ErrInvalidShareRecipients       = errors.New("invalid uuids to share duid")
+	ErrSessionIdle                  = errors.New("auth token expired after inactivity")
+	ErrTokenIssuerMismatch          = errors.New("auth token issuer is not accepted")
+	ErrTokenAudienceMismatch        = errors.New("auth token audience is not accepted")
+	ErrTokenNotYetValid             = errors.New("auth token is issued in the future")
+	ErrRetiredAuthSecret            = errors.New("auth token is signed with a retired secret")
+	ErrNoMatchingRefreshToken       = errors.New("no matching refresh token were found with given token")
+	ErrExpiredRefreshToken          = errors.New("refresh token is expired, sign in again")
+	ErrLoginCountryUnconfirmed      = errors.New("sign in from a new country must be confirmed, follow the link in the security alert email")
+	ErrExpiredLoginCountryToken     = errors.New("login country confirmation token is expired")
+	ErrNoMatchingLoginCountryToken  = errors.New("no matching login country confirmation token were found with given token")
+	ErrPasswordExpired              = errors.New("password expired, reset it to sign in")
+	ErrExpiredPasswordResetToken    = errors.New("password reset token is expired")
+	ErrNoMatchingPasswordReset      = errors.New("no matching password reset token were found with given token")
+	ErrVerificationResendCooldown   = errors.New("a verification email was sent recently, retry later")
+	ErrExpiredEmailChangeToken      = errors.New("email change token is expired, change the email again")
+	ErrNoMatchingEmailChange        = errors.New("no pending email change matches the given token")
+	ErrInvalidParentEmail           = errors.New("invalid parent email")
+	ErrParentalConsentRequired      = errors.New("parental consent is required before signing in")
+	ErrExpiredParentalConsentToken  = errors.New("parental consent token is expired")
+	ErrNoMatchingParentalConsent    = errors.New("no matching parental consent token were found with given token")
 	ErrInvalidUserOrganization      = errors.New("invalid User organization")
+	ErrInvalidPermissionLevel       = errors.New("invalid User permission level")
+	ErrPermissionChangeDenied       = errors.New("only an admin token may change the permission level of a User")
+	ErrMissingAuthorization         = errors.New("missing authorization token")
+	ErrCallerNotAllowed             = errors.New("only the User itself or an admin may modify a User")
+	ErrOrganizationNotAllowed       = errors.New("User organization is not allowed")
+	ErrOrganizationExists           = errors.New("organization already exists")
+	ErrOrganizationNotFound         = errors.New("organization is not found in database")
+	ErrNotOrganizationMember        = errors.New("only members of an organization may administer it")
+	ErrNotOrganizationAdmin         = errors.New("only an admin or an admin of the organization may manage it")
+	ErrInvalidOrganizationAdmin     = errors.New("invalid organization admin value")
+	ErrInvalidDryRun                = errors.New("invalid dry run value")
+	ErrInvalidChunkSize             = errors.New("invalid chunk size")
+	ErrRateLimited                  = errors.New("too many requests, retry later")
+	ErrInvalidRateLimit             = errors.New("invalid rate limit")
+	ErrInvalidLogLevel              = errors.New("invalid log level")
 	ErrEmailMainTemplateNotProvided = errors.New("email main template not provided")
-	ErrEmailNilFilePaths            = errors.New("nil email template file paths")
+	ErrEmailNilTemplate             = errors.New("nil email template")
+	ErrEmailTemplateNotFound        = errors.New("email template not found")
 	ErrEmailRequestFieldsEmpty      = errors.New("empty or nil fields in emailRequest struct")
 	ErrUUIDNotFound                 = errors.New("uuid does not exist in database")
 	ErrUserNotFound                 = errors.New("user is not found in database")
@@ -59,7 +250,28 @@ var (
 	ErrMismatchingEmailToken        = errors.New("email tokens do not match")
 	ErrInvalidAddTime               = errors.New("add time is zero")
 	ErrEmailExists                  = errors.New("email already exists")
+	ErrEmailReserved                = errors.New("email is reserved by another pending email change")
 	ErrEmailDoesNotExist            = errors.New("email does not exist in db")
+	ErrEmailNotVerified             = errors.New("User email is not verified, follow the link in the verification email or request a new one")
+	ErrMailingListDisabled          = errors.New("mailing list provider is not configured")
+	ErrMailingListRequestFailed     = errors.New("mailing list provider rejected request")
+	ErrInvalidMarketingOptIn        = errors.New("invalid marketing opt-in")
+	ErrEventSinkDisabled            = errors.New("event sink is not configured")
+	ErrEventSinkRequestFailed       = errors.New("event sink rejected request")
+	ErrBillingRequestFailed         = errors.New("billing endpoint rejected request")
+	ErrAnalyticsRequestFailed       = errors.New("analytics endpoint rejected request")
+	ErrGeoIPRequestFailed           = errors.New("geoip provider rejected request")
+	ErrNilEvent                     = errors.New("nil lifecycle event")
+	ErrInvalidReplaySequence        = errors.New("invalid replay sequence")
+	ErrInvalidReplayTimestamp       = errors.New("invalid replay timestamp")
+	ErrInvalidReplayLimit           = errors.New("invalid replay limit")
+	ErrReplayNotAllowed             = errors.New("only an admin or a service api key may replay events")
+	ErrDuplicateValue               = errors.New("value already exists")
+	ErrReferencedRowMissing         = errors.New("referenced row does not exist")
+	ErrInvalidValue                 = errors.New("value violates database constraints")
+	ErrConflictingTransaction       = errors.New("conflicting concurrent update, retry the request")
+	ErrDatabaseFailure              = errors.New("database error")
+	ErrStandbyInstance              = errors.New("instance is a standby, send writes to the primary region")
 	ResponseServiceUnavailable      = &pbsvc.UserResponse{
 		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.Unavailable)},
 		Message: codes.Unavailable.String(),
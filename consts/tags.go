@@ -5,13 +5,60 @@ const (
 	UpdatingUserRowTag  string = "UpdateUserRow -"
 	AuthenticateUserTag string = "AuthenticateUser -"
 	CreateUserTag       string = "CreateUser -"
+	CreateUsersTag      string = "CreateUsers -"
 	DeleteUserTag       string = "DeleteUser -"
 	UpdateUserTag       string = "UpdateUser -"
 	GetUserTag          string = "GetUser -"
+	ListUsersTag        string = "ListUsers -"
+	StreamUsersTag      string = "StreamUsers -"
+	ShareDocumentTag    string = "ShareDocument -"
 	UserServiceTag      string = "User Service -"
 	GetNewAuthTokenTag  string = "GetNewAuthToken -"
 	MakeNewAuthSecret   string = "MakeNewAuthSecret -"
 	GetAuthSecret       string = "GetAuthSecret -"
 	VerifyAuthToken     string = "VerifyAuthToken -"
 	PSQL                string = "PSQL -"
+	MailingListTag      string = "MailingList -"
+	EventsTag           string = "Events -"
+	ReplayEventsTag     string = "ReplayEvents -"
+	UserCacheTag        string = "UserCache -"
+	ValidationTag       string = "Validation -"
+	DebounceTag         string = "Debounce -"
+	GetUserStatsTag     string = "GetUserStats -"
+	ParentalConsentTag  string = "ParentalConsent -"
+	RetentionTag        string = "Retention -"
+	BillingTag          string = "Billing -"
+	GetUsageReportTag   string = "GetUsageReport -"
+	GetReferralStatsTag string = "GetReferralStats -"
+	OnboardingTag       string = "Onboarding -"
+	NotificationTag     string = "Notification -"
+	AdminActivityTag    string = "AdminActivity -"
+	AnalyticsTag        string = "Analytics -"
+	RegionTag           string = "Region -"
+	FaultsTag           string = "Faults -"
+	DeprecationTag      string = "Deprecation -"
+	AuthMethodTag       string = "AuthMethod -"
+	TwoFactorTag        string = "TwoFactor -"
+	APIKeyTag           string = "APIKey -"
+	LoginCountryTag     string = "LoginCountry -"
+	PasswordExpiryTag   string = "PasswordExpiry -"
+	PasswordResetTag    string = "PasswordReset -"
+	TLSTag              string = "TLS -"
+	RefreshTokenTag     string = "RefreshToken -"
+	CallerTag           string = "Caller -"
+	AuditTag            string = "Audit -"
+	RestoreUserTag      string = "RestoreUser -"
+	VerifyUserTag       string = "VerifyUser -"
+	ForgetUserTag       string = "ForgetUser -"
+	EmailChangeTag      string = "EmailChange -"
+	ProfileHistoryTag   string = "ProfileHistory -"
+	FavoritesTag        string = "Favorites -"
+	DocumentsTag        string = "Documents -"
+	MigrationTag        string = "Migration -"
+	EmailQueueTag       string = "EmailQueue -"
+	ResendVerifyTag     string = "ResendVerification -"
+	LogoutTag           string = "Logout -"
+	SecretRotationTag   string = "SecretRotation -"
+	OrganizationTag     string = "Organization -"
+	RateLimitTag        string = "RateLimit -"
 )
@@ -13,6 +13,25 @@ import (
 func main() {
 	logger.Info(consts.UserServiceTag, "hwsc-user-svc initiating...")
 
+	// fail before accepting requests rather than on the first signup, every problem found is logged
+	if err := svc.CheckStartup(); err != nil {
+		logger.Fatal(consts.UserServiceTag, "Failed startup checks:", err.Error())
+	}
+
+	// pending migrations are applied before serving if hosts_schema_migrate is "true"
+	if err := svc.MigrateSchema(); err != nil {
+		logger.Fatal(consts.UserServiceTag, "Failed to migrate database schema:", err.Error())
+	}
+
+	// emails are queued by the handlers and sent in the background
+	svc.StartEmailQueue()
+
+	// auth secrets are rotated before they expire
+	svc.StartSecretRotation()
+
+	// the log level and rate limits are read again on SIGHUP
+	svc.StartConfigReload()
+
 	// make TCP listener, listen for incoming client requests
 	lis, err := net.Listen(conf.GRPCHost.Network, conf.GRPCHost.String())
 	if err != nil {
@@ -20,11 +39,23 @@ func main() {
 	}
 
 	// implement all our methods/services in service/service.go THEN,
-	// build: create an instance of gRPC server
-	grpcServer := grpc.NewServer()
+	// build: create an instance of gRPC server, requests are validated, authenticated and debounced before
+	// reaching the handlers, streams are authenticated and rate limited
+	// the listener serves TLS if hosts_tls_certfile is set
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(svc.UnaryInterceptor),
+		grpc.StreamInterceptor(svc.StreamInterceptor),
+	}
+	if creds := svc.TransportCredentials(); creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	grpcServer := grpc.NewServer(opts...)
 
 	// register our service implementation with gRPC server
-	pbsvc.RegisterUserServiceServer(grpcServer, &svc.Service{})
+	// every API version is served by the same handlers
+	userService := &svc.Service{}
+	pbsvc.RegisterUserServiceServer(grpcServer, userService)
+	svc.RegisterUserServiceV2(grpcServer, userService)
 	logger.Info(consts.UserServiceTag, "hwsc-user-svc started at:", conf.GRPCHost.String())
 
 	// start gRPC server
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"strconv"
+	"time"
+)
+
+// adminAction is a call authorized with an admin token, see authorizeAdmin
+type adminAction struct {
+	sequence  int64
+	actor     string
+	action    string
+	subject   string
+	timestamp time.Time
+}
+
+const (
+	// defaultActivityPeriod covers a quarter, QueryAdminActivity is run for quarterly reviews
+	defaultActivityPeriod = 92 * 24 * time.Hour
+
+	defaultActivityLimit = 1000
+	maxActivityLimit     = 5000
+)
+
+// adminActivityCSVHeader names the columns written by writeAdminActivityCSV
+var adminActivityCSVHeader = []string{"sequence", "timestamp", "actor", "action", "subject"}
+
+// parseActivityRange returns the from and to timestamps of an admin activity query, either may be zero.
+// to defaults to now and from to defaultActivityPeriod before to.
+// Returns ErrInvalidActivityRange if from is not before to.
+func parseActivityRange(from time.Time, to time.Time, now time.Time) (time.Time, time.Time, error) {
+	if to.IsZero() {
+		to = now
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultActivityPeriod)
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, consts.ErrInvalidActivityRange
+	}
+
+	return from, to, nil
+}
+
+// writeAdminActivityCSV returns actions as a CSV document with a header row, timestamps are RFC 3339 in UTC.
+func writeAdminActivityCSV(actions []*adminAction) (string, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+
+	if err := writer.Write(adminActivityCSVHeader); err != nil {
+		return "", err
+	}
+	for _, action := range actions {
+		record := []string{
+			strconv.FormatInt(action.sequence, 10),
+			action.timestamp.UTC().Format(time.RFC3339),
+			action.actor,
+			action.action,
+			action.subject,
+		}
+		if err := writer.Write(record); err != nil {
+			return "", err
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
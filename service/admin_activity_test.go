@@ -0,0 +1,60 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseActivityRange(t *testing.T) {
+	now := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		desc     string
+		from     time.Time
+		to       time.Time
+		expFrom  time.Time
+		expTo    time.Time
+		isExpErr bool
+	}{
+		{"test defaults", time.Time{}, time.Time{}, now.Add(-defaultActivityPeriod), now, false},
+		{"test from only", now.AddDate(-1, 0, 0), time.Time{}, now.AddDate(-1, 0, 0), now, false},
+		{"test to only", time.Time{}, now.AddDate(0, -1, 0), now.AddDate(0, -1, 0).Add(-defaultActivityPeriod),
+			now.AddDate(0, -1, 0), false},
+		{"test from equals to", now, now, time.Time{}, time.Time{}, true},
+		{"test from after to", now, now.Add(-time.Second), time.Time{}, time.Time{}, true},
+	}
+
+	for _, c := range cases {
+		from, to, err := parseActivityRange(c.from, c.to, now)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidActivityRange.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+		assert.Equal(t, c.expFrom, from, c.desc)
+		assert.Equal(t, c.expTo, to, c.desc)
+	}
+}
+
+func TestWriteAdminActivityCSV(t *testing.T) {
+	desc := "test header only"
+	document, err := writeAdminActivityCSV(nil)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "sequence,timestamp,actor,action,subject\n", document, desc)
+
+	desc = "test actions are quoted as needed"
+	document, err = writeAdminActivityCSV([]*adminAction{
+		{
+			sequence:  7,
+			actor:     "0000xsnjg0mqjhbf4qx1efd6y3",
+			action:    "GetUsageReport",
+			subject:   `Whale, "Inc"`,
+			timestamp: time.Date(2019, 7, 1, 8, 0, 0, 0, time.FixedZone("PDT", -7*60*60)),
+		},
+	})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "sequence,timestamp,actor,action,subject\n"+
+		`7,2019-07-01T15:00:00Z,0000xsnjg0mqjhbf4qx1efd6y3,GetUsageReport,"Whale, ""Inc"""`+"\n", document, desc)
+}
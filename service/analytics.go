@@ -0,0 +1,237 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"net/http"
+	"time"
+)
+
+// analyticsAccount is the subset of an account the analytics export reads, it holds no personal data
+// other than identifiers, which never leave the service unhashed
+type analyticsAccount struct {
+	uuid              string
+	organization      string
+	organizationUsers int64
+	created           time.Time
+	verified          bool
+	permissionLevel   string
+	referrer          string
+}
+
+// analyticsUser is the pseudonymized record of one user.
+// User, Organization and ReferredBy are keyed hashes, stable across exports so datasets can be joined,
+// SignupWeek is the Monday (UTC) of the week the user signed up and OrganizationSize is a range.
+type analyticsUser struct {
+	User             string `json:"user"`
+	Organization     string `json:"organization"`
+	OrganizationSize string `json:"organization_size"`
+	SignupWeek       string `json:"signup_week"`
+	Verified         bool   `json:"verified"`
+	PermissionLevel  string `json:"permission_level"`
+	ReferredBy       string `json:"referred_by"`
+}
+
+// analyticsDataset is every user on Day (UTC), users without an organization or referrer have them empty
+type analyticsDataset struct {
+	Day   string           `json:"day"`
+	Users []*analyticsUser `json:"users"`
+}
+
+// analyticsExporter hands datasets to the analytics team
+type analyticsExporter interface {
+	export(ctx context.Context, dataset *analyticsDataset) error
+}
+
+// httpAnalyticsExporter POSTs a dataset as a JSON object
+type httpAnalyticsExporter struct {
+	address string
+	client  *http.Client
+}
+
+const (
+	// defaultAnalyticsSchedule exports daily at 2:30 AM
+	defaultAnalyticsSchedule = "30 2 * * *"
+	defaultAnalyticsTimezone = "UTC"
+
+	analyticsExportTimeout = time.Minute
+
+	// pseudonyms are truncated to 128 bits, collisions stay negligible and records stay short
+	analyticsPseudonymLength = 32
+
+	analyticsUserDomain         = "user"
+	analyticsOrganizationDomain = "organization"
+)
+
+var (
+	// analyticsKey is nil when exports are disabled
+	analyticsKey      []byte
+	analyticsSchedule *cronSchedule
+
+	// organizationSizes are the lower bounds of the organization size ranges, a bound per range
+	organizationSizes = []int64{1, 10, 50, 250, 1000}
+)
+
+func init() {
+	// the primary region exports, so each dataset is sent once
+	if conf.AnalyticsHost.Address == "" || conf.AnalyticsHost.Key == "" || isStandby {
+		return
+	}
+	analyticsKey = []byte(conf.AnalyticsHost.Key)
+
+	spec := conf.AnalyticsHost.Schedule
+	if spec == "" {
+		spec = defaultAnalyticsSchedule
+	}
+
+	timezone := conf.AnalyticsHost.Timezone
+	if timezone == "" {
+		timezone = defaultAnalyticsTimezone
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		reportStartupProblem("Invalid analytics timezone:", timezone)
+		return
+	}
+
+	analyticsSchedule, err = parseCronSchedule(spec, location)
+	if err != nil {
+		reportStartupProblem("Invalid analytics schedule:", spec)
+		return
+	}
+
+	go runAnalyticsSchedule(&httpAnalyticsExporter{
+		address: conf.AnalyticsHost.Address,
+		client:  &http.Client{Timeout: analyticsExportTimeout},
+	})
+}
+
+// export returns error if the request fails or the endpoint does not answer with a 2xx status.
+func (e *httpAnalyticsExporter) export(ctx context.Context, dataset *analyticsDataset) error {
+	payload, err := json.Marshal(dataset)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.address, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s: %s", consts.ErrAnalyticsRequestFailed.Error(), resp.Status)
+	}
+
+	return nil
+}
+
+// runAnalyticsSchedule exports a dataset every time analyticsSchedule comes up, it never returns.
+// A failed export is not retried, the next one covers the same users.
+func runAnalyticsSchedule(exporter analyticsExporter) {
+	for {
+		next := analyticsSchedule.next(time.Now())
+		time.Sleep(time.Until(next))
+
+		if err := refreshDBConnection(); err != nil {
+			logger.Error(consts.AnalyticsTag, consts.ErrDBConnectionError.Error())
+			continue
+		}
+
+		if err := exportAnalytics(context.Background(), exporter, analyticsKey, time.Now()); err != nil {
+			logger.Error(consts.AnalyticsTag, consts.MsgErrExportAnalytics, err.Error())
+		}
+	}
+}
+
+// exportAnalytics pseudonymizes every account with key and passes the dataset to exporter.
+// Returns the error of the db or exporter.
+func exportAnalytics(ctx context.Context, exporter analyticsExporter, key []byte, now time.Time) error {
+	accounts, err := getAnalyticsAccounts(ctx)
+	if err != nil {
+		return err
+	}
+
+	dataset := newAnalyticsDataset(key, accounts, now)
+	if err := exporter.export(ctx, dataset); err != nil {
+		return err
+	}
+
+	logger.Info(consts.AnalyticsTag, "Exported", fmt.Sprint(len(dataset.Users)), "users")
+	return nil
+}
+
+// newAnalyticsDataset pseudonymizes accounts with key.
+func newAnalyticsDataset(key []byte, accounts []*analyticsAccount, now time.Time) *analyticsDataset {
+	dataset := &analyticsDataset{
+		Day:   now.UTC().Format(usageDayLayout),
+		Users: make([]*analyticsUser, 0, len(accounts)),
+	}
+
+	for _, account := range accounts {
+		user := &analyticsUser{
+			User:            pseudonymize(key, analyticsUserDomain, account.uuid),
+			SignupWeek:      weekOf(account.created).Format(usageDayLayout),
+			Verified:        account.verified,
+			PermissionLevel: account.permissionLevel,
+		}
+		if account.organization != "" {
+			user.Organization = pseudonymize(key, analyticsOrganizationDomain, account.organization)
+			user.OrganizationSize = organizationSize(account.organizationUsers)
+		}
+		if account.referrer != "" {
+			user.ReferredBy = pseudonymize(key, analyticsUserDomain, account.referrer)
+		}
+		dataset.Users = append(dataset.Users, user)
+	}
+
+	return dataset
+}
+
+// pseudonymize returns the keyed hash of value, domain keeps equal values of different kinds apart.
+func pseudonymize(key []byte, domain string, value string) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(domain + ":" + value))
+
+	return hex.EncodeToString(mac.Sum(nil))[:analyticsPseudonymLength]
+}
+
+// weekOf returns midnight (UTC) of the Monday of the week of t.
+func weekOf(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+	// time.Sunday is 0, Sundays belong to the week that started 6 days earlier
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// organizationSize returns the range of organizationSizes users falls in, e.g. "10-49" or "1000+".
+func organizationSize(users int64) string {
+	for i := len(organizationSizes) - 1; i >= 0; i-- {
+		if users < organizationSizes[i] {
+			continue
+		}
+		if i == len(organizationSizes)-1 {
+			return fmt.Sprintf("%d+", organizationSizes[i])
+		}
+		return fmt.Sprintf("%d-%d", organizationSizes[i], organizationSizes[i+1]-1)
+	}
+
+	return ""
+}
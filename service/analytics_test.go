@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// unitTestAnalyticsExporter keeps the last exported dataset and fails with err if it is set
+type unitTestAnalyticsExporter struct {
+	dataset *analyticsDataset
+	err     error
+}
+
+func (e *unitTestAnalyticsExporter) export(ctx context.Context, dataset *analyticsDataset) error {
+	if e.err != nil {
+		return e.err
+	}
+	e.dataset = dataset
+	return nil
+}
+
+func TestPseudonymize(t *testing.T) {
+	key := []byte("analytics-key")
+	uuid := "01d3x3wm2nnrdxwpvy0eb6mhtk"
+
+	pseudonym := pseudonymize(key, analyticsUserDomain, uuid)
+	assert.Equal(t, analyticsPseudonymLength, len(pseudonym))
+	assert.NotContains(t, pseudonym, uuid)
+
+	desc := "test pseudonyms are stable"
+	assert.Equal(t, pseudonym, pseudonymize(key, analyticsUserDomain, uuid), desc)
+
+	desc = "test pseudonyms depend on the key"
+	assert.NotEqual(t, pseudonym, pseudonymize([]byte("other-key"), analyticsUserDomain, uuid), desc)
+
+	desc = "test pseudonyms depend on the domain"
+	assert.NotEqual(t, pseudonym, pseudonymize(key, analyticsOrganizationDomain, uuid), desc)
+}
+
+func TestWeekOf(t *testing.T) {
+	monday := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		desc  string
+		input time.Time
+	}{
+		{"test monday midnight", monday},
+		{"test wednesday", time.Date(2019, 7, 3, 15, 4, 5, 0, time.UTC)},
+		{"test sunday night", time.Date(2019, 7, 7, 23, 59, 59, 0, time.UTC)},
+		{"test other timezone", time.Date(2019, 7, 8, 1, 0, 0, 0, time.FixedZone("UTC+2", 2*60*60))},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, monday, weekOf(c.input), c.desc)
+	}
+}
+
+func TestOrganizationSize(t *testing.T) {
+	cases := []struct {
+		users   int64
+		expSize string
+	}{
+		{0, ""},
+		{1, "1-9"},
+		{9, "1-9"},
+		{10, "10-49"},
+		{249, "50-249"},
+		{999, "250-999"},
+		{1000, "1000+"},
+		{50000, "1000+"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expSize, organizationSize(c.users), c.users)
+	}
+}
+
+func TestNewAnalyticsDataset(t *testing.T) {
+	key := []byte("analytics-key")
+	now := time.Date(2019, 7, 3, 15, 4, 5, 0, time.UTC)
+	accounts := []*analyticsAccount{
+		{
+			uuid:              "01d3x3wm2nnrdxwpvy0eb6mhtk",
+			organization:      "hwsc",
+			organizationUsers: 12,
+			created:           time.Date(2019, 6, 27, 8, 0, 0, 0, time.UTC),
+			verified:          true,
+			permissionLevel:   "USER",
+		},
+		{
+			uuid:              "01d3x3wm2nnrdxwpvy0eb6mhtm",
+			organizationUsers: 40,
+			created:           now,
+			permissionLevel:   "USER_REGISTRATION",
+			referrer:          "01d3x3wm2nnrdxwpvy0eb6mhtk",
+		},
+	}
+
+	dataset := newAnalyticsDataset(key, accounts, now)
+	assert.Equal(t, "2019-07-03", dataset.Day)
+	assert.Equal(t, []*analyticsUser{
+		{
+			User:             pseudonymize(key, analyticsUserDomain, accounts[0].uuid),
+			Organization:     pseudonymize(key, analyticsOrganizationDomain, "hwsc"),
+			OrganizationSize: "10-49",
+			SignupWeek:       "2019-06-24",
+			Verified:         true,
+			PermissionLevel:  "USER",
+		},
+		{
+			User:            pseudonymize(key, analyticsUserDomain, accounts[1].uuid),
+			SignupWeek:      "2019-07-01",
+			PermissionLevel: "USER_REGISTRATION",
+			ReferredBy:      pseudonymize(key, analyticsUserDomain, accounts[0].uuid),
+		},
+	}, dataset.Users)
+
+	desc := "test referrals can be joined to their referrer"
+	assert.Equal(t, dataset.Users[0].User, dataset.Users[1].ReferredBy, desc)
+}
+
+func TestHTTPAnalyticsExporter(t *testing.T) {
+	dataset := &analyticsDataset{
+		Day:   "2019-07-01",
+		Users: []*analyticsUser{{User: "a", SignupWeek: "2019-07-01", PermissionLevel: "USER"}},
+	}
+
+	var received *analyticsDataset
+	statusCode := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = nil
+		_ = json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(statusCode)
+	}))
+	defer server.Close()
+
+	exporter := &httpAnalyticsExporter{address: server.URL, client: server.Client()}
+
+	desc := "test dataset is posted"
+	assert.Nil(t, exporter.export(context.TODO(), dataset), desc)
+	assert.Equal(t, dataset, received, desc)
+
+	desc = "test non 2xx status fails"
+	statusCode = http.StatusServiceUnavailable
+	assert.EqualError(t, exporter.export(context.TODO(), dataset),
+		consts.ErrAnalyticsRequestFailed.Error()+": 503 Service Unavailable", desc)
+}
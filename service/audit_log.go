@@ -0,0 +1,152 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditEntry is a successful mutation recorded in user_svc.audit_log, see recordAudit
+type auditEntry struct {
+	sequence  int64
+	actor     string
+	action    string
+	target    string
+	metadata  map[string]string
+	timestamp time.Time
+}
+
+const (
+	// audited actions, the rpc methods that made the change
+	auditActionCreateUser           = "CreateUser"
+	auditActionUpdateUser           = "UpdateUser"
+	auditActionDeleteUser           = "DeleteUser"
+	auditActionRestoreUser          = "RestoreUser"
+	auditActionVerifyUser           = "VerifyUser"
+	auditActionForgetUser           = "ForgetUser"
+	auditActionShareDocument        = "ShareDocument"
+	auditActionUnshareDocument      = "UnshareDocument"
+	auditActionRotateSecret         = "RotateAuthSecret"
+	auditActionCreateOrganization   = "CreateOrganization"
+	auditActionSetOrganizationAdmin = "SetOrganizationAdmin"
+	auditActionDeleteOrgUsers       = "DeleteUsersByOrganization"
+	auditActionVerify2FA            = "Verify2FA"
+	auditActionDisable2FA           = "Disable2FA"
+	auditActionCreateAPIKey         = "CreateAPIKey"
+	auditActionRevokeAPIKey         = "RevokeAPIKey"
+
+	// metadataKeyUserAgent is recorded with every audit entry next to x-forwarded-for
+	metadataKeyUserAgent = "user-agent"
+)
+
+var (
+	// auditLogCSVHeader names the columns written by writeAuditLogCSV
+	auditLogCSVHeader = []string{"sequence", "timestamp", "actor", "action", "target", "metadata"}
+
+	// auditExcludedMetadata carry credentials, they are never recorded
+	auditExcludedMetadata = map[string]bool{
+		metadataKeyAPIKey:       true,
+		metadataKeyRefreshToken: true,
+		metadataKeyTOTPCode:     true,
+	}
+)
+
+// recordAudit records that actor performed action on target, with the request metadata of ctx.
+// actor is empty for anonymous callers and the service itself, target is the user acted on, the document
+// for ShareDocument and UnshareDocument, the organization for CreateOrganization and DeleteUsersByOrganization,
+// the key id for CreateAPIKey and RevokeAPIKey and empty for secret rotations.
+// The change was already made, a failure to record it is logged and not returned.
+func recordAudit(ctx context.Context, actor string, action string, target string) {
+	if err := insertAuditEntry(ctx, actor, action, target, auditMetadata(ctx), time.Now()); err != nil {
+		logger.Error(consts.AuditTag, consts.MsgErrRecordAudit, action, target, err.Error())
+	}
+}
+
+// callerUUID returns the uuid of the caller put in ctx by AuthInterceptor, or the key id of the service api key
+// put in ctx by APIKeyInterceptor, empty if there is neither.
+func callerUUID(ctx context.Context) string {
+	if c, ok := callerFromContext(ctx); ok {
+		return c.uuid
+	}
+
+	if k, ok := serviceCallerFromContext(ctx); ok {
+		return k.keyID
+	}
+
+	return ""
+}
+
+// tokenActor returns the audit actor of an authorized token, the key id of a service api key or the uuid of an
+// auth token. Unlike callerUUID it does not need the interceptors to have run.
+func tokenActor(token string) string {
+	if keyID, err := parseServiceAPIKeyID(token); err == nil {
+		return keyID
+	}
+
+	return auth.ExtractUUID(token)
+}
+
+// auditMetadata returns the x-hwsc, x-forwarded-for and user-agent metadata of ctx, comma joined per key.
+// Binary values and auditExcludedMetadata are left out, the authorization metadata is never an x-hwsc key.
+func auditMetadata(ctx context.Context) map[string]string {
+	recorded := make(map[string]string)
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return recorded
+	}
+
+	for key, values := range md {
+		client := key == metadataKeyForwardedFor || key == metadataKeyUserAgent
+		if !client && (!strings.HasPrefix(key, metadataKeyPrefix) || strings.HasSuffix(key, "-bin") ||
+			auditExcludedMetadata[key]) {
+			continue
+		}
+		recorded[key] = strings.Join(values, ",")
+	}
+
+	return recorded
+}
+
+// writeAuditLogCSV returns entries as a CSV document with a header row, timestamps are RFC 3339 in UTC
+// and metadata a JSON object.
+func writeAuditLogCSV(entries []*auditEntry) (string, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+
+	if err := writer.Write(auditLogCSVHeader); err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		encoded, err := json.Marshal(entry.metadata)
+		if err != nil {
+			return "", err
+		}
+		record := []string{
+			strconv.FormatInt(entry.sequence, 10),
+			entry.timestamp.UTC().Format(time.RFC3339),
+			entry.actor,
+			entry.action,
+			entry.target,
+			string(encoded),
+		}
+		if err := writer.Write(record); err != nil {
+			return "", err
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
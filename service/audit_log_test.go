@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+	"testing"
+	"time"
+)
+
+func TestAuditMetadata(t *testing.T) {
+	desc := "test no metadata"
+	assert.Empty(t, auditMetadata(context.TODO()), desc)
+
+	desc = "test credentials and binary values are left out"
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs(
+		metadataKeyAuthorization, "Bearer a.b.c",
+		metadataKeyRefreshToken, "refresh",
+		metadataKeyAPIKey, "key",
+		metadataKeyOrganization, "Whale",
+		metadataKeyMissingUser, "notfound",
+		metadataKeyForwardedFor, "203.0.113.7",
+		metadataKeyForwardedFor, "10.0.0.1",
+		metadataKeyUserAgent, "grpc-go/1.21.0",
+		"x-request-id", "unused",
+	))
+	assert.Equal(t, map[string]string{
+		metadataKeyMissingUser:  "notfound",
+		metadataKeyForwardedFor: "203.0.113.7,10.0.0.1",
+		metadataKeyUserAgent:    "grpc-go/1.21.0",
+	}, auditMetadata(ctx), desc)
+}
+
+func TestCallerUUID(t *testing.T) {
+	assert.Equal(t, "", callerUUID(context.TODO()), "test no caller")
+
+	ctx := withCaller(context.TODO(), &caller{uuid: "0000xsnjg0mqjhbf4qx1efd6y3", permission: auth.Admin})
+	assert.Equal(t, "0000xsnjg0mqjhbf4qx1efd6y3", callerUUID(ctx), "test caller")
+}
+
+func TestWriteAuditLogCSV(t *testing.T) {
+	desc := "test header only"
+	document, err := writeAuditLogCSV(nil)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "sequence,timestamp,actor,action,target,metadata\n", document, desc)
+
+	desc = "test metadata is a quoted JSON object"
+	document, err = writeAuditLogCSV([]*auditEntry{
+		{
+			sequence:  3,
+			action:    auditActionCreateUser,
+			target:    "0000xsnjg0mqjhbf4qx1efd6y3",
+			metadata:  map[string]string{metadataKeyUserAgent: "grpc-go/1.21.0"},
+			timestamp: time.Date(2019, 7, 1, 8, 0, 0, 0, time.FixedZone("PDT", -7*60*60)),
+		},
+	})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "sequence,timestamp,actor,action,target,metadata\n"+
+		`3,2019-07-01T15:00:00Z,,CreateUser,0000xsnjg0mqjhbf4qx1efd6y3,"{""user-agent"":""grpc-go/1.21.0""}"`+"\n",
+		document, desc)
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"strings"
+)
+
+// authMethod is a credential of a user, see signInAuthMethods for those AuthenticateUser accepts
+type authMethod struct {
+	method       string
+	credentialID string
+}
+
+const (
+	// authMethodPassword is linked while the account has a password, it is set with UpdateUser
+	authMethodPassword = "password"
+
+	// authMethodGoogle and authMethodWebAuthn credentials are verified by the gateway,
+	// which links the google subject or the webauthn credential id it verified
+	authMethodGoogle   = "google"
+	authMethodWebAuthn = "webauthn"
+
+	// authMethodAPIKey credentials are generated by the service, only a hash of the key is stored
+	authMethodAPIKey = "apikey"
+
+	// apiKeyByteSize random bytes, base64 encoded keys stay below the 72 bytes bcrypt hashes
+	apiKeyByteSize     = 32
+	maxCredentialIDLen = 1023
+)
+
+var (
+	// linkedAuthMethods are the methods stored in user_svc.auth_methods
+	linkedAuthMethods = map[string]bool{
+		authMethodGoogle:   true,
+		authMethodWebAuthn: true,
+		authMethodAPIKey:   true,
+	}
+
+	// signInAuthMethods are the linked methods AuthenticateUser accepts. It accepts none yet, so the password
+	// is the only way to sign in and cannot be unlinked, see deleteAuthMethod.
+	signInAuthMethods = map[string]bool{}
+)
+
+// String returns the x-hwsc-auth-methods value of m, "password" or the method and credential id, such as
+// "google:110169484474386276334".
+func (m authMethod) String() string {
+	if m.method == authMethodPassword {
+		return m.method
+	}
+
+	return m.method + ":" + m.credentialID
+}
+
+// parseAuthMethod reads the x-hwsc-auth-method and x-hwsc-credential-id metadata.
+// The credential id is required for every method but password and, when linking, apikey.
+// Returns ErrInvalidAuthMethod or ErrInvalidCredentialID.
+func parseAuthMethod(ctx context.Context, linking bool) (*authMethod, error) {
+	method := strings.ToLower(getIncomingMetadata(ctx, metadataKeyAuthMethod))
+	credentialID := getIncomingMetadata(ctx, metadataKeyCredentialID)
+
+	switch {
+	case method == authMethodPassword:
+		if linking {
+			// passwords are hashed by UpdateUser, which validates them like at signup
+			return nil, consts.ErrInvalidAuthMethod
+		}
+		return &authMethod{method: method}, nil
+	case !linkedAuthMethods[method]:
+		return nil, consts.ErrInvalidAuthMethod
+	case linking && method == authMethodAPIKey:
+		if credentialID != "" {
+			return nil, consts.ErrInvalidCredentialID
+		}
+		return &authMethod{method: method}, nil
+	case credentialID == "" || len(credentialID) > maxCredentialIDLen:
+		return nil, consts.ErrInvalidCredentialID
+	}
+
+	return &authMethod{method: method, credentialID: credentialID}, nil
+}
+
+// generateAPIKey returns a new api key, its credential id and the key shown once to the user.
+// The credential id identifies the key in ListAuthMethods without revealing it.
+func generateAPIKey() (string, string, error) {
+	credentialID, err := generateUUID()
+	if err != nil {
+		return "", "", err
+	}
+
+	random := make([]byte, apiKeyByteSize)
+	if _, err := rand.Read(random); err != nil {
+		return "", "", err
+	}
+
+	return credentialID, base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// setAuthMethodsHeader lists methods in the x-hwsc-auth-methods response header, one value per credential.
+func setAuthMethodsHeader(ctx context.Context, methods []*authMethod) error {
+	values := make([]string, 0, len(methods))
+	for _, method := range methods {
+		values = append(values, method.String())
+	}
+
+	return setResponseHeader(ctx, metadataKeyAuthMethods, values...)
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestParseAuthMethod(t *testing.T) {
+	cases := []struct {
+		desc    string
+		method  string
+		id      string
+		linking bool
+		exp     *authMethod
+		expErr  error
+	}{
+		{"test link google", "google", "110169484474386276334", true,
+			&authMethod{method: authMethodGoogle, credentialID: "110169484474386276334"}, nil},
+		{"test link webauthn in any case", "WebAuthn", "Z3Vlc3Q", true,
+			&authMethod{method: authMethodWebAuthn, credentialID: "Z3Vlc3Q"}, nil},
+		{"test link apikey", "apikey", "", true, &authMethod{method: authMethodAPIKey}, nil},
+		{"test apikey ids are generated", "apikey", "chosen", true, nil, consts.ErrInvalidCredentialID},
+		{"test passwords are set with UpdateUser", "password", "", true, nil, consts.ErrInvalidAuthMethod},
+		{"test unlink password", "password", "", false, &authMethod{method: authMethodPassword}, nil},
+		{"test unlink apikey", "apikey", "0000xsnjg0mqjhbf4qx1efd6y3", false,
+			&authMethod{method: authMethodAPIKey, credentialID: "0000xsnjg0mqjhbf4qx1efd6y3"}, nil},
+		{"test missing credential id", "google", "", false, nil, consts.ErrInvalidCredentialID},
+		{"test long credential id", "webauthn", strings.Repeat("a", maxCredentialIDLen+1), true, nil,
+			consts.ErrInvalidCredentialID},
+		{"test unknown method", "github", "1", true, nil, consts.ErrInvalidAuthMethod},
+		{"test missing method", "", "", false, nil, consts.ErrInvalidAuthMethod},
+	}
+
+	for _, c := range cases {
+		ctx, _ := unitTestServerContext(metadataKeyAuthMethod, c.method, metadataKeyCredentialID, c.id)
+		method, err := parseAuthMethod(ctx, c.linking)
+		assert.Equal(t, c.expErr, err, c.desc)
+		assert.Equal(t, c.exp, method, c.desc)
+	}
+}
+
+func TestAuthMethodHeader(t *testing.T) {
+	ctx, stream := unitTestServerContext()
+	err := setAuthMethodsHeader(ctx, []*authMethod{
+		{method: authMethodPassword},
+		{method: authMethodGoogle, credentialID: "110169484474386276334"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"password", "google:110169484474386276334"}, stream.header.Get(metadataKeyAuthMethods))
+
+	desc := "test api keys are random and can be hashed"
+	id, key, err := generateAPIKey()
+	assert.Nil(t, err, desc)
+	otherID, otherKey, err := generateAPIKey()
+	assert.Nil(t, err, desc)
+	assert.NotEqual(t, id, otherID, desc)
+	assert.NotEqual(t, key, otherKey, desc)
+	hashed, err := hashPassword(key)
+	assert.Nil(t, err, desc)
+	assert.Nil(t, comparePassword(hashed, key), desc)
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"net/http"
+	"time"
+)
+
+// usageRecord counts the seats of an organization on a day (UTC), users without an organization are counted under ""
+type usageRecord struct {
+	Day          string `json:"day"`
+	Organization string `json:"organization"`
+	Seats        int64  `json:"seats"`
+}
+
+// usageReporter hands usage records to the billing system, records are reported again until it succeeds
+type usageReporter interface {
+	report(ctx context.Context, records []*usageRecord) error
+}
+
+// httpUsageReporter POSTs usage records as a JSON array
+type httpUsageReporter struct {
+	address string
+	client  *http.Client
+}
+
+const (
+	usageDayLayout = "2006-01-02"
+
+	// defaultUsageSchedule counts seats daily at 11:55 PM, close to the end of the day they are recorded for
+	defaultUsageSchedule = "55 23 * * *"
+	defaultUsageTimezone = "UTC"
+
+	usageReportTimeout = 10 * time.Second
+
+	// usageReportBatch bounds the records sent to the reporter in one request
+	usageReportBatch = 500
+
+	defaultUsageReportDays = 30
+	maxUsageReportDays     = 366
+)
+
+var (
+	// billingReporter is nil when no billing endpoint is configured, usage is still recorded
+	billingReporter usageReporter
+
+	usageSchedule *cronSchedule
+)
+
+func init() {
+	if conf.BillingHost.Address != "" {
+		billingReporter = &httpUsageReporter{
+			address: conf.BillingHost.Address,
+			client:  &http.Client{Timeout: usageReportTimeout},
+		}
+	}
+
+	spec := conf.BillingHost.Schedule
+	if spec == "" {
+		spec = defaultUsageSchedule
+	}
+
+	timezone := conf.BillingHost.Timezone
+	if timezone == "" {
+		timezone = defaultUsageTimezone
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		reportStartupProblem("Invalid billing timezone:", timezone)
+		return
+	}
+
+	usageSchedule, err = parseCronSchedule(spec, location)
+	if err != nil {
+		reportStartupProblem("Invalid billing schedule:", spec)
+		return
+	}
+
+	// seats are recorded by the primary region
+	if !isStandby {
+		go runUsageSchedule()
+	}
+}
+
+// report returns error if the request fails or the endpoint does not answer with a 2xx status.
+func (r *httpUsageReporter) report(ctx context.Context, records []*usageRecord) error {
+	payload, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, r.address, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s: %s", consts.ErrBillingRequestFailed.Error(), resp.Status)
+	}
+
+	return nil
+}
+
+// runUsageSchedule records and reports usage every time usageSchedule comes up, it never returns.
+func runUsageSchedule() {
+	for {
+		next := usageSchedule.next(time.Now())
+		time.Sleep(time.Until(next))
+
+		if err := refreshDBConnection(); err != nil {
+			logger.Error(consts.BillingTag, consts.ErrDBConnectionError.Error())
+			continue
+		}
+
+		recordUsage(context.Background(), billingReporter, time.Now().UTC())
+	}
+}
+
+// recordUsage records the seats of every organization on the day of now, then sends every unreported record
+// to reporter. Records that fail to report are kept and sent again on the next run.
+func recordUsage(ctx context.Context, reporter usageReporter, now time.Time) {
+	recorded, err := insertUsageRecords(ctx, now)
+	if err != nil {
+		logger.Error(consts.BillingTag, consts.MsgErrRecordUsage, err.Error())
+	} else {
+		logger.Info(consts.BillingTag, "Recorded seats of", fmt.Sprint(recorded), "organizations")
+	}
+
+	if reporter == nil {
+		return
+	}
+
+	for {
+		reported, err := reportUsageRecords(ctx, usageReportBatch, func(records []*usageRecord) error {
+			return reporter.report(ctx, records)
+		})
+		if err != nil {
+			logger.Error(consts.BillingTag, consts.MsgErrReportUsage, err.Error())
+			return
+		}
+		if reported < usageReportBatch {
+			return
+		}
+	}
+}
+
+// parseUsageReportRange parses the YYYY-MM-DD from and to dates of a usage report, either may be empty.
+// to defaults to the day of now and from to defaultUsageReportDays before to.
+// Returns ErrInvalidUsageReportRange if a date is malformed, from is after to, or the range exceeds maxUsageReportDays.
+func parseUsageReportRange(fromDate string, toDate string, now time.Time) (time.Time, time.Time, error) {
+	to, err := time.Parse(usageDayLayout, now.UTC().Format(usageDayLayout))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if toDate != "" {
+		if to, err = time.Parse(usageDayLayout, toDate); err != nil {
+			return time.Time{}, time.Time{}, consts.ErrInvalidUsageReportRange
+		}
+	}
+
+	from := to.AddDate(0, 0, 1-defaultUsageReportDays)
+	if fromDate != "" {
+		if from, err = time.Parse(usageDayLayout, fromDate); err != nil {
+			return time.Time{}, time.Time{}, consts.ErrInvalidUsageReportRange
+		}
+	}
+
+	if from.After(to) || to.Sub(from) >= maxUsageReportDays*24*time.Hour {
+		return time.Time{}, time.Time{}, consts.ErrInvalidUsageReportRange
+	}
+
+	return from, to, nil
+}
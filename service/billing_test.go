@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPUsageReporter(t *testing.T) {
+	records := []*usageRecord{
+		{Day: "2019-07-01", Organization: "", Seats: 3},
+		{Day: "2019-07-01", Organization: "hwsc", Seats: 5},
+	}
+
+	var received []*usageRecord
+	statusCode := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = nil
+		_ = json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(statusCode)
+	}))
+	defer server.Close()
+
+	reporter := &httpUsageReporter{address: server.URL, client: server.Client()}
+
+	desc := "test records are posted"
+	assert.Nil(t, reporter.report(context.TODO(), records), desc)
+	assert.Equal(t, records, received, desc)
+
+	desc = "test non 2xx status fails"
+	statusCode = http.StatusServiceUnavailable
+	assert.EqualError(t, reporter.report(context.TODO(), records),
+		consts.ErrBillingRequestFailed.Error()+": 503 Service Unavailable", desc)
+}
+
+func TestParseUsageReportRange(t *testing.T) {
+	now := time.Date(2019, 7, 1, 15, 4, 5, 0, time.UTC)
+	day := func(value string) time.Time {
+		parsed, _ := time.Parse(usageDayLayout, value)
+		return parsed
+	}
+
+	cases := []struct {
+		desc     string
+		from     string
+		to       string
+		expFrom  time.Time
+		expTo    time.Time
+		isExpErr bool
+	}{
+		{"test defaults", "", "", day("2019-06-02"), day("2019-07-01"), false},
+		{"test from only", "2019-01-01", "", day("2019-01-01"), day("2019-07-01"), false},
+		{"test single day", "2019-03-01", "2019-03-01", day("2019-03-01"), day("2019-03-01"), false},
+		{"test longest range", "2018-07-01", "2019-07-01", day("2018-07-01"), day("2019-07-01"), false},
+		{"test range too long", "2018-06-30", "2019-07-01", time.Time{}, time.Time{}, true},
+		{"test from after to", "2019-07-02", "2019-07-01", time.Time{}, time.Time{}, true},
+		{"test malformed from", "07/01/2019", "", time.Time{}, time.Time{}, true},
+		{"test malformed to", "", "2019-7-1", time.Time{}, time.Time{}, true},
+	}
+
+	for _, c := range cases {
+		from, to, err := parseUsageReportRange(c.from, c.to, now)
+		if c.isExpErr {
+			assert.NotNil(t, err, c.desc)
+			continue
+		}
+		assert.Nil(t, err, c.desc)
+		assert.Equal(t, c.expFrom, from, c.desc)
+		assert.Equal(t, c.expTo, to, c.desc)
+	}
+}
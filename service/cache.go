@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"strconv"
+	"time"
+)
+
+// userCache stores sanitized (password removed) users keyed by uuid
+type userCache interface {
+	get(uuid string) (*pblib.User, bool)
+	set(user *pblib.User)
+	invalidate(uuid string)
+}
+
+// redisUserCache is a userCache backed by redis, entries expire after ttl
+type redisUserCache struct {
+	client *redisClient
+	ttl    time.Duration
+}
+
+const (
+	userCacheKeyPrefix  = "hwsc-user-svc:user:"
+	defaultUserCacheTTL = 5 * time.Minute
+	redisTimeout        = 500 * time.Millisecond
+)
+
+var (
+	// userRowCache is nil when caching is disabled, it is kept in redis if hosts_redis_address is set and in
+	// memory if hosts_cache_usersize is
+	userRowCache userCache
+)
+
+func init() {
+	if conf.UserCacheHost.Address == "" {
+		// without redis, users may be cached in the memory of the instance
+		size, ttl, ok := parseMemoryCache(conf.Caches.UserSize, conf.Caches.UserTTL, 0)
+		if !ok {
+			reportStartupProblem("Invalid user cache:", "usersize="+conf.Caches.UserSize,
+				"userttl="+conf.Caches.UserTTL)
+			return
+		}
+		if size > 0 {
+			userRowCache = newMemoryUserCache(size, ttl)
+			logger.Info(consts.UserCacheTag, "Caching up to", strconv.Itoa(size), "users in memory for", ttl.String())
+		}
+		return
+	}
+
+	ttl := defaultUserCacheTTL
+	if conf.UserCacheHost.TTL != "" {
+		parsed, err := time.ParseDuration(conf.UserCacheHost.TTL)
+		if err != nil || parsed <= 0 {
+			reportStartupProblem("Invalid redis ttl:", conf.UserCacheHost.TTL)
+			return
+		}
+		ttl = parsed
+	}
+
+	db := 0
+	if conf.UserCacheHost.DB != "" {
+		parsed, err := strconv.Atoi(conf.UserCacheHost.DB)
+		if err != nil || parsed < 0 {
+			reportStartupProblem("Invalid redis db:", conf.UserCacheHost.DB)
+			return
+		}
+		db = parsed
+	}
+
+	userRowCache = &redisUserCache{
+		client: newRedisClient(conf.UserCacheHost.Address, conf.UserCacheHost.Password, db, redisTimeout),
+		ttl:    ttl,
+	}
+	logger.Info(consts.UserCacheTag, "Caching users in redis at", conf.UserCacheHost.Address)
+}
+
+// get returns the cached user, a miss is reported for any redis error so callers fall back to postgres.
+func (c *redisUserCache) get(uuid string) (*pblib.User, bool) {
+	value, err := c.client.get(userCacheKeyPrefix + uuid)
+	if err != nil {
+		if err != redisNil {
+			logger.Error(consts.UserCacheTag, consts.MsgErrUserCache, err.Error())
+		}
+		return nil, false
+	}
+
+	user := &pblib.User{}
+	if err := json.Unmarshal(value, user); err != nil {
+		logger.Error(consts.UserCacheTag, consts.MsgErrUserCache, err.Error())
+		return nil, false
+	}
+
+	return user, true
+}
+
+// set caches a copy of the user without its password.
+func (c *redisUserCache) set(user *pblib.User) {
+	if user == nil {
+		return
+	}
+
+	sanitized := *user
+	sanitized.Password = ""
+
+	value, err := json.Marshal(&sanitized)
+	if err != nil {
+		logger.Error(consts.UserCacheTag, consts.MsgErrUserCache, err.Error())
+		return
+	}
+
+	if err := c.client.set(userCacheKeyPrefix+user.GetUuid(), value, c.ttl); err != nil {
+		logger.Error(consts.UserCacheTag, consts.MsgErrUserCache, err.Error())
+	}
+}
+
+// invalidate removes the cached user, must be called after every write to the user's row.
+func (c *redisUserCache) invalidate(uuid string) {
+	if err := c.client.del(userCacheKeyPrefix + uuid); err != nil {
+		logger.Error(consts.UserCacheTag, consts.MsgErrUserCache, err.Error())
+	}
+}
+
+// getCachedUserRow is a read-through wrapper around getUserRow for read only paths.
+// Returned users never contain a password, use getUserRow when the password hash is needed.
+func getCachedUserRow(ctx context.Context, uuid string) (*pblib.User, error) {
+	if userRowCache != nil {
+		user, ok := userRowCache.get(uuid)
+		userCacheCounters.record(ok)
+		if ok {
+			return user, nil
+		}
+	}
+
+	user, err := getUserRow(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	user.Password = ""
+
+	// a replica may not have received the update that invalidated the cached row yet, its rows are not cached
+	if userRowCache != nil && !replicaReads(ctx) {
+		userRowCache.set(user)
+	}
+
+	return user, nil
+}
+
+// invalidateCachedUser drops the user from the cache if caching is enabled.
+func invalidateCachedUser(uuid string) {
+	if userRowCache != nil {
+		userRowCache.invalidate(uuid)
+	}
+}
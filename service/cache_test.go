@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRedisUserCache(t *testing.T) {
+	server := newUnitTestRedisServer(t, "")
+	defer server.listener.Close()
+
+	cache := &redisUserCache{
+		client: newRedisClient(server.listener.Addr().String(), "", 0, time.Second),
+		ttl:    time.Minute,
+	}
+
+	user := &pblib.User{
+		Uuid:      validUUID,
+		FirstName: "Lisa",
+		LastName:  "Kim",
+		Password:  "hashed",
+	}
+
+	desc := "test miss"
+	cachedUser, ok := cache.get(validUUID)
+	assert.False(t, ok, desc)
+	assert.Nil(t, cachedUser, desc)
+
+	desc = "test set does not store password"
+	cache.set(user)
+	assert.Equal(t, "hashed", user.GetPassword(), desc)
+	assert.NotContains(t, server.data[userCacheKeyPrefix+validUUID], "hashed", desc)
+
+	desc = "test hit"
+	cachedUser, ok = cache.get(validUUID)
+	assert.True(t, ok, desc)
+	assert.Equal(t, user.GetFirstName(), cachedUser.GetFirstName(), desc)
+	assert.Equal(t, "", cachedUser.GetPassword(), desc)
+
+	desc = "test invalidate"
+	cache.invalidate(validUUID)
+	_, ok = cache.get(validUUID)
+	assert.False(t, ok, desc)
+
+	desc = "test corrupted entry is a miss"
+	server.data[userCacheKeyPrefix+validUUID] = "{"
+	_, ok = cache.get(validUUID)
+	assert.False(t, ok, desc)
+}
+
+func TestGetCachedUserRow(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	server := newUnitTestRedisServer(t, "")
+	defer server.listener.Close()
+
+	original := userRowCache
+	defer func() { userRowCache = original }()
+	userRowCache = &redisUserCache{
+		client: newRedisClient(server.listener.Addr().String(), "", 0, time.Second),
+		ttl:    time.Minute,
+	}
+
+	response, err := unitTestInsertUser("GetCachedUserRow-One")
+	assert.Nil(t, err)
+	uuid := response.GetUser().GetUuid()
+
+	desc := "test miss reads through to postgres"
+	user, err := getCachedUserRow(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuid, user.GetUuid(), desc)
+	assert.Equal(t, "", user.GetPassword(), desc)
+	assert.NotEmpty(t, server.data[userCacheKeyPrefix+uuid], desc)
+
+	desc = "test hit is served from cache"
+	server.data[userCacheKeyPrefix+uuid] = `{"uuid":"` + uuid + `","first_name":"Cached"}`
+	user, err = getCachedUserRow(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "Cached", user.GetFirstName(), desc)
+
+	desc = "test invalidate falls back to postgres"
+	invalidateCachedUser(uuid)
+	user, err = getCachedUserRow(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, response.GetUser().GetFirstName(), user.GetFirstName(), desc)
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"path"
+	"strings"
+)
+
+// caller is the user whose auth token came with a request, set by AuthInterceptor
+type caller struct {
+	uuid       string
+	permission auth.Permission
+	token      string
+}
+
+// callerKey is the context key of the caller
+type callerKey struct{}
+
+const (
+	// metadataKeyAuthorization carries the auth token of the caller, optionally prefixed with "Bearer "
+	metadataKeyAuthorization = "authorization"
+	bearerPrefix             = "bearer "
+)
+
+// callerMethods modify a user and must be called by that user or an admin, see authorizeCaller
+var callerMethods = map[string]bool{
+	"DeleteUser": true,
+	"UpdateUser": true,
+}
+
+// AuthInterceptor verifies the authorization token of a request and puts its caller in the context.
+// Requests without a token are passed through, except to callerMethods which are refused. Service api keys were
+// verified and scoped by APIKeyInterceptor, they are passed through as well.
+// Returns an Unauthenticated status error if the token is missing or not valid.
+func AuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	method := path.Base(info.FullMethod)
+
+	token := authorizationToken(ctx)
+	if token == "" {
+		if callerMethods[method] {
+			logger.Error(consts.CallerTag, info.FullMethod, consts.ErrMissingAuthorization.Error())
+			return nil, statusFromError(consts.ErrMissingAuthorization)
+		}
+		return handler(ctx, req)
+	}
+	if isServiceAPIKey(token) {
+		return handler(ctx, req)
+	}
+
+	c, err := authenticateCaller(ctx, token)
+	if err != nil {
+		logger.Error(consts.CallerTag, info.FullMethod, err.Error())
+		return nil, err
+	}
+
+	return handler(withCaller(ctx, c), req)
+}
+
+// authorizationToken returns the token of the authorization metadata without its "Bearer " prefix.
+func authorizationToken(ctx context.Context) string {
+	token := getIncomingMetadata(ctx, metadataKeyAuthorization)
+	if len(token) >= len(bearerPrefix) && strings.EqualFold(token[:len(bearerPrefix)], bearerPrefix) {
+		token = strings.TrimSpace(token[len(bearerPrefix):])
+	}
+
+	return token
+}
+
+// authenticateCaller verifies token against the database like authorizeUser and returns its caller.
+// Returns an Unauthenticated status error if token is not valid.
+func authenticateCaller(ctx context.Context, token string) (*caller, error) {
+	retrievedIdentity, err := pairTokenWithCachedSecret(ctx, token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	authority := auth.NewAuthority(auth.Jwt, auth.User)
+	defer authority.Invalidate()
+
+	if err := authority.Authorize(retrievedIdentity); err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	if err := touchSession(ctx, token); err != nil {
+		return nil, err
+	}
+
+	body := authority.Body()
+	return &caller{uuid: body.UUID, permission: body.Permission, token: token}, nil
+}
+
+// withCaller returns a copy of ctx carrying c.
+func withCaller(ctx context.Context, c *caller) context.Context {
+	return context.WithValue(ctx, callerKey{}, c)
+}
+
+// callerFromContext returns the caller put in ctx by AuthInterceptor, if any.
+func callerFromContext(ctx context.Context) (*caller, bool) {
+	c, ok := ctx.Value(callerKey{}).(*caller)
+	return c, ok && c != nil
+}
+
+// isAdmin returns true if the caller's token carries admin permission.
+func (c *caller) isAdmin() bool {
+	return c.permission == auth.Admin
+}
+
+// authorizeCaller lets the caller of a callerMethods request modify uuid if it is that user or an admin.
+// AuthInterceptor refuses callerMethods requests without a caller, handlers called without the interceptor
+// are not restricted.
+// Returns a PermissionDenied status error if the caller is someone else.
+func authorizeCaller(ctx context.Context, uuid string) error {
+	c, ok := callerFromContext(ctx)
+	if !ok || c.uuid == uuid || c.isAdmin() {
+		return nil
+	}
+
+	return statusFromError(consts.ErrCallerNotAllowed)
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestAuthorizationToken(t *testing.T) {
+	cases := []struct {
+		desc     string
+		pairs    []string
+		expToken string
+	}{
+		{"test no metadata", nil, ""},
+		{"test bare token", []string{metadataKeyAuthorization, "a.b.c"}, "a.b.c"},
+		{"test bearer token", []string{metadataKeyAuthorization, "Bearer a.b.c"}, "a.b.c"},
+		{"test lower case bearer token", []string{metadataKeyAuthorization, "bearer  a.b.c"}, "a.b.c"},
+	}
+
+	for _, c := range cases {
+		ctx, _ := unitTestServerContext(c.pairs...)
+		assert.Equal(t, c.expToken, authorizationToken(ctx), c.desc)
+	}
+}
+
+func TestAuthInterceptor(t *testing.T) {
+	var calls int
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls++
+		_, ok := callerFromContext(ctx)
+		assert.False(t, ok)
+		return &pbsvc.UserResponse{Message: codes.OK.String()}, nil
+	}
+
+	desc := "test callerMethods require a token"
+	for method := range callerMethods {
+		info := &grpc.UnaryServerInfo{FullMethod: "/user.UserService/" + method}
+		ctx, _ := unitTestServerContext()
+		_, err := AuthInterceptor(ctx, &pbsvc.UserRequest{}, info, handler)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+	}
+	assert.Equal(t, 0, calls, desc)
+
+	desc = "test other methods pass through without a token"
+	ctx, _ := unitTestServerContext()
+	_, err := AuthInterceptor(ctx, &pbsvc.UserRequest{}, &grpc.UnaryServerInfo{FullMethod: "/user.UserService/GetUser"},
+		handler)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 1, calls, desc)
+}
+
+func TestAuthorizeCaller(t *testing.T) {
+	self, err := generateUUID()
+	assert.Nil(t, err)
+	other, err := generateUUID()
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc    string
+		caller  *caller
+		uuid    string
+		expCode codes.Code
+	}{
+		{"test no caller", nil, self, codes.OK},
+		{"test self", &caller{uuid: self, permission: auth.User}, self, codes.OK},
+		{"test admin", &caller{uuid: other, permission: auth.Admin}, self, codes.OK},
+		{"test other user", &caller{uuid: other, permission: auth.User}, self, codes.PermissionDenied},
+	}
+
+	for _, c := range cases {
+		ctx := context.TODO()
+		if c.caller != nil {
+			ctx = withCaller(ctx, c.caller)
+		}
+		assert.Equal(t, c.expCode, status.Code(authorizeCaller(ctx, c.uuid)), c.desc)
+	}
+}
+
+func TestAuthInterceptorCaller(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	_, token, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err)
+	owner := auth.ExtractUUID(token)
+
+	var seen *caller
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		seen, _ = callerFromContext(ctx)
+		return &pbsvc.UserResponse{Message: codes.OK.String()}, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/user.UserService/DeleteUser"}
+
+	desc := "test valid token puts its caller in the context"
+	ctx, _ := unitTestServerContext(metadataKeyAuthorization, "Bearer "+token)
+	_, err = AuthInterceptor(ctx, &pbsvc.UserRequest{User: &pblib.User{Uuid: owner}}, info, handler)
+	assert.Nil(t, err, desc)
+	if assert.NotNil(t, seen, desc) {
+		assert.Equal(t, owner, seen.uuid, desc)
+		assert.False(t, seen.isAdmin(), desc)
+	}
+
+	desc = "test invalid token is refused"
+	seen = nil
+	ctx, _ = unitTestServerContext(metadataKeyAuthorization, "Bearer "+token+"x")
+	_, err = AuthInterceptor(ctx, &pbsvc.UserRequest{User: &pblib.User{Uuid: owner}}, info, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+	assert.Nil(t, seen, desc)
+
+	desc = "test DeleteUser of another user is refused"
+	other, err := generateUUID()
+	assert.Nil(t, err)
+	s := Service{}
+	_, err = s.DeleteUser(withCaller(context.TODO(), &caller{uuid: owner, permission: auth.User, token: token}),
+		&pbsvc.UserRequest{User: &pblib.User{Uuid: other}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"fmt"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"strings"
+)
+
+// Columns are renamed or change type in expand-and-contract steps, so old and new service versions can run
+// side by side during a rollout. Queries keep naming the old column through readColumn and assignColumn,
+// which read and write the old column, the new one or both depending on the phase set with hosts_schema_phases:
+//
+//	""          the expand migration adds the new column, nullable, and every instance keeps using the old one
+//	dualwrite   writes go to both columns, reads use the old one, which instances not yet upgraded still write
+//	dualread    once every instance writes both, reads prefer the new column and fall back to the old one
+//	new         the contract migration backfilled the new column, only the new column is used
+//
+// Every step can be rolled back by going back one phase, the old column is only dropped once no instance
+// reads it. When the old column is gone, queries are updated to the new name and the migration is unregistered.
+
+// columnMigration replaces a column by column to, of type toType if the type changes.
+// Values written to both columns must be valid for either type, reads always return toType.
+type columnMigration struct {
+	to     string
+	toType string
+}
+
+const (
+	schemaPhaseDualWrite = "dualwrite"
+	schemaPhaseDualRead  = "dualread"
+	schemaPhaseNew       = "new"
+)
+
+var (
+	// columnMigrations are the column migrations in progress, keyed by table.column of the replaced column
+	columnMigrations = map[string]columnMigration{
+		"accounts.marketing_opt_in": {to: "marketing_alerts"},
+	}
+
+	// columnPhases are set with hosts_schema_phases, migrations without a phase use the old column only
+	columnPhases map[string]string
+)
+
+func init() {
+	var err error
+	columnPhases, err = parseSchemaPhases(conf.SchemaCompat.Phases)
+	if err != nil {
+		reportStartupProblem("Invalid schema phases:", conf.SchemaCompat.Phases)
+	}
+}
+
+// parseSchemaPhases parses a comma separated list of table.column=phase.
+// Returns ErrInvalidSchemaPhase if an entry is malformed, names an unregistered migration or an unknown phase.
+func parseSchemaPhases(value string) (map[string]string, error) {
+	phases := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, consts.ErrInvalidSchemaPhase
+		}
+		column, phase := strings.TrimSpace(parts[0]), strings.ToLower(strings.TrimSpace(parts[1]))
+		if _, ok := columnMigrations[column]; !ok {
+			return nil, consts.ErrInvalidSchemaPhase
+		}
+
+		switch phase {
+		case schemaPhaseDualWrite, schemaPhaseDualRead, schemaPhaseNew:
+			phases[column] = phase
+		default:
+			return nil, consts.ErrInvalidSchemaPhase
+		}
+	}
+
+	return phases, nil
+}
+
+// readColumn returns the SQL expression reading column of table in its current phase.
+func readColumn(table string, column string) string {
+	migration, ok := columnMigrations[table+"."+column]
+	if !ok {
+		return column
+	}
+
+	old := column
+	if migration.toType != "" {
+		old = fmt.Sprintf("%s::%s", column, migration.toType)
+	}
+
+	switch columnPhases[table+"."+column] {
+	case schemaPhaseDualRead:
+		return fmt.Sprintf("COALESCE(%s, %s)", migration.to, old)
+	case schemaPhaseNew:
+		return migration.to
+	default:
+		return old
+	}
+}
+
+// assignColumn returns the SQL assignments setting column of table to placeholder in its current phase.
+func assignColumn(table string, column string, placeholder string) []string {
+	migration, ok := columnMigrations[table+"."+column]
+	if !ok {
+		return []string{fmt.Sprintf("%s = %s", column, placeholder)}
+	}
+
+	to := fmt.Sprintf("%s = %s", migration.to, placeholder)
+	if migration.toType != "" {
+		to = fmt.Sprintf("%s = %s::%s", migration.to, placeholder, migration.toType)
+	}
+
+	switch columnPhases[table+"."+column] {
+	case schemaPhaseDualWrite, schemaPhaseDualRead:
+		return []string{fmt.Sprintf("%s = %s", column, placeholder), to}
+	case schemaPhaseNew:
+		return []string{to}
+	default:
+		return []string{fmt.Sprintf("%s = %s", column, placeholder)}
+	}
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseSchemaPhases(t *testing.T) {
+	cases := []struct {
+		desc      string
+		input     string
+		expPhases map[string]string
+		isExpErr  bool
+	}{
+		{"test empty", "", map[string]string{}, false},
+		{"test phase", "accounts.marketing_opt_in=dualwrite",
+			map[string]string{"accounts.marketing_opt_in": schemaPhaseDualWrite}, false},
+		{"test spaces and case", " accounts.marketing_opt_in = DualRead ,",
+			map[string]string{"accounts.marketing_opt_in": schemaPhaseDualRead}, false},
+		{"test unregistered column", "accounts.organization=new", nil, true},
+		{"test unknown phase", "accounts.marketing_opt_in=contract", nil, true},
+		{"test missing phase", "accounts.marketing_opt_in", nil, true},
+	}
+
+	for _, c := range cases {
+		phases, err := parseSchemaPhases(c.input)
+		if c.isExpErr {
+			assert.Equal(t, consts.ErrInvalidSchemaPhase, err, c.desc)
+			continue
+		}
+		assert.Nil(t, err, c.desc)
+		assert.Equal(t, c.expPhases, phases, c.desc)
+	}
+}
+
+func TestColumnPhases(t *testing.T) {
+	migrations, phases := columnMigrations, columnPhases
+	defer func() { columnMigrations, columnPhases = migrations, phases }()
+
+	columnMigrations = map[string]columnMigration{
+		"accounts.marketing_opt_in": {to: "marketing_alerts"},
+		"accounts.organization":     {to: "organization_id", toType: "UUID"},
+	}
+
+	cases := []struct {
+		desc      string
+		column    string
+		phase     string
+		expRead   string
+		expAssign []string
+	}{
+		{"test unregistered column", "share_alerts", "",
+			"share_alerts", []string{"share_alerts = $2"}},
+		{"test rename before rollout", "marketing_opt_in", "",
+			"marketing_opt_in", []string{"marketing_opt_in = $2"}},
+		{"test rename dual write", "marketing_opt_in", schemaPhaseDualWrite,
+			"marketing_opt_in", []string{"marketing_opt_in = $2", "marketing_alerts = $2"}},
+		{"test rename dual read", "marketing_opt_in", schemaPhaseDualRead,
+			"COALESCE(marketing_alerts, marketing_opt_in)", []string{"marketing_opt_in = $2", "marketing_alerts = $2"}},
+		{"test rename new", "marketing_opt_in", schemaPhaseNew,
+			"marketing_alerts", []string{"marketing_alerts = $2"}},
+		{"test type change before rollout", "organization", "",
+			"organization::UUID", []string{"organization = $2"}},
+		{"test type change dual write", "organization", schemaPhaseDualWrite,
+			"organization::UUID", []string{"organization = $2", "organization_id = $2::UUID"}},
+		{"test type change dual read", "organization", schemaPhaseDualRead,
+			"COALESCE(organization_id, organization::UUID)", []string{"organization = $2", "organization_id = $2::UUID"}},
+		{"test type change new", "organization", schemaPhaseNew,
+			"organization_id", []string{"organization_id = $2::UUID"}},
+	}
+
+	for _, c := range cases {
+		columnPhases = map[string]string{"accounts." + c.column: c.phase}
+		assert.Equal(t, c.expRead, readColumn("accounts", c.column), c.desc)
+		assert.Equal(t, c.expAssign, assignColumn("accounts", c.column, "$2"), c.desc)
+	}
+}
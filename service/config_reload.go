@@ -0,0 +1,127 @@
+package service
+
+import (
+	"bytes"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// levelWriter drops the log lines of hwsc-lib/logger less severe than level, the logger has no levels of its own
+type levelWriter struct {
+	out   io.Writer
+	level int32
+}
+
+const (
+	logLevelDebug int32 = iota
+	logLevelInfo
+	logLevelError
+
+	defaultLogLevel = "info"
+)
+
+var (
+	// logLevels are the levels of hosts_log_level
+	logLevels = map[string]int32{
+		"debug": logLevelDebug,
+		"info":  logLevelInfo,
+		"error": logLevelError,
+	}
+
+	// logTagLevels are the levels of the tags starting log lines, fatal lines and lines without a tag are
+	// always written
+	logTagLevels = map[string]int32{
+		logger.LogTagDebug: logLevelDebug,
+		logger.LogTagInfo:  logLevelInfo,
+		logger.LogTagError: logLevelError,
+	}
+
+	// logOutput is set with hosts_log_level and reloaded on SIGHUP
+	logOutput = &levelWriter{out: os.Stderr, level: logLevelInfo}
+)
+
+func init() {
+	level, err := parseLogLevel(conf.Log.Level)
+	if err != nil {
+		reportStartupProblem("Invalid log level:", conf.Log.Level)
+	} else {
+		logOutput.setLevel(level)
+	}
+
+	log.SetOutput(logOutput)
+}
+
+// parseLogLevel parses "debug", "info" or "error", empty defaults to "info".
+// Returns ErrInvalidLogLevel if value is not a level.
+func parseLogLevel(value string) (int32, error) {
+	if value = strings.ToLower(strings.TrimSpace(value)); value == "" {
+		value = defaultLogLevel
+	}
+
+	level, ok := logLevels[value]
+	if !ok {
+		return 0, consts.ErrInvalidLogLevel
+	}
+
+	return level, nil
+}
+
+func (w *levelWriter) setLevel(level int32) {
+	atomic.StoreInt32(&w.level, level)
+}
+
+// Write writes p unless it is a line tagged less severe than the level, the std logger writes one line per call.
+func (w *levelWriter) Write(p []byte) (int, error) {
+	if start := bytes.IndexByte(p, '['); start >= 0 {
+		if end := bytes.IndexByte(p[start:], ']'); end >= 0 {
+			tagLevel, ok := logTagLevels[string(p[start:start+end+1])]
+			if ok && tagLevel < atomic.LoadInt32(&w.level) {
+				return len(p), nil
+			}
+		}
+	}
+
+	return w.out.Write(p)
+}
+
+// StartConfigReload reloads the log level and rate limits on SIGHUP, see conf.Reload. Settings that fail to
+// parse keep their previous value.
+func StartConfigReload() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			reloadConfig()
+		}
+	}()
+}
+
+// reloadConfig reads the configuration again and applies the settings that may change without a restart.
+func reloadConfig() {
+	if err := conf.Reload(); err != nil {
+		logger.Error(consts.UserServiceTag, "Failed to reload configuration:", err.Error())
+		return
+	}
+
+	if level, err := parseLogLevel(conf.Log.Level); err != nil {
+		logger.Error(consts.UserServiceTag, "Invalid log level, keeping the previous level:", conf.Log.Level)
+	} else {
+		logOutput.setLevel(level)
+	}
+
+	if limits, err := parseRateLimits(conf.RateLimit.Limits); err != nil {
+		logger.Error(consts.UserServiceTag, "Invalid rate limits, keeping the previous limits:", conf.RateLimit.Limits)
+	} else {
+		requestLimiter.setLimits(limits)
+	}
+
+	logger.Info(consts.UserServiceTag, "Reloaded configuration")
+}
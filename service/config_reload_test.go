@@ -0,0 +1,91 @@
+package service
+
+import (
+	"bytes"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	cases := []struct {
+		value    string
+		expLevel int32
+		expErr   error
+	}{
+		{"", logLevelInfo, nil},
+		{"debug", logLevelDebug, nil},
+		{" Info ", logLevelInfo, nil},
+		{"ERROR", logLevelError, nil},
+		{"fatal", 0, consts.ErrInvalidLogLevel},
+		{"verbose", 0, consts.ErrInvalidLogLevel},
+	}
+
+	for _, c := range cases {
+		level, err := parseLogLevel(c.value)
+		assert.Equal(t, c.expErr, err, c.value)
+		assert.Equal(t, c.expLevel, level, c.value)
+	}
+}
+
+func TestLevelWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &levelWriter{out: &out, level: logLevelError}
+
+	lines := []string{
+		"2026/10/15 08:00:00 " + logger.LogTagInfo + " dropped\n",
+		"2026/10/15 08:00:00 " + logger.LogTagError + " kept\n",
+		"2026/10/15 08:00:00 " + logger.LogTagFatal + " kept\n",
+		"2026/10/15 08:00:00 untagged kept\n",
+	}
+	for _, line := range lines {
+		n, err := w.Write([]byte(line))
+		assert.Nil(t, err, line)
+		assert.Equal(t, len(line), n, line)
+	}
+	assert.Equal(t, lines[1]+lines[2]+lines[3], out.String())
+
+	out.Reset()
+	w.setLevel(logLevelDebug)
+	_, _ = w.Write([]byte(lines[0]))
+	assert.Equal(t, lines[0], out.String())
+}
+
+func TestReloadConfig(t *testing.T) {
+	limiter, level := requestLimiter, logOutput.level
+	logRules, rateLimitRules := conf.Log, conf.RateLimit
+	defer func() {
+		requestLimiter, logOutput.level = limiter, level
+		conf.Log, conf.RateLimit = logRules, rateLimitRules
+	}()
+	requestLimiter = newRateLimiter(nil)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("HWSC_USER_SVC_CONFIG", path)
+
+	desc := "test settings of the config file are applied"
+	assert.Nil(t, os.WriteFile(path,
+		[]byte(`{"hosts": {"log": {"level": "error"}, "ratelimit": {"limits": "CreateUser=1/1s"}}}`), 0600), desc)
+	reloadConfig()
+	assert.Equal(t, logLevelError, logOutput.level, desc)
+	assert.Equal(t, map[string]rateLimit{"CreateUser": {requests: 1, interval: time.Second}},
+		requestLimiter.limits, desc)
+
+	desc = "test invalid settings keep their previous value"
+	assert.Nil(t, os.WriteFile(path,
+		[]byte(`{"hosts": {"log": {"level": "verbose"}, "ratelimit": {"limits": "CreateUser"}}}`), 0600), desc)
+	reloadConfig()
+	assert.Equal(t, logLevelError, logOutput.level, desc)
+	assert.Equal(t, map[string]rateLimit{"CreateUser": {requests: 1, interval: time.Second}},
+		requestLimiter.limits, desc)
+
+	desc = "test unreadable config file changes nothing"
+	assert.Nil(t, os.Remove(path), desc)
+	reloadConfig()
+	assert.Equal(t, logLevelError, logOutput.level, desc)
+}
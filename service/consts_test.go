@@ -5,10 +5,37 @@ import (
 	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
 	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
 	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	"time"
 )
 
+// unitTestServerStream captures response metadata set by handlers outside of a real gRPC server
+type unitTestServerStream struct {
+	header  metadata.MD
+	trailer metadata.MD
+}
+
+func (s *unitTestServerStream) Method() string {
+	return unitTestTag
+}
+
+func (s *unitTestServerStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *unitTestServerStream) SendHeader(md metadata.MD) error {
+	return s.SetHeader(md)
+}
+
+func (s *unitTestServerStream) SetTrailer(md metadata.MD) error {
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
+
 var (
 	unitTestFailValue    = "shouldFail"
 	unitTestFailEmail    = "should@fail.com"
@@ -72,6 +99,8 @@ func unitTestDeleteAuthSecretTable() error {
 	_, err = postgresDB.Exec("DELETE FROM user_security.active_secret")
 
 	currAuthSecret = nil
+	authTokenCache.purge()
+	authTokenVerifier.expire()
 	return err
 }
 
@@ -80,11 +109,11 @@ func unitTestDeleteInsertGetAuthSecret() (*pblib.Secret, error) {
 		return nil, err
 	}
 
-	if err := insertNewAuthSecret(); err != nil {
+	if err := insertNewAuthSecret(context.TODO()); err != nil {
 		return nil, err
 	}
 
-	return getActiveSecretRow()
+	return getActiveSecretRow(context.TODO())
 }
 
 func unitTestInsertNewAuthToken() (*pblib.Secret, string, error) {
@@ -93,6 +122,8 @@ func unitTestInsertNewAuthToken() (*pblib.Secret, string, error) {
 	if err != nil {
 		return nil, "", err
 	}
+	authTokenCache.purge()
+	authTokenVerifier.expire()
 
 	// delete secrets table and generate a new secret
 	newSecret, err := unitTestDeleteInsertGetAuthSecret()
@@ -114,9 +145,52 @@ func unitTestInsertNewAuthToken() (*pblib.Secret, string, error) {
 	}
 
 	// insert a token
-	if err := insertAuthToken(newToken, validAuthTokenHeader, validNoUUIDAuthTokenBody, newSecret); err != nil {
+	if err := insertAuthToken(context.TODO(), newToken, validAuthTokenHeader, validNoUUIDAuthTokenBody, newSecret); err != nil {
 		return nil, "", err
 	}
 
 	return newSecret, newToken, nil
 }
+
+// unitTestInsertUUIDAuthToken inserts a user permission auth token for uuid, signed with the current secret.
+func unitTestInsertUUIDAuthToken(uuid string) (string, error) {
+	newSecret, _, err := unitTestInsertNewAuthToken()
+	if err != nil {
+		return "", err
+	}
+
+	body := &auth.Body{
+		UUID:                uuid,
+		Permission:          auth.User,
+		ExpirationTimestamp: validNoUUIDAuthTokenBody.ExpirationTimestamp,
+	}
+	newToken, err := auth.NewToken(validAuthTokenHeader, body, newSecret)
+	if err != nil {
+		return "", err
+	}
+
+	if err := insertAuthToken(context.TODO(), newToken, validAuthTokenHeader, body, newSecret); err != nil {
+		return "", err
+	}
+
+	return newToken, nil
+}
+
+// unitTestInsertOrganization makes organization, if it is new, so accounts may be set to it directly.
+func unitTestInsertOrganization(organization string) error {
+	err := insertOrganization(context.TODO(), organization, "", time.Now())
+	if err == consts.ErrOrganizationExists {
+		return nil
+	}
+
+	return err
+}
+
+// unitTestServerContext returns a context carrying incoming metadata pairs,
+// and the stream that captures any response metadata set with it.
+func unitTestServerContext(pairs ...string) (context.Context, *unitTestServerStream) {
+	stream := &unitTestServerStream{}
+	ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs(pairs...))
+
+	return grpc.NewContextWithServerTransportStream(ctx, stream), stream
+}
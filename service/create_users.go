@@ -0,0 +1,294 @@
+package service
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"strings"
+)
+
+// createUsersServer is the server side of a CreateUsers stream, every UserRequest received is answered
+// with a UserResponse, in the order they were received.
+type createUsersServer interface {
+	Context() context.Context
+	Send(*pbsvc.UserResponse) error
+	Recv() (*pbsvc.UserRequest, error)
+}
+
+// createUsersStream adapts a grpc.ServerStream to createUsersServer
+type createUsersStream struct {
+	grpc.ServerStream
+}
+
+const (
+	// createUsersBatchSize is the number of users CreateUsers inserts per transaction
+	createUsersBatchSize = 100
+)
+
+var (
+	// createUsersStreamDesc is the CreateUsers rpc of the v2 service, StreamInterceptor runs before it,
+	// the unary interceptors do not
+	createUsersStreamDesc = grpc.StreamDesc{
+		StreamName:    "CreateUsers",
+		Handler:       createUsersHandler,
+		ClientStreams: true,
+		ServerStreams: true,
+	}
+)
+
+func (s *createUsersStream) Send(response *pbsvc.UserResponse) error {
+	return s.ServerStream.SendMsg(response)
+}
+
+func (s *createUsersStream) Recv() (*pbsvc.UserRequest, error) {
+	req := &pbsvc.UserRequest{}
+	if err := s.ServerStream.RecvMsg(req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func createUsersHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(*Service).CreateUsers(&createUsersStream{stream})
+}
+
+// CreateUsers creates a user for every UserRequest streamed by the client, for bulk imports.
+// It requires an admin auth token or a service api key scoped for CreateUsers in the authorization metadata,
+// streams have no request to carry an identification. The caller is recorded as the actor of every user created.
+// Users are inserted createUsersBatchSize at a time, in a transaction per batch, and each gets a verification
+// email like CreateUser. Birthdates and referral codes are not supported.
+// Every request is answered with a UserResponse carrying the status of that user: OK with the created user,
+// InvalidArgument if it is not valid, AlreadyExists if its email belongs to an account or to an earlier
+// request of the stream, or the error that failed its batch.
+// Returns an error status, ending the stream, if the service is unavailable, the instance is a standby,
+// the caller is not authorized, or the stream fails.
+func (s *Service) CreateUsers(stream createUsersServer) error {
+	logger.RequestService("CreateUsers")
+
+	ctx := stream.Context()
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.CreateUsersTag, consts.ErrServiceUnavailable.Error())
+		return consts.ErrStatusServiceUnavailable
+	}
+
+	// the stream skips RegionInterceptor
+	if isStandby {
+		logger.Error(consts.RegionTag, "CreateUsers", consts.ErrStandbyInstance.Error())
+		return standbyStatus(ctx)
+	}
+
+	// bulk imports create accounts for others, only admins may run them
+	token := authorizationToken(ctx)
+	if token == "" {
+		logger.Error(consts.CreateUsersTag, consts.ErrMissingAuthorization.Error())
+		return statusFromError(consts.ErrMissingAuthorization)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		return statusFromError(err)
+	}
+
+	if err := authorizeAdmin(ctx, token, "CreateUsers", ""); err != nil {
+		logger.Error(consts.CreateUsersTag, consts.MsgErrValidatingIdentity, err.Error())
+		return err
+	}
+	actor := tokenActor(token)
+
+	// emails of the stream so far, lower cased, a repeated email is refused without reaching the database
+	seenEmails := make(map[string]bool)
+
+	for {
+		batch, err := recvCreateUsersBatch(stream)
+		if err != nil {
+			logger.Error(consts.CreateUsersTag, err.Error())
+			return statusFromError(err)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return statusFromError(err)
+		}
+
+		for _, response := range createUserBatch(ctx, actor, batch, seenEmails) {
+			if err := stream.Send(response); err != nil {
+				logger.Error(consts.CreateUsersTag, err.Error())
+				return err
+			}
+		}
+	}
+}
+
+// recvCreateUsersBatch receives up to createUsersBatchSize requests from stream.
+// Returns no requests once the client closed the stream, error if the stream failed.
+func recvCreateUsersBatch(stream createUsersServer) ([]*pbsvc.UserRequest, error) {
+	var batch []*pbsvc.UserRequest
+	for len(batch) < createUsersBatchSize {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, req)
+	}
+
+	return batch, nil
+}
+
+// createUserBatch validates batch and inserts its valid users in a single transaction, marking the emails
+// of batch in seenEmails. The users are audited as created by actor.
+// Returns a response per request of batch, in the same order.
+func createUserBatch(ctx context.Context, actor string, batch []*pbsvc.UserRequest,
+	seenEmails map[string]bool) []*pbsvc.UserResponse {
+	responses := make([]*pbsvc.UserResponse, len(batch))
+
+	// validate and dedupe up front, so one bad record does not fail the transaction of the batch
+	var users []*pblib.User
+	var indexes []int
+	for i, req := range batch {
+		if violations := validateCreateUserRequest(req); len(violations) != 0 {
+			// responses cannot carry status details, the violations are listed in the message
+			fields := make([]string, len(violations))
+			for k, violation := range violations {
+				fields[k] = violation.GetField() + " " + violation.GetDescription()
+			}
+			responses[i] = createUsersResponse(req.GetUser(), status.Error(codes.InvalidArgument,
+				consts.ErrInvalidRequestFields.Error()+": "+strings.Join(fields, ", ")))
+			continue
+		}
+
+		user := req.GetUser()
+		user.Email = normalizeEmail(user.GetEmail())
+		if err := checkEmailDomain(ctx, consts.CreateUsersTag, user.GetEmail()); err != nil {
+			responses[i] = createUsersResponse(user, status.Error(codes.InvalidArgument,
+				consts.ErrInvalidRequestFields.Error()+": "+fieldUserEmail+" "+err.Error()))
+			continue
+		}
+		if seenEmails[strings.ToLower(user.GetEmail())] {
+			responses[i] = createUsersResponse(user, statusFromError(consts.ErrEmailExists))
+			continue
+		}
+		seenEmails[strings.ToLower(user.GetEmail())] = true
+
+		users = append(users, user)
+		indexes = append(indexes, i)
+	}
+
+	emails := make([]string, len(users))
+	for i, user := range users {
+		emails[i] = user.GetEmail()
+	}
+	existing, err := getExistingEmails(ctx, emails)
+	if err != nil {
+		logger.Error(consts.CreateUsersTag, consts.MsgErrInsertUser, err.Error())
+		for _, i := range indexes {
+			responses[i] = createUsersResponse(batch[i].GetUser(), statusFromError(err))
+		}
+		return responses
+	}
+
+	var newUsers []*pblib.User
+	var newIndexes []int
+	var emailIDs []*pblib.Identification
+	for j, user := range users {
+		if existing[strings.ToLower(user.GetEmail())] {
+			responses[indexes[j]] = createUsersResponse(user, statusFromError(consts.ErrEmailExists))
+			continue
+		}
+
+		// generate uuid synchronously to prevent users getting the same uuid
+		user.Uuid, err = generateUUID()
+		if err != nil {
+			logger.Error(consts.CreateUsersTag, consts.MsgErrGeneratingUUID, err.Error())
+			responses[indexes[j]] = createUsersResponse(user, statusFromError(err))
+			continue
+		}
+
+		// the email token is inserted with the user so no account lacks one
+		emailID, err := auth.GenerateEmailIdentification(user.GetUuid(), auth.PermissionStringMap[auth.NoPermission])
+		if err != nil {
+			logger.Error(consts.CreateUsersTag, consts.MsgErrGeneratingEmailToken, err.Error())
+			responses[indexes[j]] = createUsersResponse(user, statusFromError(err))
+			continue
+		}
+
+		newUsers = append(newUsers, user)
+		newIndexes = append(newIndexes, indexes[j])
+		emailIDs = append(emailIDs, emailID)
+	}
+	if len(newUsers) == 0 {
+		return responses
+	}
+
+	if _, err := insertNewUsers(ctx, newUsers, emailIDs); err != nil {
+		logger.Error(consts.CreateUsersTag, consts.MsgErrInsertUser, err.Error())
+		for j, user := range newUsers {
+			user.Uuid = ""
+			responses[newIndexes[j]] = createUsersResponse(user, statusFromError(err))
+		}
+		return responses
+	}
+
+	// from here on: the users and their tokens are created, failing to email them is only logged
+	for j, user := range newUsers {
+		logger.Info("Inserted new user:", user.GetUuid(), user.GetFirstName(), user.GetLastName())
+
+		user.Password = ""
+		user.IsVerified = false
+		user.PermissionLevel = auth.PermissionStringMap[auth.NoPermission]
+		publishUserEvent(eventTypeUserCreated, user)
+		recordAudit(ctx, actor, auditActionCreateUser, user.GetUuid())
+
+		sendVerificationEmail(ctx, consts.CreateUsersTag, user, emailIDs[j].GetToken())
+
+		response := createUsersResponse(user, nil)
+		response.Identification = &pblib.Identification{Token: emailIDs[j].GetToken()}
+		responses[newIndexes[j]] = response
+	}
+
+	return responses
+}
+
+// createUsersResponse returns the CreateUsers response of user, with the status of err, user is returned
+// without its password so clients can match responses to their records.
+func createUsersResponse(user *pblib.User, err error) *pbsvc.UserResponse {
+	var responseUser *pblib.User
+	if user != nil {
+		responseUser = &pblib.User{
+			Uuid:            user.GetUuid(),
+			FirstName:       user.GetFirstName(),
+			LastName:        user.GetLastName(),
+			Email:           user.GetEmail(),
+			Organization:    user.GetOrganization(),
+			IsVerified:      user.GetIsVerified(),
+			PermissionLevel: user.GetPermissionLevel(),
+		}
+	}
+
+	if err == nil {
+		return &pbsvc.UserResponse{
+			Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+			Message: codes.OK.String(),
+			User:    responseUser,
+		}
+	}
+
+	st := status.Convert(err)
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(st.Code())},
+		Message: st.Message(),
+		User:    responseUser,
+	}
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unitTestCreateUsersStream replays requests and collects the responses of a CreateUsers stream
+type unitTestCreateUsersStream struct {
+	ctx       context.Context
+	requests  []*pbsvc.UserRequest
+	responses []*pbsvc.UserResponse
+}
+
+func (s *unitTestCreateUsersStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *unitTestCreateUsersStream) Send(response *pbsvc.UserResponse) error {
+	s.responses = append(s.responses, response)
+	return nil
+}
+
+func (s *unitTestCreateUsersStream) Recv() (*pbsvc.UserRequest, error) {
+	if len(s.requests) == 0 {
+		return nil, io.EOF
+	}
+	req := s.requests[0]
+	s.requests = s.requests[1:]
+
+	return req, nil
+}
+
+func TestRecvCreateUsersBatch(t *testing.T) {
+	stream := &unitTestCreateUsersStream{ctx: context.TODO()}
+	for i := 0; i < 2*createUsersBatchSize+1; i++ {
+		stream.requests = append(stream.requests, &pbsvc.UserRequest{})
+	}
+
+	for _, expSize := range []int{createUsersBatchSize, createUsersBatchSize, 1, 0} {
+		batch, err := recvCreateUsersBatch(stream)
+		assert.Nil(t, err)
+		assert.Equal(t, expSize, len(batch))
+	}
+}
+
+func TestCreateUsersRefused(t *testing.T) {
+	standby, limiter := isStandby, requestLimiter
+	defer func() {
+		isStandby, requestLimiter = standby, limiter
+		serviceStateLocker.currentServiceState = available
+	}()
+	// the streams below come from the same peer, earlier tests must not have used up its rate limit
+	requestLimiter = newRateLimiter(nil)
+
+	s := Service{}
+	desc := "test unavailable service"
+	serviceStateLocker.currentServiceState = unavailable
+	err := s.CreateUsers(&unitTestCreateUsersStream{ctx: context.TODO()})
+	assert.Equal(t, codes.Unavailable, status.Code(err), desc)
+
+	desc = "test stream without authorization"
+	serviceStateLocker.currentServiceState = available
+	stream := &unitTestCreateUsersStream{ctx: context.TODO()}
+	stream.requests = append(stream.requests, &pbsvc.UserRequest{User: unitTestUserGenerator("CreateUsers-NoAuth")})
+	err = s.CreateUsers(stream)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+	assert.Empty(t, stream.responses, desc)
+
+	desc = "test stream without authorization through StreamInterceptor"
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	server := grpc.NewServer(grpc.StreamInterceptor(StreamInterceptor))
+	RegisterUserServiceV2(server, &s)
+	go func() { _ = server.Serve(lis) }()
+	defer server.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	clientStream, err := conn.NewStream(context.TODO(), &createUsersStreamDesc, "/user.v2.UserService/CreateUsers")
+	assert.Nil(t, err, desc)
+	_ = clientStream.SendMsg(&pbsvc.UserRequest{User: unitTestUserGenerator("CreateUsers-NoAuth")})
+	assert.Nil(t, clientStream.CloseSend(), desc)
+	err = clientStream.RecvMsg(&pbsvc.UserResponse{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+
+	desc = "test standby instance over the v2 service"
+	isStandby = true
+
+	clientStream, err = conn.NewStream(context.TODO(), &createUsersStreamDesc, "/user.v2.UserService/CreateUsers")
+	assert.Nil(t, err, desc)
+	_ = clientStream.SendMsg(&pbsvc.UserRequest{User: unitTestUserGenerator("CreateUsers-Standby")})
+	assert.Nil(t, clientStream.CloseSend(), desc)
+	err = clientStream.RecvMsg(&pbsvc.UserResponse{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), desc)
+}
+
+func TestCreateUsers(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	existing, err := unitTestInsertUser("CreateUsers-Existing")
+	assert.Nil(t, err)
+
+	valid := unitTestUserGenerator("CreateUsers-Valid")
+	repeated := unitTestUserGenerator("CreateUsers-Repeated")
+	repeated.Email = strings.ToUpper(valid.GetEmail()[:1]) + valid.GetEmail()[1:]
+	invalid := unitTestUserGenerator("CreateUsers-Invalid")
+	invalid.Email = "not an email"
+	taken := unitTestUserGenerator("CreateUsers-Taken")
+	taken.Email = existing.GetUser().GetEmail()
+
+	s := Service{}
+	newSecret, userToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err)
+
+	desc := "test user token is denied"
+	userCtx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs(metadataKeyAuthorization, userToken))
+	stream := &unitTestCreateUsersStream{ctx: userCtx}
+	stream.requests = append(stream.requests, &pbsvc.UserRequest{User: valid})
+	assert.Equal(t, codes.PermissionDenied, status.Code(s.CreateUsers(stream)), desc)
+	assert.Empty(t, stream.responses, desc)
+
+	adminHeader := &auth.Header{Alg: auth.Hs512, TokenTyp: auth.Jwt}
+	adminBody := &auth.Body{
+		UUID:                auth.ExtractUUID(userToken),
+		Permission:          auth.Admin,
+		ExpirationTimestamp: validNoUUIDAuthTokenBody.ExpirationTimestamp,
+	}
+	adminToken, err := auth.NewToken(adminHeader, adminBody, newSecret)
+	assert.Nil(t, err)
+	assert.Nil(t, insertAuthToken(context.TODO(), adminToken, adminHeader, adminBody, newSecret))
+
+	adminCtx := metadata.NewIncomingContext(context.TODO(),
+		metadata.Pairs(metadataKeyAuthorization, "Bearer "+adminToken))
+	stream = &unitTestCreateUsersStream{ctx: adminCtx}
+	for _, user := range []*pblib.User{valid, repeated, invalid, taken} {
+		stream.requests = append(stream.requests, &pbsvc.UserRequest{User: user})
+	}
+
+	assert.Nil(t, s.CreateUsers(stream))
+	if !assert.Equal(t, 4, len(stream.responses)) {
+		return
+	}
+
+	desc = "test valid user is created"
+	assert.Equal(t, uint32(codes.OK), stream.responses[0].GetCode(), desc)
+	assert.NotEmpty(t, stream.responses[0].GetUser().GetUuid(), desc)
+	assert.Empty(t, stream.responses[0].GetUser().GetPassword(), desc)
+	_, err = getUserRow(context.TODO(), stream.responses[0].GetUser().GetUuid())
+	assert.Nil(t, err, desc)
+
+	desc = "test admin is audited as the creator"
+	entries, err := getAuditEntries(context.TODO(), 0, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), 1000)
+	assert.Nil(t, err, desc)
+	var actor string
+	for _, entry := range entries {
+		if entry.action == auditActionCreateUser && entry.target == stream.responses[0].GetUser().GetUuid() {
+			actor = entry.actor
+		}
+	}
+	assert.Equal(t, auth.ExtractUUID(adminToken), actor, desc)
+
+	desc = "test email repeated in the stream"
+	assert.Equal(t, uint32(codes.AlreadyExists), stream.responses[1].GetCode(), desc)
+	assert.Empty(t, stream.responses[1].GetUser().GetUuid(), desc)
+
+	desc = "test invalid user"
+	assert.Equal(t, uint32(codes.InvalidArgument), stream.responses[2].GetCode(), desc)
+
+	desc = "test email of an existing account"
+	assert.Equal(t, uint32(codes.AlreadyExists), stream.responses[3].GetCode(), desc)
+}
@@ -1,7 +1,9 @@
 package service
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
 	"github.com/hwsc-org/hwsc-lib/auth"
@@ -11,10 +13,12 @@ import (
 	"github.com/hwsc-org/hwsc-user-svc/conf"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
 	// database/sql uses this library indirectly
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"os"
 	"os/signal"
 	"syscall"
@@ -37,6 +41,28 @@ type tokenEmailRow struct {
 
 const (
 	dbDriverName = "postgres"
+
+	// insertAccountCommand inserts a new, unverified account, password_changed_timestamp is the created_timestamp
+	insertAccountCommand = `
+				INSERT INTO user_svc.accounts(
+					uuid, first_name, last_name, email, password, 
+				    organization, created_timestamp, is_verified, permission_level,
+				    birthdate, parental_consent_required, referral_code, password_changed_timestamp,
+				    middle_name, display_name
+				) VALUES($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9, $10, $11, $12, $7, NULLIF($13, ''), NULLIF($14, ''))
+				`
+
+	// registerOrganizationCommand makes the organization an account names, if it is new.
+	// Organizations first named by an account have no creator, see insertOrganization.
+	registerOrganizationCommand = `INSERT INTO user_svc.organizations(name, created_timestamp)
+				SELECT $1::TEXT, $2 WHERE $1::TEXT <> ''
+				ON CONFLICT (name) DO NOTHING
+				`
+
+	// insertEmailTokenCommand inserts the verification token of a user, see emailTokenArgs
+	insertEmailTokenCommand = `INSERT INTO user_svc.email_tokens(token, secret_key, created_timestamp, expiration_timestamp, uuid) 
+				VALUES($1, $2, $3, $4, $5)
+				`
 )
 
 var (
@@ -51,7 +77,7 @@ func init() {
 		conf.UserDB.Host, conf.UserDB.User, conf.UserDB.Password, conf.UserDB.Name, conf.UserDB.SSLMode, conf.UserDB.Port)
 
 	// Handle Terminate Signal(Ctrl + C) gracefully
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -64,14 +90,19 @@ func init() {
 }
 
 // refreshDBConnection verifies if connection is alive, ping will establish c/n if necessary.
+// A new connection pool is limited by dbPool.
+// With fault injection enabled, it is where artificial db latency is added.
 // Returns response object if ping failed to reconnect.
 func refreshDBConnection() error {
+	faults.delayDB()
+
 	if postgresDB == nil {
 		var err error
 		postgresDB, err = sql.Open(dbDriverName, connectionString)
 		if err != nil {
 			return err
 		}
+		dbPool.apply(postgresDB)
 	}
 
 	if err := postgresDB.Ping(); err != nil {
@@ -86,100 +117,455 @@ func refreshDBConnection() error {
 
 // insertNewUser checks user field validity, hashes password and.
 // Inserts new users to user_svc.accounts table.
-// Returns error if User is nil or if error with inserting to database.
-func insertNewUser(user *pblib.User) error {
+// names are optional, empty names are stored as NULL.
+// birthdate is optional, a zero birthdate is stored as NULL. Users under parentalConsentAge at signup
+// are marked as requiring parental consent.
+// referralCode is optional, a non empty code links the user to the code's owner in user_svc.referrals.
+// emailID is optional, a non nil identification is inserted to user_svc.email_tokens in the same transaction,
+// so the user is not created without its verification token.
+// Returns the user's own referral code.
+// Returns ErrInvalidReferralCode if referralCode belongs to no user, error if User is nil or if error with inserting to database.
+func insertNewUser(ctx context.Context, user *pblib.User, names userNames, birthdate time.Time,
+	referralCode string, emailID *pblib.Identification) (string, error) {
 	if user == nil {
-		return consts.ErrNilRequestUser
+		return "", consts.ErrNilRequestUser
 	}
 
 	// check if uuid is valid form
 	if err := validation.ValidateUserUUID(user.GetUuid()); err != nil {
-		return err
+		return "", err
 	}
 
 	// validate fields in user object
 	if err := validateUser(user); err != nil {
-		return err
+		return "", err
+	}
+
+	var tokenArgs []interface{}
+	if emailID != nil {
+		var err error
+		if tokenArgs, err = emailTokenArgs(user.GetUuid(), emailID.GetToken(), emailID.GetSecret()); err != nil {
+			return "", err
+		}
+	}
+
+	// skip the bcrypt cost if the client already gave up
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
 
 	// hash password using bcrypt
 	hashedPassword, err := hashPassword(user.GetPassword())
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	command := `
-				INSERT INTO user_svc.accounts(
-					uuid, first_name, last_name, email, password, 
-				    organization, created_timestamp, is_verified, permission_level
-				) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
-				`
+	ownReferralCode, err := generateReferralCode()
+	if err != nil {
+		return "", err
+	}
+
+	createdTimestamp := time.Now().UTC()
+	var storedBirthdate interface{}
+	if !birthdate.IsZero() {
+		storedBirthdate = birthdate.Format(birthdateLayout)
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tx.ExecContext(ctx, registerOrganizationCommand, user.GetOrganization(),
+		createdTimestamp); err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
 
-	_, err = postgresDB.Exec(command, user.GetUuid(), user.GetFirstName(), user.GetLastName(),
+	_, err = tx.ExecContext(ctx, insertAccountCommand, user.GetUuid(), user.GetFirstName(), user.GetLastName(),
 		user.GetEmail(), hashedPassword, user.GetOrganization(),
-		time.Now().UTC(), false, auth.PermissionStringMap[auth.NoPermission])
+		createdTimestamp, false, auth.PermissionStringMap[auth.NoPermission],
+		storedBirthdate, requiresParentalConsent(birthdate, createdTimestamp), ownReferralCode,
+		names.middleName, names.displayName)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	if referralCode != "" {
+		command := `INSERT INTO user_svc.referrals(referee_uuid, referrer_uuid, referral_code, created_timestamp)
+					SELECT $1, uuid, referral_code, $2
+					FROM user_svc.accounts
+					WHERE referral_code = $3
+					`
+		result, err := tx.ExecContext(ctx, command, user.GetUuid(), createdTimestamp, referralCode)
+		if err != nil {
+			_ = tx.Rollback()
+			return "", err
+		}
+
+		// the user is not created with a code that matches no one
+		if linked, err := result.RowsAffected(); err != nil || linked == 0 {
+			_ = tx.Rollback()
+			if err != nil {
+				return "", err
+			}
+			return "", consts.ErrInvalidReferralCode
+		}
+	}
+
+	if tokenArgs != nil {
+		if _, err := tx.ExecContext(ctx, insertEmailTokenCommand, tokenArgs...); err != nil {
+			_ = tx.Rollback()
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return ownReferralCode, nil
+}
+
+// insertNewUsers checks user field validity, hashes passwords and inserts users to user_svc.accounts,
+// with the email token of emailIDs at the same index, in a single transaction, either every user is inserted
+// or none is. Users are inserted without a birthdate or referral.
+// Returns the users' own referral codes in the order of users.
+// Returns error if a User is nil, emailIDs does not match users or if error with inserting to database.
+func insertNewUsers(ctx context.Context, users []*pblib.User, emailIDs []*pblib.Identification) ([]string, error) {
+	if len(emailIDs) != len(users) {
+		return nil, consts.ErrNilRequestIdentification
+	}
+
+	hashedPasswords := make([]string, len(users))
+	ownReferralCodes := make([]string, len(users))
+	tokenArgs := make([][]interface{}, len(users))
+	for i, user := range users {
+		if user == nil {
+			return nil, consts.ErrNilRequestUser
+		}
+
+		if err := validation.ValidateUserUUID(user.GetUuid()); err != nil {
+			return nil, err
+		}
+
+		if err := validateUser(user); err != nil {
+			return nil, err
+		}
+
+		args, err := emailTokenArgs(user.GetUuid(), emailIDs[i].GetToken(), emailIDs[i].GetSecret())
+		if err != nil {
+			return nil, err
+		}
+		tokenArgs[i] = args
+
+		// skip the remaining bcrypt cost if the client already gave up
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		hashedPassword, err := hashPassword(user.GetPassword())
+		if err != nil {
+			return nil, err
+		}
+		hashedPasswords[i] = hashedPassword
+
+		ownReferralCodes[i], err = generateReferralCode()
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	createdTimestamp := time.Now().UTC()
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
 	if err != nil {
+		return nil, err
+	}
+
+	for i, user := range users {
+		if _, err := tx.ExecContext(ctx, registerOrganizationCommand, user.GetOrganization(),
+			createdTimestamp); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+
+		if _, err := tx.ExecContext(ctx, insertAccountCommand, user.GetUuid(), user.GetFirstName(),
+			user.GetLastName(), user.GetEmail(), hashedPasswords[i], user.GetOrganization(),
+			createdTimestamp, false, auth.PermissionStringMap[auth.NoPermission],
+			nil, false, ownReferralCodes[i], "", ""); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+
+		if _, err := tx.ExecContext(ctx, insertEmailTokenCommand, tokenArgs[i]...); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return ownReferralCodes, nil
+}
+
+// getExistingEmails returns which of emails already belong to an account, deleted or not, lower cased
+// like user_svc_accounts_email_lower_index compares them.
+// Returns error if error with querying the database.
+func getExistingEmails(ctx context.Context, emails []string) (map[string]bool, error) {
+	existing := make(map[string]bool)
+	if len(emails) == 0 {
+		return existing, nil
+	}
+
+	lowered := make([]string, len(emails))
+	for i, email := range emails {
+		lowered[i] = strings.ToLower(email)
+	}
+
+	var rows *sql.Rows
+	err := withDBRetry(ctx, func() (err error) {
+		rows, err = postgresDB.QueryContext(ctx,
+			`SELECT LOWER(email) FROM user_svc.accounts WHERE LOWER(email) = ANY($1)`, pq.Array(lowered))
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return nil
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		existing[email] = true
+	}
+
+	return existing, rows.Err()
 }
 
 // insertEmailToken inserts received token and secret to user_svc.email_tokens.
 // Returns error if strings are empty or error with inserting to database.
-func insertEmailToken(uuid string, token string, secret *pblib.Secret) error {
+func insertEmailToken(ctx context.Context, uuid string, token string, secret *pblib.Secret) error {
+	args, err := emailTokenArgs(uuid, token, secret)
+	if err != nil {
+		return err
+	}
+
+	_, err = postgresDB.ExecContext(ctx, insertEmailTokenCommand, args...)
+	return err
+}
+
+// emailTokenArgs validates the fields of an email token and returns them as the arguments of
+// insertEmailTokenCommand.
+// Returns error if strings are empty or secret is not valid.
+func emailTokenArgs(uuid string, token string, secret *pblib.Secret) ([]interface{}, error) {
 	// check if uuid is valid form
 	if err := validation.ValidateUserUUID(uuid); err != nil {
-		return err
+		return nil, err
 	}
 
 	if token == "" {
-		return authconst.ErrEmptyToken
+		return nil, authconst.ErrEmptyToken
 	}
 
 	if err := auth.ValidateSecret(secret); err != nil {
-		return err
+		return nil, err
 	}
 
 	createdTimestamp := time.Unix(secret.GetCreatedTimestamp(), 0).UTC()
 	expirationTimestamp := time.Unix(secret.GetExpirationTimestamp(), 0).UTC()
 
-	command := `INSERT INTO user_svc.email_tokens(token, secret_key, created_timestamp, expiration_timestamp, uuid) 
+	return []interface{}{token, secret.GetKey(), createdTimestamp, expirationTimestamp, uuid}, nil
+}
+
+// replaceEmailToken stores token as the email token of uuid, replacing the token of any previous verification
+// email unless it was created less than cooldown before secret, so the previous link stops working.
+// Returns the time the token of uuid may be replaced again, ErrVerificationResendCooldown with that time if
+// token was not stored, error if uuid, token or secret are invalid, or any db error.
+func replaceEmailToken(ctx context.Context, uuid string, token string, secret *pblib.Secret,
+	cooldown time.Duration) (time.Time, error) {
+	args, err := emailTokenArgs(uuid, token, secret)
+	if err != nil {
+		return time.Time{}, err
+	}
+	created := time.Unix(secret.GetCreatedTimestamp(), 0).UTC()
+
+	command := `INSERT INTO user_svc.email_tokens(token, secret_key, created_timestamp, expiration_timestamp, uuid)
 				VALUES($1, $2, $3, $4, $5)
+				ON CONFLICT (uuid) DO UPDATE SET
+					token = EXCLUDED.token,
+					secret_key = EXCLUDED.secret_key,
+					created_timestamp = EXCLUDED.created_timestamp,
+					expiration_timestamp = EXCLUDED.expiration_timestamp
+				WHERE user_svc.email_tokens.created_timestamp <= $6
+				RETURNING created_timestamp
 				`
-	_, err := postgresDB.Exec(command, token, secret.GetKey(), createdTimestamp, expirationTimestamp, uuid)
+	var stored time.Time
+	err = postgresDB.QueryRowContext(ctx, command, append(args, created.Add(-cooldown))...).Scan(&stored)
+	if err == nil {
+		return stored.Add(cooldown), nil
+	}
+	if err != sql.ErrNoRows {
+		return time.Time{}, err
+	}
+
+	// the token of the previous email is too recent and was kept
+	var previous time.Time
+	err = postgresDB.QueryRowContext(ctx, `SELECT created_timestamp FROM user_svc.email_tokens WHERE uuid = $1`,
+		uuid).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return created.Add(cooldown), consts.ErrVerificationResendCooldown
+	}
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
 
-	return nil
+	return previous.Add(cooldown), consts.ErrVerificationResendCooldown
 }
 
 // deleteUser deletes user from user_svc.accounts.
 // Deleting non-existent uuid does not throw an error, db simply returns nothing which is okay.
-// Returns error if string is empty or error with deleting from database.
-func deleteUserRow(uuid string) error {
+// Returns the number of deleted rows, error if string is empty or error with deleting from database.
+func deleteUserRow(ctx context.Context, uuid string) (int64, error) {
 	// check if uuid is valid form
 	if err := validation.ValidateUserUUID(uuid); err != nil {
-		return err
+		return 0, err
 	}
 
 	command := `DELETE FROM user_svc.accounts WHERE user_svc.accounts.uuid = $1`
-	_, err := postgresDB.Exec(command, uuid)
+	result, err := postgresDB.ExecContext(ctx, command, uuid)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// softDeleteUserRow marks a user row deleted at now, the row is purged by the soft deleted users retention rule.
+// Users already soft deleted keep their deletion time.
+// Returns the number of rows marked, 0 if the user does not exist or was already deleted, or any db error.
+func softDeleteUserRow(ctx context.Context, uuid string, now time.Time) (int64, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return 0, err
+	}
+
+	command := `UPDATE user_svc.accounts SET deleted_timestamp = $2
+				WHERE uuid = $1 AND deleted_timestamp IS NULL
+				`
+	result, err := postgresDB.ExecContext(ctx, command, uuid, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// deleteOrganizationUsers deletes every user of organization in one transaction, or marks them deleted at now if
+// soft, and revokes their auth and refresh tokens like revokeAuthTokens. A dry run rolls the transaction back.
+// Returns the uuids of the users deleted, or that a dry run would delete, in uuid order, or any db error.
+func deleteOrganizationUsers(ctx context.Context, organization string, soft bool, dryRun bool,
+	now time.Time) ([]string, error) {
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// lock the users so accounts joining or leaving the organization meanwhile are not half deleted
+	rows, err := tx.QueryContext(ctx, `SELECT uuid FROM user_svc.accounts
+				WHERE organization = $1 AND deleted_timestamp IS NULL
+				ORDER BY uuid
+				FOR UPDATE`, organization)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
 
+	var uuids []string
+	for rows.Next() {
+		var uuid string
+		if err := rows.Scan(&uuid); err != nil {
+			_ = rows.Close()
+			_ = tx.Rollback()
+			return nil, err
+		}
+		uuids = append(uuids, uuid)
+	}
+	if err := rows.Err(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if dryRun || len(uuids) == 0 {
+		return uuids, tx.Rollback()
+	}
+
+	command := `DELETE FROM user_svc.accounts WHERE uuid = ANY($1::TEXT[])`
+	args := []interface{}{pq.Array(uuids)}
+	if soft {
+		command = `UPDATE user_svc.accounts SET deleted_timestamp = $2 WHERE uuid = ANY($1::TEXT[])`
+		args = append(args, now.UTC())
+	}
+
+	commands := []struct {
+		command string
+		args    []interface{}
+	}{
+		{command, args},
+		{`DELETE FROM user_security.auth_tokens WHERE uuid = ANY($1::TEXT[])`, []interface{}{pq.Array(uuids)}},
+		{`DELETE FROM user_security.refresh_tokens WHERE uuid = ANY($1::TEXT[])`, []interface{}{pq.Array(uuids)}},
+		{`INSERT INTO user_security.revocations(uuid, revoked_timestamp) SELECT UNNEST($1::TEXT[]), $2`,
+			[]interface{}{pq.Array(uuids), now.UTC()}},
+	}
+	for _, c := range commands {
+		if _, err := tx.ExecContext(ctx, c.command, c.args...); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return uuids, nil
+}
+
+// restoreUserRow undoes softDeleteUserRow, forgotten users stay deleted.
+// Returns ErrUserNotFound if the user is not soft deleted, was purged or forgotten, or any db error.
+func restoreUserRow(ctx context.Context, uuid string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	command := `UPDATE user_svc.accounts SET deleted_timestamp = NULL
+				WHERE uuid = $1 AND deleted_timestamp IS NOT NULL AND forgotten_timestamp IS NULL
+				`
+	result, err := postgresDB.ExecContext(ctx, command, uuid)
+	if err != nil {
+		return err
+	}
+
+	restored, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if restored == 0 {
+		return consts.ErrUserNotFound
+	}
 
 	return nil
 }
 
 // getUserRow looks up a user by its uuid and stores the result in a pb.User struct.
-// Retrieving non-existent uuid does not throw an error, db simply returns nothing.
-// So we put in a check to see if uuid exists to return error if not found.
-// Returns pb.User struct if found, nil otherwise, error if uuid does not exist or err with db.
-func getUserRow(uuid string) (*pblib.User, error) {
+// A replica serves the read if ctx was marked by withReplicaReads.
+// Returns pb.User struct if found, ErrUserNotFound if uuid does not exist, or err with db.
+func getUserRow(ctx context.Context, uuid string) (*pblib.User, error) {
 	// check if uuid is valid form
 	if err := validation.ValidateUserUUID(uuid); err != nil {
 		return nil, err
@@ -187,60 +573,64 @@ func getUserRow(uuid string) (*pblib.User, error) {
 
 	command := `SELECT uuid, first_name, last_name, email, organization, 
        				created_timestamp, is_verified, password, permission_level, prospective_email
-				FROM user_svc.accounts WHERE user_svc.accounts.uuid = $1
+				FROM user_svc.accounts WHERE user_svc.accounts.uuid = $1 AND deleted_timestamp IS NULL
 				`
-	row, err := postgresDB.Query(command, uuid)
+
+	var foundUser *pblib.User
+	err := readReplica(ctx, func(db *sql.DB) (err error) {
+		foundUser, err = scanUserRow(db.QueryRowContext(ctx, command, uuid))
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrUserNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	defer row.Close()
-
-	var foundUser *pblib.User
-	for row.Next() {
-		var prospectiveEmailNullable sql.NullString
-		var uid, firstName, lastName, email, organization, password, permissionLevel, prospectiveEmail string
-		var isVerified bool
-		var createdTimestamp time.Time
-
-		err := row.Scan(&uid, &firstName, &lastName, &email, &organization,
-			&createdTimestamp, &isVerified, &password, &permissionLevel, &prospectiveEmailNullable)
-		if err != nil {
-			return nil, err
-		}
+	return foundUser, nil
+}
 
-		if prospectiveEmailNullable.Valid {
-			prospectiveEmail = prospectiveEmailNullable.String
-		}
+// scanUserRow scans a row selected with the column order used by getUserRow into a pb.User struct.
+// Returns sql.ErrNoRows if the query matched nothing.
+func scanUserRow(row *sql.Row) (*pblib.User, error) {
+	var prospectiveEmailNullable, organization sql.NullString
+	var uuid, firstName, lastName, email, password, permissionLevel, prospectiveEmail string
+	var isVerified bool
+	var createdTimestamp time.Time
 
-		foundUser = &pblib.User{
-			Uuid:             uid,
-			FirstName:        firstName,
-			LastName:         lastName,
-			Email:            email,
-			Organization:     organization,
-			CreatedTimestamp: createdTimestamp.Unix(),
-			IsVerified:       isVerified,
-			Password:         password,
-			PermissionLevel:  permissionLevel,
-			ProspectiveEmail: prospectiveEmail,
-		}
-	}
-	if err := row.Err(); err != nil {
+	err := row.Scan(&uuid, &firstName, &lastName, &email, &organization,
+		&createdTimestamp, &isVerified, &password, &permissionLevel, &prospectiveEmailNullable)
+	if err != nil {
 		return nil, err
 	}
 
-	if foundUser == nil {
-		return nil, consts.ErrUserNotFound
+	if prospectiveEmailNullable.Valid {
+		prospectiveEmail = prospectiveEmailNullable.String
 	}
 
-	return foundUser, nil
+	return &pblib.User{
+		Uuid:             uuid,
+		FirstName:        firstName,
+		LastName:         lastName,
+		Email:            email,
+		Organization:     organization.String,
+		CreatedTimestamp: createdTimestamp.Unix(),
+		IsVerified:       isVerified,
+		Password:         password,
+		PermissionLevel:  permissionLevel,
+		ProspectiveEmail: prospectiveEmail,
+	}, nil
 }
 
 // updateUser does a partial update by going through each User fields and replacing values.
 // that are different from original values. It's partial b/c some fields like created_timestamp & uuid are not touched.
-// Return error if params are zero values or querying problem.
-func updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (*pblib.User, error) {
+// Empty fields in svcDerived and names are left unchanged, optional fields named in clearFields are blanked out
+// instead.
+// A different permission level is written as given, callers authorize the change.
+// Return error if params are zero values, a cleared field is also given a value or querying problem.
+func updateUserRow(ctx context.Context, uuid string, svcDerived *pblib.User, dbDerived *pblib.User,
+	names userNames, clearFields map[string]bool) (*pblib.User, error) {
 	if svcDerived == nil || dbDerived == nil {
 		return nil, consts.ErrNilRequestUser
 	}
@@ -266,15 +656,41 @@ func updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (
 	}
 
 	newOrganization := dbDerived.GetOrganization()
-	if svcDerived.GetOrganization() != "" && svcDerived.GetOrganization() != newOrganization {
+	if clearFields[userFieldOrganization] {
+		if svcDerived.GetOrganization() != "" {
+			return nil, consts.ErrConflictingClearField
+		}
+		newOrganization = ""
+	} else if svcDerived.GetOrganization() != "" && svcDerived.GetOrganization() != newOrganization {
 		if err := validateOrganization(svcDerived.GetOrganization()); err != nil {
 			return nil, err
 		}
 		newOrganization = svcDerived.GetOrganization()
 	}
 
+	if clearFields[userFieldMiddleName] && names.middleName != "" {
+		return nil, consts.ErrConflictingClearField
+	}
+	if names.middleName != "" {
+		if err := validateMiddleName(names.middleName); err != nil {
+			return nil, err
+		}
+	}
+
+	if clearFields[userFieldDisplayName] && names.displayName != "" {
+		return nil, consts.ErrConflictingClearField
+	}
+	if names.displayName != "" {
+		if err := validateDisplayName(names.displayName); err != nil {
+			return nil, err
+		}
+	}
+
 	newHashedPassword := dbDerived.GetPassword()
 	if svcDerived.GetPassword() != "" {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		// hash password using bcrypt
 		hashedPassword, err := hashPassword(svcDerived.GetPassword())
 		if err != nil {
@@ -283,17 +699,24 @@ func updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (
 		newHashedPassword = hashedPassword
 	}
 
+	newPermissionLevel := dbDerived.GetPermissionLevel()
+	if svcDerived.GetPermissionLevel() != "" && svcDerived.GetPermissionLevel() != newPermissionLevel {
+		if err := validatePermissionLevel(svcDerived.GetPermissionLevel()); err != nil {
+			return nil, err
+		}
+		newPermissionLevel = svcDerived.GetPermissionLevel()
+	}
+
 	newIsVerified := dbDerived.GetIsVerified()
 
 	newEmail := ""
-	var newEmailID *pblib.Identification
 	if svcDerived.GetEmail() != "" && svcDerived.GetEmail() != dbDerived.GetEmail() {
 		if err := validateEmail(svcDerived.GetEmail()); err != nil {
 			return nil, err
 		}
 		newEmail = svcDerived.GetEmail()
 
-		emailTaken, err := isEmailTaken(newEmail)
+		emailTaken, err := isEmailTaken(ctx, newEmail)
 		if err != nil {
 			return nil, err
 		}
@@ -301,111 +724,192 @@ func updateUserRow(uuid string, svcDerived *pblib.User, dbDerived *pblib.User) (
 		if emailTaken {
 			return nil, consts.ErrEmailExists
 		}
-
-		// create unique email token
-		id, err := auth.GenerateEmailIdentification(dbDerived.GetUuid(), dbDerived.GetPermissionLevel())
-		if err != nil {
-			// does not return error because we can regen a token and thus resend email
-			logger.Error(consts.UpdatingUserRowTag, consts.MsgErrGeneratingEmailToken, err.Error())
-		}
-		newEmailID = id
-		newIsVerified = false
 	}
 
 	if newFirstName == "" && newLastName == "" && newOrganization == "" && newHashedPassword == "" && newEmail == "" {
 		return nil, consts.ErrEmptyRequestUser
 	}
 
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the reservation settles races between users asking for the same prospective email
+	lapsedHolder, err := reserveProspectiveEmail(ctx, tx, uuid, newEmail)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	// members that leave an organization stop administering it
+	if newOrganization != dbDerived.GetOrganization() {
+		if _, err := tx.ExecContext(ctx, registerOrganizationCommand, newOrganization, now); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM user_svc.organization_admins WHERE uuid = $1`,
+			uuid); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+	}
+
 	command := `UPDATE user_svc.accounts SET 
                 	first_name = $2,
                     last_name = $3, 
-                    organization = $4, 
+                    organization = NULLIF($4, ''), 
                     password = $5, 
                     prospective_email = (CASE WHEN LENGTH($6) = 0 THEN NULL ELSE $6 END),
 					is_verified = $7,
-                    modified_timestamp = $8
+                    modified_timestamp = $8,
+                    password_changed_timestamp = (CASE WHEN $9 THEN $8 ELSE password_changed_timestamp END),
+                    password_reminder_timestamp = (CASE WHEN $9 THEN NULL ELSE password_reminder_timestamp END),
+                    permission_level = $10,
+                    middle_name = (CASE WHEN $11 THEN NULL ELSE COALESCE(NULLIF($12, ''), middle_name) END),
+                    display_name = (CASE WHEN $13 THEN NULL ELSE COALESCE(NULLIF($14, ''), display_name) END)
 				WHERE user_svc.accounts.uuid = $1
 				`
-	_, err := postgresDB.Exec(command, uuid, newFirstName, newLastName, newOrganization,
-		newHashedPassword, newEmail, newIsVerified, time.Now().UTC())
+	_, err = tx.ExecContext(ctx, command, uuid, newFirstName, newLastName, newOrganization,
+		newHashedPassword, newEmail, newIsVerified, now, svcDerived.GetPassword() != "", newPermissionLevel,
+		clearFields[userFieldMiddleName], names.middleName, clearFields[userFieldDisplayName], names.displayName)
 	if err != nil {
+		_ = tx.Rollback()
 		return nil, err
 	}
 
-	updatedUser := &pblib.User{
-		Uuid:             uuid,
-		FirstName:        newFirstName,
-		LastName:         newLastName,
-		Organization:     newOrganization,
-		Email:            newEmail,
-		IsVerified:       newIsVerified,
-		ProspectiveEmail: newEmail,
+	requestedEmail := dbDerived.GetEmail()
+	if newEmail != "" {
+		requestedEmail = newEmail
 	}
-
-	// new email process
-	if newEmailID != nil {
-		// do not return error b/c we can resend verification emails
-		if err := insertEmailToken(uuid, newEmailID.GetToken(), newEmailID.GetSecret()); err != nil {
-			logger.Error(consts.UpdateUserTag, consts.MsgErrInsertEmailToken, err.Error())
-			return updatedUser, nil
-		}
-		// generate a new verification link
-		verificationLink, err := generateEmailVerifyLink(newEmailID.GetToken())
-		if err != nil {
-			logger.Error(consts.UpdateUserTag, consts.MsgErrGeneratingEmailVerifyLink, err.Error())
-			return updatedUser, nil
-		}
-		// send email
-		emailData := make(map[string]string)
-		if verificationLink != "" {
-			emailData[verificationLinkKey] = verificationLink
-			return updatedUser, nil
-		}
-		emailReq, err := newEmailRequest(emailData, []string{newEmail}, conf.EmailHost.Username, subjectUpdateEmail)
-		if err != nil {
-			logger.Error(consts.UpdateUserTag, consts.MsgErrEmailRequest, err.Error())
-			return updatedUser, nil
-		}
-		if err := emailReq.sendEmail(templateUpdateEmail); err != nil {
-			logger.Error(consts.UpdateUserTag, consts.MsgErrSendEmail, err.Error())
-			return updatedUser, nil
+	// a new password signs out clients that were kept signed in with the old one
+	if svcDerived.GetPassword() != "" {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM user_security.refresh_tokens WHERE uuid = $1`,
+			uuid); err != nil {
+			_ = tx.Rollback()
+			return nil, err
 		}
 	}
 
+	changes := diffProfile(uuid, dbDerived, &pblib.User{
+		FirstName:    newFirstName,
+		LastName:     newLastName,
+		Organization: newOrganization,
+		Email:        requestedEmail,
+		Password:     newHashedPassword,
+	})
+	if err := insertProfileChanges(ctx, tx, uuid, changes, now); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if lapsedHolder != "" {
+		invalidateCachedUser(lapsedHolder)
+	}
+
+	updatedUser := &pblib.User{
+		Uuid:             uuid,
+		FirstName:        newFirstName,
+		LastName:         newLastName,
+		Organization:     newOrganization,
+		Email:            newEmail,
+		IsVerified:       newIsVerified,
+		PermissionLevel:  newPermissionLevel,
+		ProspectiveEmail: newEmail,
+	}
+
 	return updatedUser, nil
 }
 
+// reserveProspectiveEmail reserves email for uuid for prospectiveEmailHold and releases
+// the other reservations of uuid, an empty email only releases them.
+// A lapsed reservation of another user is taken over and their prospective email is cleared.
+// Returns the uuid of the user whose lapsed reservation was taken over, if any,
+// ErrEmailReserved if another user holds an unexpired reservation, or any db error.
+func reserveProspectiveEmail(ctx context.Context, tx *sql.Tx, uuid string, email string) (string, error) {
+	_, err := tx.ExecContext(ctx, `DELETE FROM user_svc.email_reservations
+				WHERE uuid = $1 AND email <> LOWER($2)`, uuid, email)
+	if err != nil || email == "" {
+		return "", err
+	}
+
+	expirationTimestamp := time.Now().UTC().Add(prospectiveEmailHold)
+
+	// concurrent inserts of the same email wait on each other here, only one of them inserts a row
+	result, err := tx.ExecContext(ctx, `INSERT INTO user_svc.email_reservations(email, uuid, expiration_timestamp)
+				VALUES(LOWER($1), $2, $3)
+				ON CONFLICT (email) DO NOTHING`, email, uuid, expirationTimestamp)
+	if err != nil {
+		return "", err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 1 {
+		return "", err
+	}
+
+	var holder string
+	var holdExpiration time.Time
+	err = tx.QueryRowContext(ctx, `SELECT uuid, expiration_timestamp
+				FROM user_svc.email_reservations
+				WHERE email = LOWER($1)
+				FOR UPDATE`, email).Scan(&holder, &holdExpiration)
+	if err == sql.ErrNoRows {
+		// the holder released it in the meantime, the client can retry
+		return "", consts.ErrEmailReserved
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if holder != uuid && holdExpiration.After(time.Now()) {
+		return "", consts.ErrEmailReserved
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE user_svc.email_reservations
+				SET uuid = $2, expiration_timestamp = $3
+				WHERE email = LOWER($1)`, email, uuid, expirationTimestamp)
+	if err != nil || holder == uuid {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE user_svc.accounts
+				SET prospective_email = NULL
+				WHERE uuid = $1 AND LOWER(prospective_email) = LOWER($2)`, holder, email)
+	if err != nil {
+		return "", err
+	}
+
+	return holder, nil
+}
+
 // getActiveSecretRow retrieves active key information from active_secret table (constraint to one row).
 // Returns secret object if a row exists, else returns nil for all other cases (secret not found).
-func getActiveSecretRow() (*pblib.Secret, error) {
+func getActiveSecretRow(ctx context.Context) (*pblib.Secret, error) {
 	command := `SELECT secret_key, created_timestamp, expiration_timestamp 
 				FROM user_security.active_secret
 				`
 
-	row, err := postgresDB.Query(command)
-	if err != nil {
-		return nil, err
-	}
-
-	defer row.Close()
 	var secretKey string
 	var createdTimestamp, expirationTimestamp time.Time
-	for row.Next() {
-		err := row.Scan(&secretKey, &createdTimestamp, &expirationTimestamp)
-		if err != nil {
-			return nil, err
-		}
-
-		if secretKey != "" {
-			return &pblib.Secret{
-				Key:                 secretKey,
-				CreatedTimestamp:    createdTimestamp.Unix(),
-				ExpirationTimestamp: expirationTimestamp.Unix(),
-			}, nil
-		}
+	err := withDBRetry(ctx, func() error {
+		return postgresDB.QueryRowContext(ctx, command).Scan(&secretKey, &createdTimestamp, &expirationTimestamp)
+	})
+	if err == sql.ErrNoRows || (err == nil && secretKey == "") {
+		return nil, consts.ErrNoActiveSecretKeyFound
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, consts.ErrNoActiveSecretKeyFound
+	return &pblib.Secret{
+		Key:                 secretKey,
+		CreatedTimestamp:    createdTimestamp.Unix(),
+		ExpirationTimestamp: expirationTimestamp.Unix(),
+	}, nil
 }
 
 // insertNewAuthSecret inserts a newly generated secret key to database.
@@ -413,37 +917,105 @@ func getActiveSecretRow() (*pblib.Secret, error) {
 // There is a trigger set up with secrets table in that with every insert,
 // the active_secret table is updated with the newly inserted secret.
 // Returns err if secret is empty or error with database.
-func insertNewAuthSecret() error {
-	// generate a new secret
-	secretKey, err := auth.GenerateSecretKey(auth.SecretByteSize)
+func insertNewAuthSecret(ctx context.Context) error {
+	tx, err := postgresDB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
+	if _, err := insertAuthSecretTx(ctx, tx, time.Now()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertAuthSecretTx inserts a newly generated secret created at created in tx, the trigger of the secrets
+// table makes it the active secret.
+// Returns the secret key, or error if it could not be generated or any db error.
+func insertAuthSecretTx(ctx context.Context, tx *sql.Tx, created time.Time) (string, error) {
+	secretKey, err := auth.GenerateSecretKey(auth.SecretByteSize)
+	if err != nil {
+		return "", err
+	}
+
 	command := `INSERT INTO user_security.secrets(
 					secret_key, created_timestamp, expiration_timestamp
 				) VALUES($1, $2, $3)
 				`
 
-	createdTimestamp := time.Now().UTC()
-	expirationTimestamp, err := auth.GenerateExpirationTimestamp(createdTimestamp, daysInOneWeek)
+	createdTimestamp := created.UTC()
+	if _, err := tx.ExecContext(ctx, command, secretKey, createdTimestamp, secretExpiration(createdTimestamp)); err != nil {
+		return "", err
+	}
+
+	return secretKey, nil
+}
+
+// rotateAuthSecret makes a new active secret created at now, unless the active secret is no longer activeKey
+// because another instance rotated it first. The keep previous secrets stay valid until at least verifyUntil,
+// so the tokens they signed can be verified until they expire, older secrets are retired at now.
+// Returns true if the secret was rotated, or any db error.
+func rotateAuthSecret(ctx context.Context, activeKey string, keep int, now time.Time,
+	verifyUntil time.Time) (bool, error) {
+	tx, err := postgresDB.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	_, err = postgresDB.Exec(command, secretKey, createdTimestamp, expirationTimestamp)
+	// instances rotating at the same time wait on the lock, then see the active secret changed
+	var lockedKey string
+	err = tx.QueryRowContext(ctx, `SELECT secret_key FROM user_security.active_secret FOR UPDATE`).Scan(&lockedKey)
+	if err != nil && err != sql.ErrNoRows {
+		_ = tx.Rollback()
+		return false, err
+	}
+	if lockedKey != activeKey {
+		return false, tx.Rollback()
+	}
 
+	newKey, err := insertAuthSecretTx(ctx, tx, now)
 	if err != nil {
-		return err
+		_ = tx.Rollback()
+		return false, err
 	}
 
-	return nil
+	command := `UPDATE user_security.secrets
+				SET expiration_timestamp = GREATEST(expiration_timestamp, $3)
+				WHERE secret_key IN (SELECT secret_key
+									 FROM user_security.secrets
+									 WHERE secret_key <> $1
+									 ORDER BY created_timestamp DESC
+									 LIMIT $2)
+				`
+	if _, err := tx.ExecContext(ctx, command, newKey, keep, verifyUntil.UTC()); err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+
+	command = `UPDATE user_security.secrets
+				SET expiration_timestamp = $3
+				WHERE expiration_timestamp > $3
+				  AND secret_key <> $1
+				  AND secret_key NOT IN (SELECT secret_key
+										 FROM user_security.secrets
+										 WHERE secret_key <> $1
+										 ORDER BY created_timestamp DESC
+										 LIMIT $2)
+				`
+	if _, err := tx.ExecContext(ctx, command, newKey, keep, now.UTC()); err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+
+	return true, tx.Commit()
 }
 
 // getLatestSecret looks at the secrets table and selects row that is less than parameter seconds.
 // Used to validate that the latest secret has been inserted into database.
 // Returns the secret key string if row passes timestamp test, else empty value.
-func getLatestSecret(seconds int) (string, error) {
+func getLatestSecret(ctx context.Context, seconds int) (string, error) {
 	if seconds == 0 {
 		return "", consts.ErrInvalidAddTime
 	}
@@ -457,7 +1029,7 @@ func getLatestSecret(seconds int) (string, error) {
 				`
 
 	var secretKey string
-	err := postgresDB.QueryRow(command, interval).Scan(&secretKey)
+	err := postgresDB.QueryRowContext(ctx, command, interval).Scan(&secretKey)
 	if err != nil {
 		return "", err
 	}
@@ -471,7 +1043,7 @@ func getLatestSecret(seconds int) (string, error) {
 
 // insertAuthToken inserts new token information for auditing in the database.
 // Returns error if parameters are zero values, expired secret, db error.
-func insertAuthToken(token string, header *auth.Header, body *auth.Body, secret *pblib.Secret) error {
+func insertAuthToken(ctx context.Context, token string, header *auth.Header, body *auth.Body, secret *pblib.Secret) error {
 	if token == "" {
 		return authconst.ErrEmptyToken
 	}
@@ -488,13 +1060,13 @@ func insertAuthToken(token string, header *auth.Header, body *auth.Body, secret
 	command := `
 				INSERT INTO user_security.auth_tokens(
 					token, secret_key, token_type, algorithm,
-					permission, expiration_timestamp, uuid
-				) VALUES($1, $2, $3, $4, $5, $6, $7)
+					permission, expiration_timestamp, uuid, last_activity
+				) VALUES($1, $2, $3, $4, $5, $6, $7, $8)
 				`
 
-	_, err := postgresDB.Exec(command, token, secret.Key, auth.TokenTypeStringMap[header.TokenTyp],
+	_, err := postgresDB.ExecContext(ctx, command, token, secret.Key, auth.TokenTypeStringMap[header.TokenTyp],
 		auth.AlgorithmStringMap[header.Alg], auth.PermissionStringMap[body.Permission],
-		time.Unix(body.ExpirationTimestamp, 0), body.UUID)
+		time.Unix(body.ExpirationTimestamp, 0), body.UUID, time.Now().UTC())
 
 	if err != nil {
 		return err
@@ -507,7 +1079,7 @@ func insertAuthToken(token string, header *auth.Header, body *auth.Body, secret
 // Once matched, inner join will join a row from secrets table that matches its secrets_key with
 // the matched token's row secret_key.
 // Returns tokenAuthRow object if existing token is found and unexpired, nil if not found, else errors.
-func getAuthTokenRow(uuid string) (*tokenAuthRow, error) {
+func getAuthTokenRow(ctx context.Context, uuid string) (*tokenAuthRow, error) {
 	if err := validation.ValidateUserUUID(uuid); err != nil {
 		return nil, authconst.ErrInvalidUUID
 	}
@@ -521,45 +1093,40 @@ func getAuthTokenRow(uuid string) (*tokenAuthRow, error) {
 				ORDER BY uuid, user_security.auth_tokens.expiration_timestamp DESC
 				`
 
-	row, err := postgresDB.Query(command, uuid)
+	var retrievedUUID, permission, token, secret string
+	var secretCreatedTimestamp, secretExpirationTimestamp time.Time
+
+	err := withDBRetry(ctx, func() error {
+		return postgresDB.QueryRowContext(ctx, command, uuid).Scan(&retrievedUUID, &permission, &token, &secret,
+			&secretCreatedTimestamp, &secretExpirationTimestamp)
+	})
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrNoAuthTokenFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	defer row.Close()
-	for row.Next() {
-		var retrievedUUID, permission, token, secret string
-		var secretCreatedTimestamp, secretExpirationTimestamp time.Time
-
-		err := row.Scan(&retrievedUUID, &permission, &token, &secret,
-			&secretCreatedTimestamp, &secretExpirationTimestamp)
-		if err != nil {
-			return nil, err
-		}
-
-		if uuid != retrievedUUID {
-			return nil, authconst.ErrInvalidUUID
-		}
-
-		return &tokenAuthRow{
-			uuid:       retrievedUUID,
-			permission: permission,
-			token:      token,
-			secret: &pblib.Secret{
-				Key:                 secret,
-				CreatedTimestamp:    secretCreatedTimestamp.Unix(),
-				ExpirationTimestamp: secretExpirationTimestamp.Unix(),
-			},
-		}, nil
+	if uuid != retrievedUUID {
+		return nil, authconst.ErrInvalidUUID
 	}
 
-	return nil, consts.ErrNoAuthTokenFound
+	return &tokenAuthRow{
+		uuid:       retrievedUUID,
+		permission: permission,
+		token:      token,
+		secret: &pblib.Secret{
+			Key:                 secret,
+			CreatedTimestamp:    secretCreatedTimestamp.Unix(),
+			ExpirationTimestamp: secretExpirationTimestamp.Unix(),
+		},
+	}, nil
 }
 
 // pairTokenWithSecret will look up matching token in the tokens table.
 // Once matched, inner join will join the matching secret_key row in secrets table with matched tokens row secret_key.
 // Returns secret object for the found token.
-func pairTokenWithSecret(token string) (*pblib.Identification, error) {
+func pairTokenWithSecret(ctx context.Context, token string) (*pblib.Identification, error) {
 	if token == "" {
 		return nil, authconst.ErrEmptyToken
 	}
@@ -571,49 +1138,48 @@ func pairTokenWithSecret(token string) (*pblib.Identification, error) {
 				ON user_security.auth_tokens.secret_key = user_security.secrets.secret_key
 				WHERE token = $1
 				`
-	row, err := postgresDB.Query(command, token)
+
+	var retrievedToken, secretKey string
+	var secretCreatedTimeStamp, secretExpirationTimestamp time.Time
+
+	err := withDBRetry(ctx, func() error {
+		return postgresDB.QueryRowContext(ctx, command, token).Scan(&retrievedToken, &secretKey,
+			&secretCreatedTimeStamp, &secretExpirationTimestamp)
+	})
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrNoMatchingAuthTokenFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	defer row.Close()
-	for row.Next() {
-		var retrievedToken, secretKey string
-		var secretCreatedTimeStamp, secretExpirationTimestamp time.Time
-
-		err := row.Scan(&retrievedToken, &secretKey, &secretCreatedTimeStamp, &secretExpirationTimestamp)
-		if err != nil {
-			return nil, err
-		}
-
-		if token != retrievedToken {
-			return nil, consts.ErrMismatchingToken
-		}
-
-		return &pblib.Identification{
-			Token: retrievedToken,
-			Secret: &pblib.Secret{
-				Key:                 secretKey,
-				CreatedTimestamp:    secretCreatedTimeStamp.Unix(),
-				ExpirationTimestamp: secretExpirationTimestamp.Unix(),
-			},
-		}, nil
+	if token != retrievedToken {
+		return nil, consts.ErrMismatchingToken
 	}
 
-	return nil, consts.ErrNoMatchingAuthTokenFound
+	return &pblib.Identification{
+		Token: retrievedToken,
+		Secret: &pblib.Secret{
+			Key:                 secretKey,
+			CreatedTimestamp:    secretCreatedTimeStamp.Unix(),
+			ExpirationTimestamp: secretExpirationTimestamp.Unix(),
+		},
+	}, nil
 }
 
 // hasActiveAuthSecret checks active_secret table for a row.
 // active_secret table has a constraint to only one row.
 // Returns true if a row was found, false otherwise, or any error encountered with the db itself.
-func hasActiveAuthSecret() (bool, error) {
+func hasActiveAuthSecret(ctx context.Context) (bool, error) {
 	command := `SELECT EXISTS( 
   					SELECT *
   					FROM user_security.active_secret
   				)`
 
 	var exists bool
-	err := postgresDB.QueryRow(command).Scan(&exists)
+	err := withDBRetry(ctx, func() error {
+		return postgresDB.QueryRowContext(ctx, command).Scan(&exists)
+	})
 	if err != nil {
 		return false, err
 	}
@@ -626,22 +1192,26 @@ func hasActiveAuthSecret() (bool, error) {
 }
 
 // isEmailTaken takes received email and checks it against user_svc.accounts table for
-// existing email in both email and prospective_email columns.
+// existing email and against unexpired prospective email reservations, ignoring case.
 // On success querying, returns true if exists, false otherwise.
-func isEmailTaken(prospectiveEmail string) (bool, error) {
+func isEmailTaken(ctx context.Context, prospectiveEmail string) (bool, error) {
 	if err := validateEmail(prospectiveEmail); err != nil {
 		return false, err
 	}
 
-	// do a query to check prospective_email is not a existing email for someone else
+	// do a query to check prospective_email is not a existing or reserved email for someone else
 	command := `SELECT EXISTS(
   					SELECT email
   					FROM user_svc.accounts
-  					WHERE email = $1 OR prospective_email = $1
+  					WHERE LOWER(email) = LOWER($1)
+				) OR EXISTS(
+					SELECT email
+					FROM user_svc.email_reservations
+					WHERE email = LOWER($1) AND expiration_timestamp > NOW()
 				)`
 
 	var emailExists bool
-	err := postgresDB.QueryRow(command, prospectiveEmail).Scan(&emailExists)
+	err := postgresDB.QueryRowContext(ctx, command, prospectiveEmail).Scan(&emailExists)
 	if err != nil {
 		return false, err
 	}
@@ -656,55 +1226,52 @@ func isEmailTaken(prospectiveEmail string) (bool, error) {
 // getEmailTokenRow looks up existing token from user_svc.email_tokens table.
 // If token exists, the rows information are returned in a tokenEmailRow struct.
 // If token does not exist, return error.
-func getEmailTokenRow(token string) (*tokenEmailRow, error) {
+func getEmailTokenRow(ctx context.Context, token string) (*tokenEmailRow, error) {
 	if token == "" {
 		return nil, authconst.ErrEmptyToken
 	}
 
-	command := `SELECT * FROM user_svc.email_tokens
+	command := `SELECT token, secret_key, created_timestamp, expiration_timestamp, uuid
+				FROM user_svc.email_tokens
 				WHERE token = $1`
 
-	row, err := postgresDB.Query(command, token)
+	var emailToken, secretKey, uuid string
+	var createdTimestamp, expirationTimestamp time.Time
+
+	err := withDBRetry(ctx, func() error {
+		return postgresDB.QueryRowContext(ctx, command, token).Scan(&emailToken, &secretKey,
+			&createdTimestamp, &expirationTimestamp, &uuid)
+	})
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrNoMatchingEmailTokenFound
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	defer row.Close()
-	for row.Next() {
-		var emailToken, secretKey, uuid string
-		var createdTimestamp, expirationTimestamp time.Time
-
-		err := row.Scan(&emailToken, &secretKey, &createdTimestamp, &expirationTimestamp, &uuid)
-		if err != nil {
-			return nil, err
-		}
-
-		if token != emailToken {
-			return nil, consts.ErrMismatchingEmailToken
-		}
-
-		return &tokenEmailRow{
-			token:               emailToken,
-			secretKey:           secretKey,
-			createdTimestamp:    createdTimestamp.Unix(),
-			expirationTimestamp: expirationTimestamp.Unix(),
-			uuid:                uuid,
-		}, nil
+	if token != emailToken {
+		return nil, consts.ErrMismatchingEmailToken
 	}
 
-	return nil, consts.ErrNoMatchingEmailTokenFound
+	return &tokenEmailRow{
+		token:               emailToken,
+		secretKey:           secretKey,
+		createdTimestamp:    createdTimestamp.Unix(),
+		expirationTimestamp: expirationTimestamp.Unix(),
+		uuid:                uuid,
+	}, nil
 }
 
 // deleteEmailTokenRow looks up the given uuid in user_svc.email_tokens table and deletes the matching row.
 // Returns error if given uuid is invalid or any db error.
-func deleteEmailTokenRow(uuid string) error {
+func deleteEmailTokenRow(ctx context.Context, uuid string) error {
 	if err := validation.ValidateUserUUID(uuid); err != nil {
 		return authconst.ErrInvalidUUID
 	}
 
 	command := `DELETE FROM user_svc.email_tokens WHERE uuid = $1`
 
-	_, err := postgresDB.Exec(command, uuid)
+	_, err := postgresDB.ExecContext(ctx, command, uuid)
 
 	if err != nil {
 		return err
@@ -713,13 +1280,13 @@ func deleteEmailTokenRow(uuid string) error {
 	return nil
 }
 
-// matchEmailAndPassword looks up a row that matches the email. Then after the matched row is retrieved,
+// matchEmailAndPassword looks up a row that matches the email, ignoring case. Then after the matched row is retrieved,
 // password retrieved from db is matched with given password.
 // If both email and password matches, returns the matched users row.
 // If the query by email returns nothing, returns email does not exist error.
 // If email is found, but password does not match, returns password does not match error.
 // All other errors are returned.
-func matchEmailAndPassword(email string, password string) (*pblib.User, error) {
+func matchEmailAndPassword(ctx context.Context, email string, password string) (*pblib.User, error) {
 	if err := validateEmail(email); err != nil {
 		return nil, err
 	}
@@ -731,53 +1298,21 @@ func matchEmailAndPassword(email string, password string) (*pblib.User, error) {
 	command := `SELECT uuid, first_name, last_name, email, organization, 
        				created_timestamp, is_verified, password, permission_level, prospective_email
 				FROM user_svc.accounts 
-				WHERE email = $1
+				WHERE LOWER(email) = LOWER($1) AND deleted_timestamp IS NULL
 				`
 
-	row, err := postgresDB.Query(command, email)
+	foundUser, err := scanUserRow(postgresDB.QueryRowContext(ctx, command, email))
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrEmailDoesNotExist
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	defer row.Close()
-	var foundUser *pblib.User
-	for row.Next() {
-		var prospectiveEmailNullable sql.NullString
-		var uuid, firstName, lastName, email, organization, hashedPassword, permissionLevel, prospectiveEmail string
-		var isVerified bool
-		var createdTimestamp time.Time
-
-		err := row.Scan(&uuid, &firstName, &lastName, &email, &organization,
-			&createdTimestamp, &isVerified, &hashedPassword, &permissionLevel, &prospectiveEmailNullable)
-		if err != nil {
-			return nil, err
-		}
-
-		if prospectiveEmailNullable.Valid {
-			prospectiveEmail = prospectiveEmailNullable.String
-		}
-
-		foundUser = &pblib.User{
-			Uuid:             uuid,
-			FirstName:        firstName,
-			LastName:         lastName,
-			Email:            email,
-			Organization:     organization,
-			CreatedTimestamp: createdTimestamp.Unix(),
-			IsVerified:       isVerified,
-			Password:         hashedPassword,
-			PermissionLevel:  permissionLevel,
-			ProspectiveEmail: prospectiveEmail,
-		}
-	}
-	if err := row.Err(); err != nil {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	if foundUser == nil {
-		return nil, consts.ErrEmailDoesNotExist
-	}
-
 	// match password
 	if err := comparePassword(foundUser.GetPassword(), password); err != nil {
 		return nil, err
@@ -788,7 +1323,7 @@ func matchEmailAndPassword(email string, password string) (*pblib.User, error) {
 
 // updatePermissionLevel changes the permission level for given UUID.
 // returns nil on success, nil if user doesnt exist, else err
-func updatePermissionLevel(uuid string, permissionLevel string) error {
+func updatePermissionLevel(ctx context.Context, uuid string, permissionLevel string) error {
 	if err := validation.ValidateUserUUID(uuid); err != nil {
 		return err
 	}
@@ -801,10 +1336,3189 @@ func updatePermissionLevel(uuid string, permissionLevel string) error {
 				WHERE uuid = $1
 				`
 
-	_, err := postgresDB.Exec(command, uuid, permissionLevel)
+	_, err := postgresDB.ExecContext(ctx, command, uuid, permissionLevel)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// verifyEmailTokenRow consumes token in one transaction: the token and its user's account are locked,
+// the token row is deleted and the user is marked verified and promoted to User permission.
+// If the token is expired, the token row is still deleted, along with the account of a new user who never verified,
+// and ErrExpiredEmailToken is returned.
+// Returns the user as stored before the update, error if token is empty, not found or any db error.
+func verifyEmailTokenRow(ctx context.Context, token string) (*pblib.User, error) {
+	if token == "" {
+		return nil, authconst.ErrEmptyToken
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// concurrent verifications of the same token wait here and then find no row
+	var uuid string
+	var expirationTimestamp time.Time
+	err = tx.QueryRowContext(ctx, `SELECT uuid, expiration_timestamp
+				FROM user_svc.email_tokens
+				WHERE token = $1
+				FOR UPDATE`, token).Scan(&uuid, &expirationTimestamp)
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return nil, consts.ErrNoMatchingEmailTokenFound
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	// lock the account so a concurrent UpdateUser cannot change it between the check and the update
+	retrievedUser, err := scanUserRow(tx.QueryRowContext(ctx, `SELECT uuid, first_name, last_name, email, organization, 
+       				created_timestamp, is_verified, password, permission_level, prospective_email
+				FROM user_svc.accounts WHERE uuid = $1
+				FOR UPDATE`, uuid))
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return nil, consts.ErrUserNotFound
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_svc.email_tokens WHERE token = $1`, token); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if time.Now().Unix() >= expirationTimestamp.Unix() || expirationTimestamp.Unix() <= 0 {
+		// delete stale new user
+		if retrievedUser.GetProspectiveEmail() == "" && !retrievedUser.GetIsVerified() &&
+			retrievedUser.GetPermissionLevel() == auth.PermissionStringMap[auth.NoPermission] {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM user_svc.accounts WHERE uuid = $1`, uuid); err != nil {
+				_ = tx.Rollback()
+				return nil, err
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return retrievedUser, consts.ErrExpiredEmailToken
+	}
+
+	command := `UPDATE user_svc.accounts
+				SET permission_level = $2, is_verified = TRUE
+				WHERE uuid = $1
+				`
+	if _, err := tx.ExecContext(ctx, command, uuid, auth.PermissionStringMap[auth.User]); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return retrievedUser, nil
+}
+
+// forceVerifyUserRow marks the user verified without an email token, deleting its pending email tokens in the
+// same transaction. Like verifyEmailTokenRow, a user without permission is given user permission.
+// Returns the user as stored before the update, ErrUserNotFound if uuid does not exist or is soft deleted,
+// or any db error.
+func forceVerifyUserRow(ctx context.Context, uuid string) (*pblib.User, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	retrievedUser, err := scanUserRow(tx.QueryRowContext(ctx, `SELECT uuid, first_name, last_name, email, organization, 
+       				created_timestamp, is_verified, password, permission_level, prospective_email
+				FROM user_svc.accounts WHERE uuid = $1 AND deleted_timestamp IS NULL
+				FOR UPDATE`, uuid))
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return nil, consts.ErrUserNotFound
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_svc.email_tokens WHERE uuid = $1`, uuid); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	command := `UPDATE user_svc.accounts
+				SET is_verified = TRUE,
+					permission_level = CASE WHEN permission_level = $2 THEN $3 ELSE permission_level END,
+					modified_timestamp = $4
+				WHERE uuid = $1
+				`
+	if _, err := tx.ExecContext(ctx, command, uuid, auth.PermissionStringMap[auth.NoPermission],
+		auth.PermissionStringMap[auth.User], time.Now().UTC()); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return retrievedUser, nil
+}
+
+// forgetUserRow anonymizes the user in one transaction and registers its erasure by actor at now in
+// user_svc.erasures, see ForgetUser. The account keeps its uuid, and is marked deleted if it was not already.
+// Returns the hash of the erasure, ErrUserNotFound if uuid does not exist or was already forgotten, or any db error.
+func forgetUserRow(ctx context.Context, uuid string, actor string, now time.Time) (string, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return "", err
+	}
+	now = now.UTC().Truncate(time.Microsecond)
+
+	// referral_code cannot be NULL, a fresh code stops the shared one from linking new users to the account
+	referralCode, err := generateReferralCode()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var email string
+	var prospectiveEmail sql.NullString
+	err = tx.QueryRowContext(ctx, `SELECT email, prospective_email FROM user_svc.accounts
+				WHERE uuid = $1 AND forgotten_timestamp IS NULL
+				FOR UPDATE`, uuid).Scan(&email, &prospectiveEmail)
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return "", consts.ErrUserNotFound
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	emails := []string{strings.ToLower(email)}
+	if prospectiveEmail.Valid {
+		emails = append(emails, strings.ToLower(prospectiveEmail.String))
+	}
+
+	// erasures are registered one at a time, so each one chains to the one before
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE user_svc.erasures IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+	var previous string
+	err = tx.QueryRowContext(ctx, `SELECT hash FROM user_svc.erasures ORDER BY sequence DESC LIMIT 1`).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		_ = tx.Rollback()
+		return "", err
+	}
+	hash := erasureHash(previous, uuid, actor, now)
+
+	commands := []struct {
+		command string
+		args    []interface{}
+	}{
+		{`UPDATE user_svc.accounts
+				SET first_name = $2, last_name = $3, email = $4, prospective_email = NULL, password = '',
+					organization = NULL, birthdate = NULL, referral_code = $8, locale = NULL,
+					middle_name = NULL, display_name = NULL, last_seen_timestamp = NULL,
+					is_verified = FALSE, permission_level = $5, ` +
+			strings.Join(assignColumn("accounts", "marketing_opt_in", "$7"), ", ") + `,
+					modified_timestamp = $6, deleted_timestamp = COALESCE(deleted_timestamp, $6),
+					forgotten_timestamp = $6
+				WHERE uuid = $1`, []interface{}{uuid, forgottenFirstName, forgottenLastName,
+			uuid + forgottenEmailDomain, auth.PermissionStringMap[auth.NoPermission], now, false, referralCode}},
+		{`DELETE FROM user_svc.organization_admins WHERE uuid = $1`, []interface{}{uuid}},
+		{`DELETE FROM user_svc.email_tokens WHERE uuid = $1`, []interface{}{uuid}},
+		{`DELETE FROM user_svc.email_change_tokens WHERE uuid = $1`, []interface{}{uuid}},
+		{`DELETE FROM user_svc.email_reservations WHERE uuid = $1`, []interface{}{uuid}},
+		{`DELETE FROM user_svc.parental_consent_tokens WHERE uuid = $1`, []interface{}{uuid}},
+		{`DELETE FROM user_svc.password_reset_tokens WHERE uuid = $1`, []interface{}{uuid}},
+		{`DELETE FROM user_svc.auth_methods WHERE uuid = $1`, []interface{}{uuid}},
+		{`DELETE FROM user_svc.profile_changes WHERE uuid = $1`, []interface{}{uuid}},
+		{`DELETE FROM user_svc.events WHERE subject = $1`, []interface{}{uuid}},
+		{`DELETE FROM user_svc.email_outbox
+				WHERE EXISTS (SELECT 1 FROM UNNEST(recipients) AS recipient WHERE LOWER(recipient) = ANY($1))`,
+			[]interface{}{pq.Array(emails)}},
+		{`DELETE FROM user_security.login_countries WHERE uuid = $1`, []interface{}{uuid}},
+		{`DELETE FROM user_security.auth_tokens WHERE uuid = $1`, []interface{}{uuid}},
+		{`DELETE FROM user_security.refresh_tokens WHERE uuid = $1`, []interface{}{uuid}},
+		{`DELETE FROM user_security.totp_secrets WHERE uuid = $1`, []interface{}{uuid}},
+		{`DELETE FROM user_security.backup_codes WHERE uuid = $1`, []interface{}{uuid}},
+		{`INSERT INTO user_security.revocations(uuid, revoked_timestamp) VALUES($1, $2)`, []interface{}{uuid, now}},
+		// the client ip and user agent of the user's own requests
+		{`UPDATE user_svc.audit_log SET metadata = '{}' WHERE actor = $1`, []interface{}{uuid}},
+		{`INSERT INTO user_svc.erasures(uuid, actor, previous_hash, hash, created_timestamp)
+				VALUES($1, $2, $3, $4, $5)`, []interface{}{uuid, actor, previous, hash, now}},
+	}
+	for _, c := range commands {
+		if _, err := tx.ExecContext(ctx, c.command, c.args...); err != nil {
+			_ = tx.Rollback()
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// getMarketingPreference looks up the marketing opt-in flag and locale of a user.
+// Locale is returned as an empty string if it was never set.
+// Returns error if uuid is invalid, user is not found or any db error.
+func getMarketingPreference(ctx context.Context, uuid string) (bool, string, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return false, "", err
+	}
+
+	command := `SELECT ` + readColumn("accounts", "marketing_opt_in") + `, locale
+				FROM user_svc.accounts
+				WHERE uuid = $1
+				`
+
+	var optIn bool
+	var localeNullable sql.NullString
+	err := postgresDB.QueryRowContext(ctx, command, uuid).Scan(&optIn, &localeNullable)
+	if err == sql.ErrNoRows {
+		return false, "", consts.ErrUserNotFound
+	}
+	if err != nil {
+		return false, "", err
+	}
+
+	return optIn, localeNullable.String, nil
+}
+
+// getValidSecrets retrieves every secret from the secrets table that has not expired yet.
+// A replica serves the read if ctx was marked by withReplicaReads.
+// Returns the secrets ordered newest first, or any db error.
+func getValidSecrets(ctx context.Context) ([]*pblib.Secret, error) {
+	command := `SELECT secret_key, created_timestamp, expiration_timestamp
+				FROM user_security.secrets
+				WHERE NOW() AT TIME ZONE 'UTC' < expiration_timestamp
+				ORDER BY created_timestamp DESC
+				`
+
+	var rows *sql.Rows
+	err := readReplica(ctx, func(db *sql.DB) (err error) {
+		rows, err = db.QueryContext(ctx, command)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var secrets []*pblib.Secret
+	for rows.Next() {
+		var secretKey string
+		var createdTimestamp, expirationTimestamp time.Time
+
+		if err := rows.Scan(&secretKey, &createdTimestamp, &expirationTimestamp); err != nil {
+			return nil, err
+		}
+
+		secrets = append(secrets, &pblib.Secret{
+			Key:                 secretKey,
+			CreatedTimestamp:    createdTimestamp.Unix(),
+			ExpirationTimestamp: expirationTimestamp.Unix(),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+// revokeAuthTokens deletes every auth and refresh token issued to uuid and records the revocation
+// so instances verifying tokens without a db lookup stop accepting them.
+// Returns error if uuid is invalid or any db error.
+func revokeAuthTokens(ctx context.Context, uuid string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return authconst.ErrInvalidUUID
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_security.auth_tokens WHERE uuid = $1`, uuid); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_security.refresh_tokens WHERE uuid = $1`, uuid); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	command := `INSERT INTO user_security.revocations(uuid, revoked_timestamp) VALUES($1, $2)`
+	if _, err := tx.ExecContext(ctx, command, uuid, time.Now().UTC()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// revokeAuthToken deletes the auth token of uuid, and its refresh token if refreshTokenHash is not empty, and
+// records the revocation until expiration, when the token expires, so instances verifying tokens without a db
+// lookup stop accepting it. Revoking a token twice keeps the first revocation.
+// Returns error if uuid is invalid or token is empty, or any db error.
+func revokeAuthToken(ctx context.Context, uuid string, token string, refreshTokenHash string,
+	expiration time.Time) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return authconst.ErrInvalidUUID
+	}
+	if token == "" {
+		return authconst.ErrEmptyToken
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	command := `DELETE FROM user_security.auth_tokens WHERE token = $1 AND uuid = $2`
+	if _, err := tx.ExecContext(ctx, command, token, uuid); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if refreshTokenHash != "" {
+		command := `DELETE FROM user_security.refresh_tokens WHERE token_hash = $1 AND uuid = $2`
+		if _, err := tx.ExecContext(ctx, command, refreshTokenHash, uuid); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	command = `INSERT INTO user_security.token_revocations(token_hash, uuid, revoked_timestamp, expiration_timestamp)
+				VALUES($1, $2, $3, $4)
+				ON CONFLICT (token_hash) DO NOTHING
+				`
+	if _, err := tx.ExecContext(ctx, command, hashToken(token), uuid, time.Now().UTC(), expiration.UTC()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getTokenRevocations retrieves the hashes of the revoked auth tokens that have not expired at now.
+// Returns any db error.
+func getTokenRevocations(ctx context.Context, now time.Time) (map[string]bool, error) {
+	command := `SELECT token_hash
+				FROM user_security.token_revocations
+				WHERE expiration_timestamp > $1
+				`
+
+	rows, err := postgresDB.QueryContext(ctx, command, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	revocations := make(map[string]bool)
+	for rows.Next() {
+		var tokenHash string
+		if err := rows.Scan(&tokenHash); err != nil {
+			return nil, err
+		}
+		revocations[tokenHash] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revocations, nil
+}
+
+// getRevocationsSince retrieves the uuids whose tokens were revoked after since,
+// mapped to their latest revocation time.
+// Returns any db error.
+func getRevocationsSince(ctx context.Context, since time.Time) (map[string]time.Time, error) {
+	command := `SELECT uuid, MAX(revoked_timestamp)
+				FROM user_security.revocations
+				WHERE revoked_timestamp > $1
+				GROUP BY uuid
+				`
+
+	rows, err := postgresDB.QueryContext(ctx, command, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	revocations := make(map[string]time.Time)
+	for rows.Next() {
+		var uuid string
+		var revokedTimestamp time.Time
+
+		if err := rows.Scan(&uuid, &revokedTimestamp); err != nil {
+			return nil, err
+		}
+		revocations[uuid] = revokedTimestamp
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revocations, nil
+}
+
+// insertEvent persists a lifecycle event to user_svc.events.
+// Returns the sequence number assigned to the event, error if event is nil or any db error.
+func insertEvent(ctx context.Context, event *cloudEvent) (int64, error) {
+	if event == nil {
+		return 0, consts.ErrNilEvent
+	}
+
+	envelope, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+
+	command := `INSERT INTO user_svc.events(id, type, subject, created_timestamp, envelope)
+				VALUES($1, $2, $3, $4, $5)
+				RETURNING sequence
+				`
+
+	var sequence int64
+	err = postgresDB.QueryRowContext(ctx, command, event.ID, event.Type, event.Subject,
+		time.Now().UTC(), envelope).Scan(&sequence)
+	if err != nil {
+		return 0, err
+	}
+
+	return sequence, nil
+}
+
+// getEventsAfter retrieves up to limit events with a sequence greater than fromSequence,
+// created at or after fromTimestamp, ordered by sequence.
+// Returns error if sequence or limit is invalid or any db error.
+func getEventsAfter(ctx context.Context, fromSequence int64, fromTimestamp time.Time, limit int) ([]*cloudEvent, error) {
+	if fromSequence < 0 {
+		return nil, consts.ErrInvalidReplaySequence
+	}
+	if limit <= 0 {
+		return nil, consts.ErrInvalidReplayLimit
+	}
+
+	command := `SELECT sequence, envelope
+				FROM user_svc.events
+				WHERE sequence > $1 AND created_timestamp >= $2
+				ORDER BY sequence
+				LIMIT $3
+				`
+
+	rows, err := postgresDB.QueryContext(ctx, command, fromSequence, fromTimestamp.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var events []*cloudEvent
+	for rows.Next() {
+		var sequence int64
+		var envelope []byte
+
+		if err := rows.Scan(&sequence, &envelope); err != nil {
+			return nil, err
+		}
+
+		event := &cloudEvent{}
+		if err := json.Unmarshal(envelope, event); err != nil {
+			return nil, err
+		}
+		event.Sequence = sequence
+
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// insertEmailDelivery records whether sending an email with htmlTemplate succeeded.
+// Returns any db error.
+func insertEmailDelivery(ctx context.Context, htmlTemplate string, succeeded bool) error {
+	command := `INSERT INTO user_svc.email_deliveries(template, succeeded, created_timestamp) VALUES($1, $2, $3)`
+	_, err := postgresDB.ExecContext(ctx, command, htmlTemplate, succeeded, time.Now().UTC())
+
+	return err
+}
+
+// insertOutboxEmail queues the rendered email of r, to be sent from now on.
+// Returns the id of the queued email, or any db error.
+func insertOutboxEmail(ctx context.Context, r *emailRequest, htmlTemplate string, now time.Time) (int64, error) {
+	command := `INSERT INTO user_svc.email_outbox(
+					sender, recipients, subject, body, text_body, template, created_timestamp, next_attempt_timestamp
+				) VALUES($1, $2, $3, $4, $5, $6, $7, $7)
+				RETURNING id
+				`
+	var id int64
+	err := postgresDB.QueryRowContext(ctx, command, r.from, pq.Array(r.to), r.subject, r.body, r.text,
+		htmlTemplate, now.UTC()).Scan(&id)
+
+	return id, err
+}
+
+// claimOutboxEmail takes the queued email due the longest at now and counts an attempt, no other worker
+// takes it before leaseEnd, when it is retried if the worker never reported back.
+// Returns nil if no email is due, or any db error.
+func claimOutboxEmail(ctx context.Context, now time.Time, leaseEnd time.Time) (*outboxEmail, error) {
+	command := `UPDATE user_svc.email_outbox
+				SET attempts = attempts + 1, next_attempt_timestamp = $2
+				WHERE id = (
+					SELECT id FROM user_svc.email_outbox
+					WHERE dead_timestamp IS NULL AND next_attempt_timestamp <= $1
+					ORDER BY next_attempt_timestamp
+					LIMIT 1
+					FOR UPDATE SKIP LOCKED
+				)
+				RETURNING id, sender, recipients, subject, body, text_body, template, attempts
+				`
+	email := &outboxEmail{}
+	err := postgresDB.QueryRowContext(ctx, command, now.UTC(), leaseEnd.UTC()).Scan(&email.id, &email.from,
+		pq.Array(&email.to), &email.subject, &email.body, &email.text, &email.template, &email.attempts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return email, nil
+}
+
+// deleteOutboxEmail removes a sent email from the queue.
+// Returns any db error.
+func deleteOutboxEmail(ctx context.Context, id int64) error {
+	_, err := postgresDB.ExecContext(ctx, `DELETE FROM user_svc.email_outbox WHERE id = $1`, id)
+	return err
+}
+
+// retryOutboxEmail records the failure of the last attempt to send email id, it is retried at next.
+// Returns any db error.
+func retryOutboxEmail(ctx context.Context, id int64, lastError string, next time.Time) error {
+	command := `UPDATE user_svc.email_outbox SET last_error = $2, next_attempt_timestamp = $3 WHERE id = $1`
+	_, err := postgresDB.ExecContext(ctx, command, id, lastError, next.UTC())
+
+	return err
+}
+
+// killOutboxEmail records the failure of the last attempt to send email id, it is never retried.
+// Returns any db error.
+func killOutboxEmail(ctx context.Context, id int64, lastError string, now time.Time) error {
+	command := `UPDATE user_svc.email_outbox SET last_error = $2, dead_timestamp = $3 WHERE id = $1`
+	_, err := postgresDB.ExecContext(ctx, command, id, lastError, now.UTC())
+
+	return err
+}
+
+// getUserStats computes the admin dashboard aggregates over the last days days, today included.
+// The queries run in one read only transaction so the aggregates describe the same snapshot.
+// Returns error if days is invalid or any db error.
+func getUserStats(ctx context.Context, days int) (*userStats, error) {
+	if days <= 0 || days > maxStatsDays {
+		return nil, consts.ErrInvalidStatsDays
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	// read only, nothing to commit
+	defer func() { _ = tx.Rollback() }()
+
+	stats := &userStats{}
+
+	// days without signups are listed with a count of 0
+	command := `SELECT days.day, COUNT(accounts.uuid), COUNT(accounts.uuid) FILTER (WHERE accounts.is_verified)
+				FROM generate_series(date_trunc('day', NOW() AT TIME ZONE 'UTC') - ($1 - 1) * INTERVAL '1 day',
+									 date_trunc('day', NOW() AT TIME ZONE 'UTC'), INTERVAL '1 day') AS days(day)
+						 LEFT JOIN user_svc.accounts
+								   ON accounts.created_timestamp >= days.day AT TIME ZONE 'UTC'
+									   AND accounts.created_timestamp < (days.day + INTERVAL '1 day') AT TIME ZONE 'UTC'
+				GROUP BY days.day
+				ORDER BY days.day
+				`
+	rows, err := tx.QueryContext(ctx, command, days)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		signups := dailySignups{}
+		if err := rows.Scan(&signups.day, &signups.users, &signups.verified); err != nil {
+			return nil, err
+		}
+		stats.signups = append(stats.signups, signups)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	command = `SELECT COUNT(DISTINCT uuid) FROM user_security.auth_tokens WHERE expiration_timestamp > NOW()`
+	if err := tx.QueryRowContext(ctx, command).Scan(&stats.activeSessions); err != nil {
+		return nil, err
+	}
+
+	// users without an organization are counted under ""
+	command = `SELECT COALESCE(organization, ''), COUNT(*)
+				FROM user_svc.accounts
+				GROUP BY 1
+				ORDER BY 2 DESC, 1
+				`
+	orgRows, err := tx.QueryContext(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	defer orgRows.Close()
+	for orgRows.Next() {
+		users := organizationUsers{}
+		if err := orgRows.Scan(&users.Organization, &users.Users); err != nil {
+			return nil, err
+		}
+		stats.organizations = append(stats.organizations, users)
+	}
+	if err := orgRows.Err(); err != nil {
+		return nil, err
+	}
+
+	command = `SELECT COUNT(*), COUNT(*) FILTER (WHERE NOT succeeded)
+				FROM user_svc.email_deliveries
+				WHERE created_timestamp >= date_trunc('day', NOW() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+					- ($1 - 1) * INTERVAL '1 day'
+				`
+	if err := tx.QueryRowContext(ctx, command, days).Scan(&stats.emailsSent, &stats.emailsFailed); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// insertParentalConsentToken inserts the token a parent uses to consent to uuid's account.
+// Returns error if uuid, token or parentEmail are invalid or error with inserting to database.
+func insertParentalConsentToken(ctx context.Context, uuid string, parentEmail string, token string,
+	secret *pblib.Secret) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if token == "" {
+		return authconst.ErrEmptyToken
+	}
+
+	if err := validateEmail(parentEmail); err != nil {
+		return consts.ErrInvalidParentEmail
+	}
+
+	if err := auth.ValidateSecret(secret); err != nil {
+		return err
+	}
+
+	createdTimestamp := time.Unix(secret.GetCreatedTimestamp(), 0).UTC()
+	expirationTimestamp := time.Unix(secret.GetExpirationTimestamp(), 0).UTC()
+
+	command := `INSERT INTO user_svc.parental_consent_tokens(
+					token, secret_key, parent_email, created_timestamp, expiration_timestamp, uuid
+				) VALUES($1, $2, $3, $4, $5, $6)
+				`
+	_, err := postgresDB.ExecContext(ctx, command, token, secret.GetKey(), parentEmail,
+		createdTimestamp, expirationTimestamp, uuid)
+
+	return err
+}
+
+// verifyParentalConsentTokenRow consumes a parental consent token and records the consent on the account
+// in one transaction, concurrent verifications of the same token find no row once the first commits.
+// If the token is expired the account is deleted, a child's data is not kept without consent.
+// Returns the uuid of the account, ErrExpiredParentalConsentToken if the token expired,
+// ErrNoMatchingParentalConsent if there is no such token, or any db error.
+func verifyParentalConsentTokenRow(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", authconst.ErrEmptyToken
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var uuid string
+	var expirationTimestamp time.Time
+	err = tx.QueryRowContext(ctx, `DELETE FROM user_svc.parental_consent_tokens
+				WHERE token = $1
+				RETURNING uuid, expiration_timestamp`, token).Scan(&uuid, &expirationTimestamp)
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return "", consts.ErrNoMatchingParentalConsent
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	if !time.Now().Before(expirationTimestamp) {
+		command := `DELETE FROM user_svc.accounts
+					WHERE uuid = $1 AND parental_consent_required AND parental_consent_timestamp IS NULL
+					`
+		if _, err := tx.ExecContext(ctx, command, uuid); err != nil {
+			_ = tx.Rollback()
+			return "", err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return "", err
+		}
+		return uuid, consts.ErrExpiredParentalConsentToken
+	}
+
+	command := `UPDATE user_svc.accounts SET parental_consent_timestamp = $2 WHERE uuid = $1`
+	if _, err := tx.ExecContext(ctx, command, uuid, time.Now().UTC()); err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return uuid, nil
+}
+
+// isParentalConsentPending reports whether uuid was under parentalConsentAge at signup and no parent
+// has consented yet.
+// Returns error if uuid is invalid, user is not found or any db error.
+func isParentalConsentPending(ctx context.Context, uuid string) (bool, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return false, err
+	}
+
+	command := `SELECT parental_consent_required AND parental_consent_timestamp IS NULL
+				FROM user_svc.accounts
+				WHERE uuid = $1
+				`
+	var pending bool
+	err := postgresDB.QueryRowContext(ctx, command, uuid).Scan(&pending)
+	if err == sql.ErrNoRows {
+		return false, consts.ErrUserNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return pending, nil
+}
+
+// purgeUnverifiedAccounts deletes new users created before cutoff that never verified their email, forgotten users
+// are kept.
+// Returns the uuids of the deleted users, or any db error.
+func purgeUnverifiedAccounts(ctx context.Context, tx *sql.Tx, cutoff time.Time) ([]string, error) {
+	command := `DELETE FROM user_svc.accounts
+				WHERE is_verified = FALSE AND permission_level = $1 AND created_timestamp < $2
+					AND forgotten_timestamp IS NULL
+				RETURNING uuid
+				`
+	rows, err := tx.QueryContext(ctx, command, auth.PermissionStringMap[auth.NoPermission], cutoff.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var uuids []string
+	for rows.Next() {
+		var uuid string
+		if err := rows.Scan(&uuid); err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, uuid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return uuids, nil
+}
+
+// purgeSoftDeletedAccounts deletes the accounts soft deleted before cutoff, forgotten accounts are kept.
+// Returns the uuids of the deleted accounts, or any db error.
+func purgeSoftDeletedAccounts(ctx context.Context, tx *sql.Tx, cutoff time.Time) ([]string, error) {
+	command := `DELETE FROM user_svc.accounts
+				WHERE deleted_timestamp < $1 AND forgotten_timestamp IS NULL
+				RETURNING uuid
+				`
+	rows, err := tx.QueryContext(ctx, command, cutoff.UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var uuids []string
+	for rows.Next() {
+		var uuid string
+		if err := rows.Scan(&uuid); err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, uuid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return uuids, nil
+}
+
+// deleteLoginHistory deletes auth and refresh tokens that expired before cutoff, revocations recorded before cutoff
+// and revocations of tokens that expired before cutoff.
+// Returns the number of deleted rows, or any db error.
+func deleteLoginHistory(ctx context.Context, tx *sql.Tx, cutoff time.Time) (int64, error) {
+	var deleted int64
+	for _, command := range []string{
+		`DELETE FROM user_security.auth_tokens WHERE expiration_timestamp < $1`,
+		`DELETE FROM user_security.revocations WHERE revoked_timestamp < $1`,
+		`DELETE FROM user_security.token_revocations WHERE expiration_timestamp < $1`,
+		`DELETE FROM user_security.refresh_tokens WHERE expiration_timestamp < $1`,
+	} {
+		result, err := tx.ExecContext(ctx, command, cutoff.UTC())
+		if err != nil {
+			return 0, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		deleted += affected
+	}
+
+	return deleted, nil
+}
+
+// anonymizeDeletedUserEvents strips names, emails and organizations from the lifecycle events of users
+// deleted before cutoff, events keep the uuid so consumers replaying them still see a consistent history.
+// Returns the number of anonymized events, or any db error.
+func anonymizeDeletedUserEvents(ctx context.Context, tx *sql.Tx, cutoff time.Time) (int64, error) {
+	command := `UPDATE user_svc.events
+				SET envelope = envelope #- '{data,first_name}' #- '{data,last_name}'
+								   #- '{data,email}' #- '{data,organization}'
+				WHERE envelope -> 'data' ?| ARRAY ['first_name', 'last_name', 'email', 'organization']
+				  AND subject IN (SELECT subject
+								  FROM user_svc.events
+								  WHERE type = $1 AND created_timestamp < $2)
+				`
+	result, err := tx.ExecContext(ctx, command, eventTypeUserDeleted, cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// insertUsageRecords records the seats of every organization on day, a seat is a verified user that may sign in.
+// Days already recorded are left unchanged, so a repeated or concurrent run does not recount them.
+// Returns the number of recorded organizations, or any db error.
+func insertUsageRecords(ctx context.Context, day time.Time) (int64, error) {
+	command := `INSERT INTO user_svc.usage_records (day, organization, seats, created_timestamp)
+				SELECT $1, COALESCE(organization, ''), COUNT(*), $2
+				FROM user_svc.accounts
+				WHERE is_verified AND permission_level <> $3 AND deleted_timestamp IS NULL
+				  AND NOT (parental_consent_required AND parental_consent_timestamp IS NULL)
+				GROUP BY 2
+				ON CONFLICT (day, organization) DO NOTHING
+				`
+	result, err := postgresDB.ExecContext(ctx, command, day.UTC().Format(usageDayLayout), time.Now().UTC(),
+		auth.PermissionStringMap[auth.NoPermission])
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// reportUsageRecords passes up to limit unreported usage records to report, oldest first,
+// and marks them reported if report succeeds. Records being reported by another instance are skipped.
+// Returns the number of reported records, or the error of report or the db.
+func reportUsageRecords(ctx context.Context, limit int, report func([]*usageRecord) error) (int, error) {
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	command := `SELECT day, organization, seats
+				FROM user_svc.usage_records
+				WHERE reported_timestamp IS NULL
+				ORDER BY day, organization
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+				`
+	records, err := scanUsageRecords(tx.QueryContext(ctx, command, limit))
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, tx.Rollback()
+	}
+
+	if err := report(records); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	command = `UPDATE user_svc.usage_records SET reported_timestamp = $3 WHERE day = $1 AND organization = $2`
+	for _, record := range records {
+		if _, err := tx.ExecContext(ctx, command, record.Day, record.Organization, time.Now().UTC()); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(records), nil
+}
+
+// getUsageRecords retrieves the usage records from from to to, both included, ordered by day and organization.
+// An empty organization returns every organization.
+// Returns any db error.
+func getUsageRecords(ctx context.Context, from time.Time, to time.Time, organization string) ([]*usageRecord, error) {
+	command := `SELECT day, organization, seats
+				FROM user_svc.usage_records
+				WHERE day BETWEEN $1 AND $2 AND ($3::TEXT = '' OR organization = $3)
+				ORDER BY day, organization
+				`
+
+	return scanUsageRecords(postgresDB.QueryContext(ctx, command,
+		from.UTC().Format(usageDayLayout), to.UTC().Format(usageDayLayout), organization))
+}
+
+func scanUsageRecords(rows *sql.Rows, err error) ([]*usageRecord, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var records []*usageRecord
+	for rows.Next() {
+		var day time.Time
+		record := &usageRecord{}
+		if err := rows.Scan(&day, &record.Organization, &record.Seats); err != nil {
+			return nil, err
+		}
+		record.Day = day.Format(usageDayLayout)
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// getReferralStats retrieves the referral code of uuid, how many users signed up with it and how many
+// of them verified their email, and who referred uuid.
+// Returns ErrUUIDNotFound if uuid does not exist, or any db error.
+func getReferralStats(ctx context.Context, uuid string) (*referralStats, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT a.referral_code,
+					COUNT(r.referee_uuid),
+					COUNT(r.referee_uuid) FILTER (WHERE referee.is_verified),
+					COALESCE((SELECT referrer_uuid FROM user_svc.referrals WHERE referee_uuid = a.uuid), '')
+				FROM user_svc.accounts a
+				LEFT JOIN user_svc.referrals r ON r.referrer_uuid = a.uuid
+				LEFT JOIN user_svc.accounts referee ON referee.uuid = r.referee_uuid
+				WHERE a.uuid = $1
+				GROUP BY a.uuid, a.referral_code
+				`
+
+	stats := &referralStats{}
+	err := postgresDB.QueryRowContext(ctx, command, uuid).Scan(&stats.code, &stats.referrals,
+		&stats.verifiedReferrals, &stats.referredBy)
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrUUIDNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// setOnboardingStep marks step of uuid's onboarding checklist completed at now, or not completed.
+// Completing a step twice keeps the first timestamp.
+// Returns ErrTooManyOnboardingSteps if uuid already completed maxOnboardingSteps other steps, or any db error.
+func setOnboardingStep(ctx context.Context, uuid string, step string, completed bool, now time.Time) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if !completed {
+		command := `DELETE FROM user_svc.onboarding_steps WHERE uuid = $1 AND step = $2`
+		_, err := postgresDB.ExecContext(ctx, command, uuid, step)
+		return err
+	}
+
+	command := `INSERT INTO user_svc.onboarding_steps(uuid, step, completed_timestamp)
+				SELECT $1, $2, $3
+				WHERE (SELECT COUNT(*) FROM user_svc.onboarding_steps WHERE uuid = $1) < $4
+				ON CONFLICT (uuid, step) DO NOTHING
+				`
+	result, err := postgresDB.ExecContext(ctx, command, uuid, step, now.UTC(), maxOnboardingSteps)
+	if err != nil {
+		return err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil || inserted > 0 {
+		return err
+	}
+
+	// nothing was inserted, either the step was already completed or the checklist is full
+	var exists bool
+	command = `SELECT EXISTS(SELECT 1 FROM user_svc.onboarding_steps WHERE uuid = $1 AND step = $2)`
+	if err := postgresDB.QueryRowContext(ctx, command, uuid, step).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return consts.ErrTooManyOnboardingSteps
+	}
+
+	return nil
+}
+
+// getOnboardingSteps retrieves the completed onboarding steps of uuid, in the order they were completed.
+// Returns any db error.
+func getOnboardingSteps(ctx context.Context, uuid string) ([]onboardingStep, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT step, completed_timestamp
+				FROM user_svc.onboarding_steps
+				WHERE uuid = $1
+				ORDER BY completed_timestamp, step
+				`
+	rows, err := postgresDB.QueryContext(ctx, command, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var steps []onboardingStep
+	for rows.Next() {
+		var step onboardingStep
+		if err := rows.Scan(&step.name, &step.completed); err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return steps, nil
+}
+
+// getNotificationPreferences looks up the email categories uuid receives.
+// Returns ErrUserNotFound if uuid does not exist, or any db error.
+func getNotificationPreferences(ctx context.Context, uuid string) (*notificationPreferences, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT ` + notificationPreferencesColumns() + `
+				FROM user_svc.accounts
+				WHERE uuid = $1
+				`
+
+	return scanNotificationPreferences(postgresDB.QueryRowContext(ctx, command, uuid))
+}
+
+// updateNotificationPreferences switches the email categories in updates on or off for uuid,
+// categories not in updates are left unchanged.
+// Returns the resulting preferences, ErrUserNotFound if uuid does not exist, or any db error.
+func updateNotificationPreferences(ctx context.Context, uuid string,
+	updates map[string]bool) (*notificationPreferences, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+	if len(updates) == 0 {
+		return nil, consts.ErrInvalidNotificationSetting
+	}
+
+	categories := make([]string, 0, len(updates))
+	for category := range updates {
+		if _, ok := notificationColumns[category]; !ok {
+			return nil, consts.ErrInvalidNotificationSetting
+		}
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	assignments := make([]string, 0, len(categories))
+	args := []interface{}{uuid}
+	for _, category := range categories {
+		args = append(args, updates[category])
+		assignments = append(assignments,
+			assignColumn("accounts", notificationColumns[category], fmt.Sprintf("$%d", len(args)))...)
+	}
+
+	command := `UPDATE user_svc.accounts SET ` + strings.Join(assignments, ", ") + `
+				WHERE uuid = $1
+				RETURNING ` + notificationPreferencesColumns() + `
+				`
+
+	return scanNotificationPreferences(postgresDB.QueryRowContext(ctx, command, args...))
+}
+
+// notificationPreferencesColumns returns the select list scanned by scanNotificationPreferences.
+func notificationPreferencesColumns() string {
+	return strings.Join([]string{
+		readColumn("accounts", notificationColumns[emailCategoryShareAlerts]),
+		readColumn("accounts", notificationColumns[emailCategorySecurityAlerts]),
+		readColumn("accounts", notificationColumns[emailCategoryMarketing]),
+	}, ", ")
+}
+
+func scanNotificationPreferences(row *sql.Row) (*notificationPreferences, error) {
+	preferences := &notificationPreferences{}
+	err := row.Scan(&preferences.shareAlerts, &preferences.securityAlerts, &preferences.marketing)
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return preferences, nil
+}
+
+// insertAdminAction records that actor, an admin, was authorized to perform action on subject at now.
+// Returns any db error.
+func insertAdminAction(ctx context.Context, actor string, action string, subject string, now time.Time) error {
+	command := `INSERT INTO user_svc.admin_actions(actor, action, subject, created_timestamp)
+				VALUES($1, $2, $3, $4)
+				`
+	_, err := postgresDB.ExecContext(ctx, command, actor, action, subject, now.UTC())
+
+	return err
+}
+
+// getAdminActions retrieves at most limit admin actions recorded from from, included, to to, excluded,
+// after fromSequence, in the order they were recorded.
+// Returns any db error.
+func getAdminActions(ctx context.Context, fromSequence int64, from time.Time, to time.Time,
+	limit int) ([]*adminAction, error) {
+	command := `SELECT sequence, actor, action, subject, created_timestamp
+				FROM user_svc.admin_actions
+				WHERE sequence > $1 AND created_timestamp >= $2 AND created_timestamp < $3
+				ORDER BY sequence
+				LIMIT $4
+				`
+	rows, err := postgresDB.QueryContext(ctx, command, fromSequence, from.UTC(), to.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var actions []*adminAction
+	for rows.Next() {
+		action := &adminAction{}
+		if err := rows.Scan(&action.sequence, &action.actor, &action.action, &action.subject,
+			&action.timestamp); err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return actions, nil
+}
+
+// insertAuditEntry records that actor performed action on target at now, with the request metadata recorded.
+// Returns any db error.
+func insertAuditEntry(ctx context.Context, actor string, action string, target string,
+	recorded map[string]string, now time.Time) error {
+	encoded, err := json.Marshal(recorded)
+	if err != nil {
+		return err
+	}
+
+	command := `INSERT INTO user_svc.audit_log(actor, action, target, metadata, created_timestamp)
+				VALUES($1, $2, $3, $4, $5)
+				`
+	_, err = postgresDB.ExecContext(ctx, command, actor, action, target, string(encoded), now.UTC())
+
+	return err
+}
+
+// getAuditEntries retrieves at most limit audit entries recorded from from, included, to to, excluded,
+// after fromSequence, in the order they were recorded.
+// Returns any db error.
+func getAuditEntries(ctx context.Context, fromSequence int64, from time.Time, to time.Time,
+	limit int) ([]*auditEntry, error) {
+	command := `SELECT sequence, actor, action, target, metadata, created_timestamp
+				FROM user_svc.audit_log
+				WHERE sequence > $1 AND created_timestamp >= $2 AND created_timestamp < $3
+				ORDER BY sequence
+				LIMIT $4
+				`
+	rows, err := postgresDB.QueryContext(ctx, command, fromSequence, from.UTC(), to.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var entries []*auditEntry
+	for rows.Next() {
+		entry := &auditEntry{}
+		var encoded []byte
+		if err := rows.Scan(&entry.sequence, &entry.actor, &entry.action, &entry.target, &encoded,
+			&entry.timestamp); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(encoded, &entry.metadata); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// getAnalyticsAccounts retrieves the columns of every account the analytics export needs, names and emails
+// are deliberately not selected. organizationUsers counts the accounts sharing the organization.
+// Returns any db error.
+func getAnalyticsAccounts(ctx context.Context) ([]*analyticsAccount, error) {
+	command := `SELECT accounts.uuid, COALESCE(accounts.organization, ''),
+					   COUNT(*) OVER (PARTITION BY accounts.organization),
+					   accounts.created_timestamp, accounts.is_verified, accounts.permission_level,
+					   COALESCE(referrals.referrer_uuid, '')
+				FROM user_svc.accounts
+						 LEFT JOIN user_svc.referrals ON referrals.referee_uuid = accounts.uuid
+				ORDER BY accounts.uuid
+				`
+	rows, err := postgresDB.QueryContext(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var accounts []*analyticsAccount
+	for rows.Next() {
+		account := &analyticsAccount{}
+		if err := rows.Scan(&account.uuid, &account.organization, &account.organizationUsers, &account.created,
+			&account.verified, &account.permissionLevel, &account.referrer); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return accounts, nil
+}
+
+// getAuthMethods returns the methods uuid can sign in with, the password first and then in the order they were linked.
+// Returns ErrUserNotFound if uuid does not exist, or any db error.
+func getAuthMethods(ctx context.Context, uuid string) ([]*authMethod, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	var hasPassword bool
+	err := postgresDB.QueryRowContext(ctx, `SELECT password <> '' FROM user_svc.accounts WHERE uuid = $1`,
+		uuid).Scan(&hasPassword)
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var methods []*authMethod
+	if hasPassword {
+		methods = append(methods, &authMethod{method: authMethodPassword})
+	}
+
+	command := `SELECT method, credential_id
+				FROM user_svc.auth_methods
+				WHERE uuid = $1
+				ORDER BY created_timestamp, method, credential_id
+				`
+	rows, err := postgresDB.QueryContext(ctx, command, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		method := &authMethod{}
+		if err := rows.Scan(&method.method, &method.credentialID); err != nil {
+			return nil, err
+		}
+		methods = append(methods, method)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return methods, nil
+}
+
+// insertAuthMethod links method to uuid at now, secret is the hash of a credential generated by the service,
+// such as an api key, empty if the credential is verified by the gateway.
+// Returns ErrAuthMethodLinked if the credential is linked to any account, ErrUserNotFound if uuid does not
+// exist, or any db error.
+func insertAuthMethod(ctx context.Context, uuid string, method *authMethod, secret string, now time.Time) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	command := `INSERT INTO user_svc.auth_methods(method, credential_id, secret, uuid, created_timestamp)
+				VALUES($1, $2, $3, $4, $5)
+				`
+	_, err := postgresDB.ExecContext(ctx, command, method.method, method.credentialID,
+		sql.NullString{String: secret, Valid: secret != ""}, uuid, now.UTC())
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Name() {
+		case "unique_violation":
+			return consts.ErrAuthMethodLinked
+		case "foreign_key_violation":
+			return consts.ErrUserNotFound
+		}
+	}
+
+	return err
+}
+
+// deleteAuthMethod unlinks method from uuid, unlinking the password blanks it out.
+// The password is only unlinked if one of signInAuthMethods remains, so the user can still sign in.
+// The account is locked, so concurrent unlinks cannot remove the last two methods at once.
+// Returns ErrAuthMethodNotFound if method is not linked to uuid, ErrLastSignInMethod if the user could no
+// longer sign in, ErrLastAuthMethod if it is the only method left, ErrUserNotFound if uuid does not exist,
+// or any db error.
+func deleteAuthMethod(ctx context.Context, uuid string, method *authMethod) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var hasPassword bool
+	err = tx.QueryRowContext(ctx, `SELECT password <> '' FROM user_svc.accounts WHERE uuid = $1 FOR UPDATE`,
+		uuid).Scan(&hasPassword)
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return consts.ErrUserNotFound
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	signInMethods := make([]string, 0, len(signInAuthMethods))
+	for signInMethod := range signInAuthMethods {
+		signInMethods = append(signInMethods, signInMethod)
+	}
+
+	var linked, signIn int64
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*), COUNT(*) FILTER (WHERE method = ANY($2))
+				FROM user_svc.auth_methods WHERE uuid = $1`, uuid, pq.Array(signInMethods)).Scan(&linked, &signIn)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	var remaining int64
+	if method.method == authMethodPassword {
+		if !hasPassword {
+			_ = tx.Rollback()
+			return consts.ErrAuthMethodNotFound
+		}
+		if signIn < 1 {
+			_ = tx.Rollback()
+			return consts.ErrLastSignInMethod
+		}
+		remaining = linked
+
+		command := `UPDATE user_svc.accounts SET password = '', modified_timestamp = $2 WHERE uuid = $1`
+		if _, err := tx.ExecContext(ctx, command, uuid, time.Now().UTC()); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	} else {
+		command := `DELETE FROM user_svc.auth_methods WHERE uuid = $1 AND method = $2 AND credential_id = $3`
+		result, err := tx.ExecContext(ctx, command, uuid, method.method, method.credentialID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if deleted == 0 {
+			_ = tx.Rollback()
+			return consts.ErrAuthMethodNotFound
+		}
+
+		remaining = linked - deleted
+		if hasPassword {
+			remaining++
+		}
+	}
+
+	if remaining < 1 {
+		_ = tx.Rollback()
+		return consts.ErrLastAuthMethod
+	}
+
+	return tx.Commit()
+}
+
+// getTwoFactor looks up the two-factor enrollment of uuid.
+// Returns nil if uuid never enabled two-factor authentication, error if uuid is invalid, or any db error.
+func getTwoFactor(ctx context.Context, uuid string) (*twoFactor, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	enrollment := &twoFactor{}
+	err := postgresDB.QueryRowContext(ctx, `SELECT secret, last_used_step, enabled_timestamp IS NOT NULL
+				FROM user_security.totp_secrets
+				WHERE uuid = $1`, uuid).Scan(&enrollment.sealedSecret, &enrollment.lastUsedStep, &enrollment.enabled)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return enrollment, nil
+}
+
+// insertTOTPSecret stores the sealed TOTP secret of uuid as its pending enrollment, replacing a pending secret.
+// Returns ErrTwoFactorEnabled if uuid has two-factor authentication enabled, ErrUserNotFound if uuid does not
+// exist, or any db error.
+func insertTOTPSecret(ctx context.Context, uuid string, sealedSecret []byte, now time.Time) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	command := `INSERT INTO user_security.totp_secrets(uuid, secret, created_timestamp)
+				VALUES($1, $2, $3)
+				ON CONFLICT (uuid) DO UPDATE
+				SET secret = EXCLUDED.secret, last_used_step = 0, created_timestamp = EXCLUDED.created_timestamp
+				WHERE user_security.totp_secrets.enabled_timestamp IS NULL
+				`
+	result, err := postgresDB.ExecContext(ctx, command, uuid, sealedSecret, now.UTC())
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "foreign_key_violation" {
+		return consts.ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		if err != nil {
+			return err
+		}
+		return consts.ErrTwoFactorEnabled
+	}
+
+	return nil
+}
+
+// enableTwoFactor enables the pending enrollment of uuid, confirmed with the code of step, and replaces its
+// backup codes with codeHashes.
+// Returns ErrTwoFactorNotPending if uuid has no pending enrollment, or any db error.
+func enableTwoFactor(ctx context.Context, uuid string, step int64, codeHashes []string, now time.Time) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `UPDATE user_security.totp_secrets
+				SET enabled_timestamp = $2, last_used_step = $3
+				WHERE uuid = $1 AND enabled_timestamp IS NULL`, uuid, now.UTC(), step)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	enabled, err := result.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if enabled == 0 {
+		_ = tx.Rollback()
+		return consts.ErrTwoFactorNotPending
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_security.backup_codes WHERE uuid = $1`, uuid); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO user_security.backup_codes(uuid, code_hash)
+				SELECT $1, UNNEST($2::TEXT[])`, uuid, pq.Array(codeHashes)); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// useTOTPStep records step as the last step whose code uuid used, each code is accepted once.
+// Returns ErrInvalidTwoFactorCode if the code of step or a later one was already used, or any db error.
+func useTOTPStep(ctx context.Context, uuid string, step int64) error {
+	result, err := postgresDB.ExecContext(ctx, `UPDATE user_security.totp_secrets SET last_used_step = $2
+				WHERE uuid = $1 AND last_used_step < $2`, uuid, step)
+	if err != nil {
+		return err
+	}
+
+	if used, err := result.RowsAffected(); err != nil || used == 0 {
+		if err != nil {
+			return err
+		}
+		return consts.ErrInvalidTwoFactorCode
+	}
+
+	return nil
+}
+
+// useBackupCode uses up the backup code of uuid with codeHash at now.
+// Returns ErrInvalidTwoFactorCode if uuid has no unused backup code with codeHash, or any db error.
+func useBackupCode(ctx context.Context, uuid string, codeHash string, now time.Time) error {
+	result, err := postgresDB.ExecContext(ctx, `UPDATE user_security.backup_codes SET used_timestamp = $3
+				WHERE uuid = $1 AND code_hash = $2 AND used_timestamp IS NULL`, uuid, codeHash, now.UTC())
+	if err != nil {
+		return err
+	}
+
+	if used, err := result.RowsAffected(); err != nil || used == 0 {
+		if err != nil {
+			return err
+		}
+		return consts.ErrInvalidTwoFactorCode
+	}
+
+	return nil
+}
+
+// deleteTwoFactor deletes the two-factor enrollment and backup codes of uuid.
+// Returns ErrTwoFactorNotEnabled if uuid has no enrollment, or any db error.
+func deleteTwoFactor(ctx context.Context, uuid string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM user_security.totp_secrets WHERE uuid = $1`, uuid)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if deleted == 0 {
+		_ = tx.Rollback()
+		return consts.ErrTwoFactorNotEnabled
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_security.backup_codes WHERE uuid = $1`, uuid); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertServiceAPIKey stores k, created by the admin or service createdBy.
+// Returns any db error.
+func insertServiceAPIKey(ctx context.Context, k *serviceAPIKey) error {
+	command := `INSERT INTO user_security.service_api_keys(key_id, name, key_hash, scopes, created_by, created_timestamp)
+				VALUES($1, $2, $3, $4, $5, $6)
+				`
+	_, err := postgresDB.ExecContext(ctx, command, k.keyID, k.name, k.keyHash, pq.Array(k.scopes), k.createdBy,
+		k.created.UTC())
+
+	return err
+}
+
+// getServiceAPIKey looks up the service api key with keyID, revoked keys included.
+// Returns ErrAPIKeyNotFound if there is no such key, or any db error.
+func getServiceAPIKey(ctx context.Context, keyID string) (*serviceAPIKey, error) {
+	command := `SELECT key_id, name, key_hash, scopes, created_by, created_timestamp, revoked_timestamp
+				FROM user_security.service_api_keys
+				WHERE key_id = $1
+				`
+	k, err := scanServiceAPIKey(postgresDB.QueryRowContext(ctx, command, keyID))
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// listServiceAPIKeys returns every service api key in the order they were created, revoked keys included.
+// Returns any db error.
+func listServiceAPIKeys(ctx context.Context) ([]*serviceAPIKey, error) {
+	command := `SELECT key_id, name, key_hash, scopes, created_by, created_timestamp, revoked_timestamp
+				FROM user_security.service_api_keys
+				ORDER BY created_timestamp, key_id
+				`
+	rows, err := postgresDB.QueryContext(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var keys []*serviceAPIKey
+	for rows.Next() {
+		k, err := scanServiceAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// scanServiceAPIKey scans a row of user_security.service_api_keys selected in column order.
+func scanServiceAPIKey(row interface{ Scan(...interface{}) error }) (*serviceAPIKey, error) {
+	k := &serviceAPIKey{}
+	var revoked pq.NullTime
+	if err := row.Scan(&k.keyID, &k.name, &k.keyHash, pq.Array(&k.scopes), &k.createdBy, &k.created,
+		&revoked); err != nil {
+		return nil, err
+	}
+	if revoked.Valid {
+		k.revoked = revoked.Time
+	}
+
+	return k, nil
+}
+
+// revokeServiceAPIKey revokes the service api key with keyID at now, it is refused from then on.
+// Returns ErrAPIKeyNotFound if there is no such key or it is already revoked, or any db error.
+func revokeServiceAPIKey(ctx context.Context, keyID string, now time.Time) error {
+	result, err := postgresDB.ExecContext(ctx, `UPDATE user_security.service_api_keys SET revoked_timestamp = $2
+				WHERE key_id = $1 AND revoked_timestamp IS NULL`, keyID, now.UTC())
+	if err != nil {
+		return err
+	}
+
+	if revoked, err := result.RowsAffected(); err != nil || revoked == 0 {
+		if err != nil {
+			return err
+		}
+		return consts.ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+// touchAuthToken records activity of token at now, unless it was last active idle or longer ago.
+// Tokens without recorded activity count as active.
+// Returns false if token is idle or does not exist, or any db error.
+func touchAuthToken(ctx context.Context, token string, now time.Time, idle time.Duration) (bool, error) {
+	if token == "" {
+		return false, authconst.ErrEmptyToken
+	}
+
+	command := `UPDATE user_security.auth_tokens
+				SET last_activity = $2
+				WHERE token = $1 AND COALESCE(last_activity, $2) > $3
+				`
+	result, err := postgresDB.ExecContext(ctx, command, token, now.UTC(), now.UTC().Add(-idle))
+	if err != nil {
+		return false, err
+	}
+
+	touched, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return touched == 1, nil
+}
+
+// recordLoginCountry records a login of uuid from country at now. A country the account never signed in from is
+// stored unconfirmed if confirm is true, unless it is the first country of the account. Unconfirmed countries
+// are confirmed by the next login if confirm is false.
+// Returns whether country is known, new or still unconfirmed for the account, ErrUserNotFound, or any db error.
+func recordLoginCountry(ctx context.Context, uuid string, country string, now time.Time,
+	confirm bool) (loginCountryState, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return loginCountryKnown, err
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return loginCountryKnown, err
+	}
+
+	// concurrent logins of the account wait here, so only one of them finds the country new
+	var locked string
+	err = tx.QueryRowContext(ctx, `SELECT uuid FROM user_svc.accounts WHERE uuid = $1 FOR UPDATE`,
+		uuid).Scan(&locked)
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return loginCountryKnown, consts.ErrUserNotFound
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return loginCountryKnown, err
+	}
+
+	var confirmed bool
+	err = tx.QueryRowContext(ctx, `UPDATE user_security.login_countries
+				SET last_seen_timestamp = $3, confirmed = confirmed OR NOT $4
+				WHERE uuid = $1 AND country = $2
+				RETURNING confirmed`, uuid, country, now.UTC(), confirm).Scan(&confirmed)
+	switch {
+	case err == nil:
+		if err := tx.Commit(); err != nil {
+			return loginCountryKnown, err
+		}
+		if !confirmed {
+			return loginCountryUnconfirmed, nil
+		}
+		return loginCountryKnown, nil
+	case err != sql.ErrNoRows:
+		_ = tx.Rollback()
+		return loginCountryKnown, err
+	}
+
+	var seen bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM user_security.login_countries WHERE uuid = $1)`,
+		uuid).Scan(&seen)
+	if err != nil {
+		_ = tx.Rollback()
+		return loginCountryKnown, err
+	}
+
+	command := `INSERT INTO user_security.login_countries(
+					uuid, country, first_seen_timestamp, last_seen_timestamp, confirmed
+				) VALUES($1, $2, $3, $3, $4)
+				`
+	if _, err := tx.ExecContext(ctx, command, uuid, country, now.UTC(), !seen || !confirm); err != nil {
+		_ = tx.Rollback()
+		return loginCountryKnown, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return loginCountryKnown, err
+	}
+
+	if !seen {
+		return loginCountryKnown, nil
+	}
+	return loginCountryNew, nil
+}
+
+// insertLoginCountryToken stores token as the confirmation of the unconfirmed country of uuid,
+// replacing any token sent before. Confirmed countries are left unchanged.
+// Returns error if uuid, token or secret is invalid, or any db error.
+func insertLoginCountryToken(ctx context.Context, uuid string, country string, token string,
+	secret *pblib.Secret) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if token == "" {
+		return authconst.ErrEmptyToken
+	}
+
+	if err := auth.ValidateSecret(secret); err != nil {
+		return err
+	}
+
+	command := `UPDATE user_security.login_countries
+				SET confirmation_token = $3, confirmation_expiration = $4
+				WHERE uuid = $1 AND country = $2 AND NOT confirmed
+				`
+	_, err := postgresDB.ExecContext(ctx, command, uuid, country, token,
+		time.Unix(secret.GetExpirationTimestamp(), 0).UTC())
+
+	return err
+}
+
+// confirmLoginCountryRow consumes token and confirms the country it was sent for.
+// Returns the uuid of the account, ErrNoMatchingLoginCountryToken, ErrExpiredLoginCountryToken with the uuid
+// of the account if the token expired, or any db error.
+func confirmLoginCountryRow(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", authconst.ErrEmptyToken
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	var uuid, country string
+	var expirationTimestamp time.Time
+	err = tx.QueryRowContext(ctx, `SELECT uuid, country, confirmation_expiration
+				FROM user_security.login_countries
+				WHERE confirmation_token = $1
+				FOR UPDATE`, token).Scan(&uuid, &country, &expirationTimestamp)
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return "", consts.ErrNoMatchingLoginCountryToken
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	confirmed := time.Now().Before(expirationTimestamp)
+	command := `UPDATE user_security.login_countries
+				SET confirmed = confirmed OR $3, confirmation_token = NULL, confirmation_expiration = NULL
+				WHERE uuid = $1 AND country = $2
+				`
+	if _, err := tx.ExecContext(ctx, command, uuid, country, confirmed); err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	if !confirmed {
+		return uuid, consts.ErrExpiredLoginCountryToken
+	}
+	return uuid, nil
+}
+
+// getPasswordChanged returns when the password of uuid was last set.
+// Returns ErrUserNotFound, or any db error.
+func getPasswordChanged(ctx context.Context, uuid string) (time.Time, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return time.Time{}, err
+	}
+
+	var changed time.Time
+	err := postgresDB.QueryRowContext(ctx, `SELECT password_changed_timestamp FROM user_svc.accounts WHERE uuid = $1`,
+		uuid).Scan(&changed)
+	if err == sql.ErrNoRows {
+		return time.Time{}, consts.ErrUserNotFound
+	}
+
+	return changed, err
+}
+
+// getPasswordExpiryReminders returns the users of organization whose password was set between expired and due,
+// and who were not reminded of it yet. Users without a password are not returned.
+// Returns any db error.
+func getPasswordExpiryReminders(ctx context.Context, organization string, expired time.Time,
+	due time.Time) ([]*passwordExpiryReminder, error) {
+	command := `SELECT uuid, email, password_changed_timestamp
+				FROM user_svc.accounts
+				WHERE organization = $1 AND password <> '' AND password_reminder_timestamp IS NULL
+					AND deleted_timestamp IS NULL
+					AND password_changed_timestamp > $2 AND password_changed_timestamp <= $3
+				ORDER BY password_changed_timestamp
+				`
+	rows, err := postgresDB.QueryContext(ctx, command, organization, expired.UTC(), due.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reminders []*passwordExpiryReminder
+	for rows.Next() {
+		reminder := &passwordExpiryReminder{}
+		if err := rows.Scan(&reminder.uuid, &reminder.email, &reminder.changed); err != nil {
+			return nil, err
+		}
+		reminders = append(reminders, reminder)
+	}
+
+	return reminders, rows.Err()
+}
+
+// markPasswordReminded records uuid was reminded at now that its password expires, unless the password
+// was changed after changed.
+// Returns any db error.
+func markPasswordReminded(ctx context.Context, uuid string, changed time.Time, now time.Time) error {
+	command := `UPDATE user_svc.accounts
+				SET password_reminder_timestamp = $3
+				WHERE uuid = $1 AND password_changed_timestamp = $2
+				`
+	_, err := postgresDB.ExecContext(ctx, command, uuid, changed.UTC(), now.UTC())
+
+	return err
+}
+
+// insertRefreshToken stores the hash of a refresh token of uuid, created at created and valid until expires.
+// Returns error if uuid is invalid or the hash is empty, ErrUserNotFound if there is no such user, or any db error.
+func insertRefreshToken(ctx context.Context, uuid string, tokenHash string, created time.Time,
+	expires time.Time) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if tokenHash == "" {
+		return authconst.ErrEmptyToken
+	}
+
+	command := `INSERT INTO user_security.refresh_tokens(token_hash, uuid, created_timestamp, expiration_timestamp)
+				VALUES($1, $2, $3, $4)
+				`
+	_, err := postgresDB.ExecContext(ctx, command, tokenHash, uuid, created.UTC(), expires.UTC())
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "foreign_key_violation" {
+		return consts.ErrUserNotFound
+	}
+
+	return err
+}
+
+// consumeRefreshToken deletes the refresh token with tokenHash, a refresh token is exchanged once.
+// Returns the uuid of the account, ErrExpiredRefreshToken if the token expired, ErrNoMatchingRefreshToken
+// if there is no such token, or any db error.
+func consumeRefreshToken(ctx context.Context, tokenHash string) (string, error) {
+	if tokenHash == "" {
+		return "", authconst.ErrEmptyToken
+	}
+
+	var uuid string
+	var expirationTimestamp time.Time
+	err := postgresDB.QueryRowContext(ctx, `DELETE FROM user_security.refresh_tokens
+				WHERE token_hash = $1
+				RETURNING uuid, expiration_timestamp`, tokenHash).Scan(&uuid, &expirationTimestamp)
+	if err == sql.ErrNoRows {
+		return "", consts.ErrNoMatchingRefreshToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !time.Now().Before(expirationTimestamp) {
+		return "", consts.ErrExpiredRefreshToken
+	}
+
+	return uuid, nil
+}
+
+// getUserRowByEmail looks up a user by its email, ignoring case.
+// Returns ErrEmailDoesNotExist if no account has the email, or any db error.
+func getUserRowByEmail(ctx context.Context, email string) (*pblib.User, error) {
+	if err := validateEmail(email); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT uuid, first_name, last_name, email, organization, 
+       				created_timestamp, is_verified, password, permission_level, prospective_email
+				FROM user_svc.accounts 
+				WHERE LOWER(email) = LOWER($1) AND deleted_timestamp IS NULL
+				`
+
+	foundUser, err := scanUserRow(postgresDB.QueryRowContext(ctx, command, email))
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrEmailDoesNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return foundUser, nil
+}
+
+// insertPasswordResetToken stores token as the pending password reset of uuid until expires,
+// replacing the token of any previous request.
+// Returns error if uuid, token or secret are invalid, or any db error.
+func insertPasswordResetToken(ctx context.Context, uuid string, token string, secret *pblib.Secret,
+	expires time.Time) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if token == "" {
+		return authconst.ErrEmptyToken
+	}
+
+	if err := auth.ValidateSecret(secret); err != nil {
+		return err
+	}
+
+	command := `INSERT INTO user_svc.password_reset_tokens(
+					token, secret_key, created_timestamp, expiration_timestamp, uuid
+				) VALUES($1, $2, $3, $4, $5)
+				ON CONFLICT (uuid) DO UPDATE SET
+					token = EXCLUDED.token,
+					secret_key = EXCLUDED.secret_key,
+					created_timestamp = EXCLUDED.created_timestamp,
+					expiration_timestamp = EXCLUDED.expiration_timestamp
+				`
+	_, err := postgresDB.ExecContext(ctx, command, token, secret.GetKey(),
+		time.Unix(secret.GetCreatedTimestamp(), 0).UTC(), expires.UTC(), uuid)
+
+	return err
+}
+
+// consumePasswordResetToken deletes token, concurrent resets with the same token find no row once the first
+// deletes it.
+// Returns the uuid of the account, ErrExpiredPasswordResetToken with the uuid of the account if the token expired,
+// ErrNoMatchingPasswordReset if there is no such token, or any db error.
+func consumePasswordResetToken(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", authconst.ErrEmptyToken
+	}
+
+	var uuid string
+	var expirationTimestamp time.Time
+	err := postgresDB.QueryRowContext(ctx, `DELETE FROM user_svc.password_reset_tokens
+				WHERE token = $1
+				RETURNING uuid, expiration_timestamp`, token).Scan(&uuid, &expirationTimestamp)
+	if err == sql.ErrNoRows {
+		return "", consts.ErrNoMatchingPasswordReset
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if !time.Now().Before(expirationTimestamp) {
+		return uuid, consts.ErrExpiredPasswordResetToken
+	}
+
+	return uuid, nil
+}
+
+// insertEmailChangeToken stores the token confirming email as the new email of uuid until expires,
+// replacing the token of any previous change.
+// Returns error if a parameter is invalid, or any db error.
+func insertEmailChangeToken(ctx context.Context, uuid string, email string, token string, secret *pblib.Secret,
+	expires time.Time) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	if err := validateEmail(email); err != nil {
+		return err
+	}
+
+	if token == "" {
+		return authconst.ErrEmptyToken
+	}
+
+	if err := auth.ValidateSecret(secret); err != nil {
+		return err
+	}
+
+	command := `INSERT INTO user_svc.email_change_tokens(
+					token, secret_key, email, created_timestamp, expiration_timestamp, uuid
+				) VALUES($1, $2, $3, $4, $5, $6)
+				ON CONFLICT (uuid) DO UPDATE SET
+					token = EXCLUDED.token,
+					secret_key = EXCLUDED.secret_key,
+					email = EXCLUDED.email,
+					created_timestamp = EXCLUDED.created_timestamp,
+					expiration_timestamp = EXCLUDED.expiration_timestamp
+				`
+	_, err := postgresDB.ExecContext(ctx, command, token, secret.GetKey(), email,
+		time.Unix(secret.GetCreatedTimestamp(), 0).UTC(), expires.UTC(), uuid)
+
+	return err
+}
+
+// confirmEmailChangeRow consumes token and makes the prospective email of its user the email, which counts as
+// verified since the user opened the link sent to it. The reservation of the email is released.
+// Returns the updated user, ErrExpiredEmailChangeToken if the token expired, ErrNoMatchingEmailChange if there is
+// no such token or the change was cancelled, ErrEmailExists if another account took the email, or any db error.
+func confirmEmailChangeRow(ctx context.Context, token string) (*pblib.User, error) {
+	if token == "" {
+		return nil, authconst.ErrEmptyToken
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var uuid, email string
+	var expirationTimestamp time.Time
+	err = tx.QueryRowContext(ctx, `DELETE FROM user_svc.email_change_tokens
+				WHERE token = $1
+				RETURNING uuid, email, expiration_timestamp`, token).Scan(&uuid, &email, &expirationTimestamp)
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return nil, consts.ErrNoMatchingEmailChange
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if !time.Now().Before(expirationTimestamp) {
+		// the token is gone either way
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, consts.ErrExpiredEmailChangeToken
+	}
+
+	// a cancelled change, or a reservation taken over by another user, cleared the prospective email
+	command := `UPDATE user_svc.accounts
+				SET email = prospective_email, prospective_email = NULL, is_verified = TRUE, modified_timestamp = $3
+				WHERE uuid = $1 AND LOWER(prospective_email) = LOWER($2) AND deleted_timestamp IS NULL
+				RETURNING uuid, first_name, last_name, email, organization,
+					created_timestamp, is_verified, password, permission_level, prospective_email
+				`
+	updatedUser, err := scanUserRow(tx.QueryRowContext(ctx, command, uuid, email, time.Now().UTC()))
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return nil, consts.ErrNoMatchingEmailChange
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "unique_violation" {
+		_ = tx.Rollback()
+		return nil, consts.ErrEmailExists
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_svc.email_reservations WHERE uuid = $1`,
+		uuid); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return updatedUser, nil
+}
+
+// cancelEmailChangeRow clears the prospective email of uuid, its confirmation token and its reservation.
+// Returns the number of cancelled changes, 0 if none was pending, or any db error.
+func cancelEmailChangeRow(ctx context.Context, uuid string) (int64, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return 0, err
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, `UPDATE user_svc.accounts
+				SET prospective_email = NULL, modified_timestamp = $2
+				WHERE uuid = $1 AND prospective_email IS NOT NULL`, uuid, time.Now().UTC())
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	cancelled, err := result.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	for _, command := range []string{
+		`DELETE FROM user_svc.email_change_tokens WHERE uuid = $1`,
+		`DELETE FROM user_svc.email_reservations WHERE uuid = $1`,
+	} {
+		if _, err := tx.ExecContext(ctx, command, uuid); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return cancelled, nil
+}
+
+// insertProfileChanges records changes uuid made to its profile at now, as part of tx.
+// Returns any db error.
+func insertProfileChanges(ctx context.Context, tx *sql.Tx, uuid string, changes []*profileChange,
+	now time.Time) error {
+	command := `INSERT INTO user_svc.profile_changes(uuid, field, old_hash, new_hash, created_timestamp)
+				VALUES($1, $2, $3, $4, $5)
+				`
+	for _, change := range changes {
+		if _, err := tx.ExecContext(ctx, command, uuid, change.field, change.oldHash, change.newHash,
+			now.UTC()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getProfileChanges returns at most limit changes uuid made to its profile after fromSequence, oldest first.
+// Returns any db error.
+func getProfileChanges(ctx context.Context, uuid string, fromSequence int64, limit int) ([]*profileChange, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT sequence, field, old_hash, new_hash, created_timestamp
+				FROM user_svc.profile_changes
+				WHERE uuid = $1 AND sequence > $2
+				ORDER BY sequence
+				LIMIT $3
+				`
+	rows, err := postgresDB.QueryContext(ctx, command, uuid, fromSequence, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var changes []*profileChange
+	for rows.Next() {
+		change := &profileChange{}
+		if err := rows.Scan(&change.sequence, &change.field, &change.oldHash, &change.newHash,
+			&change.timestamp); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// insertFavoriteDocument pins duid for uuid at now, favoriting a document twice keeps the first timestamp.
+// uuid may favorite the documents it owns, public documents and documents shared with it.
+// Returns ErrDocumentNotFound if duid is none of them, ErrTooManyFavorites if uuid already has maxFavorites
+// other favorites, ErrUserNotFound, or any db error.
+func insertFavoriteDocument(ctx context.Context, uuid string, duid string, now time.Time) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	command := `INSERT INTO user_svc.favorite_documents(uuid, duid, created_timestamp)
+				SELECT $1, d.duid, $3
+				FROM user_svc.documents d
+				WHERE d.duid = $2
+					AND (d.uuid = $1 OR d.is_public OR EXISTS(
+						SELECT 1 FROM user_svc.shared_documents s WHERE s.duid = d.duid AND s.uuid = $1))
+					AND (SELECT COUNT(*) FROM user_svc.favorite_documents WHERE uuid = $1) < $4
+				ON CONFLICT (uuid, duid) DO NOTHING
+				`
+	result, err := postgresDB.ExecContext(ctx, command, uuid, duid, now.UTC(), maxFavorites)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "foreign_key_violation" {
+		if pqErr.Constraint == "favorite_documents_duid_fkey" {
+			return consts.ErrDocumentNotFound
+		}
+		return consts.ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil || inserted > 0 {
+		return err
+	}
+
+	// nothing was inserted, the document is already a favorite, not accessible, or the favorites are full
+	var favorite, accessible bool
+	command = `SELECT
+					EXISTS(SELECT 1 FROM user_svc.favorite_documents WHERE uuid = $1 AND duid = $2),
+					EXISTS(SELECT 1 FROM user_svc.documents d
+						WHERE d.duid = $2 AND (d.uuid = $1 OR d.is_public OR EXISTS(
+							SELECT 1 FROM user_svc.shared_documents s WHERE s.duid = d.duid AND s.uuid = $1)))
+				`
+	if err := postgresDB.QueryRowContext(ctx, command, uuid, duid).Scan(&favorite, &accessible); err != nil {
+		return err
+	}
+
+	switch {
+	case favorite:
+		return nil
+	case !accessible:
+		return consts.ErrDocumentNotFound
+	}
+
+	return consts.ErrTooManyFavorites
+}
+
+// deleteFavoriteDocument unpins duid for uuid.
+// Returns ErrFavoriteNotFound if duid is not a favorite of uuid, or any db error.
+func deleteFavoriteDocument(ctx context.Context, uuid string, duid string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	command := `DELETE FROM user_svc.favorite_documents WHERE uuid = $1 AND duid = $2`
+	result, err := postgresDB.ExecContext(ctx, command, uuid, duid)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return consts.ErrFavoriteNotFound
+	}
+
+	return nil
+}
+
+// getFavoriteDocuments returns the duids uuid favorited, in the order they were favorited.
+// Documents that are no longer shared with uuid are left out until they are shared again.
+// Returns any db error.
+func getFavoriteDocuments(ctx context.Context, uuid string) ([]string, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT f.duid
+				FROM user_svc.favorite_documents f
+				JOIN user_svc.documents d ON d.duid = f.duid
+				WHERE f.uuid = $1
+					AND (d.uuid = $1 OR d.is_public OR EXISTS(
+						SELECT 1 FROM user_svc.shared_documents s WHERE s.duid = d.duid AND s.uuid = $1))
+				ORDER BY f.created_timestamp, f.duid
+				`
+	rows, err := postgresDB.QueryContext(ctx, command, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var duids []string
+	for rows.Next() {
+		var duid string
+		if err := rows.Scan(&duid); err != nil {
+			return nil, err
+		}
+		duids = append(duids, duid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return duids, nil
+}
+
+// insertDocument registers duid as a document owned by uuid. Registering a document of uuid again keeps it as is.
+// uuid owns any number of documents if quota is 0. New documents are shared as the share policy of uuid's
+// organization says, see SetSharePolicy.
+// Returns ErrDocumentExists if another user owns duid, ErrDocumentQuotaExceeded if uuid already owns quota
+// documents, ErrUserNotFound, or any db error.
+func insertDocument(ctx context.Context, uuid string, duid string, isPublic bool, quota int) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// concurrent registrations of the account wait here, so they cannot exceed the quota together
+	var organization string
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(organization, '') FROM user_svc.accounts WHERE uuid = $1 FOR UPDATE`,
+		uuid).Scan(&organization)
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return consts.ErrUserNotFound
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	var owner sql.NullString
+	var count int
+	command := `SELECT (SELECT uuid FROM user_svc.documents WHERE duid = $2),
+					(SELECT COUNT(*) FROM user_svc.documents WHERE uuid = $1)
+				`
+	if err := tx.QueryRowContext(ctx, command, uuid, duid).Scan(&owner, &count); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	switch {
+	case owner.Valid && owner.String == uuid:
+		return tx.Commit()
+	case owner.Valid:
+		_ = tx.Rollback()
+		return consts.ErrDocumentExists
+	case quota > 0 && count >= quota:
+		_ = tx.Rollback()
+		return consts.ErrDocumentQuotaExceeded
+	}
+
+	command = `INSERT INTO user_svc.documents(duid, uuid, is_public) VALUES($1, $2, $3)`
+	_, err = tx.ExecContext(ctx, command, duid, uuid, isPublic)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "unique_violation" {
+		// the document was registered by another user since it was looked up
+		_ = tx.Rollback()
+		return consts.ErrDocumentExists
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	command = `INSERT INTO user_svc.shared_documents(duid, uuid)
+				SELECT $1, a.uuid
+				FROM user_svc.accounts a
+				JOIN user_svc.share_policies p ON p.organization = a.organization
+				WHERE p.organization = $2 AND p.rule = $3 AND a.uuid <> $4
+				`
+	if _, err := tx.ExecContext(ctx, command, duid, organization, sharePolicyOrganization, uuid); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deleteDocument unregisters duid, a document owned by uuid, its shares and favorites are removed with it.
+// Returns ErrDocumentNotFound if uuid does not own duid, or any db error.
+func deleteDocument(ctx context.Context, uuid string, duid string) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	command := `DELETE FROM user_svc.documents WHERE duid = $1 AND uuid = $2`
+	result, err := postgresDB.ExecContext(ctx, command, duid, uuid)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return consts.ErrDocumentNotFound
+	}
+
+	return nil
+}
+
+// countDocuments returns the number of documents uuid owns.
+// Returns any db error.
+func countDocuments(ctx context.Context, uuid string) (int, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return 0, err
+	}
+
+	var count int
+	command := `SELECT COUNT(*) FROM user_svc.documents WHERE uuid = $1`
+	if err := postgresDB.QueryRowContext(ctx, command, uuid).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// updateDocumentPublic sets the is_public flag of duid, a document owned by uuid, and records the change at now.
+// Setting the flag to its current value records nothing.
+// Returns ErrDocumentNotFound if uuid does not own duid, or any db error.
+func updateDocumentPublic(ctx context.Context, uuid string, duid string, isPublic bool, now time.Time) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// concurrent changes of the document wait here, so each recorded change is the one applied
+	var wasPublic bool
+	err = tx.QueryRowContext(ctx, `SELECT is_public FROM user_svc.documents WHERE duid = $1 AND uuid = $2 FOR UPDATE`,
+		duid, uuid).Scan(&wasPublic)
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return consts.ErrDocumentNotFound
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if wasPublic == isPublic {
+		return tx.Commit()
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE user_svc.documents SET is_public = $2 WHERE duid = $1`,
+		duid, isPublic); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	command := `INSERT INTO user_svc.document_visibility_changes(duid, actor, is_public, created_timestamp)
+				VALUES($1, $2, $3, $4)
+				`
+	if _, err := tx.ExecContext(ctx, command, duid, uuid, isPublic, now.UTC()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getPublicDocuments retrieves at most limit public documents owned by uuid after fromDuid, in duid order.
+// An empty fromDuid starts from the first document.
+// Returns any db error.
+func getPublicDocuments(ctx context.Context, uuid string, fromDuid string, limit int) ([]string, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT duid
+				FROM user_svc.documents
+				WHERE uuid = $1 AND is_public AND duid > $2::TEXT
+				ORDER BY duid
+				LIMIT $3
+				`
+	rows, err := postgresDB.QueryContext(ctx, command, uuid, fromDuid, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var duids []string
+	for rows.Next() {
+		var duid string
+		if err := rows.Scan(&duid); err != nil {
+			return nil, err
+		}
+		duids = append(duids, duid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return duids, nil
+}
+
+// getUserDocuments retrieves at most limit documents owned by uuid after fromDuid, public or not, in duid order.
+// An empty fromDuid starts from the first document.
+// Returns any db error.
+func getUserDocuments(ctx context.Context, uuid string, fromDuid string, limit int) ([]*userDocument, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT duid, is_public
+				FROM user_svc.documents
+				WHERE uuid = $1 AND duid > $2::TEXT
+				ORDER BY duid
+				LIMIT $3
+				`
+	rows, err := postgresDB.QueryContext(ctx, command, uuid, fromDuid, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var documents []*userDocument
+	for rows.Next() {
+		document := &userDocument{}
+		if err := rows.Scan(&document.duid, &document.isPublic); err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return documents, nil
+}
+
+// upsertSharePolicy sets the share policy of organization to rule, recording actor as the admin that set it at now.
+// Setting sharePolicyNone removes the policy.
+// Returns any db error.
+func upsertSharePolicy(ctx context.Context, organization string, rule string, actor string, now time.Time) error {
+	if rule == sharePolicyNone {
+		_, err := postgresDB.ExecContext(ctx, `DELETE FROM user_svc.share_policies WHERE organization = $1`,
+			organization)
+		return err
+	}
+
+	command := `INSERT INTO user_svc.share_policies(organization, rule, updated_by, updated_timestamp)
+				VALUES($1, $2, $3, $4)
+				ON CONFLICT (organization) DO UPDATE
+				SET rule = EXCLUDED.rule, updated_by = EXCLUDED.updated_by, updated_timestamp = EXCLUDED.updated_timestamp
+				`
+	_, err := postgresDB.ExecContext(ctx, command, organization, rule, actor, now.UTC())
+
+	return err
+}
+
+// getSharePolicy retrieves the share policy of organization, sharePolicyNone if it has none.
+// Returns any db error.
+func getSharePolicy(ctx context.Context, organization string) (string, error) {
+	var rule string
+	err := postgresDB.QueryRowContext(ctx, `SELECT rule FROM user_svc.share_policies WHERE organization = $1`,
+		organization).Scan(&rule)
+	if err == sql.ErrNoRows {
+		return sharePolicyNone, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return rule, nil
+}
+
+// updateLastSeen sets the last seen timestamp of uuid to seen, unless another instance already recorded a later one.
+// Returns any db error.
+func updateLastSeen(ctx context.Context, uuid string, seen time.Time) error {
+	command := `UPDATE user_svc.accounts
+				SET last_seen_timestamp = $2
+				WHERE uuid = $1 AND (last_seen_timestamp IS NULL OR last_seen_timestamp < $2)
+				`
+	_, err := postgresDB.ExecContext(ctx, command, uuid, seen.UTC())
+
+	return err
+}
+
+// getLastSeen retrieves the last seen timestamp of uuid, zero if it was never seen.
+// Returns ErrUserNotFound, or any db error.
+func getLastSeen(ctx context.Context, uuid string) (time.Time, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return time.Time{}, err
+	}
+
+	var lastSeen pq.NullTime
+	err := postgresDB.QueryRowContext(ctx, `SELECT last_seen_timestamp FROM user_svc.accounts WHERE uuid = $1`,
+		uuid).Scan(&lastSeen)
+	if err == sql.ErrNoRows {
+		return time.Time{}, consts.ErrUserNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return lastSeen.Time, nil
+}
+
+// getUserNames retrieves the middle and display names of uuid, empty if it has none.
+// Returns ErrUserNotFound, or any db error.
+func getUserNames(ctx context.Context, uuid string) (userNames, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return userNames{}, err
+	}
+
+	var middleName, displayName sql.NullString
+	err := postgresDB.QueryRowContext(ctx, `SELECT middle_name, display_name FROM user_svc.accounts WHERE uuid = $1`,
+		uuid).Scan(&middleName, &displayName)
+	if err == sql.ErrNoRows {
+		return userNames{}, consts.ErrUserNotFound
+	}
+	if err != nil {
+		return userNames{}, err
+	}
+
+	return userNames{middleName: middleName.String, displayName: displayName.String}, nil
+}
+
+// getUsersPage retrieves at most limit users matching filter after afterUUID, in uuid order, which is the order
+// they signed up in. An empty afterUUID starts from the first user. lastSeen maps the uuids of returned users
+// that were ever seen to their last seen timestamp. A replica serves the read if ctx was marked by
+// withReplicaReads.
+// Returns any db error.
+func getUsersPage(ctx context.Context, filter *userListFilter, afterUUID string, limit int) ([]*pblib.User,
+	map[string]time.Time, error) {
+	command := `SELECT uuid, first_name, last_name, email, COALESCE(organization, ''),
+					created_timestamp, is_verified, password, permission_level, prospective_email, last_seen_timestamp
+				FROM user_svc.accounts
+				WHERE uuid > $1::TEXT AND deleted_timestamp IS NULL
+					AND ($2 = '' OR organization = $2)
+					AND ($3::BOOLEAN IS NULL OR is_verified = $3)
+					AND ($4::TIMESTAMPTZ IS NULL OR created_timestamp >= $4)
+					AND ($5::TIMESTAMPTZ IS NULL OR created_timestamp < $5)
+				ORDER BY uuid
+				LIMIT $6
+				`
+	var from, to pq.NullTime
+	if !filter.createdFrom.IsZero() {
+		from = pq.NullTime{Time: filter.createdFrom.UTC(), Valid: true}
+	}
+	if !filter.createdTo.IsZero() {
+		to = pq.NullTime{Time: filter.createdTo.UTC(), Valid: true}
+	}
+
+	var rows *sql.Rows
+	err := readReplica(ctx, func(db *sql.DB) (err error) {
+		rows, err = db.QueryContext(ctx, command, afterUUID, filter.organization, filter.isVerified,
+			from, to, limit)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+	var users []*pblib.User
+	lastSeen := make(map[string]time.Time)
+	for rows.Next() {
+		var prospectiveEmail sql.NullString
+		var seen pq.NullTime
+		var createdTimestamp time.Time
+		user := &pblib.User{}
+		if err := rows.Scan(&user.Uuid, &user.FirstName, &user.LastName, &user.Email, &user.Organization,
+			&createdTimestamp, &user.IsVerified, &user.Password, &user.PermissionLevel, &prospectiveEmail,
+			&seen); err != nil {
+			return nil, nil, err
+		}
+		user.CreatedTimestamp = createdTimestamp.Unix()
+		user.ProspectiveEmail = prospectiveEmail.String
+		if seen.Valid {
+			lastSeen[user.GetUuid()] = seen.Time
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return users, lastSeen, nil
+}
+
+// streamUsers reads the users matching filter in uuid order through a cursor, calling send with every
+// chunkSize of them and then the rest. The users are read from one snapshot, users changing while they are
+// streamed are sent as they were when streamUsers started. The cursor is closed as soon as ctx is done.
+// Returns the number of users sent, and the error of send, ctx or any db error.
+func streamUsers(ctx context.Context, filter *userListFilter, chunkSize int,
+	send func([]*pblib.User) error) (int64, error) {
+	if chunkSize <= 0 {
+		return 0, consts.ErrInvalidChunkSize
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	// read only, rolling back closes the cursor
+	defer func() { _ = tx.Rollback() }()
+
+	command := `DECLARE stream_users NO SCROLL CURSOR FOR
+				SELECT uuid, first_name, last_name, email, COALESCE(organization, ''),
+					created_timestamp, is_verified, permission_level, prospective_email
+				FROM user_svc.accounts
+				WHERE deleted_timestamp IS NULL
+					AND ($1 = '' OR organization = $1)
+					AND ($2::BOOLEAN IS NULL OR is_verified = $2)
+					AND ($3::TIMESTAMPTZ IS NULL OR created_timestamp >= $3)
+					AND ($4::TIMESTAMPTZ IS NULL OR created_timestamp < $4)
+				ORDER BY uuid
+				`
+	var from, to pq.NullTime
+	if !filter.createdFrom.IsZero() {
+		from = pq.NullTime{Time: filter.createdFrom.UTC(), Valid: true}
+	}
+	if !filter.createdTo.IsZero() {
+		to = pq.NullTime{Time: filter.createdTo.UTC(), Valid: true}
+	}
+	if _, err := tx.ExecContext(ctx, command, filter.organization, filter.isVerified, from, to); err != nil {
+		return 0, err
+	}
+
+	// FETCH does not take parameters, chunkSize is a positive int
+	fetch := fmt.Sprintf("FETCH FORWARD %d FROM stream_users", chunkSize)
+	var sent int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
+
+		users, err := fetchStreamedUsers(ctx, tx, fetch)
+		if err != nil {
+			return sent, err
+		}
+		if len(users) == 0 {
+			return sent, nil
+		}
+
+		if err := send(users); err != nil {
+			return sent, err
+		}
+		sent += int64(len(users))
+
+		if len(users) < chunkSize {
+			return sent, nil
+		}
+	}
+}
+
+// fetchStreamedUsers runs fetch, a FETCH of the streamUsers cursor, in tx.
+// Returns the users fetched, none once the cursor is exhausted, or any db error.
+func fetchStreamedUsers(ctx context.Context, tx *sql.Tx, fetch string) ([]*pblib.User, error) {
+	rows, err := tx.QueryContext(ctx, fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var users []*pblib.User
+	for rows.Next() {
+		var prospectiveEmail sql.NullString
+		var createdTimestamp time.Time
+		user := &pblib.User{}
+		if err := rows.Scan(&user.Uuid, &user.FirstName, &user.LastName, &user.Email, &user.Organization,
+			&createdTimestamp, &user.IsVerified, &user.PermissionLevel, &prospectiveEmail); err != nil {
+			return nil, err
+		}
+		user.CreatedTimestamp = createdTimestamp.Unix()
+		user.ProspectiveEmail = prospectiveEmail.String
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// insertSharedDocuments shares duid, a document owned by owner, with every user of uuids. Users the document is
+// already shared with and the owner itself are skipped. The document is shared with all of them or none.
+// Returns ErrDocumentNotFound if owner does not own duid, ErrUserNotFound if a user of uuids does not exist,
+// or any db error.
+func insertSharedDocuments(ctx context.Context, owner string, duid string, uuids []string) error {
+	if err := validation.ValidateUserUUID(owner); err != nil {
+		return err
+	}
+
+	recipients := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		if uuid != owner {
+			recipients = append(recipients, uuid)
+		}
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// the document cannot change owner or be unregistered while it is shared
+	var locked string
+	err = tx.QueryRowContext(ctx, `SELECT duid FROM user_svc.documents WHERE duid = $1 AND uuid = $2 FOR UPDATE`,
+		duid, owner).Scan(&locked)
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return consts.ErrDocumentNotFound
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	command := `INSERT INTO user_svc.shared_documents(duid, uuid)
+				SELECT $1, recipient FROM UNNEST($2::TEXT[]) AS recipient
+				ON CONFLICT (duid, uuid) DO NOTHING
+				`
+	_, err = tx.ExecContext(ctx, command, duid, pq.Array(recipients))
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "foreign_key_violation" {
+		_ = tx.Rollback()
+		return consts.ErrUserNotFound
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// insertOrganization makes organization, recording createdBy as the admin that made it at now.
+// Returns ErrOrganizationExists if it was already made or named by an account, or any db error.
+func insertOrganization(ctx context.Context, organization string, createdBy string, now time.Time) error {
+	command := `INSERT INTO user_svc.organizations(name, created_by, created_timestamp)
+				VALUES($1, NULLIF($2, ''), $3)
+				ON CONFLICT (name) DO NOTHING
+				`
+	result, err := postgresDB.ExecContext(ctx, command, organization, createdBy, now.UTC())
+	if err != nil {
+		return err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		return consts.ErrOrganizationExists
+	}
+
+	return nil
+}
+
+// getOrganizationRow retrieves organization with its member count and admins, in the order they were made admins.
+// Returns ErrOrganizationNotFound, or any db error.
+func getOrganizationRow(ctx context.Context, organization string) (*organizationRow, error) {
+	command := `SELECT o.name, COALESCE(o.created_by, ''), o.created_timestamp,
+					(SELECT COUNT(*) FROM user_svc.accounts a
+					 WHERE a.organization = o.name AND a.deleted_timestamp IS NULL)
+				FROM user_svc.organizations o
+				WHERE o.name = $1
+				`
+	row := &organizationRow{}
+	err := postgresDB.QueryRowContext(ctx, command, organization).Scan(&row.name, &row.createdBy, &row.created,
+		&row.members)
+	if err == sql.ErrNoRows {
+		return nil, consts.ErrOrganizationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	row.admins, err = getOrganizationAdmins(ctx, organization)
+	if err != nil {
+		return nil, err
+	}
+
+	return row, nil
+}
+
+// getOrganizationAdmins retrieves the uuids of the admins of organization, in the order they were made admins.
+// Returns any db error.
+func getOrganizationAdmins(ctx context.Context, organization string) ([]string, error) {
+	command := `SELECT uuid FROM user_svc.organization_admins
+				WHERE organization = $1
+				ORDER BY granted_timestamp, uuid
+				`
+	rows, err := postgresDB.QueryContext(ctx, command, organization)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var admins []string
+	for rows.Next() {
+		var uuid string
+		if err := rows.Scan(&uuid); err != nil {
+			return nil, err
+		}
+		admins = append(admins, uuid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return admins, nil
+}
+
+// setOrganizationAdmin makes uuid an admin of organization if isAdmin, recording actor as the one that did at now,
+// or stops it being one otherwise. Only members of organization are made admins.
+// Returns ErrOrganizationNotFound, ErrNotOrganizationMember, or any db error.
+func setOrganizationAdmin(ctx context.Context, organization string, uuid string, isAdmin bool, actor string,
+	now time.Time) error {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return err
+	}
+
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM user_svc.organizations WHERE name = $1)`,
+		organization).Scan(&exists)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if !exists {
+		_ = tx.Rollback()
+		return consts.ErrOrganizationNotFound
+	}
+
+	if !isAdmin {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM user_svc.organization_admins
+				WHERE organization = $1 AND uuid = $2`, organization, uuid); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	// the member cannot leave the organization while they are made an admin
+	var memberOf sql.NullString
+	err = tx.QueryRowContext(ctx, `SELECT organization FROM user_svc.accounts
+				WHERE uuid = $1 AND deleted_timestamp IS NULL FOR SHARE`, uuid).Scan(&memberOf)
+	if err != nil && err != sql.ErrNoRows {
+		_ = tx.Rollback()
+		return err
+	}
+	if err == sql.ErrNoRows || memberOf.String != organization {
+		_ = tx.Rollback()
+		return consts.ErrNotOrganizationMember
+	}
+
+	command := `INSERT INTO user_svc.organization_admins(organization, uuid, granted_by, granted_timestamp)
+				VALUES($1, $2, $3, $4)
+				ON CONFLICT (organization, uuid) DO NOTHING
+				`
+	if _, err := tx.ExecContext(ctx, command, organization, uuid, actor, now.UTC()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// isOrganizationAdmin returns true if uuid is an admin and a member of organization.
+// Returns any db error.
+func isOrganizationAdmin(ctx context.Context, organization string, uuid string) (bool, error) {
+	command := `SELECT EXISTS (
+					SELECT 1 FROM user_svc.organization_admins r
+					JOIN user_svc.accounts a ON a.uuid = r.uuid AND a.organization = r.organization
+					WHERE r.organization = $1 AND r.uuid = $2 AND a.deleted_timestamp IS NULL
+				)
+				`
+	var isAdmin bool
+	if err := postgresDB.QueryRowContext(ctx, command, organization, uuid).Scan(&isAdmin); err != nil {
+		return false, err
+	}
+
+	return isAdmin, nil
+}
+
+// deleteSharedDocuments stops sharing duid, a document owned by owner, with every user of uuids. Users the
+// document is not shared with are skipped. Shares are also removed when the document or the user is deleted.
+// Returns the number of users the document was unshared from, ErrDocumentNotFound if owner does not own duid,
+// or any db error.
+func deleteSharedDocuments(ctx context.Context, owner string, duid string, uuids []string) (int64, error) {
+	if err := validation.ValidateUserUUID(owner); err != nil {
+		return 0, err
+	}
+
+	command := `DELETE FROM user_svc.shared_documents s
+				USING user_svc.documents d
+				WHERE s.duid = d.duid AND d.duid = $1 AND d.uuid = $2 AND s.uuid = ANY($3::TEXT[])
+				`
+	result, err := postgresDB.ExecContext(ctx, command, duid, owner, pq.Array(uuids))
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if deleted > 0 {
+		return deleted, nil
+	}
+
+	// nothing was unshared, either the document was not shared with them or it is not owner's
+	var exists bool
+	err = postgresDB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM user_svc.documents
+				WHERE duid = $1 AND uuid = $2)`, duid, owner).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, consts.ErrDocumentNotFound
+	}
+
+	return 0, nil
+}
+
+// getSharedDocuments retrieves at most limit documents shared with uuid after fromDuid, in duid order, with their
+// owners. Documents of soft deleted owners are left out. An empty fromDuid starts from the first document.
+// Returns any db error.
+func getSharedDocuments(ctx context.Context, uuid string, fromDuid string, limit int) ([]*sharedDocument, error) {
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, err
+	}
+
+	command := `SELECT s.duid, d.uuid
+				FROM user_svc.shared_documents s
+				JOIN user_svc.documents d ON d.duid = s.duid
+				JOIN user_svc.accounts a ON a.uuid = d.uuid
+				WHERE s.uuid = $1 AND s.duid > $2::TEXT AND a.deleted_timestamp IS NULL
+				ORDER BY s.duid
+				LIMIT $3
+				`
+	rows, err := postgresDB.QueryContext(ctx, command, uuid, fromDuid, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	var documents []*sharedDocument
+	for rows.Next() {
+		document := &sharedDocument{}
+		if err := rows.Scan(&document.duid, &document.owner); err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return documents, nil
+}
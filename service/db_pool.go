@@ -0,0 +1,73 @@
+package service
+
+import (
+	"database/sql"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"strconv"
+	"time"
+)
+
+// dbPoolSettings are the limits applied to postgresDB, set with hosts_dbpool_*.
+// A negative maxIdle keeps the database/sql default, zero values of the other fields do.
+type dbPoolSettings struct {
+	maxOpen     int
+	maxIdle     int
+	maxLifetime time.Duration
+}
+
+var (
+	// dbPool is applied whenever refreshDBConnection opens postgresDB
+	dbPool = dbPoolSettings{maxIdle: -1}
+)
+
+func init() {
+	pool, err := parseDBPool(conf.DBPool)
+	if err != nil {
+		reportStartupProblem("Invalid db pool:", "maxopenconns="+conf.DBPool.MaxOpenConns,
+			"maxidleconns="+conf.DBPool.MaxIdleConns, "connmaxlifetime="+conf.DBPool.ConnMaxLifetime)
+		return
+	}
+	dbPool = pool
+}
+
+// parseDBPool parses the connection pool limits of settings, empty values keep the database/sql defaults.
+// Returns ErrInvalidDBPool if a limit is not a non negative number or duration.
+func parseDBPool(settings conf.ConnectionPool) (dbPoolSettings, error) {
+	pool := dbPoolSettings{maxIdle: -1}
+
+	if settings.MaxOpenConns != "" {
+		maxOpen, err := strconv.Atoi(settings.MaxOpenConns)
+		if err != nil || maxOpen < 0 {
+			return pool, consts.ErrInvalidDBPool
+		}
+		pool.maxOpen = maxOpen
+	}
+
+	if settings.MaxIdleConns != "" {
+		maxIdle, err := strconv.Atoi(settings.MaxIdleConns)
+		if err != nil || maxIdle < 0 {
+			return pool, consts.ErrInvalidDBPool
+		}
+		pool.maxIdle = maxIdle
+	}
+
+	if settings.ConnMaxLifetime != "" {
+		maxLifetime, err := time.ParseDuration(settings.ConnMaxLifetime)
+		if err != nil || maxLifetime < 0 {
+			return pool, consts.ErrInvalidDBPool
+		}
+		pool.maxLifetime = maxLifetime
+	}
+
+	return pool, nil
+}
+
+// apply sets the limits of p on db, database/sql lowers the idle limit to the open limit if it is higher.
+func (p dbPoolSettings) apply(db *sql.DB) {
+	db.SetMaxOpenConns(p.maxOpen)
+	if p.maxIdle >= 0 {
+		db.SetMaxIdleConns(p.maxIdle)
+	}
+	db.SetConnMaxLifetime(p.maxLifetime)
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"database/sql"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseDBPool(t *testing.T) {
+	cases := []struct {
+		desc     string
+		settings conf.ConnectionPool
+		expPool  dbPoolSettings
+		expErr   error
+	}{
+		{"test defaults", conf.ConnectionPool{}, dbPoolSettings{maxIdle: -1}, nil},
+		{"test every limit", conf.ConnectionPool{MaxOpenConns: "20", MaxIdleConns: "5", ConnMaxLifetime: "30m"},
+			dbPoolSettings{maxOpen: 20, maxIdle: 5, maxLifetime: 30 * time.Minute}, nil},
+		{"test no idle connections", conf.ConnectionPool{MaxIdleConns: "0"}, dbPoolSettings{}, nil},
+		{"test invalid open limit", conf.ConnectionPool{MaxOpenConns: "many"}, dbPoolSettings{}, consts.ErrInvalidDBPool},
+		{"test negative idle limit", conf.ConnectionPool{MaxIdleConns: "-1"}, dbPoolSettings{}, consts.ErrInvalidDBPool},
+		{"test invalid lifetime", conf.ConnectionPool{ConnMaxLifetime: "30"}, dbPoolSettings{}, consts.ErrInvalidDBPool},
+	}
+
+	for _, c := range cases {
+		pool, err := parseDBPool(c.settings)
+		assert.Equal(t, c.expErr, err, c.desc)
+		if c.expErr == nil {
+			assert.Equal(t, c.expPool, pool, c.desc)
+		}
+	}
+}
+
+func TestDBPoolApply(t *testing.T) {
+	db, err := sql.Open(dbDriverName, connectionString)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	dbPoolSettings{maxOpen: 3, maxIdle: 1, maxLifetime: time.Minute}.apply(db)
+	assert.Equal(t, 3, db.Stats().MaxOpenConnections)
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"database/sql"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dbReplica is a read replica of the user database, opened on first use and limited by dbPool like postgresDB.
+type dbReplica struct {
+	index            int
+	connectionString string
+
+	lock sync.Mutex
+	db   *sql.DB
+
+	// unhealthyUntil is when a replica that failed is read from again
+	unhealthyUntil time.Time
+}
+
+// replicaReadsKey marks the context of a request whose reads a replica may serve
+type replicaReadsKey struct{}
+
+const (
+	// replicaRecoveryDelay is how long reads skip a replica after it failed
+	replicaRecoveryDelay = 30 * time.Second
+)
+
+var (
+	// dbReplicas are set with hosts_dbreplicas_connections, every read goes to the primary without them
+	dbReplicas []*dbReplica
+
+	// dbReplicaNext spreads reads over dbReplicas round robin
+	dbReplicaNext uint32
+)
+
+func init() {
+	for _, connection := range strings.Split(conf.DBReplicas.Connections, ",") {
+		if connection = strings.TrimSpace(connection); connection != "" {
+			dbReplicas = append(dbReplicas, &dbReplica{index: len(dbReplicas), connectionString: connection})
+		}
+	}
+
+	if len(dbReplicas) > 0 {
+		logger.Info(consts.PSQL, "Reading from", strconv.Itoa(len(dbReplicas)), "replicas")
+	}
+}
+
+// withReplicaReads returns ctx marked to let a replica serve the reads of its request, see readReplica.
+// Replicas lag the primary, only requests that read without writing what they read may be marked.
+func withReplicaReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replicaReadsKey{}, true)
+}
+
+// replicaReads returns true if ctx was marked by withReplicaReads and there are replicas to read from.
+func replicaReads(ctx context.Context) bool {
+	marked, _ := ctx.Value(replicaReadsKey{}).(bool)
+	return marked && len(dbReplicas) > 0
+}
+
+// readReplica runs read against a replica if ctx was marked by withReplicaReads and a replica is healthy,
+// against the primary otherwise. If the replica fails, or finds no rows since it may not have received them
+// yet, read runs against the primary. A replica failing with a connection or transient error is skipped for
+// replicaRecoveryDelay.
+// Returns the error of the last read.
+func readReplica(ctx context.Context, read func(db *sql.DB) error) error {
+	if replica := nextHealthyReplica(ctx, time.Now()); replica != nil {
+		err := read(replica.open())
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		// postgres errors other than transient ones are the read's own, the primary returns them again
+		if _, isPostgresErr := err.(*pq.Error); (!isPostgresErr && err != sql.ErrNoRows) || isTransientDBError(err) {
+			replica.fail(time.Now(), err)
+		}
+	}
+
+	return withDBRetry(ctx, func() error {
+		return read(postgresDB)
+	})
+}
+
+// nextHealthyReplica returns the next replica not skipped at now, nil if ctx was not marked by
+// withReplicaReads or every replica is skipped.
+func nextHealthyReplica(ctx context.Context, now time.Time) *dbReplica {
+	if !replicaReads(ctx) {
+		return nil
+	}
+
+	start := atomic.AddUint32(&dbReplicaNext, 1)
+	for i := range dbReplicas {
+		replica := dbReplicas[(int(start)+i)%len(dbReplicas)]
+		if replica.isHealthy(now) {
+			return replica
+		}
+	}
+
+	return nil
+}
+
+// open returns the db of r, opening it if needed. Connections are only made by the first query.
+func (r *dbReplica) open() *sql.DB {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.db == nil {
+		// sql.Open only fails for an unknown driver, postgres is registered by lib/pq
+		r.db, _ = sql.Open(dbDriverName, r.connectionString)
+		dbPool.apply(r.db)
+	}
+
+	return r.db
+}
+
+// isHealthy returns true if r is not skipped at now.
+func (r *dbReplica) isHealthy(now time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return !now.Before(r.unhealthyUntil)
+}
+
+// fail skips r for replicaRecoveryDelay after now, because of err.
+func (r *dbReplica) fail(now time.Time, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.unhealthyUntil = now.Add(replicaRecoveryDelay)
+	// connection strings carry passwords, replicas are logged by their position in hosts_dbreplicas_connections
+	logger.Error(consts.PSQL, "Skipping replica", strconv.Itoa(r.index), "until",
+		r.unhealthyUntil.UTC().Format(time.RFC3339), err.Error())
+}
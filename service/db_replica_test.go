@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestReadReplica(t *testing.T) {
+	defer func(replicas []*dbReplica, backoff time.Duration) {
+		dbReplicas, dbRetryBackoff = replicas, backoff
+	}(dbReplicas, dbRetryBackoff)
+	dbRetryBackoff = time.Millisecond
+
+	first := &dbReplica{index: 0, connectionString: "postgres://replica-0/user_svc"}
+	second := &dbReplica{index: 1, connectionString: "postgres://replica-1/user_svc"}
+	for _, replica := range []*dbReplica{first, second} {
+		defer func(replica *dbReplica) { _ = replica.open().Close() }(replica)
+	}
+	dbReplicas = []*dbReplica{first, second}
+	marked := withReplicaReads(context.TODO())
+
+	// read fails on the replicas with replicaErr, and records the databases it ran against
+	var readFrom []*sql.DB
+	var replicaErr error
+	read := func(db *sql.DB) error {
+		readFrom = append(readFrom, db)
+		if db != postgresDB {
+			return replicaErr
+		}
+		return nil
+	}
+
+	desc := "test unmarked request reads from the primary"
+	assert.False(t, replicaReads(context.TODO()), desc)
+	assert.Nil(t, readReplica(context.TODO(), read), desc)
+	assert.Equal(t, []*sql.DB{postgresDB}, readFrom, desc)
+
+	desc = "test marked request reads from the replicas round robin"
+	assert.True(t, replicaReads(marked), desc)
+	readFrom = nil
+	assert.Nil(t, readReplica(marked, read), desc)
+	assert.Nil(t, readReplica(marked, read), desc)
+	if assert.Equal(t, 2, len(readFrom), desc) {
+		assert.NotEqual(t, readFrom[0], readFrom[1], desc)
+		assert.Contains(t, []*sql.DB{first.open(), second.open()}, readFrom[0], desc)
+		assert.Contains(t, []*sql.DB{first.open(), second.open()}, readFrom[1], desc)
+	}
+
+	desc = "test missing rows are read from the primary"
+	readFrom, replicaErr = nil, sql.ErrNoRows
+	assert.Nil(t, readReplica(marked, read), desc)
+	assert.Equal(t, postgresDB, readFrom[len(readFrom)-1], desc)
+	assert.True(t, first.isHealthy(time.Now()) && second.isHealthy(time.Now()), desc)
+
+	desc = "test query errors fall back without skipping the replica"
+	readFrom, replicaErr = nil, &pq.Error{Code: "42601"}
+	assert.Nil(t, readReplica(marked, read), desc)
+	assert.Equal(t, 2, len(readFrom), desc)
+	assert.True(t, first.isHealthy(time.Now()) && second.isHealthy(time.Now()), desc)
+
+	desc = "test failing replicas are skipped"
+	replicaErr = driver.ErrBadConn
+	for i := 0; i < 2; i++ {
+		readFrom = nil
+		assert.Nil(t, readReplica(marked, read), desc)
+		assert.Equal(t, 2, len(readFrom), desc)
+	}
+	assert.False(t, first.isHealthy(time.Now()), desc)
+	assert.False(t, second.isHealthy(time.Now()), desc)
+	readFrom = nil
+	assert.Nil(t, readReplica(marked, read), desc)
+	assert.Equal(t, []*sql.DB{postgresDB}, readFrom, desc)
+
+	desc = "test skipped replicas are read from again after the recovery delay"
+	assert.True(t, first.isHealthy(time.Now().Add(replicaRecoveryDelay)), desc)
+
+	desc = "test request without replicas"
+	dbReplicas = nil
+	assert.False(t, replicaReads(marked), desc)
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"database/sql/driver"
+	"errors"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Reads failing with a transient postgres error, such as a serialization failure or a reset connection, are
+// tried again by withDBRetry instead of surfacing as Internal. Retries wait a random duration that doubles with
+// every attempt, so instances that failed together do not retry together. Writes are never retried, a reset
+// connection does not tell whether they were applied.
+
+const (
+	defaultDBRetryAttempts = 3
+	defaultDBRetryBackoff  = 50 * time.Millisecond
+)
+
+var (
+	// dbRetryAttempts and dbRetryBackoff are set with hosts_dbretry_maxattempts and hosts_dbretry_backoff
+	dbRetryAttempts = defaultDBRetryAttempts
+	dbRetryBackoff  = defaultDBRetryBackoff
+
+	// dbRetries counts the retries since the service started, dbRetriesExhausted the reads that still failed
+	// after their last attempt. GetStatus reports both.
+	dbRetries          int64
+	dbRetriesExhausted int64
+
+	// transientPostgresCodes are the transient errors outside of the transaction rollback (40) and connection
+	// exception (08) classes, which are transient as a whole
+	transientPostgresCodes = map[pq.ErrorCode]bool{
+		"53300": true, // too_many_connections
+		"57P01": true, // admin_shutdown
+		"57P02": true, // crash_shutdown
+		"57P03": true, // cannot_connect_now
+	}
+)
+
+func init() {
+	if value := conf.DBRetry.MaxAttempts; value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts <= 0 {
+			reportStartupProblem("Invalid db retry max attempts:", value)
+		} else {
+			dbRetryAttempts = attempts
+		}
+	}
+
+	if value := conf.DBRetry.Backoff; value != "" {
+		backoff, err := time.ParseDuration(value)
+		if err != nil || backoff <= 0 {
+			reportStartupProblem("Invalid db retry backoff:", value)
+		} else {
+			dbRetryBackoff = backoff
+		}
+	}
+}
+
+// isTransientDBError returns true if err may not happen again when the statement that failed with it is rerun.
+func isTransientDBError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		class := pqErr.Code.Class()
+		return class == "40" || class == "08" || transientPostgresCodes[pqErr.Code]
+	}
+
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE)
+}
+
+// withDBRetry runs read, up to dbRetryAttempts times while it fails with a transient error. read must be safe to
+// run again, such as a single select.
+// Returns the error of the last attempt, or the error of ctx if it is done while waiting to retry.
+func withDBRetry(ctx context.Context, read func() error) error {
+	backoff := dbRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := read()
+		if err == nil || !isTransientDBError(err) {
+			return err
+		}
+		if attempt >= dbRetryAttempts {
+			if attempt > 1 {
+				atomic.AddInt64(&dbRetriesExhausted, 1)
+			}
+			return err
+		}
+
+		// full jitter, the wait is anywhere up to backoff
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff))))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		atomic.AddInt64(&dbRetries, 1)
+		logger.Info(consts.PSQL, "Retrying transient db error, attempt", strconv.Itoa(attempt+1), err.Error())
+		backoff *= 2
+	}
+}
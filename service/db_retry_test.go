@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsTransientDBError(t *testing.T) {
+	cases := []struct {
+		desc  string
+		err   error
+		expOk bool
+	}{
+		{"test serialization failure", &pq.Error{Code: "40001"}, true},
+		{"test deadlock", &pq.Error{Code: "40P01"}, true},
+		{"test connection failure", &pq.Error{Code: "08006"}, true},
+		{"test too many connections", &pq.Error{Code: "53300"}, true},
+		{"test admin shutdown", &pq.Error{Code: "57P01"}, true},
+		{"test bad connection", driver.ErrBadConn, true},
+		{"test connection reset", &net.OpError{Op: "read", Net: "tcp",
+			Err: os.NewSyscallError("read", syscall.ECONNRESET)}, true},
+		{"test unique violation", &pq.Error{Code: "23505"}, false},
+		{"test syntax error", &pq.Error{Code: "42601"}, false},
+		{"test no rows", sql.ErrNoRows, false},
+		{"test canceled", context.Canceled, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expOk, isTransientDBError(c.err), c.desc)
+	}
+}
+
+func TestWithDBRetry(t *testing.T) {
+	defer func(attempts int, backoff time.Duration) {
+		dbRetryAttempts, dbRetryBackoff = attempts, backoff
+	}(dbRetryAttempts, dbRetryBackoff)
+	dbRetryAttempts, dbRetryBackoff = 3, time.Millisecond
+
+	transient := &pq.Error{Code: "40001"}
+	failing := func(failures int, err error) (func() error, *int) {
+		calls := 0
+		return func() error {
+			calls++
+			if calls <= failures {
+				return err
+			}
+			return nil
+		}, &calls
+	}
+
+	desc := "test transient error passes on retry"
+	retries := atomic.LoadInt64(&dbRetries)
+	read, calls := failing(2, transient)
+	assert.Nil(t, withDBRetry(context.TODO(), read), desc)
+	assert.Equal(t, 3, *calls, desc)
+	assert.Equal(t, retries+2, atomic.LoadInt64(&dbRetries), desc)
+
+	desc = "test attempts are exhausted"
+	exhausted := atomic.LoadInt64(&dbRetriesExhausted)
+	read, calls = failing(3, transient)
+	assert.Equal(t, transient, withDBRetry(context.TODO(), read), desc)
+	assert.Equal(t, 3, *calls, desc)
+	assert.Equal(t, exhausted+1, atomic.LoadInt64(&dbRetriesExhausted), desc)
+
+	desc = "test other errors are not retried"
+	read, calls = failing(1, sql.ErrNoRows)
+	assert.Equal(t, sql.ErrNoRows, withDBRetry(context.TODO(), read), desc)
+	assert.Equal(t, 1, *calls, desc)
+
+	desc = "test retries switched off"
+	dbRetryAttempts = 1
+	exhausted = atomic.LoadInt64(&dbRetriesExhausted)
+	read, calls = failing(1, transient)
+	assert.Equal(t, transient, withDBRetry(context.TODO(), read), desc)
+	assert.Equal(t, 1, *calls, desc)
+	assert.Equal(t, exhausted, atomic.LoadInt64(&dbRetriesExhausted), desc)
+
+	desc = "test canceled context stops retrying"
+	dbRetryAttempts, dbRetryBackoff = 3, time.Hour
+	ctx, cancel := context.WithCancel(context.TODO())
+	calls = new(int)
+	read = func() error {
+		*calls++
+		cancel()
+		return transient
+	}
+	assert.Equal(t, context.Canceled, withDBRetry(ctx, read), desc)
+	assert.Equal(t, 1, *calls, desc)
+}
@@ -1,17 +1,26 @@
 package service
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
 	"github.com/hwsc-org/hwsc-lib/auth"
 	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestRefreshDBConnection(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	assert.NotNil(t, postgresDB)
 
 	//verify connection on supposedly opened connection
@@ -34,6 +43,8 @@ func TestRefreshDBConnection(t *testing.T) {
 }
 
 func TestInsertNewUser(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// valid user
 	uuid1, _ := generateUUID()
 	uuid2, _ := generateUUID()
@@ -113,7 +124,7 @@ func TestInsertNewUser(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		err := insertNewUser(c.user)
+		_, err := insertNewUser(context.TODO(), c.user, userNames{}, time.Time{}, "", nil)
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg, c.desc)
 		} else {
@@ -123,13 +134,15 @@ func TestInsertNewUser(t *testing.T) {
 }
 
 func TestInsertEmailToken(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	user1, err := unitTestInsertUser("InsertEmailToken-One")
 	assert.Nil(t, err)
 	user2, err := unitTestInsertUser("InsertEmailToken-Two")
 	assert.Nil(t, err)
-	err = deleteEmailTokenRow(user1.GetUser().GetUuid())
+	err = deleteEmailTokenRow(context.TODO(), user1.GetUser().GetUuid())
 	assert.Nil(t, err)
-	err = deleteEmailTokenRow(user2.GetUser().GetUuid())
+	err = deleteEmailTokenRow(context.TODO(), user2.GetUser().GetUuid())
 	assert.Nil(t, err)
 
 	validID1, err := auth.GenerateEmailIdentification(user1.GetUser().GetUuid(), user1.GetUser().GetPermissionLevel())
@@ -137,62 +150,70 @@ func TestInsertEmailToken(t *testing.T) {
 	assert.NotNil(t, validID1)
 
 	desc := "empty uuid"
-	err = insertEmailToken("", validID1.GetToken(), validID1.GetSecret())
+	err = insertEmailToken(context.TODO(), "", validID1.GetToken(), validID1.GetSecret())
 	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error(), desc)
 
 	desc = "invalid uuid format"
-	err = insertEmailToken("1234", validID1.GetToken(), validID1.GetSecret())
+	err = insertEmailToken(context.TODO(), "1234", validID1.GetToken(), validID1.GetSecret())
 	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error(), desc)
 
 	desc = "empty token"
-	err = insertEmailToken(user1.GetUser().GetUuid(), "", validID1.GetSecret())
+	err = insertEmailToken(context.TODO(), user1.GetUser().GetUuid(), "", validID1.GetSecret())
 	assert.EqualError(t, err, authconst.ErrEmptyToken.Error(), desc)
 
 	desc = "valid uuid and valid token"
-	err = insertEmailToken(user1.GetUser().GetUuid(), validID1.GetToken(), validID1.GetSecret())
+	err = insertEmailToken(context.TODO(), user1.GetUser().GetUuid(), validID1.GetToken(), validID1.GetSecret())
 	assert.Nil(t, err, desc)
 
 	desc = "test duplicate uuid in user_svc.email_tokens table"
-	err = insertEmailToken(user1.GetUser().GetUuid(), "some token", validID1.GetSecret())
+	err = insertEmailToken(context.TODO(), user1.GetUser().GetUuid(), "some token", validID1.GetSecret())
 	assert.EqualError(t, err, "pq: duplicate key value violates unique constraint \"email_tokens_uuid_key\"", desc)
 
 	desc = "test non-existent uuid"
 	nonExistentUUID, _ := generateUUID()
-	err = insertEmailToken(nonExistentUUID, "some token", validID1.GetSecret())
+	err = insertEmailToken(context.TODO(), nonExistentUUID, "some token", validID1.GetSecret())
 	assert.EqualError(t, err, "pq: insert or update on table \"email_tokens\" violates foreign key constraint \"email_tokens_uuid_fkey\"", desc)
 
 	desc = "test duplicate token"
-	err = insertEmailToken(user2.GetUser().GetUuid(), validID1.GetToken(), validID1.GetSecret())
+	err = insertEmailToken(context.TODO(), user2.GetUser().GetUuid(), validID1.GetToken(), validID1.GetSecret())
 	assert.EqualError(t, err, "pq: duplicate key value violates unique constraint \"email_tokens_pkey\"", desc)
 
 	desc = "test nil secret"
-	err = insertEmailToken(user2.GetUser().GetUuid(), validID1.GetToken(), nil)
+	err = insertEmailToken(context.TODO(), user2.GetUser().GetUuid(), validID1.GetToken(), nil)
 	assert.EqualError(t, err, authconst.ErrNilSecret.Error(), desc)
 
 }
 
 func TestDeleteUserRow(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	response, err := unitTestInsertUser("DeleteUserRow-One")
 	assert.Nil(t, err)
 
-	err = deleteUserRow("")
+	deletedRows, err := deleteUserRow(context.TODO(), "")
 	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error())
+	assert.Equal(t, int64(0), deletedRows)
 
-	err = deleteUserRow("1234")
+	deletedRows, err = deleteUserRow(context.TODO(), "1234")
 	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error())
+	assert.Equal(t, int64(0), deletedRows)
 
-	err = deleteUserRow(response.GetUser().GetUuid())
+	deletedRows, err = deleteUserRow(context.TODO(), response.GetUser().GetUuid())
 	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deletedRows)
 
 	// non existent (db does not throw an error)
-	err = deleteUserRow(response.GetUser().GetUuid())
+	deletedRows, err = deleteUserRow(context.TODO(), response.GetUser().GetUuid())
 	assert.Nil(t, err)
+	assert.Equal(t, int64(0), deletedRows)
 }
 
 func TestGetUserRow(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// non existent uuid
 	nonExistentUUID, _ := generateUUID()
-	retrievedUser, err := getUserRow(nonExistentUUID)
+	retrievedUser, err := getUserRow(context.TODO(), nonExistentUUID)
 	assert.EqualError(t, err, consts.ErrUserNotFound.Error())
 	assert.Nil(t, retrievedUser)
 
@@ -200,16 +221,25 @@ func TestGetUserRow(t *testing.T) {
 	response, err := unitTestInsertUser("GetUserRow-One")
 	assert.Nil(t, err)
 
-	retrievedUser, err = getUserRow(response.GetUser().GetUuid())
+	retrievedUser, err = getUserRow(context.TODO(), response.GetUser().GetUuid())
 	assert.Nil(t, err)
 	assert.Equal(t, response.GetUser().GetUuid(), retrievedUser.GetUuid())
 	assert.Equal(t, response.GetUser().GetFirstName(), retrievedUser.GetFirstName())
 	assert.Equal(t, response.GetUser().GetLastName(), retrievedUser.GetLastName())
 	assert.Equal(t, response.GetUser().GetEmail(), retrievedUser.GetEmail())
 	assert.Equal(t, response.GetUser().GetOrganization(), retrievedUser.GetOrganization())
+
+	// canceled context
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	retrievedUser, err = getUserRow(ctx, response.GetUser().GetUuid())
+	assert.EqualError(t, err, context.Canceled.Error())
+	assert.Nil(t, retrievedUser)
 }
 
 func TestUpdateUserRow(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// insert some new users
 	response1, err := unitTestInsertUser("UpdateUserRow-One")
 	assert.Nil(t, err)
@@ -219,7 +249,7 @@ func TestUpdateUserRow(t *testing.T) {
 	response2, err := unitTestInsertUser("UpdateUserRow-Two")
 	assert.Nil(t, err)
 	assert.Equal(t, codes.OK.String(), response2.GetMessage())
-	err = deleteEmailTokenRow(response2.GetUser().GetUuid())
+	err = deleteEmailTokenRow(context.TODO(), response2.GetUser().GetUuid())
 	assert.Nil(t, err)
 	response2.GetUser().IsVerified = true
 
@@ -248,35 +278,52 @@ func TestUpdateUserRow(t *testing.T) {
 		Uuid:  response1.GetUser().GetUuid(),
 	}
 
+	// clear organization
+	svc5 := &pblib.User{
+		Uuid: response1.GetUser().GetUuid(),
+	}
+
+	// invalid - clear and update organization
+	svc6 := &pblib.User{
+		Organization: "UpdateUserRow",
+		Uuid:         response1.GetUser().GetUuid(),
+	}
+
 	nonExistentUUID, _ := generateUUID()
+	clearOrganization := map[string]bool{userFieldOrganization: true}
 
 	cases := []struct {
-		uuid       string
-		svcDerived *pblib.User
-		dbDerived  *pblib.User
-		isExpErr   bool
-		expMsg     string
+		uuid        string
+		svcDerived  *pblib.User
+		dbDerived   *pblib.User
+		clearFields map[string]bool
+		isExpErr    bool
+		expMsg      string
 	}{
-		{"", nil, nil, true, consts.ErrNilRequestUser.Error()},
-		{nonExistentUUID, nil, nil, true, consts.ErrNilRequestUser.Error()},
-		{nonExistentUUID, &pblib.User{}, nil, true,
+		{"", nil, nil, nil, true, consts.ErrNilRequestUser.Error()},
+		{nonExistentUUID, nil, nil, nil, true, consts.ErrNilRequestUser.Error()},
+		{nonExistentUUID, &pblib.User{}, nil, nil, true,
 			consts.ErrNilRequestUser.Error()},
-		{nonExistentUUID, &pblib.User{}, &pblib.User{}, true,
+		{nonExistentUUID, &pblib.User{}, &pblib.User{}, nil, true,
 			consts.ErrEmptyRequestUser.Error()},
-		{nonExistentUUID, &pblib.User{FirstName: "@"}, &pblib.User{}, true,
+		{nonExistentUUID, &pblib.User{FirstName: "@"}, &pblib.User{}, nil, true,
 			consts.ErrInvalidUserFirstName.Error()},
-		{nonExistentUUID, &pblib.User{LastName: "@"}, &pblib.User{}, true,
+		{nonExistentUUID, &pblib.User{LastName: "@"}, &pblib.User{}, nil, true,
 			consts.ErrInvalidUserLastName.Error()},
-		{nonExistentUUID, &pblib.User{Email: "@"}, &pblib.User{}, true,
+		{nonExistentUUID, &pblib.User{Email: "@"}, &pblib.User{}, nil, true,
 			consts.ErrInvalidUserEmail.Error()},
-		{svc.Uuid, svc, response1.GetUser(), false, ""},
-		{svc2.Uuid, svc2, response2.GetUser(), false, ""},
-		{svc3.Uuid, svc3, response1.GetUser(), true, consts.ErrEmailExists.Error()},
-		{svc4.Uuid, svc4, response1.GetUser(), true, consts.ErrEmailExists.Error()},
+		{svc.Uuid, svc, response1.GetUser(), nil, false, ""},
+		{svc2.Uuid, svc2, response2.GetUser(), nil, false, ""},
+		{svc3.Uuid, svc3, response1.GetUser(), nil, true, consts.ErrEmailExists.Error()},
+		{svc4.Uuid, svc4, response1.GetUser(), nil, true, consts.ErrEmailExists.Error()},
+		{svc5.Uuid, svc5, response1.GetUser(), clearOrganization, false, ""},
+		{svc6.Uuid, svc6, response1.GetUser(), clearOrganization, true,
+			consts.ErrConflictingClearField.Error()},
 	}
 
 	for _, c := range cases {
-		updatedUser, err := updateUserRow(c.uuid, c.svcDerived, c.dbDerived)
+		updatedUser, err := updateUserRow(context.TODO(), c.uuid, c.svcDerived, c.dbDerived, userNames{},
+			c.clearFields)
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg)
 			assert.Nil(t, updatedUser)
@@ -286,23 +333,29 @@ func TestUpdateUserRow(t *testing.T) {
 		}
 	}
 
+	retrievedUser, err := getUserRow(context.TODO(), response1.GetUser().GetUuid())
+	assert.Nil(t, err)
+	assert.Equal(t, "", retrievedUser.GetOrganization(), "test organization is cleared")
+
 	//TODO test for new insertion of token for new email updates
 }
 
 func TestGetActiveSecretRow(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	err := unitTestDeleteAuthSecretTable()
 	assert.Nil(t, err)
 
 	// test empty row
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := getActiveSecretRow(context.TODO())
 	assert.EqualError(t, err, consts.ErrNoActiveSecretKeyFound.Error())
 	assert.Nil(t, retrievedSecret)
 
 	// insert a key to test for active key retrieval
-	err = insertNewAuthSecret()
+	err = insertNewAuthSecret(context.TODO())
 	assert.Nil(t, err)
 
-	retrievedSecret, err = getActiveSecretRow()
+	retrievedSecret, err = getActiveSecretRow(context.TODO())
 	assert.Nil(t, err)
 	assert.NotNil(t, retrievedSecret)
 	assert.NotEmpty(t, retrievedSecret.Key)
@@ -311,43 +364,49 @@ func TestGetActiveSecretRow(t *testing.T) {
 }
 
 func TestInsertNewSecret(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	err := unitTestDeleteAuthSecretTable()
 	assert.Nil(t, err)
 
-	err = insertNewAuthSecret()
+	err = insertNewAuthSecret(context.TODO())
 	assert.Nil(t, err)
 
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := getActiveSecretRow(context.TODO())
 	assert.Nil(t, err)
 	assert.NotNil(t, retrievedSecret)
 
 	// test that key was inserted
-	secretKey, err := getLatestSecret(2)
+	secretKey, err := getLatestSecret(context.TODO(), 2)
 	assert.Nil(t, err)
 	assert.Equal(t, retrievedSecret.GetKey(), secretKey)
 }
 
 func TestGetLatestSecret(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	err := unitTestDeleteAuthSecretTable()
 	assert.Nil(t, err)
 
-	err = insertNewAuthSecret()
+	err = insertNewAuthSecret(context.TODO())
 	assert.Nil(t, err)
 
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := getActiveSecretRow(context.TODO())
 	assert.Nil(t, err)
 
-	secretKey, err := getLatestSecret(2)
+	secretKey, err := getLatestSecret(context.TODO(), 2)
 	assert.Nil(t, err)
 	assert.Equal(t, retrievedSecret.GetKey(), secretKey)
 
-	secretKey, err = getLatestSecret(0)
+	secretKey, err = getLatestSecret(context.TODO(), 0)
 	assert.EqualError(t, err, consts.ErrInvalidAddTime.Error())
 	assert.Empty(t, secretKey)
 
 }
 
 func TestInsertAuthToken(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	token := "someToken"
 
 	// retrieve freshly active secret
@@ -427,7 +486,7 @@ func TestInsertAuthToken(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		err := insertAuthToken(c.token, c.header, c.body, c.secret)
+		err := insertAuthToken(context.TODO(), c.token, c.header, c.body, c.secret)
 
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg)
@@ -438,6 +497,8 @@ func TestInsertAuthToken(t *testing.T) {
 }
 
 func TestGetAuthTokenRow(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	retrievedSecret, err := unitTestDeleteInsertGetAuthSecret()
 	assert.Nil(t, err)
 	assert.NotNil(t, retrievedSecret)
@@ -458,7 +519,7 @@ func TestGetAuthTokenRow(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		retrievedToken, err := getAuthTokenRow(c.uuid)
+		retrievedToken, err := getAuthTokenRow(context.TODO(), c.uuid)
 
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg, c.desc)
@@ -473,10 +534,10 @@ func TestGetAuthTokenRow(t *testing.T) {
 	validNoUUIDAuthTokenBody.UUID = validUUID
 	// the above happens so fast that validating secret creation time fails b/c time == now()
 	time.Sleep(2 * time.Second)
-	err = insertAuthToken("TestRetrieveExistingToken", validAuthTokenHeader, validNoUUIDAuthTokenBody, retrievedSecret)
+	err = insertAuthToken(context.TODO(), "TestRetrieveExistingToken", validAuthTokenHeader, validNoUUIDAuthTokenBody, retrievedSecret)
 	assert.Nil(t, err)
 
-	retrievedToken, err := getAuthTokenRow(validUUID)
+	retrievedToken, err := getAuthTokenRow(context.TODO(), validUUID)
 	assert.Nil(t, err)
 	assert.NotEmpty(t, retrievedToken.uuid)
 	assert.NotEmpty(t, retrievedToken.token)
@@ -487,13 +548,15 @@ func TestGetAuthTokenRow(t *testing.T) {
 }
 
 func TestPairTokenWithSecret(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	desc := "test empty token"
-	retrievedSecret, err := pairTokenWithSecret("")
+	retrievedSecret, err := pairTokenWithSecret(context.TODO(), "")
 	assert.EqualError(t, err, authconst.ErrEmptyToken.Error(), desc)
 	assert.Nil(t, retrievedSecret, desc)
 
 	desc = "test non-existing token"
-	retrievedSecret, err = pairTokenWithSecret("non-existing-token")
+	retrievedSecret, err = pairTokenWithSecret(context.TODO(), "non-existing-token")
 	assert.EqualError(t, err, consts.ErrNoMatchingAuthTokenFound.Error(), desc)
 	assert.Nil(t, retrievedSecret, desc)
 
@@ -503,7 +566,7 @@ func TestPairTokenWithSecret(t *testing.T) {
 	assert.NotEmpty(t, newToken)
 
 	desc = "test against existing token"
-	retrievedSecret, err = pairTokenWithSecret(newToken)
+	retrievedSecret, err = pairTokenWithSecret(context.TODO(), newToken)
 	assert.Nil(t, err, desc)
 	assert.NotEmpty(t, retrievedSecret, desc)
 	assert.Equal(t, newSecret.Key, retrievedSecret.GetSecret().GetKey(), desc)
@@ -512,50 +575,56 @@ func TestPairTokenWithSecret(t *testing.T) {
 }
 
 func TestHasActiveSecret(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	err := unitTestDeleteAuthSecretTable()
 	assert.Nil(t, err)
 
 	desc := "test with no active secret in table"
-	exists, err := hasActiveAuthSecret()
+	exists, err := hasActiveAuthSecret(context.TODO())
 	assert.Nil(t, err, desc)
 	assert.Equal(t, false, exists, desc)
 
 	desc = "test with an active secret in table"
-	err = insertNewAuthSecret()
+	err = insertNewAuthSecret(context.TODO())
 	assert.Nil(t, err)
-	exists, err = hasActiveAuthSecret()
+	exists, err = hasActiveAuthSecret(context.TODO())
 	assert.Nil(t, err, desc)
 	assert.Equal(t, true, exists, desc)
 }
 
 func TestActiveSecretTrigger(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	err := unitTestDeleteAuthSecretTable()
 	assert.Nil(t, err)
 
 	time.Sleep(10 * time.Second)
-	err = insertNewAuthSecret()
+	err = insertNewAuthSecret(context.TODO())
 	assert.Nil(t, err)
 	time.Sleep(10 * time.Second)
-	err = insertNewAuthSecret()
+	err = insertNewAuthSecret(context.TODO())
 	assert.Nil(t, err)
 	time.Sleep(10 * time.Second)
-	err = insertNewAuthSecret()
+	err = insertNewAuthSecret(context.TODO())
 	assert.Nil(t, err)
 
-	exists, err := hasActiveAuthSecret()
+	exists, err := hasActiveAuthSecret(context.TODO())
 	assert.Nil(t, err)
 	assert.Equal(t, true, exists)
 
-	secretKey, err := getLatestSecret(5)
+	secretKey, err := getLatestSecret(context.TODO(), 5)
 	assert.Nil(t, err)
 	assert.NotEmpty(t, secretKey)
 
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := getActiveSecretRow(context.TODO())
 	assert.Nil(t, err)
 	assert.Equal(t, retrievedSecret.GetKey(), secretKey)
 }
 
 func TestIsEmailTaken(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// create a user to test with
 	user1, err := unitTestInsertUser("IsEmailTaken-One")
 	assert.Nil(t, err)
@@ -568,7 +637,8 @@ func TestIsEmailTaken(t *testing.T) {
 		Uuid:  user1.GetUser().GetUuid(),
 	}
 	// update user1's email
-	updatedUser, err := updateUserRow(user1.GetUser().GetUuid(), svcDerived, user1.GetUser())
+	updatedUser, err := updateUserRow(context.TODO(), user1.GetUser().GetUuid(), svcDerived, user1.GetUser(),
+		userNames{}, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, updatedUser)
 
@@ -587,7 +657,7 @@ func TestIsEmailTaken(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		emailTaken, err := isEmailTaken(c.email)
+		emailTaken, err := isEmailTaken(context.TODO(), c.email)
 		if c.isExpErr {
 			assert.EqualError(t, err, consts.ErrInvalidUserEmail.Error(), c.desc)
 			assert.Equal(t, false, emailTaken, c.desc)
@@ -602,13 +672,100 @@ func TestIsEmailTaken(t *testing.T) {
 	}
 }
 
+func TestReserveProspectiveEmail(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	user1, err := unitTestInsertUser("ReserveProspectiveEmail-One")
+	assert.Nil(t, err)
+	u1 := user1.GetUser()
+	user2, err := unitTestInsertUser("ReserveProspectiveEmail-Two")
+	assert.Nil(t, err)
+	u2 := user2.GetUser()
+
+	desc := "test concurrent reservations of the same email succeed once"
+	email := unitTestEmailGenerator()
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, uuid := range []string{u1.GetUuid(), u2.GetUuid()} {
+		wg.Add(1)
+		go func(uuid string) {
+			defer wg.Done()
+			tx, err := postgresDB.Begin()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := reserveProspectiveEmail(context.TODO(), tx, uuid, email); err != nil {
+				_ = tx.Rollback()
+				errs <- err
+				return
+			}
+			errs <- tx.Commit()
+		}(uuid)
+	}
+	wg.Wait()
+	close(errs)
+
+	reserved := 0
+	for err := range errs {
+		if err == nil {
+			reserved++
+		} else {
+			assert.EqualError(t, err, consts.ErrEmailReserved.Error(), desc)
+		}
+	}
+	assert.Equal(t, 1, reserved, desc)
+
+	desc = "test prospective email is reserved"
+	newEmail := unitTestEmailGenerator()
+	_, err = updateUserRow(context.TODO(), u1.GetUuid(), &pblib.User{Email: newEmail}, u1, userNames{}, nil)
+	assert.Nil(t, err, desc)
+	taken, err := isEmailTaken(context.TODO(), strings.ToUpper(newEmail))
+	assert.Nil(t, err, desc)
+	assert.True(t, taken, desc)
+
+	desc = "test reserved email cannot be taken by another user"
+	tx, err := postgresDB.Begin()
+	assert.Nil(t, err, desc)
+	_, err = reserveProspectiveEmail(context.TODO(), tx, u2.GetUuid(), newEmail)
+	assert.EqualError(t, err, consts.ErrEmailReserved.Error(), desc)
+	assert.Nil(t, tx.Rollback(), desc)
+
+	desc = "test lapsed reservation is taken over"
+	_, err = postgresDB.Exec(`UPDATE user_svc.email_reservations
+		SET expiration_timestamp = NOW() - INTERVAL '1 minute' WHERE email = LOWER($1)`, newEmail)
+	assert.Nil(t, err, desc)
+	taken, err = isEmailTaken(context.TODO(), newEmail)
+	assert.Nil(t, err, desc)
+	assert.False(t, taken, desc)
+
+	_, err = updateUserRow(context.TODO(), u2.GetUuid(), &pblib.User{Email: newEmail}, u2, userNames{}, nil)
+	assert.Nil(t, err, desc)
+	retrievedUser, err := getUserRow(context.TODO(), u1.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "", retrievedUser.GetProspectiveEmail(), desc)
+	retrievedUser, err = getUserRow(context.TODO(), u2.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, newEmail, retrievedUser.GetProspectiveEmail(), desc)
+
+	desc = "test updating other fields releases the reservation"
+	_, err = updateUserRow(context.TODO(), u2.GetUuid(), &pblib.User{FirstName: "Released"}, retrievedUser,
+		userNames{}, nil)
+	assert.Nil(t, err, desc)
+	taken, err = isEmailTaken(context.TODO(), newEmail)
+	assert.Nil(t, err, desc)
+	assert.False(t, taken, desc)
+}
+
 func TestGetEmailTokenRow(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// create a user to insert a token to its uuid
 	user1, err := unitTestInsertUser("GetExistingEmailToken-One")
 	assert.Nil(t, err)
 	assert.Equal(t, codes.OK.String(), user1.GetMessage())
 
-	err = deleteEmailTokenRow(user1.GetUser().GetUuid())
+	err = deleteEmailTokenRow(context.TODO(), user1.GetUser().GetUuid())
 	assert.Nil(t, err)
 
 	emailID, err := auth.GenerateEmailIdentification(user1.GetUser().GetUuid(), user1.GetUser().GetPermissionLevel())
@@ -616,7 +773,7 @@ func TestGetEmailTokenRow(t *testing.T) {
 	assert.NotNil(t, emailID)
 
 	// insert token
-	err = insertEmailToken(user1.GetUser().GetUuid(), emailID.GetToken(), emailID.GetSecret())
+	err = insertEmailToken(context.TODO(), user1.GetUser().GetUuid(), emailID.GetToken(), emailID.GetSecret())
 	assert.Nil(t, err)
 
 	cases := []struct {
@@ -631,7 +788,7 @@ func TestGetEmailTokenRow(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		retrievedRow, err := getEmailTokenRow(c.token)
+		retrievedRow, err := getEmailTokenRow(context.TODO(), c.token)
 
 		if c.isExpErr {
 			assert.Nil(t, retrievedRow, c.desc)
@@ -644,6 +801,8 @@ func TestGetEmailTokenRow(t *testing.T) {
 }
 
 func TestDeleteEmailTokenRow(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// create a user to insert a token
 	user1, err := unitTestInsertUser("DeleteEmailTokenRow-One")
 	assert.Nil(t, err)
@@ -665,7 +824,7 @@ func TestDeleteEmailTokenRow(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		err := deleteEmailTokenRow(c.uuid)
+		err := deleteEmailTokenRow(context.TODO(), c.uuid)
 
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg, c.desc)
@@ -676,6 +835,8 @@ func TestDeleteEmailTokenRow(t *testing.T) {
 }
 
 func TestMatchEmailAndPassword(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// create a user
 	user1Password := "TestMatchEmailAndPassword-One"
 	user1, err := unitTestInsertUser(user1Password)
@@ -714,10 +875,14 @@ func TestMatchEmailAndPassword(t *testing.T) {
 			"valid, test existing email and matching password", u1.GetEmail(), user1Password,
 			false, "",
 		},
+		{
+			"valid, test existing email in different case", strings.ToUpper(u1.GetEmail()), user1Password,
+			false, "",
+		},
 	}
 
 	for _, c := range cases {
-		retrievedUser, err := matchEmailAndPassword(c.email, c.password)
+		retrievedUser, err := matchEmailAndPassword(context.TODO(), c.email, c.password)
 		if c.isExpErr {
 			assert.Nil(t, retrievedUser, c.desc)
 			assert.EqualError(t, err, c.expMsg, c.desc)
@@ -730,7 +895,198 @@ func TestMatchEmailAndPassword(t *testing.T) {
 
 }
 
+func TestVerifyEmailTokenRow(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	user1, err := unitTestInsertUser("TestVerifyEmailTokenRow-One")
+	assert.Nil(t, err)
+	assert.Equal(t, codes.OK.String(), user1.GetMessage())
+	u1 := user1.GetUser()
+
+	err = deleteEmailTokenRow(context.TODO(), u1.GetUuid())
+	assert.Nil(t, err)
+
+	emailID, err := auth.GenerateEmailIdentification(u1.GetUuid(), u1.GetPermissionLevel())
+	assert.Nil(t, err)
+	err = insertEmailToken(context.TODO(), u1.GetUuid(), emailID.GetToken(), emailID.GetSecret())
+	assert.Nil(t, err)
+
+	desc := "test empty token"
+	retrievedUser, err := verifyEmailTokenRow(context.TODO(), "")
+	assert.Nil(t, retrievedUser, desc)
+	assert.EqualError(t, err, authconst.ErrEmptyToken.Error(), desc)
+
+	desc = "test concurrent verifications of the same token succeed once"
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := verifyEmailTokenRow(context.TODO(), emailID.GetToken())
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	verified := 0
+	for err := range errs {
+		if err == nil {
+			verified++
+		} else {
+			assert.EqualError(t, err, consts.ErrNoMatchingEmailTokenFound.Error(), desc)
+		}
+	}
+	assert.Equal(t, 1, verified, desc)
+
+	retrievedUser, err = getUserRow(context.TODO(), u1.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, auth.PermissionStringMap[auth.User], retrievedUser.GetPermissionLevel(), desc)
+	assert.True(t, retrievedUser.GetIsVerified(), desc)
+
+	desc = "test token is deleted"
+	_, err = getEmailTokenRow(context.TODO(), emailID.GetToken())
+	assert.EqualError(t, err, consts.ErrNoMatchingEmailTokenFound.Error(), desc)
+
+	desc = "test expired token deletes new user"
+	user2, err := unitTestInsertUser("TestVerifyEmailTokenRow-Two")
+	assert.Nil(t, err)
+	u2 := user2.GetUser()
+	err = deleteEmailTokenRow(context.TODO(), u2.GetUuid())
+	assert.Nil(t, err)
+
+	expiredID, err := auth.GenerateEmailIdentification(u2.GetUuid(), u2.GetPermissionLevel())
+	assert.Nil(t, err)
+	_, err = postgresDB.Exec(`INSERT INTO user_svc.email_tokens(token, secret_key, created_timestamp, expiration_timestamp, uuid)
+		VALUES($1, $2, $3, $4, $5)`, expiredID.GetToken(), expiredID.GetSecret().GetKey(),
+		time.Now().Add(-time.Hour), time.Now().Add(-time.Minute), u2.GetUuid())
+	assert.Nil(t, err, desc)
+
+	retrievedUser, err = verifyEmailTokenRow(context.TODO(), expiredID.GetToken())
+	assert.EqualError(t, err, consts.ErrExpiredEmailToken.Error(), desc)
+	assert.Equal(t, u2.GetUuid(), retrievedUser.GetUuid(), desc)
+
+	_, err = getUserRow(context.TODO(), u2.GetUuid())
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+}
+
+func TestForceVerifyUserRow(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	user, err := unitTestInsertUser("TestForceVerifyUserRow")
+	assert.Nil(t, err)
+	u := user.GetUser()
+
+	emailID, err := auth.GenerateEmailIdentification(u.GetUuid(), u.GetPermissionLevel())
+	assert.Nil(t, err)
+	err = insertEmailToken(context.TODO(), u.GetUuid(), emailID.GetToken(), emailID.GetSecret())
+	assert.Nil(t, err)
+
+	desc := "test invalid uuid"
+	_, err = forceVerifyUserRow(context.TODO(), "")
+	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error(), desc)
+
+	desc = "test nonexistent user"
+	uuid, err := generateUUID()
+	assert.Nil(t, err, desc)
+	_, err = forceVerifyUserRow(context.TODO(), uuid)
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+
+	desc = "test unverified user is verified and its tokens deleted"
+	retrievedUser, err := forceVerifyUserRow(context.TODO(), u.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.False(t, retrievedUser.GetIsVerified(), desc)
+	retrievedUser, err = getUserRow(context.TODO(), u.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.True(t, retrievedUser.GetIsVerified(), desc)
+	assert.Equal(t, auth.PermissionStringMap[auth.User], retrievedUser.GetPermissionLevel(), desc)
+	_, err = getEmailTokenRow(context.TODO(), emailID.GetToken())
+	assert.EqualError(t, err, consts.ErrNoMatchingEmailTokenFound.Error(), desc)
+
+	desc = "test verified user stays verified"
+	retrievedUser, err = forceVerifyUserRow(context.TODO(), u.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.True(t, retrievedUser.GetIsVerified(), desc)
+}
+
+func TestVerifyParentalConsentTokenRow(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	childBirthdate := time.Now().UTC().AddDate(-8, 0, 0)
+
+	insertChild := func(lastName string) *pblib.User {
+		child := unitTestUserGenerator(lastName)
+		uuid, err := generateUUID()
+		assert.Nil(t, err)
+		child.Uuid = uuid
+		_, err = insertNewUser(context.TODO(), child, userNames{}, childBirthdate, "", nil)
+		assert.Nil(t, err)
+		return child
+	}
+
+	desc := "test adult with birthdate does not need consent"
+	adult := unitTestUserGenerator("TestVerifyParentalConsent-Adult")
+	adult.Uuid, _ = generateUUID()
+	_, err := insertNewUser(context.TODO(), adult, userNames{}, time.Now().UTC().AddDate(-30, 0, 0), "", nil)
+	assert.Nil(t, err, desc)
+	pending, err := isParentalConsentPending(context.TODO(), adult.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.False(t, pending, desc)
+
+	desc = "test child needs consent"
+	child := insertChild("TestVerifyParentalConsent-One")
+	pending, err = isParentalConsentPending(context.TODO(), child.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.True(t, pending, desc)
+
+	consentID, err := auth.GenerateEmailIdentification(child.GetUuid(), auth.PermissionStringMap[auth.NoPermission])
+	assert.Nil(t, err)
+
+	desc = "test invalid parent email"
+	err = insertParentalConsentToken(context.TODO(), child.GetUuid(), "parent", consentID.GetToken(), consentID.GetSecret())
+	assert.EqualError(t, err, consts.ErrInvalidParentEmail.Error(), desc)
+
+	err = insertParentalConsentToken(context.TODO(), child.GetUuid(), unitTestEmailGenerator(),
+		consentID.GetToken(), consentID.GetSecret())
+	assert.Nil(t, err)
+
+	desc = "test empty token"
+	uuid, err := verifyParentalConsentTokenRow(context.TODO(), "")
+	assert.EqualError(t, err, authconst.ErrEmptyToken.Error(), desc)
+	assert.Empty(t, uuid, desc)
+
+	desc = "test consent is recorded once"
+	uuid, err = verifyParentalConsentTokenRow(context.TODO(), consentID.GetToken())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, child.GetUuid(), uuid, desc)
+	pending, err = isParentalConsentPending(context.TODO(), child.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.False(t, pending, desc)
+
+	_, err = verifyParentalConsentTokenRow(context.TODO(), consentID.GetToken())
+	assert.EqualError(t, err, consts.ErrNoMatchingParentalConsent.Error(), desc)
+
+	desc = "test expired token deletes the child"
+	child = insertChild("TestVerifyParentalConsent-Two")
+	expiredID, err := auth.GenerateEmailIdentification(child.GetUuid(), auth.PermissionStringMap[auth.NoPermission])
+	assert.Nil(t, err)
+	_, err = postgresDB.Exec(`INSERT INTO user_svc.parental_consent_tokens(
+			token, secret_key, parent_email, created_timestamp, expiration_timestamp, uuid
+		) VALUES($1, $2, $3, $4, $5, $6)`, expiredID.GetToken(), expiredID.GetSecret().GetKey(),
+		unitTestEmailGenerator(), time.Now().Add(-time.Hour), time.Now().Add(-time.Minute), child.GetUuid())
+	assert.Nil(t, err, desc)
+
+	uuid, err = verifyParentalConsentTokenRow(context.TODO(), expiredID.GetToken())
+	assert.EqualError(t, err, consts.ErrExpiredParentalConsentToken.Error(), desc)
+	assert.Equal(t, child.GetUuid(), uuid, desc)
+	_, err = isParentalConsentPending(context.TODO(), child.GetUuid())
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+}
+
 func TestUpdatePermissionLevel(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// create a test user
 	user1, err := unitTestInsertUser("TestUpdatePermissionLevel")
 	assert.Nil(t, err)
@@ -775,16 +1131,1797 @@ func TestUpdatePermissionLevel(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		err := updatePermissionLevel(c.uuid, c.permLevel)
+		err := updatePermissionLevel(context.TODO(), c.uuid, c.permLevel)
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg, c.desc)
 		} else {
 			assert.Nil(t, err, c.desc)
 
-			retrievedUser, err := getUserRow(c.uuid)
+			retrievedUser, err := getUserRow(context.TODO(), c.uuid)
 			if err == nil {
 				assert.Equal(t, c.permLevel, retrievedUser.GetPermissionLevel())
 			}
 		}
 	}
 }
+
+func TestInsertEventAndGetEventsAfter(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	desc := "test nil event"
+	_, err := insertEvent(context.TODO(), nil)
+	assert.EqualError(t, err, consts.ErrNilEvent.Error(), desc)
+
+	desc = "test sequence increases with each insert"
+	first, err := newCloudEvent(eventTypeUserCreated, validUUID, &userEventData{UUID: validUUID})
+	assert.Nil(t, err, desc)
+	second, err := newCloudEvent(eventTypeUserDeleted, validUUID, &userEventData{UUID: validUUID})
+	assert.Nil(t, err, desc)
+
+	firstSequence, err := insertEvent(context.TODO(), first)
+	assert.Nil(t, err, desc)
+	secondSequence, err := insertEvent(context.TODO(), second)
+	assert.Nil(t, err, desc)
+	assert.True(t, secondSequence > firstSequence, desc)
+
+	desc = "test events after sequence"
+	events, err := getEventsAfter(context.TODO(), firstSequence-1, time.Time{}, maxReplayLimit)
+	assert.Nil(t, err, desc)
+	assert.True(t, len(events) >= 2, desc)
+	assert.Equal(t, first.ID, events[0].ID, desc)
+	assert.Equal(t, firstSequence, events[0].Sequence, desc)
+	assert.Equal(t, second.ID, events[1].ID, desc)
+
+	desc = "test limit"
+	events, err = getEventsAfter(context.TODO(), firstSequence-1, time.Time{}, 1)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 1, len(events), desc)
+
+	desc = "test timestamp in the future"
+	events, err = getEventsAfter(context.TODO(), 0, time.Now().Add(time.Hour), maxReplayLimit)
+	assert.Nil(t, err, desc)
+	assert.Empty(t, events, desc)
+
+	desc = "test invalid sequence"
+	_, err = getEventsAfter(context.TODO(), -1, time.Time{}, 1)
+	assert.EqualError(t, err, consts.ErrInvalidReplaySequence.Error(), desc)
+
+	desc = "test invalid limit"
+	_, err = getEventsAfter(context.TODO(), 0, time.Time{}, 0)
+	assert.EqualError(t, err, consts.ErrInvalidReplayLimit.Error(), desc)
+}
+
+func TestRevokeAuthTokens(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	newSecret, newToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err)
+	uuid := auth.ExtractUUID(newToken)
+
+	desc := "test valid secrets include the active secret"
+	secrets, err := getValidSecrets(context.TODO())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 1, len(secrets), desc)
+	assert.Equal(t, newSecret.GetKey(), secrets[0].GetKey(), desc)
+
+	desc = "test invalid uuid"
+	err = revokeAuthTokens(context.TODO(), "")
+	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error(), desc)
+
+	desc = "test revoke deletes tokens and records revocation"
+	before := time.Now().Add(-time.Second)
+	err = revokeAuthTokens(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	_, err = pairTokenWithSecret(context.TODO(), newToken)
+	assert.EqualError(t, err, consts.ErrNoMatchingAuthTokenFound.Error(), desc)
+
+	revocations, err := getRevocationsSince(context.TODO(), before)
+	assert.Nil(t, err, desc)
+	assert.Contains(t, revocations, uuid, desc)
+
+	desc = "test revocations before since are excluded"
+	revocations, err = getRevocationsSince(context.TODO(), time.Now().Add(time.Minute))
+	assert.Nil(t, err, desc)
+	assert.NotContains(t, revocations, uuid, desc)
+}
+
+func TestRevokeAuthToken(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	_, newToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err)
+	uuid := auth.ExtractUUID(newToken)
+	expiration := time.Now().Add(time.Hour)
+
+	desc := "test invalid uuid"
+	err = revokeAuthToken(context.TODO(), "", newToken, "", expiration)
+	assert.EqualError(t, err, authconst.ErrInvalidUUID.Error(), desc)
+
+	desc = "test empty token"
+	err = revokeAuthToken(context.TODO(), uuid, "", "", expiration)
+	assert.EqualError(t, err, authconst.ErrEmptyToken.Error(), desc)
+
+	desc = "test revoke deletes the token and records its revocation"
+	assert.Nil(t, revokeAuthToken(context.TODO(), uuid, newToken, "", expiration), desc)
+	_, err = pairTokenWithSecret(context.TODO(), newToken)
+	assert.EqualError(t, err, consts.ErrNoMatchingAuthTokenFound.Error(), desc)
+	revoked, err := getTokenRevocations(context.TODO(), time.Now())
+	assert.Nil(t, err, desc)
+	assert.True(t, revoked[hashToken(newToken)], desc)
+
+	desc = "test revoking twice keeps the first revocation"
+	assert.Nil(t, revokeAuthToken(context.TODO(), uuid, newToken, "", expiration), desc)
+
+	desc = "test revocations of expired tokens are excluded"
+	revoked, err = getTokenRevocations(context.TODO(), expiration.Add(time.Second))
+	assert.Nil(t, err, desc)
+	assert.False(t, revoked[hashToken(newToken)], desc)
+}
+
+func TestRotateAuthSecret(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, insertNewAuthSecret(context.TODO()))
+	}
+	secrets, err := getValidSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.True(t, len(secrets) >= 3)
+	active, previous, older := secrets[0], secrets[1], secrets[2]
+	defer func() { currAuthSecret, _ = getActiveSecretRow(context.TODO()) }()
+
+	desc := "test secret rotated by another instance is not rotated again"
+	now := time.Now()
+	rotated, err := rotateAuthSecret(context.TODO(), "TestRotateAuthSecret-Stale", 1, now, now.Add(time.Hour))
+	assert.Nil(t, err, desc)
+	assert.False(t, rotated, desc)
+	retrieved, err := getActiveSecretRow(context.TODO())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, active.GetKey(), retrieved.GetKey(), desc)
+
+	desc = "test rotation keeps the previous secrets and retires older ones"
+	verifyUntil := time.Unix(active.GetExpirationTimestamp(), 0).Add(time.Hour)
+	rotated, err = rotateAuthSecret(context.TODO(), active.GetKey(), 2, now, verifyUntil)
+	assert.Nil(t, err, desc)
+	assert.True(t, rotated, desc)
+
+	secrets, err = getValidSecrets(context.TODO())
+	assert.Nil(t, err, desc)
+	assert.Len(t, secrets, 3, desc)
+	assert.NotEqual(t, active.GetKey(), secrets[0].GetKey(), desc)
+	assert.Equal(t, active.GetKey(), secrets[1].GetKey(), desc)
+	assert.Equal(t, verifyUntil.Unix(), secrets[1].GetExpirationTimestamp(), desc)
+	assert.Equal(t, previous.GetKey(), secrets[2].GetKey(), desc)
+	for _, secret := range secrets {
+		assert.NotEqual(t, older.GetKey(), secret.GetKey(), desc)
+	}
+}
+
+func TestGetUserStatsQueries(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	desc := "test invalid days"
+	stats, err := getUserStats(context.TODO(), 0)
+	assert.EqualError(t, err, consts.ErrInvalidStatsDays.Error(), desc)
+	assert.Nil(t, stats, desc)
+	stats, err = getUserStats(context.TODO(), maxStatsDays+1)
+	assert.EqualError(t, err, consts.ErrInvalidStatsDays.Error(), desc)
+	assert.Nil(t, stats, desc)
+
+	before, err := getUserStats(context.TODO(), 7)
+	assert.Nil(t, err)
+
+	_, err = unitTestInsertUser("GetUserStats-One")
+	assert.Nil(t, err)
+	_, newToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, newToken)
+	assert.Nil(t, insertEmailDelivery(context.TODO(), templateVerifyEmail, false))
+
+	desc = "test aggregates count new rows"
+	stats, err = getUserStats(context.TODO(), 7)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 7, len(stats.signups), desc)
+	assert.Equal(t, time.Now().UTC().Format(statsDayLayout), stats.signups[6].day.Format(statsDayLayout), desc)
+	assert.Equal(t, before.signups[6].users+1, stats.signups[6].users, desc)
+	assert.Equal(t, int64(1), stats.activeSessions, desc)
+	assert.NotEmpty(t, stats.organizations, desc)
+	assert.Equal(t, before.emailsFailed+1, stats.emailsFailed, desc)
+	assert.True(t, stats.emailsSent >= stats.emailsFailed, desc)
+}
+
+func TestRunRetention(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	rules, err := newRetentionRules(conf.RetentionRules{
+		UnverifiedAccounts: "30d",
+		LoginHistory:       "365d",
+		DeletedUsers:       "90d",
+	})
+	assert.Nil(t, err)
+
+	// a stale unverified user, an old expired token and a user deleted long ago
+	response, err := unitTestInsertUser("TestRunRetention-One")
+	assert.Nil(t, err)
+	staleUUID := response.GetUser().GetUuid()
+	_, err = postgresDB.Exec(`UPDATE user_svc.accounts SET created_timestamp = $2 WHERE uuid = $1`,
+		staleUUID, time.Now().AddDate(0, 0, -31))
+	assert.Nil(t, err)
+
+	_, newToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err)
+	_, err = postgresDB.Exec(`UPDATE user_security.auth_tokens SET expiration_timestamp = $2 WHERE token = $1`,
+		newToken, time.Now().AddDate(-2, 0, 0))
+	assert.Nil(t, err)
+
+	response, err = unitTestInsertUser("TestRunRetention-Two")
+	assert.Nil(t, err)
+	deletedUUID := response.GetUser().GetUuid()
+	_, err = deleteUserRow(context.TODO(), deletedUUID)
+	assert.Nil(t, err)
+	publishUserEvent(eventTypeUserDeleted, &pblib.User{Uuid: deletedUUID})
+	_, err = postgresDB.Exec(`UPDATE user_svc.events SET created_timestamp = $2 WHERE subject = $1`,
+		deletedUUID, time.Now().AddDate(0, 0, -91))
+	assert.Nil(t, err)
+
+	desc := "test dry run reports without removing"
+	report := runRetention(context.TODO(), rules, true, time.Now().UTC())
+	assert.Empty(t, report.failed, desc)
+	assert.True(t, report.affected[retentionRuleUnverifiedAccounts] >= 1, desc)
+	assert.True(t, report.affected[retentionRuleLoginHistory] >= 1, desc)
+	assert.True(t, report.affected[retentionRuleDeletedUsers] >= 1, desc)
+	_, err = getUserRow(context.TODO(), staleUUID)
+	assert.Nil(t, err, desc)
+
+	desc = "test enforce removes"
+	report = runRetention(context.TODO(), rules, false, time.Now().UTC())
+	assert.Empty(t, report.failed, desc)
+	_, err = getUserRow(context.TODO(), staleUUID)
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+
+	var tokens int
+	err = postgresDB.QueryRow(`SELECT COUNT(*) FROM user_security.auth_tokens WHERE token = $1`, newToken).Scan(&tokens)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 0, tokens, desc)
+
+	var identified int
+	err = postgresDB.QueryRow(`SELECT COUNT(*) FROM user_svc.events
+		WHERE subject = $1 AND envelope -> 'data' ? 'email'`, deletedUUID).Scan(&identified)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 0, identified, desc)
+
+	desc = "test second run has nothing left"
+	report = runRetention(context.TODO(), rules, false, time.Now().UTC())
+	assert.Empty(t, report.failed, desc)
+	assert.Equal(t, int64(0), report.affected[retentionRuleDeletedUsers], desc)
+}
+
+func TestUsageRecords(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("TestUsageRecords-One")
+	assert.Nil(t, err)
+	assert.Nil(t, unitTestInsertOrganization("TestUsageRecords"))
+	_, err = postgresDB.Exec(`UPDATE user_svc.accounts SET is_verified = TRUE, organization = $2 WHERE uuid = $1`,
+		response.GetUser().GetUuid(), "TestUsageRecords")
+	assert.Nil(t, err)
+
+	day := time.Date(2001, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	desc := "test seats are recorded once a day"
+	recorded, err := insertUsageRecords(context.TODO(), day)
+	assert.Nil(t, err, desc)
+	assert.True(t, recorded >= 1, desc)
+	recorded, err = insertUsageRecords(context.TODO(), day)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, int64(0), recorded, desc)
+
+	desc = "test organization filter"
+	records, err := getUsageRecords(context.TODO(), day, day, "TestUsageRecords")
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []*usageRecord{{Day: "2001-01-01", Organization: "TestUsageRecords", Seats: 1}}, records, desc)
+
+	desc = "test failed report keeps records unreported"
+	_, err = reportUsageRecords(context.TODO(), usageReportBatch, func([]*usageRecord) error {
+		return consts.ErrBillingRequestFailed
+	})
+	assert.EqualError(t, err, consts.ErrBillingRequestFailed.Error(), desc)
+
+	desc = "test records are reported until none are left"
+	var reported []*usageRecord
+	for {
+		count, err := reportUsageRecords(context.TODO(), 1, func(records []*usageRecord) error {
+			reported = append(reported, records...)
+			return nil
+		})
+		assert.Nil(t, err, desc)
+		if count == 0 {
+			break
+		}
+	}
+	assert.Contains(t, reported, records[0], desc)
+
+	desc = "test range outside the records"
+	records, err = getUsageRecords(context.TODO(), day.AddDate(0, 0, 1), day.AddDate(0, 0, 2), "")
+	assert.Nil(t, err, desc)
+	assert.Empty(t, records, desc)
+}
+
+func TestGetReferralStatsQueries(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	referrer := unitTestUserGenerator("TestGetReferralStats-One")
+	referrer.Uuid, _ = generateUUID()
+	code, err := insertNewUser(context.TODO(), referrer, userNames{}, time.Time{}, "", nil)
+	assert.Nil(t, err)
+
+	desc := "test unknown code creates no user"
+	unreferred := unitTestUserGenerator("TestGetReferralStats-Two")
+	unreferred.Uuid, _ = generateUUID()
+	_, err = insertNewUser(context.TODO(), unreferred, userNames{}, time.Time{}, "0000000000", nil)
+	assert.EqualError(t, err, consts.ErrInvalidReferralCode.Error(), desc)
+	_, err = getUserRow(context.TODO(), unreferred.GetUuid())
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+
+	desc = "test referees are counted"
+	referees := make([]*pblib.User, 2)
+	for i := range referees {
+		referees[i] = unitTestUserGenerator("TestGetReferralStats-Referee")
+		referees[i].Uuid, _ = generateUUID()
+		_, err = insertNewUser(context.TODO(), referees[i], userNames{}, time.Time{}, code, nil)
+		assert.Nil(t, err, desc)
+	}
+	_, err = postgresDB.Exec(`UPDATE user_svc.accounts SET is_verified = TRUE WHERE uuid = $1`, referees[0].GetUuid())
+	assert.Nil(t, err, desc)
+
+	stats, err := getReferralStats(context.TODO(), referrer.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, &referralStats{code: code, referrals: 2, verifiedReferrals: 1}, stats, desc)
+
+	desc = "test referee knows its referrer"
+	stats, err = getReferralStats(context.TODO(), referees[1].GetUuid())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, int64(0), stats.referrals, desc)
+	assert.Equal(t, referrer.GetUuid(), stats.referredBy, desc)
+
+	desc = "test nonexistent uuid"
+	uuid, _ := generateUUID()
+	_, err = getReferralStats(context.TODO(), uuid)
+	assert.EqualError(t, err, consts.ErrUUIDNotFound.Error(), desc)
+}
+
+func TestOnboardingSteps(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("TestOnboardingSteps-One")
+	assert.Nil(t, err)
+	uuid := response.GetUser().GetUuid()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	desc := "test completing a step twice keeps the first time"
+	assert.Nil(t, setOnboardingStep(context.TODO(), uuid, "profile", true, now), desc)
+	assert.Nil(t, setOnboardingStep(context.TODO(), uuid, "profile", true, now.Add(time.Hour)), desc)
+	assert.Nil(t, setOnboardingStep(context.TODO(), uuid, "invite-team", true, now.Add(time.Minute)), desc)
+	steps, err := getOnboardingSteps(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 2, len(steps), desc)
+	assert.Equal(t, "profile", steps[0].name, desc)
+	assert.True(t, now.Equal(steps[0].completed), desc)
+	assert.Equal(t, "invite-team", steps[1].name, desc)
+
+	desc = "test clearing a step"
+	assert.Nil(t, setOnboardingStep(context.TODO(), uuid, "profile", false, now), desc)
+	steps, err = getOnboardingSteps(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []onboardingStep{{name: "invite-team", completed: steps[0].completed}}, steps, desc)
+
+	desc = "test checklist is bounded"
+	for i := len(steps); i < maxOnboardingSteps; i++ {
+		assert.Nil(t, setOnboardingStep(context.TODO(), uuid, fmt.Sprintf("step-%d", i), true, now), desc)
+	}
+	err = setOnboardingStep(context.TODO(), uuid, "one-too-many", true, now)
+	assert.EqualError(t, err, consts.ErrTooManyOnboardingSteps.Error(), desc)
+	assert.Nil(t, setOnboardingStep(context.TODO(), uuid, "invite-team", true, now), desc+": completed steps still pass")
+
+	desc = "test deleted user has no steps"
+	_, err = deleteUserRow(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	steps, err = getOnboardingSteps(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.Empty(t, steps, desc)
+}
+
+func TestUpdateNotificationPreferences(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("TestUpdateNotificationPreferences-One")
+	assert.Nil(t, err)
+	uuid := response.GetUser().GetUuid()
+
+	desc := "test defaults"
+	preferences, err := getNotificationPreferences(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, &notificationPreferences{shareAlerts: true, securityAlerts: true, marketing: false}, preferences, desc)
+
+	desc = "test partial update"
+	preferences, err = updateNotificationPreferences(context.TODO(), uuid, map[string]bool{
+		emailCategoryShareAlerts: false,
+		emailCategoryMarketing:   true,
+	})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, &notificationPreferences{shareAlerts: false, securityAlerts: true, marketing: true}, preferences, desc)
+
+	desc = "test switched off category is not allowed"
+	allowed, err := emailAllowed(context.TODO(), uuid, emailCategoryShareAlerts)
+	assert.Nil(t, err, desc)
+	assert.False(t, allowed, desc)
+	allowed, err = emailAllowed(context.TODO(), uuid, emailCategorySecurityAlerts)
+	assert.Nil(t, err, desc)
+	assert.True(t, allowed, desc)
+
+	desc = "test unknown category"
+	_, err = updateNotificationPreferences(context.TODO(), uuid, map[string]bool{emailCategoryAccount: false})
+	assert.EqualError(t, err, consts.ErrInvalidNotificationSetting.Error(), desc)
+
+	desc = "test nonexistent user"
+	missingUUID, _ := generateUUID()
+	_, err = updateNotificationPreferences(context.TODO(), missingUUID, map[string]bool{emailCategoryMarketing: true})
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+	_, err = emailAllowed(context.TODO(), missingUUID, emailCategoryMarketing)
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+}
+
+func TestMarketingAlertsRollout(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	phases := columnPhases
+	defer func() { columnPhases = phases }()
+
+	response, err := unitTestInsertUser("TestMarketingAlertsRollout")
+	assert.Nil(t, err)
+	uuid := response.GetUser().GetUuid()
+	columns := func() (bool, sql.NullBool) {
+		var optIn bool
+		var alerts sql.NullBool
+		err := postgresDB.QueryRow(`SELECT marketing_opt_in, marketing_alerts FROM user_svc.accounts WHERE uuid = $1`,
+			uuid).Scan(&optIn, &alerts)
+		assert.Nil(t, err)
+		return optIn, alerts
+	}
+
+	desc := "test before rollout only the old column is written"
+	columnPhases = map[string]string{}
+	_, err = updateNotificationPreferences(context.TODO(), uuid, map[string]bool{emailCategoryMarketing: true})
+	assert.Nil(t, err, desc)
+	optIn, alerts := columns()
+	assert.True(t, optIn, desc)
+	assert.False(t, alerts.Valid, desc)
+
+	desc = "test dual read falls back to the old column"
+	columnPhases = map[string]string{"accounts.marketing_opt_in": schemaPhaseDualRead}
+	preferences, err := getNotificationPreferences(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.True(t, preferences.marketing, desc)
+
+	desc = "test dual write writes both columns"
+	columnPhases = map[string]string{"accounts.marketing_opt_in": schemaPhaseDualWrite}
+	_, err = updateNotificationPreferences(context.TODO(), uuid, map[string]bool{emailCategoryMarketing: false})
+	assert.Nil(t, err, desc)
+	optIn, alerts = columns()
+	assert.False(t, optIn, desc)
+	assert.Equal(t, sql.NullBool{Bool: false, Valid: true}, alerts, desc)
+
+	desc = "test new phase only uses the new column"
+	columnPhases = map[string]string{"accounts.marketing_opt_in": schemaPhaseNew}
+	preferences, err = updateNotificationPreferences(context.TODO(), uuid, map[string]bool{emailCategoryMarketing: true})
+	assert.Nil(t, err, desc)
+	assert.True(t, preferences.marketing, desc)
+	optIn, alerts = columns()
+	assert.False(t, optIn, desc)
+	assert.Equal(t, sql.NullBool{Bool: true, Valid: true}, alerts, desc)
+	optIn, _, err = getMarketingPreference(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.True(t, optIn, desc)
+}
+
+func TestForgetUserRowMarketingAlerts(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	phases := columnPhases
+	defer func() { columnPhases = phases }()
+
+	cases := []struct {
+		desc      string
+		phase     string
+		expAlerts sql.NullBool
+	}{
+		{"test before rollout only the old column is erased", "", sql.NullBool{}},
+		{"test dual write erases both columns", schemaPhaseDualWrite, sql.NullBool{Bool: false, Valid: true}},
+		{"test dual read erases both columns", schemaPhaseDualRead, sql.NullBool{Bool: false, Valid: true}},
+		{"test new phase erases the new column", schemaPhaseNew, sql.NullBool{Bool: false, Valid: true}},
+	}
+
+	for _, c := range cases {
+		columnPhases = map[string]string{"accounts.marketing_opt_in": c.phase}
+
+		response, err := unitTestInsertUser("TestForgetUserRowMarketingAlerts")
+		assert.Nil(t, err, c.desc)
+		uuid := response.GetUser().GetUuid()
+		_, err = updateNotificationPreferences(context.TODO(), uuid, map[string]bool{emailCategoryMarketing: true})
+		assert.Nil(t, err, c.desc)
+
+		_, err = forgetUserRow(context.TODO(), uuid, uuid, time.Now())
+		assert.Nil(t, err, c.desc)
+
+		var marketing, optIn bool
+		var alerts sql.NullBool
+		err = postgresDB.QueryRow(`SELECT `+readColumn("accounts", "marketing_opt_in")+`, marketing_opt_in,
+			marketing_alerts FROM user_svc.accounts WHERE uuid = $1`, uuid).Scan(&marketing, &optIn, &alerts)
+		assert.Nil(t, err, c.desc)
+		assert.False(t, marketing, c.desc)
+		assert.False(t, optIn, c.desc)
+		assert.Equal(t, c.expAlerts, alerts, c.desc)
+	}
+}
+
+func TestAdminActions(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	actor, _ := generateUUID()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	assert.Nil(t, insertAdminAction(context.TODO(), actor, "GetUserStats", "", now.Add(-time.Hour)))
+	assert.Nil(t, insertAdminAction(context.TODO(), actor, "GetUsageReport", "hwsc", now))
+
+	desc := "test time range"
+	actions, err := getAdminActions(context.TODO(), 0, now.Add(-time.Minute), now.Add(time.Minute), maxActivityLimit)
+	assert.Nil(t, err, desc)
+	var found *adminAction
+	for _, action := range actions {
+		if action.actor == actor {
+			assert.Nil(t, found, desc+": one action in range")
+			found = action
+		}
+	}
+	assert.NotNil(t, found, desc)
+	assert.Equal(t, "GetUsageReport", found.action, desc)
+	assert.Equal(t, "hwsc", found.subject, desc)
+	assert.True(t, now.Equal(found.timestamp), desc)
+
+	desc = "test from sequence"
+	actions, err = getAdminActions(context.TODO(), found.sequence, now.Add(-time.Minute), now.Add(time.Minute),
+		maxActivityLimit)
+	assert.Nil(t, err, desc)
+	for _, action := range actions {
+		assert.True(t, action.sequence > found.sequence, desc)
+	}
+}
+
+func TestExportAnalytics(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("TestExportAnalytics")
+	assert.Nil(t, err)
+	assert.Nil(t, unitTestInsertOrganization("TestExportAnalytics"))
+	_, err = postgresDB.Exec(`UPDATE user_svc.accounts SET organization = $2 WHERE uuid = $1`,
+		response.GetUser().GetUuid(), "TestExportAnalytics")
+	assert.Nil(t, err)
+	user, err := getUserRow(context.TODO(), response.GetUser().GetUuid())
+	assert.Nil(t, err)
+
+	key := []byte("analytics-key")
+	exporter := &unitTestAnalyticsExporter{}
+
+	desc := "test every account is exported"
+	assert.Nil(t, exportAnalytics(context.TODO(), exporter, key, time.Now()), desc)
+	assert.NotNil(t, exporter.dataset, desc)
+	var found *analyticsUser
+	for _, exported := range exporter.dataset.Users {
+		if exported.User == pseudonymize(key, analyticsUserDomain, user.GetUuid()) {
+			found = exported
+		}
+	}
+	assert.NotNil(t, found, desc)
+	assert.Equal(t, pseudonymize(key, analyticsOrganizationDomain, "TestExportAnalytics"), found.Organization, desc)
+	assert.Equal(t, "1-9", found.OrganizationSize, desc)
+
+	desc = "test no raw identifiers or personal data are exported"
+	payload, err := json.Marshal(exporter.dataset)
+	assert.Nil(t, err, desc)
+	for _, raw := range []string{user.GetUuid(), user.GetEmail(), user.GetFirstName(), user.GetLastName(),
+		user.GetOrganization()} {
+		assert.NotContains(t, string(payload), raw, desc)
+	}
+
+	desc = "test exporter error is returned"
+	exporter.err = consts.ErrAnalyticsRequestFailed
+	assert.EqualError(t, exportAnalytics(context.TODO(), exporter, key, time.Now()),
+		consts.ErrAnalyticsRequestFailed.Error(), desc)
+}
+
+func TestAuthMethods(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("TestAuthMethods-One")
+	assert.Nil(t, err)
+	uuid := response.GetUser().GetUuid()
+	other, err := unitTestInsertUser("TestAuthMethods-Two")
+	assert.Nil(t, err)
+
+	google := &authMethod{method: authMethodGoogle, credentialID: "110169484474386276334"}
+	webauthn := &authMethod{method: authMethodWebAuthn, credentialID: "Z3Vlc3Q"}
+	password := &authMethod{method: authMethodPassword}
+
+	desc := "test new users sign in with their password"
+	methods, err := getAuthMethods(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []*authMethod{password}, methods, desc)
+
+	desc = "test link"
+	assert.Nil(t, insertAuthMethod(context.TODO(), uuid, google, "", time.Now()), desc)
+	assert.Nil(t, insertAuthMethod(context.TODO(), uuid, webauthn, "", time.Now().Add(time.Second)), desc)
+	methods, err = getAuthMethods(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []*authMethod{password, google, webauthn}, methods, desc)
+
+	desc = "test a credential links to one account"
+	err = insertAuthMethod(context.TODO(), other.GetUser().GetUuid(), google, "", time.Now())
+	assert.EqualError(t, err, consts.ErrAuthMethodLinked.Error(), desc)
+
+	desc = "test password is not unlinked while linked methods cannot sign in"
+	err = deleteAuthMethod(context.TODO(), uuid, password)
+	assert.EqualError(t, err, consts.ErrLastSignInMethod.Error(), desc)
+	_, err = matchEmailAndPassword(context.TODO(), response.GetUser().GetEmail(), "TestAuthMethods-One")
+	assert.Nil(t, err, desc)
+
+	desc = "test unlink password"
+	signInMethods := signInAuthMethods
+	signInAuthMethods = map[string]bool{authMethodGoogle: true}
+	assert.Nil(t, deleteAuthMethod(context.TODO(), uuid, password), desc)
+	signInAuthMethods = signInMethods
+	_, err = matchEmailAndPassword(context.TODO(), response.GetUser().GetEmail(), "TestAuthMethods-One")
+	assert.NotNil(t, err, desc)
+	err = deleteAuthMethod(context.TODO(), uuid, password)
+	assert.EqualError(t, err, consts.ErrAuthMethodNotFound.Error(), desc)
+
+	desc = "test unlink credential"
+	assert.Nil(t, deleteAuthMethod(context.TODO(), uuid, google), desc)
+	err = deleteAuthMethod(context.TODO(), uuid, google)
+	assert.EqualError(t, err, consts.ErrAuthMethodNotFound.Error(), desc)
+
+	desc = "test the last method remains"
+	err = deleteAuthMethod(context.TODO(), uuid, webauthn)
+	assert.EqualError(t, err, consts.ErrLastAuthMethod.Error(), desc)
+	methods, err = getAuthMethods(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []*authMethod{webauthn}, methods, desc)
+
+	desc = "test the last password remains"
+	err = deleteAuthMethod(context.TODO(), other.GetUser().GetUuid(), password)
+	assert.EqualError(t, err, consts.ErrLastSignInMethod.Error(), desc)
+
+	desc = "test nonexistent user"
+	missingUUID, _ := generateUUID()
+	_, err = getAuthMethods(context.TODO(), missingUUID)
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+	err = insertAuthMethod(context.TODO(), missingUUID, &authMethod{method: authMethodWebAuthn, credentialID: "bWlzc2luZw"},
+		"", time.Now())
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+	err = deleteAuthMethod(context.TODO(), missingUUID, webauthn)
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+}
+
+func TestTouchAuthToken(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	_, token, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err)
+	now := time.Now()
+
+	desc := "test new token is active"
+	active, err := touchAuthToken(context.TODO(), token, now, time.Hour)
+	assert.Nil(t, err, desc)
+	assert.True(t, active, desc)
+
+	desc = "test activity within the idle timeout"
+	active, err = touchAuthToken(context.TODO(), token, now.Add(59*time.Minute), time.Hour)
+	assert.Nil(t, err, desc)
+	assert.True(t, active, desc)
+
+	desc = "test idle token"
+	active, err = touchAuthToken(context.TODO(), token, now.Add(2*time.Hour), time.Hour)
+	assert.Nil(t, err, desc)
+	assert.False(t, active, desc)
+
+	desc = "test tokens issued before activity was recorded are active"
+	_, err = postgresDB.Exec("UPDATE user_security.auth_tokens SET last_activity = NULL WHERE token = $1", token)
+	assert.Nil(t, err, desc)
+	active, err = touchAuthToken(context.TODO(), token, now.Add(3*time.Hour), time.Hour)
+	assert.Nil(t, err, desc)
+	assert.True(t, active, desc)
+
+	desc = "test unknown token"
+	active, err = touchAuthToken(context.TODO(), "unknown", now, time.Hour)
+	assert.Nil(t, err, desc)
+	assert.False(t, active, desc)
+
+	desc = "test empty token"
+	_, err = touchAuthToken(context.TODO(), "", now, time.Hour)
+	assert.EqualError(t, err, authconst.ErrEmptyToken.Error(), desc)
+}
+
+func TestLoginCountries(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("TestLoginCountries")
+	assert.Nil(t, err)
+	user := response.GetUser()
+	uuid := user.GetUuid()
+
+	record := func(country string, confirm bool) loginCountryState {
+		state, err := recordLoginCountry(context.TODO(), uuid, country, time.Now(), confirm)
+		assert.Nil(t, err)
+		return state
+	}
+
+	desc := "test the first country is known"
+	assert.Equal(t, loginCountryKnown, record("NZ", true), desc)
+	assert.Equal(t, loginCountryKnown, record("NZ", true), desc)
+
+	desc = "test a new country without confirmation"
+	assert.Equal(t, loginCountryNew, record("AU", false), desc)
+	assert.Equal(t, loginCountryKnown, record("AU", true), desc)
+
+	desc = "test a new country waits on confirmation"
+	assert.Equal(t, loginCountryNew, record("FR", true), desc)
+	assert.Equal(t, loginCountryUnconfirmed, record("FR", true), desc)
+
+	desc = "test confirm"
+	identification, err := auth.GenerateEmailIdentification(uuid, user.GetPermissionLevel())
+	assert.Nil(t, err, desc)
+	err = insertLoginCountryToken(context.TODO(), uuid, "FR", identification.GetToken(), identification.GetSecret())
+	assert.Nil(t, err, desc)
+	confirmedUUID, err := confirmLoginCountryRow(context.TODO(), identification.GetToken())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuid, confirmedUUID, desc)
+	assert.Equal(t, loginCountryKnown, record("FR", true), desc)
+
+	desc = "test tokens are consumed"
+	_, err = confirmLoginCountryRow(context.TODO(), identification.GetToken())
+	assert.EqualError(t, err, consts.ErrNoMatchingLoginCountryToken.Error(), desc)
+
+	desc = "test expired token"
+	assert.Equal(t, loginCountryNew, record("DE", true), desc)
+	identification, err = auth.GenerateEmailIdentification(uuid, user.GetPermissionLevel())
+	assert.Nil(t, err, desc)
+	identification.GetSecret().ExpirationTimestamp = time.Now().Add(-time.Minute).Unix()
+	identification.GetSecret().CreatedTimestamp = time.Now().Add(-time.Hour).Unix()
+	err = insertLoginCountryToken(context.TODO(), uuid, "DE", identification.GetToken(), identification.GetSecret())
+	assert.Nil(t, err, desc)
+	_, err = confirmLoginCountryRow(context.TODO(), identification.GetToken())
+	assert.EqualError(t, err, consts.ErrExpiredLoginCountryToken.Error(), desc)
+	assert.Equal(t, loginCountryUnconfirmed, record("DE", true), desc)
+
+	desc = "test switching confirmation off confirms pending countries"
+	assert.Equal(t, loginCountryKnown, record("DE", false), desc)
+
+	desc = "test nonexistent user"
+	missingUUID, _ := generateUUID()
+	_, err = recordLoginCountry(context.TODO(), missingUUID, "NZ", time.Now(), true)
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+}
+
+func TestPasswordExpiryReminders(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("TestPasswordExpiryReminders")
+	assert.Nil(t, err)
+	user := response.GetUser()
+	uuid := user.GetUuid()
+
+	changed, err := getPasswordChanged(context.TODO(), uuid)
+	assert.Nil(t, err)
+
+	isDue := func(now time.Time) bool {
+		reminders, err := getPasswordExpiryReminders(context.TODO(), user.GetOrganization(),
+			now.Add(-30*24*time.Hour), now.Add(-23*24*time.Hour))
+		assert.Nil(t, err)
+		for _, reminder := range reminders {
+			if reminder.uuid == uuid {
+				assert.Equal(t, user.GetEmail(), reminder.email)
+				return true
+			}
+		}
+		return false
+	}
+
+	desc := "test reminders are due a week before expiry"
+	assert.False(t, isDue(changed.Add(22*24*time.Hour)), desc)
+	assert.True(t, isDue(changed.Add(24*24*time.Hour)), desc)
+	assert.False(t, isDue(changed.Add(31*24*time.Hour)), desc)
+
+	desc = "test users are reminded once"
+	assert.Nil(t, markPasswordReminded(context.TODO(), uuid, changed, time.Now()), desc)
+	assert.False(t, isDue(changed.Add(24*24*time.Hour)), desc)
+
+	desc = "test changing the password resets the reminder"
+	dbDerived, err := getUserRow(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	_, err = updateUserRow(context.TODO(), uuid, &pblib.User{Password: "NewPassword"}, dbDerived, userNames{}, nil)
+	assert.Nil(t, err, desc)
+	newChanged, err := getPasswordChanged(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.True(t, newChanged.After(changed), desc)
+	assert.True(t, isDue(newChanged.Add(24*24*time.Hour)), desc)
+
+	desc = "test nonexistent user"
+	missingUUID, _ := generateUUID()
+	_, err = getPasswordChanged(context.TODO(), missingUUID)
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+}
+
+func TestProfileChanges(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("TestProfileChanges")
+	assert.Nil(t, err)
+	uuid := response.GetUser().GetUuid()
+
+	desc := "test new users have no history"
+	changes, err := getProfileChanges(context.TODO(), uuid, 0, defaultProfileHistoryLimit)
+	assert.Nil(t, err, desc)
+	assert.Empty(t, changes, desc)
+
+	desc = "test updates are recorded"
+	dbDerived, err := getUserRow(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	_, err = updateUserRow(context.TODO(), uuid, &pblib.User{LastName: "Changed", Password: "NewPassword"},
+		dbDerived, userNames{}, nil)
+	assert.Nil(t, err, desc)
+	changes, err = getProfileChanges(context.TODO(), uuid, 0, defaultProfileHistoryLimit)
+	assert.Nil(t, err, desc)
+	if assert.Len(t, changes, 2, desc) {
+		assert.Equal(t, profileFieldLastName, changes[0].field, desc)
+		assert.Equal(t, hashProfileValue(uuid, profileFieldLastName, "TestProfileChanges"), changes[0].oldHash, desc)
+		assert.Equal(t, hashProfileValue(uuid, profileFieldLastName, "Changed"), changes[0].newHash, desc)
+		assert.Equal(t, profileFieldPassword, changes[1].field, desc)
+	}
+
+	desc = "test paging"
+	page, err := getProfileChanges(context.TODO(), uuid, changes[0].sequence, 1)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, changes[1:], page, desc)
+
+	desc = "test other users do not see the history"
+	other, err := unitTestInsertUser("TestProfileChanges-Other")
+	assert.Nil(t, err, desc)
+	changes, err = getProfileChanges(context.TODO(), other.GetUser().GetUuid(), 0, defaultProfileHistoryLimit)
+	assert.Nil(t, err, desc)
+	assert.Empty(t, changes, desc)
+}
+
+func TestFavoriteDocuments(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	owner, err := unitTestInsertUser("TestFavoriteDocuments-Owner")
+	assert.Nil(t, err)
+	ownerUUID := owner.GetUser().GetUuid()
+	reader, err := unitTestInsertUser("TestFavoriteDocuments-Reader")
+	assert.Nil(t, err)
+	readerUUID := reader.GetUser().GetUuid()
+
+	private, public, shared := "1IYmSxWbCLM1cLM2eqbcZ1wlbba", "1IYmSxWbCLM1cLM2eqbcZ1wlbbb", "1IYmSxWbCLM1cLM2eqbcZ1wlbbc"
+	for _, document := range []struct {
+		duid     string
+		isPublic bool
+	}{{private, false}, {public, true}, {shared, false}} {
+		_, err := postgresDB.Exec(`INSERT INTO user_svc.documents(duid, uuid, is_public) VALUES($1, $2, $3)`,
+			document.duid, ownerUUID, document.isPublic)
+		assert.Nil(t, err)
+	}
+	_, err = postgresDB.Exec(`INSERT INTO user_svc.shared_documents(duid, uuid) VALUES($1, $2)`, shared, readerUUID)
+	assert.Nil(t, err)
+
+	desc := "test owners favorite their documents"
+	assert.Nil(t, insertFavoriteDocument(context.TODO(), ownerUUID, private, time.Now()), desc)
+	duids, err := getFavoriteDocuments(context.TODO(), ownerUUID)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{private}, duids, desc)
+
+	desc = "test users favorite public and shared documents"
+	assert.Nil(t, insertFavoriteDocument(context.TODO(), readerUUID, shared, time.Now()), desc)
+	assert.Nil(t, insertFavoriteDocument(context.TODO(), readerUUID, public, time.Now().Add(time.Second)), desc)
+	assert.Nil(t, insertFavoriteDocument(context.TODO(), readerUUID, shared, time.Now().Add(time.Minute)), desc)
+	duids, err = getFavoriteDocuments(context.TODO(), readerUUID)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{shared, public}, duids, desc)
+
+	desc = "test private documents of other users"
+	err = insertFavoriteDocument(context.TODO(), readerUUID, private, time.Now())
+	assert.EqualError(t, err, consts.ErrDocumentNotFound.Error(), desc)
+
+	desc = "test nonexistent document"
+	err = insertFavoriteDocument(context.TODO(), readerUUID, "1IYmSxWbCLM1cLM2eqbcZ1wlbbz", time.Now())
+	assert.EqualError(t, err, consts.ErrDocumentNotFound.Error(), desc)
+
+	desc = "test unshared documents are left out"
+	_, err = postgresDB.Exec(`DELETE FROM user_svc.shared_documents WHERE duid = $1`, shared)
+	assert.Nil(t, err, desc)
+	duids, err = getFavoriteDocuments(context.TODO(), readerUUID)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{public}, duids, desc)
+
+	desc = "test unfavorite"
+	assert.Nil(t, deleteFavoriteDocument(context.TODO(), readerUUID, public), desc)
+	err = deleteFavoriteDocument(context.TODO(), readerUUID, public)
+	assert.EqualError(t, err, consts.ErrFavoriteNotFound.Error(), desc)
+
+	desc = "test deleted documents are removed"
+	_, err = postgresDB.Exec(`DELETE FROM user_svc.documents WHERE duid = $1`, private)
+	assert.Nil(t, err, desc)
+	duids, err = getFavoriteDocuments(context.TODO(), ownerUUID)
+	assert.Nil(t, err, desc)
+	assert.Empty(t, duids, desc)
+}
+
+func TestDocumentQuota(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	owner, err := unitTestInsertUser("TestDocumentQuota-Owner")
+	assert.Nil(t, err)
+	ownerUUID := owner.GetUser().GetUuid()
+	other, err := unitTestInsertUser("TestDocumentQuota-Other")
+	assert.Nil(t, err)
+	otherUUID := other.GetUser().GetUuid()
+
+	first, second, third := "1IYmSxWbCLM1cLM2eqbcZ1wlbqa", "1IYmSxWbCLM1cLM2eqbcZ1wlbqb", "1IYmSxWbCLM1cLM2eqbcZ1wlbqc"
+
+	desc := "test register documents"
+	assert.Nil(t, insertDocument(context.TODO(), ownerUUID, first, false, 2), desc)
+	assert.Nil(t, insertDocument(context.TODO(), ownerUUID, second, true, 2), desc)
+	count, err := countDocuments(context.TODO(), ownerUUID)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 2, count, desc)
+
+	desc = "test register a document again"
+	assert.Nil(t, insertDocument(context.TODO(), ownerUUID, second, true, 2), desc)
+
+	desc = "test quota exceeded"
+	err = insertDocument(context.TODO(), ownerUUID, third, false, 2)
+	assert.EqualError(t, err, consts.ErrDocumentQuotaExceeded.Error(), desc)
+
+	desc = "test unlimited quota"
+	assert.Nil(t, insertDocument(context.TODO(), ownerUUID, third, false, 0), desc)
+
+	desc = "test document of another user"
+	err = insertDocument(context.TODO(), otherUUID, first, false, 0)
+	assert.EqualError(t, err, consts.ErrDocumentExists.Error(), desc)
+	err = deleteDocument(context.TODO(), otherUUID, first)
+	assert.EqualError(t, err, consts.ErrDocumentNotFound.Error(), desc)
+
+	desc = "test unregister documents"
+	assert.Nil(t, deleteDocument(context.TODO(), ownerUUID, first), desc)
+	count, err = countDocuments(context.TODO(), ownerUUID)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 2, count, desc)
+	err = deleteDocument(context.TODO(), ownerUUID, first)
+	assert.EqualError(t, err, consts.ErrDocumentNotFound.Error(), desc)
+
+	desc = "test nonexistent user"
+	nonExistentUUID, _ := generateUUID()
+	err = insertDocument(context.TODO(), nonExistentUUID, "1IYmSxWbCLM1cLM2eqbcZ1wlbqd", false, 0)
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+}
+
+func TestDocumentVisibility(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	owner, err := unitTestInsertUser("TestDocumentVisibility-Owner")
+	assert.Nil(t, err)
+	ownerUUID := owner.GetUser().GetUuid()
+	other, err := unitTestInsertUser("TestDocumentVisibility-Other")
+	assert.Nil(t, err)
+	otherUUID := other.GetUser().GetUuid()
+
+	first, second, third := "1IYmSxWbCLM1cLM2eqbcZ1wlbva", "1IYmSxWbCLM1cLM2eqbcZ1wlbvb", "1IYmSxWbCLM1cLM2eqbcZ1wlbvc"
+	for _, duid := range []string{first, second, third} {
+		assert.Nil(t, insertDocument(context.TODO(), ownerUUID, duid, false, 0))
+	}
+
+	countChanges := func(duid string) int {
+		var count int
+		err := postgresDB.QueryRow(`SELECT COUNT(*) FROM user_svc.document_visibility_changes WHERE duid = $1`,
+			duid).Scan(&count)
+		assert.Nil(t, err)
+		return count
+	}
+
+	desc := "test make documents public"
+	assert.Nil(t, updateDocumentPublic(context.TODO(), ownerUUID, first, true, time.Now()), desc)
+	assert.Nil(t, updateDocumentPublic(context.TODO(), ownerUUID, third, true, time.Now()), desc)
+	duids, err := getPublicDocuments(context.TODO(), ownerUUID, "", 10)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{first, third}, duids, desc)
+	assert.Equal(t, 1, countChanges(first), desc)
+
+	desc = "test unchanged visibility is not recorded"
+	assert.Nil(t, updateDocumentPublic(context.TODO(), ownerUUID, first, true, time.Now()), desc)
+	assert.Equal(t, 1, countChanges(first), desc)
+
+	desc = "test list public documents after a duid"
+	duids, err = getPublicDocuments(context.TODO(), ownerUUID, first, 10)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{third}, duids, desc)
+	duids, err = getPublicDocuments(context.TODO(), ownerUUID, "", 1)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{first}, duids, desc)
+
+	desc = "test make a document private"
+	assert.Nil(t, updateDocumentPublic(context.TODO(), ownerUUID, first, false, time.Now()), desc)
+	assert.Equal(t, 2, countChanges(first), desc)
+	duids, err = getPublicDocuments(context.TODO(), ownerUUID, "", 10)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{third}, duids, desc)
+
+	desc = "test list every document"
+	documents, err := getUserDocuments(context.TODO(), ownerUUID, first, 10)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []*userDocument{{second, false}, {third, true}}, documents, desc)
+	documents, err = getUserDocuments(context.TODO(), otherUUID, "", 10)
+	assert.Nil(t, err, desc)
+	assert.Empty(t, documents, desc)
+
+	desc = "test document of another user"
+	err = updateDocumentPublic(context.TODO(), otherUUID, second, true, time.Now())
+	assert.EqualError(t, err, consts.ErrDocumentNotFound.Error(), desc)
+	assert.Equal(t, 0, countChanges(second), desc)
+
+	desc = "test changes are kept after the document is deleted"
+	assert.Nil(t, deleteDocument(context.TODO(), ownerUUID, first), desc)
+	assert.Equal(t, 2, countChanges(first), desc)
+}
+
+func TestSharePolicies(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	const organization = "TestSharePolicies"
+	var uuids []string
+	for _, lastName := range []string{"TestSharePolicies-Owner", "TestSharePolicies-Member", "TestSharePolicies-Outsider"} {
+		resp, err := unitTestInsertUser(lastName)
+		assert.Nil(t, err)
+		uuids = append(uuids, resp.GetUser().GetUuid())
+	}
+	ownerUUID, memberUUID, outsiderUUID := uuids[0], uuids[1], uuids[2]
+	assert.Nil(t, unitTestInsertOrganization(organization))
+	_, err := postgresDB.Exec(`UPDATE user_svc.accounts SET organization = $1 WHERE uuid IN ($2, $3)`,
+		organization, ownerUUID, memberUUID)
+	assert.Nil(t, err)
+	actor, _ := generateUUID()
+
+	sharedWith := func(duid string) []string {
+		rows, err := postgresDB.Query(`SELECT uuid FROM user_svc.shared_documents WHERE duid = $1 ORDER BY uuid`, duid)
+		assert.Nil(t, err)
+		defer rows.Close()
+
+		var shared []string
+		for rows.Next() {
+			var uuid string
+			assert.Nil(t, rows.Scan(&uuid))
+			shared = append(shared, uuid)
+		}
+		return shared
+	}
+
+	desc := "test organizations without a policy"
+	rule, err := getSharePolicy(context.TODO(), organization)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, sharePolicyNone, rule, desc)
+	assert.Nil(t, insertDocument(context.TODO(), ownerUUID, "1IYmSxWbCLM1cLM2eqbcZ1wlbsa", false, 0), desc)
+	assert.Empty(t, sharedWith("1IYmSxWbCLM1cLM2eqbcZ1wlbsa"), desc)
+
+	desc = "test share with the organization"
+	assert.Nil(t, upsertSharePolicy(context.TODO(), organization, sharePolicyOrganization, actor, time.Now()), desc)
+	rule, err = getSharePolicy(context.TODO(), organization)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, sharePolicyOrganization, rule, desc)
+	assert.Nil(t, insertDocument(context.TODO(), ownerUUID, "1IYmSxWbCLM1cLM2eqbcZ1wlbsb", false, 0), desc)
+	assert.Equal(t, []string{memberUUID}, sharedWith("1IYmSxWbCLM1cLM2eqbcZ1wlbsb"), desc)
+	assert.Empty(t, sharedWith("1IYmSxWbCLM1cLM2eqbcZ1wlbsa"), desc)
+
+	desc = "test other organizations are not shared with"
+	assert.Nil(t, insertDocument(context.TODO(), outsiderUUID, "1IYmSxWbCLM1cLM2eqbcZ1wlbsc", false, 0), desc)
+	assert.Empty(t, sharedWith("1IYmSxWbCLM1cLM2eqbcZ1wlbsc"), desc)
+
+	desc = "test remove the policy"
+	assert.Nil(t, upsertSharePolicy(context.TODO(), organization, sharePolicyNone, actor, time.Now()), desc)
+	rule, err = getSharePolicy(context.TODO(), organization)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, sharePolicyNone, rule, desc)
+	assert.Nil(t, insertDocument(context.TODO(), memberUUID, "1IYmSxWbCLM1cLM2eqbcZ1wlbsd", false, 0), desc)
+	assert.Empty(t, sharedWith("1IYmSxWbCLM1cLM2eqbcZ1wlbsd"), desc)
+	assert.Equal(t, []string{memberUUID}, sharedWith("1IYmSxWbCLM1cLM2eqbcZ1wlbsb"), desc)
+}
+
+func TestLastSeen(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	resp, err := unitTestInsertUser("TestLastSeen")
+	assert.Nil(t, err)
+	uuid := resp.GetUser().GetUuid()
+	seen := time.Now().UTC().Truncate(presenceGranularity)
+
+	desc := "test users never seen"
+	lastSeen, err := getLastSeen(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.True(t, lastSeen.IsZero(), desc)
+
+	desc = "test update last seen"
+	assert.Nil(t, updateLastSeen(context.TODO(), uuid, seen), desc)
+	lastSeen, err = getLastSeen(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.True(t, seen.Equal(lastSeen), desc)
+
+	desc = "test earlier sightings are ignored"
+	assert.Nil(t, updateLastSeen(context.TODO(), uuid, seen.Add(-presenceGranularity)), desc)
+	lastSeen, err = getLastSeen(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.True(t, seen.Equal(lastSeen), desc)
+
+	desc = "test nonexistent user"
+	nonExistentUUID, _ := generateUUID()
+	_, err = getLastSeen(context.TODO(), nonExistentUUID)
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+}
+
+func TestGetUsersPage(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	const organization = "TestGetUsersPage"
+	var uuids []string
+	for _, lastName := range []string{"TestGetUsersPage-One", "TestGetUsersPage-Two", "TestGetUsersPage-Three"} {
+		resp, err := unitTestInsertUser(lastName)
+		assert.Nil(t, err)
+		uuids = append(uuids, resp.GetUser().GetUuid())
+	}
+	assert.Nil(t, unitTestInsertOrganization(organization))
+	_, err := postgresDB.Exec(`UPDATE user_svc.accounts SET organization = $1 WHERE uuid IN ($2, $3, $4)`,
+		organization, uuids[0], uuids[1], uuids[2])
+	assert.Nil(t, err)
+	_, err = postgresDB.Exec(`UPDATE user_svc.accounts SET is_verified = TRUE WHERE uuid = $1`, uuids[1])
+	assert.Nil(t, err)
+	seen := time.Now().UTC().Truncate(presenceGranularity)
+	assert.Nil(t, updateLastSeen(context.TODO(), uuids[2], seen))
+
+	pageUUIDs := func(users []*pblib.User) []string {
+		var page []string
+		for _, user := range users {
+			page = append(page, user.GetUuid())
+		}
+		return page
+	}
+
+	desc := "test pages follow signup order"
+	filter := &userListFilter{organization: organization}
+	users, _, err := getUsersPage(context.TODO(), filter, "", 2)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuids[:2], pageUUIDs(users), desc)
+	users, lastSeen, err := getUsersPage(context.TODO(), filter, uuids[1], 2)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuids[2:], pageUUIDs(users), desc)
+	assert.True(t, seen.Equal(lastSeen[uuids[2]]), desc)
+
+	desc = "test filter verified users"
+	filter = &userListFilter{organization: organization, isVerified: sql.NullBool{Bool: true, Valid: true}}
+	users, _, err = getUsersPage(context.TODO(), filter, "", 10)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuids[1:2], pageUUIDs(users), desc)
+
+	desc = "test filter created range"
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	filter = &userListFilter{organization: organization, createdFrom: today.AddDate(0, 0, 1)}
+	users, _, err = getUsersPage(context.TODO(), filter, "", 10)
+	assert.Nil(t, err, desc)
+	assert.Empty(t, users, desc)
+	filter = &userListFilter{organization: organization, createdFrom: today, createdTo: today.AddDate(0, 0, 1)}
+	users, _, err = getUsersPage(context.TODO(), filter, "", 10)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuids, pageUUIDs(users), desc)
+}
+
+func TestInsertSharedDocuments(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	var uuids []string
+	for _, lastName := range []string{"TestInsertSharedDocuments-Owner", "TestInsertSharedDocuments-One",
+		"TestInsertSharedDocuments-Two"} {
+		resp, err := unitTestInsertUser(lastName)
+		assert.Nil(t, err)
+		uuids = append(uuids, resp.GetUser().GetUuid())
+	}
+	ownerUUID := uuids[0]
+	duid := "1IYmSxWbCLM1cLM2eqbcZ1wlbsh"
+	assert.Nil(t, insertDocument(context.TODO(), ownerUUID, duid, false, 0))
+
+	countShares := func() int {
+		var count int
+		err := postgresDB.QueryRow(`SELECT COUNT(*) FROM user_svc.shared_documents WHERE duid = $1`, duid).Scan(&count)
+		assert.Nil(t, err)
+		return count
+	}
+
+	desc := "test share with users"
+	assert.Nil(t, insertSharedDocuments(context.TODO(), ownerUUID, duid, uuids[1:2]), desc)
+	assert.Equal(t, 1, countShares(), desc)
+
+	desc = "test already shared users and the owner are skipped"
+	assert.Nil(t, insertSharedDocuments(context.TODO(), ownerUUID, duid, uuids), desc)
+	assert.Equal(t, 2, countShares(), desc)
+
+	desc = "test nonexistent users share nothing"
+	nonExistentUUID, _ := generateUUID()
+	_, err := postgresDB.Exec(`DELETE FROM user_svc.shared_documents WHERE duid = $1 AND uuid = $2`, duid, uuids[2])
+	assert.Nil(t, err, desc)
+	err = insertSharedDocuments(context.TODO(), ownerUUID, duid, []string{uuids[2], nonExistentUUID})
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+	assert.Equal(t, 1, countShares(), desc)
+
+	desc = "test documents of other users"
+	err = insertSharedDocuments(context.TODO(), uuids[1], duid, uuids[2:])
+	assert.EqualError(t, err, consts.ErrDocumentNotFound.Error(), desc)
+
+	desc = "test nonexistent document"
+	err = insertSharedDocuments(context.TODO(), ownerUUID, "1IYmSxWbCLM1cLM2eqbcZ1wlbsz", uuids[1:])
+	assert.EqualError(t, err, consts.ErrDocumentNotFound.Error(), desc)
+}
+
+func TestReplaceEmailToken(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("TestReplaceEmailToken")
+	assert.Nil(t, err)
+	uuid := response.GetUser().GetUuid()
+
+	desc := "test token created within the cooldown is kept"
+	emailID, err := auth.GenerateEmailIdentification(uuid, auth.PermissionStringMap[auth.NoPermission])
+	assert.Nil(t, err, desc)
+	next, err := replaceEmailToken(context.TODO(), uuid, emailID.GetToken(), emailID.GetSecret(), time.Hour)
+	assert.EqualError(t, err, consts.ErrVerificationResendCooldown.Error(), desc)
+	assert.True(t, next.After(time.Now().Add(59*time.Minute)), desc)
+	_, err = getEmailTokenRow(context.TODO(), response.GetIdentification().GetToken())
+	assert.Nil(t, err, desc)
+
+	desc = "test token is replaced after the cooldown"
+	next, err = replaceEmailToken(context.TODO(), uuid, emailID.GetToken(), emailID.GetSecret(), 0)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, emailID.GetSecret().GetCreatedTimestamp(), next.Unix(), desc)
+	_, err = getEmailTokenRow(context.TODO(), response.GetIdentification().GetToken())
+	assert.NotNil(t, err, desc)
+	_, err = getEmailTokenRow(context.TODO(), emailID.GetToken())
+	assert.Nil(t, err, desc)
+
+	desc = "test account without token"
+	assert.Nil(t, deleteEmailTokenRow(context.TODO(), uuid), desc)
+	emailID, err = auth.GenerateEmailIdentification(uuid, auth.PermissionStringMap[auth.NoPermission])
+	assert.Nil(t, err, desc)
+	_, err = replaceEmailToken(context.TODO(), uuid, emailID.GetToken(), emailID.GetSecret(), time.Hour)
+	assert.Nil(t, err, desc)
+
+	desc = "test invalid uuid"
+	_, err = replaceEmailToken(context.TODO(), "", emailID.GetToken(), emailID.GetSecret(), time.Hour)
+	assert.NotNil(t, err, desc)
+}
+
+func TestPasswordResetTokens(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("TestPasswordResetTokens")
+	assert.Nil(t, err)
+	user := response.GetUser()
+	uuid := user.GetUuid()
+
+	desc := "test look up by email ignores case"
+	foundUser, err := getUserRowByEmail(context.TODO(), strings.ToUpper(user.GetEmail()))
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuid, foundUser.GetUuid(), desc)
+
+	desc = "test nonexistent email"
+	_, err = getUserRowByEmail(context.TODO(), "nonexistent-reset@hwsc.com")
+	assert.EqualError(t, err, consts.ErrEmailDoesNotExist.Error(), desc)
+
+	desc = "test a new request replaces the previous token"
+	previousID, err := auth.GenerateEmailIdentification(uuid, user.GetPermissionLevel())
+	assert.Nil(t, err, desc)
+	err = insertPasswordResetToken(context.TODO(), uuid, previousID.GetToken(), previousID.GetSecret(),
+		time.Now().Add(passwordResetLifetime))
+	assert.Nil(t, err, desc)
+	resetID, err := auth.GenerateEmailIdentification(uuid, user.GetPermissionLevel())
+	assert.Nil(t, err, desc)
+	err = insertPasswordResetToken(context.TODO(), uuid, resetID.GetToken(), resetID.GetSecret(),
+		time.Now().Add(passwordResetLifetime))
+	assert.Nil(t, err, desc)
+	_, err = consumePasswordResetToken(context.TODO(), previousID.GetToken())
+	assert.EqualError(t, err, consts.ErrNoMatchingPasswordReset.Error(), desc)
+
+	desc = "test consume"
+	resetUUID, err := consumePasswordResetToken(context.TODO(), resetID.GetToken())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuid, resetUUID, desc)
+
+	desc = "test tokens are consumed"
+	_, err = consumePasswordResetToken(context.TODO(), resetID.GetToken())
+	assert.EqualError(t, err, consts.ErrNoMatchingPasswordReset.Error(), desc)
+
+	desc = "test expired token"
+	resetID, err = auth.GenerateEmailIdentification(uuid, user.GetPermissionLevel())
+	assert.Nil(t, err, desc)
+	err = insertPasswordResetToken(context.TODO(), uuid, resetID.GetToken(), resetID.GetSecret(),
+		time.Now().Add(-time.Minute))
+	assert.Nil(t, err, desc)
+	resetUUID, err = consumePasswordResetToken(context.TODO(), resetID.GetToken())
+	assert.EqualError(t, err, consts.ErrExpiredPasswordResetToken.Error(), desc)
+	assert.Equal(t, uuid, resetUUID, desc)
+
+	desc = "test empty token"
+	err = insertPasswordResetToken(context.TODO(), uuid, "", resetID.GetSecret(), time.Now())
+	assert.EqualError(t, err, authconst.ErrEmptyToken.Error(), desc)
+	_, err = consumePasswordResetToken(context.TODO(), "")
+	assert.EqualError(t, err, authconst.ErrEmptyToken.Error(), desc)
+}
+
+func TestRefreshTokens(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("TestRefreshTokens")
+	assert.Nil(t, err)
+	uuid := response.GetUser().GetUuid()
+	now := time.Now()
+
+	desc := "test consume"
+	assert.Nil(t, insertRefreshToken(context.TODO(), uuid, hashToken("first"), now, now.Add(time.Hour)), desc)
+	refreshedUUID, err := consumeRefreshToken(context.TODO(), hashToken("first"))
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuid, refreshedUUID, desc)
+
+	desc = "test tokens are consumed"
+	_, err = consumeRefreshToken(context.TODO(), hashToken("first"))
+	assert.EqualError(t, err, consts.ErrNoMatchingRefreshToken.Error(), desc)
+
+	desc = "test expired token"
+	err = insertRefreshToken(context.TODO(), uuid, hashToken("expired"), now.Add(-time.Hour), now)
+	assert.Nil(t, err, desc)
+	_, err = consumeRefreshToken(context.TODO(), hashToken("expired"))
+	assert.EqualError(t, err, consts.ErrExpiredRefreshToken.Error(), desc)
+
+	desc = "test revoking auth tokens revokes refresh tokens"
+	assert.Nil(t, insertRefreshToken(context.TODO(), uuid, hashToken("revoked"), now, now.Add(time.Hour)), desc)
+	assert.Nil(t, revokeAuthTokens(context.TODO(), uuid), desc)
+	_, err = consumeRefreshToken(context.TODO(), hashToken("revoked"))
+	assert.EqualError(t, err, consts.ErrNoMatchingRefreshToken.Error(), desc)
+
+	desc = "test nonexistent user"
+	missingUUID, _ := generateUUID()
+	err = insertRefreshToken(context.TODO(), missingUUID, hashToken("missing"), now, now.Add(time.Hour))
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+
+	desc = "test empty token"
+	assert.EqualError(t, insertRefreshToken(context.TODO(), uuid, "", now, now), authconst.ErrEmptyToken.Error(), desc)
+	_, err = consumeRefreshToken(context.TODO(), "")
+	assert.EqualError(t, err, authconst.ErrEmptyToken.Error(), desc)
+}
+
+func TestAuditEntries(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	now := time.Now()
+	actor, _ := generateUUID()
+	target, _ := generateUUID()
+
+	desc := "test insert"
+	recorded := map[string]string{metadataKeyForwardedFor: "203.0.113.7"}
+	assert.Nil(t, insertAuditEntry(context.TODO(), actor, auditActionDeleteUser, target, recorded, now), desc)
+
+	desc = "test entries are kept after the users are gone"
+	entries, err := getAuditEntries(context.TODO(), 0, now.Add(-time.Second), now.Add(time.Second), maxActivityLimit)
+	assert.Nil(t, err, desc)
+	var found *auditEntry
+	for _, entry := range entries {
+		if entry.target == target {
+			found = entry
+		}
+	}
+	if !assert.NotNil(t, found, desc) {
+		return
+	}
+	assert.Equal(t, actor, found.actor, desc)
+	assert.Equal(t, auditActionDeleteUser, found.action, desc)
+	assert.Equal(t, recorded, found.metadata, desc)
+
+	desc = "test from sequence"
+	entries, err = getAuditEntries(context.TODO(), found.sequence, now.Add(-time.Second), now.Add(time.Second),
+		maxActivityLimit)
+	assert.Nil(t, err, desc)
+	for _, entry := range entries {
+		assert.NotEqual(t, target, entry.target, desc)
+	}
+}
+
+func TestSoftDeleteUserRow(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("SoftDeleteUserRow")
+	assert.Nil(t, err)
+	uuid := response.GetUser().GetUuid()
+	now := time.Now()
+
+	desc := "test soft deleted users are not found"
+	deletedRows, err := softDeleteUserRow(context.TODO(), uuid, now)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, int64(1), deletedRows, desc)
+	_, err = getUserRow(context.TODO(), uuid)
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+	_, err = getUserRowByEmail(context.TODO(), response.GetUser().GetEmail())
+	assert.EqualError(t, err, consts.ErrEmailDoesNotExist.Error(), desc)
+
+	desc = "test soft delete is idempotent"
+	deletedRows, err = softDeleteUserRow(context.TODO(), uuid, now.Add(time.Hour))
+	assert.Nil(t, err, desc)
+	assert.Equal(t, int64(0), deletedRows, desc)
+
+	desc = "test restore"
+	assert.Nil(t, restoreUserRow(context.TODO(), uuid), desc)
+	_, err = getUserRow(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.EqualError(t, restoreUserRow(context.TODO(), uuid), consts.ErrUserNotFound.Error(), desc)
+
+	desc = "test purge after the grace period"
+	_, err = softDeleteUserRow(context.TODO(), uuid, now)
+	assert.Nil(t, err, desc)
+	tx, err := postgresDB.BeginTx(context.TODO(), nil)
+	assert.Nil(t, err, desc)
+	purged, err := purgeSoftDeletedAccounts(context.TODO(), tx, now)
+	assert.Nil(t, err, desc)
+	assert.NotContains(t, purged, uuid, desc)
+	purged, err = purgeSoftDeletedAccounts(context.TODO(), tx, now.Add(time.Second))
+	assert.Nil(t, err, desc)
+	assert.Contains(t, purged, uuid, desc)
+	assert.Nil(t, tx.Commit(), desc)
+	assert.EqualError(t, restoreUserRow(context.TODO(), uuid), consts.ErrUserNotFound.Error(), desc)
+}
+
+func TestEmailChange(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("EmailChange")
+	assert.Nil(t, err)
+	user := response.GetUser()
+	newEmail := "email-change-" + user.GetUuid() + "@hwsc.test"
+
+	prospect := func() {
+		_, err := postgresDB.Exec(`UPDATE user_svc.accounts SET prospective_email = $2 WHERE uuid = $1`,
+			user.GetUuid(), newEmail)
+		assert.Nil(t, err)
+	}
+	insert := func(expires time.Time) string {
+		changeID, err := auth.GenerateEmailIdentification(user.GetUuid(), user.GetPermissionLevel())
+		assert.Nil(t, err)
+		assert.Nil(t, insertEmailChangeToken(context.TODO(), user.GetUuid(), newEmail, changeID.GetToken(),
+			changeID.GetSecret(), expires))
+		return changeID.GetToken()
+	}
+
+	desc := "test unknown token"
+	_, err = confirmEmailChangeRow(context.TODO(), "unknownToken")
+	assert.EqualError(t, err, consts.ErrNoMatchingEmailChange.Error(), desc)
+
+	desc = "test expired token"
+	prospect()
+	token := insert(time.Now().Add(-time.Minute))
+	_, err = confirmEmailChangeRow(context.TODO(), token)
+	assert.EqualError(t, err, consts.ErrExpiredEmailChangeToken.Error(), desc)
+	_, err = confirmEmailChangeRow(context.TODO(), token)
+	assert.EqualError(t, err, consts.ErrNoMatchingEmailChange.Error(), desc)
+
+	desc = "test cancelled change"
+	token = insert(time.Now().Add(time.Hour))
+	cancelled, err := cancelEmailChangeRow(context.TODO(), user.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, int64(1), cancelled, desc)
+	_, err = confirmEmailChangeRow(context.TODO(), token)
+	assert.EqualError(t, err, consts.ErrNoMatchingEmailChange.Error(), desc)
+	cancelled, err = cancelEmailChangeRow(context.TODO(), user.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, int64(0), cancelled, desc)
+
+	desc = "test confirmed change"
+	prospect()
+	token = insert(time.Now().Add(time.Hour))
+	updatedUser, err := confirmEmailChangeRow(context.TODO(), token)
+	assert.Nil(t, err, desc)
+	if assert.NotNil(t, updatedUser, desc) {
+		assert.Equal(t, newEmail, updatedUser.GetEmail(), desc)
+		assert.Empty(t, updatedUser.GetProspectiveEmail(), desc)
+		assert.True(t, updatedUser.GetIsVerified(), desc)
+	}
+	_, err = confirmEmailChangeRow(context.TODO(), token)
+	assert.EqualError(t, err, consts.ErrNoMatchingEmailChange.Error(), desc)
+}
+
+func TestInsertNewUserEmailToken(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	user := unitTestUserGenerator("InsertNewUserEmailToken")
+	uuid, err := generateUUID()
+	assert.Nil(t, err)
+	user.Uuid = uuid
+	emailID, err := auth.GenerateEmailIdentification(uuid, auth.PermissionStringMap[auth.NoPermission])
+	assert.Nil(t, err)
+
+	desc := "test user and token are inserted together"
+	_, err = insertNewUser(context.TODO(), user, userNames{}, time.Time{}, "", emailID)
+	assert.Nil(t, err, desc)
+	row, err := getEmailTokenRow(context.TODO(), emailID.GetToken())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuid, row.uuid, desc)
+
+	desc = "test user is not inserted if its token is not"
+	other := unitTestUserGenerator("InsertNewUserEmailToken-Other")
+	other.Uuid, err = generateUUID()
+	assert.Nil(t, err)
+	_, err = insertNewUser(context.TODO(), other, userNames{}, time.Time{}, "", emailID)
+	assert.NotNil(t, err, desc)
+	_, err = getUserRow(context.TODO(), other.GetUuid())
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+}
+
+func TestSetOrganizationAdmin(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	const organization = "TestSetOrganizationAdmin"
+	actor, _ := generateUUID()
+	now := time.Now()
+
+	desc := "test create organization"
+	assert.Nil(t, insertOrganization(context.TODO(), organization, actor, now), desc)
+	assert.EqualError(t, insertOrganization(context.TODO(), organization, actor, now),
+		consts.ErrOrganizationExists.Error(), desc)
+
+	member, err := unitTestInsertUser("TestSetOrganizationAdmin-Member")
+	assert.Nil(t, err)
+	outsider, err := unitTestInsertUser("TestSetOrganizationAdmin-Outsider")
+	assert.Nil(t, err)
+	memberUUID, outsiderUUID := member.GetUser().GetUuid(), outsider.GetUser().GetUuid()
+	_, err = postgresDB.Exec(`UPDATE user_svc.accounts SET organization = $1 WHERE uuid = $2`, organization, memberUUID)
+	assert.Nil(t, err)
+
+	desc = "test only members are made admins"
+	err = setOrganizationAdmin(context.TODO(), organization, outsiderUUID, true, actor, now)
+	assert.EqualError(t, err, consts.ErrNotOrganizationMember.Error(), desc)
+	assert.Nil(t, setOrganizationAdmin(context.TODO(), organization, memberUUID, true, actor, now), desc)
+	isAdmin, err := isOrganizationAdmin(context.TODO(), organization, memberUUID)
+	assert.Nil(t, err, desc)
+	assert.True(t, isAdmin, desc)
+
+	desc = "test get organization"
+	row, err := getOrganizationRow(context.TODO(), organization)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, actor, row.createdBy, desc)
+	assert.Equal(t, int64(1), row.members, desc)
+	assert.Equal(t, []string{memberUUID}, row.admins, desc)
+
+	desc = "test unknown organization"
+	_, err = getOrganizationRow(context.TODO(), "TestSetOrganizationAdmin-Unknown")
+	assert.EqualError(t, err, consts.ErrOrganizationNotFound.Error(), desc)
+	err = setOrganizationAdmin(context.TODO(), "TestSetOrganizationAdmin-Unknown", memberUUID, true, actor, now)
+	assert.EqualError(t, err, consts.ErrOrganizationNotFound.Error(), desc)
+
+	desc = "test members that leave stop being admins"
+	user, err := getUserRow(context.TODO(), memberUUID)
+	assert.Nil(t, err, desc)
+	_, err = updateUserRow(context.TODO(), memberUUID, &pblib.User{Organization: "TestSetOrganizationAdmin-Other"},
+		user, userNames{}, nil)
+	assert.Nil(t, err, desc)
+	isAdmin, err = isOrganizationAdmin(context.TODO(), organization, memberUUID)
+	assert.Nil(t, err, desc)
+	assert.False(t, isAdmin, desc)
+
+	desc = "test accounts make unknown organizations"
+	row, err = getOrganizationRow(context.TODO(), "TestSetOrganizationAdmin-Other")
+	assert.Nil(t, err, desc)
+	assert.Empty(t, row.createdBy, desc)
+	assert.Equal(t, int64(1), row.members, desc)
+
+	desc = "test revoke admin"
+	assert.Nil(t, setOrganizationAdmin(context.TODO(), organization, memberUUID, false, actor, now), desc)
+	row, err = getOrganizationRow(context.TODO(), organization)
+	assert.Nil(t, err, desc)
+	assert.Empty(t, row.admins, desc)
+}
+
+func TestDeleteSharedDocuments(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	var uuids []string
+	for _, lastName := range []string{"TestDeleteSharedDocuments-Owner", "TestDeleteSharedDocuments-One",
+		"TestDeleteSharedDocuments-Two"} {
+		resp, err := unitTestInsertUser(lastName)
+		assert.Nil(t, err)
+		uuids = append(uuids, resp.GetUser().GetUuid())
+	}
+	ownerUUID := uuids[0]
+	first, second := "1IYmSxWbCLM1cLM2eqbcZ1wlbua", "1IYmSxWbCLM1cLM2eqbcZ1wlbub"
+	for _, duid := range []string{first, second} {
+		assert.Nil(t, insertDocument(context.TODO(), ownerUUID, duid, false, 0))
+		assert.Nil(t, insertSharedDocuments(context.TODO(), ownerUUID, duid, uuids[1:]))
+	}
+
+	desc := "test list documents shared with user"
+	documents, err := getSharedDocuments(context.TODO(), uuids[1], "", 10)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []*sharedDocument{{first, ownerUUID}, {second, ownerUUID}}, documents, desc)
+	documents, err = getSharedDocuments(context.TODO(), uuids[1], first, 10)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []*sharedDocument{{second, ownerUUID}}, documents, desc)
+
+	desc = "test unshare skips users it is not shared with"
+	unshared, err := deleteSharedDocuments(context.TODO(), ownerUUID, first, uuids)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, int64(2), unshared, desc)
+	unshared, err = deleteSharedDocuments(context.TODO(), ownerUUID, first, uuids[1:])
+	assert.Nil(t, err, desc)
+	assert.Equal(t, int64(0), unshared, desc)
+	documents, err = getSharedDocuments(context.TODO(), uuids[1], "", 10)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []*sharedDocument{{second, ownerUUID}}, documents, desc)
+
+	desc = "test documents of other users"
+	_, err = deleteSharedDocuments(context.TODO(), uuids[1], second, uuids[2:])
+	assert.EqualError(t, err, consts.ErrDocumentNotFound.Error(), desc)
+
+	desc = "test documents of soft deleted owners are left out"
+	_, err = softDeleteUserRow(context.TODO(), ownerUUID, time.Now())
+	assert.Nil(t, err, desc)
+	documents, err = getSharedDocuments(context.TODO(), uuids[2], "", 10)
+	assert.Nil(t, err, desc)
+	assert.Empty(t, documents, desc)
+	assert.Nil(t, restoreUserRow(context.TODO(), ownerUUID), desc)
+
+	desc = "test shares are removed with the user"
+	_, err = deleteUserRow(context.TODO(), uuids[2])
+	assert.Nil(t, err, desc)
+	var count int
+	err = postgresDB.QueryRow(`SELECT COUNT(*) FROM user_svc.shared_documents WHERE uuid = $1`, uuids[2]).Scan(&count)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 0, count, desc)
+
+	desc = "test shares are removed with the document"
+	assert.Nil(t, deleteDocument(context.TODO(), ownerUUID, second), desc)
+	documents, err = getSharedDocuments(context.TODO(), uuids[1], "", 10)
+	assert.Nil(t, err, desc)
+	assert.Empty(t, documents, desc)
+}
+
+func TestDBDeadlineExceeded(t *testing.T) {
+	// sql.Open connects on first use, an expired context fails before any connection is made, so the test does
+	// not need postgres
+	if postgresDB == nil {
+		db, err := sql.Open(dbDriverName, connectionString)
+		assert.Nil(t, err)
+		postgresDB = db
+		defer func() {
+			_ = db.Close()
+			postgresDB = nil
+		}()
+	}
+
+	ctx, cancel := context.WithDeadline(context.TODO(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	now := time.Now()
+	secret := &pblib.Secret{
+		Key:                 "TestDBDeadlineExceeded-Secret",
+		CreatedTimestamp:    now.Add(-time.Minute).Unix(),
+		ExpirationTimestamp: now.Add(time.Hour).Unix(),
+	}
+	token, err := auth.NewToken(validAuthTokenHeader, validAuthTokenBody, secret)
+	assert.Nil(t, err)
+	user := unitTestUserGenerator("DBDeadlineExceeded")
+	user.Uuid = validUUID
+
+	calls := map[string]func() error{
+		"insertNewUser": func() error {
+			_, err := insertNewUser(ctx, user, userNames{}, time.Time{}, "", nil)
+			return err
+		},
+		"getUserRow": func() error {
+			_, err := getUserRow(ctx, validUUID)
+			return err
+		},
+		"getExistingEmails": func() error {
+			_, err := getExistingEmails(ctx, []string{user.GetEmail()})
+			return err
+		},
+		"deleteUserRow": func() error {
+			_, err := deleteUserRow(ctx, validUUID)
+			return err
+		},
+		"updateUserRow": func() error {
+			_, err := updateUserRow(ctx, validUUID, &pblib.User{LastName: "Updated"}, user, userNames{}, nil)
+			return err
+		},
+		"getActiveSecretRow": func() error {
+			_, err := getActiveSecretRow(ctx)
+			return err
+		},
+		"getLatestSecret": func() error {
+			_, err := getLatestSecret(ctx, 2)
+			return err
+		},
+		"insertAuthToken": func() error {
+			return insertAuthToken(ctx, token, validAuthTokenHeader, validAuthTokenBody, secret)
+		},
+		"getAuthTokenRow": func() error {
+			_, err := getAuthTokenRow(ctx, validUUID)
+			return err
+		},
+		"getMarketingPreference": func() error {
+			_, _, err := getMarketingPreference(ctx, validUUID)
+			return err
+		},
+		"insertEvent": func() error {
+			_, err := insertEvent(ctx, &cloudEvent{ID: "TestDBDeadlineExceeded"})
+			return err
+		},
+		"insertEmailDelivery": func() error {
+			return insertEmailDelivery(ctx, templateVerifyEmail, true)
+		},
+	}
+
+	for name, call := range calls {
+		assert.Equal(t, context.DeadlineExceeded, call(), name)
+	}
+}
+
+func TestUserNames(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	user := unitTestUserGenerator("UserNames")
+	uuid, err := generateUUID()
+	assert.Nil(t, err)
+	user.Uuid = uuid
+
+	desc := "test names are inserted with the user"
+	_, err = insertNewUser(context.TODO(), user, userNames{middleName: "Mary"}, time.Time{}, "", nil)
+	assert.Nil(t, err, desc)
+	names, err := getUserNames(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, userNames{middleName: "Mary"}, names, desc)
+
+	dbDerived, err := getUserRow(context.TODO(), uuid)
+	assert.Nil(t, err)
+
+	desc = "test empty names are left unchanged"
+	_, err = updateUserRow(context.TODO(), uuid, &pblib.User{}, dbDerived, userNames{displayName: "Mary K."}, nil)
+	assert.Nil(t, err, desc)
+	names, err = getUserNames(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, userNames{middleName: "Mary", displayName: "Mary K."}, names, desc)
+
+	desc = "test cleared names are removed"
+	_, err = updateUserRow(context.TODO(), uuid, &pblib.User{}, dbDerived, userNames{},
+		map[string]bool{userFieldMiddleName: true, userFieldDisplayName: true})
+	assert.Nil(t, err, desc)
+	names, err = getUserNames(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, userNames{}, names, desc)
+
+	desc = "test name cannot be both cleared and updated"
+	_, err = updateUserRow(context.TODO(), uuid, &pblib.User{}, dbDerived, userNames{middleName: "Mary"},
+		map[string]bool{userFieldMiddleName: true})
+	assert.EqualError(t, err, consts.ErrConflictingClearField.Error(), desc)
+
+	desc = "test unknown user"
+	unknownUUID, err := generateUUID()
+	assert.Nil(t, err)
+	_, err = getUserNames(context.TODO(), unknownUUID)
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+}
@@ -0,0 +1,281 @@
+package service
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/golang/protobuf/proto"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestDebouncer replays the result of a mutation to identical requests arriving within window,
+// so double clicks and gateway retries do not repeat its side effects.
+// A duplicate of a request still in flight waits for it, failed requests are not replayed.
+type requestDebouncer struct {
+	lock    sync.Mutex
+	window  time.Duration
+	entries *list.List
+	byKey   map[string]*list.Element
+}
+
+type debounceEntry struct {
+	key        string
+	done       chan struct{}
+	response   interface{}
+	err        error
+	header     metadata.MD
+	expiration time.Time
+}
+
+// headerRecorder is a grpc.ServerTransportStream that keeps a copy of the response header set by a handler
+type headerRecorder struct {
+	grpc.ServerTransportStream
+	header metadata.MD
+}
+
+const (
+	defaultDebounceWindow = 3 * time.Second
+)
+
+var (
+	// debouncedMethods are the rpc methods with side effects such as emails, shares or events
+	debouncedMethods = map[string]bool{
+		"CreateUser":                true,
+		"DeleteUser":                true,
+		"RestoreUser":               true,
+		"VerifyUser":                true,
+		"ForgetUser":                true,
+		"UpdateUser":                true,
+		"ShareDocument":             true,
+		"UnshareDocument":           true,
+		"MakeNewAuthSecret":         true,
+		"VerifyEmailToken":          true,
+		"ConfirmEmailChange":        true,
+		"VerifyParentalConsent":     true,
+		"ConfirmLoginCountry":       true,
+		"RequestPasswordReset":      true,
+		"ResendVerificationEmail":   true,
+		"ResetPassword":             true,
+		"Enable2FA":                 true,
+		"Verify2FA":                 true,
+		"Disable2FA":                true,
+		"CreateAPIKey":              true,
+		"RevokeAPIKey":              true,
+		"CreateOrganization":        true,
+		"DeleteUsersByOrganization": true,
+	}
+
+	// mutationDebouncer is set with hosts_debounce_window, a window of 0 disables it
+	mutationDebouncer *requestDebouncer
+)
+
+func init() {
+	window := defaultDebounceWindow
+	if conf.Debounce.Window != "" {
+		parsed, err := time.ParseDuration(conf.Debounce.Window)
+		if err != nil || parsed < 0 {
+			reportStartupProblem("Invalid debounce window:", conf.Debounce.Window)
+			return
+		}
+		window = parsed
+	}
+
+	if window > 0 {
+		mutationDebouncer = newRequestDebouncer(window)
+	}
+}
+
+func newRequestDebouncer(window time.Duration) *requestDebouncer {
+	return &requestDebouncer{
+		window:  window,
+		entries: list.New(),
+		byKey:   make(map[string]*list.Element),
+	}
+}
+
+// DebounceInterceptor answers a repeated mutation with the result of the first identical request
+// seen within the debounce window, instead of running the handler again.
+// Requests are identical if the same caller calls the same method with the same request and x-hwsc metadata,
+// a caller never gets the result of a request it did not send.
+func DebounceInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	if mutationDebouncer == nil || !debouncedMethods[path.Base(info.FullMethod)] {
+		return handler(ctx, req)
+	}
+
+	key, err := requestFingerprint(ctx, info.FullMethod, req)
+	if err != nil {
+		// an unhashable request is simply not debounced
+		return handler(ctx, req)
+	}
+
+	return mutationDebouncer.do(ctx, key, req, handler)
+}
+
+// do runs handler unless a request with key succeeded within window or is in flight.
+func (d *requestDebouncer) do(ctx context.Context, key string, req interface{},
+	handler grpc.UnaryHandler) (interface{}, error) {
+	for {
+		entry, isLeader := d.begin(key)
+		if isLeader {
+			return d.run(ctx, entry, req, handler)
+		}
+
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, statusFromError(ctx.Err())
+		}
+
+		// the first request failed and was forgotten, try again as a new request
+		if entry.err != nil {
+			continue
+		}
+
+		if len(entry.header) > 0 {
+			if err := grpc.SetHeader(ctx, entry.header); err != nil {
+				logger.Error(consts.DebounceTag, consts.MsgErrSetResponseHeader, err.Error())
+			}
+		}
+		logger.Info(consts.DebounceTag, "Replayed duplicate request")
+
+		// callers may modify the response, each gets its own copy
+		if message, ok := entry.response.(proto.Message); ok {
+			return proto.Clone(message), nil
+		}
+		return entry.response, nil
+	}
+}
+
+// begin returns the entry of key, creating it if there is none, and whether the caller created it.
+func (d *requestDebouncer) begin(key string) (*debounceEntry, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.removeExpired(time.Now())
+
+	if element, ok := d.byKey[key]; ok {
+		return element.Value.(*debounceEntry), false
+	}
+
+	entry := &debounceEntry{
+		key:  key,
+		done: make(chan struct{}),
+	}
+	d.byKey[key] = d.entries.PushBack(entry)
+
+	return entry, true
+}
+
+// run calls handler and publishes its result to the requests waiting on entry.
+func (d *requestDebouncer) run(ctx context.Context, entry *debounceEntry, req interface{},
+	handler grpc.UnaryHandler) (interface{}, error) {
+	recorder := &headerRecorder{ServerTransportStream: grpc.ServerTransportStreamFromContext(ctx)}
+	if recorder.ServerTransportStream != nil {
+		ctx = grpc.NewContextWithServerTransportStream(ctx, recorder)
+	}
+
+	response, err := handler(ctx, req)
+
+	d.lock.Lock()
+	entry.response = response
+	entry.err = err
+	entry.header = recorder.header
+	entry.expiration = time.Now().Add(d.window)
+	if err != nil {
+		d.remove(d.byKey[entry.key])
+	} else {
+		// keep entries ordered by expiration for removeExpired
+		d.entries.MoveToBack(d.byKey[entry.key])
+	}
+	d.lock.Unlock()
+	close(entry.done)
+
+	return response, err
+}
+
+// removeExpired drops finished entries older than window, must be called while holding lock.
+func (d *requestDebouncer) removeExpired(now time.Time) {
+	for element := d.entries.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*debounceEntry)
+		if entry.expiration.IsZero() {
+			// in flight
+			element = next
+			continue
+		}
+		if now.Before(entry.expiration) {
+			return
+		}
+		d.remove(element)
+		element = next
+	}
+}
+
+// remove must be called while holding lock.
+func (d *requestDebouncer) remove(element *list.Element) {
+	d.entries.Remove(element)
+	delete(d.byKey, element.Value.(*debounceEntry).key)
+}
+
+func (d *requestDebouncer) len() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.entries.Len()
+}
+
+// requestFingerprint hashes method, req, the x-hwsc request metadata and the authorization token of the caller.
+// The token, or service api key, stands for the caller, whose identification token is already part of req.
+func requestFingerprint(ctx context.Context, method string, req interface{}) (string, error) {
+	message, ok := req.(proto.Message)
+	if !ok {
+		return "", consts.ErrNilRequest
+	}
+
+	buffer := proto.NewBuffer(nil)
+	buffer.SetDeterministic(true)
+	if err := buffer.Marshal(message); err != nil {
+		return "", err
+	}
+
+	fingerprint := append([]byte(method+"\x00"+authorizationToken(ctx)+"\x00"), buffer.Bytes()...)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := make([]string, 0, len(md))
+	for key := range md {
+		if strings.HasPrefix(key, metadataKeyPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fingerprint = append(fingerprint, "\x00"+key...)
+		for _, value := range md[key] {
+			fingerprint = append(fingerprint, "\x00"+value...)
+		}
+	}
+
+	hash := sha256.Sum256(fingerprint)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// SetHeader records md before passing it on.
+func (r *headerRecorder) SetHeader(md metadata.MD) error {
+	if err := r.ServerTransportStream.SetHeader(md); err != nil {
+		return err
+	}
+	r.header = metadata.Join(r.header, md)
+
+	return nil
+}
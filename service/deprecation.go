@@ -0,0 +1,76 @@
+package service
+
+import (
+	"fmt"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"path"
+)
+
+// deprecation is a behavior that is removed after its sunset date, an ISO 8601 date
+type deprecation struct {
+	name   string
+	sunset string
+}
+
+var (
+	// deprecatedEmptyUpdateFields is UpdateUser leaving empty fields unchanged, replaced by v2 field masks
+	deprecatedEmptyUpdateFields = deprecation{name: "empty-update-fields", sunset: "2027-04-01"}
+
+	// deprecatedErrorStrings is clients matching status messages, replaced by the v2 error details
+	deprecatedErrorStrings = deprecation{name: "error-strings", sunset: "2027-04-01"}
+)
+
+// String returns the x-hwsc-deprecation value of d, such as "error-strings; sunset=2027-04-01".
+func (d deprecation) String() string {
+	return fmt.Sprintf("%s; sunset=%s", d.name, d.sunset)
+}
+
+// DeprecationInterceptor lists the deprecated behaviors a request relies on in the x-hwsc-deprecation
+// response header, one value per behavior, so client teams learn of removals before the sunset date.
+func DeprecationInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	var used []deprecation
+	if path.Base(info.FullMethod) == "UpdateUser" && usesEmptyUpdateFields(req) {
+		used = append(used, deprecatedEmptyUpdateFields)
+	}
+
+	resp, err := handler(ctx, req)
+	if err != nil {
+		used = append(used, deprecatedErrorStrings)
+	}
+
+	if len(used) == 0 {
+		return resp, err
+	}
+
+	values := make([]string, 0, len(used))
+	for _, d := range used {
+		logger.Info(consts.DeprecationTag, info.FullMethod, d.String())
+		values = append(values, d.String())
+	}
+	if headerErr := setResponseHeader(ctx, metadataKeyDeprecation, values...); headerErr != nil {
+		logger.Error(consts.DeprecationTag, consts.MsgErrSetResponseHeader, headerErr.Error())
+	}
+
+	return resp, err
+}
+
+// usesEmptyUpdateFields returns true if an UpdateUser request leaves a field unchanged by leaving it empty.
+func usesEmptyUpdateFields(req interface{}) bool {
+	userReq, ok := req.(*pbsvc.UserRequest)
+	if !ok {
+		return false
+	}
+
+	user := userReq.GetUser()
+	if user == nil {
+		return false
+	}
+
+	return user.GetFirstName() == "" || user.GetLastName() == "" || user.GetEmail() == "" ||
+		user.GetPassword() == "" || user.GetOrganization() == ""
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"testing"
+)
+
+func TestDeprecationInterceptor(t *testing.T) {
+	updateInfo := &grpc.UnaryServerInfo{FullMethod: "/user.UserService/UpdateUser"}
+	getInfo := &grpc.UnaryServerInfo{FullMethod: "/user.UserService/GetUser"}
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &pbsvc.UserResponse{}, nil
+	}
+	fail := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, consts.ErrStatusUUIDNotFound
+	}
+	partial := &pbsvc.UserRequest{User: &pblib.User{Uuid: "0000xsnjg0mqjhbf4qx1efd6y3", FirstName: "Lisa"}}
+	full := &pbsvc.UserRequest{User: &pblib.User{
+		Uuid:         "0000xsnjg0mqjhbf4qx1efd6y3",
+		FirstName:    "Lisa",
+		LastName:     "Kim",
+		Email:        "lisa@hwsc.com",
+		Password:     "12345678",
+		Organization: "hwsc",
+	}}
+
+	cases := []struct {
+		desc    string
+		info    *grpc.UnaryServerInfo
+		req     *pbsvc.UserRequest
+		handler grpc.UnaryHandler
+		exp     []string
+	}{
+		{"test successful read", getInfo, partial, ok, nil},
+		{"test update with every field", updateInfo, full, ok, nil},
+		{"test update leaving fields empty", updateInfo, partial, ok,
+			[]string{"empty-update-fields; sunset=2027-04-01"}},
+		{"test error", getInfo, partial, fail,
+			[]string{"error-strings; sunset=2027-04-01"}},
+		{"test failed update leaving fields empty", updateInfo, partial, fail,
+			[]string{"empty-update-fields; sunset=2027-04-01", "error-strings; sunset=2027-04-01"}},
+	}
+
+	for _, c := range cases {
+		ctx, stream := unitTestServerContext()
+		_, err := DeprecationInterceptor(ctx, c.req, c.info, c.handler)
+		_, expErr := c.handler(ctx, c.req)
+		assert.Equal(t, expErr, err, c.desc)
+		assert.Equal(t, c.exp, stream.header.Get(metadataKeyDeprecation), c.desc)
+	}
+}
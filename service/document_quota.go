@@ -0,0 +1,86 @@
+package service
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"strconv"
+)
+
+var (
+	// documentQuota is the number of documents a user may own, set with hosts_documents_quota, 0 is unlimited
+	documentQuota int
+)
+
+func init() {
+	var err error
+	documentQuota, err = parseDocumentQuota(conf.Documents.Quota)
+	if err != nil {
+		reportStartupProblem("Invalid document quota:", conf.Documents.Quota)
+		return
+	}
+
+	if documentQuota > 0 {
+		logger.Info(consts.DocumentsTag, "Users may own up to", strconv.Itoa(documentQuota), "documents")
+	}
+}
+
+// parseDocumentQuota parses the number of documents a user may own, empty is unlimited.
+// Returns ErrInvalidDocumentQuota if value is not a number or is negative.
+func parseDocumentQuota(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	quota, err := strconv.Atoi(value)
+	if err != nil || quota < 0 {
+		return 0, consts.ErrInvalidDocumentQuota
+	}
+
+	return quota, nil
+}
+
+// parseDocumentPublic parses the x-hwsc-public metadata value, empty defaults to false.
+// Returns ErrInvalidDocumentVisibility if value is not a boolean.
+func parseDocumentPublic(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+
+	public, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, consts.ErrInvalidDocumentVisibility
+	}
+
+	return public, nil
+}
+
+// documentQuotaResponse returns the documents uuid owns in the x-hwsc-document-count response header and
+// the quota, if any, in x-hwsc-document-quota.
+func documentQuotaResponse(ctx context.Context, uuid string) (*pbsvc.UserResponse, error) {
+	count, err := countDocuments(ctx, uuid)
+	if err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrGetDocumentQuota, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := setResponseHeader(ctx, metadataKeyDocumentCount, strconv.Itoa(count)); err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if documentQuota > 0 {
+		if err := setResponseHeader(ctx, metadataKeyDocumentQuota, strconv.Itoa(documentQuota)); err != nil {
+			logger.Error(consts.DocumentsTag, consts.MsgErrSetResponseHeader, err.Error())
+			return nil, statusFromError(err)
+		}
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
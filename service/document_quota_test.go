@@ -0,0 +1,56 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseDocumentQuota(t *testing.T) {
+	cases := []struct {
+		desc     string
+		value    string
+		expQuota int
+		isExpErr bool
+	}{
+		{"test empty is unlimited", "", 0, false},
+		{"test zero is unlimited", "0", 0, false},
+		{"test quota", "250", 250, false},
+		{"test negative quota", "-1", 0, true},
+		{"test invalid quota", "many", 0, true},
+	}
+
+	for _, c := range cases {
+		quota, err := parseDocumentQuota(c.value)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidDocumentQuota.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.expQuota, quota, c.desc)
+		}
+	}
+}
+
+func TestParseDocumentPublic(t *testing.T) {
+	cases := []struct {
+		desc      string
+		value     string
+		expPublic bool
+		isExpErr  bool
+	}{
+		{"test empty defaults to private", "", false, false},
+		{"test public", "true", true, false},
+		{"test private", "false", false, false},
+		{"test invalid value", "yes", false, true},
+	}
+
+	for _, c := range cases {
+		public, err := parseDocumentPublic(c.value)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidDocumentVisibility.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.expPublic, public, c.desc)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package service
+
+// userDocument is a document of user_svc.documents listed by ListUserDocuments
+type userDocument struct {
+	duid     string
+	isPublic bool
+}
+
+const (
+	// ListPublicDocuments and ListUserDocuments page sizes
+	defaultDocumentsLimit = 100
+	maxDocumentsLimit     = 500
+)
+
+// parseFromDuid parses the x-hwsc-from-duid metadata value, empty lists documents from the first.
+// Returns ErrInvalidDuid if value is not a duid.
+func parseFromDuid(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	if err := validateDuid(value); err != nil {
+		return "", err
+	}
+
+	return value, nil
+}
@@ -0,0 +1,29 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseFromDuid(t *testing.T) {
+	cases := []struct {
+		desc     string
+		value    string
+		isExpErr bool
+	}{
+		{"test empty starts from the first document", "", false},
+		{"test duid", "1IYmSxWbCLM1cLM2eqbcZ1wlbbv", false},
+		{"test invalid duid", "1IYmSxWbCLM1cLM2eqbcZ1wlbb-", true},
+	}
+
+	for _, c := range cases {
+		duid, err := parseFromDuid(c.value)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidDuid.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.value, duid, c.desc)
+		}
+	}
+}
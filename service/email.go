@@ -2,15 +2,19 @@ package service
 
 import (
 	"bytes"
-	"fmt"
+	"context"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/logger"
 	"github.com/hwsc-org/hwsc-user-svc/conf"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
-	"io/ioutil"
-	"net/smtp"
+	"github.com/hwsc-org/hwsc-user-svc/tmpl"
+	"io/fs"
+	"net"
+	"net/mail"
 	"os"
-	"regexp"
 	"strings"
 	"text/template"
+	"time"
 )
 
 // Request holds transaction email data
@@ -20,31 +24,83 @@ type emailRequest struct {
 	subject      string
 	body         string
 	templateData map[string]string
+
+	// text is the plain text alternative of body, empty if the html template has no plain text template
+	text string
+
+	// uuid is the user whose notification preferences apply, only account emails may leave it empty
+	uuid string
 }
 
 const (
 	// MIME (Multipurpose Internet Mail Extension), extends the format of email
 	mime                = "MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
 	subjectVerifyEmail  = "Verify email for Humpback Whale Social Call"
-	subjectUpdateEmail  = "Verify Request to Update Email"
 	templateVerifyEmail = "verify_new_user_email.html"
-	templateUpdateEmail = "verify_email_update.html"
 	maxEmailLength      = 320
 
+	// emailDomainLookupTimeout bounds how long a request waits on DNS, slower lookups are let through
+	emailDomainLookupTimeout = 3 * time.Second
+
+	subjectConfirmEmailChange  = "Confirm Your New Email for Humpback Whale Social Call"
+	templateConfirmEmailChange = "confirm_email_change.html"
+
+	subjectParentalConsent  = "Parental Consent Request for Humpback Whale Social Call"
+	templateParentalConsent = "verify_parental_consent.html"
+
+	subjectSecurityAlert       = "New Sign In to Humpback Whale Social Call"
+	templateSecurityAlert      = "security_alert_new_country.html"
+	subjectVerifyLoginCountry  = "Confirm Sign In to Humpback Whale Social Call"
+	templateVerifyLoginCountry = "verify_login_country.html"
+
+	subjectPasswordExpiry  = "Your Humpback Whale Social Call Password Expires Soon"
+	templatePasswordExpiry = "password_expiry_reminder.html"
+
+	subjectPasswordReset  = "Reset Your Humpback Whale Social Call Password"
+	templatePasswordReset = "reset_password.html"
+
 	verificationLinkKey = "VERIFICATION_LINK"
+	firstNameKey        = "FIRST_NAME"
+	childNameKey        = "CHILD_NAME"
+	countryKey          = "COUNTRY"
+	loginTimeKey        = "LOGIN_TIME"
+	expirationDateKey   = "EXPIRATION_DATE"
 )
 
+// emailDomainLookup resolves the records checkEmailDomain needs, a *net.Resolver
+type emailDomainLookup interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
 var (
-	templateDirectory string
+	// templateFiles holds the email templates, embedded unless conf.EmailTemplates overrides their directory
+	templateFiles fs.FS = tmpl.Files
+
+	// emailTemplates are the templates of templateFiles by html file name, parsed once at startup
+	emailTemplates map[string]*template.Template
 
-	// tests empty string, @ symbol in between, at least 3 chars
-	emailRegex = regexp.MustCompile(`.+@.+`)
+	// emailDomainResolver is nil unless hosts_validation_verifyemaildomains is on
+	emailDomainResolver emailDomainLookup
+
+	// gmailDomains deliver to the same inbox whatever dots the local part has
+	gmailDomains = map[string]bool{
+		"gmail.com":      true,
+		"googlemail.com": true,
+	}
 )
 
 func init() {
-	// set template directory
-	pwd, _ := os.Getwd()
-	templateDirectory = pwd + "/tmpl"
+	if directory := conf.EmailTemplates.Directory; directory != "" {
+		templateFiles = os.DirFS(directory)
+		logger.Info(consts.UserServiceTag, "Reading email templates from", directory)
+	}
+
+	var err error
+	emailTemplates, err = parseEmailTemplates(templateFiles)
+	if err != nil {
+		reportStartupProblem("Failed to parse email templates:", err.Error())
+	}
 }
 
 // newEmailRequest creates a new emailRequest object, initialized to the parameters passed in
@@ -69,52 +125,64 @@ func newEmailRequest(data map[string]string, to []string, from string, subject s
 	}, nil
 }
 
-// getAllTemplatePaths walks through the specified directory that holds email templates
-// and stores each template path in a slice of strings
-// param htmlTemplate is the main html file that references these template files ending in .tmpl
-// Returns slice of strings holding all templates
-
-// order matters for future parsing of these files
-// the first element in slice must be the html file path that references these .tmpl files
-func (r *emailRequest) getAllTemplatePaths(htmlTemplate string) ([]string, error) {
-	if htmlTemplate == "" {
-		return nil, consts.ErrEmailMainTemplateNotProvided
-	}
-
-	// grab all files in directory
-	files, err := ioutil.ReadDir(templateDirectory)
+// parseEmailTemplates parses every html template of fsys with the .tmpl partials of fsys, and every .txt plain
+// text template of fsys on its own.
+// Returns the parsed templates by html file name, or error if fsys could not be read or a template fails to parse
+func parseEmailTemplates(fsys fs.FS) (map[string]*template.Template, error) {
+	files, err := fs.ReadDir(fsys, ".")
 	if err != nil {
 		return nil, err
 	}
 
-	// put files into a string slice
-	var allFilePaths []string
-	allFilePaths = append(allFilePaths, fmt.Sprintf("%s/%s", templateDirectory, htmlTemplate))
+	var partials []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".tmpl") {
+			partials = append(partials, file.Name())
+		}
+	}
 
+	templates := make(map[string]*template.Template)
 	for _, file := range files {
-		filename := file.Name()
-		if strings.HasSuffix(filename, ".tmpl") {
-			allFilePaths = append(allFilePaths, fmt.Sprintf("%s/%s", templateDirectory, filename))
+		var parsed *template.Template
+		switch {
+		case strings.HasSuffix(file.Name(), ".html"):
+			// the html file is named first so it is the template executed
+			parsed, err = template.ParseFS(fsys, append([]string{file.Name()}, partials...)...)
+		case strings.HasSuffix(file.Name(), ".txt"):
+			parsed, err = template.ParseFS(fsys, file.Name())
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
 		}
+		templates[file.Name()] = parsed
 	}
 
-	return allFilePaths, nil
+	return templates, nil
 }
 
-// parseTemplates reads through the files in the slice and generates a new template.
-// This template represents the complete template where any .tmpl files referenced in html file
-// are interpolated. Afterwards, this parsed template is executed where any variables referenced
-// in this template is also interpolated. Finally, this template itself is read and outputted to a buffer
-// and this buffer is then converted to a string and stored in property "body" of emailRequest object.
-// Returns error if filePaths are nil or any errors generated when parsing/executing
-func (r *emailRequest) parseTemplates(filePaths []string) error {
-	if filePaths == nil {
-		return consts.ErrEmailNilFilePaths
+// getTemplate looks up the parsed html template htmlTemplate, with the .tmpl files it references
+// Returns error if htmlTemplate is empty or not one of emailTemplates
+func (r *emailRequest) getTemplate(htmlTemplate string) (*template.Template, error) {
+	if htmlTemplate == "" {
+		return nil, consts.ErrEmailMainTemplateNotProvided
 	}
 
-	parsedTemplate, err := template.ParseFiles(filePaths...)
-	if err != nil {
-		return err
+	parsed, ok := emailTemplates[htmlTemplate]
+	if !ok {
+		return nil, consts.ErrEmailTemplateNotFound
+	}
+
+	return parsed, nil
+}
+
+// parseTemplates executes the parsed template, interpolating any variables referenced in it with
+// templateData. The output is stored in property "body" of emailRequest object.
+// Returns error if parsedTemplate is nil or any errors generated when executing
+func (r *emailRequest) parseTemplates(parsedTemplate *template.Template) error {
+	if parsedTemplate == nil {
+		return consts.ErrEmailNilTemplate
 	}
 
 	buffer := &bytes.Buffer{}
@@ -126,63 +194,205 @@ func (r *emailRequest) parseTemplates(filePaths []string) error {
 	return nil
 }
 
-// processEmail preps all necessary email information and sends emails to all recipients
-// Returns error if failed to send emails or failed to authenticate
-
-// var "msg" contains the RFC 822-style email with headers (From, To, Subject, MIME)
-func (r *emailRequest) processEmail() error {
-	for _, recipient := range r.to {
-		msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n%s\r\n%s",
-			r.from, recipient, r.subject, mime, r.body)
-		addr := fmt.Sprintf("%s:%s", conf.EmailHost.Host, conf.EmailHost.Port)
-
-		auth := smtp.PlainAuth("", conf.EmailHost.Username, conf.EmailHost.Password, conf.EmailHost.Host)
-		err := smtp.SendMail(
-			addr,
-			auth,
-			r.from,
-			[]string{recipient},
-			[]byte(msg))
+// parseTextTemplate executes the plain text template of htmlTemplate like parseTemplates, storing the output
+// in property "text" of emailRequest object. Nothing is done if htmlTemplate has no plain text template.
+// Returns error if executing fails
+func (r *emailRequest) parseTextTemplate(htmlTemplate string) error {
+	parsed, ok := emailTemplates[textTemplateName(htmlTemplate)]
+	if !ok {
+		return nil
+	}
 
-		if err != nil {
-			return err
-		}
+	buffer := &bytes.Buffer{}
+	if err := parsed.Execute(buffer, r.templateData); err != nil {
+		return err
 	}
+
+	r.text = buffer.String()
 	return nil
 }
 
+// textTemplateName returns the name of the plain text template of htmlTemplate, "x.html" has "x.txt"
+func textTemplateName(htmlTemplate string) string {
+	return strings.TrimSuffix(htmlTemplate, ".html") + ".txt"
+}
+
+// htmlTemplateName returns the name of the html template of textTemplate, "x.txt" belongs to "x.html"
+func htmlTemplateName(textTemplate string) string {
+	return strings.TrimSuffix(textTemplate, ".txt") + ".html"
+}
+
+// processEmail sends the rendered email to all recipients with emailDelivery, each recipient gets
+// a message of its own. Emails with a plain text alternative are sent as multipart/alternative messages.
+// Returns error if failed to send emails or failed to authenticate
+func (r *emailRequest) processEmail(ctx context.Context) error {
+	return emailDelivery.send(ctx, r.from, r.to, r.subject, r.body, r.text)
+}
+
 // sendEmail is the master function that calls upon sub functions that actually sends the email
-// First, template paths need to be grabbed from template directory
-// Second, these templates then have to be parsed and interpolated
-// Then, with all these information, email is processed and sent
-// Returns error if there are any errors returned from the sub functions or if htmlTemplate is empty
-func (r *emailRequest) sendEmail(htmlTemplate string) error {
+// First, the template parsed at startup is looked up
+// Second, this template and its plain text template, if any, then have to be interpolated
+// Then, with all these information, email is queued and sent by the email queue workers
+// Nothing is sent if ctx is done by the time the templates are ready
+// Nothing is sent, without error, if the user switched off the category of htmlTemplate, see templateCategories
+// Every send attempt is recorded in user_svc.email_deliveries
+// Returns error if there are any errors returned from the sub functions, if htmlTemplate is empty,
+// or if the email could not be queued. Failures to send are retried, see email_queue.go
+func (r *emailRequest) sendEmail(ctx context.Context, htmlTemplate string) error {
 	if htmlTemplate == "" {
 		return consts.ErrEmailMainTemplateNotProvided
 	}
 
-	filePaths, err := r.getAllTemplatePaths(htmlTemplate)
+	parsedTemplate, err := r.getTemplate(htmlTemplate)
 	if err != nil {
 		return err
 	}
 
-	if err := r.parseTemplates(filePaths); err != nil {
+	if err := r.parseTemplates(parsedTemplate); err != nil {
 		return err
 	}
 
-	if err := r.processEmail(); err != nil {
+	if err := r.parseTextTemplate(htmlTemplate); err != nil {
 		return err
 	}
 
-	return nil
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	category, ok := templateCategories[htmlTemplate]
+	if !ok {
+		category = emailCategoryAccount
+	}
+	allowed, err := emailAllowed(ctx, r.uuid, category)
+	if err != nil {
+		logger.Error(consts.NotificationTag, consts.MsgErrNotificationPreferences, err.Error())
+		return err
+	}
+	if !allowed {
+		logger.Info(consts.NotificationTag, "Skipped", category, "email, switched off by", r.uuid)
+		return nil
+	}
+
+	return queueEmail(ctx, r, htmlTemplate)
+}
+
+// normalizeEmail trims spaces and lowercases email.
+// If plus tag stripping is switched on, "+tag" is also removed from the local part, and if gmail dot folding is
+// switched on, dots are removed from the local part of gmail addresses, gmail ignores both.
+// Emails without "@" are only trimmed and lowercased, validateEmail rejects them.
+func normalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+
+	local, domain := email[:at], email[at+1:]
+	if stripEmailPlusTags {
+		if plus := strings.Index(local, "+"); plus > 0 {
+			local = local[:plus]
+		}
+	}
+	if foldGmailDots && gmailDomains[domain] {
+		if folded := strings.Replace(local, ".", "", -1); folded != "" {
+			local = folded
+		}
+	}
+
+	return local + "@" + domain
 }
 
-// validateEmail checks for very basic valid email format and string length
-// Returns error if checks fail
+// validateEmail checks email is a single RFC 5322 address without a display name or angle brackets,
+// and not longer than maxEmailLength.
+// Returns ErrInvalidUserEmail if checks fail.
 func validateEmail(email string) error {
-	if len(email) > maxEmailLength || !emailRegex.MatchString(email) {
+	if len(email) > maxEmailLength || strings.HasSuffix(email, ">") {
+		return consts.ErrInvalidUserEmail
+	}
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" {
 		return consts.ErrInvalidUserEmail
 	}
 
 	return nil
 }
+
+// checkEmailDomain looks up the MX records of the domain of email if hosts_validation_verifyemaildomains is on,
+// domains without any fall back to their address records as SMTP does. Lookups failing for another reason than
+// the domain having no records are logged with tag and let through, a DNS outage does not stop signups.
+// Returns ErrUndeliverableEmailDomain if the domain has no records or a null MX, RFC 7505.
+func checkEmailDomain(ctx context.Context, tag string, email string) error {
+	resolver := emailDomainResolver
+	if resolver == nil {
+		return nil
+	}
+
+	// address literals such as "[192.0.2.1]" name no domain to look up
+	domain := email[strings.LastIndex(email, "@")+1:]
+	if strings.HasPrefix(domain, "[") {
+		return nil
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, emailDomainLookupTimeout)
+	defer cancel()
+
+	records, err := resolver.LookupMX(lookupCtx, domain)
+	if err == nil && len(records) == 1 && strings.TrimSuffix(records[0].Host, ".") == "" {
+		return consts.ErrUndeliverableEmailDomain
+	}
+	if err == nil && len(records) != 0 {
+		return nil
+	}
+	if err != nil && !isDomainNotFound(err) {
+		logger.Error(tag, consts.MsgErrLookupEmailDomain, err.Error())
+		return nil
+	}
+
+	if _, err := resolver.LookupHost(lookupCtx, domain); err != nil {
+		if isDomainNotFound(err) {
+			return consts.ErrUndeliverableEmailDomain
+		}
+		logger.Error(tag, consts.MsgErrLookupEmailDomain, err.Error())
+	}
+
+	return nil
+}
+
+// isDomainNotFound returns true if err is the answer of a DNS server that the name has no such records.
+func isDomainNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// sendVerificationEmail emails user the link verifying its email with token, failures are logged with tag.
+// The token is already stored, the email can be sent again with ResendVerificationEmail.
+// Returns the error logged, callers that already succeeded may ignore it.
+func sendVerificationEmail(ctx context.Context, tag string, user *pblib.User, token string) error {
+	// generate verification link for emails
+	verificationLink, err := generateEmailVerifyLink(token)
+	if err != nil {
+		logger.Error(tag, consts.MsgErrGeneratingEmailVerifyLink, err.Error())
+		return err
+	}
+
+	emailData := map[string]string{
+		verificationLinkKey: verificationLink,
+		firstNameKey:        user.GetFirstName(),
+	}
+	emailReq, err := newEmailRequest(emailData, []string{user.GetEmail()}, conf.EmailHost.Username, subjectVerifyEmail)
+	if err != nil {
+		logger.Error(tag, consts.MsgErrEmailRequest, err.Error())
+		return err
+	}
+	emailReq.uuid = user.GetUuid()
+
+	if err := emailReq.sendEmail(ctx, templateVerifyEmail); err != nil {
+		logger.Error(tag, consts.MsgErrSendEmail, err.Error())
+		return err
+	}
+
+	return nil
+}
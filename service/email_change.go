@@ -0,0 +1,42 @@
+package service
+
+import (
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// requestEmailChange emails newEmail a link to confirm it as the email of user, the link of any previous change
+// stops working. The link expires with the reservation of newEmail, see prospectiveEmailHold.
+// Returns error if the token could not be generated or stored, or the email could not be sent.
+func requestEmailChange(ctx context.Context, user *pblib.User, newEmail string) error {
+	changeID, err := auth.GenerateEmailIdentification(user.GetUuid(), user.GetPermissionLevel())
+	if err != nil {
+		return err
+	}
+
+	expires := time.Unix(changeID.GetSecret().GetCreatedTimestamp(), 0).Add(prospectiveEmailHold)
+	if err := insertEmailChangeToken(ctx, user.GetUuid(), newEmail, changeID.GetToken(), changeID.GetSecret(),
+		expires); err != nil {
+		return err
+	}
+
+	changeLink, err := generateEmailChangeLink(changeID.GetToken())
+	if err != nil {
+		return err
+	}
+
+	emailData := map[string]string{
+		verificationLinkKey: changeLink,
+	}
+	emailReq, err := newEmailRequest(emailData, []string{newEmail}, conf.EmailHost.Username,
+		subjectConfirmEmailChange)
+	if err != nil {
+		return err
+	}
+	emailReq.uuid = user.GetUuid()
+
+	return emailReq.sendEmail(ctx, templateConfirmEmailChange)
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Emails are not sent by the requests that trigger them, sendEmail queues them in user_svc.email_outbox and
+// workers started by StartEmailQueue send them, so a slow or failing smtp server does not fail requests.
+// A failed email is retried with exponential backoff, after emailMaxAttempts failures it is dead-lettered:
+// logged, and kept in the outbox with its dead_timestamp set.
+
+// outboxEmail is a rendered email of user_svc.email_outbox
+type outboxEmail struct {
+	id       int64
+	from     string
+	to       []string
+	subject  string
+	body     string
+	text     string
+	template string
+	attempts int
+}
+
+const (
+	defaultEmailWorkers     = 2
+	defaultEmailMaxAttempts = 5
+	defaultEmailBackoff     = 30 * time.Second
+
+	// maxEmailBackoff caps the wait between two attempts
+	maxEmailBackoff = 6 * time.Hour
+
+	// emailQueuePollInterval is how often idle workers look for emails due for a retry
+	emailQueuePollInterval = 10 * time.Second
+
+	// emailSendLease is how long a claimed email is left to its worker, it is retried afterwards
+	// if the worker never reported back, e.g. because the instance stopped
+	emailSendLease = 5 * time.Minute
+)
+
+var (
+	emailWorkers     = defaultEmailWorkers
+	emailMaxAttempts = defaultEmailMaxAttempts
+	emailBackoff     = defaultEmailBackoff
+
+	// emailQueueWake wakes an idle worker when an email is queued
+	emailQueueWake = make(chan struct{}, 1)
+)
+
+func init() {
+	if value := conf.EmailQueue.Workers; value != "" {
+		workers, err := strconv.Atoi(value)
+		if err != nil || workers <= 0 {
+			reportStartupProblem("Invalid email queue workers:", value)
+		} else {
+			emailWorkers = workers
+		}
+	}
+
+	if value := conf.EmailQueue.MaxAttempts; value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts <= 0 {
+			reportStartupProblem("Invalid email queue max attempts:", value)
+		} else {
+			emailMaxAttempts = attempts
+		}
+	}
+
+	if value := conf.EmailQueue.Backoff; value != "" {
+		backoff, err := time.ParseDuration(value)
+		if err != nil || backoff <= 0 {
+			reportStartupProblem("Invalid email queue backoff:", value)
+		} else {
+			emailBackoff = backoff
+		}
+	}
+}
+
+// StartEmailQueue starts the workers sending the emails of user_svc.email_outbox, including those queued
+// before the service started. A standby instance queues no emails and sends none.
+func StartEmailQueue() {
+	if isStandby {
+		return
+	}
+
+	for i := 0; i < emailWorkers; i++ {
+		go runEmailWorker()
+	}
+	logger.Info(consts.EmailQueueTag, "Sending queued emails with", strconv.Itoa(emailWorkers), "workers")
+}
+
+// queueEmail queues the rendered email of r for the workers, htmlTemplate is recorded with its deliveries.
+// Returns error if the email could not be queued.
+func queueEmail(ctx context.Context, r *emailRequest, htmlTemplate string) error {
+	if _, err := insertOutboxEmail(ctx, r, htmlTemplate, time.Now()); err != nil {
+		return err
+	}
+
+	// a worker is already awake if the channel is full
+	select {
+	case emailQueueWake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// runEmailWorker sends queued emails one at a time, it never returns.
+func runEmailWorker() {
+	for {
+		if err := refreshDBConnection(); err != nil {
+			time.Sleep(emailQueuePollInterval)
+			continue
+		}
+
+		claimed, err := deliverNextEmail(context.Background(), time.Now())
+		if err != nil {
+			logger.Error(consts.EmailQueueTag, consts.MsgErrDeliverEmail, err.Error())
+		}
+		if claimed && err == nil {
+			continue
+		}
+
+		select {
+		case <-emailQueueWake:
+		case <-time.After(emailQueuePollInterval):
+		}
+	}
+}
+
+// deliverNextEmail sends the queued email due the longest at now. A failure is retried after
+// emailRetryDelay, or dead-lettered once the email failed emailMaxAttempts times.
+// Every attempt is recorded in user_svc.email_deliveries.
+// Returns true if an email was due, error if the outbox could not be read or updated.
+func deliverNextEmail(ctx context.Context, now time.Time) (bool, error) {
+	email, err := claimOutboxEmail(ctx, now, now.Add(emailSendLease))
+	if err != nil || email == nil {
+		return false, err
+	}
+
+	sendErr := faults.failSMTP()
+	if sendErr == nil {
+		sendErr = email.request().processEmail(ctx)
+	}
+
+	// the delivery record feeds the email failure rate, it does not change the outcome of the send
+	if recordErr := insertEmailDelivery(ctx, email.template, sendErr == nil); recordErr != nil {
+		logger.Error(consts.UserServiceTag, consts.MsgErrRecordEmailDelivery, recordErr.Error())
+	}
+
+	if sendErr == nil {
+		return true, deleteOutboxEmail(ctx, email.id)
+	}
+
+	if email.attempts >= emailMaxAttempts {
+		logger.Error(consts.EmailQueueTag, consts.MsgErrEmailDeadLetter, fmt.Sprint(email.id), email.template,
+			strings.Join(email.to, ","), sendErr.Error())
+		return true, killOutboxEmail(ctx, email.id, sendErr.Error(), now)
+	}
+
+	logger.Error(consts.EmailQueueTag, consts.MsgErrSendEmail, fmt.Sprint(email.id), sendErr.Error())
+	return true, retryOutboxEmail(ctx, email.id, sendErr.Error(), now.Add(emailRetryDelay(email.attempts)))
+}
+
+// emailRetryDelay returns the wait after the failed attempt of attempts, emailBackoff doubled after every
+// further failure, up to maxEmailBackoff.
+func emailRetryDelay(attempts int) time.Duration {
+	delay := emailBackoff
+	for i := 1; i < attempts && delay < maxEmailBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxEmailBackoff {
+		return maxEmailBackoff
+	}
+
+	return delay
+}
+
+// request returns e as the emailRequest it was rendered from.
+func (e *outboxEmail) request() *emailRequest {
+	return &emailRequest{
+		from:    e.from,
+		to:      e.to,
+		subject: e.subject,
+		body:    e.body,
+		text:    e.text,
+	}
+}
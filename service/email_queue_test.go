@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEmailRetryDelay(t *testing.T) {
+	backoff := emailBackoff
+	defer func() { emailBackoff = backoff }()
+	emailBackoff = time.Minute
+
+	cases := []struct {
+		attempts int
+		expDelay time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{20, maxEmailBackoff},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expDelay, emailRetryDelay(c.attempts), c.attempts)
+	}
+}
+
+func TestDeliverNextEmail(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	maxAttempts := emailMaxAttempts
+	defer func() { emailMaxAttempts = maxAttempts }()
+	emailMaxAttempts = 2
+
+	// leave only the emails of this test in the queue
+	_, err := postgresDB.Exec(`DELETE FROM user_svc.email_outbox`)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	r, err := newEmailRequest(map[string]string{}, []string{"123"}, conf.EmailHost.Username, "HWSC Testing")
+	assert.Nil(t, err)
+	r.body = "Hello World"
+	id, err := insertOutboxEmail(context.TODO(), r, templateVerifyEmail, now)
+	assert.Nil(t, err)
+
+	desc := "test failed email is retried later"
+	claimed, err := deliverNextEmail(context.TODO(), now)
+	assert.Nil(t, err, desc)
+	assert.True(t, claimed, desc)
+	claimed, err = deliverNextEmail(context.TODO(), now)
+	assert.Nil(t, err, desc)
+	assert.False(t, claimed, desc)
+
+	desc = "test email is dead-lettered after the last attempt"
+	claimed, err = deliverNextEmail(context.TODO(), now.Add(emailRetryDelay(1)))
+	assert.Nil(t, err, desc)
+	assert.True(t, claimed, desc)
+	var dead bool
+	err = postgresDB.QueryRow(`SELECT dead_timestamp IS NOT NULL FROM user_svc.email_outbox WHERE id = $1`,
+		id).Scan(&dead)
+	assert.Nil(t, err, desc)
+	assert.True(t, dead, desc)
+	claimed, err = deliverNextEmail(context.TODO(), now.Add(maxEmailBackoff))
+	assert.Nil(t, err, desc)
+	assert.False(t, claimed, desc)
+
+	desc = "test sent email leaves the queue"
+	r.to = []string{"hwsc.test+user0@gmail.com"}
+	id, err = insertOutboxEmail(context.TODO(), r, templateVerifyEmail, now)
+	assert.Nil(t, err)
+	claimed, err = deliverNextEmail(context.TODO(), now)
+	assert.Nil(t, err, desc)
+	assert.True(t, claimed, desc)
+	var queued int
+	err = postgresDB.QueryRow(`SELECT COUNT(*) FROM user_svc.email_outbox WHERE id = $1`, id).Scan(&queued)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 0, queued, desc)
+}
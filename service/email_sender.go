@@ -0,0 +1,336 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emailSender delivers a rendered html email with its plain text alternative, if text is not empty,
+// every recipient gets a message of its own
+type emailSender interface {
+	send(ctx context.Context, from string, to []string, subject string, body string, text string) error
+}
+
+// smtpEmailSender sends over the pooled connections to conf.EmailHost
+type smtpEmailSender struct {
+	pool *smtpPool
+}
+
+// sendGridEmailSender POSTs to the SendGrid v3 mail send API
+type sendGridEmailSender struct {
+	address string
+	apiKey  string
+	client  *http.Client
+}
+
+// sesEmailSender POSTs to the AWS SES v2 outbound emails API, with requests signed by signAWSRequest
+type sesEmailSender struct {
+	address         string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+}
+
+const (
+	emailProviderSMTP     = "smtp"
+	emailProviderSendGrid = "sendgrid"
+	emailProviderSES      = "ses"
+
+	defaultSendGridAddress = "https://api.sendgrid.com/v3/mail/send"
+
+	// sesAddressFormat is the SES v2 endpoint of a region
+	sesAddressFormat = "https://email.%s.amazonaws.com/v2/email/outbound-emails"
+	sesServiceName   = "ses"
+
+	// emailAPITimeout bounds a request to an email API, the email queue retries failed emails
+	emailAPITimeout = 10 * time.Second
+
+	awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+	awsDateLayout       = "20060102T150405Z"
+)
+
+var (
+	// emailDelivery sends every email, tests replace it with a mock
+	emailDelivery emailSender = &smtpEmailSender{pool: emailPool}
+)
+
+func init() {
+	settings := conf.EmailDelivery
+	client := &http.Client{Timeout: emailAPITimeout}
+
+	switch strings.ToLower(settings.Provider) {
+	case "", emailProviderSMTP:
+		return
+	case emailProviderSendGrid:
+		if settings.APIKey == "" {
+			reportStartupProblem("SendGrid email provider requires an api key")
+			return
+		}
+		address := settings.Address
+		if address == "" {
+			address = defaultSendGridAddress
+		}
+		emailDelivery = &sendGridEmailSender{address: address, apiKey: settings.APIKey, client: client}
+	case emailProviderSES:
+		if settings.Region == "" || settings.AccessKeyID == "" || settings.SecretAccessKey == "" {
+			reportStartupProblem("SES email provider requires a region, an access key id and a secret access key")
+			return
+		}
+		address := settings.Address
+		if address == "" {
+			address = fmt.Sprintf(sesAddressFormat, settings.Region)
+		}
+		emailDelivery = &sesEmailSender{
+			address:         address,
+			region:          settings.Region,
+			accessKeyID:     settings.AccessKeyID,
+			secretAccessKey: settings.SecretAccessKey,
+			client:          client,
+		}
+	default:
+		reportStartupProblem("Invalid email provider:", settings.Provider)
+		return
+	}
+
+	logger.Info(consts.EmailQueueTag, "Sending emails with", strings.ToLower(settings.Provider))
+}
+
+// send sends all messages over one pooled connection, ctx is not used by net/smtp.
+func (s *smtpEmailSender) send(ctx context.Context, from string, to []string, subject string, body string,
+	text string) error {
+	return s.pool.sendMails(from, to, func(recipient string) []byte {
+		return buildEmailMessage(from, recipient, subject, body, text)
+	})
+}
+
+// buildEmailMessage returns the RFC 822-style email with headers (From, To, Subject, MIME) of body.
+// With a plain text alternative, the message is multipart/alternative with text first, so clients
+// pick the html part they prefer, each part quoted-printable encoded.
+func buildEmailMessage(from string, recipient string, subject string, body string, text string) []byte {
+	if text == "" {
+		return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n%s\r\n%s",
+			from, recipient, subject, mime, body))
+	}
+
+	message := &bytes.Buffer{}
+	parts := multipart.NewWriter(message)
+	fmt.Fprintf(message, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/alternative; boundary=\"%s\"\r\n\r\n", from, recipient, subject, parts.Boundary())
+
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=\"UTF-8\"", text},
+		{"text/html; charset=\"UTF-8\"", body},
+	} {
+		// writes to a bytes.Buffer do not fail
+		writer, _ := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		encoder := quotedprintable.NewWriter(writer)
+		_, _ = encoder.Write([]byte(part.content))
+		_ = encoder.Close()
+	}
+	_ = parts.Close()
+
+	return message.Bytes()
+}
+
+// send sends a personalization per recipient in a single request.
+func (s *sendGridEmailSender) send(ctx context.Context, from string, to []string, subject string,
+	body string, text string) error {
+	type address struct {
+		Email string `json:"email"`
+	}
+	type personalization struct {
+		To []address `json:"to"`
+	}
+	type content struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+
+	message := struct {
+		Personalizations []personalization `json:"personalizations"`
+		From             address           `json:"from"`
+		Subject          string            `json:"subject"`
+		Content          []content         `json:"content"`
+	}{
+		From:    address{Email: from},
+		Subject: subject,
+	}
+	// SendGrid requires text/plain to come before text/html
+	if text != "" {
+		message.Content = append(message.Content, content{Type: "text/plain", Value: text})
+	}
+	message.Content = append(message.Content, content{Type: "text/html", Value: body})
+	for _, recipient := range to {
+		message.Personalizations = append(message.Personalizations, personalization{To: []address{{Email: recipient}}})
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.address, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	return doEmailAPIRequest(ctx, s.client, req)
+}
+
+// send sends a request per recipient, the first error is returned after trying every recipient.
+func (s *sesEmailSender) send(ctx context.Context, from string, to []string, subject string, body string,
+	text string) error {
+	var firstErr error
+	for _, recipient := range to {
+		if err := s.sendOne(ctx, from, recipient, subject, body, text); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (s *sesEmailSender) sendOne(ctx context.Context, from string, recipient string, subject string,
+	body string, text string) error {
+	type content struct {
+		Data    string `json:"Data"`
+		Charset string `json:"Charset"`
+	}
+
+	bodies := map[string]content{
+		"Html": {Data: body, Charset: "UTF-8"},
+	}
+	if text != "" {
+		bodies["Text"] = content{Data: text, Charset: "UTF-8"}
+	}
+
+	message := map[string]interface{}{
+		"FromEmailAddress": from,
+		"Destination": map[string][]string{
+			"ToAddresses": {recipient},
+		},
+		"Content": map[string]interface{}{
+			"Simple": map[string]interface{}{
+				"Subject": content{Data: subject, Charset: "UTF-8"},
+				"Body":    bodies,
+			},
+		},
+	}
+
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.address, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signAWSRequest(req, payload, s.region, sesServiceName, s.accessKeyID, s.secretAccessKey, time.Now())
+
+	return doEmailAPIRequest(ctx, s.client, req)
+}
+
+// doEmailAPIRequest sends req with ctx.
+// Returns error if the request fails or the API does not answer with a 2xx status.
+func doEmailAPIRequest(ctx context.Context, client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		// the start of the body explains the rejection, e.g. an unverified sender
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s %s", consts.ErrEmailProviderFailed.Error(), resp.Status,
+			strings.TrimSpace(string(detail)))
+	}
+
+	return nil
+}
+
+// signAWSRequest adds the X-Amz-Date and Authorization headers of AWS Signature Version 4 to req, signing
+// its host, query, payload and every header already set.
+func signAWSRequest(req *http.Request, payload []byte, region string, service string, accessKeyID string,
+	secretAccessKey string, now time.Time) {
+	amzDate := now.UTC().Format(awsDateLayout)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	payloadHash := sha256.Sum256(payload)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{awsSigningAlgorithm, amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgorithm, accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	mimeheader "mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unitTestEmailSender records the emails it is asked to send
+type unitTestEmailSender struct {
+	from    string
+	to      []string
+	subject string
+	body    string
+	text    string
+}
+
+func (s *unitTestEmailSender) send(ctx context.Context, from string, to []string, subject string, body string,
+	text string) error {
+	s.from, s.to, s.subject, s.body, s.text = from, to, subject, body, text
+	return nil
+}
+
+func TestProcessEmailSender(t *testing.T) {
+	delivery := emailDelivery
+	defer func() { emailDelivery = delivery }()
+
+	sender := &unitTestEmailSender{}
+	emailDelivery = sender
+
+	r := &emailRequest{from: "from@test.com", to: []string{"a@test.com", "b@test.com"}, subject: "subject",
+		body: "<p>body</p>", text: "body"}
+	assert.Nil(t, r.processEmail(context.TODO()))
+	assert.Equal(t, r.from, sender.from)
+	assert.Equal(t, r.to, sender.to)
+	assert.Equal(t, r.subject, sender.subject)
+	assert.Equal(t, r.body, sender.body)
+	assert.Equal(t, r.text, sender.text)
+}
+
+func TestBuildEmailMessage(t *testing.T) {
+	desc := "test html only message"
+	message := buildEmailMessage("from@test.com", "to@test.com", "subject", "<p>body</p>", "")
+	parsed, err := mail.ReadMessage(bytes.NewReader(message))
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "to@test.com", parsed.Header.Get("To"), desc)
+	assert.True(t, strings.HasPrefix(parsed.Header.Get("Content-Type"), "text/html"), desc)
+
+	desc = "test multipart alternative message"
+	message = buildEmailMessage("from@test.com", "to@test.com", "subject", "<p>body é</p>", "body é")
+	parsed, err = mail.ReadMessage(bytes.NewReader(message))
+	assert.Nil(t, err, desc)
+	mediaType, params, err := mimeheader.ParseMediaType(parsed.Header.Get("Content-Type"))
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "multipart/alternative", mediaType, desc)
+
+	var contentTypes, contents []string
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			assert.Equal(t, io.EOF, err, desc)
+			break
+		}
+		// quoted-printable parts are decoded by the reader
+		content, err := ioutil.ReadAll(part)
+		assert.Nil(t, err, desc)
+		contentTypes = append(contentTypes, part.Header.Get("Content-Type"))
+		contents = append(contents, string(content))
+	}
+	assert.Equal(t, []string{`text/plain; charset="UTF-8"`, `text/html; charset="UTF-8"`}, contentTypes, desc)
+	assert.Equal(t, []string{"body é", "<p>body é</p>"}, contents, desc)
+}
+
+func TestSendGridEmailSender(t *testing.T) {
+	var received struct {
+		Subject          string
+		Personalizations []interface{}
+		Content          []struct {
+			Type string
+		}
+	}
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		payload, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(payload, &received)
+		if r.URL.Path != "/v3/mail/send" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	desc := "test accepted email"
+	sender := &sendGridEmailSender{address: server.URL + "/v3/mail/send", apiKey: "key", client: server.Client()}
+	err := sender.send(context.TODO(), "from@test.com", []string{"a@test.com", "b@test.com"}, "subject", "body",
+		"text")
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "Bearer key", authorization, desc)
+	assert.Equal(t, "subject", received.Subject, desc)
+	assert.Len(t, received.Personalizations, 2, desc)
+	if assert.Len(t, received.Content, 2, desc) {
+		assert.Equal(t, "text/plain", received.Content[0].Type, desc)
+		assert.Equal(t, "text/html", received.Content[1].Type, desc)
+	}
+
+	desc = "test refused email"
+	sender.address = server.URL + "/unknown"
+	err = sender.send(context.TODO(), "from@test.com", []string{"a@test.com"}, "subject", "body", "")
+	assert.NotNil(t, err, desc)
+	assert.True(t, strings.HasPrefix(err.Error(), consts.ErrEmailProviderFailed.Error()), desc)
+}
+
+func TestSESEmailSender(t *testing.T) {
+	var recipients, texts []string
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		payload, _ := ioutil.ReadAll(r.Body)
+		var received struct {
+			Destination struct {
+				ToAddresses []string
+			}
+			Content struct {
+				Simple struct {
+					Body struct {
+						Text struct {
+							Data string
+						}
+					}
+				}
+			}
+		}
+		_ = json.Unmarshal(payload, &received)
+		recipients = append(recipients, received.Destination.ToAddresses...)
+		texts = append(texts, received.Content.Simple.Body.Text.Data)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sender := &sesEmailSender{address: server.URL + "/v2/email/outbound-emails", region: "us-east-1",
+		accessKeyID: "AKIDEXAMPLE", secretAccessKey: "secret", client: server.Client()}
+	err := sender.send(context.TODO(), "from@test.com", []string{"a@test.com", "b@test.com"}, "subject", "body",
+		"text")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a@test.com", "b@test.com"}, recipients)
+	assert.Equal(t, []string{"text", "text"}, texts)
+	assert.True(t, strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"))
+	assert.Contains(t, authorization, "/us-east-1/ses/aws4_request")
+}
+
+func TestSignAWSRequest(t *testing.T) {
+	// get-vanilla of the AWS Signature Version 4 test suite
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	assert.Nil(t, err)
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	signAWSRequest(req, nil, "us-east-1", "service", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", now)
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, "+
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
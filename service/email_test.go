@@ -1,9 +1,15 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"github.com/hwsc-org/hwsc-user-svc/conf"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
 	"testing"
 )
 
@@ -41,40 +47,87 @@ func TestNewEmailRequest(t *testing.T) {
 	assert.Nil(t, req, desc)
 }
 
-func TestGetAllTemplatePaths(t *testing.T) {
+func TestGetTemplate(t *testing.T) {
 	r := &emailRequest{}
 
 	// empty template
-	files, err := r.getAllTemplatePaths("")
+	parsed, err := r.getTemplate("")
 	assert.EqualError(t, err, consts.ErrEmailMainTemplateNotProvided.Error())
-	assert.Nil(t, files)
+	assert.Nil(t, parsed)
+
+	// unknown template
+	parsed, err = r.getTemplate("wrong_file_name")
+	assert.EqualError(t, err, consts.ErrEmailTemplateNotFound.Error())
+	assert.Nil(t, parsed)
+
+	// embedded template
+	parsed, err = r.getTemplate(templateVerifyEmail)
+	assert.Nil(t, err)
+	assert.NotNil(t, parsed)
 }
 
 func TestParseTemplates(t *testing.T) {
-	r := &emailRequest{}
+	r := &emailRequest{templateData: map[string]string{verificationLinkKey: "https://hwsc.com/verify"}}
 
 	// test nil
 	err := r.parseTemplates(nil)
-	assert.EqualError(t, err, consts.ErrEmailNilFilePaths.Error())
+	assert.EqualError(t, err, consts.ErrEmailNilTemplate.Error())
 
-	// wrong file path
-	files, err := r.getAllTemplatePaths("wrong_file_name")
+	// embedded template
+	parsed, err := r.getTemplate(templateVerifyEmail)
 	assert.Nil(t, err)
-	assert.NotNil(t, files)
-
-	err = r.parseTemplates(files)
-	assert.EqualError(t, err, "open ../tmpl/wrong_file_name: no such file or directory")
 
-	// correct file path
-	files, err = r.getAllTemplatePaths(templateVerifyEmail)
+	err = r.parseTemplates(parsed)
 	assert.Nil(t, err)
-	assert.NotNil(t, files)
+	assert.Contains(t, r.body, "https://hwsc.com/verify")
+}
 
-	err = r.parseTemplates(files)
+func TestParseTextTemplate(t *testing.T) {
+	r := &emailRequest{templateData: map[string]string{
+		verificationLinkKey: "https://hwsc.com/verify",
+		firstNameKey:        "Lisa",
+	}}
+
+	desc := "test template without plain text alternative"
+	assert.Nil(t, r.parseTextTemplate(templatePasswordReset), desc)
+	assert.Empty(t, r.text, desc)
+
+	desc = "test embedded plain text template"
+	assert.Nil(t, r.parseTextTemplate(templateVerifyEmail), desc)
+	assert.Contains(t, r.text, "Welcome to HWSC, Lisa!", desc)
+	assert.Contains(t, r.text, "https://hwsc.com/verify", desc)
+}
+
+func TestParseEmailTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
 	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	desc := "test override directory"
+	assert.Nil(t, ioutil.WriteFile(fmt.Sprintf("%s/header.tmpl", dir), []byte(`{{ define "header" }}<html>{{ end }}`), 0600))
+	assert.Nil(t, ioutil.WriteFile(fmt.Sprintf("%s/%s", dir, templatePasswordReset),
+		[]byte(`{{ template "header" }}{{.VERIFICATION_LINK}}`), 0600))
+	templates, err := parseEmailTemplates(os.DirFS(dir))
+	assert.Nil(t, err, desc)
+	assert.Len(t, templates, 1, desc)
+
+	buffer := &bytes.Buffer{}
+	assert.Nil(t, templates[templatePasswordReset].Execute(buffer, map[string]string{verificationLinkKey: "link"}), desc)
+	assert.Equal(t, "<html>link", buffer.String(), desc)
+
+	desc = "test invalid template"
+	assert.Nil(t, ioutil.WriteFile(fmt.Sprintf("%s/%s", dir, templateVerifyEmail), []byte(`{{ .VERIFICATION_LINK`), 0600))
+	_, err = parseEmailTemplates(os.DirFS(dir))
+	assert.NotNil(t, err, desc)
+
+	desc = "test missing directory"
+	_, err = parseEmailTemplates(os.DirFS(fmt.Sprintf("%s/missing", dir)))
+	assert.NotNil(t, err, desc)
 }
 
 func TestProcessEmail(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	validEmails := []string{
 		"hwsc.test+user1@gmail.com",
 		"hwsc.test+user2@gmail.com",
@@ -104,7 +157,7 @@ func TestProcessEmail(t *testing.T) {
 		assert.NotNil(t, r)
 		r.body = "Hello World"
 
-		err = r.processEmail()
+		err = r.processEmail(context.TODO())
 		if c.isExpErr {
 			// gsmtp errors give errors with varying unpredictable id keys
 			// ex1: "555 5.5.2 Syntax error. l85sm91728408pfg.161 - gsmtp"
@@ -118,6 +171,8 @@ func TestProcessEmail(t *testing.T) {
 }
 
 func TestSendEmail(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	testData := map[string]string{verificationLinkKey: "Unit Testing sendEmail"}
 	email := []string{"hwsc.test+user0@gmail.com"}
 	r, err := newEmailRequest(testData, email, conf.EmailHost.Username, "HWSC Testing")
@@ -125,22 +180,55 @@ func TestSendEmail(t *testing.T) {
 	assert.NotNil(t, r)
 
 	// valid
-	err = r.sendEmail(templateVerifyEmail)
+	err = r.sendEmail(context.TODO(), templateVerifyEmail)
 	assert.Nil(t, err)
 
 	// invalid - empty file
-	err = r.sendEmail("")
+	err = r.sendEmail(context.TODO(), "")
 	assert.EqualError(t, err, consts.ErrEmailMainTemplateNotProvided.Error())
 
 	// invalid - wrong file name
-	err = r.sendEmail("wrong_file")
+	err = r.sendEmail(context.TODO(), "wrong_file")
 	assert.EqualError(t, err, "open ../tmpl/wrong_file: no such file or directory")
 
-	// invalid - wrong email
+	// invalid - canceled context, nothing is sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = r.sendEmail(ctx, templateVerifyEmail)
+	assert.EqualError(t, err, context.Canceled.Error())
+
+	// wrong email - queued, the failure is left to the email queue
 	r.to = []string{"123"}
-	err = r.sendEmail(templateVerifyEmail)
-	// gsmtp errs includes varying id keys with its msg, cannot test for equalError
-	assert.NotNil(t, err)
+	err = r.sendEmail(context.TODO(), templateVerifyEmail)
+	assert.Nil(t, err)
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	cases := []struct {
+		desc          string
+		email         string
+		stripPlusTags bool
+		foldGmailDots bool
+		expEmail      string
+	}{
+		{"test spaces are trimmed", "  hwsc.test@gmail.com ", false, false, "hwsc.test@gmail.com"},
+		{"test email is lowercased", "Hwsc.Test@GMail.COM", false, false, "hwsc.test@gmail.com"},
+		{"test plus tag is kept", "hwsc.test+user1@gmail.com", false, false, "hwsc.test+user1@gmail.com"},
+		{"test plus tag is stripped", "hwsc.test+user1@gmail.com", true, false, "hwsc.test@gmail.com"},
+		{"test leading plus is kept", "+user1@gmail.com", true, false, "+user1@gmail.com"},
+		{"test gmail dots are folded", "Hwsc.Test@GoogleMail.com", false, true, "hwsctest@googlemail.com"},
+		{"test gmail dots and plus tag are folded", "h.w.s.c+user1@gmail.com", true, true, "hwsc@gmail.com"},
+		{"test dots of other domains are kept", "hwsc.test@outlook.com", false, true, "hwsc.test@outlook.com"},
+		{"test local part of only dots is kept", "..@gmail.com", false, true, "..@gmail.com"},
+		{"test last at splits domain", "\"a@b\"@Gmail.com", false, false, "\"a@b\"@gmail.com"},
+		{"test missing at", " HWSC ", false, false, "hwsc"},
+	}
+
+	for _, c := range cases {
+		stripEmailPlusTags, foldGmailDots = c.stripPlusTags, c.foldGmailDots
+		assert.Equal(t, c.expEmail, normalizeEmail(c.email), c.desc)
+	}
+	stripEmailPlusTags, foldGmailDots = false, false
 }
 
 func TestValidateEmail(t *testing.T) {
@@ -166,13 +254,21 @@ func TestValidateEmail(t *testing.T) {
 		{"a@", true, consts.ErrInvalidUserEmail.Error()},
 		{"@a", true, consts.ErrInvalidUserEmail.Error()},
 		{exceedMaxLengthEmail, true, consts.ErrInvalidUserEmail.Error()},
-		{"@@@", false, ""},
-		{"!@@", false, ""},
-		{"@@#", false, ""},
+		{"@@@", true, consts.ErrInvalidUserEmail.Error()},
+		{"!@@", true, consts.ErrInvalidUserEmail.Error()},
+		{"@@#", true, consts.ErrInvalidUserEmail.Error()},
+		{"a..b@outlook.com", true, consts.ErrInvalidUserEmail.Error()},
+		{"lisa keem@outlook.com", true, consts.ErrInvalidUserEmail.Error()},
+		{"Lisa <lisakeem@outlook.com>", true, consts.ErrInvalidUserEmail.Error()},
+		{"<lisakeem@outlook.com>", true, consts.ErrInvalidUserEmail.Error()},
+		{"lisakeem@outlook.com (Lisa)", true, consts.ErrInvalidUserEmail.Error()},
+		{"a@b.com, c@d.com", true, consts.ErrInvalidUserEmail.Error()},
 		{"lisakeem@outlook.com", false, ""},
+		{"lisa.keem+hwsc@outlook.com", false, ""},
+		{"\"lisa@keem\"@outlook.com", false, ""},
+		{"lisakeem@[192.0.2.1]", false, ""},
 	}
 
-	// TODO test for non-existing emails
 	for _, c := range cases {
 		err := validateEmail(c.email)
 
@@ -183,3 +279,64 @@ func TestValidateEmail(t *testing.T) {
 		}
 	}
 }
+
+// unitTestResolver answers lookups from its maps, names without an entry are not found
+type unitTestResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	err   error
+}
+
+func (r *unitTestResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if records, ok := r.mx[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *unitTestResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestCheckEmailDomain(t *testing.T) {
+	defer func() { emailDomainResolver = nil }()
+
+	desc := "test domains are not looked up when switched off"
+	emailDomainResolver = nil
+	assert.Nil(t, checkEmailDomain(context.TODO(), consts.UserServiceTag, "lisakeem@nowhere.invalid"), desc)
+
+	emailDomainResolver = &unitTestResolver{
+		mx: map[string][]*net.MX{
+			"outlook.com": {{Host: "outlook-com.olc.protection.outlook.com.", Pref: 5}},
+			"nomail.com":  {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{"example.com": {"192.0.2.1"}},
+	}
+	cases := []struct {
+		desc   string
+		email  string
+		expErr error
+	}{
+		{"test domain with mx records", "lisakeem@outlook.com", nil},
+		{"test domain without mx falls back to its address", "lisakeem@example.com", nil},
+		{"test domain with null mx", "lisakeem@nomail.com", consts.ErrUndeliverableEmailDomain},
+		{"test unknown domain", "lisakeem@nowhere.invalid", consts.ErrUndeliverableEmailDomain},
+		{"test address literal is not looked up", "lisakeem@[192.0.2.1]", nil},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expErr, checkEmailDomain(context.TODO(), consts.UserServiceTag, c.email), c.desc)
+	}
+
+	desc = "test failed lookup lets the email through"
+	emailDomainResolver = &unitTestResolver{err: &net.DNSError{Err: "i/o timeout", Name: "outlook.com", IsTimeout: true}}
+	assert.Nil(t, checkEmailDomain(context.TODO(), consts.UserServiceTag, "lisakeem@outlook.com"), desc)
+}
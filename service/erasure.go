@@ -0,0 +1,26 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	// forgottenFirstName and forgottenLastName replace the names of forgotten users, the columns cannot be empty
+	forgottenFirstName = "Forgotten"
+	forgottenLastName  = "User"
+
+	// forgottenEmailDomain follows the uuid in the email of forgotten users, keeping emails unique
+	// without being deliverable
+	forgottenEmailDomain = "@forgotten.invalid"
+)
+
+// erasureHash returns the hex sha-256 of the erasure of uuid by actor at erased, chained to previous, the hash of
+// the erasure before it or empty for the first. The chain is checked by recomputing the hash of every entry of
+// user_svc.erasures in sequence order, erased is hashed at the microsecond precision postgres stores.
+func erasureHash(previous string, uuid string, actor string, erased time.Time) string {
+	sum := sha256.Sum256([]byte(previous + "\x00" + uuid + "\x00" + actor + "\x00" +
+		erased.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano)))
+	return hex.EncodeToString(sum[:])
+}
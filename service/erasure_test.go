@@ -0,0 +1,29 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestErasureHash(t *testing.T) {
+	erased := time.Date(2026, 10, 15, 8, 0, 0, 123456789, time.UTC)
+	hash := erasureHash("", "01d3x3wm2nnrdxwpvy0eb6mhtk", "01d3x3wm2nnrdxwpvy0eb6mhtm", erased)
+
+	desc := "test hash is hex sha-256"
+	assert.Len(t, hash, 64, desc)
+
+	desc = "test hash ignores precision postgres does not store"
+	assert.Equal(t, hash, erasureHash("", "01d3x3wm2nnrdxwpvy0eb6mhtk", "01d3x3wm2nnrdxwpvy0eb6mhtm",
+		erased.Truncate(time.Microsecond).In(time.FixedZone("NZDT", 13*60*60))), desc)
+
+	desc = "test hash covers every field"
+	for _, other := range []string{
+		erasureHash(hash, "01d3x3wm2nnrdxwpvy0eb6mhtk", "01d3x3wm2nnrdxwpvy0eb6mhtm", erased),
+		erasureHash("", "01d3x3wm2nnrdxwpvy0eb6mhtn", "01d3x3wm2nnrdxwpvy0eb6mhtm", erased),
+		erasureHash("", "01d3x3wm2nnrdxwpvy0eb6mhtk", "", erased),
+		erasureHash("", "01d3x3wm2nnrdxwpvy0eb6mhtk", "01d3x3wm2nnrdxwpvy0eb6mhtm", erased.Add(time.Microsecond)),
+	} {
+		assert.NotEqual(t, hash, other, desc)
+	}
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// errorCodes maps errors returned by the data and validation layers to grpc codes
+var errorCodes = map[error]codes.Code{
+	consts.ErrNilRequestUser:              codes.InvalidArgument,
+	consts.ErrEmptyRequestUser:            codes.InvalidArgument,
+	consts.ErrInvalidUserFirstName:        codes.InvalidArgument,
+	consts.ErrInvalidUserLastName:         codes.InvalidArgument,
+	consts.ErrInvalidUserMiddleName:       codes.InvalidArgument,
+	consts.ErrInvalidUserDisplayName:      codes.InvalidArgument,
+	consts.ErrInvalidUserEmail:            codes.InvalidArgument,
+	consts.ErrUndeliverableEmailDomain:    codes.InvalidArgument,
+	consts.ErrInvalidPassword:             codes.InvalidArgument,
+	consts.ErrPasswordTooLong:             codes.InvalidArgument,
+	consts.ErrPasswordTooShort:            codes.InvalidArgument,
+	consts.ErrPasswordMissingLower:        codes.InvalidArgument,
+	consts.ErrPasswordMissingUpper:        codes.InvalidArgument,
+	consts.ErrPasswordMissingDigit:        codes.InvalidArgument,
+	consts.ErrPasswordMissingSymbol:       codes.InvalidArgument,
+	consts.ErrPasswordCommon:              codes.InvalidArgument,
+	consts.ErrPasswordTooWeak:             codes.InvalidArgument,
+	consts.ErrInvalidClearField:           codes.InvalidArgument,
+	consts.ErrConflictingClearField:       codes.InvalidArgument,
+	consts.ErrInvalidUserOrganization:     codes.InvalidArgument,
+	consts.ErrOrganizationNotAllowed:      codes.InvalidArgument,
+	consts.ErrInvalidOrganizationAdmin:    codes.InvalidArgument,
+	consts.ErrInvalidDryRun:               codes.InvalidArgument,
+	consts.ErrInvalidChunkSize:            codes.InvalidArgument,
+	consts.ErrInvalidUsageReportRange:     codes.InvalidArgument,
+	consts.ErrInvalidStatsDays:            codes.InvalidArgument,
+	consts.ErrInvalidBirthdate:            codes.InvalidArgument,
+	consts.ErrInvalidParentEmail:          codes.InvalidArgument,
+	consts.ErrInvalidReferralCode:         codes.InvalidArgument,
+	consts.ErrInvalidOnboardingStep:       codes.InvalidArgument,
+	consts.ErrInvalidOnboardingCompleted:  codes.InvalidArgument,
+	consts.ErrTooManyOnboardingSteps:      codes.ResourceExhausted,
+	consts.ErrTooManyFavorites:            codes.ResourceExhausted,
+	consts.ErrDocumentQuotaExceeded:       codes.ResourceExhausted,
+	consts.ErrVerificationResendCooldown:  codes.ResourceExhausted,
+	consts.ErrRateLimited:                 codes.ResourceExhausted,
+	consts.ErrInvalidNotificationSetting:  codes.InvalidArgument,
+	consts.ErrInvalidActivityRange:        codes.InvalidArgument,
+	consts.ErrInvalidAuthMethod:           codes.InvalidArgument,
+	consts.ErrInvalidCredentialID:         codes.InvalidArgument,
+	consts.ErrInvalidAPIKeyID:             codes.InvalidArgument,
+	consts.ErrInvalidAPIKeyName:           codes.InvalidArgument,
+	consts.ErrInvalidAPIKeyScope:          codes.InvalidArgument,
+	consts.ErrInvalidDuid:                 codes.InvalidArgument,
+	consts.ErrInvalidDocumentVisibility:   codes.InvalidArgument,
+	consts.ErrInvalidSharePolicy:          codes.InvalidArgument,
+	consts.ErrInvalidPageToken:            codes.InvalidArgument,
+	consts.ErrInvalidVerifiedFilter:       codes.InvalidArgument,
+	consts.ErrInvalidCreatedDateRange:     codes.InvalidArgument,
+	consts.ErrInvalidShareRecipients:      codes.InvalidArgument,
+	authconst.ErrInvalidUUID:              codes.InvalidArgument,
+	authconst.ErrEmptyToken:               codes.InvalidArgument,
+	consts.ErrUUIDNotFound:                codes.NotFound,
+	consts.ErrUserNotFound:                codes.NotFound,
+	consts.ErrNoMatchingEmailTokenFound:   codes.NotFound,
+	consts.ErrNoMatchingParentalConsent:   codes.NotFound,
+	consts.ErrAuthMethodNotFound:          codes.NotFound,
+	consts.ErrAPIKeyNotFound:              codes.NotFound,
+	consts.ErrNoMatchingLoginCountryToken: codes.NotFound,
+	consts.ErrNoMatchingPasswordReset:     codes.NotFound,
+	consts.ErrNoMatchingEmailChange:       codes.NotFound,
+	consts.ErrDocumentNotFound:            codes.NotFound,
+	consts.ErrFavoriteNotFound:            codes.NotFound,
+	consts.ErrOrganizationNotFound:        codes.NotFound,
+	consts.ErrEmailExists:                 codes.AlreadyExists,
+	consts.ErrEmailReserved:               codes.AlreadyExists,
+	consts.ErrAuthMethodLinked:            codes.AlreadyExists,
+	consts.ErrTwoFactorEnabled:            codes.AlreadyExists,
+	consts.ErrDocumentExists:              codes.AlreadyExists,
+	consts.ErrOrganizationExists:          codes.AlreadyExists,
+	consts.ErrInvalidPermissionLevel:      codes.InvalidArgument,
+	consts.ErrSessionIdle:                 codes.Unauthenticated,
+	consts.ErrPermissionChangeDenied:      codes.PermissionDenied,
+	consts.ErrCallerNotAllowed:            codes.PermissionDenied,
+	consts.ErrNotOrganizationAdmin:        codes.PermissionDenied,
+	consts.ErrAPIKeyScopeDenied:           codes.PermissionDenied,
+	consts.ErrMissingAuthorization:        codes.Unauthenticated,
+	consts.ErrTokenIssuerMismatch:         codes.Unauthenticated,
+	consts.ErrTokenAudienceMismatch:       codes.Unauthenticated,
+	consts.ErrTokenNotYetValid:            codes.Unauthenticated,
+	consts.ErrRetiredAuthSecret:           codes.Unauthenticated,
+	consts.ErrNoMatchingRefreshToken:      codes.Unauthenticated,
+	consts.ErrExpiredRefreshToken:         codes.Unauthenticated,
+	consts.ErrTwoFactorRequired:           codes.Unauthenticated,
+	consts.ErrInvalidTwoFactorCode:        codes.Unauthenticated,
+	consts.ErrInvalidAPIKey:               codes.Unauthenticated,
+	consts.ErrNoActiveSecretKeyFound:      codes.FailedPrecondition,
+	consts.ErrEmailNotVerified:            codes.FailedPrecondition,
+	consts.ErrParentalConsentRequired:     codes.FailedPrecondition,
+	consts.ErrLastAuthMethod:              codes.FailedPrecondition,
+	consts.ErrLastSignInMethod:            codes.FailedPrecondition,
+	consts.ErrTwoFactorUnavailable:        codes.FailedPrecondition,
+	consts.ErrTwoFactorNotPending:         codes.FailedPrecondition,
+	consts.ErrTwoFactorNotEnabled:         codes.FailedPrecondition,
+	consts.ErrLoginCountryUnconfirmed:     codes.FailedPrecondition,
+	consts.ErrNotOrganizationMember:       codes.FailedPrecondition,
+	consts.ErrExpiredParentalConsentToken: codes.DeadlineExceeded,
+	consts.ErrExpiredLoginCountryToken:    codes.DeadlineExceeded,
+	consts.ErrExpiredPasswordResetToken:   codes.DeadlineExceeded,
+	consts.ErrExpiredEmailChangeToken:     codes.DeadlineExceeded,
+	context.Canceled:                      codes.Canceled,
+	context.DeadlineExceeded:              codes.DeadlineExceeded,
+}
+
+// statusFromError converts err into a grpc status error.
+// Known errors and postgres error codes get a matching code and a message that hides db internals,
+// everything else is Internal. Errors that already carry a status are returned unchanged.
+func statusFromError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	if code, ok := errorCodes[err]; ok {
+		return status.Error(code, err.Error())
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok {
+		return statusFromPostgresError(pqErr)
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+// statusFromPostgresError maps postgres error codes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+func statusFromPostgresError(err *pq.Error) error {
+	switch err.Code.Name() {
+	case "unique_violation":
+		if strings.Contains(err.Constraint, "email") {
+			return status.Error(codes.AlreadyExists, consts.ErrEmailExists.Error())
+		}
+		return status.Error(codes.AlreadyExists, consts.ErrDuplicateValue.Error())
+	case "foreign_key_violation":
+		return status.Error(codes.FailedPrecondition, consts.ErrReferencedRowMissing.Error())
+	case "not_null_violation", "check_violation", "string_data_right_truncation", "invalid_text_representation":
+		return status.Error(codes.InvalidArgument, consts.ErrInvalidValue.Error())
+	case "serialization_failure", "deadlock_detected":
+		return status.Error(codes.Aborted, consts.ErrConflictingTransaction.Error())
+	case "query_canceled":
+		return status.Error(codes.Canceled, context.Canceled.Error())
+	}
+
+	switch err.Code.Class() {
+	case "08", "53", "57":
+		// connection exception, insufficient resources, operator intervention
+		return status.Error(codes.Unavailable, consts.ErrDBConnectionError.Error())
+	}
+
+	// the pq message names tables, columns and values, it is only logged
+	logger.Error(consts.PSQL, consts.MsgErrUnmappedPostgres, string(err.Code), err.Error())
+	return status.Error(codes.Internal, consts.ErrDatabaseFailure.Error())
+}
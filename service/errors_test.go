@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestStatusFromError(t *testing.T) {
+	cases := []struct {
+		desc    string
+		err     error
+		expCode codes.Code
+		expMsg  string
+	}{
+		{"test status error is unchanged", consts.ErrStatusUUIDInvalid, codes.InvalidArgument, "invalid uuid"},
+		{"test validation error", consts.ErrInvalidUserEmail, codes.InvalidArgument, "invalid User email"},
+		{"test not found", consts.ErrUserNotFound, codes.NotFound, "user is not found in database"},
+		{"test email exists", consts.ErrEmailExists, codes.AlreadyExists, "email already exists"},
+		{"test canceled context", context.Canceled, codes.Canceled, "context canceled"},
+		{"test unique email constraint",
+			&pq.Error{Code: "23505", Constraint: "accounts_email_key", Message: "duplicate key value"},
+			codes.AlreadyExists, "email already exists"},
+		{"test unique constraint",
+			&pq.Error{Code: "23505", Constraint: "events_id_key"},
+			codes.AlreadyExists, consts.ErrDuplicateValue.Error()},
+		{"test foreign key constraint", &pq.Error{Code: "23503"},
+			codes.FailedPrecondition, consts.ErrReferencedRowMissing.Error()},
+		{"test check constraint", &pq.Error{Code: "23514"},
+			codes.InvalidArgument, consts.ErrInvalidValue.Error()},
+		{"test deadlock", &pq.Error{Code: "40P01"},
+			codes.Aborted, consts.ErrConflictingTransaction.Error()},
+		{"test connection failure", &pq.Error{Code: "08006"},
+			codes.Unavailable, consts.ErrDBConnectionError.Error()},
+		{"test unmapped postgres error", &pq.Error{Code: "42P01", Message: `relation "user_svc.accounts" does not exist`},
+			codes.Internal, consts.ErrDatabaseFailure.Error()},
+		{"test unknown error", errors.New("boom"), codes.Internal, "boom"},
+	}
+
+	for _, c := range cases {
+		s, ok := status.FromError(statusFromError(c.err))
+		assert.True(t, ok, c.desc)
+		assert.Equal(t, c.expCode, s.Code(), c.desc)
+		assert.Equal(t, c.expMsg, s.Message(), c.desc)
+	}
+
+	assert.Nil(t, statusFromError(nil))
+}
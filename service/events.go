@@ -0,0 +1,175 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"net/http"
+	"time"
+)
+
+// cloudEvent is the CloudEvents 1.0 envelope every lifecycle event is wrapped in
+// https://github.com/cloudevents/spec/blob/v1.0/spec.md
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+
+	// Sequence is an extension attribute holding the position of the event in user_svc.events
+	Sequence int64 `json:"sequence,omitempty"`
+}
+
+// userEventData is the data payload of user lifecycle events, it never contains credentials
+type userEventData struct {
+	UUID            string `json:"uuid"`
+	FirstName       string `json:"first_name,omitempty"`
+	LastName        string `json:"last_name,omitempty"`
+	Email           string `json:"email,omitempty"`
+	Organization    string `json:"organization,omitempty"`
+	PermissionLevel string `json:"permission_level,omitempty"`
+	IsVerified      bool   `json:"is_verified"`
+}
+
+const (
+	cloudEventSpecVersion = "1.0"
+	cloudEventContentType = "application/cloudevents+json"
+	cloudEventDataType    = "application/json"
+	defaultEventSource    = "/hwsc-user-svc"
+	eventPublishTimeout   = 10 * time.Second
+	eventTypeUserCreated  = "org.hwsc.user.created"
+	eventTypeUserUpdated  = "org.hwsc.user.updated"
+	eventTypeUserDeleted  = "org.hwsc.user.deleted"
+	eventTypeUserVerified = "org.hwsc.user.verified"
+	defaultReplayLimit    = 100
+	maxReplayLimit        = 1000
+)
+
+var (
+	eventSinkClient = &http.Client{Timeout: eventPublishTimeout}
+)
+
+// isEventSinkEnabled checks if an event sink is configured.
+func isEventSinkEnabled() bool {
+	return conf.EventSinkHost.Address != ""
+}
+
+// eventSource returns the configured CloudEvents source attribute, or the service default.
+func eventSource() string {
+	if conf.EventSinkHost.Source != "" {
+		return conf.EventSinkHost.Source
+	}
+	return defaultEventSource
+}
+
+// newCloudEvent wraps data in a CloudEvents envelope with a fresh ulid as id.
+// Returns error if id generation or data encoding fails.
+func newCloudEvent(eventType string, subject string, data interface{}) (*cloudEvent, error) {
+	id, err := generateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cloudEvent{
+		SpecVersion:     cloudEventSpecVersion,
+		ID:              id,
+		Source:          eventSource(),
+		Type:            eventType,
+		Subject:         subject,
+		Time:            time.Now().UTC().Format(time.RFC3339Nano),
+		DataContentType: cloudEventDataType,
+		Data:            encodedData,
+	}, nil
+}
+
+// newUserEventData strips a user down to the fields consumers are allowed to see.
+func newUserEventData(user *pblib.User) *userEventData {
+	return &userEventData{
+		UUID:            user.GetUuid(),
+		FirstName:       user.GetFirstName(),
+		LastName:        user.GetLastName(),
+		Email:           user.GetEmail(),
+		Organization:    user.GetOrganization(),
+		PermissionLevel: user.GetPermissionLevel(),
+		IsVerified:      user.GetIsVerified(),
+	}
+}
+
+// sendCloudEvent posts the event to the sink using the CloudEvents HTTP structured content mode.
+// Returns error if sink is not configured, event is nil, or sink rejects the event.
+func sendCloudEvent(event *cloudEvent) error {
+	if !isEventSinkEnabled() {
+		return consts.ErrEventSinkDisabled
+	}
+	if event == nil {
+		return consts.ErrNilEvent
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, conf.EventSinkHost.Address, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", cloudEventContentType)
+
+	resp, err := eventSinkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s: %s", consts.ErrEventSinkRequestFailed.Error(), resp.Status)
+	}
+
+	return nil
+}
+
+// publishUserEvent wraps the user in a lifecycle event, persists it for replays and sends it in the background.
+// Errors are only logged because publishing must never fail the originating request.
+func publishUserEvent(eventType string, user *pblib.User) {
+	if user == nil {
+		return
+	}
+
+	event, err := newCloudEvent(eventType, user.GetUuid(), newUserEventData(user))
+	if err != nil {
+		logger.Error(consts.EventsTag, consts.MsgErrPublishEvent, err.Error())
+		return
+	}
+
+	// events are persisted even without a sink, so consumers added later can replay them.
+	// The change they describe is made, so a canceled request does not cancel persisting its event.
+	event.Sequence, err = insertEvent(context.Background(), event)
+	if err != nil {
+		logger.Error(consts.EventsTag, consts.MsgErrPersistEvent, event.Type, err.Error())
+	}
+
+	if !isEventSinkEnabled() {
+		return
+	}
+
+	go func() {
+		if err := sendCloudEvent(event); err != nil {
+			logger.Error(consts.EventsTag, consts.MsgErrPublishEvent, event.Type, err.Error())
+		}
+	}()
+}
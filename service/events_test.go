@@ -0,0 +1,97 @@
+package service
+
+import (
+	"encoding/json"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewCloudEvent(t *testing.T) {
+	original := conf.EventSinkHost
+	defer func() { conf.EventSinkHost = original }()
+
+	user := &pblib.User{
+		Uuid:      validUUID,
+		FirstName: "Lisa",
+		LastName:  "Kim",
+		Email:     "lisa@test.com",
+		Password:  "12345678",
+	}
+
+	desc := "test default source"
+	conf.EventSinkHost = conf.EventSink{}
+	event, err := newCloudEvent(eventTypeUserCreated, user.GetUuid(), newUserEventData(user))
+	assert.Nil(t, err, desc)
+	assert.Equal(t, cloudEventSpecVersion, event.SpecVersion, desc)
+	assert.Equal(t, defaultEventSource, event.Source, desc)
+	assert.Equal(t, eventTypeUserCreated, event.Type, desc)
+	assert.Equal(t, validUUID, event.Subject, desc)
+	assert.Equal(t, cloudEventDataType, event.DataContentType, desc)
+	assert.NotEmpty(t, event.ID, desc)
+	_, err = time.Parse(time.RFC3339Nano, event.Time)
+	assert.Nil(t, err, desc)
+
+	desc = "test data never contains password"
+	assert.NotContains(t, string(event.Data), user.GetPassword(), desc)
+	var data userEventData
+	assert.Nil(t, json.Unmarshal(event.Data, &data), desc)
+	assert.Equal(t, user.GetEmail(), data.Email, desc)
+
+	desc = "test configured source and unique ids"
+	conf.EventSinkHost = conf.EventSink{Source: "/test"}
+	other, err := newCloudEvent(eventTypeUserCreated, user.GetUuid(), newUserEventData(user))
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "/test", other.Source, desc)
+	assert.NotEqual(t, event.ID, other.ID, desc)
+}
+
+func TestSendCloudEvent(t *testing.T) {
+	original := conf.EventSinkHost
+	defer func() { conf.EventSinkHost = original }()
+
+	var contentType string
+	var received cloudEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	event, err := newCloudEvent(eventTypeUserDeleted, validUUID, &userEventData{UUID: validUUID})
+	assert.Nil(t, err)
+
+	desc := "test disabled sink"
+	conf.EventSinkHost = conf.EventSink{}
+	err = sendCloudEvent(event)
+	assert.EqualError(t, err, consts.ErrEventSinkDisabled.Error(), desc)
+
+	conf.EventSinkHost = conf.EventSink{Address: server.URL}
+
+	desc = "test nil event"
+	err = sendCloudEvent(nil)
+	assert.EqualError(t, err, consts.ErrNilEvent.Error(), desc)
+
+	desc = "test valid event"
+	err = sendCloudEvent(event)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, cloudEventContentType, contentType, desc)
+	assert.Equal(t, event.ID, received.ID, desc)
+	assert.Equal(t, event.Type, received.Type, desc)
+
+	desc = "test sink rejecting event"
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	err = sendCloudEvent(event)
+	assert.EqualError(t, err, consts.ErrEventSinkRequestFailed.Error()+": 500 Internal Server Error", desc)
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// faultInjector injects artificial failures at configured rates, so the retry and fallback logic of
+// clients can be exercised against a real deployment
+type faultInjector struct {
+	dbLatency         time.Duration
+	dbLatencyRate     float64
+	smtpFailureRate   float64
+	internalErrorRate float64
+
+	lock   sync.Mutex
+	random *rand.Rand
+}
+
+var (
+	// faults is nil unless hosts_faults_enabled is "true", which no production deployment should set
+	faults *faultInjector
+)
+
+func init() {
+	if !strings.EqualFold(conf.Faults.Enabled, "true") {
+		return
+	}
+
+	var err error
+	faults, err = newFaultInjector(conf.Faults, time.Now().UnixNano())
+	if err != nil {
+		reportStartupProblem("Invalid fault injection:", err.Error())
+		return
+	}
+
+	logger.Info(consts.FaultsTag, "Fault injection enabled, db latency", faults.dbLatency.String(),
+		"at", strconv.FormatFloat(faults.dbLatencyRate, 'f', -1, 64),
+		"smtp failures at", strconv.FormatFloat(faults.smtpFailureRate, 'f', -1, 64),
+		"internal errors at", strconv.FormatFloat(faults.internalErrorRate, 'f', -1, 64))
+}
+
+// newFaultInjector parses the rates and latency of config, empty values inject nothing.
+// Returns ErrInvalidFaultInjection if a rate is not between 0 and 1 or the latency is negative.
+func newFaultInjector(config conf.FaultInjection, seed int64) (*faultInjector, error) {
+	injector := &faultInjector{random: rand.New(rand.NewSource(seed))}
+
+	if config.DBLatency != "" {
+		latency, err := time.ParseDuration(config.DBLatency)
+		if err != nil || latency < 0 {
+			return nil, consts.ErrInvalidFaultInjection
+		}
+		injector.dbLatency = latency
+	}
+
+	rates := []struct {
+		value string
+		rate  *float64
+	}{
+		{config.DBLatencyRate, &injector.dbLatencyRate},
+		{config.SMTPFailureRate, &injector.smtpFailureRate},
+		{config.InternalErrorRate, &injector.internalErrorRate},
+	}
+	for _, r := range rates {
+		if r.value == "" {
+			continue
+		}
+		rate, err := strconv.ParseFloat(r.value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, consts.ErrInvalidFaultInjection
+		}
+		*r.rate = rate
+	}
+
+	return injector, nil
+}
+
+// roll returns true with probability rate, always false on a nil injector.
+func (f *faultInjector) roll(rate float64) bool {
+	if f == nil || rate <= 0 {
+		return false
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.random.Float64() < rate
+}
+
+// delayDB sleeps dbLatency at dbLatencyRate, a nil injector never sleeps.
+func (f *faultInjector) delayDB() {
+	if f != nil && f.roll(f.dbLatencyRate) {
+		time.Sleep(f.dbLatency)
+	}
+}
+
+// failSMTP returns ErrInjectedSMTPFailure at smtpFailureRate, a nil injector never fails.
+func (f *faultInjector) failSMTP() error {
+	if f != nil && f.roll(f.smtpFailureRate) {
+		return consts.ErrInjectedSMTPFailure
+	}
+
+	return nil
+}
+
+// FaultInterceptor fails requests with an Internal status at the configured rate before they reach the handler.
+func FaultInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	if faults != nil && faults.roll(faults.internalErrorRate) {
+		logger.Error(consts.FaultsTag, info.FullMethod, consts.ErrInjectedFault.Error())
+		return nil, status.Error(codes.Internal, consts.ErrInjectedFault.Error())
+	}
+
+	return handler(ctx, req)
+}
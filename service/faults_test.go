@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestNewFaultInjector(t *testing.T) {
+	cases := []struct {
+		desc     string
+		config   conf.FaultInjection
+		isExpErr bool
+	}{
+		{"test nothing configured", conf.FaultInjection{}, false},
+		{"test every fault", conf.FaultInjection{DBLatency: "200ms", DBLatencyRate: "0.5",
+			SMTPFailureRate: "1", InternalErrorRate: "0.01"}, false},
+		{"test negative latency", conf.FaultInjection{DBLatency: "-1s"}, true},
+		{"test malformed latency", conf.FaultInjection{DBLatency: "200"}, true},
+		{"test rate above 1", conf.FaultInjection{SMTPFailureRate: "1.5"}, true},
+		{"test negative rate", conf.FaultInjection{InternalErrorRate: "-0.1"}, true},
+		{"test percentage rate", conf.FaultInjection{DBLatencyRate: "10%"}, true},
+	}
+
+	for _, c := range cases {
+		injector, err := newFaultInjector(c.config, 1)
+		if c.isExpErr {
+			assert.Equal(t, consts.ErrInvalidFaultInjection, err, c.desc)
+			continue
+		}
+		assert.Nil(t, err, c.desc)
+		assert.NotNil(t, injector, c.desc)
+	}
+
+	injector, err := newFaultInjector(conf.FaultInjection{DBLatency: "200ms", DBLatencyRate: "0.5"}, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 200*time.Millisecond, injector.dbLatency)
+	assert.Equal(t, 0.5, injector.dbLatencyRate)
+	assert.Equal(t, float64(0), injector.smtpFailureRate)
+}
+
+func TestFaultInjectorRates(t *testing.T) {
+	var disabled *faultInjector
+	desc := "test nil injector injects nothing"
+	assert.False(t, disabled.roll(1), desc)
+	assert.Nil(t, disabled.failSMTP(), desc)
+	disabled.delayDB()
+
+	injector, err := newFaultInjector(conf.FaultInjection{SMTPFailureRate: "1", InternalErrorRate: "0.25"}, 1)
+	assert.Nil(t, err)
+
+	desc = "test rate of 1 always fails"
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, consts.ErrInjectedSMTPFailure, injector.failSMTP(), desc)
+	}
+
+	desc = "test rate of 0 never rolls"
+	for i := 0; i < 100; i++ {
+		assert.False(t, injector.roll(injector.dbLatencyRate), desc)
+	}
+
+	desc = "test rate is approximated"
+	var failures int
+	for i := 0; i < 10000; i++ {
+		if injector.roll(injector.internalErrorRate) {
+			failures++
+		}
+	}
+	assert.InDelta(t, 2500, failures, 250, desc)
+}
+
+func TestFaultInterceptor(t *testing.T) {
+	injector := faults
+	defer func() { faults = injector }()
+
+	var calls int
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls++
+		return &pbsvc.UserResponse{Message: codes.OK.String()}, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/user.UserService/GetUser"}
+
+	desc := "test disabled fault injection passes requests through"
+	faults = nil
+	_, err := FaultInterceptor(context.TODO(), &pbsvc.UserRequest{}, info, handler)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 1, calls, desc)
+
+	desc = "test injected internal error skips the handler"
+	faults, err = newFaultInjector(conf.FaultInjection{InternalErrorRate: "1"}, 1)
+	assert.Nil(t, err, desc)
+	_, err = FaultInterceptor(context.TODO(), &pbsvc.UserRequest{}, info, handler)
+	assert.Equal(t, codes.Internal, status.Code(err), desc)
+	assert.Equal(t, consts.ErrInjectedFault.Error(), status.Convert(err).Message(), desc)
+	assert.Equal(t, 1, calls, desc)
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"regexp"
+)
+
+const (
+	// maxFavorites bounds the favorites of a user, so the x-hwsc-favorites header stays small
+	maxFavorites = 500
+)
+
+var (
+	// duids are ksuids, 27 base62 characters, see user_svc.ksuid
+	duidRegex = regexp.MustCompile(`^[0-9A-Za-z]{27}$`)
+)
+
+// validateDuid returns ErrInvalidDuid if duid is not a ksuid.
+func validateDuid(duid string) error {
+	if !duidRegex.MatchString(duid) {
+		return consts.ErrInvalidDuid
+	}
+
+	return nil
+}
+
+// favoritesResponse lists the favorites of uuid in the x-hwsc-favorites response header.
+func favoritesResponse(ctx context.Context, uuid string) (*pbsvc.UserResponse, error) {
+	duids, err := getFavoriteDocuments(ctx, uuid)
+	if err != nil {
+		logger.Error(consts.FavoritesTag, consts.MsgErrListFavorites, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := setResponseHeader(ctx, metadataKeyFavorites, duids...); err != nil {
+		logger.Error(consts.FavoritesTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
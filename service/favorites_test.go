@@ -0,0 +1,30 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValidateDuid(t *testing.T) {
+	cases := []struct {
+		desc     string
+		duid     string
+		isExpErr bool
+	}{
+		{"test valid duid", "1IYmSxWbCLM1cLM2eqbcZ1wlbbv", false},
+		{"test empty duid", "", true},
+		{"test short duid", "1IYmSxWbCLM1cLM2eqbcZ1wlbb", true},
+		{"test long duid", "1IYmSxWbCLM1cLM2eqbcZ1wlbbvv", true},
+		{"test invalid character", "1IYmSxWbCLM1cLM2eqbcZ1wlbb_", true},
+	}
+
+	for _, c := range cases {
+		err := validateDuid(c.duid)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidDuid.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package service
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-lib/validation"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"path"
+)
+
+// requestValidator returns a violation for every invalid field of req, req is never nil.
+type requestValidator func(req *pbsvc.UserRequest) []*errdetails.BadRequest_FieldViolation
+
+const (
+	// field paths reported in BadRequest field violations
+	fieldRequest             = "request"
+	fieldUser                = "user"
+	fieldUserUUID            = "user.uuid"
+	fieldUserFirstName       = "user.first_name"
+	fieldUserLastName        = "user.last_name"
+	fieldUserEmail           = "user.email"
+	fieldUserPassword        = "user.password"
+	fieldUserOrganization    = "user.organization"
+	fieldUserPermission      = "user.permission_level"
+	fieldIdentification      = "identification"
+	fieldIdentificationToken = "identification.token"
+	fieldDuid                = "duid"
+	fieldUUIDsToShareDuid    = "uuids_to_share_duid"
+)
+
+// requestValidators maps rpc method names to the validation of their requests.
+// Methods without an entry take no request fields and are passed through.
+var requestValidators = map[string]requestValidator{
+	"CreateUser":                    validateCreateUserRequest,
+	"DeleteUser":                    validateUUIDRequest,
+	"RestoreUser":                   validateRestoreUserRequest,
+	"VerifyUser":                    validateRestoreUserRequest,
+	"ForgetUser":                    validateRestoreUserRequest,
+	"GetUser":                       validateUUIDRequest,
+	"ListUsers":                     validateTokenRequest,
+	"ShareDocument":                 validateShareDocumentRequest,
+	"UnshareDocument":               validateShareDocumentRequest,
+	"ListSharedWithMe":              validateTokenRequest,
+	"UpdateUser":                    validateUpdateUserRequest,
+	"AuthenticateUser":              validateAuthenticateUserRequest,
+	"GetNewAuthToken":               validateTokenRequest,
+	"VerifyAuthToken":               validateTokenRequest,
+	"RefreshAuthToken":              validateParamsRequest,
+	"LogoutUser":                    validateTokenRequest,
+	"VerifyEmailToken":              validateTokenRequest,
+	"ConfirmEmailChange":            validateTokenRequest,
+	"CancelEmailChange":             validateTokenRequest,
+	"VerifyParentalConsent":         validateTokenRequest,
+	"ConfirmLoginCountry":           validateTokenRequest,
+	"RequestPasswordReset":          validateEmailRequest,
+	"ResendVerificationEmail":       validateEmailRequest,
+	"ResetPassword":                 validateResetPasswordRequest,
+	"ReplayEvents":                  validateParamsRequest,
+	"GetUserStats":                  validateTokenRequest,
+	"GetUsageReport":                validateTokenRequest,
+	"GetReferralStats":              validateTokenRequest,
+	"SetOnboardingStep":             validateTokenRequest,
+	"GetOnboardingState":            validateTokenRequest,
+	"GetNotificationPreferences":    validateTokenRequest,
+	"UpdateNotificationPreferences": validateTokenRequest,
+	"QueryAdminActivity":            validateTokenRequest,
+	"GetAuditLog":                   validateTokenRequest,
+	"GetProfileHistory":             validateTokenRequest,
+	"FavoriteDocument":              validateDocumentRequest,
+	"UnfavoriteDocument":            validateDocumentRequest,
+	"ListFavorites":                 validateTokenRequest,
+	"RegisterDocument":              validateDocumentRequest,
+	"UnregisterDocument":            validateDocumentRequest,
+	"GetDocumentQuota":              validateTokenRequest,
+	"SetDocumentPublic":             validateDocumentRequest,
+	"ListPublicDocuments":           validateTokenRequest,
+	"ListUserDocuments":             validateTokenRequest,
+	"SetSharePolicy":                validateTokenRequest,
+	"GetSharePolicy":                validateTokenRequest,
+	"LinkAuthMethod":                validateTokenRequest,
+	"ListAuthMethods":               validateTokenRequest,
+	"UnlinkAuthMethod":              validateTokenRequest,
+	"Enable2FA":                     validateTokenRequest,
+	"Verify2FA":                     validateTokenRequest,
+	"Disable2FA":                    validateTokenRequest,
+	"CreateAPIKey":                  validateTokenRequest,
+	"RevokeAPIKey":                  validateTokenRequest,
+	"ListAPIKeys":                   validateTokenRequest,
+	"CreateOrganization":            validateTokenRequest,
+	"GetOrganization":               validateTokenRequest,
+	"ListOrganizationUsers":         validateTokenRequest,
+	"SetOrganizationAdmin":          validateSetOrganizationAdminRequest,
+	"DeleteUsersByOrganization":     validateTokenRequest,
+}
+
+// UnaryInterceptor runs DeprecationInterceptor, FaultInterceptor, RegionInterceptor, ValidationInterceptor,
+// APIKeyInterceptor, AuthInterceptor, RateLimitInterceptor and then DebounceInterceptor before the handler,
+// a grpc.Server takes a single unary interceptor.
+func UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	return DeprecationInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return FaultInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return RegionInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return ValidationInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return APIKeyInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+						return AuthInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+							return RateLimitInterceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+								return DebounceInterceptor(ctx, req, info, handler)
+							})
+						})
+					})
+				})
+			})
+		})
+	})
+}
+
+// StreamInterceptor runs APIKeyInterceptor, AuthInterceptor and RateLimitInterceptor before stream handlers,
+// which get the context they put the caller in. Streams have no request to validate or fingerprint up front,
+// so the other unary interceptors do not run, the handlers check what they need.
+func StreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	unaryInfo := &grpc.UnaryServerInfo{Server: srv, FullMethod: info.FullMethod}
+	streamHandler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, handler(srv, &callerStream{ServerStream: stream, ctx: ctx})
+	}
+
+	_, err := APIKeyInterceptor(stream.Context(), nil, unaryInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return AuthInterceptor(ctx, req, unaryInfo, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return RateLimitInterceptor(ctx, req, unaryInfo, streamHandler)
+		})
+	})
+
+	return err
+}
+
+// callerStream is a grpc.ServerStream whose context carries the caller put in by StreamInterceptor
+type callerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *callerStream) Context() context.Context {
+	return s.ctx
+}
+
+// ValidationInterceptor rejects malformed requests before they reach the Service handlers.
+// Every violated field is listed in a BadRequest detail of the returned InvalidArgument status,
+// so handlers can rely on the request, and the user or identification it needs, being set.
+func ValidationInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	validate, ok := requestValidators[path.Base(info.FullMethod)]
+	if !ok {
+		return handler(ctx, req)
+	}
+
+	var violations []*errdetails.BadRequest_FieldViolation
+	if userReq, ok := req.(*pbsvc.UserRequest); !ok || userReq == nil {
+		violations = appendViolation(violations, fieldRequest, consts.ErrNilRequest)
+	} else {
+		violations = validate(userReq)
+	}
+
+	if len(violations) > 0 {
+		for _, violation := range violations {
+			logger.Error(consts.ValidationTag, info.FullMethod, violation.GetField(), violation.GetDescription())
+		}
+		return nil, badRequestStatus(violations)
+	}
+
+	return handler(ctx, req)
+}
+
+// badRequestStatus returns an InvalidArgument status error detailing violations.
+func badRequestStatus(violations []*errdetails.BadRequest_FieldViolation) error {
+	st := status.New(codes.InvalidArgument, consts.ErrInvalidRequestFields.Error())
+	detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		// details are a convenience, the code and message are still accurate without them
+		return st.Err()
+	}
+
+	return detailed.Err()
+}
+
+// appendViolation appends a violation of field if err is not nil.
+func appendViolation(violations []*errdetails.BadRequest_FieldViolation, field string,
+	err error) []*errdetails.BadRequest_FieldViolation {
+	if err == nil {
+		return violations
+	}
+
+	return append(violations, &errdetails.BadRequest_FieldViolation{
+		Field:       field,
+		Description: err.Error(),
+	})
+}
+
+// appendPasswordViolations appends the violation of a password being set to violations, or a violation for every
+// rule of the password policy it breaks, each with the description of its error.
+func appendPasswordViolations(violations []*errdetails.BadRequest_FieldViolation,
+	password string) []*errdetails.BadRequest_FieldViolation {
+	if err := validatePassword(password); err != nil {
+		return appendViolation(violations, fieldUserPassword, err)
+	}
+
+	for _, err := range newPasswordPolicy.violations(password) {
+		violations = appendViolation(violations, fieldUserPassword, err)
+	}
+
+	return violations
+}
+
+func validateCreateUserRequest(req *pbsvc.UserRequest) []*errdetails.BadRequest_FieldViolation {
+	user := req.GetUser()
+	if user == nil {
+		return appendViolation(nil, fieldUser, consts.ErrNilRequestUser)
+	}
+
+	var violations []*errdetails.BadRequest_FieldViolation
+	violations = appendViolation(violations, fieldUserFirstName, validateFirstName(user.GetFirstName()))
+	violations = appendViolation(violations, fieldUserLastName, validateLastName(user.GetLastName()))
+	violations = appendViolation(violations, fieldUserEmail, validateEmail(normalizeEmail(user.GetEmail())))
+	violations = appendPasswordViolations(violations, user.GetPassword())
+	violations = appendViolation(violations, fieldUserOrganization, validateOrganization(user.GetOrganization()))
+
+	return violations
+}
+
+func validateUUIDRequest(req *pbsvc.UserRequest) []*errdetails.BadRequest_FieldViolation {
+	user := req.GetUser()
+	if user == nil {
+		return appendViolation(nil, fieldUser, consts.ErrNilRequestUser)
+	}
+
+	return appendViolation(nil, fieldUserUUID, validation.ValidateUserUUID(user.GetUuid()))
+}
+
+func validateRestoreUserRequest(req *pbsvc.UserRequest) []*errdetails.BadRequest_FieldViolation {
+	return append(validateTokenRequest(req), validateUUIDRequest(req)...)
+}
+
+// validateUpdateUserRequest only checks fields that are set, empty fields are left unchanged.
+// Organization is checked against the stored value by updateUserRow, an unchanged organization
+// stays valid even if it was since removed from the allowlist.
+func validateUpdateUserRequest(req *pbsvc.UserRequest) []*errdetails.BadRequest_FieldViolation {
+	user := req.GetUser()
+	if user == nil {
+		return appendViolation(nil, fieldUser, consts.ErrNilRequestUser)
+	}
+
+	violations := appendViolation(nil, fieldUserUUID, validation.ValidateUserUUID(user.GetUuid()))
+	if user.GetFirstName() != "" {
+		violations = appendViolation(violations, fieldUserFirstName, validateFirstName(user.GetFirstName()))
+	}
+	if user.GetLastName() != "" {
+		violations = appendViolation(violations, fieldUserLastName, validateLastName(user.GetLastName()))
+	}
+	if user.GetEmail() != "" {
+		violations = appendViolation(violations, fieldUserEmail, validateEmail(normalizeEmail(user.GetEmail())))
+	}
+	if user.GetPassword() != "" {
+		violations = appendPasswordViolations(violations, user.GetPassword())
+	}
+	if user.GetPermissionLevel() != "" {
+		violations = appendViolation(violations, fieldUserPermission, validatePermissionLevel(user.GetPermissionLevel()))
+	}
+
+	return violations
+}
+
+func validateAuthenticateUserRequest(req *pbsvc.UserRequest) []*errdetails.BadRequest_FieldViolation {
+	user := req.GetUser()
+	if user == nil {
+		return appendViolation(nil, fieldUser, consts.ErrNilRequestUser)
+	}
+
+	violations := appendViolation(nil, fieldUserEmail, validateEmail(normalizeEmail(user.GetEmail())))
+	violations = appendViolation(violations, fieldUserPassword, validatePassword(user.GetPassword()))
+
+	return violations
+}
+
+// validateParamsRequest accepts any non nil request, parameters are passed as metadata and checked by the handler.
+func validateParamsRequest(*pbsvc.UserRequest) []*errdetails.BadRequest_FieldViolation {
+	return nil
+}
+
+func validateTokenRequest(req *pbsvc.UserRequest) []*errdetails.BadRequest_FieldViolation {
+	identification := req.GetIdentification()
+	if identification == nil {
+		return appendViolation(nil, fieldIdentification, consts.ErrNilRequestIdentification)
+	}
+
+	if identification.GetToken() == "" {
+		return appendViolation(nil, fieldIdentificationToken, authconst.ErrEmptyToken)
+	}
+
+	return nil
+}
+
+func validateSetOrganizationAdminRequest(req *pbsvc.UserRequest) []*errdetails.BadRequest_FieldViolation {
+	return append(validateTokenRequest(req), validateUUIDRequest(req)...)
+}
+
+func validateEmailRequest(req *pbsvc.UserRequest) []*errdetails.BadRequest_FieldViolation {
+	user := req.GetUser()
+	if user == nil {
+		return appendViolation(nil, fieldUser, consts.ErrNilRequestUser)
+	}
+
+	return appendViolation(nil, fieldUserEmail, validateEmail(normalizeEmail(user.GetEmail())))
+}
+
+func validateResetPasswordRequest(req *pbsvc.UserRequest) []*errdetails.BadRequest_FieldViolation {
+	violations := validateTokenRequest(req)
+
+	user := req.GetUser()
+	if user == nil {
+		return appendViolation(violations, fieldUser, consts.ErrNilRequestUser)
+	}
+
+	return appendPasswordViolations(violations, user.GetPassword())
+}
+
+func validateDocumentRequest(req *pbsvc.UserRequest) []*errdetails.BadRequest_FieldViolation {
+	violations := validateTokenRequest(req)
+	return appendViolation(violations, fieldDuid, validateDuid(req.GetDuid()))
+}
+
+func validateShareDocumentRequest(req *pbsvc.UserRequest) []*errdetails.BadRequest_FieldViolation {
+	violations := validateDocumentRequest(req)
+	return appendViolation(violations, fieldUUIDsToShareDuid, validateShareRecipients(req.GetUuidsToShareDuid()))
+}
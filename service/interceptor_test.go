@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestValidationInterceptor(t *testing.T) {
+	uuid, err := generateUUID()
+	assert.Nil(t, err)
+
+	validUser := unitTestUserGenerator("ValidationInterceptor")
+
+	cases := []struct {
+		desc       string
+		method     string
+		req        interface{}
+		violations map[string]string
+	}{
+		{"test valid create user", "CreateUser", &pbsvc.UserRequest{User: validUser}, nil},
+		{"test nil request", "CreateUser", (*pbsvc.UserRequest)(nil),
+			map[string]string{fieldRequest: consts.ErrNilRequest.Error()}},
+		{"test nil user", "CreateUser", &pbsvc.UserRequest{},
+			map[string]string{fieldUser: consts.ErrNilRequestUser.Error()}},
+		{"test every invalid field is listed", "CreateUser", &pbsvc.UserRequest{User: &pblib.User{}},
+			map[string]string{
+				fieldUserFirstName:    consts.ErrInvalidUserFirstName.Error(),
+				fieldUserLastName:     consts.ErrInvalidUserLastName.Error(),
+				fieldUserEmail:        consts.ErrInvalidUserEmail.Error(),
+				fieldUserPassword:     consts.ErrInvalidPassword.Error(),
+				fieldUserOrganization: consts.ErrInvalidUserOrganization.Error(),
+			}},
+		{"test valid uuid", "GetUser", &pbsvc.UserRequest{User: &pblib.User{Uuid: uuid}}, nil},
+		{"test invalid uuid", "DeleteUser", &pbsvc.UserRequest{User: &pblib.User{Uuid: unitTestFailValue}},
+			map[string]string{fieldUserUUID: authconst.ErrInvalidUUID.Error()}},
+		{"test partial update", "UpdateUser", &pbsvc.UserRequest{User: &pblib.User{Uuid: uuid, LastName: "Update"}}, nil},
+		{"test invalid update fields", "UpdateUser",
+			&pbsvc.UserRequest{User: &pblib.User{FirstName: "@@@", Email: "a", Password: " "}},
+			map[string]string{
+				fieldUserUUID:      authconst.ErrInvalidUUID.Error(),
+				fieldUserFirstName: consts.ErrInvalidUserFirstName.Error(),
+				fieldUserEmail:     consts.ErrInvalidUserEmail.Error(),
+				fieldUserPassword:  consts.ErrInvalidPassword.Error(),
+			}},
+		{"test invalid permission level", "UpdateUser",
+			&pbsvc.UserRequest{User: &pblib.User{Uuid: uuid, PermissionLevel: "ROOT"}},
+			map[string]string{fieldUserPermission: consts.ErrInvalidPermissionLevel.Error()}},
+		{"test invalid credentials", "AuthenticateUser", &pbsvc.UserRequest{User: &pblib.User{Email: "a"}},
+			map[string]string{
+				fieldUserEmail:    consts.ErrInvalidUserEmail.Error(),
+				fieldUserPassword: consts.ErrInvalidPassword.Error(),
+			}},
+		{"test nil identification", "VerifyAuthToken", &pbsvc.UserRequest{},
+			map[string]string{fieldIdentification: consts.ErrNilRequestIdentification.Error()}},
+		{"test empty token", "VerifyEmailToken", &pbsvc.UserRequest{Identification: &pblib.Identification{}},
+			map[string]string{fieldIdentificationToken: authconst.ErrEmptyToken.Error()}},
+		{"test valid token", "GetNewAuthToken",
+			&pbsvc.UserRequest{Identification: &pblib.Identification{Token: unitTestFailValue}}, nil},
+		{"test valid document", "FavoriteDocument", &pbsvc.UserRequest{
+			Identification: &pblib.Identification{Token: unitTestFailValue},
+			Duid:           "1IYmSxWbCLM1cLM2eqbcZ1wlbbv",
+		}, nil},
+		{"test invalid document", "UnfavoriteDocument", &pbsvc.UserRequest{Duid: "1IYmSxWbCLM1cLM2eqbcZ1wlbb-"},
+			map[string]string{
+				fieldIdentification: consts.ErrNilRequestIdentification.Error(),
+				fieldDuid:           consts.ErrInvalidDuid.Error(),
+			}},
+		{"test invalid registered document", "RegisterDocument", &pbsvc.UserRequest{
+			Identification: &pblib.Identification{Token: unitTestFailValue},
+		}, map[string]string{fieldDuid: consts.ErrInvalidDuid.Error()}},
+		{"test valid document visibility", "SetDocumentPublic", &pbsvc.UserRequest{
+			Identification: &pblib.Identification{Token: unitTestFailValue},
+			Duid:           "1IYmSxWbCLM1cLM2eqbcZ1wlbbv",
+		}, nil},
+		{"test share without recipients", "ShareDocument", &pbsvc.UserRequest{
+			Identification: &pblib.Identification{Token: unitTestFailValue},
+			Duid:           "1IYmSxWbCLM1cLM2eqbcZ1wlbbv",
+		}, map[string]string{fieldUUIDsToShareDuid: consts.ErrInvalidShareRecipients.Error()}},
+		{"test invalid password reset email", "RequestPasswordReset", &pbsvc.UserRequest{User: &pblib.User{Email: "a"}},
+			map[string]string{fieldUserEmail: consts.ErrInvalidUserEmail.Error()}},
+		{"test invalid resend verification email", "ResendVerificationEmail", &pbsvc.UserRequest{},
+			map[string]string{fieldUser: consts.ErrNilRequestUser.Error()}},
+		{"test reset password without token and password", "ResetPassword", &pbsvc.UserRequest{User: &pblib.User{}},
+			map[string]string{
+				fieldIdentification: consts.ErrNilRequestIdentification.Error(),
+				fieldUserPassword:   consts.ErrInvalidPassword.Error(),
+			}},
+		{"test reset to a common password", "ResetPassword", &pbsvc.UserRequest{
+			Identification: &pblib.Identification{Token: unitTestFailValue},
+			User:           &pblib.User{Password: "password"},
+		}, map[string]string{fieldUserPassword: consts.ErrPasswordCommon.Error()}},
+		{"test valid reset password", "ResetPassword", &pbsvc.UserRequest{
+			Identification: &pblib.Identification{Token: unitTestFailValue},
+			User:           &pblib.User{Password: validUser.GetPassword()},
+		}, nil},
+		{"test restore without token and user", "RestoreUser", &pbsvc.UserRequest{},
+			map[string]string{
+				fieldIdentification: consts.ErrNilRequestIdentification.Error(),
+				fieldUser:           consts.ErrNilRequestUser.Error(),
+			}},
+		{"test valid restore", "RestoreUser", &pbsvc.UserRequest{
+			Identification: &pblib.Identification{Token: unitTestFailValue},
+			User:           &pblib.User{Uuid: "0000xsnjg0mqjhbf4qx1efd6y3"},
+		}, nil},
+		{"test verify without user", "VerifyUser", &pbsvc.UserRequest{
+			Identification: &pblib.Identification{Token: unitTestFailValue},
+		}, map[string]string{fieldUser: consts.ErrNilRequestUser.Error()}},
+		{"test forget without token", "ForgetUser", &pbsvc.UserRequest{
+			User: &pblib.User{Uuid: "0000xsnjg0mqjhbf4qx1efd6y3"},
+		}, map[string]string{fieldIdentification: consts.ErrNilRequestIdentification.Error()}},
+		{"test enable 2fa without token", "Enable2FA", &pbsvc.UserRequest{},
+			map[string]string{fieldIdentification: consts.ErrNilRequestIdentification.Error()}},
+		{"test metadata only request", "ReplayEvents", &pbsvc.UserRequest{}, nil},
+		{"test nil metadata only request", "ReplayEvents", (*pbsvc.UserRequest)(nil),
+			map[string]string{fieldRequest: consts.ErrNilRequest.Error()}},
+		{"test method without validation", "GetStatus", (*pbsvc.UserRequest)(nil), nil},
+	}
+
+	for _, c := range cases {
+		handled := false
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			handled = true
+			return &pbsvc.UserResponse{Message: codes.OK.String()}, nil
+		}
+		info := &grpc.UnaryServerInfo{FullMethod: "/user.UserService/" + c.method}
+
+		response, err := ValidationInterceptor(context.TODO(), c.req, info, handler)
+		if c.violations == nil {
+			assert.Nil(t, err, c.desc)
+			assert.True(t, handled, c.desc)
+			assert.NotNil(t, response, c.desc)
+			continue
+		}
+
+		assert.False(t, handled, c.desc)
+		assert.Nil(t, response, c.desc)
+
+		st, ok := status.FromError(err)
+		assert.True(t, ok, c.desc)
+		assert.Equal(t, codes.InvalidArgument, st.Code(), c.desc)
+		assert.Equal(t, consts.ErrInvalidRequestFields.Error(), st.Message(), c.desc)
+
+		violations := make(map[string]string)
+		for _, detail := range st.Details() {
+			badRequest, ok := detail.(*errdetails.BadRequest)
+			assert.True(t, ok, c.desc)
+			for _, violation := range badRequest.GetFieldViolations() {
+				violations[violation.GetField()] = violation.GetDescription()
+			}
+		}
+		assert.Equal(t, c.violations, violations, c.desc)
+	}
+}
+
+// unitTestStreamContext is a grpc.ServerStream that only carries ctx
+type unitTestStreamContext struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *unitTestStreamContext) Context() context.Context {
+	return s.ctx
+}
+
+func TestStreamInterceptor(t *testing.T) {
+	limiter := requestLimiter
+	requestLimiter = newRateLimiter(map[string]rateLimit{"CreateUsers": {requests: 1, interval: time.Minute}})
+	defer func() { requestLimiter = limiter }()
+
+	var calls int
+	var handled context.Context
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		calls++
+		handled = stream.Context()
+		return nil
+	}
+	info := &grpc.StreamServerInfo{FullMethod: "/user.v2.UserService/CreateUsers", IsClientStream: true}
+
+	desc := "test stream without a token reaches the handler"
+	ctx, _ := unitTestServerContext()
+	err := StreamInterceptor(nil, &unitTestStreamContext{ctx: ctx}, info, handler)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 1, calls, desc)
+	assert.NotNil(t, handled, desc)
+
+	desc = "test malformed key in authorization metadata"
+	ctx, _ = unitTestServerContext(metadataKeyAuthorization, serviceAPIKeyPrefix+"1234_c2VjcmV0")
+	err = StreamInterceptor(nil, &unitTestStreamContext{ctx: ctx}, info, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+	assert.Equal(t, 1, calls, desc)
+
+	desc = "test stream opens are rate limited"
+	peerAddr := &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}}
+	ctx, _ = unitTestServerContext()
+	err = StreamInterceptor(nil, &unitTestStreamContext{ctx: peer.NewContext(ctx, peerAddr)}, info, handler)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 2, calls, desc)
+	err = StreamInterceptor(nil, &unitTestStreamContext{ctx: peer.NewContext(ctx, peerAddr)}, info, handler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), desc)
+	assert.Equal(t, 2, calls, desc)
+}
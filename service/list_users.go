@@ -0,0 +1,150 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/base64"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-lib/validation"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"time"
+)
+
+// userListFilter narrows the users returned by ListUsers, zero values match every user
+type userListFilter struct {
+	organization string
+	isVerified   sql.NullBool
+
+	// created from createdFrom, included, to createdTo, excluded
+	createdFrom time.Time
+	createdTo   time.Time
+}
+
+const (
+	defaultListUsersLimit = 100
+	maxListUsersLimit     = 1000
+)
+
+// encodePageToken returns the x-hwsc-next-page-token value continuing after uuid.
+// Tokens are opaque to clients, which send them back unchanged.
+func encodePageToken(uuid string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(uuid))
+}
+
+// decodePageToken returns the uuid a x-hwsc-page-token value continues after, empty starts from the first user.
+// Returns ErrInvalidPageToken if token was not returned by encodePageToken.
+func decodePageToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+
+	uuid, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", consts.ErrInvalidPageToken
+	}
+	if err := validation.ValidateUserUUID(string(uuid)); err != nil {
+		return "", consts.ErrInvalidPageToken
+	}
+
+	return string(uuid), nil
+}
+
+// parseUserListFilter reads the optional x-hwsc-organization-bin, x-hwsc-is-verified, x-hwsc-from-date and
+// x-hwsc-to-date metadata. Dates are YYYY-MM-DD in UTC and both included.
+// Returns ErrInvalidVerifiedFilter or ErrInvalidCreatedDateRange.
+func parseUserListFilter(ctx context.Context) (*userListFilter, error) {
+	filter := &userListFilter{
+		organization: getIncomingMetadata(ctx, metadataKeyOrganization),
+	}
+
+	if value := getIncomingMetadata(ctx, metadataKeyIsVerified); value != "" {
+		isVerified, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, consts.ErrInvalidVerifiedFilter
+		}
+		filter.isVerified = sql.NullBool{Bool: isVerified, Valid: true}
+	}
+
+	if value := getIncomingMetadata(ctx, metadataKeyFromDate); value != "" {
+		from, err := time.Parse(usageDayLayout, value)
+		if err != nil {
+			return nil, consts.ErrInvalidCreatedDateRange
+		}
+		filter.createdFrom = from
+	}
+
+	if value := getIncomingMetadata(ctx, metadataKeyToDate); value != "" {
+		to, err := time.Parse(usageDayLayout, value)
+		if err != nil {
+			return nil, consts.ErrInvalidCreatedDateRange
+		}
+		filter.createdTo = to.AddDate(0, 0, 1)
+	}
+
+	if !filter.createdFrom.IsZero() && !filter.createdTo.IsZero() && !filter.createdFrom.Before(filter.createdTo) {
+		return nil, consts.ErrInvalidCreatedDateRange
+	}
+
+	return filter, nil
+}
+
+// parseUserListPage reads the optional x-hwsc-page-token and x-hwsc-limit metadata.
+// Returns ErrInvalidPageToken, or an InvalidArgument status error if the limit is not valid.
+func parseUserListPage(ctx context.Context) (string, int, error) {
+	afterUUID, err := decodePageToken(getIncomingMetadata(ctx, metadataKeyPageToken))
+	if err != nil {
+		return "", 0, err
+	}
+
+	limit, err := getIncomingMetadataInt64(ctx, metadataKeyLimit, defaultListUsersLimit)
+	if err != nil || limit <= 0 || limit > maxListUsersLimit {
+		return "", 0, status.Error(codes.InvalidArgument, consts.ErrInvalidReplayLimit.Error())
+	}
+
+	return afterUUID, int(limit), nil
+}
+
+// usersPageResponse returns the page of at most limit users matching filter after afterUUID, with passwords set
+// to empty, the x-hwsc-next-page-token response header unless it is the last page, and x-hwsc-users-last-seen.
+func usersPageResponse(ctx context.Context, tag string, filter *userListFilter, afterUUID string,
+	limit int) (*pbsvc.UserResponse, error) {
+	// one more user than the page tells whether there is a next page
+	users, lastSeen, err := getUsersPage(ctx, filter, afterUUID, limit+1)
+	if err != nil {
+		logger.Error(tag, consts.MsgErrListUsers, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if len(users) > limit {
+		users = users[:limit]
+		nextPageToken := encodePageToken(users[len(users)-1].GetUuid())
+		if err := setResponseHeader(ctx, metadataKeyNextPageToken, nextPageToken); err != nil {
+			logger.Error(tag, consts.MsgErrSetResponseHeader, err.Error())
+			return nil, statusFromError(err)
+		}
+	}
+
+	var seen []string
+	for _, user := range users {
+		user.Password = ""
+		if timestamp, ok := lastSeen[user.GetUuid()]; ok {
+			seen = append(seen, user.GetUuid()+"="+timestamp.UTC().Format(time.RFC3339))
+		}
+	}
+	if len(seen) > 0 {
+		if err := setResponseHeader(ctx, metadataKeyUsersLastSeen, seen...); err != nil {
+			logger.Error(tag, consts.MsgErrSetResponseHeader, err.Error())
+			return nil, statusFromError(err)
+		}
+	}
+
+	return &pbsvc.UserResponse{
+		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message:        codes.OK.String(),
+		UserCollection: users,
+	}, nil
+}
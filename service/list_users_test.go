@@ -0,0 +1,70 @@
+package service
+
+import (
+	"database/sql"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPageToken(t *testing.T) {
+	uuid, _ := generateUUID()
+
+	desc := "test tokens round trip"
+	decoded, err := decodePageToken(encodePageToken(uuid))
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuid, decoded, desc)
+
+	desc = "test empty token starts from the first user"
+	decoded, err = decodePageToken("")
+	assert.Nil(t, err, desc)
+	assert.Empty(t, decoded, desc)
+
+	desc = "test malformed token"
+	_, err = decodePageToken("not a token")
+	assert.EqualError(t, err, consts.ErrInvalidPageToken.Error(), desc)
+
+	desc = "test token of something else than a uuid"
+	_, err = decodePageToken(encodePageToken("hello"))
+	assert.EqualError(t, err, consts.ErrInvalidPageToken.Error(), desc)
+}
+
+func TestParseUserListFilter(t *testing.T) {
+	cases := []struct {
+		desc      string
+		pairs     []string
+		expFilter *userListFilter
+		expErr    error
+	}{
+		{"test no filter", nil, &userListFilter{}, nil},
+		{"test organization and verified", []string{metadataKeyOrganization, "hwsc", metadataKeyIsVerified, "false"},
+			&userListFilter{organization: "hwsc", isVerified: sql.NullBool{Valid: true}}, nil},
+		{"test created range includes the to date",
+			[]string{metadataKeyFromDate, "2019-05-01", metadataKeyToDate, "2019-05-31"},
+			&userListFilter{
+				createdFrom: time.Date(2019, time.May, 1, 0, 0, 0, 0, time.UTC),
+				createdTo:   time.Date(2019, time.June, 1, 0, 0, 0, 0, time.UTC),
+			}, nil},
+		{"test single day", []string{metadataKeyFromDate, "2019-05-01", metadataKeyToDate, "2019-05-01"},
+			&userListFilter{
+				createdFrom: time.Date(2019, time.May, 1, 0, 0, 0, 0, time.UTC),
+				createdTo:   time.Date(2019, time.May, 2, 0, 0, 0, 0, time.UTC),
+			}, nil},
+		{"test invalid verified", []string{metadataKeyIsVerified, "maybe"}, nil, consts.ErrInvalidVerifiedFilter},
+		{"test invalid date", []string{metadataKeyFromDate, "05/01/2019"}, nil, consts.ErrInvalidCreatedDateRange},
+		{"test from after to", []string{metadataKeyFromDate, "2019-05-02", metadataKeyToDate, "2019-05-01"},
+			nil, consts.ErrInvalidCreatedDateRange},
+	}
+
+	for _, c := range cases {
+		ctx, _ := unitTestServerContext(c.pairs...)
+		filter, err := parseUserListFilter(ctx)
+		if c.expErr != nil {
+			assert.EqualError(t, err, c.expErr.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.expFilter, filter, c.desc)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/peer"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// geoIPProvider resolves client ips to their country, as an ISO 3166-1 alpha-2 code such as "NZ"
+type geoIPProvider interface {
+	country(ctx context.Context, ip net.IP) (string, error)
+}
+
+// httpGeoIPProvider GETs address?ip=<ip> and reads the country of a JSON object such as {"country": "NZ"}
+type httpGeoIPProvider struct {
+	address string
+	client  *http.Client
+}
+
+// geoIPResponse is the body of a geoip lookup
+type geoIPResponse struct {
+	Country string `json:"country"`
+}
+
+// loginCountryState is how the country of a login relates to the countries the account signed in from before
+type loginCountryState int
+
+const (
+	// loginCountryKnown countries were confirmed, or are the first the account signed in from
+	loginCountryKnown loginCountryState = iota
+
+	// loginCountryNew countries are recorded for the first time by this login
+	loginCountryNew
+
+	// loginCountryUnconfirmed countries were recorded while hosts_geoip_forcereverify was on and not confirmed yet
+	loginCountryUnconfirmed
+)
+
+const (
+	// geoIPLookupTimeout bounds how long a login waits on the provider, slower lookups are not flagged
+	geoIPLookupTimeout = 2 * time.Second
+
+	// metadataKeyForwardedFor is set by the gateway to the client ip, the peer of the service is the gateway
+	metadataKeyForwardedFor = "x-forwarded-for"
+
+	loginTimeLayout = "January 2, 2006 15:04 MST"
+)
+
+var (
+	// geoIP is nil when suspicious login detection is disabled
+	geoIP geoIPProvider
+
+	// forceLoginReverify refuses logins from new countries until the user confirms them
+	forceLoginReverify bool
+
+	countryCodeRegex = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+func init() {
+	if conf.GeoIPHost.Address == "" {
+		return
+	}
+
+	geoIP = &httpGeoIPProvider{
+		address: conf.GeoIPHost.Address,
+		client:  &http.Client{Timeout: geoIPLookupTimeout},
+	}
+	forceLoginReverify = strings.EqualFold(conf.GeoIPHost.ForceReverify, "true")
+
+	logger.Info(consts.LoginCountryTag, "Detecting logins from new countries, forced reverification:",
+		fmt.Sprint(forceLoginReverify))
+}
+
+// country returns error if the request fails, the provider does not answer with a 2xx status,
+// or the answer is not a country code.
+func (p *httpGeoIPProvider) country(ctx context.Context, ip net.IP) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, p.address+"?ip="+url.QueryEscape(ip.String()), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return "", fmt.Errorf("%s: %s", consts.ErrGeoIPRequestFailed.Error(), resp.Status)
+	}
+
+	body := &geoIPResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
+		return "", err
+	}
+
+	country := strings.ToUpper(strings.TrimSpace(body.Country))
+	if !countryCodeRegex.MatchString(country) {
+		return "", fmt.Errorf("%s: invalid country %q", consts.ErrGeoIPRequestFailed.Error(), body.Country)
+	}
+
+	return country, nil
+}
+
+// loginIP returns the ip of the client, the first x-forwarded-for address or the peer address.
+// Returns nil if the address is not an ip.
+func loginIP(ctx context.Context) net.IP {
+	if forwarded := getIncomingMetadata(ctx, metadataKeyForwardedFor); forwarded != "" {
+		return net.ParseIP(strings.TrimSpace(strings.Split(forwarded, ",")[0]))
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// isPublicIP returns true if ip may be located, loopback, link-local and private addresses have no country.
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// checkLoginCountry records the country user signs in from and flags countries it never signed in from.
+// Flagged logins send a security alert, or with forceLoginReverify a confirmation link the login waits on.
+// Failed lookups and ips without a country are not flagged, so an unavailable provider does not lock users out.
+// Returns ErrLoginCountryUnconfirmed if the login must be confirmed first, or any db or email error.
+func checkLoginCountry(ctx context.Context, provider geoIPProvider, user *pblib.User, now time.Time) error {
+	if provider == nil {
+		return nil
+	}
+
+	ip := loginIP(ctx)
+	if ip == nil || !isPublicIP(ip) {
+		return nil
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, geoIPLookupTimeout)
+	defer cancel()
+
+	country, err := provider.country(lookupCtx, ip)
+	if err != nil {
+		logger.Error(consts.LoginCountryTag, consts.MsgErrLookupLoginCountry, err.Error())
+		return nil
+	}
+
+	state, err := recordLoginCountry(ctx, user.GetUuid(), country, now, forceLoginReverify)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case state == loginCountryKnown:
+		return nil
+	case state == loginCountryUnconfirmed || forceLoginReverify:
+		logger.Info(consts.LoginCountryTag, "Confirming login from", country, "for", user.GetUuid())
+		if err := requestLoginCountryConfirmation(ctx, user, country, now); err != nil {
+			return err
+		}
+		return consts.ErrLoginCountryUnconfirmed
+	}
+
+	logger.Info(consts.LoginCountryTag, "New login country", country, "for", user.GetUuid())
+
+	// the login does not wait on the alert
+	go func() {
+		if err := sendSecurityAlert(context.Background(), user, country, now); err != nil {
+			logger.Error(consts.LoginCountryTag, consts.MsgErrSendSecurityAlert, err.Error())
+		}
+	}()
+
+	return nil
+}
+
+// sendSecurityAlert emails user that it signed in from country at now, unless security alerts are switched off.
+func sendSecurityAlert(ctx context.Context, user *pblib.User, country string, now time.Time) error {
+	emailData := map[string]string{
+		countryKey:   country,
+		loginTimeKey: now.UTC().Format(loginTimeLayout),
+	}
+	emailReq, err := newEmailRequest(emailData, []string{user.GetEmail()}, conf.EmailHost.Username, subjectSecurityAlert)
+	if err != nil {
+		return err
+	}
+	emailReq.uuid = user.GetUuid()
+
+	return emailReq.sendEmail(ctx, templateSecurityAlert)
+}
+
+// requestLoginCountryConfirmation emails user a link to confirm signing in from country, the link of any
+// previous attempt from country stops working.
+// Returns error if the token could not be generated or stored, or the email could not be sent.
+func requestLoginCountryConfirmation(ctx context.Context, user *pblib.User, country string, now time.Time) error {
+	confirmationID, err := auth.GenerateEmailIdentification(user.GetUuid(), user.GetPermissionLevel())
+	if err != nil {
+		return err
+	}
+
+	if err := insertLoginCountryToken(ctx, user.GetUuid(), country,
+		confirmationID.GetToken(), confirmationID.GetSecret()); err != nil {
+		return err
+	}
+
+	confirmationLink, err := generateLoginCountryLink(confirmationID.GetToken())
+	if err != nil {
+		return err
+	}
+
+	emailData := map[string]string{
+		verificationLinkKey: confirmationLink,
+		countryKey:          country,
+		loginTimeKey:        now.UTC().Format(loginTimeLayout),
+	}
+	emailReq, err := newEmailRequest(emailData, []string{user.GetEmail()}, conf.EmailHost.Username,
+		subjectVerifyLoginCountry)
+	if err != nil {
+		return err
+	}
+	emailReq.uuid = user.GetUuid()
+
+	return emailReq.sendEmail(ctx, templateVerifyLoginCountry)
+}
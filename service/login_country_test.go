@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/peer"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// unitTestGeoIPProvider resolves every ip to resolved, or fails with err
+type unitTestGeoIPProvider struct {
+	resolved string
+	err      error
+	lookups  int
+}
+
+func (p *unitTestGeoIPProvider) country(ctx context.Context, ip net.IP) (string, error) {
+	p.lookups++
+	return p.resolved, p.err
+}
+
+func TestHTTPGeoIPProvider(t *testing.T) {
+	var query string
+	body := `{"country": "nz"}`
+	statusCode := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("ip")
+		w.WriteHeader(statusCode)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	provider := &httpGeoIPProvider{address: server.URL, client: server.Client()}
+
+	desc := "test country is looked up"
+	country, err := provider.country(context.TODO(), net.ParseIP("2001:db8::1"))
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "NZ", country, desc)
+	assert.Equal(t, "2001:db8::1", query, desc)
+
+	desc = "test invalid country fails"
+	body = `{"country": "New Zealand"}`
+	_, err = provider.country(context.TODO(), net.ParseIP("203.0.113.7"))
+	assert.EqualError(t, err, consts.ErrGeoIPRequestFailed.Error()+`: invalid country "New Zealand"`, desc)
+
+	desc = "test non 2xx status fails"
+	statusCode = http.StatusTooManyRequests
+	_, err = provider.country(context.TODO(), net.ParseIP("203.0.113.7"))
+	assert.EqualError(t, err, consts.ErrGeoIPRequestFailed.Error()+": 429 Too Many Requests", desc)
+}
+
+func TestLoginIP(t *testing.T) {
+	withPeer := func(ctx context.Context, address string) context.Context {
+		addr, _ := net.ResolveTCPAddr("tcp", address)
+		return peer.NewContext(ctx, &peer.Peer{Addr: addr})
+	}
+
+	forwarded, _ := unitTestServerContext(metadataKeyForwardedFor, "203.0.113.7, 10.0.0.2")
+	invalid, _ := unitTestServerContext(metadataKeyForwardedFor, "unknown")
+
+	cases := []struct {
+		desc  string
+		ctx   context.Context
+		expIP net.IP
+	}{
+		{"test no address", context.TODO(), nil},
+		{"test peer address", withPeer(context.TODO(), "198.51.100.4:50051"), net.ParseIP("198.51.100.4")},
+		{"test forwarded address", withPeer(forwarded, "10.0.0.2:50051"), net.ParseIP("203.0.113.7")},
+		{"test invalid forwarded address", withPeer(invalid, "10.0.0.2:50051"), nil},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expIP, loginIP(c.ctx), c.desc)
+	}
+}
+
+func TestCheckLoginCountry(t *testing.T) {
+	user := unitTestUserGenerator("TestCheckLoginCountry")
+
+	private, _ := unitTestServerContext(metadataKeyForwardedFor, "192.168.1.20")
+	public, _ := unitTestServerContext(metadataKeyForwardedFor, "203.0.113.7")
+
+	desc := "test detection disabled"
+	assert.Nil(t, checkLoginCountry(public, nil, user, time.Now()), desc)
+
+	desc = "test private ips are not looked up"
+	provider := &unitTestGeoIPProvider{resolved: "NZ"}
+	assert.Nil(t, checkLoginCountry(private, provider, user, time.Now()), desc)
+	assert.Equal(t, 0, provider.lookups, desc)
+
+	desc = "test failed lookups do not block the login"
+	provider = &unitTestGeoIPProvider{err: errors.New("unavailable")}
+	assert.Nil(t, checkLoginCountry(public, provider, user, time.Now()), desc)
+	assert.Equal(t, 1, provider.lookups, desc)
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// mailingListMember is the Mailchimp-compatible payload for upserting a list member
+type mailingListMember struct {
+	EmailAddress string            `json:"email_address"`
+	StatusIfNew  string            `json:"status_if_new"`
+	MergeFields  map[string]string `json:"merge_fields"`
+	Language     string            `json:"language,omitempty"`
+}
+
+const (
+	mailingListStatusSubscribed = "subscribed"
+	mailingListMergeFirstName   = "FNAME"
+	mailingListMergeLastName    = "LNAME"
+	mailingListAuthUser         = "hwsc-user-svc"
+	mailingListRequestTimeout   = 10 * time.Second
+)
+
+var (
+	mailingListClient = &http.Client{Timeout: mailingListRequestTimeout}
+)
+
+// isMailingListEnabled checks if a mailing-list provider is configured.
+func isMailingListEnabled() bool {
+	return conf.MailingListHost.Address != "" && conf.MailingListHost.ListID != ""
+}
+
+// subscriberHash returns the Mailchimp subscriber id, which is the md5 of the lower cased email.
+func subscriberHash(email string) string {
+	hash := md5.Sum([]byte(strings.ToLower(email)))
+	return hex.EncodeToString(hash[:])
+}
+
+// syncMailingListMember upserts the user into the configured mailing list.
+// PUT is used so syncing the same user more than once does not create duplicates.
+// Returns error if provider is not configured, user is nil, or provider rejects the request.
+func syncMailingListMember(user *pblib.User, locale string) error {
+	if !isMailingListEnabled() {
+		return consts.ErrMailingListDisabled
+	}
+	if user == nil {
+		return consts.ErrNilRequestUser
+	}
+	if err := validateEmail(user.GetEmail()); err != nil {
+		return err
+	}
+
+	member := &mailingListMember{
+		EmailAddress: user.GetEmail(),
+		StatusIfNew:  mailingListStatusSubscribed,
+		MergeFields: map[string]string{
+			mailingListMergeFirstName: user.GetFirstName(),
+			mailingListMergeLastName:  user.GetLastName(),
+		},
+		Language: locale,
+	}
+
+	payload, err := json.Marshal(member)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/lists/%s/members/%s", strings.TrimSuffix(conf.MailingListHost.Address, "/"),
+		conf.MailingListHost.ListID, subscriberHash(user.GetEmail()))
+
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(mailingListAuthUser, conf.MailingListHost.APIKey)
+
+	resp, err := mailingListClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s: %s", consts.ErrMailingListRequestFailed.Error(), resp.Status)
+	}
+
+	return nil
+}
+
+// subscribeVerifiedUser pushes a newly verified user to the mailing list if the user opted in to marketing.
+// Errors are only logged because mailing-list sync must never fail email verification.
+func subscribeVerifiedUser(user *pblib.User) {
+	if !isMailingListEnabled() || user == nil {
+		return
+	}
+
+	// it runs after the verification request returned, its context would be canceled
+	optIn, locale, err := getMarketingPreference(context.Background(), user.GetUuid())
+	if err != nil {
+		logger.Error(consts.MailingListTag, consts.MsgErrSyncMailingList, err.Error())
+		return
+	}
+
+	if !optIn {
+		return
+	}
+
+	if err := syncMailingListMember(user, locale); err != nil {
+		logger.Error(consts.MailingListTag, consts.MsgErrSyncMailingList, err.Error())
+		return
+	}
+
+	logger.Info(consts.MailingListTag, "Synced verified user:", user.GetUuid())
+}
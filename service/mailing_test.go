@@ -0,0 +1,84 @@
+package service
+
+import (
+	"encoding/json"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSubscriberHash(t *testing.T) {
+	// hash is case insensitive
+	assert.Equal(t, subscriberHash("lisa@test.com"), subscriberHash("Lisa@Test.COM"))
+	assert.Equal(t, "5487a058b8776d205952b52dc276697d", subscriberHash("lisa@test.com"))
+	assert.NotEqual(t, subscriberHash("lisa@test.com"), subscriberHash("kim@test.com"))
+}
+
+func TestSyncMailingListMember(t *testing.T) {
+	original := conf.MailingListHost
+	defer func() { conf.MailingListHost = original }()
+
+	validUser := &pblib.User{
+		FirstName: "Lisa",
+		LastName:  "Kim",
+		Email:     "lisa@test.com",
+	}
+
+	var received mailingListMember
+	var receivedPath, receivedMethod string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedPath = r.URL.Path
+		receivedMethod = r.Method
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	desc := "test disabled provider"
+	conf.MailingListHost = conf.MailingListProvider{}
+	err := syncMailingListMember(validUser, "")
+	assert.EqualError(t, err, consts.ErrMailingListDisabled.Error(), desc)
+
+	conf.MailingListHost = conf.MailingListProvider{
+		Address: server.URL + "/",
+		APIKey:  "key",
+		ListID:  "list",
+	}
+
+	desc = "test nil user"
+	err = syncMailingListMember(nil, "")
+	assert.EqualError(t, err, consts.ErrNilRequestUser.Error(), desc)
+
+	desc = "test invalid email"
+	err = syncMailingListMember(&pblib.User{Email: "@"}, "")
+	assert.EqualError(t, err, consts.ErrInvalidUserEmail.Error(), desc)
+
+	desc = "test valid user"
+	err = syncMailingListMember(validUser, "en")
+	assert.Nil(t, err, desc)
+	assert.Equal(t, http.MethodPut, receivedMethod, desc)
+	assert.Equal(t, "/lists/list/members/"+subscriberHash(validUser.GetEmail()), receivedPath, desc)
+	assert.Equal(t, validUser.GetEmail(), received.EmailAddress, desc)
+	assert.Equal(t, mailingListStatusSubscribed, received.StatusIfNew, desc)
+	assert.Equal(t, validUser.GetFirstName(), received.MergeFields[mailingListMergeFirstName], desc)
+	assert.Equal(t, validUser.GetLastName(), received.MergeFields[mailingListMergeLastName], desc)
+	assert.Equal(t, "en", received.Language, desc)
+
+	desc = "test provider rejecting request"
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	err = syncMailingListMember(validUser, "")
+	assert.EqualError(t, err, consts.ErrMailingListRequestFailed.Error()+": 400 Bad Request", desc)
+}
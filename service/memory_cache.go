@@ -0,0 +1,157 @@
+package service
+
+import (
+	"container/list"
+	"github.com/golang/protobuf/proto"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryUserCache is a userCache kept in the memory of the instance, a bounded LRU whose entries expire after ttl.
+// Writes on other instances cannot invalidate it, a changed user is served for at most ttl.
+type memoryUserCache struct {
+	lock     sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  *list.List
+	byUUID   map[string]*list.Element
+}
+
+type memoryUserCacheEntry struct {
+	user       *pblib.User
+	expiration time.Time
+}
+
+// cacheCounters count the lookups of a cache since the service started, GetStatus reports them
+type cacheCounters struct {
+	hits   int64
+	misses int64
+}
+
+const (
+	defaultMemoryCacheTTL = 30 * time.Second
+)
+
+var (
+	userCacheCounters  cacheCounters
+	tokenCacheCounters cacheCounters
+)
+
+// parseMemoryCache parses the size and ttl of an in-memory cache, empty values default to defaultSize and
+// defaultMemoryCacheTTL.
+// Returns false if size is not a non negative number or ttl is not a positive duration.
+func parseMemoryCache(size string, ttl string, defaultSize int) (int, time.Duration, bool) {
+	capacity := defaultSize
+	if size != "" {
+		parsed, err := strconv.Atoi(size)
+		if err != nil || parsed < 0 {
+			return 0, 0, false
+		}
+		capacity = parsed
+	}
+
+	expiration := defaultMemoryCacheTTL
+	if ttl != "" {
+		parsed, err := time.ParseDuration(ttl)
+		if err != nil || parsed <= 0 {
+			return 0, 0, false
+		}
+		expiration = parsed
+	}
+
+	return capacity, expiration, true
+}
+
+func newMemoryUserCache(capacity int, ttl time.Duration) *memoryUserCache {
+	return &memoryUserCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  list.New(),
+		byUUID:   make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of the cached user, expired entries are removed and reported as a miss.
+func (c *memoryUserCache) get(uuid string) (*pblib.User, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.byUUID[uuid]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*memoryUserCacheEntry)
+	if time.Now().After(entry.expiration) {
+		c.remove(element)
+		return nil, false
+	}
+
+	c.entries.MoveToFront(element)
+	return proto.Clone(entry.user).(*pblib.User), true
+}
+
+// set caches a copy of the user without its password, evicting the least recently used user when full.
+func (c *memoryUserCache) set(user *pblib.User) {
+	if user == nil || user.GetUuid() == "" || c.capacity <= 0 {
+		return
+	}
+
+	sanitized := proto.Clone(user).(*pblib.User)
+	sanitized.Password = ""
+	entry := &memoryUserCacheEntry{user: sanitized, expiration: time.Now().Add(c.ttl)}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.byUUID[user.GetUuid()]; ok {
+		element.Value = entry
+		c.entries.MoveToFront(element)
+		return
+	}
+
+	c.byUUID[user.GetUuid()] = c.entries.PushFront(entry)
+	for c.entries.Len() > c.capacity {
+		c.remove(c.entries.Back())
+	}
+}
+
+// invalidate removes the cached user, must be called after every write to the user's row.
+func (c *memoryUserCache) invalidate(uuid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.byUUID[uuid]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *memoryUserCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.entries.Len()
+}
+
+// remove must be called while holding lock.
+func (c *memoryUserCache) remove(element *list.Element) {
+	c.entries.Remove(element)
+	delete(c.byUUID, element.Value.(*memoryUserCacheEntry).user.GetUuid())
+}
+
+// record counts a lookup as a hit or a miss.
+func (c *cacheCounters) record(hit bool) {
+	if hit {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+}
+
+// load returns the hits and misses counted so far.
+func (c *cacheCounters) load() (int64, int64) {
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses)
+}
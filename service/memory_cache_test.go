@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseMemoryCache(t *testing.T) {
+	cases := []struct {
+		desc    string
+		size    string
+		ttl     string
+		expSize int
+		expTTL  time.Duration
+		isExpOk bool
+	}{
+		{"test defaults", "", "", 10, defaultMemoryCacheTTL, true},
+		{"test size and ttl", "100", "1m", 100, time.Minute, true},
+		{"test disabled", "0", "", 0, defaultMemoryCacheTTL, true},
+		{"test negative size", "-1", "", 0, 0, false},
+		{"test invalid size", "many", "", 0, 0, false},
+		{"test zero ttl", "", "0s", 0, 0, false},
+		{"test invalid ttl", "", "soon", 0, 0, false},
+	}
+
+	for _, c := range cases {
+		size, ttl, ok := parseMemoryCache(c.size, c.ttl, 10)
+		assert.Equal(t, c.isExpOk, ok, c.desc)
+		assert.Equal(t, c.expSize, size, c.desc)
+		assert.Equal(t, c.expTTL, ttl, c.desc)
+	}
+}
+
+func TestMemoryUserCache(t *testing.T) {
+	user := &pblib.User{
+		Uuid:      validUUID,
+		FirstName: "Lisa",
+		LastName:  "Kim",
+		Password:  "hashed",
+	}
+	other := &pblib.User{Uuid: "TestMemoryUserCache-Other"}
+	third := &pblib.User{Uuid: "TestMemoryUserCache-Third"}
+
+	cases := []struct {
+		desc      string
+		populate  func(c *memoryUserCache)
+		uuid      string
+		isExpHit  bool
+		expLength int
+	}{
+		{"test miss", func(c *memoryUserCache) {}, validUUID, false, 0},
+		{"test hit", func(c *memoryUserCache) {
+			c.set(user)
+		}, validUUID, true, 1},
+		{"test nil user is not cached", func(c *memoryUserCache) {
+			c.set(nil)
+		}, validUUID, false, 0},
+		{"test least recently used is evicted", func(c *memoryUserCache) {
+			c.set(user)
+			c.set(other)
+			c.get(validUUID)
+			c.set(third)
+		}, other.GetUuid(), false, 2},
+		{"test recently used survives eviction", func(c *memoryUserCache) {
+			c.set(user)
+			c.set(other)
+			c.get(validUUID)
+			c.set(third)
+		}, validUUID, true, 2},
+		{"test invalidate", func(c *memoryUserCache) {
+			c.set(user)
+			c.set(other)
+			c.invalidate(validUUID)
+		}, validUUID, false, 1},
+	}
+
+	for _, c := range cases {
+		cache := newMemoryUserCache(2, time.Minute)
+		c.populate(cache)
+		cachedUser, ok := cache.get(c.uuid)
+		assert.Equal(t, c.isExpHit, ok, c.desc)
+		if c.isExpHit {
+			assert.Equal(t, c.uuid, cachedUser.GetUuid(), c.desc)
+		}
+		assert.Equal(t, c.expLength, cache.len(), c.desc)
+	}
+
+	desc := "test cached copies do not store password"
+	cache := newMemoryUserCache(2, time.Minute)
+	cache.set(user)
+	assert.Equal(t, "hashed", user.GetPassword(), desc)
+	cachedUser, _ := cache.get(validUUID)
+	assert.Empty(t, cachedUser.GetPassword(), desc)
+	cachedUser.FirstName = "Changed"
+	cachedUser, _ = cache.get(validUUID)
+	assert.Equal(t, user.GetFirstName(), cachedUser.GetFirstName(), desc)
+
+	desc = "test expired user is a miss"
+	cache = newMemoryUserCache(2, time.Nanosecond)
+	cache.set(user)
+	time.Sleep(time.Millisecond)
+	_, ok := cache.get(validUUID)
+	assert.False(t, ok, desc)
+	assert.Equal(t, 0, cache.len(), desc)
+}
+
+func TestCacheCounters(t *testing.T) {
+	original := userRowCache
+	defer func() { userRowCache = original }()
+	userRowCache = newMemoryUserCache(1, time.Minute)
+	userRowCache.set(&pblib.User{Uuid: validUUID, FirstName: "Lisa"})
+
+	desc := "test user cache hit is counted"
+	hits, misses := userCacheCounters.load()
+	cachedUser, err := getCachedUserRow(context.TODO(), validUUID)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "Lisa", cachedUser.GetFirstName(), desc)
+	expHits, expMisses := userCacheCounters.load()
+	assert.Equal(t, hits+1, expHits, desc)
+	assert.Equal(t, misses, expMisses, desc)
+
+	desc = "test token cache miss is counted"
+	hits, misses = tokenCacheCounters.load()
+	_, err = pairTokenWithCachedSecret(context.TODO(), "")
+	assert.NotNil(t, err, desc)
+	expHits, expMisses = tokenCacheCounters.load()
+	assert.Equal(t, hits, expHits, desc)
+	assert.Equal(t, misses+1, expMisses, desc)
+}
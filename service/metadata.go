@@ -0,0 +1,289 @@
+package service
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RPCs added ahead of the hwsc-api-blocks proto contract carry any parameters that
+// UserRequest/UserResponse cannot express as gRPC metadata.
+// Request parameters are read from incoming metadata, results are returned as response headers.
+// Keys ending in "-bin" are base64 encoded by gRPC, use them for values that may not be ASCII.
+const (
+	metadataKeyPrefix        = "x-hwsc-"
+	metadataKeyFromSequence  = "x-hwsc-from-sequence"
+	metadataKeyFromTimestamp = "x-hwsc-from-timestamp"
+	metadataKeyToTimestamp   = "x-hwsc-to-timestamp"
+	metadataKeyLimit         = "x-hwsc-limit"
+	metadataKeyLastSequence  = "x-hwsc-last-sequence"
+	metadataKeyEvent         = "x-hwsc-event-bin"
+	metadataKeyClearFields   = "x-hwsc-clear-fields"
+	metadataKeyMissingUser   = "x-hwsc-missing-user"
+	metadataKeyRowsAffected  = "x-hwsc-rows-affected"
+	metadataKeyUserView      = "x-hwsc-user-view"
+	metadataKeyDays          = "x-hwsc-days"
+	metadataKeyBirthdate     = "x-hwsc-birthdate"
+	metadataKeyParentEmail   = "x-hwsc-parent-email"
+	metadataKeyFromDate      = "x-hwsc-from-date"
+	metadataKeyToDate        = "x-hwsc-to-date"
+	metadataKeyOrganization  = "x-hwsc-organization-bin"
+	metadataKeyUsage         = "x-hwsc-usage-bin"
+
+	// CreateUser request metadata, and CreateUser and GetReferralStats response header with the user's own code
+	metadataKeyReferralCode = "x-hwsc-referral-code"
+
+	// SetOnboardingStep request metadata, x-hwsc-onboarding-completed defaults to "true"
+	metadataKeyOnboardingStep      = "x-hwsc-onboarding-step"
+	metadataKeyOnboardingCompleted = "x-hwsc-onboarding-completed"
+
+	// GetOnboardingState response header
+	metadataKeyOnboardingSteps = "x-hwsc-onboarding-steps"
+
+	// UpdateNotificationPreferences request metadata and notification preference response headers,
+	// "true" or "false" for each email category, x-hwsc-marketing is also read by CreateUser
+	metadataKeyShareAlerts    = "x-hwsc-share-alerts"
+	metadataKeySecurityAlerts = "x-hwsc-security-alerts"
+	metadataKeyMarketing      = "x-hwsc-marketing"
+
+	// QueryAdminActivity response header, a CSV document
+	metadataKeyAdminActivity = "x-hwsc-admin-activity-bin"
+
+	// LinkAuthMethod and UnlinkAuthMethod request metadata, LinkAuthMethod returns the credential id of api keys
+	// in x-hwsc-credential-id and the key, which is not stored, in x-hwsc-api-key
+	metadataKeyAuthMethod   = "x-hwsc-auth-method"
+	metadataKeyCredentialID = "x-hwsc-credential-id"
+	metadataKeyAPIKey       = "x-hwsc-api-key"
+
+	// ListAuthMethods, LinkAuthMethod and UnlinkAuthMethod response header, one value per linked credential
+	metadataKeyAuthMethods = "x-hwsc-auth-methods"
+
+	// AuthenticateUser, Verify2FA and Disable2FA request metadata, a TOTP code or, except for Verify2FA,
+	// a backup code
+	metadataKeyTOTPCode = "x-hwsc-totp-code"
+
+	// Enable2FA response headers, the base32 TOTP secret and its otpauth uri
+	metadataKeyTOTPSecret = "x-hwsc-totp-secret"
+	metadataKeyTOTPURI    = "x-hwsc-totp-uri"
+
+	// Verify2FA response header, one value per backup code
+	metadataKeyBackupCodes = "x-hwsc-backup-codes"
+
+	// CreateAPIKey request metadata, the name of the service api key and the comma separated rpc methods it may
+	// call. CreateAPIKey returns the key id in x-hwsc-api-key-id and the key, which is not stored, in
+	// x-hwsc-api-key, RevokeAPIKey takes the key id
+	metadataKeyAPIKeyName   = "x-hwsc-api-key-name-bin"
+	metadataKeyAPIKeyScopes = "x-hwsc-api-key-scopes"
+	metadataKeyAPIKeyID     = "x-hwsc-api-key-id"
+
+	// ListAPIKeys response header, a CSV document
+	metadataKeyAPIKeys = "x-hwsc-api-keys-bin"
+
+	// response headers of writes rejected by a standby instance, the region that rejected it and the primary's address
+	metadataKeyRegion  = "x-hwsc-region"
+	metadataKeyPrimary = "x-hwsc-primary"
+
+	// CreateUser response header, set to parentalConsentPending when the user cannot sign in until a parent consents
+	metadataKeyParentalConsent = "x-hwsc-parental-consent"
+
+	// GetUserStats response headers
+	metadataKeySignups           = "x-hwsc-signups"
+	metadataKeyVerificationRate  = "x-hwsc-verification-rate"
+	metadataKeyActiveSessions    = "x-hwsc-active-sessions"
+	metadataKeyOrganizationUsers = "x-hwsc-organization-users-bin"
+	metadataKeyEmailFailureRate  = "x-hwsc-email-failure-rate"
+
+	// response header of refused resends and rate limited requests, the seconds until the request may be sent again
+	metadataKeyRetryAfter = "x-hwsc-retry-after"
+
+	// response header of every request relying on a deprecated behavior, such as "error-strings; sunset=2027-04-01"
+	metadataKeyDeprecation = "x-hwsc-deprecation"
+
+	// ListFavorites, FavoriteDocument and UnfavoriteDocument response header, one duid per favorite
+	metadataKeyFavorites = "x-hwsc-favorites"
+
+	// RegisterDocument and SetDocumentPublic request metadata and SetDocumentPublic response header,
+	// "true" or "false", RegisterDocument defaults to "false"
+	metadataKeyPublic = "x-hwsc-public"
+
+	// ListPublicDocuments request metadata, the duid to list documents after, and response header, one duid per document
+	metadataKeyFromDuid        = "x-hwsc-from-duid"
+	metadataKeyPublicDocuments = "x-hwsc-public-documents"
+
+	// ListUserDocuments response header, one duid=true or duid=false value per document, "true" if it is public
+	metadataKeyUserDocuments = "x-hwsc-user-documents"
+
+	// ListSharedWithMe response header, one duid=uuid value per document, the uuid of its owner
+	metadataKeySharedDocuments = "x-hwsc-shared-documents"
+
+	// GetDocumentQuota, RegisterDocument and UnregisterDocument response headers, the documents the user owns and
+	// the quota, which is not set while users own any number of documents
+	metadataKeyDocumentCount = "x-hwsc-document-count"
+	metadataKeyDocumentQuota = "x-hwsc-document-quota"
+
+	// SetSharePolicy request metadata and SetSharePolicy and GetSharePolicy response header, the organization is
+	// set with x-hwsc-organization-bin
+	metadataKeySharePolicy = "x-hwsc-share-policy"
+
+	// ForgetUser response header, the hash of the erasure chaining it to the erasures before, see erasureHash
+	metadataKeyErasureHash = "x-hwsc-erasure-hash"
+
+	// GetUser response header, when the user last used an auth token as RFC 3339
+	metadataKeyLastSeen = "x-hwsc-last-seen"
+
+	// CreateUser and UpdateUser request metadata and CreateUser, UpdateUser and GetUser response headers,
+	// the display name header is derived from the first and last names if the user has not chosen one
+	metadataKeyMiddleName  = "x-hwsc-middle-name-bin"
+	metadataKeyDisplayName = "x-hwsc-display-name-bin"
+
+	// ListUsers request metadata, x-hwsc-page-token continues from a previous page's x-hwsc-next-page-token
+	metadataKeyIsVerified = "x-hwsc-is-verified"
+	metadataKeyPageToken  = "x-hwsc-page-token"
+
+	// ListUsers response headers, x-hwsc-users-last-seen has a uuid=RFC 3339 value per listed user that was seen
+	metadataKeyNextPageToken = "x-hwsc-next-page-token"
+	metadataKeyUsersLastSeen = "x-hwsc-users-last-seen"
+
+	// StreamUsers request metadata, the number of users per response, along with the ListUsers filters
+	metadataKeyChunkSize = "x-hwsc-chunk-size"
+
+	// AuthenticateUser and RefreshAuthToken response header, and RefreshAuthToken and LogoutUser request metadata
+	metadataKeyRefreshToken = "x-hwsc-refresh-token"
+
+	// GetAuditLog response header, a CSV document
+	metadataKeyAuditLog = "x-hwsc-audit-log-bin"
+
+	// GetProfileHistory response header, a CSV document
+	metadataKeyProfileHistory = "x-hwsc-profile-history-bin"
+
+	// GetApiVersions response headers, the comma separated versions served and the version requested
+	metadataKeyAPIVersions = "x-hwsc-api-versions"
+	metadataKeyAPIVersion  = "x-hwsc-api-version"
+
+	// GetReferralStats response headers
+	metadataKeyReferrals         = "x-hwsc-referrals"
+	metadataKeyVerifiedReferrals = "x-hwsc-verified-referrals"
+	metadataKeyReferredBy        = "x-hwsc-referred-by"
+
+	// GetStatus response headers, the schema migration version applied to the database and "true" if it failed
+	// halfway, not set if the database is not managed by migrations
+	metadataKeyMigrationVersion = "x-hwsc-migration-version"
+	metadataKeyMigrationDirty   = "x-hwsc-migration-dirty"
+
+	// SetOrganizationAdmin request metadata, "true" or "false", defaults to "true"
+	metadataKeyOrganizationAdmin = "x-hwsc-organization-admin"
+
+	// DeleteUsersByOrganization request metadata, "true" to return the users that would be deleted without
+	// deleting them, defaults to "false"
+	metadataKeyDryRun = "x-hwsc-dry-run"
+
+	// CreateOrganization, GetOrganization and SetOrganizationAdmin response headers, when and by whom the
+	// organization was made, its member count and one uuid per admin, the organization is set with
+	// x-hwsc-organization-bin
+	metadataKeyOrganizationCreated   = "x-hwsc-organization-created"
+	metadataKeyOrganizationCreatedBy = "x-hwsc-organization-created-by"
+	metadataKeyOrganizationMembers   = "x-hwsc-organization-members"
+	metadataKeyOrganizationAdmins    = "x-hwsc-organization-admins"
+
+	// GetStatus response header, the RFC 3339 time the active auth secret is planned to be rotated at
+	metadataKeySecretRotation = "x-hwsc-secret-rotation"
+
+	// GetStatus response headers, the connections of the user database pool in use and idle, and the number of
+	// times a request waited for a connection since the service started
+	metadataKeyDBInUse     = "x-hwsc-db-in-use"
+	metadataKeyDBIdle      = "x-hwsc-db-idle"
+	metadataKeyDBWaitCount = "x-hwsc-db-wait-count"
+
+	// GetStatus response headers, the number of database reads retried after a transient error, and of those that
+	// still failed after the last attempt, since the service started
+	metadataKeyDBRetries          = "x-hwsc-db-retries"
+	metadataKeyDBRetriesExhausted = "x-hwsc-db-retries-exhausted"
+
+	// GetStatus response headers, the lookups of the user and auth token caches served from the cache and those
+	// that missed it since the service started, user cache lookups are only counted while it is enabled
+	metadataKeyUserCacheHits    = "x-hwsc-user-cache-hits"
+	metadataKeyUserCacheMisses  = "x-hwsc-user-cache-misses"
+	metadataKeyTokenCacheHits   = "x-hwsc-token-cache-hits"
+	metadataKeyTokenCacheMisses = "x-hwsc-token-cache-misses"
+
+	// x-hwsc-missing-user values
+	missingUserOK       = "ok"
+	missingUserNotFound = "notfound"
+
+	// x-hwsc-parental-consent values
+	parentalConsentPending = "pending"
+
+	// x-hwsc-user-view values
+	userViewBasic = "basic"
+	userViewFull  = "full"
+)
+
+// getIncomingMetadata returns the first value of key found in the request metadata.
+// Returns empty string if ctx has no metadata or key is not present.
+func getIncomingMetadata(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return strings.TrimSpace(values[0])
+}
+
+// getIncomingMetadataList returns every comma separated value of key found in the request metadata.
+// Returns nil if key is not present.
+func getIncomingMetadataList(ctx context.Context, key string) []string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	var list []string
+	for _, value := range md.Get(key) {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+
+	return list
+}
+
+// getIncomingMetadataInt64 parses the metadata value of key as an int64.
+// Returns def if key is not present, error if value is not a number.
+func getIncomingMetadataInt64(ctx context.Context, key string, def int64) (int64, error) {
+	value := getIncomingMetadata(ctx, key)
+	if value == "" {
+		return def, nil
+	}
+
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// getIncomingMetadataTime parses the metadata value of key as a RFC 3339 timestamp.
+// Returns zero time if key is not present, error if value is not a RFC 3339 timestamp.
+func getIncomingMetadataTime(ctx context.Context, key string) (time.Time, error) {
+	value := getIncomingMetadata(ctx, key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// setResponseHeader attaches key/values to the response header.
+// Returns error if ctx is not a gRPC server context or headers were already sent.
+func setResponseHeader(ctx context.Context, key string, values ...string) error {
+	md := metadata.MD{}
+	md.Append(key, values...)
+
+	return grpc.SetHeader(ctx, md)
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+func TestGetIncomingMetadata(t *testing.T) {
+	desc := "test context without metadata"
+	assert.Equal(t, "", getIncomingMetadata(context.TODO(), metadataKeyLimit), desc)
+
+	ctx, _ := unitTestServerContext(metadataKeyLimit, " 10 ")
+
+	desc = "test present key is trimmed"
+	assert.Equal(t, "10", getIncomingMetadata(ctx, metadataKeyLimit), desc)
+
+	desc = "test missing key"
+	assert.Equal(t, "", getIncomingMetadata(ctx, metadataKeyFromSequence), desc)
+}
+
+func TestGetIncomingMetadataList(t *testing.T) {
+	desc := "test context without metadata"
+	assert.Nil(t, getIncomingMetadataList(context.TODO(), metadataKeyClearFields), desc)
+
+	ctx, _ := unitTestServerContext(metadataKeyClearFields, " organization, ,locale ",
+		metadataKeyClearFields, "email")
+
+	desc = "test values are split, trimmed and merged"
+	assert.Equal(t, []string{"organization", "locale", "email"},
+		getIncomingMetadataList(ctx, metadataKeyClearFields), desc)
+
+	desc = "test missing key"
+	assert.Nil(t, getIncomingMetadataList(ctx, metadataKeyLimit), desc)
+}
+
+func TestGetIncomingMetadataInt64(t *testing.T) {
+	ctx, _ := unitTestServerContext(metadataKeyLimit, "10", metadataKeyFromSequence, "ten")
+
+	desc := "test valid number"
+	value, err := getIncomingMetadataInt64(ctx, metadataKeyLimit, 1)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, int64(10), value, desc)
+
+	desc = "test default value"
+	value, err = getIncomingMetadataInt64(ctx, metadataKeyLastSequence, 1)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, int64(1), value, desc)
+
+	desc = "test invalid number"
+	_, err = getIncomingMetadataInt64(ctx, metadataKeyFromSequence, 1)
+	assert.NotNil(t, err, desc)
+}
+
+func TestGetIncomingMetadataTime(t *testing.T) {
+	ctx, _ := unitTestServerContext(metadataKeyFromTimestamp, "2019-03-31T05:45:17Z", metadataKeyLimit, "now")
+
+	desc := "test valid timestamp"
+	value, err := getIncomingMetadataTime(ctx, metadataKeyFromTimestamp)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, time.Date(2019, 3, 31, 5, 45, 17, 0, time.UTC), value.UTC(), desc)
+
+	desc = "test missing timestamp"
+	value, err = getIncomingMetadataTime(ctx, metadataKeyFromSequence)
+	assert.Nil(t, err, desc)
+	assert.True(t, value.IsZero(), desc)
+
+	desc = "test invalid timestamp"
+	_, err = getIncomingMetadataTime(ctx, metadataKeyLimit)
+	assert.NotNil(t, err, desc)
+}
+
+func TestSetResponseHeader(t *testing.T) {
+	desc := "test context without server stream"
+	err := setResponseHeader(context.TODO(), metadataKeyLastSequence, "1")
+	assert.NotNil(t, err, desc)
+
+	desc = "test multiple values"
+	ctx, stream := unitTestServerContext()
+	err = setResponseHeader(ctx, metadataKeyEvent, "one", "two")
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{"one", "two"}, stream.header.Get(metadataKeyEvent), desc)
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	bindata "github.com/golang-migrate/migrate/v4/source/go_bindata"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"path"
+)
+
+const (
+	// migrationDirectory holds the golang-migrate files of the user_svc schema, the tests apply the same files
+	// and seed test_fixtures/psql on top
+	migrationDirectory = "migrations"
+
+	// migrationSourceName names the embedded migrations in golang-migrate errors
+	migrationSourceName = "go-bindata"
+)
+
+var (
+	// migrationFiles are the migrations of migrationDirectory built into the binary
+	//go:embed migrations/*.sql
+	migrationFiles embed.FS
+
+	// migrateOnStartup is set with hosts_schema_migrate, see MigrateSchema
+	migrateOnStartup bool
+)
+
+func init() {
+	migrateOnStartup = parseValidationSwitch("migrate on startup", conf.SchemaCompat.Migrate)
+}
+
+// newMigration returns a golang-migrate instance applying the embedded migrations to db.
+// Closing the instance closes db.
+func newMigration(db *sql.DB) (*migrate.Migrate, error) {
+	entries, err := migrationFiles.ReadDir(migrationDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	source, err := bindata.WithInstance(bindata.Resource(names, func(name string) ([]byte, error) {
+		return migrationFiles.ReadFile(path.Join(migrationDirectory, name))
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	return migrate.NewWithInstance(migrationSourceName, source, dbDriverName, driver)
+}
+
+// MigrateSchema applies the pending embedded migrations to the user database if hosts_schema_migrate is "true",
+// over a connection of its own. golang-migrate locks the database, instances starting together apply them once.
+// Returns error if the database cannot be reached or a migration fails, the service should not start.
+func MigrateSchema() error {
+	if !migrateOnStartup {
+		return nil
+	}
+
+	db, err := sql.Open(dbDriverName, connectionString)
+	if err != nil {
+		return err
+	}
+
+	migration, err := newMigration(db)
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+	defer func() {
+		_, _ = migration.Close()
+	}()
+
+	if err := migration.Up(); err != nil && err != migrate.ErrNoChange {
+		return err
+	}
+
+	version, _, err := migration.Version()
+	if err != nil {
+		return err
+	}
+	logger.Info(consts.MigrationTag, "Database schema at migration", fmt.Sprint(version))
+
+	return nil
+}
+
+// schemaMigrationVersion returns the migration version recorded by golang-migrate and whether it failed halfway.
+// Returns ok false if the database is not managed by migrations, error if it cannot be read.
+func schemaMigrationVersion(ctx context.Context) (version int64, dirty bool, ok bool, err error) {
+	var tracked bool
+	if err := postgresDB.QueryRowContext(ctx,
+		`SELECT to_regclass('public.schema_migrations') IS NOT NULL`).Scan(&tracked); err != nil {
+		return 0, false, false, err
+	}
+	if !tracked {
+		return 0, false, false, nil
+	}
+
+	err = postgresDB.QueryRowContext(ctx,
+		`SELECT version, dirty FROM public.schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err == sql.ErrNoRows {
+		return 0, false, false, nil
+	}
+	if err != nil {
+		return 0, false, false, err
+	}
+
+	return version, dirty, true, nil
+}
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS user_security.user_security_auth_tokens_expiration_index;
+DROP INDEX IF EXISTS user_svc.user_svc_accounts_created_index;
+DROP INDEX IF EXISTS user_svc.user_svc_email_deliveries_created_index;
+DROP TABLE IF EXISTS user_svc.email_deliveries;
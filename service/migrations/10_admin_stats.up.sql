@@ -0,0 +1,15 @@
+-- every email send attempt, used to report the email failure rate
+CREATE TABLE user_svc.email_deliveries
+(
+    template          TEXT        NOT NULL,
+    succeeded         BOOLEAN     NOT NULL,
+    created_timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_svc_email_deliveries_created_index ON user_svc.email_deliveries (created_timestamp);
+
+-- signups per day are counted over a range of created_timestamp
+CREATE INDEX user_svc_accounts_created_index ON user_svc.accounts (created_timestamp);
+
+-- active sessions are counted over unexpired auth tokens
+CREATE INDEX user_security_auth_tokens_expiration_index ON user_security.auth_tokens (expiration_timestamp);
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS user_svc.parental_consent_tokens;
+
+ALTER TABLE user_svc.accounts
+    DROP COLUMN IF EXISTS birthdate,
+    DROP COLUMN IF EXISTS parental_consent_required,
+    DROP COLUMN IF EXISTS parental_consent_timestamp;
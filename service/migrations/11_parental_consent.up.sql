@@ -0,0 +1,15 @@
+-- users under 13 at signup cannot log in until a parent consents
+ALTER TABLE user_svc.accounts
+    ADD COLUMN birthdate                  DATE DEFAULT NULL,
+    ADD COLUMN parental_consent_required  BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN parental_consent_timestamp TIMESTAMPTZ DEFAULT NULL;
+
+CREATE TABLE user_svc.parental_consent_tokens
+(
+    token                TEXT PRIMARY KEY,
+    secret_key           TEXT         NOT NULL,
+    parent_email         VARCHAR(320) NOT NULL,
+    created_timestamp    TIMESTAMPTZ  NOT NULL,
+    expiration_timestamp TIMESTAMPTZ  NOT NULL,
+    uuid                 ulid UNIQUE REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS user_svc.user_svc_events_subject_index;
+DROP INDEX IF EXISTS user_svc.user_svc_events_type_created_index;
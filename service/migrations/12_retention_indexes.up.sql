@@ -0,0 +1,3 @@
+-- the retention job finds deleted users by event type and anonymizes their events by subject
+CREATE INDEX user_svc_events_type_created_index ON user_svc.events (type, created_timestamp);
+CREATE INDEX user_svc_events_subject_index ON user_svc.events (subject);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS user_svc.user_svc_usage_records_unreported_index;
+DROP TABLE IF EXISTS user_svc.usage_records;
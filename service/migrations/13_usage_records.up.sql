@@ -0,0 +1,12 @@
+-- daily seat counts per organization, reported_timestamp is set once the billing reporter accepted the record
+CREATE TABLE user_svc.usage_records
+(
+    PRIMARY KEY (day, organization),
+    day                DATE        NOT NULL,
+    organization       TEXT        NOT NULL,
+    seats              BIGINT      NOT NULL,
+    created_timestamp  TIMESTAMPTZ NOT NULL,
+    reported_timestamp TIMESTAMPTZ DEFAULT NULL
+);
+
+CREATE INDEX user_svc_usage_records_unreported_index ON user_svc.usage_records (day) WHERE reported_timestamp IS NULL;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS user_svc.referrals;
+
+ALTER TABLE user_svc.accounts
+    DROP COLUMN IF EXISTS referral_code;
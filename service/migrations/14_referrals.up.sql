@@ -0,0 +1,20 @@
+-- every user has a code to share, users created with a code are linked to the code's owner
+ALTER TABLE user_svc.accounts
+    ADD COLUMN referral_code TEXT UNIQUE DEFAULT NULL;
+
+UPDATE user_svc.accounts
+SET referral_code = upper(substr(md5(uuid || random()::TEXT), 1, 10))
+WHERE referral_code IS NULL;
+
+ALTER TABLE user_svc.accounts
+    ALTER COLUMN referral_code SET NOT NULL;
+
+CREATE TABLE user_svc.referrals
+(
+    referee_uuid      ulid PRIMARY KEY REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    referrer_uuid     ulid        NOT NULL REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    referral_code     TEXT        NOT NULL,
+    created_timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_svc_referrals_referrer_index ON user_svc.referrals (referrer_uuid);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS user_svc.onboarding_steps;
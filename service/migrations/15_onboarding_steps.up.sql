@@ -0,0 +1,8 @@
+-- onboarding checklist progress, one row per completed step
+CREATE TABLE user_svc.onboarding_steps
+(
+    uuid                ulid        NOT NULL REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    step                TEXT        NOT NULL,
+    completed_timestamp TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (uuid, step)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE user_svc.accounts
+    DROP COLUMN IF EXISTS share_alerts,
+    DROP COLUMN IF EXISTS security_alerts;
@@ -0,0 +1,4 @@
+-- email categories users can switch off, marketing emails are already covered by marketing_opt_in
+ALTER TABLE user_svc.accounts
+    ADD COLUMN share_alerts    BOOLEAN NOT NULL DEFAULT TRUE,
+    ADD COLUMN security_alerts BOOLEAN NOT NULL DEFAULT TRUE;
@@ -0,0 +1,11 @@
+-- every call authorized with an admin token, kept after the admin is deleted for compliance reviews
+CREATE TABLE user_svc.admin_actions
+(
+    sequence          BIGSERIAL PRIMARY KEY,
+    actor             ulid        NOT NULL,
+    action            TEXT        NOT NULL,
+    subject           TEXT        NOT NULL DEFAULT '',
+    created_timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_svc_admin_actions_created_index ON user_svc.admin_actions (created_timestamp);
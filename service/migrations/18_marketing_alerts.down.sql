@@ -0,0 +1,2 @@
+ALTER TABLE user_svc.accounts
+    DROP COLUMN IF EXISTS marketing_alerts;
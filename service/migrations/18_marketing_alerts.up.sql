@@ -0,0 +1,4 @@
+-- expand step of renaming marketing_opt_in to marketing_alerts, in line with the other email categories.
+-- The column stays nullable without a default until the contract step backfills it, see service/compat.go
+ALTER TABLE user_svc.accounts
+    ADD COLUMN marketing_alerts BOOLEAN;
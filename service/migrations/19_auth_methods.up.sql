@@ -0,0 +1,13 @@
+-- sign in methods linked to an account besides its password, which is linked while accounts.password is not empty.
+-- credential_id is the google subject, the webauthn credential id, or the public part of an api key
+CREATE TABLE user_svc.auth_methods
+(
+    PRIMARY KEY (method, credential_id),
+    method            TEXT        NOT NULL CHECK (method IN ('google', 'webauthn', 'apikey')),
+    credential_id     TEXT        NOT NULL,
+    secret            TEXT DEFAULT NULL,
+    uuid              ulid REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    created_timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_svc_auth_methods_uuid_index ON user_svc.auth_methods (uuid);
@@ -0,0 +1,2 @@
+ALTER TABLE user_security.auth_tokens
+    DROP COLUMN IF EXISTS last_activity;
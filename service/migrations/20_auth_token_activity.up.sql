@@ -0,0 +1,4 @@
+-- auth tokens unused for longer than hosts_auth_idletimeout are expired, tokens issued before this migration
+-- have no last_activity and are counted from their first use
+ALTER TABLE user_security.auth_tokens
+    ADD COLUMN last_activity TIMESTAMPTZ DEFAULT NULL;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS user_security.login_countries;
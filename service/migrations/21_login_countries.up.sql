@@ -0,0 +1,13 @@
+-- countries accounts signed in from, resolved from the client ip. Unconfirmed countries were first seen while
+-- hosts_geoip_forcereverify was on, their logins are refused until the token emailed to the user is confirmed
+CREATE TABLE user_security.login_countries
+(
+    PRIMARY KEY (uuid, country),
+    uuid                    ulid REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    country                 CHAR(2)     NOT NULL,
+    first_seen_timestamp    TIMESTAMPTZ NOT NULL,
+    last_seen_timestamp     TIMESTAMPTZ NOT NULL,
+    confirmed               BOOLEAN     NOT NULL,
+    confirmation_token      TEXT UNIQUE DEFAULT NULL,
+    confirmation_expiration TIMESTAMPTZ DEFAULT NULL
+);
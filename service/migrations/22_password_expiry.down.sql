@@ -0,0 +1,3 @@
+ALTER TABLE user_svc.accounts
+    DROP COLUMN IF EXISTS password_changed_timestamp,
+    DROP COLUMN IF EXISTS password_reminder_timestamp;
@@ -0,0 +1,5 @@
+-- passwords of existing accounts start aging when the column is added, so a max age cannot lock everyone out at once.
+-- password_reminder_timestamp is when the user was last reminded the current password expires
+ALTER TABLE user_svc.accounts
+    ADD COLUMN password_changed_timestamp  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ADD COLUMN password_reminder_timestamp TIMESTAMPTZ DEFAULT NULL;
@@ -0,0 +1,12 @@
+-- changes users made to their own profile, values are salted sha-256 hashes so no old personal data is kept
+CREATE TABLE user_svc.profile_changes
+(
+    sequence          BIGSERIAL PRIMARY KEY,
+    uuid              ulid REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    field             TEXT        NOT NULL,
+    old_hash          TEXT        NOT NULL,
+    new_hash          TEXT        NOT NULL,
+    created_timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_svc_profile_changes_uuid_index ON user_svc.profile_changes (uuid, sequence);
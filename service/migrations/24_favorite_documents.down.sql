@@ -0,0 +1 @@
+DROP TABLE IF EXISTS user_svc.favorite_documents;
@@ -0,0 +1,10 @@
+-- documents users pinned, a favorite is removed with its user or document
+CREATE TABLE user_svc.favorite_documents
+(
+    PRIMARY KEY (uuid, duid),
+    uuid              ulid REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    duid              user_svc.ksuid REFERENCES user_svc.documents (duid) ON DELETE CASCADE,
+    created_timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_svc_favorite_documents_duid_index ON user_svc.favorite_documents (duid);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS user_svc.user_svc_documents_uuid_index;
@@ -0,0 +1,2 @@
+-- documents are counted per owner against the document quota
+CREATE INDEX user_svc_documents_uuid_index ON user_svc.documents (uuid);
@@ -0,0 +1,11 @@
+-- every change of a document's is_public flag, kept after the document or its owner is deleted for audits
+CREATE TABLE user_svc.document_visibility_changes
+(
+    sequence          BIGSERIAL PRIMARY KEY,
+    duid              user_svc.ksuid NOT NULL,
+    actor             ulid           NOT NULL,
+    is_public         BOOLEAN        NOT NULL,
+    created_timestamp TIMESTAMPTZ    NOT NULL
+);
+
+CREATE INDEX user_svc_document_visibility_changes_duid_index ON user_svc.document_visibility_changes (duid);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS user_svc.user_svc_accounts_organization_index;
+DROP TABLE IF EXISTS user_svc.share_policies;
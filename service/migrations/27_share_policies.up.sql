@@ -0,0 +1,11 @@
+-- how documents registered by members of an organization are shared by default, organizations without a policy
+-- share nothing by default
+CREATE TABLE user_svc.share_policies
+(
+    organization      TEXT PRIMARY KEY,
+    rule              TEXT        NOT NULL,
+    updated_by        ulid        NOT NULL,
+    updated_timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_svc_accounts_organization_index ON user_svc.accounts (organization);
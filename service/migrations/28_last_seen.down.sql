@@ -0,0 +1 @@
+ALTER TABLE user_svc.accounts DROP COLUMN IF EXISTS last_seen_timestamp;
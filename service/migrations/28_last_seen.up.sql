@@ -0,0 +1,2 @@
+-- coarse presence, rounded down to the presence granularity of the service
+ALTER TABLE user_svc.accounts ADD COLUMN last_seen_timestamp TIMESTAMPTZ;
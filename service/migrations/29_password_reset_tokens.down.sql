@@ -0,0 +1 @@
+DROP TABLE IF EXISTS user_svc.password_reset_tokens;
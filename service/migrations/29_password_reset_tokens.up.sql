@@ -0,0 +1,9 @@
+-- a user has at most one pending password reset, a new request replaces the previous token
+CREATE TABLE user_svc.password_reset_tokens
+(
+    token                TEXT PRIMARY KEY,
+    secret_key           TEXT        NOT NULL,
+    created_timestamp    TIMESTAMPTZ NOT NULL,
+    expiration_timestamp TIMESTAMPTZ NOT NULL,
+    uuid                 ulid UNIQUE REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE
+);
@@ -0,0 +1,10 @@
+-- refresh tokens are exchanged for auth tokens with RefreshAuthToken, only their sha-256 is stored
+CREATE TABLE user_security.refresh_tokens
+(
+    token_hash           TEXT PRIMARY KEY,
+    uuid                 ulid        NOT NULL REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    created_timestamp    TIMESTAMPTZ NOT NULL,
+    expiration_timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_security_refresh_tokens_uuid_index ON user_security.refresh_tokens (uuid);
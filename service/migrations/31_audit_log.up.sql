@@ -0,0 +1,12 @@
+-- every successful mutation, kept after the actor or target is deleted for compliance reviews
+CREATE TABLE user_svc.audit_log
+(
+    sequence          BIGSERIAL PRIMARY KEY,
+    actor             TEXT        NOT NULL DEFAULT '',
+    action            TEXT        NOT NULL,
+    target            TEXT        NOT NULL DEFAULT '',
+    metadata          JSONB       NOT NULL DEFAULT '{}',
+    created_timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_svc_audit_log_created_index ON user_svc.audit_log (created_timestamp);
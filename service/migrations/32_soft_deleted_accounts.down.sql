@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS user_svc.user_svc_accounts_deleted_index;
+ALTER TABLE user_svc.accounts DROP COLUMN IF EXISTS deleted_timestamp;
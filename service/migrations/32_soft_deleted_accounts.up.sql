@@ -0,0 +1,5 @@
+-- accounts deleted with DeleteUser while soft deletion is on, purged by the retention job after the grace period
+ALTER TABLE user_svc.accounts ADD COLUMN deleted_timestamp TIMESTAMPTZ;
+
+CREATE INDEX user_svc_accounts_deleted_index ON user_svc.accounts (deleted_timestamp)
+    WHERE deleted_timestamp IS NOT NULL;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS user_svc.email_change_tokens;
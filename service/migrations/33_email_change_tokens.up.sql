@@ -0,0 +1,10 @@
+-- a user has at most one pending email change, a new UpdateUser email replaces the previous token
+CREATE TABLE user_svc.email_change_tokens
+(
+    token                TEXT PRIMARY KEY,
+    secret_key           TEXT         NOT NULL,
+    email                VARCHAR(320) NOT NULL,
+    created_timestamp    TIMESTAMPTZ  NOT NULL,
+    expiration_timestamp TIMESTAMPTZ  NOT NULL,
+    uuid                 ulid UNIQUE REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE
+);
@@ -0,0 +1,19 @@
+-- rendered emails waiting to be sent by the email queue, rows are deleted once sent
+-- rows whose last attempt failed keep dead_timestamp set for investigation
+CREATE TABLE user_svc.email_outbox
+(
+    id                     BIGSERIAL PRIMARY KEY,
+    sender                 VARCHAR(320) NOT NULL,
+    recipients             TEXT[]       NOT NULL,
+    subject                TEXT         NOT NULL,
+    body                   TEXT         NOT NULL,
+    template               TEXT         NOT NULL,
+    attempts               INTEGER      NOT NULL DEFAULT 0,
+    last_error             TEXT,
+    created_timestamp      TIMESTAMPTZ  NOT NULL,
+    next_attempt_timestamp TIMESTAMPTZ  NOT NULL,
+    dead_timestamp         TIMESTAMPTZ
+);
+
+CREATE INDEX user_svc_email_outbox_next_attempt_index ON user_svc.email_outbox (next_attempt_timestamp)
+    WHERE dead_timestamp IS NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE user_svc.email_outbox
+    DROP COLUMN IF EXISTS text_body;
@@ -0,0 +1,3 @@
+-- plain text alternative of body, empty if the email is html only
+ALTER TABLE user_svc.email_outbox
+    ADD COLUMN text_body TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS user_security.user_security_token_revocations_expiration_index;
+DROP TABLE IF EXISTS user_security.token_revocations;
@@ -0,0 +1,10 @@
+-- auth tokens revoked one at a time by LogoutUser, kept until the token would have expired
+CREATE TABLE user_security.token_revocations
+(
+    token_hash           TEXT PRIMARY KEY,
+    uuid                 ulid        NOT NULL,
+    revoked_timestamp    TIMESTAMPTZ NOT NULL,
+    expiration_timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_security_token_revocations_expiration_index ON user_security.token_revocations (expiration_timestamp);
@@ -0,0 +1,3 @@
+ALTER TABLE user_svc.accounts DROP CONSTRAINT IF EXISTS user_svc_accounts_organization_fkey;
+DROP TABLE IF EXISTS user_svc.organization_admins;
+DROP TABLE IF EXISTS user_svc.organizations;
@@ -0,0 +1,32 @@
+-- the tenants of the service, organizations named by accounts before the table existed have no creator
+CREATE TABLE user_svc.organizations
+(
+    name              TEXT PRIMARY KEY,
+    created_by        VARCHAR(26) DEFAULT NULL,
+    created_timestamp TIMESTAMPTZ NOT NULL
+);
+
+-- members that administer their organization, an admin stops being one when they leave it
+CREATE TABLE user_svc.organization_admins
+(
+    PRIMARY KEY (organization, uuid),
+    organization      TEXT REFERENCES user_svc.organizations (name) ON DELETE CASCADE,
+    uuid              ulid REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    granted_by        ulid,
+    granted_timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_svc_organization_admins_uuid_index ON user_svc.organization_admins (uuid);
+
+-- an empty organization is no organization
+UPDATE user_svc.accounts SET organization = NULL WHERE organization = '';
+
+INSERT INTO user_svc.organizations(name, created_timestamp)
+SELECT organization, MIN(created_timestamp)
+FROM user_svc.accounts
+WHERE organization IS NOT NULL
+GROUP BY organization;
+
+ALTER TABLE user_svc.accounts
+    ADD CONSTRAINT user_svc_accounts_organization_fkey FOREIGN KEY (organization)
+        REFERENCES user_svc.organizations (name);
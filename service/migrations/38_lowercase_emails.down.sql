@@ -0,0 +1 @@
+-- the case of emails stored before they were lowercased is not kept, they stay lowercased
@@ -0,0 +1,7 @@
+-- emails are stored lowercased by normalizeEmail, the LOWER(email) unique index already keeps the accounts from
+-- sharing an email in any case, so lowercasing the emails stored before cannot collide
+UPDATE user_svc.accounts SET email = LOWER(email) WHERE email <> LOWER(email);
+
+UPDATE user_svc.accounts SET prospective_email = LOWER(prospective_email)
+WHERE prospective_email <> LOWER(prospective_email);
+
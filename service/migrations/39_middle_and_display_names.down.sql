@@ -0,0 +1,3 @@
+ALTER TABLE user_svc.accounts
+    DROP COLUMN IF EXISTS middle_name,
+    DROP COLUMN IF EXISTS display_name;
@@ -0,0 +1,5 @@
+-- middle_name is validated like first_name by the service, display_name may be any printable text,
+-- accounts without a display_name go by their first and last names
+ALTER TABLE user_svc.accounts
+    ADD COLUMN middle_name  VARCHAR(32) DEFAULT NULL CHECK (middle_name !~ '[[:cntrl:]0-9]'),
+    ADD COLUMN display_name VARCHAR(64) DEFAULT NULL CHECK (display_name !~ '[[:cntrl:]]');
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS user_svc.erasures;
+ALTER TABLE user_svc.accounts DROP COLUMN IF EXISTS forgotten_timestamp;
@@ -0,0 +1,14 @@
+-- accounts anonymized by ForgetUser keep their uuid, they are never restored or purged
+ALTER TABLE user_svc.accounts ADD COLUMN forgotten_timestamp TIMESTAMPTZ;
+
+-- the register of erasures, each hash covers the previous entry's hash so editing or removing an entry
+-- breaks the chain of every entry after it
+CREATE TABLE user_svc.erasures
+(
+    sequence          BIGSERIAL PRIMARY KEY,
+    uuid              ulid        NOT NULL,
+    actor             TEXT        NOT NULL DEFAULT '',
+    previous_hash     TEXT        NOT NULL,
+    hash              TEXT        NOT NULL,
+    created_timestamp TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,20 @@
+-- TOTP secrets of two-factor authentication, encrypted with hosts_auth_totpkey. enabled_timestamp is set once
+-- Verify2FA confirmed the user's authenticator has the secret, codes of last_used_step or before are refused
+-- so a code cannot be replayed
+CREATE TABLE user_security.totp_secrets
+(
+    uuid              ulid PRIMARY KEY REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    secret            BYTEA       NOT NULL,
+    last_used_step    BIGINT      NOT NULL DEFAULT 0,
+    created_timestamp TIMESTAMPTZ NOT NULL,
+    enabled_timestamp TIMESTAMPTZ DEFAULT NULL
+);
+
+-- one-time backup codes of two-factor authentication, only their sha-256 is stored
+CREATE TABLE user_security.backup_codes
+(
+    PRIMARY KEY (uuid, code_hash),
+    uuid           ulid NOT NULL REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    code_hash      TEXT NOT NULL,
+    used_timestamp TIMESTAMPTZ DEFAULT NULL
+);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS user_security.service_api_keys;
@@ -0,0 +1,12 @@
+-- api keys of other hwsc services, see CreateAPIKey. Only the sha-256 of a key is stored, key_id is the public
+-- part of the key it is looked up by. scopes are the rpc methods the key may call
+CREATE TABLE user_security.service_api_keys
+(
+    key_id            ulid PRIMARY KEY,
+    name              TEXT        NOT NULL,
+    key_hash          TEXT        NOT NULL,
+    scopes            TEXT[]      NOT NULL,
+    created_by        TEXT        NOT NULL DEFAULT '',
+    created_timestamp TIMESTAMPTZ NOT NULL,
+    revoked_timestamp TIMESTAMPTZ DEFAULT NULL
+);
@@ -0,0 +1 @@
+-- the dummy user is not restored, the tests seed it from test_fixtures/psql/dummy_user.sql
@@ -0,0 +1,5 @@
+-- the dummy user of the test fixtures was applied as migration 3 to every database, it is only seeded by the tests
+DELETE
+FROM user_svc.accounts
+WHERE uuid = '01d793kwwv8ncaamd1b3yr5w48'
+  AND email = 'hwss2018@outlook.com';
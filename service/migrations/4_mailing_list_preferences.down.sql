@@ -0,0 +1,3 @@
+ALTER TABLE user_svc.accounts
+    DROP COLUMN IF EXISTS locale,
+    DROP COLUMN IF EXISTS marketing_opt_in;
@@ -0,0 +1,3 @@
+ALTER TABLE user_svc.accounts
+    ADD COLUMN locale           VARCHAR(35) DEFAULT NULL,
+    ADD COLUMN marketing_opt_in BOOLEAN NOT NULL DEFAULT FALSE;
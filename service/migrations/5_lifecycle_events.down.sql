@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS user_svc.user_svc_events_created_index;
+DROP TABLE IF EXISTS user_svc.events;
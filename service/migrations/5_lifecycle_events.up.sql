@@ -0,0 +1,11 @@
+CREATE TABLE user_svc.events
+(
+    sequence          BIGSERIAL PRIMARY KEY,
+    id                ulid UNIQUE,
+    type              TEXT        NOT NULL,
+    subject           TEXT        NOT NULL,
+    created_timestamp TIMESTAMPTZ NOT NULL,
+    envelope          JSONB       NOT NULL
+);
+
+CREATE INDEX user_svc_events_created_index ON user_svc.events (created_timestamp);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS user_security.user_security_revocations_revoked_index;
+DROP TABLE IF EXISTS user_security.revocations;
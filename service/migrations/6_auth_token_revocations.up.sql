@@ -0,0 +1,7 @@
+CREATE TABLE user_security.revocations
+(
+    uuid              ulid        NOT NULL,
+    revoked_timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_security_revocations_revoked_index ON user_security.revocations (revoked_timestamp);
@@ -0,0 +1,3 @@
+ALTER DOMAIN user_svc.user_name DROP CONSTRAINT user_name_check;
+ALTER DOMAIN user_svc.user_name ADD CONSTRAINT user_name_check
+    CHECK (VALUE ~ '^[[:alpha:]]+(([''.\s-][[:alpha:]\s])?[[:alpha:]]*)*$');
@@ -0,0 +1,5 @@
+-- postgres regex classes can't express unicode letters,
+-- name characters are validated by the service
+ALTER DOMAIN user_svc.user_name DROP CONSTRAINT user_name_check;
+ALTER DOMAIN user_svc.user_name ADD CONSTRAINT user_name_check
+    CHECK (VALUE !~ '[[:cntrl:]0-9]');
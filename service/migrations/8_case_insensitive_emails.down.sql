@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS user_svc.user_svc_accounts_prospective_email_lower_index;
+DROP INDEX IF EXISTS user_svc.user_svc_accounts_email_lower_index;
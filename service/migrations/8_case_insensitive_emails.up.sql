@@ -0,0 +1,2 @@
+CREATE UNIQUE INDEX user_svc_accounts_email_lower_index ON user_svc.accounts (LOWER(email));
+CREATE INDEX user_svc_accounts_prospective_email_lower_index ON user_svc.accounts (LOWER(prospective_email));
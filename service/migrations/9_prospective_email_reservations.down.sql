@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS user_svc.user_svc_email_reservations_uuid_index;
+DROP TABLE IF EXISTS user_svc.email_reservations;
@@ -0,0 +1,17 @@
+-- email holds the lower cased prospective email, only one user can hold it until expiration_timestamp
+CREATE TABLE user_svc.email_reservations
+(
+    email                VARCHAR(320) PRIMARY KEY,
+    uuid                 ulid REFERENCES user_svc.accounts (uuid) ON DELETE CASCADE,
+    expiration_timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX user_svc_email_reservations_uuid_index ON user_svc.email_reservations (uuid);
+
+-- pending email changes keep their hold until their verification token expires
+INSERT INTO user_svc.email_reservations (email, uuid, expiration_timestamp)
+SELECT LOWER(accounts.prospective_email), accounts.uuid, COALESCE(email_tokens.expiration_timestamp, NOW())
+FROM user_svc.accounts
+         LEFT JOIN user_svc.email_tokens ON email_tokens.uuid = accounts.uuid
+WHERE accounts.prospective_email IS NOT NULL
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMigrationFiles(t *testing.T) {
+	files, err := ioutil.ReadDir(migrationDirectory)
+	assert.Nil(t, err)
+
+	entries, err := migrationFiles.ReadDir(migrationDirectory)
+	assert.Nil(t, err)
+	assert.Equal(t, len(files), len(entries), "test every migration file is embedded")
+
+	directions := make(map[uint]map[source.Direction]bool)
+	for _, entry := range entries {
+		m, err := source.DefaultParse(entry.Name())
+		if !assert.Nil(t, err, entry.Name()) {
+			continue
+		}
+		if directions[m.Version] == nil {
+			directions[m.Version] = make(map[source.Direction]bool)
+		}
+		assert.False(t, directions[m.Version][m.Direction], "test duplicate migration %s", entry.Name())
+		directions[m.Version][m.Direction] = true
+	}
+
+	// version 3 was the dummy user of the tests, it is now seeded from unitTestSeedFile
+	assert.Nil(t, directions[3], "test version 3 is retired")
+	for version, direction := range directions {
+		assert.True(t, direction[source.Up], "test migration %d has an up file", version)
+		assert.True(t, direction[source.Down], "test migration %d has a down file", version)
+	}
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"sort"
+	"strconv"
+)
+
+// notificationPreferences are the optional email categories a user receives
+type notificationPreferences struct {
+	shareAlerts    bool
+	securityAlerts bool
+	marketing      bool
+}
+
+const (
+	// emailCategoryAccount emails are needed to use the account, such as verification links, and are always sent
+	emailCategoryAccount        = "account"
+	emailCategoryShareAlerts    = "share_alerts"
+	emailCategorySecurityAlerts = "security_alerts"
+	emailCategoryMarketing      = "marketing"
+)
+
+var (
+	// templateCategories maps email templates to their category, templates not listed are account emails
+	templateCategories = map[string]string{
+		templateVerifyEmail:        emailCategoryAccount,
+		templateConfirmEmailChange: emailCategoryAccount,
+		templateParentalConsent:    emailCategoryAccount,
+		templateSecurityAlert:      emailCategorySecurityAlerts,
+		templateVerifyLoginCountry: emailCategoryAccount,
+		templatePasswordExpiry:     emailCategoryAccount,
+		templatePasswordReset:      emailCategoryAccount,
+	}
+
+	// notificationMetadataKeys maps the optional categories to their metadata keys
+	notificationMetadataKeys = map[string]string{
+		emailCategoryShareAlerts:    metadataKeyShareAlerts,
+		emailCategorySecurityAlerts: metadataKeySecurityAlerts,
+		emailCategoryMarketing:      metadataKeyMarketing,
+	}
+
+	// notificationColumns maps the optional categories to their user_svc.accounts column
+	notificationColumns = map[string]string{
+		emailCategoryShareAlerts:    "share_alerts",
+		emailCategorySecurityAlerts: "security_alerts",
+		emailCategoryMarketing:      "marketing_opt_in",
+	}
+)
+
+// allows returns true if emails of category may be sent.
+func (p *notificationPreferences) allows(category string) bool {
+	switch category {
+	case emailCategoryShareAlerts:
+		return p.shareAlerts
+	case emailCategorySecurityAlerts:
+		return p.securityAlerts
+	case emailCategoryMarketing:
+		return p.marketing
+	}
+
+	return true
+}
+
+// setResponseHeaders returns every optional category as a response header, see Service.GetNotificationPreferences.
+func (p *notificationPreferences) setResponseHeaders(ctx context.Context) error {
+	categories := make([]string, 0, len(notificationMetadataKeys))
+	for category := range notificationMetadataKeys {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	for _, category := range categories {
+		value := strconv.FormatBool(p.allows(category))
+		if err := setResponseHeader(ctx, notificationMetadataKeys[category], value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseNotificationPreferences reads the categories switched on or off in the request metadata.
+// Returns ErrInvalidNotificationSetting if a value is not a boolean or no category is set.
+func parseNotificationPreferences(ctx context.Context) (map[string]bool, error) {
+	updates := make(map[string]bool)
+	for category, key := range notificationMetadataKeys {
+		value := getIncomingMetadata(ctx, key)
+		if value == "" {
+			continue
+		}
+
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, consts.ErrInvalidNotificationSetting
+		}
+		updates[category] = enabled
+	}
+
+	if len(updates) == 0 {
+		return nil, consts.ErrInvalidNotificationSetting
+	}
+
+	return updates, nil
+}
+
+// emailAllowed checks the notification preferences of uuid for an email of category, account emails are always allowed.
+// Returns error if the preferences could not be looked up.
+func emailAllowed(ctx context.Context, uuid string, category string) (bool, error) {
+	if category == emailCategoryAccount {
+		return true, nil
+	}
+
+	preferences, err := getNotificationPreferences(ctx, uuid)
+	if err != nil {
+		return false, err
+	}
+
+	return preferences.allows(category), nil
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+	"testing"
+)
+
+func TestNotificationPreferences(t *testing.T) {
+	preferences := &notificationPreferences{shareAlerts: true, securityAlerts: false, marketing: true}
+
+	desc := "test categories"
+	assert.True(t, preferences.allows(emailCategoryShareAlerts), desc)
+	assert.False(t, preferences.allows(emailCategorySecurityAlerts), desc)
+	assert.True(t, preferences.allows(emailCategoryMarketing), desc)
+	assert.True(t, (&notificationPreferences{}).allows(emailCategoryAccount), desc+": account emails")
+
+	desc = "test response headers"
+	ctx, stream := unitTestServerContext()
+	assert.Nil(t, preferences.setResponseHeaders(ctx), desc)
+	assert.Equal(t, []string{"true"}, stream.header.Get(metadataKeyShareAlerts), desc)
+	assert.Equal(t, []string{"false"}, stream.header.Get(metadataKeySecurityAlerts), desc)
+	assert.Equal(t, []string{"true"}, stream.header.Get(metadataKeyMarketing), desc)
+
+	desc = "test every template has a category"
+	for _, template := range []string{templateVerifyEmail, templateConfirmEmailChange, templateParentalConsent} {
+		_, ok := templateCategories[template]
+		assert.True(t, ok, desc+": "+template)
+	}
+
+	desc = "test account emails need no lookup"
+	allowed, err := emailAllowed(context.TODO(), "", emailCategoryAccount)
+	assert.Nil(t, err, desc)
+	assert.True(t, allowed, desc)
+}
+
+func TestParseNotificationPreferences(t *testing.T) {
+	cases := []struct {
+		desc       string
+		pairs      []string
+		expUpdates map[string]bool
+		isExpErr   bool
+	}{
+		{"test one category", []string{metadataKeyMarketing, "false"},
+			map[string]bool{emailCategoryMarketing: false}, false},
+		{"test every category", []string{metadataKeyShareAlerts, "true", metadataKeySecurityAlerts, "false",
+			metadataKeyMarketing, "true"}, map[string]bool{emailCategoryShareAlerts: true,
+			emailCategorySecurityAlerts: false, emailCategoryMarketing: true}, false},
+		{"test no category", nil, nil, true},
+		{"test invalid value", []string{metadataKeyShareAlerts, "sometimes"}, nil, true},
+	}
+
+	for _, c := range cases {
+		ctx := metadata.NewIncomingContext(context.TODO(), metadata.Pairs(c.pairs...))
+		updates, err := parseNotificationPreferences(ctx)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidNotificationSetting.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+		assert.Equal(t, c.expUpdates, updates, c.desc)
+	}
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// onboardingStep is a completed step of a user's onboarding checklist
+type onboardingStep struct {
+	name      string
+	completed time.Time
+}
+
+const (
+	// steps are named by the front end, these bounds keep a client from storing arbitrary data
+	maxOnboardingStepLength = 64
+	maxOnboardingSteps      = 64
+)
+
+var onboardingStepRegex = regexp.MustCompile(`^[a-z0-9]+([_-][a-z0-9]+)*$`)
+
+// normalizeOnboardingStep lower cases step.
+// Returns ErrInvalidOnboardingStep if step is not made of letters and digits separated by '-' or '_',
+// or is longer than maxOnboardingStepLength.
+func normalizeOnboardingStep(step string) (string, error) {
+	step = strings.ToLower(strings.TrimSpace(step))
+	if len(step) > maxOnboardingStepLength || !onboardingStepRegex.MatchString(step) {
+		return "", consts.ErrInvalidOnboardingStep
+	}
+
+	return step, nil
+}
+
+// parseOnboardingCompleted parses the x-hwsc-onboarding-completed metadata value, empty defaults to true.
+// Returns ErrInvalidOnboardingCompleted if value is not a boolean.
+func parseOnboardingCompleted(value string) (bool, error) {
+	if value == "" {
+		return true, nil
+	}
+
+	completed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, consts.ErrInvalidOnboardingCompleted
+	}
+
+	return completed, nil
+}
+
+// setOnboardingHeader returns steps in the x-hwsc-onboarding-steps response header, see Service.GetOnboardingState.
+func setOnboardingHeader(ctx context.Context, steps []onboardingStep) error {
+	if len(steps) == 0 {
+		return nil
+	}
+
+	values := make([]string, 0, len(steps))
+	for _, step := range steps {
+		values = append(values, step.name+"="+step.completed.UTC().Format(time.RFC3339))
+	}
+
+	return setResponseHeader(ctx, metadataKeyOnboardingSteps, values...)
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeOnboardingStep(t *testing.T) {
+	cases := []struct {
+		desc     string
+		step     string
+		expStep  string
+		isExpErr bool
+	}{
+		{"test simple step", "profile", "profile", false},
+		{"test separators", "connect_calendar-2", "connect_calendar-2", false},
+		{"test upper case", " Invite-Team ", "invite-team", false},
+		{"test longest step", strings.Repeat("a", maxOnboardingStepLength), strings.Repeat("a", maxOnboardingStepLength), false},
+		{"test too long", strings.Repeat("a", maxOnboardingStepLength+1), "", true},
+		{"test empty", "", "", true},
+		{"test leading separator", "-profile", "", true},
+		{"test double separator", "invite--team", "", true},
+		{"test space", "invite team", "", true},
+		{"test non ASCII", "résumé", "", true},
+	}
+
+	for _, c := range cases {
+		step, err := normalizeOnboardingStep(c.step)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidOnboardingStep.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+		assert.Equal(t, c.expStep, step, c.desc)
+	}
+}
+
+func TestParseOnboardingCompleted(t *testing.T) {
+	cases := []struct {
+		desc         string
+		value        string
+		expCompleted bool
+		isExpErr     bool
+	}{
+		{"test default", "", true, false},
+		{"test true", "true", true, false},
+		{"test false", "false", false, false},
+		{"test invalid", "done", false, true},
+	}
+
+	for _, c := range cases {
+		completed, err := parseOnboardingCompleted(c.value)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidOnboardingCompleted.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+		assert.Equal(t, c.expCompleted, completed, c.desc)
+	}
+}
+
+func TestSetOnboardingHeader(t *testing.T) {
+	desc := "test steps are listed in order"
+	ctx, stream := unitTestServerContext()
+	completed := time.Date(2019, 7, 1, 15, 4, 5, 0, time.FixedZone("PDT", -7*60*60))
+	err := setOnboardingHeader(ctx, []onboardingStep{
+		{name: "profile", completed: completed},
+		{name: "invite-team", completed: completed.Add(time.Hour)},
+	})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{"profile=2019-07-01T22:04:05Z", "invite-team=2019-07-01T23:04:05Z"},
+		stream.header.Get(metadataKeyOnboardingSteps), desc)
+
+	desc = "test no steps sets no header"
+	ctx, stream = unitTestServerContext()
+	assert.Nil(t, setOnboardingHeader(ctx, nil), desc)
+	assert.Empty(t, stream.header.Get(metadataKeyOnboardingSteps), desc)
+}
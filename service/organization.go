@@ -0,0 +1,118 @@
+package service
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"time"
+)
+
+// organizationRow is an organization of user_svc.organizations. Organizations are the tenants of the service:
+// admins make them with CreateOrganization, and accounts naming an unknown organization make it on first use.
+// Members an organization makes its admins manage it, see authorizeOrganizationAdmin.
+type organizationRow struct {
+	name string
+
+	// createdBy is empty if an account made the organization
+	createdBy string
+	created   time.Time
+
+	members int64
+	admins  []string
+}
+
+// parseOrganizationAdmin parses the x-hwsc-organization-admin metadata value, empty defaults to true.
+// Returns ErrInvalidOrganizationAdmin if value is not a boolean.
+func parseOrganizationAdmin(value string) (bool, error) {
+	if value == "" {
+		return true, nil
+	}
+
+	isAdmin, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, consts.ErrInvalidOrganizationAdmin
+	}
+
+	return isAdmin, nil
+}
+
+// parseDryRun parses the x-hwsc-dry-run metadata value, empty defaults to false.
+// Returns ErrInvalidDryRun if value is not a boolean.
+func parseDryRun(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, consts.ErrInvalidDryRun
+	}
+
+	return dryRun, nil
+}
+
+// authorizeOrganizationAdmin verifies token against the database and checks it carries admin permission, or is
+// the token of an admin of organization. The call is recorded like authorizeAdmin records it.
+// Returns an Unauthenticated status error if token is not valid, PermissionDenied if it is neither.
+func authorizeOrganizationAdmin(ctx context.Context, token string, action string, organization string) error {
+	retrievedIdentity, err := pairTokenWithCachedSecret(ctx, token)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	authority := auth.NewAuthority(auth.Jwt, auth.User)
+	defer authority.Invalidate()
+
+	if err := authority.Authorize(retrievedIdentity); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	if body := authority.Body(); body.Permission != auth.Admin {
+		isAdmin, err := isOrganizationAdmin(ctx, organization, body.UUID)
+		if err != nil {
+			return statusFromError(err)
+		}
+		if !isAdmin {
+			return statusFromError(consts.ErrNotOrganizationAdmin)
+		}
+	}
+
+	return recordAdminCall(ctx, token, action, organization)
+}
+
+// organizationResponse returns organization in the x-hwsc-organization-created (RFC 3339),
+// x-hwsc-organization-created-by, x-hwsc-organization-members and x-hwsc-organization-admins response headers.
+func organizationResponse(ctx context.Context, organization string) (*pbsvc.UserResponse, error) {
+	row, err := getOrganizationRow(ctx, organization)
+	if err != nil {
+		logger.Error(consts.OrganizationTag, consts.MsgErrGetOrganization, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	headers := map[string][]string{
+		metadataKeyOrganizationCreated: {row.created.UTC().Format(time.RFC3339)},
+		metadataKeyOrganizationMembers: {strconv.FormatInt(row.members, 10)},
+	}
+	if row.createdBy != "" {
+		headers[metadataKeyOrganizationCreatedBy] = []string{row.createdBy}
+	}
+	if len(row.admins) > 0 {
+		headers[metadataKeyOrganizationAdmins] = row.admins
+	}
+	for key, values := range headers {
+		if err := setResponseHeader(ctx, key, values...); err != nil {
+			logger.Error(consts.OrganizationTag, consts.MsgErrSetResponseHeader, err.Error())
+			return nil, statusFromError(err)
+		}
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseOrganizationAdmin(t *testing.T) {
+	cases := []struct {
+		desc       string
+		value      string
+		expIsAdmin bool
+		isExpErr   bool
+	}{
+		{"test empty defaults to admin", "", true, false},
+		{"test admin", "true", true, false},
+		{"test not admin", "false", false, false},
+		{"test invalid value", "yes", false, true},
+	}
+
+	for _, c := range cases {
+		isAdmin, err := parseOrganizationAdmin(c.value)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidOrganizationAdmin.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.expIsAdmin, isAdmin, c.desc)
+		}
+	}
+}
+
+func TestParseDryRun(t *testing.T) {
+	cases := []struct {
+		desc      string
+		value     string
+		expDryRun bool
+		isExpErr  bool
+	}{
+		{"test empty defaults to no dry run", "", false, false},
+		{"test dry run", "true", true, false},
+		{"test no dry run", "false", false, false},
+		{"test invalid value", "maybe", false, true},
+	}
+
+	for _, c := range cases {
+		dryRun, err := parseDryRun(c.value)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidDryRun.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.expDryRun, dryRun, c.desc)
+		}
+	}
+}
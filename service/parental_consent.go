@@ -0,0 +1,40 @@
+package service
+
+import (
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"golang.org/x/net/context"
+)
+
+// requestParentalConsent emails parentEmail a link to consent to user's account.
+// The account cannot sign in until VerifyParentalConsent consumes the token, and is deleted if the token expires.
+// Returns error if the token could not be generated or stored, or the email could not be sent.
+func requestParentalConsent(ctx context.Context, user *pblib.User, parentEmail string) error {
+	consentID, err := auth.GenerateEmailIdentification(user.GetUuid(), user.GetPermissionLevel())
+	if err != nil {
+		return err
+	}
+
+	if err := insertParentalConsentToken(ctx, user.GetUuid(), parentEmail,
+		consentID.GetToken(), consentID.GetSecret()); err != nil {
+		return err
+	}
+
+	consentLink, err := generateParentalConsentLink(consentID.GetToken())
+	if err != nil {
+		return err
+	}
+
+	emailData := map[string]string{
+		verificationLinkKey: consentLink,
+		childNameKey:        user.GetFirstName(),
+	}
+	emailReq, err := newEmailRequest(emailData, []string{parentEmail}, conf.EmailHost.Username, subjectParentalConsent)
+	if err != nil {
+		return err
+	}
+	emailReq.uuid = user.GetUuid()
+
+	return emailReq.sendEmail(ctx, templateParentalConsent)
+}
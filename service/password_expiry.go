@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"strings"
+	"time"
+)
+
+// passwordExpiryReminder is a user whose password expires soon
+type passwordExpiryReminder struct {
+	uuid    string
+	email   string
+	changed time.Time
+}
+
+const (
+	// defaultPasswordReminder emails users a week before their password expires
+	defaultPasswordReminder = 7 * 24 * time.Hour
+
+	// defaultPasswordReminderSchedule sends reminders daily at 9 AM
+	defaultPasswordReminderSchedule = "0 9 * * *"
+	defaultPasswordReminderTimezone = "UTC"
+
+	// passwordExpiredViolation is the PreconditionFailure type of AuthenticateUser with an expired password,
+	// clients send the user to the password reset flow when they see it
+	passwordExpiredViolation = "PASSWORD_EXPIRED"
+
+	expirationDateLayout = "January 2, 2006"
+)
+
+var (
+	// passwordMaxAges are set with hosts_password_maxage, passwords of other organizations never expire
+	passwordMaxAges map[string]time.Duration
+
+	passwordReminder         time.Duration
+	passwordReminderSchedule *cronSchedule
+)
+
+func init() {
+	var err error
+	passwordMaxAges, err = parsePasswordMaxAges(conf.PasswordExpiry.MaxAge)
+	if err != nil {
+		reportStartupProblem("Invalid password max age:", conf.PasswordExpiry.MaxAge)
+		return
+	}
+	if len(passwordMaxAges) == 0 {
+		return
+	}
+
+	passwordReminder = defaultPasswordReminder
+	if conf.PasswordExpiry.Reminder != "" {
+		passwordReminder, err = time.ParseDuration(conf.PasswordExpiry.Reminder)
+		if err != nil || passwordReminder <= 0 {
+			reportStartupProblem("Invalid password reminder:", conf.PasswordExpiry.Reminder)
+			return
+		}
+	}
+
+	spec := conf.PasswordExpiry.Schedule
+	if spec == "" {
+		spec = defaultPasswordReminderSchedule
+	}
+
+	timezone := conf.PasswordExpiry.Timezone
+	if timezone == "" {
+		timezone = defaultPasswordReminderTimezone
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		reportStartupProblem("Invalid password reminder timezone:", timezone)
+		return
+	}
+
+	passwordReminderSchedule, err = parseCronSchedule(spec, location)
+	if err != nil {
+		reportStartupProblem("Invalid password reminder schedule:", spec)
+		return
+	}
+
+	// the primary region reminds, so each user is emailed once
+	if !isStandby {
+		go runPasswordReminderSchedule()
+	}
+}
+
+// parsePasswordMaxAges parses a comma separated list of organization=duration.
+// Returns ErrInvalidPasswordMaxAge if an entry is malformed or its duration is not positive.
+func parsePasswordMaxAges(value string) (map[string]time.Duration, error) {
+	maxAges := make(map[string]time.Duration)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, consts.ErrInvalidPasswordMaxAge
+		}
+		organization := strings.TrimSpace(parts[0])
+		maxAge, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if organization == "" || err != nil || maxAge <= 0 {
+			return nil, consts.ErrInvalidPasswordMaxAge
+		}
+
+		maxAges[organization] = maxAge
+	}
+
+	return maxAges, nil
+}
+
+// checkPasswordExpiry refuses users signing in with a password older than the max age of their organization.
+// Returns a FailedPrecondition status error with a PASSWORD_EXPIRED violation if the password expired,
+// or any db error.
+func checkPasswordExpiry(ctx context.Context, user *pblib.User, now time.Time) error {
+	maxAge, ok := passwordMaxAges[user.GetOrganization()]
+	if !ok {
+		return nil
+	}
+
+	changed, err := getPasswordChanged(ctx, user.GetUuid())
+	if err != nil {
+		return err
+	}
+
+	if expires := changed.Add(maxAge); !now.Before(expires) {
+		return passwordExpiredStatus(expires)
+	}
+
+	return nil
+}
+
+// passwordExpiredStatus returns the FailedPrecondition status error of a password that expired at expired.
+func passwordExpiredStatus(expired time.Time) error {
+	st := status.New(codes.FailedPrecondition, consts.ErrPasswordExpired.Error())
+	detailed, err := st.WithDetails(&errdetails.PreconditionFailure{
+		Violations: []*errdetails.PreconditionFailure_Violation{{
+			Type:        passwordExpiredViolation,
+			Subject:     fieldUserPassword,
+			Description: fmt.Sprintf("password expired at %s", expired.UTC().Format(time.RFC3339)),
+		}},
+	})
+	if err != nil {
+		// details are a convenience, the code and message are still accurate without them
+		return st.Err()
+	}
+
+	return detailed.Err()
+}
+
+// runPasswordReminderSchedule reminds users every time passwordReminderSchedule comes up, it never returns.
+func runPasswordReminderSchedule() {
+	for {
+		next := passwordReminderSchedule.next(time.Now())
+		time.Sleep(time.Until(next))
+
+		if err := refreshDBConnection(); err != nil {
+			logger.Error(consts.PasswordExpiryTag, consts.ErrDBConnectionError.Error())
+			continue
+		}
+
+		remindPasswordExpiry(context.Background(), time.Now())
+	}
+}
+
+// remindPasswordExpiry emails every user whose password expires within passwordReminder of now.
+// Users are reminded once per password, failed reminders are sent again on the next run.
+func remindPasswordExpiry(ctx context.Context, now time.Time) {
+	organizations := make([]string, 0, len(passwordMaxAges))
+	for organization := range passwordMaxAges {
+		organizations = append(organizations, organization)
+	}
+	sort.Strings(organizations)
+
+	var reminded int
+	for _, organization := range organizations {
+		maxAge := passwordMaxAges[organization]
+		reminders, err := getPasswordExpiryReminders(ctx, organization, now.Add(-maxAge),
+			now.Add(passwordReminder-maxAge))
+		if err != nil {
+			logger.Error(consts.PasswordExpiryTag, consts.MsgErrRemindPasswordExpiry, err.Error())
+			continue
+		}
+
+		for _, reminder := range reminders {
+			if err := sendPasswordExpiryReminder(ctx, reminder, reminder.changed.Add(maxAge)); err != nil {
+				logger.Error(consts.PasswordExpiryTag, consts.MsgErrRemindPasswordExpiry, err.Error())
+				continue
+			}
+			if err := markPasswordReminded(ctx, reminder.uuid, reminder.changed, now); err != nil {
+				logger.Error(consts.PasswordExpiryTag, consts.MsgErrRemindPasswordExpiry, err.Error())
+				continue
+			}
+			reminded++
+		}
+	}
+
+	logger.Info(consts.PasswordExpiryTag, "Reminded", fmt.Sprint(reminded), "users of expiring passwords")
+}
+
+// sendPasswordExpiryReminder emails reminder that its password expires at expires.
+func sendPasswordExpiryReminder(ctx context.Context, reminder *passwordExpiryReminder, expires time.Time) error {
+	emailData := map[string]string{
+		expirationDateKey: expires.UTC().Format(expirationDateLayout),
+	}
+	emailReq, err := newEmailRequest(emailData, []string{reminder.email}, conf.EmailHost.Username,
+		subjectPasswordExpiry)
+	if err != nil {
+		return err
+	}
+	emailReq.uuid = reminder.uuid
+
+	return emailReq.sendEmail(ctx, templatePasswordExpiry)
+}
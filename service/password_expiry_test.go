@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestParsePasswordMaxAges(t *testing.T) {
+	cases := []struct {
+		desc     string
+		value    string
+		expAges  map[string]time.Duration
+		isExpErr bool
+	}{
+		{"test empty", "", map[string]time.Duration{}, false},
+		{"test organizations", "hwsc=2160h, Unit Testing = 720h,", map[string]time.Duration{
+			"hwsc":         2160 * time.Hour,
+			"Unit Testing": 720 * time.Hour,
+		}, false},
+		{"test missing duration", "hwsc", nil, true},
+		{"test missing organization", "=720h", nil, true},
+		{"test invalid duration", "hwsc=90d", nil, true},
+		{"test negative duration", "hwsc=-720h", nil, true},
+	}
+
+	for _, c := range cases {
+		maxAges, err := parsePasswordMaxAges(c.value)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidPasswordMaxAge.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+		assert.Equal(t, c.expAges, maxAges, c.desc)
+	}
+}
+
+func TestPasswordExpiredStatus(t *testing.T) {
+	expired := time.Date(2019, 7, 1, 15, 4, 5, 0, time.UTC)
+
+	st, ok := status.FromError(passwordExpiredStatus(expired))
+	assert.True(t, ok)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+	assert.Equal(t, consts.ErrPasswordExpired.Error(), st.Message())
+	if assert.Len(t, st.Details(), 1) {
+		failure := st.Details()[0].(*errdetails.PreconditionFailure)
+		assert.Equal(t, passwordExpiredViolation, failure.GetViolations()[0].GetType())
+		assert.Equal(t, fieldUserPassword, failure.GetViolations()[0].GetSubject())
+		assert.Equal(t, "password expired at 2019-07-01T15:04:05Z", failure.GetViolations()[0].GetDescription())
+	}
+}
+
+func TestCheckPasswordExpiry(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	defer func(maxAges map[string]time.Duration) { passwordMaxAges = maxAges }(passwordMaxAges)
+
+	response, err := unitTestInsertUser("TestCheckPasswordExpiry")
+	assert.Nil(t, err)
+	user := response.GetUser()
+
+	desc := "test organization without max age"
+	passwordMaxAges = map[string]time.Duration{}
+	assert.Nil(t, checkPasswordExpiry(context.TODO(), user, time.Now().Add(24*time.Hour)), desc)
+
+	passwordMaxAges = map[string]time.Duration{user.GetOrganization(): 24 * time.Hour}
+
+	desc = "test password within max age"
+	assert.Nil(t, checkPasswordExpiry(context.TODO(), user, time.Now()), desc)
+
+	desc = "test expired password"
+	err = checkPasswordExpiry(context.TODO(), user, time.Now().Add(25*time.Hour))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), desc)
+	assert.Contains(t, err.Error(), consts.ErrPasswordExpired.Error(), desc)
+}
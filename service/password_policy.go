@@ -0,0 +1,205 @@
+package service
+
+import (
+	_ "embed"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// passwordPolicy are the strength rules of new passwords, set by CreateUser, UpdateUser and ResetPassword.
+// Passwords are only checked when they are set, existing passwords keep signing in.
+type passwordPolicy struct {
+	minLength int
+	classes   []passwordClass
+	blocklist bool
+	minScore  int
+}
+
+// passwordClass is a character class a password may be required to contain
+type passwordClass struct {
+	matches func(rune) bool
+	err     error
+}
+
+const (
+	defaultPasswordMinLength = 8
+	maxPasswordScore         = 4
+)
+
+var (
+	// passwordClasses are the classes hosts_password_classes may require
+	passwordClasses = map[string]passwordClass{
+		"lower":  {unicode.IsLower, consts.ErrPasswordMissingLower},
+		"upper":  {unicode.IsUpper, consts.ErrPasswordMissingUpper},
+		"digit":  {unicode.IsDigit, consts.ErrPasswordMissingDigit},
+		"symbol": {isPasswordSymbol, consts.ErrPasswordMissingSymbol},
+	}
+
+	// commonPasswords are refused while the blocklist is switched on, lower cased
+	//go:embed common_passwords.txt
+	commonPasswordList string
+	commonPasswords    = parseCommonPasswords(commonPasswordList)
+
+	// newPasswordPolicy is set with hosts_password_*
+	newPasswordPolicy = passwordPolicy{minLength: defaultPasswordMinLength, blocklist: true}
+)
+
+func init() {
+	settings := conf.PasswordPolicy
+
+	if settings.MinLength != "" {
+		minLength, err := strconv.Atoi(settings.MinLength)
+		if err != nil || minLength < 1 {
+			reportStartupProblem("Invalid password min length:", settings.MinLength)
+		} else {
+			newPasswordPolicy.minLength = minLength
+		}
+	}
+
+	for _, name := range strings.Split(settings.Classes, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		class, ok := passwordClasses[name]
+		if !ok {
+			reportStartupProblem("Invalid password class:", name)
+			continue
+		}
+		newPasswordPolicy.classes = append(newPasswordPolicy.classes, class)
+	}
+
+	// the blocklist is on unless switched off
+	if settings.Blocklist != "" {
+		newPasswordPolicy.blocklist = parseValidationSwitch("password blocklist", settings.Blocklist)
+	}
+
+	if settings.MinScore != "" {
+		minScore, err := strconv.Atoi(settings.MinScore)
+		if err != nil || minScore < 0 || minScore > maxPasswordScore {
+			reportStartupProblem("Invalid password min score:", settings.MinScore)
+		} else {
+			newPasswordPolicy.minScore = minScore
+		}
+	}
+}
+
+// validateNewPassword checks a password being set with validatePassword and newPasswordPolicy.
+// Returns the first error found.
+func validateNewPassword(password string) error {
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+
+	if violations := newPasswordPolicy.violations(password); len(violations) != 0 {
+		return violations[0]
+	}
+
+	return nil
+}
+
+// violations returns an error for every rule of p that password breaks, so clients can list them all.
+func (p passwordPolicy) violations(password string) []error {
+	var violations []error
+	if utf8.RuneCountInString(password) < p.minLength {
+		violations = append(violations, consts.ErrPasswordTooShort)
+	}
+
+	for _, class := range p.classes {
+		if strings.IndexFunc(password, class.matches) < 0 {
+			violations = append(violations, class.err)
+		}
+	}
+
+	if p.blocklist && commonPasswords[strings.ToLower(password)] {
+		violations = append(violations, consts.ErrPasswordCommon)
+	}
+
+	if p.minScore > 0 && passwordScore(password) < p.minScore {
+		violations = append(violations, consts.ErrPasswordTooWeak)
+	}
+
+	return violations
+}
+
+// passwordScore estimates how hard password is to guess on the 0 to 4 scale of zxcvbn, from the guesses a
+// brute force over the character classes it uses needs. Runs of repeated or sequential characters, such as
+// "aaa" or "123", count as their first character, common passwords score 0. Unlike zxcvbn, dictionary words
+// and keyboard patterns are not recognized, the estimate is rough.
+func passwordScore(password string) int {
+	if commonPasswords[strings.ToLower(password)] {
+		return 0
+	}
+
+	var lower, upper, digit, symbol, other bool
+	length := 0
+	previous := rune(-1)
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case isPasswordSymbol(r):
+			symbol = true
+		default:
+			other = true
+		}
+
+		if previous < 0 || (r != previous && r != previous+1 && r != previous-1) {
+			length++
+		}
+		previous = r
+	}
+
+	alphabet := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			alphabet += class.size
+		}
+	}
+	if alphabet == 0 {
+		return 0
+	}
+
+	// log10 of the guesses, against the thresholds of zxcvbn
+	guesses := float64(length) * math.Log10(float64(alphabet))
+	switch {
+	case guesses < 3:
+		return 0
+	case guesses < 6:
+		return 1
+	case guesses < 8:
+		return 2
+	case guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// isPasswordSymbol returns true for punctuation and symbols, including spaces.
+func isPasswordSymbol(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r) || r == ' '
+}
+
+// parseCommonPasswords returns the passwords of list, one per line, lower cased.
+func parseCommonPasswords(list string) map[string]bool {
+	passwords := make(map[string]bool)
+	for _, line := range strings.Split(list, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			passwords[strings.ToLower(line)] = true
+		}
+	}
+
+	return passwords
+}
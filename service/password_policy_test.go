@@ -0,0 +1,78 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPasswordPolicyViolations(t *testing.T) {
+	strict := passwordPolicy{
+		minLength: 10,
+		classes: []passwordClass{passwordClasses["lower"], passwordClasses["upper"], passwordClasses["digit"],
+			passwordClasses["symbol"]},
+		blocklist: true,
+		minScore:  3,
+	}
+
+	cases := []struct {
+		desc       string
+		policy     passwordPolicy
+		password   string
+		violations []error
+	}{
+		{"test default policy accepts a long password", newPasswordPolicy, "humpback whales", nil},
+		{"test default policy refuses short passwords", newPasswordPolicy, "a",
+			[]error{consts.ErrPasswordTooShort}},
+		{"test default policy refuses common passwords ignoring case", newPasswordPolicy, "PassWord1",
+			[]error{consts.ErrPasswordCommon}},
+		{"test length counts characters", passwordPolicy{minLength: 4}, "éééé", nil},
+		{"test every broken rule is listed", strict, "password",
+			[]error{consts.ErrPasswordTooShort, consts.ErrPasswordMissingUpper, consts.ErrPasswordMissingDigit,
+				consts.ErrPasswordMissingSymbol, consts.ErrPasswordCommon, consts.ErrPasswordTooWeak}},
+		{"test strong password", strict, "Humpback-Wh4les", nil},
+		{"test weak password with every class", strict, "Aaaaaaaa1!", []error{consts.ErrPasswordTooWeak}},
+		{"test policy switched off", passwordPolicy{}, "123456", nil},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.violations, c.policy.violations(c.password), c.desc)
+	}
+}
+
+func TestValidateNewPassword(t *testing.T) {
+	desc := "test basic validation comes first"
+	assert.EqualError(t, validateNewPassword(" "), consts.ErrInvalidPassword.Error(), desc)
+
+	desc = "test first violation of the policy"
+	assert.EqualError(t, validateNewPassword("qwerty"), consts.ErrPasswordTooShort.Error(), desc)
+
+	desc = "test valid password"
+	assert.Nil(t, validateNewPassword("ValidateNewPassword"), desc)
+}
+
+func TestPasswordScore(t *testing.T) {
+	cases := []struct {
+		password string
+		score    int
+	}{
+		{"", 0},
+		{"qwerty123", 0},
+		{"aaaaaaaaaaaaaaaaaaaa", 0},
+		{"abcdefghijkl", 0},
+		{"cat", 1},
+		{"zebra", 2},
+		{"zebra9", 3},
+		{"Humpback-Wh4les", 4},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.score, passwordScore(c.password), c.password)
+	}
+}
+
+func TestParseCommonPasswords(t *testing.T) {
+	passwords := parseCommonPasswords("Password\n\n  letmein \n")
+	assert.Equal(t, map[string]bool{"password": true, "letmein": true}, passwords)
+	assert.True(t, commonPasswords["123456"])
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"golang.org/x/net/context"
+	"time"
+)
+
+const (
+	// passwordResetLifetime is shorter than other email tokens, a reset link is as good as the password
+	passwordResetLifetime = time.Hour
+)
+
+// requestPasswordReset emails user a link to choose a new password, the link of any previous request stops working.
+// Returns error if the token could not be generated or stored, or the email could not be sent.
+func requestPasswordReset(ctx context.Context, user *pblib.User) error {
+	resetID, err := auth.GenerateEmailIdentification(user.GetUuid(), user.GetPermissionLevel())
+	if err != nil {
+		return err
+	}
+
+	expires := time.Unix(resetID.GetSecret().GetCreatedTimestamp(), 0).Add(passwordResetLifetime)
+	if err := insertPasswordResetToken(ctx, user.GetUuid(), resetID.GetToken(), resetID.GetSecret(),
+		expires); err != nil {
+		return err
+	}
+
+	resetLink, err := generatePasswordResetLink(resetID.GetToken())
+	if err != nil {
+		return err
+	}
+
+	emailData := map[string]string{
+		verificationLinkKey: resetLink,
+	}
+	emailReq, err := newEmailRequest(emailData, []string{user.GetEmail()}, conf.EmailHost.Username,
+		subjectPasswordReset)
+	if err != nil {
+		return err
+	}
+	emailReq.uuid = user.GetUuid()
+
+	return emailReq.sendEmail(ctx, templatePasswordReset)
+}
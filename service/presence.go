@@ -0,0 +1,89 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+// presenceTracker records when users were last seen using an auth token, rounded down to granularity.
+// Each instance writes a user's presence at most once per granularity, so verifying tokens stays cheap.
+type presenceTracker struct {
+	granularity time.Duration
+	store       func(ctx context.Context, uuid string, seen time.Time) error
+
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+const (
+	// presenceGranularity is coarse on purpose, presence tells collaborators whether a user is around,
+	// not what the user is doing
+	presenceGranularity = 5 * time.Minute
+
+	// maxTrackedPresences bounds the users an instance remembers recording presence for
+	maxTrackedPresences = 100000
+)
+
+var (
+	presence = newPresenceTracker(presenceGranularity)
+)
+
+func newPresenceTracker(granularity time.Duration) *presenceTracker {
+	return &presenceTracker{
+		granularity: granularity,
+		store:       updateLastSeen,
+		seen:        make(map[string]time.Time),
+	}
+}
+
+// observe records that uuid was seen at now, unless this instance recorded it within the same granularity.
+// Returns the rounded down timestamp to record and true if it must be written.
+func (p *presenceTracker) observe(uuid string, now time.Time) (time.Time, bool) {
+	seen := now.UTC().Truncate(p.granularity)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if last, ok := p.seen[uuid]; ok && !seen.After(last) {
+		return seen, false
+	}
+
+	if len(p.seen) >= maxTrackedPresences {
+		for tracked, last := range p.seen {
+			if last.Before(seen) {
+				delete(p.seen, tracked)
+			}
+		}
+	}
+	p.seen[uuid] = seen
+
+	return seen, true
+}
+
+// record writes that uuid was seen at now without waiting on the db. Presence is best effort, failed writes are
+// logged and written again on the next granularity. A standby instance cannot write and records nothing.
+func (p *presenceTracker) record(uuid string, now time.Time) {
+	if isStandby || uuid == "" {
+		return
+	}
+
+	seen, ok := p.observe(uuid, now)
+	if !ok {
+		return
+	}
+
+	go func() {
+		if err := p.store(context.Background(), uuid, seen); err != nil {
+			logger.Error(consts.UserServiceTag, consts.MsgErrRecordPresence, err.Error())
+		}
+	}()
+}
+
+// recordPresence records that the user of token, a verified auth token, was seen now.
+func recordPresence(token string) {
+	presence.record(auth.ExtractUUID(token), time.Now())
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPresenceTrackerObserve(t *testing.T) {
+	tracker := newPresenceTracker(5 * time.Minute)
+	start := time.Date(2019, time.May, 1, 10, 2, 30, 0, time.UTC)
+
+	desc := "test first sighting is rounded down and written"
+	seen, ok := tracker.observe("uuid", start)
+	assert.True(t, ok, desc)
+	assert.Equal(t, time.Date(2019, time.May, 1, 10, 0, 0, 0, time.UTC), seen, desc)
+
+	desc = "test sightings within the granularity are not written again"
+	_, ok = tracker.observe("uuid", start.Add(2*time.Minute))
+	assert.False(t, ok, desc)
+
+	desc = "test sightings in the next granularity are written"
+	seen, ok = tracker.observe("uuid", start.Add(3*time.Minute))
+	assert.True(t, ok, desc)
+	assert.Equal(t, time.Date(2019, time.May, 1, 10, 5, 0, 0, time.UTC), seen, desc)
+
+	desc = "test users are tracked separately"
+	_, ok = tracker.observe("other", start.Add(3*time.Minute))
+	assert.True(t, ok, desc)
+
+	desc = "test earlier sightings are not written"
+	_, ok = tracker.observe("uuid", start)
+	assert.False(t, ok, desc)
+}
+
+func TestPresenceTrackerRecord(t *testing.T) {
+	written := make(chan time.Time, 1)
+	tracker := newPresenceTracker(5 * time.Minute)
+	tracker.store = func(ctx context.Context, uuid string, seen time.Time) error {
+		written <- seen
+		return nil
+	}
+	now := time.Date(2019, time.May, 1, 10, 2, 30, 0, time.UTC)
+
+	desc := "test presence is written"
+	tracker.record("uuid", now)
+	select {
+	case seen := <-written:
+		assert.Equal(t, time.Date(2019, time.May, 1, 10, 0, 0, 0, time.UTC), seen, desc)
+	case <-time.After(time.Second):
+		t.Error(desc)
+	}
+
+	desc = "test tokens without a uuid are not recorded"
+	tracker.record("", now.Add(time.Hour))
+	assert.Empty(t, tracker.seen[""], desc)
+}
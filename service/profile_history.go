@@ -0,0 +1,108 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"strconv"
+	"time"
+)
+
+// profileChange is a change a user made to its own profile with UpdateUser.
+// Values are kept as hashes, users can check a change against the value they expect without the service
+// keeping old personal data around
+type profileChange struct {
+	sequence  int64
+	field     string
+	oldHash   string
+	newHash   string
+	timestamp time.Time
+}
+
+const (
+	// profile fields recorded by diffProfile, as named in User
+	profileFieldFirstName    = "first_name"
+	profileFieldLastName     = "last_name"
+	profileFieldOrganization = "organization"
+	profileFieldEmail        = "email"
+	profileFieldPassword     = "password"
+
+	defaultProfileHistoryLimit = 100
+	maxProfileHistoryLimit     = 1000
+)
+
+// profileHistoryCSVHeader names the columns written by writeProfileHistoryCSV
+var profileHistoryCSVHeader = []string{"sequence", "timestamp", "field", "old_hash", "new_hash"}
+
+// hashProfileValue returns the hex sha-256 of value salted with uuid and field, so equal values of different
+// users or fields do not share a hash. Empty values hash to an empty string, the field was blank.
+func hashProfileValue(uuid string, field string, value string) string {
+	if value == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(uuid + "\x00" + field + "\x00" + value))
+	return hex.EncodeToString(sum[:])
+}
+
+// diffProfile returns the fields of uuid that differ between before and after, the stored user and the user
+// updateUserRow writes. Emails compare before's email with after's, the email the user asked to change to.
+// Passwords compare their bcrypt hashes, a password is never hashed with sha-256.
+func diffProfile(uuid string, before *pblib.User, after *pblib.User) []*profileChange {
+	fields := []struct {
+		name   string
+		before string
+		after  string
+	}{
+		{profileFieldFirstName, before.GetFirstName(), after.GetFirstName()},
+		{profileFieldLastName, before.GetLastName(), after.GetLastName()},
+		{profileFieldOrganization, before.GetOrganization(), after.GetOrganization()},
+		{profileFieldEmail, before.GetEmail(), after.GetEmail()},
+		{profileFieldPassword, before.GetPassword(), after.GetPassword()},
+	}
+
+	var changes []*profileChange
+	for _, f := range fields {
+		if f.before == f.after {
+			continue
+		}
+		changes = append(changes, &profileChange{
+			field:   f.name,
+			oldHash: hashProfileValue(uuid, f.name, f.before),
+			newHash: hashProfileValue(uuid, f.name, f.after),
+		})
+	}
+
+	return changes
+}
+
+// writeProfileHistoryCSV returns changes as a CSV document with a header row, timestamps are RFC 3339 in UTC.
+func writeProfileHistoryCSV(changes []*profileChange) (string, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+
+	if err := writer.Write(profileHistoryCSVHeader); err != nil {
+		return "", err
+	}
+	for _, change := range changes {
+		record := []string{
+			strconv.FormatInt(change.sequence, 10),
+			change.timestamp.UTC().Format(time.RFC3339),
+			change.field,
+			change.oldHash,
+			change.newHash,
+		}
+		if err := writer.Write(record); err != nil {
+			return "", err
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
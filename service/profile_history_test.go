@@ -0,0 +1,87 @@
+package service
+
+import (
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHashProfileValue(t *testing.T) {
+	uuid := "01d3x3wm2nmk3e5pbt2fjwwfkh"
+
+	desc := "test hashes are stable"
+	assert.Equal(t, hashProfileValue(uuid, profileFieldLastName, "Whale"),
+		hashProfileValue(uuid, profileFieldLastName, "Whale"), desc)
+	assert.Len(t, hashProfileValue(uuid, profileFieldLastName, "Whale"), 64, desc)
+
+	desc = "test hashes are salted with the uuid and field"
+	assert.NotEqual(t, hashProfileValue(uuid, profileFieldLastName, "Whale"),
+		hashProfileValue("01d3x3wm2nmk3e5pbt2fjwwfkj", profileFieldLastName, "Whale"), desc)
+	assert.NotEqual(t, hashProfileValue(uuid, profileFieldLastName, "Whale"),
+		hashProfileValue(uuid, profileFieldFirstName, "Whale"), desc)
+
+	desc = "test blank values"
+	assert.Equal(t, "", hashProfileValue(uuid, profileFieldOrganization, ""), desc)
+}
+
+func TestDiffProfile(t *testing.T) {
+	uuid := "01d3x3wm2nmk3e5pbt2fjwwfkh"
+	before := &pblib.User{
+		FirstName:    "Humpback",
+		LastName:     "Whale",
+		Organization: "hwsc",
+		Email:        "whale@hwsc.org",
+		Password:     "$2a$04$before",
+	}
+
+	desc := "test unchanged profile"
+	assert.Nil(t, diffProfile(uuid, before, before), desc)
+
+	desc = "test changed fields"
+	after := &pblib.User{
+		FirstName: "Humpback",
+		LastName:  "Orca",
+		Email:     "orca@hwsc.org",
+		Password:  "$2a$04$after",
+	}
+	changes := diffProfile(uuid, before, after)
+	assert.Equal(t, []*profileChange{
+		{
+			field:   profileFieldLastName,
+			oldHash: hashProfileValue(uuid, profileFieldLastName, "Whale"),
+			newHash: hashProfileValue(uuid, profileFieldLastName, "Orca"),
+		},
+		{
+			field:   profileFieldOrganization,
+			oldHash: hashProfileValue(uuid, profileFieldOrganization, "hwsc"),
+		},
+		{
+			field:   profileFieldEmail,
+			oldHash: hashProfileValue(uuid, profileFieldEmail, "whale@hwsc.org"),
+			newHash: hashProfileValue(uuid, profileFieldEmail, "orca@hwsc.org"),
+		},
+		{
+			field:   profileFieldPassword,
+			oldHash: hashProfileValue(uuid, profileFieldPassword, "$2a$04$before"),
+			newHash: hashProfileValue(uuid, profileFieldPassword, "$2a$04$after"),
+		},
+	}, changes, desc)
+}
+
+func TestWriteProfileHistoryCSV(t *testing.T) {
+	changes := []*profileChange{
+		{
+			sequence:  7,
+			field:     profileFieldOrganization,
+			oldHash:   "",
+			newHash:   "ab12",
+			timestamp: time.Date(2019, 7, 1, 15, 4, 5, 0, time.FixedZone("PDT", -7*60*60)),
+		},
+	}
+
+	document, err := writeProfileHistoryCSV(changes)
+	assert.Nil(t, err)
+	assert.Equal(t, "sequence,timestamp,field,old_hash,new_hash\n7,2019-07-01T22:04:05Z,organization,,ab12\n",
+		document)
+}
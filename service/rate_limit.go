@@ -0,0 +1,213 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimit lets a caller send requests in a burst, then one more request every interval
+type rateLimit struct {
+	requests int
+	interval time.Duration
+}
+
+// rateLimiter keeps a token bucket per method and caller, buckets refilled to their burst are forgotten
+type rateLimiter struct {
+	lock    sync.Mutex
+	limits  map[string]rateLimit
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	limit   rateLimit
+	tokens  float64
+	updated time.Time
+}
+
+const (
+	defaultRateLimits = "CreateUser=10/1m,CreateUsers=5/1m,AuthenticateUser=20/1m,Verify2FA=5/1m,Disable2FA=5/1m"
+	noRateLimits      = "none"
+
+	// rateLimitSweepInterval is how often full buckets are removed
+	rateLimitSweepInterval = time.Minute
+)
+
+var (
+	// requestLimiter is set with hosts_ratelimit_limits and reloaded on SIGHUP
+	requestLimiter = newRateLimiter(nil)
+)
+
+func init() {
+	limits, err := parseRateLimits(conf.RateLimit.Limits)
+	if err != nil {
+		reportStartupProblem("Invalid rate limits:", conf.RateLimit.Limits)
+		return
+	}
+	requestLimiter.setLimits(limits)
+}
+
+// parseRateLimits parses a comma separated list of method=requests/period, "none" limits no method and empty
+// defaults to defaultRateLimits.
+// Returns ErrInvalidRateLimit if an entry is not a method with a positive number of requests and period.
+func parseRateLimits(value string) (map[string]rateLimit, error) {
+	if strings.TrimSpace(value) == "" {
+		value = defaultRateLimits
+	}
+
+	limits := make(map[string]rateLimit)
+	if strings.EqualFold(strings.TrimSpace(value), noRateLimits) {
+		return limits, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, consts.ErrInvalidRateLimit
+		}
+		method := strings.TrimSpace(parts[0])
+		rate := strings.SplitN(parts[1], "/", 2)
+		if method == "" || len(rate) != 2 {
+			return nil, consts.ErrInvalidRateLimit
+		}
+
+		requests, err := strconv.Atoi(strings.TrimSpace(rate[0]))
+		if err != nil || requests <= 0 {
+			return nil, consts.ErrInvalidRateLimit
+		}
+		period, err := time.ParseDuration(strings.TrimSpace(rate[1]))
+		if err != nil || period <= 0 {
+			return nil, consts.ErrInvalidRateLimit
+		}
+
+		limits[method] = rateLimit{requests: requests, interval: period / time.Duration(requests)}
+	}
+
+	return limits, nil
+}
+
+func newRateLimiter(limits map[string]rateLimit) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// RateLimitInterceptor refuses requests to a limited method once their caller used up its limit.
+// Callers are the uuid of the auth token verified by AuthInterceptor, or the client ip of requests without one.
+// Returns a ResourceExhausted status error with an x-hwsc-retry-after header, the seconds until the caller may
+// send the request again.
+func RateLimitInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	method := path.Base(info.FullMethod)
+	key := rateLimitKey(ctx)
+	if key == "" {
+		// without a peer, the request did not come from the network
+		return handler(ctx, req)
+	}
+
+	wait, ok := requestLimiter.allow(method, key, time.Now())
+	if ok {
+		return handler(ctx, req)
+	}
+
+	// rounded up, a client retrying after the header is not refused again
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	if err := setResponseHeader(ctx, metadataKeyRetryAfter, strconv.FormatInt(seconds, 10)); err != nil {
+		logger.Error(consts.RateLimitTag, consts.MsgErrSetResponseHeader, err.Error())
+	}
+	logger.Error(consts.RateLimitTag, info.FullMethod, consts.ErrRateLimited.Error(), key)
+	return nil, statusFromError(consts.ErrRateLimited)
+}
+
+// rateLimitKey returns the uuid of the caller, the key id of a service api key, the client ip if there is neither,
+// or "" if nothing is known.
+func rateLimitKey(ctx context.Context) string {
+	if c, ok := callerFromContext(ctx); ok {
+		return "uuid:" + c.uuid
+	}
+
+	if k, ok := serviceCallerFromContext(ctx); ok {
+		return "apikey:" + k.keyID
+	}
+
+	if ip := loginIP(ctx); ip != nil {
+		return "ip:" + ip.String()
+	}
+
+	return ""
+}
+
+// setLimits replaces the limits of every method, callers keep the requests left of methods whose limit is
+// unchanged.
+func (l *rateLimiter) setLimits(limits map[string]rateLimit) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.limits = limits
+}
+
+// allow takes a token from the bucket of method and key at now, methods without a limit are always allowed.
+// Returns how long until a token is available and false if the bucket is empty.
+func (l *rateLimiter) allow(method string, key string, now time.Time) (time.Duration, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	limit, ok := l.limits[method]
+	if !ok {
+		return 0, true
+	}
+
+	if now.Sub(l.swept) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	bucketKey := method + " " + key
+	bucket, ok := l.buckets[bucketKey]
+	if !ok || bucket.limit != limit {
+		bucket = &tokenBucket{limit: limit, tokens: float64(limit.requests), updated: now}
+		l.buckets[bucketKey] = bucket
+	}
+
+	bucket.refill(now)
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0, true
+	}
+
+	return time.Duration((1 - bucket.tokens) * float64(limit.interval)), false
+}
+
+// sweep removes the buckets full at now, must be called while holding lock.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.refill(now); bucket.tokens >= float64(bucket.limit.requests) {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// refill adds the tokens earned since the bucket was last updated, up to its burst.
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens += float64(elapsed) / float64(b.limit.interval)
+		if burst := float64(b.limit.requests); b.tokens > burst {
+			b.tokens = burst
+		}
+		b.updated = now
+	}
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"context"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	cases := []struct {
+		value     string
+		expLimits map[string]rateLimit
+		expErr    error
+	}{
+		{"", map[string]rateLimit{
+			"CreateUser":       {requests: 10, interval: 6 * time.Second},
+			"CreateUsers":      {requests: 5, interval: 12 * time.Second},
+			"AuthenticateUser": {requests: 20, interval: 3 * time.Second},
+			"Verify2FA":        {requests: 5, interval: 12 * time.Second},
+			"Disable2FA":       {requests: 5, interval: 12 * time.Second},
+		}, nil},
+		{"none", map[string]rateLimit{}, nil},
+		{"CreateUser=10/1m", map[string]rateLimit{"CreateUser": {requests: 10, interval: 6 * time.Second}}, nil},
+		{" CreateUser = 2/1s , AuthenticateUser=1/1h ", map[string]rateLimit{
+			"CreateUser":       {requests: 2, interval: 500 * time.Millisecond},
+			"AuthenticateUser": {requests: 1, interval: time.Hour},
+		}, nil},
+		{"CreateUser", nil, consts.ErrInvalidRateLimit},
+		{"=10/1m", nil, consts.ErrInvalidRateLimit},
+		{"CreateUser=10", nil, consts.ErrInvalidRateLimit},
+		{"CreateUser=0/1m", nil, consts.ErrInvalidRateLimit},
+		{"CreateUser=ten/1m", nil, consts.ErrInvalidRateLimit},
+		{"CreateUser=10/0s", nil, consts.ErrInvalidRateLimit},
+		{"CreateUser=10/minute", nil, consts.ErrInvalidRateLimit},
+	}
+
+	for _, c := range cases {
+		limits, err := parseRateLimits(c.value)
+		assert.Equal(t, c.expErr, err, c.value)
+		assert.Equal(t, c.expLimits, limits, c.value)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := newRateLimiter(map[string]rateLimit{"CreateUser": {requests: 2, interval: 10 * time.Second}})
+	now := time.Now()
+
+	desc := "test burst is allowed"
+	for i := 0; i < 2; i++ {
+		_, ok := limiter.allow("CreateUser", "ip:192.0.2.1", now)
+		assert.True(t, ok, desc)
+	}
+
+	desc = "test request after the burst is refused until a token is earned"
+	wait, ok := limiter.allow("CreateUser", "ip:192.0.2.1", now.Add(4*time.Second))
+	assert.False(t, ok, desc)
+	assert.Equal(t, 6*time.Second, wait, desc)
+
+	desc = "test other callers have their own bucket"
+	_, ok = limiter.allow("CreateUser", "ip:192.0.2.2", now)
+	assert.True(t, ok, desc)
+
+	desc = "test methods without a limit are always allowed"
+	for i := 0; i < 5; i++ {
+		_, ok = limiter.allow("GetUser", "ip:192.0.2.1", now)
+		assert.True(t, ok, desc)
+	}
+
+	desc = "test earned token is allowed"
+	_, ok = limiter.allow("CreateUser", "ip:192.0.2.1", now.Add(10*time.Second))
+	assert.True(t, ok, desc)
+	_, ok = limiter.allow("CreateUser", "ip:192.0.2.1", now.Add(10*time.Second))
+	assert.False(t, ok, desc)
+
+	desc = "test changed limit starts a new bucket"
+	limiter.setLimits(map[string]rateLimit{"CreateUser": {requests: 3, interval: 10 * time.Second}})
+	_, ok = limiter.allow("CreateUser", "ip:192.0.2.1", now.Add(10*time.Second))
+	assert.True(t, ok, desc)
+
+	desc = "test removed limit is not enforced"
+	limiter.setLimits(map[string]rateLimit{})
+	_, ok = limiter.allow("CreateUser", "ip:192.0.2.1", now.Add(10*time.Second))
+	assert.True(t, ok, desc)
+	limiter.setLimits(map[string]rateLimit{"CreateUser": {requests: 3, interval: 10 * time.Second}})
+
+	desc = "test full buckets are swept"
+	_, ok = limiter.allow("CreateUser", "ip:192.0.2.3", now.Add(time.Hour))
+	assert.True(t, ok, desc)
+	assert.Equal(t, 1, len(limiter.buckets), desc)
+}
+
+func TestRateLimitInterceptor(t *testing.T) {
+	limiter := requestLimiter
+	requestLimiter = newRateLimiter(map[string]rateLimit{"CreateUser": {requests: 1, interval: time.Minute}})
+	defer func() { requestLimiter = limiter }()
+
+	var calls int
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls++
+		return nil, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/user.UserService/CreateUser"}
+	peerContext := func(ctx context.Context) context.Context {
+		return peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4242}})
+	}
+
+	desc := "test first request of the ip runs"
+	ctx, stream := unitTestServerContext()
+	_, err := RateLimitInterceptor(peerContext(ctx), nil, info, handler)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 1, calls, desc)
+	assert.Empty(t, stream.header.Get(metadataKeyRetryAfter), desc)
+
+	desc = "test second request of the ip is refused with retry after"
+	ctx, stream = unitTestServerContext()
+	_, err = RateLimitInterceptor(peerContext(ctx), nil, info, handler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), desc)
+	assert.Equal(t, 1, calls, desc)
+	if assert.Len(t, stream.header.Get(metadataKeyRetryAfter), 1, desc) {
+		wait, err := strconv.Atoi(stream.header.Get(metadataKeyRetryAfter)[0])
+		assert.Nil(t, err, desc)
+		assert.True(t, wait > 0 && wait <= 60, desc)
+	}
+
+	desc = "test caller is limited by uuid instead of ip"
+	ctx, _ = unitTestServerContext()
+	ctx = withCaller(peerContext(ctx), &caller{uuid: "TestRateLimitInterceptor"})
+	_, err = RateLimitInterceptor(ctx, nil, info, handler)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 2, calls, desc)
+
+	desc = "test forwarded ip is limited on its own"
+	ctx, _ = unitTestServerContext(metadataKeyForwardedFor, "198.51.100.7")
+	_, err = RateLimitInterceptor(peerContext(ctx), nil, info, handler)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 3, calls, desc)
+
+	desc = "test request without a peer is not limited"
+	for i := 0; i < 3; i++ {
+		ctx, _ = unitTestServerContext()
+		_, err = RateLimitInterceptor(ctx, nil, info, handler)
+		assert.Nil(t, err, desc)
+	}
+	assert.Equal(t, 6, calls, desc)
+
+	desc = "test unlimited method runs"
+	ctx, _ = unitTestServerContext()
+	_, err = RateLimitInterceptor(peerContext(ctx), nil, &grpc.UnaryServerInfo{FullMethod: "/user.UserService/GetUser"},
+		handler)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 7, calls, desc)
+}
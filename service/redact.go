@@ -0,0 +1,55 @@
+package service
+
+import (
+	"io"
+	"log"
+	"os"
+	"regexp"
+)
+
+// redactWriter scrubs credentials from log lines before they reach out.
+// hwsc-lib logger writes through the standard log package, so every logger call passes through here.
+type redactWriter struct {
+	out io.Writer
+}
+
+const (
+	redactedValue = "[REDACTED]"
+)
+
+var (
+	redactPatterns = []*regexp.Regexp{
+		// bcrypt password hashes, before tokens since their base64 may contain dots
+		regexp.MustCompile(`\$2[abxy]?\$\d{2}\$[./A-Za-z0-9]{53}`),
+		// auth and email tokens: base64url header.body.signature
+		regexp.MustCompile(`[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_=-]{10,}`),
+		// secret keys: base64url of auth.SecretByteSize random bytes
+		regexp.MustCompile(`[A-Za-z0-9_-]{43}=`),
+	}
+
+	// redactFieldPattern matches key=value pairs of sensitive fields, e.g. in connection strings or driver errors
+	redactFieldPattern = regexp.MustCompile(`(?i)\b(password|passwd|secret_key|secret|token)(\s*=\s*)("[^"]*"|'[^']*'|\S+)`)
+)
+
+func init() {
+	log.SetOutput(&redactWriter{out: os.Stderr})
+}
+
+// Write redacts p and writes it to out.
+// Returns len(p) on success since callers only care that the whole line was handled.
+func (w *redactWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write(redact(p)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// redact replaces every credential found in p with redactedValue.
+func redact(p []byte) []byte {
+	for _, pattern := range redactPatterns {
+		p = pattern.ReplaceAll(p, []byte(redactedValue))
+	}
+
+	return redactFieldPattern.ReplaceAll(p, []byte("${1}${2}"+redactedValue))
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"bytes"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/stretchr/testify/assert"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedact(t *testing.T) {
+	secretKey, err := auth.GenerateSecretKey(auth.SecretByteSize)
+	assert.Nil(t, err)
+
+	hashedPassword, err := hashPassword("TestRedact")
+	assert.Nil(t, err)
+
+	secret := &pblib.Secret{
+		Key:                 secretKey,
+		CreatedTimestamp:    time.Now().Unix(),
+		ExpirationTimestamp: time.Now().Add(time.Hour).Unix(),
+	}
+	uuid, err := generateUUID()
+	assert.Nil(t, err)
+	body := &auth.Body{
+		UUID:                uuid,
+		Permission:          auth.User,
+		ExpirationTimestamp: time.Now().Add(time.Hour).Unix(),
+	}
+	authToken, err := auth.NewToken(validAuthTokenHeader, body, secret)
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc     string
+		input    string
+		expected string
+	}{
+		{"test auth token", "[ERROR] VerifyAuthToken - " + authToken + " expired",
+			"[ERROR] VerifyAuthToken - [REDACTED] expired"},
+		{"test password hash", "[INFO] hash " + hashedPassword, "[INFO] hash [REDACTED]"},
+		{"test password hash with dots", "[INFO] hash $2a$04$abcdefghij.klmnopqrst.uvwxyzABCDEFGHIJKLMNOPQRSTUVWXY",
+			"[INFO] hash [REDACTED]"},
+		{"test secret key", "[ERROR] secret " + secretKey + " expired", "[ERROR] secret [REDACTED] expired"},
+		{"test connection string", "[ERROR] host=localhost user=postgres password=hunter2 dbname=test",
+			"[ERROR] host=localhost user=postgres password=[REDACTED] dbname=test"},
+		{"test quoted field", `[ERROR] secret_key = "abc def"`, "[ERROR] secret_key = [REDACTED]"},
+		{"test message without credentials", "[INFO] Retrieved user: 01d3x3wm2nnrdfzp0tka2vw9dx",
+			"[INFO] Retrieved user: 01d3x3wm2nnrdfzp0tka2vw9dx"},
+		{"test message mentioning a token", "[ERROR] error in generating email token: invalid",
+			"[ERROR] error in generating email token: invalid"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, string(redact([]byte(c.input))), c.desc)
+	}
+
+	desc := "test writer reports the unredacted length"
+	var out bytes.Buffer
+	w := &redactWriter{out: &out}
+	n, err := w.Write([]byte("token=" + authToken + "\n"))
+	assert.Nil(t, err, desc)
+	assert.Equal(t, len("token="+authToken+"\n"), n, desc)
+	assert.Equal(t, "token=[REDACTED]\n", out.String(), desc)
+}
+
+// sensitiveLogNames are proto fields, getters and variable names that must never be formatted into a log call
+var sensitiveLogNames = map[string]bool{
+	"Password":       true,
+	"GetPassword":    true,
+	"Token":          true,
+	"GetToken":       true,
+	"Secret":         true,
+	"GetSecret":      true,
+	"Key":            true,
+	"GetKey":         true,
+	"password":       true,
+	"hashedPassword": true,
+	"token":          true,
+	"newToken":       true,
+	"emailToken":     true,
+	"secret":         true,
+	"secretKey":      true,
+}
+
+// TestLogCallsOmitSensitiveFields works like a vet check over the module's non-test sources:
+// it fails if a sensitive field or variable is passed to logger, log or fmt.Print calls.
+func TestLogCallsOmitSensitiveFields(t *testing.T) {
+	fileSet := token.NewFileSet()
+	var violations []string
+
+	err := filepath.Walk("..", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && (info.Name() == "vendor" || strings.HasPrefix(info.Name(), ".")) && path != ".." {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+
+		file, err := parser.ParseFile(fileSet, path, nil, 0)
+		if err != nil {
+			return err
+		}
+
+		ast.Inspect(file, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok || !isLogCall(call) {
+				return true
+			}
+			for _, arg := range call.Args {
+				ast.Inspect(arg, func(argNode ast.Node) bool {
+					if name := sensitiveName(argNode); name != "" {
+						violations = append(violations, fileSet.Position(argNode.Pos()).String()+" logs "+name)
+					}
+					return true
+				})
+			}
+			return true
+		})
+
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Empty(t, violations)
+}
+
+func isLogCall(call *ast.CallExpr) bool {
+	selector, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	pkg, ok := selector.X.(*ast.Ident)
+	if !ok {
+		return false
+	}
+
+	switch pkg.Name {
+	case "logger", "log":
+		return true
+	case "fmt":
+		return strings.HasPrefix(selector.Sel.Name, "Print")
+	}
+
+	return false
+}
+
+func sensitiveName(node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.SelectorExpr:
+		if sensitiveLogNames[n.Sel.Name] {
+			return n.Sel.Name
+		}
+	case *ast.Ident:
+		if sensitiveLogNames[n.Name] && n.Obj != nil {
+			return n.Name
+		}
+	}
+
+	return ""
+}
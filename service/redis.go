@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// redisClient runs the handful of commands the user cache needs on a go-redis connection pool.
+// Every command, waiting for a pooled connection included, must finish within timeout.
+type redisClient struct {
+	client  *redis.Client
+	timeout time.Duration
+}
+
+// redisPoolSize bounds the connections to redis of an instance, GetUser only sends single GET and SET commands
+const redisPoolSize = 8
+
+var (
+	// redisNil is returned by get when the key does not exist
+	redisNil = redis.Nil
+)
+
+// newRedisClient creates a client for the redis server at address, no connection is made until the first command.
+func newRedisClient(address string, password string, db int, timeout time.Duration) *redisClient {
+	return &redisClient{
+		client: redis.NewClient(&redis.Options{
+			Addr:         address,
+			Password:     password,
+			DB:           db,
+			DialTimeout:  timeout,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+			PoolSize:     redisPoolSize,
+			PoolTimeout:  timeout,
+			// a failed command is a cache miss that falls back to postgres, retrying would only delay it
+			MaxRetries: -1,
+		}),
+		timeout: timeout,
+	}
+}
+
+// get returns the value stored at key, or redisNil if key does not exist.
+func (c *redisClient) get(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	return c.client.Get(ctx, key).Bytes()
+}
+
+// set stores value at key, expiring after ttl rounded down to seconds, at least one.
+func (c *redisClient) set(key string, value []byte, ttl time.Duration) error {
+	ttl = ttl.Truncate(time.Second)
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	return c.client.Set(ctx, key, value, ttl).Err()
+}
+
+// del removes keys, missing keys are ignored.
+func (c *redisClient) del(keys ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	return c.client.Del(ctx, keys...).Err()
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// unitTestRedisServer is an in-memory server speaking just enough RESP2 for redisClient, it refuses HELLO
+// like a redis older than 6
+type unitTestRedisServer struct {
+	lock        sync.Mutex
+	listener    net.Listener
+	password    string
+	data        map[string]string
+	ttl         map[string]string
+	connections int
+}
+
+func newUnitTestRedisServer(t *testing.T, password string) *unitTestRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	server := &unitTestRedisServer{
+		listener: listener,
+		password: password,
+		data:     make(map[string]string),
+		ttl:      make(map[string]string),
+	}
+	go server.serve()
+
+	return server
+}
+
+func (s *unitTestRedisServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.connections++
+		s.lock.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *unitTestRedisServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := s.password == ""
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, count)
+		for i := range args {
+			line, _ = reader.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			buf := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				return
+			}
+			args[i] = string(buf[:size])
+		}
+
+		// go-redis sends lower case commands
+		args[0] = strings.ToUpper(args[0])
+
+		// DEBUG SLEEP only stalls its own connection, unlike redis
+		if args[0] == "DEBUG" {
+			seconds, _ := strconv.ParseFloat(args[2], 64)
+			time.Sleep(time.Duration(seconds * float64(time.Second)))
+			if _, err := conn.Write([]byte("+OK\r\n")); err != nil {
+				return
+			}
+			continue
+		}
+
+		s.lock.Lock()
+		var reply string
+		switch {
+		case args[0] == "AUTH":
+			authenticated = args[1] == s.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-ERR invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "SET":
+			s.data[args[1]] = args[2]
+			s.ttl[args[1]] = args[4]
+			reply = "+OK\r\n"
+		case args[0] == "GET":
+			value, ok := s.data[args[1]]
+			reply = "$-1\r\n"
+			if ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+			}
+		case args[0] == "DEL":
+			deleted := 0
+			for _, key := range args[1:] {
+				if _, ok := s.data[key]; ok {
+					delete(s.data, key)
+					deleted++
+				}
+			}
+			reply = fmt.Sprintf(":%d\r\n", deleted)
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		s.lock.Unlock()
+
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func TestRedisClient(t *testing.T) {
+	server := newUnitTestRedisServer(t, "secret")
+	defer server.listener.Close()
+
+	desc := "test wrong password"
+	client := newRedisClient(server.listener.Addr().String(), "wrong", 0, time.Second)
+	_, err := client.get("key")
+	assert.EqualError(t, err, "ERR invalid password", desc)
+
+	client = newRedisClient(server.listener.Addr().String(), "secret", 0, time.Second)
+
+	desc = "test missing key"
+	_, err = client.get("key")
+	assert.Equal(t, redisNil, err, desc)
+
+	desc = "test set and get binary safe value"
+	err = client.set("key", []byte("value\r\nwith newline"), 90*time.Second)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "90", server.ttl["key"], desc)
+	value, err := client.get("key")
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "value\r\nwith newline", string(value), desc)
+
+	desc = "test ttl is at least one second"
+	err = client.set("short", []byte("value"), time.Millisecond)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "1", server.ttl["short"], desc)
+
+	desc = "test delete"
+	err = client.del("key", "short", "missing")
+	assert.Nil(t, err, desc)
+	_, err = client.get("key")
+	assert.Equal(t, redisNil, err, desc)
+
+	desc = "test unreachable server"
+	client = newRedisClient("127.0.0.1:1", "", 0, 100*time.Millisecond)
+	_, err = client.get("key")
+	assert.NotNil(t, err, desc)
+}
+
+func TestRedisClientPool(t *testing.T) {
+	server := newUnitTestRedisServer(t, "")
+	defer server.listener.Close()
+	client := newRedisClient(server.listener.Addr().String(), "", 0, 200*time.Millisecond)
+
+	desc := "test connections are reused"
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, client.set("key", []byte("value"), time.Minute), desc)
+	}
+	server.lock.Lock()
+	assert.Equal(t, 1, server.connections, desc)
+	server.lock.Unlock()
+
+	desc = "test a stalled connection does not hold up other commands"
+	stalled := make(chan error)
+	go func() {
+		stalled <- client.client.Do(context.TODO(), "DEBUG", "SLEEP", "1").Err()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	value, err := client.get("key")
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "value", string(value), desc)
+	assert.True(t, time.Since(start) < 100*time.Millisecond, desc)
+
+	desc = "test stalled command times out"
+	assert.NotNil(t, <-stalled, desc)
+
+	desc = "test timed out connections are replaced"
+	value, err = client.get("key")
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "value", string(value), desc)
+}
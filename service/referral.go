@@ -0,0 +1,79 @@
+package service
+
+import (
+	"crypto/rand"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"strconv"
+	"strings"
+)
+
+// referralStats are returned by GetReferralStats
+type referralStats struct {
+	code              string
+	referrals         int64
+	verifiedReferrals int64
+
+	// referredBy is the uuid of the user whose code was used at signup, empty if none
+	referredBy string
+}
+
+const (
+	// referralCodeAlphabet is Crockford's base32, it leaves out I, L, O and U so codes are easy to read out loud
+	referralCodeAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	referralCodeLength   = 10
+)
+
+// generateReferralCode returns a random code of referralCodeLength characters from referralCodeAlphabet.
+// Uniqueness is enforced by the db, collisions are unlikely enough to surface as a failed insert.
+func generateReferralCode() (string, error) {
+	random := make([]byte, referralCodeLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	code := make([]byte, referralCodeLength)
+	for i, b := range random {
+		// 256 is a multiple of 32, every character is equally likely
+		code[i] = referralCodeAlphabet[int(b)%len(referralCodeAlphabet)]
+	}
+
+	return string(code), nil
+}
+
+// normalizeReferralCode upper cases code, users may type it in any case.
+// Returns ErrInvalidReferralCode if code cannot have been generated by generateReferralCode.
+func normalizeReferralCode(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != referralCodeLength {
+		return "", consts.ErrInvalidReferralCode
+	}
+
+	for _, r := range code {
+		if !strings.ContainsRune(referralCodeAlphabet, r) {
+			return "", consts.ErrInvalidReferralCode
+		}
+	}
+
+	return code, nil
+}
+
+// setResponseHeaders returns the stats as response headers, see Service.GetReferralStats.
+func (s *referralStats) setResponseHeaders(ctx context.Context) error {
+	if err := setResponseHeader(ctx, metadataKeyReferralCode, s.code); err != nil {
+		return err
+	}
+	if err := setResponseHeader(ctx, metadataKeyReferrals, strconv.FormatInt(s.referrals, 10)); err != nil {
+		return err
+	}
+	if err := setResponseHeader(ctx, metadataKeyVerifiedReferrals,
+		strconv.FormatInt(s.verifiedReferrals, 10)); err != nil {
+		return err
+	}
+
+	if s.referredBy == "" {
+		return nil
+	}
+
+	return setResponseHeader(ctx, metadataKeyReferredBy, s.referredBy)
+}
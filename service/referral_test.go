@@ -0,0 +1,51 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGenerateReferralCode(t *testing.T) {
+	codes := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		code, err := generateReferralCode()
+		assert.Nil(t, err)
+		assert.Len(t, code, referralCodeLength)
+
+		normalized, err := normalizeReferralCode(code)
+		assert.Nil(t, err, code)
+		assert.Equal(t, code, normalized)
+
+		codes[code] = true
+	}
+	assert.Len(t, codes, 100)
+}
+
+func TestNormalizeReferralCode(t *testing.T) {
+	cases := []struct {
+		desc     string
+		code     string
+		expCode  string
+		isExpErr bool
+	}{
+		{"test valid code", "0123456789", "0123456789", false},
+		{"test lower case", "abcdefghjk", "ABCDEFGHJK", false},
+		{"test surrounding spaces", " MNPQRSTVWX ", "MNPQRSTVWX", false},
+		{"test too short", "ABCDEFGHJ", "", true},
+		{"test too long", "ABCDEFGHJKM", "", true},
+		{"test excluded letter", "ABCDEFGHJI", "", true},
+		{"test symbol", "ABCDEFGHJ-", "", true},
+		{"test empty", "", "", true},
+	}
+
+	for _, c := range cases {
+		code, err := normalizeReferralCode(c.code)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidReferralCode.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+		assert.Equal(t, c.expCode, code, c.desc)
+	}
+}
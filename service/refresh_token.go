@@ -0,0 +1,79 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"golang.org/x/net/context"
+	"time"
+)
+
+const (
+	// defaultRefreshLifetime lets a client stay signed in for 30 days without the user's password
+	defaultRefreshLifetime = 30 * 24 * time.Hour
+
+	refreshTokenByteSize = 32
+)
+
+var (
+	// refreshLifetime is set with hosts_auth_refreshlifetime
+	refreshLifetime = defaultRefreshLifetime
+)
+
+func init() {
+	if conf.Auth.RefreshLifetime == "" {
+		return
+	}
+
+	lifetime, err := time.ParseDuration(conf.Auth.RefreshLifetime)
+	if err != nil || lifetime <= 0 {
+		reportStartupProblem("Invalid refresh token lifetime:", conf.Auth.RefreshLifetime)
+		return
+	}
+	refreshLifetime = lifetime
+}
+
+// hashToken returns the hex sha-256 of token, the value refresh tokens and revoked auth tokens are stored and
+// looked up as. Tokens are random or signed, unlike passwords they do not need a slow hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueRefreshToken stores a new refresh token of uuid valid for refreshLifetime from now.
+// Returns the token, shown once to the client, or error if it could not be generated or stored.
+func issueRefreshToken(ctx context.Context, uuid string, now time.Time) (string, error) {
+	random := make([]byte, refreshTokenByteSize)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+
+	if err := insertRefreshToken(ctx, uuid, hashToken(token), now, now.Add(refreshLifetime)); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// refreshIdentification generates a new auth token for user with the permission user has now,
+// permission changes since the refresh token was issued apply to the new auth token.
+// Returns the new identification or error.
+func refreshIdentification(ctx context.Context, user *pblib.User) (*pblib.Identification, error) {
+	permissionLevel := auth.PermissionEnumMap[user.GetPermissionLevel()]
+	header := &auth.Header{
+		Alg:      auth.AlgorithmMap[permissionLevel],
+		TokenTyp: auth.Jwt,
+	}
+	body := &auth.Body{
+		UUID:                user.GetUuid(),
+		Permission:          permissionLevel,
+		ExpirationTimestamp: time.Now().UTC().Add(time.Hour * time.Duration(authTokenExpirationTime)).Unix(),
+	}
+
+	return newAuthIdentification(ctx, header, body, user)
+}
@@ -0,0 +1,15 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHashRefreshToken(t *testing.T) {
+	desc := "test hashes are stable hex sha-256"
+	assert.Equal(t, hashToken("token"), hashToken("token"), desc)
+	assert.Len(t, hashToken("token"), 64, desc)
+
+	desc = "test different tokens have different hashes"
+	assert.NotEqual(t, hashToken("token"), hashToken("other"), desc)
+}
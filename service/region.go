@@ -0,0 +1,110 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"path"
+	"strings"
+)
+
+const (
+	regionRolePrimary = "primary"
+	regionRoleStandby = "standby"
+)
+
+var (
+	// writeMethods are the rpc methods that write to the database, a standby instance rejects them.
+	// Admin RPCs record the call and are rejected by authorizeAdmin instead, reads by other users still work.
+	writeMethods = map[string]bool{
+		"CreateUser":                    true,
+		"DeleteUser":                    true,
+		"RestoreUser":                   true,
+		"VerifyUser":                    true,
+		"ForgetUser":                    true,
+		"UpdateUser":                    true,
+		"AuthenticateUser":              true,
+		"ShareDocument":                 true,
+		"UnshareDocument":               true,
+		"GetNewAuthToken":               true,
+		"RefreshAuthToken":              true,
+		"LogoutUser":                    true,
+		"MakeNewAuthSecret":             true,
+		"VerifyEmailToken":              true,
+		"ConfirmEmailChange":            true,
+		"CancelEmailChange":             true,
+		"VerifyParentalConsent":         true,
+		"ConfirmLoginCountry":           true,
+		"RequestPasswordReset":          true,
+		"ResendVerificationEmail":       true,
+		"ResetPassword":                 true,
+		"SetOnboardingStep":             true,
+		"UpdateNotificationPreferences": true,
+		"LinkAuthMethod":                true,
+		"UnlinkAuthMethod":              true,
+		"Enable2FA":                     true,
+		"Verify2FA":                     true,
+		"Disable2FA":                    true,
+		"CreateAPIKey":                  true,
+		"RevokeAPIKey":                  true,
+		"FavoriteDocument":              true,
+		"UnfavoriteDocument":            true,
+		"RegisterDocument":              true,
+		"UnregisterDocument":            true,
+		"SetDocumentPublic":             true,
+		"SetSharePolicy":                true,
+		"CreateOrganization":            true,
+		"DeleteUsersByOrganization":     true,
+		"SetOrganizationAdmin":          true,
+	}
+
+	// isStandby is set with hosts_region_role, standby instances never write so regions cannot diverge.
+	// It is initialized before any init function, so the scheduled jobs of other files can check it.
+	isStandby      = strings.ToLower(conf.Region.Role) == regionRoleStandby
+	regionName     = conf.Region.Name
+	primaryAddress = conf.Region.Primary
+)
+
+func init() {
+	switch strings.ToLower(conf.Region.Role) {
+	case "", regionRolePrimary:
+	case regionRoleStandby:
+		if primaryAddress == "" {
+			reportStartupProblem("Standby region requires the primary address")
+			return
+		}
+		logger.Info(consts.RegionTag, "Serving reads as a standby of", primaryAddress)
+	default:
+		reportStartupProblem("Invalid region role:", conf.Region.Role)
+	}
+}
+
+// RegionInterceptor rejects writes on a standby instance before they reach the Service handlers.
+func RegionInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	if isStandby && writeMethods[path.Base(info.FullMethod)] {
+		logger.Error(consts.RegionTag, info.FullMethod, consts.ErrStandbyInstance.Error())
+		return nil, standbyStatus(ctx)
+	}
+
+	return handler(ctx, req)
+}
+
+// standbyStatus returns a FailedPrecondition status error, and points the client to the primary
+// with the x-hwsc-primary response header.
+func standbyStatus(ctx context.Context) error {
+	if err := setResponseHeader(ctx, metadataKeyPrimary, primaryAddress); err != nil {
+		logger.Error(consts.RegionTag, consts.MsgErrSetResponseHeader, err.Error())
+	}
+	if regionName != "" {
+		if err := setResponseHeader(ctx, metadataKeyRegion, regionName); err != nil {
+			logger.Error(consts.RegionTag, consts.MsgErrSetResponseHeader, err.Error())
+		}
+	}
+
+	return status.Error(codes.FailedPrecondition, consts.ErrStandbyInstance.Error())
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestRegionInterceptor(t *testing.T) {
+	standby, region, primary := isStandby, regionName, primaryAddress
+	defer func() { isStandby, regionName, primaryAddress = standby, region, primary }()
+
+	var calls int
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls++
+		return &pbsvc.UserResponse{Message: codes.OK.String()}, nil
+	}
+	createInfo := &grpc.UnaryServerInfo{FullMethod: "/user.UserService/CreateUser"}
+	getInfo := &grpc.UnaryServerInfo{FullMethod: "/user.UserService/GetUser"}
+
+	desc := "test primary serves writes"
+	isStandby, regionName, primaryAddress = false, "us-west", ""
+	ctx, stream := unitTestServerContext()
+	_, err := RegionInterceptor(ctx, &pbsvc.UserRequest{}, createInfo, handler)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 1, calls, desc)
+	assert.Empty(t, stream.header.Get(metadataKeyPrimary), desc)
+
+	isStandby, regionName, primaryAddress = true, "us-east", "user-svc.us-west.hwsc.com:50052"
+
+	desc = "test standby rejects writes with a redirect to the primary"
+	ctx, stream = unitTestServerContext()
+	_, err = RegionInterceptor(ctx, &pbsvc.UserRequest{}, createInfo, handler)
+	assert.Equal(t, 1, calls, desc)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), desc)
+	assert.Equal(t, consts.ErrStandbyInstance.Error(), status.Convert(err).Message(), desc)
+	assert.Equal(t, []string{"user-svc.us-west.hwsc.com:50052"}, stream.header.Get(metadataKeyPrimary), desc)
+	assert.Equal(t, []string{"us-east"}, stream.header.Get(metadataKeyRegion), desc)
+
+	desc = "test standby serves reads"
+	ctx, stream = unitTestServerContext()
+	_, err = RegionInterceptor(ctx, &pbsvc.UserRequest{}, getInfo, handler)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 2, calls, desc)
+	assert.Empty(t, stream.header.Get(metadataKeyPrimary), desc)
+
+	desc = "test every debounced mutation is a write"
+	for method := range debouncedMethods {
+		assert.True(t, writeMethods[method], desc+": "+method)
+	}
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"time"
+)
+
+const (
+	// defaultVerificationResendCooldown keeps ResendVerificationEmail from mail-bombing an address
+	defaultVerificationResendCooldown = 5 * time.Minute
+)
+
+var (
+	// verificationResendCooldown is set with hosts_verification_resendcooldown
+	verificationResendCooldown = defaultVerificationResendCooldown
+)
+
+func init() {
+	if value := conf.Verification.ResendCooldown; value != "" {
+		cooldown, err := time.ParseDuration(value)
+		if err != nil || cooldown < 0 {
+			reportStartupProblem("Invalid verification resend cooldown:", value)
+			return
+		}
+		verificationResendCooldown = cooldown
+	}
+}
+
+// resendVerificationEmail emails unverified user a new verification link, the link of any previous email
+// stops working. The previous email is kept if it was sent less than verificationResendCooldown ago.
+// Returns the time user may be sent another email, ErrVerificationResendCooldown with that time if no email
+// was sent, or error if the token could not be generated or stored, or the email could not be queued.
+func resendVerificationEmail(ctx context.Context, user *pblib.User) (time.Time, error) {
+	emailID, err := auth.GenerateEmailIdentification(user.GetUuid(), auth.PermissionStringMap[auth.NoPermission])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	next, err := replaceEmailToken(ctx, user.GetUuid(), emailID.GetToken(), emailID.GetSecret(),
+		verificationResendCooldown)
+	if err != nil {
+		return next, err
+	}
+
+	return next, sendVerificationEmail(ctx, consts.ResendVerifyTag, user, emailID.GetToken())
+}
@@ -0,0 +1,285 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentionRule removes data older than period.
+// apply runs inside the rule's transaction and returns the number of affected rows, and optionally
+// a function to run once the transaction is committed, e.g. to publish events.
+type retentionRule struct {
+	name   string
+	period time.Duration
+	apply  func(ctx context.Context, tx *sql.Tx, cutoff time.Time) (int64, func(), error)
+}
+
+// retentionReport is the outcome of one run of the retention rules, logged after every run
+type retentionReport struct {
+	dryRun   bool
+	started  time.Time
+	affected map[string]int64
+	failed   map[string]error
+}
+
+const (
+	retentionModeEnforce = "enforce"
+	retentionModeDryRun  = "dryrun"
+
+	// defaultRetentionSchedule runs the rules daily at 4 AM
+	defaultRetentionSchedule = "0 4 * * *"
+	defaultRetentionTimezone = "UTC"
+
+	retentionRuleUnverifiedAccounts = "unverified accounts"
+	retentionRuleLoginHistory       = "login history"
+	retentionRuleDeletedUsers       = "deleted users"
+	retentionRuleSoftDeletedUsers   = "soft deleted users"
+)
+
+var (
+	// retentionRules are the rules with a configured period, nil disables the retention job
+	retentionRules []retentionRule
+
+	retentionDryRun   bool
+	retentionSchedule *cronSchedule
+
+	// softDeleteUsers makes DeleteUser mark accounts deleted, the soft deleted users rule purges them
+	softDeleteUsers = conf.Retention.SoftDeletedUsers != ""
+)
+
+func init() {
+	var err error
+	retentionRules, err = newRetentionRules(conf.Retention)
+	if err != nil {
+		reportStartupProblem("Invalid retention period:", err.Error())
+		return
+	}
+
+	switch strings.ToLower(conf.Retention.Mode) {
+	case "", retentionModeEnforce:
+	case retentionModeDryRun:
+		retentionDryRun = true
+	default:
+		reportStartupProblem("Invalid retention mode:", conf.Retention.Mode)
+		return
+	}
+
+	spec := conf.Retention.Schedule
+	if spec == "" {
+		spec = defaultRetentionSchedule
+	}
+
+	timezone := conf.Retention.Timezone
+	if timezone == "" {
+		timezone = defaultRetentionTimezone
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		reportStartupProblem("Invalid retention timezone:", timezone)
+		return
+	}
+
+	retentionSchedule, err = parseCronSchedule(spec, location)
+	if err != nil {
+		reportStartupProblem("Invalid retention schedule:", spec)
+		return
+	}
+
+	// the primary region applies the rules, deletions reach standby databases through replication
+	if len(retentionRules) > 0 && !isStandby {
+		go runRetentionSchedule()
+	}
+}
+
+// newRetentionRules returns a rule for every configured period.
+// Returns error if a period is invalid.
+func newRetentionRules(rules conf.RetentionRules) ([]retentionRule, error) {
+	candidates := []struct {
+		name   string
+		period string
+		apply  func(ctx context.Context, tx *sql.Tx, cutoff time.Time) (int64, func(), error)
+	}{
+		{retentionRuleUnverifiedAccounts, rules.UnverifiedAccounts, applyUnverifiedAccountsRetention},
+		{retentionRuleLoginHistory, rules.LoginHistory, applyLoginHistoryRetention},
+		{retentionRuleDeletedUsers, rules.DeletedUsers, applyDeletedUsersRetention},
+		{retentionRuleSoftDeletedUsers, rules.SoftDeletedUsers, applySoftDeletedUsersRetention},
+	}
+
+	var configured []retentionRule
+	for _, candidate := range candidates {
+		if candidate.period == "" {
+			continue
+		}
+
+		period, err := parseRetentionPeriod(candidate.period)
+		if err != nil {
+			return nil, err
+		}
+		configured = append(configured, retentionRule{
+			name:   candidate.name,
+			period: period,
+			apply:  candidate.apply,
+		})
+	}
+
+	return configured, nil
+}
+
+// parseRetentionPeriod parses a positive number of days such as "30d", or a duration such as "720h".
+// Returns ErrInvalidRetentionPeriod otherwise.
+func parseRetentionPeriod(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+
+	var period time.Duration
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, consts.ErrInvalidRetentionPeriod
+		}
+		period = time.Duration(days) * 24 * time.Hour
+	} else {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, consts.ErrInvalidRetentionPeriod
+		}
+		period = parsed
+	}
+
+	if period <= 0 {
+		return 0, consts.ErrInvalidRetentionPeriod
+	}
+
+	return period, nil
+}
+
+// runRetentionSchedule applies retentionRules every time retentionSchedule comes up, it never returns.
+func runRetentionSchedule() {
+	for {
+		next := retentionSchedule.next(time.Now())
+		time.Sleep(time.Until(next))
+
+		if err := refreshDBConnection(); err != nil {
+			logger.Error(consts.RetentionTag, consts.ErrDBConnectionError.Error())
+			continue
+		}
+
+		runRetention(context.Background(), retentionRules, retentionDryRun, time.Now().UTC()).log()
+	}
+}
+
+// runRetention applies each rule to the data older than its period at now, in its own transaction
+// so a failing rule does not hold back the others. A dry run rolls every transaction back.
+func runRetention(ctx context.Context, rules []retentionRule, dryRun bool, now time.Time) *retentionReport {
+	report := &retentionReport{
+		dryRun:   dryRun,
+		started:  now,
+		affected: make(map[string]int64, len(rules)),
+		failed:   make(map[string]error),
+	}
+
+	for _, rule := range rules {
+		affected, err := applyRetentionRule(ctx, rule, dryRun, now.Add(-rule.period))
+		if err != nil {
+			report.failed[rule.name] = err
+			continue
+		}
+		report.affected[rule.name] = affected
+	}
+
+	return report
+}
+
+func applyRetentionRule(ctx context.Context, rule retentionRule, dryRun bool, cutoff time.Time) (int64, error) {
+	tx, err := postgresDB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	affected, committed, err := rule.apply(ctx, tx, cutoff)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	if dryRun {
+		return affected, tx.Rollback()
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if committed != nil {
+		committed()
+	}
+
+	return affected, nil
+}
+
+func applyUnverifiedAccountsRetention(ctx context.Context, tx *sql.Tx, cutoff time.Time) (int64, func(), error) {
+	uuids, err := purgeUnverifiedAccounts(ctx, tx, cutoff)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return int64(len(uuids)), func() {
+		for _, uuid := range uuids {
+			invalidateCachedUser(uuid)
+			publishUserEvent(eventTypeUserDeleted, &pblib.User{Uuid: uuid})
+		}
+	}, nil
+}
+
+func applyLoginHistoryRetention(ctx context.Context, tx *sql.Tx, cutoff time.Time) (int64, func(), error) {
+	deleted, err := deleteLoginHistory(ctx, tx, cutoff)
+	return deleted, nil, err
+}
+
+func applyDeletedUsersRetention(ctx context.Context, tx *sql.Tx, cutoff time.Time) (int64, func(), error) {
+	anonymized, err := anonymizeDeletedUserEvents(ctx, tx, cutoff)
+	return anonymized, nil, err
+}
+
+func applySoftDeletedUsersRetention(ctx context.Context, tx *sql.Tx, cutoff time.Time) (int64, func(), error) {
+	uuids, err := purgeSoftDeletedAccounts(ctx, tx, cutoff)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// consumers learn of the deletion once it can no longer be undone
+	return int64(len(uuids)), func() {
+		for _, uuid := range uuids {
+			invalidateCachedUser(uuid)
+			publishUserEvent(eventTypeUserDeleted, &pblib.User{Uuid: uuid})
+		}
+	}, nil
+}
+
+// log writes one line per rule, failed rules are logged as errors.
+func (r *retentionReport) log() {
+	verb := "removed"
+	if r.dryRun {
+		verb = "would remove"
+	}
+
+	names := make([]string, 0, len(r.affected))
+	for name := range r.affected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		logger.Info(consts.RetentionTag, name+":", verb, strconv.FormatInt(r.affected[name], 10), "rows")
+	}
+
+	for name, err := range r.failed {
+		logger.Error(consts.RetentionTag, name+":", consts.MsgErrApplyRetention, err.Error())
+	}
+}
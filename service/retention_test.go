@@ -0,0 +1,63 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPeriod(t *testing.T) {
+	cases := []struct {
+		desc      string
+		value     string
+		expPeriod time.Duration
+		isExpErr  bool
+	}{
+		{"test days", "30d", 30 * 24 * time.Hour, false},
+		{"test duration", "720h", 720 * time.Hour, false},
+		{"test surrounding spaces", " 90d ", 90 * 24 * time.Hour, false},
+		{"test zero days", "0d", 0, true},
+		{"test negative duration", "-1h", 0, true},
+		{"test fractional days", "1.5d", 0, true},
+		{"test missing unit", "30", 0, true},
+	}
+
+	for _, c := range cases {
+		period, err := parseRetentionPeriod(c.value)
+		if c.isExpErr {
+			assert.Equal(t, consts.ErrInvalidRetentionPeriod, err, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+		assert.Equal(t, c.expPeriod, period, c.desc)
+	}
+}
+
+func TestNewRetentionRules(t *testing.T) {
+	desc := "test no periods disables retention"
+	rules, err := newRetentionRules(conf.RetentionRules{})
+	assert.Nil(t, err, desc)
+	assert.Empty(t, rules, desc)
+
+	desc = "test only configured rules are returned"
+	rules, err = newRetentionRules(conf.RetentionRules{UnverifiedAccounts: "30d", DeletedUsers: "2160h"})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 2, len(rules), desc)
+	assert.Equal(t, retentionRuleUnverifiedAccounts, rules[0].name, desc)
+	assert.Equal(t, 30*24*time.Hour, rules[0].period, desc)
+	assert.Equal(t, retentionRuleDeletedUsers, rules[1].name, desc)
+	assert.Equal(t, 90*24*time.Hour, rules[1].period, desc)
+
+	desc = "test soft deleted users rule"
+	rules, err = newRetentionRules(conf.RetentionRules{SoftDeletedUsers: "30d"})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 1, len(rules), desc)
+	assert.Equal(t, retentionRuleSoftDeletedUsers, rules[0].name, desc)
+
+	desc = "test invalid period"
+	rules, err = newRetentionRules(conf.RetentionRules{LoginHistory: "a year"})
+	assert.Equal(t, consts.ErrInvalidRetentionPeriod, err, desc)
+	assert.Nil(t, rules, desc)
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five field cron expression: minute hour day-of-month month day-of-week.
+// Each field is a bitset of the values it matches.
+type cronSchedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	// as in cron, a restricted day-of-month or day-of-week matches if either field matches
+	daysRestricted     bool
+	weekdaysRestricted bool
+	location           *time.Location
+}
+
+type cronField struct {
+	min int
+	max int
+}
+
+const (
+	// defaultSecretSchedule rotates secrets on Mondays at 3 AM
+	defaultSecretSchedule = "0 3 * * 1"
+	defaultSecretTimezone = "UTC"
+
+	// cronSearchYears bounds the search for a schedule matching rare dates like Feb 29
+	cronSearchYears = 8
+)
+
+var (
+	cronFields = []cronField{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+	// minSecretLifetime keeps a secret created right before a scheduled rotation valid for the lifetime of its tokens
+	minSecretLifetime = time.Hour * time.Duration(authTokenExpirationTime)
+
+	secretRotation *cronSchedule
+
+	// secretRotationInterval is set with hosts_secret_interval, secrets expire on secretRotation unless it is set
+	secretRotationInterval time.Duration
+)
+
+func init() {
+	if value := conf.SecretRotation.Interval; value != "" {
+		if conf.SecretRotation.Schedule != "" {
+			reportStartupProblem("Secret rotation takes a schedule or an interval, not both")
+			return
+		}
+
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < minSecretLifetime {
+			reportStartupProblem("Invalid secret rotation interval:", value)
+			return
+		}
+		secretRotationInterval = interval
+	}
+
+	spec := conf.SecretRotation.Schedule
+	if spec == "" {
+		spec = defaultSecretSchedule
+	}
+
+	timezone := conf.SecretRotation.Timezone
+	if timezone == "" {
+		timezone = defaultSecretTimezone
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		reportStartupProblem("Invalid secret rotation timezone:", timezone)
+		return
+	}
+
+	secretRotation, err = parseCronSchedule(spec, location)
+	if err != nil {
+		reportStartupProblem("Invalid secret rotation schedule:", spec)
+		return
+	}
+}
+
+// parseCronSchedule parses spec in location.
+// Fields accept *, values, ranges, steps and comma separated lists, e.g. "*/15 2-4 1,15 * 1-5".
+// Returns error if spec does not have five valid fields or never matches a date.
+func parseCronSchedule(spec string, location *time.Location) (*cronSchedule, error) {
+	if location == nil {
+		return nil, consts.ErrInvalidCronSchedule
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, consts.ErrInvalidCronSchedule
+	}
+
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		parsed, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = parsed
+	}
+
+	// 7 is an alias of Sunday
+	if bits[4]&(1<<7) != 0 {
+		bits[4] = bits[4]&^(1<<7) | 1
+	}
+
+	schedule := &cronSchedule{
+		minutes:            bits[0],
+		hours:              bits[1],
+		days:               bits[2],
+		months:             bits[3],
+		weekdays:           bits[4],
+		daysRestricted:     fields[2] != "*",
+		weekdaysRestricted: fields[4] != "*",
+		location:           location,
+	}
+
+	// reject schedules such as Feb 30 that would never rotate
+	if schedule.next(time.Date(2000, time.January, 1, 0, 0, 0, 0, location)).IsZero() {
+		return nil, consts.ErrInvalidCronSchedule
+	}
+
+	return schedule, nil
+}
+
+func parseCronField(field string, bounds cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			parsed, err := strconv.Atoi(part[i+1:])
+			if err != nil || parsed <= 0 {
+				return 0, consts.ErrInvalidCronSchedule
+			}
+			step = parsed
+			part = part[:i]
+		}
+
+		low, high := bounds.min, bounds.max
+		switch i := strings.Index(part, "-"); {
+		case part == "*":
+		case i >= 0:
+			var err error
+			if low, err = strconv.Atoi(part[:i]); err != nil {
+				return 0, consts.ErrInvalidCronSchedule
+			}
+			if high, err = strconv.Atoi(part[i+1:]); err != nil {
+				return 0, consts.ErrInvalidCronSchedule
+			}
+		default:
+			value, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, consts.ErrInvalidCronSchedule
+			}
+			low = value
+			// a single value with a step runs from the value to the end of the range
+			if step == 1 {
+				high = value
+			}
+		}
+
+		if low < bounds.min || high > bounds.max || low > high {
+			return 0, consts.ErrInvalidCronSchedule
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+
+	return bits, nil
+}
+
+// matchesDate reports whether the schedule runs on the calendar date year-month-day.
+func (s *cronSchedule) matchesDate(year int, month time.Month, day int) bool {
+	if s.months&(1<<uint(month)) == 0 {
+		return false
+	}
+
+	dayMatch := s.days&(1<<uint(day)) != 0
+	weekday := time.Date(year, month, day, 12, 0, 0, 0, time.UTC).Weekday()
+	weekdayMatch := s.weekdays&(1<<uint(weekday)) != 0
+
+	if s.daysRestricted && s.weekdaysRestricted {
+		return dayMatch || weekdayMatch
+	}
+
+	return dayMatch && weekdayMatch
+}
+
+// next returns the first scheduled time strictly after after, or the zero time if there is none.
+// Times are evaluated on the wall clock of the schedule's location: a time skipped by a DST
+// transition runs once the clocks have moved forward, and a time repeated when clocks move back runs once.
+func (s *cronSchedule) next(after time.Time) time.Time {
+	after = after.In(s.location)
+	year, month, day := after.Date()
+	last := time.Date(year+cronSearchYears, month, day, 0, 0, 0, 0, time.UTC)
+
+	for date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC); date.Before(last); date = date.AddDate(0, 0, 1) {
+		if !s.matchesDate(date.Year(), date.Month(), date.Day()) {
+			continue
+		}
+
+		// times moved past a DST gap may come after later times of the day, so the earliest instant is picked explicitly
+		var earliest time.Time
+		for hour := 0; hour < 24; hour++ {
+			if s.hours&(1<<uint(hour)) == 0 {
+				continue
+			}
+			for minute := 0; minute < 60; minute++ {
+				if s.minutes&(1<<uint(minute)) == 0 {
+					continue
+				}
+				candidate := time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, s.location)
+				if candidate.Hour() != hour || candidate.Minute() != minute {
+					// wall time falls in a DST gap, read it on the clock from before the transition so it lands after the gap
+					_, offset := candidate.Add(-12 * time.Hour).Zone()
+					candidate = time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0,
+						time.FixedZone("", offset)).In(s.location)
+				}
+				if candidate.After(after) && (earliest.IsZero() || candidate.Before(earliest)) {
+					earliest = candidate
+				}
+			}
+		}
+
+		if !earliest.IsZero() {
+			return earliest
+		}
+	}
+
+	return time.Time{}
+}
+
+// secretExpiration returns when a secret created at createdTimestamp expires: secretRotationInterval later if
+// it is set, otherwise the first scheduled rotation at least minSecretLifetime later.
+func secretExpiration(createdTimestamp time.Time) time.Time {
+	if secretRotationInterval > 0 {
+		return createdTimestamp.Add(secretRotationInterval).UTC()
+	}
+
+	return secretRotation.next(createdTimestamp.Add(minSecretLifetime)).UTC()
+}
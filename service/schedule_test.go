@@ -0,0 +1,113 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	cases := []struct {
+		desc     string
+		spec     string
+		isExpErr bool
+	}{
+		{"test default schedule", defaultSecretSchedule, false},
+		{"test every minute", "* * * * *", false},
+		{"test lists ranges and steps", "*/15 2-4 1,15 1-12/3 1-5", false},
+		{"test value with step", "5/20 * * * *", false},
+		{"test sunday as 7", "0 0 * * 7", false},
+		{"test leap day", "0 0 29 2 *", false},
+		{"test too few fields", "0 3 * *", true},
+		{"test too many fields", "0 3 * * 1 2019", true},
+		{"test minute out of range", "60 3 * * 1", true},
+		{"test hour out of range", "0 24 * * 1", true},
+		{"test day of month zero", "0 3 0 * *", true},
+		{"test reversed range", "0 5-3 * * *", true},
+		{"test zero step", "*/0 * * * *", true},
+		{"test names are not supported", "0 3 * * mon", true},
+		{"test date that never occurs", "0 0 30 2 *", true},
+		{"test empty", "", true},
+	}
+
+	for _, c := range cases {
+		schedule, err := parseCronSchedule(c.spec, time.UTC)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidCronSchedule.Error(), c.desc)
+			assert.Nil(t, schedule, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.NotNil(t, schedule, c.desc)
+		}
+	}
+
+	schedule, err := parseCronSchedule(defaultSecretSchedule, nil)
+	assert.EqualError(t, err, consts.ErrInvalidCronSchedule.Error(), "test nil location")
+	assert.Nil(t, schedule, "test nil location")
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	assert.Nil(t, err)
+
+	cases := []struct {
+		desc     string
+		spec     string
+		location *time.Location
+		after    time.Time
+		expected time.Time
+	}{
+		{"test later the same day", "0 3 * * *", time.UTC,
+			time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC), time.Date(2019, 7, 1, 3, 0, 0, 0, time.UTC)},
+		{"test strictly after", "0 3 * * *", time.UTC,
+			time.Date(2019, 7, 1, 3, 0, 0, 0, time.UTC), time.Date(2019, 7, 2, 3, 0, 0, 0, time.UTC)},
+		{"test next monday", defaultSecretSchedule, time.UTC,
+			time.Date(2019, 7, 3, 12, 0, 0, 0, time.UTC), time.Date(2019, 7, 8, 3, 0, 0, 0, time.UTC)},
+		{"test day of month or day of week", "0 0 13 * 5", time.UTC,
+			time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC), time.Date(2019, 9, 6, 0, 0, 0, 0, time.UTC)},
+		{"test leap day", "0 0 29 2 *", time.UTC,
+			time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"test timezone", "0 3 * * 1", newYork,
+			time.Date(2019, 7, 3, 12, 0, 0, 0, time.UTC), time.Date(2019, 7, 8, 7, 0, 0, 0, time.UTC)},
+		{"test time in spring forward gap runs after the gap", "30 2 * * *", newYork,
+			time.Date(2019, 3, 10, 5, 0, 0, 0, time.UTC), time.Date(2019, 3, 10, 7, 30, 0, 0, time.UTC)},
+		{"test earliest time on spring forward day", "30 2,3 * * *", newYork,
+			time.Date(2019, 3, 10, 5, 0, 0, 0, time.UTC), time.Date(2019, 3, 10, 7, 30, 0, 0, time.UTC)},
+		{"test day after spring forward", "30 2 * * *", newYork,
+			time.Date(2019, 3, 10, 7, 30, 0, 0, time.UTC), time.Date(2019, 3, 11, 6, 30, 0, 0, time.UTC)},
+		{"test repeated fall back time runs once", "30 1 * * *", newYork,
+			time.Date(2019, 11, 3, 5, 30, 0, 0, time.UTC), time.Date(2019, 11, 4, 6, 30, 0, 0, time.UTC)},
+		{"test offset changes across fall back", "0 3 * * *", newYork,
+			time.Date(2019, 11, 2, 8, 0, 0, 0, time.UTC), time.Date(2019, 11, 3, 8, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		schedule, err := parseCronSchedule(c.spec, c.location)
+		assert.Nil(t, err, c.desc)
+		assert.True(t, c.expected.Equal(schedule.next(c.after)), c.desc+": got "+schedule.next(c.after).UTC().String())
+	}
+}
+
+func TestSecretExpiration(t *testing.T) {
+	schedule := secretRotation
+	defer func() { secretRotation = schedule }()
+
+	var err error
+	secretRotation, err = parseCronSchedule(defaultSecretSchedule, time.UTC)
+	assert.Nil(t, err)
+
+	desc := "test expires at the next rotation"
+	expiration := secretExpiration(time.Date(2019, 7, 3, 12, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2019, 7, 8, 3, 0, 0, 0, time.UTC), expiration, desc)
+
+	desc = "test secret created right before a rotation outlives its tokens"
+	expiration = secretExpiration(time.Date(2019, 7, 8, 2, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2019, 7, 15, 3, 0, 0, 0, time.UTC), expiration, desc)
+
+	desc = "test interval replaces the schedule"
+	defer func(interval time.Duration) { secretRotationInterval = interval }(secretRotationInterval)
+	secretRotationInterval = 72 * time.Hour
+	expiration = secretExpiration(time.Date(2019, 7, 8, 2, 0, 0, 0, time.FixedZone("EST", -5*60*60)))
+	assert.Equal(t, time.Date(2019, 7, 11, 7, 0, 0, 0, time.UTC), expiration, desc)
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"strconv"
+	"time"
+)
+
+// Secrets expire on the rotation schedule, see secretExpiration. StartSecretRotation makes a new active secret
+// secretRotationLead before the active one expires, so tokens are never signed with an expired secret, and keeps
+// the previous secretRotationKeep secrets valid for the lifetime of the tokens they signed.
+
+const (
+	defaultSecretRotationLead = 10 * time.Minute
+	defaultSecretRotationKeep = 1
+
+	// secretRotationRetry is the wait after a failed rotation
+	secretRotationRetry = time.Minute
+)
+
+var (
+	// secretRotationLead is set with hosts_secret_lead
+	secretRotationLead = defaultSecretRotationLead
+
+	// secretRotationKeep is set with hosts_secret_keep
+	secretRotationKeep = defaultSecretRotationKeep
+)
+
+func init() {
+	if value := conf.SecretRotation.Lead; value != "" {
+		lead, err := time.ParseDuration(value)
+		// a secret lives at least minSecretLifetime, a longer lead would rotate it as soon as it is made
+		if err != nil || lead <= 0 || lead >= minSecretLifetime {
+			reportStartupProblem("Invalid secret rotation lead:", value)
+		} else {
+			secretRotationLead = lead
+		}
+	}
+
+	if value := conf.SecretRotation.Keep; value != "" {
+		keep, err := strconv.Atoi(value)
+		if err != nil || keep < 0 {
+			reportStartupProblem("Invalid secret rotation keep:", value)
+		} else {
+			secretRotationKeep = keep
+		}
+	}
+}
+
+// StartSecretRotation starts rotating the auth secret in the background. Every instance checks the active
+// secret, the first to find it due rotates it. A standby instance cannot rotate secrets.
+func StartSecretRotation() {
+	if isStandby {
+		return
+	}
+
+	go runSecretRotation()
+	logger.Info(consts.SecretRotationTag, "Rotating auth secrets", secretRotationLead.String(), "before they expire")
+}
+
+// runSecretRotation rotates the auth secret whenever it is due, it never returns.
+func runSecretRotation() {
+	for {
+		next, err := rotateAuthSecretIfDue(context.Background(), time.Now())
+		if err != nil {
+			logger.Error(consts.SecretRotationTag, consts.MsgErrRotateSecret, err.Error())
+			next = time.Now().Add(secretRotationRetry)
+		}
+
+		time.Sleep(time.Until(next))
+	}
+}
+
+// nextSecretRotation returns when active is planned to be rotated.
+func nextSecretRotation(active *pblib.Secret) time.Time {
+	return time.Unix(active.GetExpirationTimestamp(), 0).Add(-secretRotationLead).UTC()
+}
+
+// rotateAuthSecretIfDue makes a new active secret if the active secret expires within secretRotationLead of
+// now, or there is none. The secret this instance signs tokens with is updated to the active secret, which
+// another instance may have rotated.
+// Returns when the next rotation is due, or any error.
+func rotateAuthSecretIfDue(ctx context.Context, now time.Time) (time.Time, error) {
+	if err := refreshDBConnection(); err != nil {
+		return time.Time{}, err
+	}
+
+	authSecretLocker.Lock()
+	defer authSecretLocker.Unlock()
+
+	var activeKey string
+	active, err := getActiveSecretRow(ctx)
+	switch {
+	case err == consts.ErrNoActiveSecretKeyFound:
+	case err != nil:
+		return time.Time{}, err
+	default:
+		activeKey = active.GetKey()
+		due := nextSecretRotation(active)
+		if now.Before(due) {
+			if currAuthSecret == nil || currAuthSecret.GetKey() != activeKey {
+				currAuthSecret = active
+			}
+			return due, nil
+		}
+	}
+
+	rotated, err := rotateAuthSecret(ctx, activeKey, secretRotationKeep, now, now.Add(minSecretLifetime))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	active, err = getActiveSecretRow(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	currAuthSecret = active
+	authTokenCache.purge()
+	authTokenVerifier.expire()
+
+	if rotated {
+		recordAudit(ctx, "", auditActionRotateSecret, "")
+		logger.Info(consts.SecretRotationTag, "Rotated auth secret, keeping", strconv.Itoa(secretRotationKeep),
+			"previous secrets, next expiration:", time.Unix(active.GetExpirationTimestamp(), 0).UTC().String())
+	}
+
+	return nextSecretRotation(active), nil
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRotateAuthSecretIfDue(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	assert.Nil(t, insertNewAuthSecret(context.TODO()))
+	active, err := getActiveSecretRow(context.TODO())
+	assert.Nil(t, err)
+	currAuthSecret = nil
+
+	desc := "test secret that is not due is kept"
+	next, err := rotateAuthSecretIfDue(context.TODO(), time.Now())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, time.Unix(active.GetExpirationTimestamp(), 0).Add(-secretRotationLead), next, desc)
+	retrieved, err := getActiveSecretRow(context.TODO())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, active.GetKey(), retrieved.GetKey(), desc)
+	assert.Equal(t, active.GetKey(), currAuthSecret.GetKey(), desc)
+
+	desc = "test secret expiring within the lead is rotated"
+	expiration := time.Now().Add(secretRotationLead / 2).UTC()
+	for _, command := range []string{
+		`UPDATE user_security.secrets SET expiration_timestamp = $2 WHERE secret_key = $1`,
+		`UPDATE user_security.active_secret SET expiration_timestamp = $2 WHERE secret_key = $1`,
+	} {
+		_, err = postgresDB.Exec(command, active.GetKey(), expiration)
+		assert.Nil(t, err, desc)
+	}
+	next, err = rotateAuthSecretIfDue(context.TODO(), time.Now())
+	assert.Nil(t, err, desc)
+	rotated, err := getActiveSecretRow(context.TODO())
+	assert.Nil(t, err, desc)
+	assert.NotEqual(t, active.GetKey(), rotated.GetKey(), desc)
+	assert.Equal(t, rotated.GetKey(), currAuthSecret.GetKey(), desc)
+	assert.Equal(t, time.Unix(rotated.GetExpirationTimestamp(), 0).Add(-secretRotationLead), next, desc)
+
+	desc = "test previous secret stays valid for the lifetime of its tokens"
+	secrets, err := getValidSecrets(context.TODO())
+	assert.Nil(t, err, desc)
+	assert.True(t, len(secrets) >= 2, desc)
+	assert.Equal(t, active.GetKey(), secrets[1].GetKey(), desc)
+	assert.True(t, secrets[1].GetExpirationTimestamp() >= time.Now().Add(minSecretLifetime-time.Minute).Unix(), desc)
+}
@@ -1,23 +1,26 @@
 package service
 
 import (
-	"fmt"
+	"encoding/json"
 	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
 	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
 	"github.com/hwsc-org/hwsc-lib/auth"
 	authconst "github.com/hwsc-org/hwsc-lib/consts"
 	"github.com/hwsc-org/hwsc-lib/logger"
 	"github.com/hwsc-org/hwsc-lib/validation"
-	"github.com/hwsc-org/hwsc-user-svc/conf"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Service struct type, implements the generated (pb file) UserServiceServer interface
+// Handlers expect requests to have passed ValidationInterceptor, which rejects nil requests and missing fields.
 type Service struct{}
 
 // state of the service
@@ -29,6 +32,12 @@ type stateLocker struct {
 	currentServiceState state
 }
 
+// uuidLockTable serializes requests per uuid with a fixed set of striped RWMutexes selected by hashing the uuid.
+// Different uuids may share a stripe, which only costs some extra contention.
+type uuidLockTable struct {
+	stripes [uuidLockStripes]sync.RWMutex
+}
+
 const (
 	// available - service is ready and available for read/write
 	available state = 0
@@ -45,7 +54,7 @@ const (
 
 var (
 	serviceStateLocker stateLocker
-	uuidMapLocker      sync.Map
+	uuidMapLocker      uuidLockTable
 	authSecretLocker   sync.RWMutex
 )
 
@@ -56,6 +65,12 @@ func init() {
 }
 
 // GetStatus checks the current status of the service.
+// The schema migration version of the database is returned in the x-hwsc-migration-version header, with
+// x-hwsc-migration-dirty "true" if the last migration failed halfway. The connections of the database pool in
+// use and idle, how often requests waited for one, and how often reads were retried after a transient error,
+// are returned in the x-hwsc-db-* headers, the hits and misses of the user and token caches in the
+// x-hwsc-*-cache-* headers. The time the active auth secret is planned to be rotated at is returned in the
+// x-hwsc-secret-rotation header.
 // On success, returns OK status and message.
 func (s *Service) GetStatus(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
 	logger.RequestService("GetStatus")
@@ -68,15 +83,72 @@ func (s *Service) GetStatus(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc
 		return consts.ResponseServiceUnavailable, nil
 	}
 
+	stats := postgresDB.Stats()
+	userHits, userMisses := userCacheCounters.load()
+	tokenHits, tokenMisses := tokenCacheCounters.load()
+	for key, value := range map[string]int{
+		metadataKeyDBInUse:            stats.InUse,
+		metadataKeyDBIdle:             stats.Idle,
+		metadataKeyDBWaitCount:        int(stats.WaitCount),
+		metadataKeyDBRetries:          int(atomic.LoadInt64(&dbRetries)),
+		metadataKeyDBRetriesExhausted: int(atomic.LoadInt64(&dbRetriesExhausted)),
+		metadataKeyUserCacheHits:      int(userHits),
+		metadataKeyUserCacheMisses:    int(userMisses),
+		metadataKeyTokenCacheHits:     int(tokenHits),
+		metadataKeyTokenCacheMisses:   int(tokenMisses),
+	} {
+		if err := setResponseHeader(ctx, key, strconv.Itoa(value)); err != nil {
+			logger.Error(consts.PSQL, consts.MsgErrSetResponseHeader, err.Error())
+		}
+	}
+
+	// the migration version is informational, the service is available without it
+	version, dirty, ok, err := schemaMigrationVersion(ctx)
+	if err != nil {
+		logger.Error(consts.MigrationTag, consts.MsgErrGetMigrationVersion, err.Error())
+	}
+	if ok {
+		if err := setResponseHeader(ctx, metadataKeyMigrationVersion, strconv.FormatInt(version, 10)); err != nil {
+			logger.Error(consts.MigrationTag, consts.MsgErrSetResponseHeader, err.Error())
+		}
+		if dirty {
+			if err := setResponseHeader(ctx, metadataKeyMigrationDirty, strconv.FormatBool(dirty)); err != nil {
+				logger.Error(consts.MigrationTag, consts.MsgErrSetResponseHeader, err.Error())
+			}
+		}
+	}
+
+	// no secret is active until the first token is issued
+	active, err := getActiveSecretRow(ctx)
+	if err != nil && err != consts.ErrNoActiveSecretKeyFound {
+		logger.Error(consts.SecretRotationTag, consts.MsgErrGetActiveSecret, err.Error())
+	}
+	if err == nil {
+		rotation := nextSecretRotation(active).Format(time.RFC3339)
+		if err := setResponseHeader(ctx, metadataKeySecretRotation, rotation); err != nil {
+			logger.Error(consts.SecretRotationTag, consts.MsgErrSetResponseHeader, err.Error())
+		}
+	}
+
 	return &pbsvc.UserResponse{
 		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
 		Message: codes.OK.String(),
 	}, nil
 }
 
-// CreateUser creates a new User row and inserts it to accounts table.
+// CreateUser creates a new User row and inserts it to accounts table, with its email token in one transaction.
+// Users opt in to marketing emails, and the mailing list once verified, with the x-hwsc-marketing metadata value true.
 // After row insertion, sends verification link to users email.
+// An optional x-hwsc-birthdate metadata value (YYYY-MM-DD) is stored with the user. Users under 13 at signup
+// must give a x-hwsc-parent-email, which is sent a parental consent link, and cannot sign in until it is followed;
+// their response carries a x-hwsc-parental-consent "pending" header.
+// An optional x-hwsc-referral-code metadata value links the user to the user who shared it, a code that
+// matches no user returns InvalidArgument. The user's own code is returned in the x-hwsc-referral-code header.
+// Optional x-hwsc-middle-name-bin and x-hwsc-display-name-bin metadata values are stored with the user and
+// returned in the headers of the same name, the display name derived from the first and last names if not given.
 // On success, returns user object with password set to empty for security reasons.
+// If the x-hwsc-user-view metadata is "full", the user is read back from the accounts table
+// so the response also carries the stored fields such as created_timestamp.
 func (s *Service) CreateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
 	logger.RequestService("CreateUser")
 
@@ -85,95 +157,149 @@ func (s *Service) CreateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 		return nil, consts.ErrStatusServiceUnavailable
 	}
 
-	if req == nil {
-		return nil, consts.ErrStatusNilRequestUser
-	}
-
 	if err := refreshDBConnection(); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
-	// get User Object
 	user := req.GetUser()
-	if user == nil {
-		logger.Error(consts.ErrNilRequestUser.Error())
-		return nil, consts.ErrStatusNilRequestUser
+
+	userView := strings.ToLower(getIncomingMetadata(ctx, metadataKeyUserView))
+	if userView != "" && userView != userViewBasic && userView != userViewFull {
+		logger.Error(consts.CreateUserTag, consts.ErrInvalidUserView.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidUserView.Error())
+	}
+
+	user.Email = normalizeEmail(user.GetEmail())
+	if err := checkEmailDomain(ctx, consts.CreateUserTag, user.GetEmail()); err != nil {
+		logger.Error(consts.CreateUserTag, err.Error())
+		return nil, badRequestStatus(appendViolation(nil, fieldUserEmail, err))
+	}
+
+	marketingOptIn := false
+	if value := getIncomingMetadata(ctx, metadataKeyMarketing); value != "" {
+		var err error
+		if marketingOptIn, err = strconv.ParseBool(value); err != nil {
+			logger.Error(consts.CreateUserTag, consts.ErrInvalidMarketingOptIn.Error())
+			return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidMarketingOptIn.Error())
+		}
+	}
+
+	names, err := parseUserNames(ctx)
+	if err != nil {
+		logger.Error(consts.CreateUserTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	// birthdate is optional, users under parentalConsentAge must name a parent to ask for consent
+	now := time.Now().UTC()
+	var birthdate time.Time
+	if value := getIncomingMetadata(ctx, metadataKeyBirthdate); value != "" {
+		parsed, err := parseBirthdate(value, now)
+		if err != nil {
+			logger.Error(consts.CreateUserTag, err.Error())
+			return nil, statusFromError(err)
+		}
+		birthdate = parsed
+	}
+
+	var parentEmail string
+	if requiresParentalConsent(birthdate, now) {
+		parentEmail = normalizeEmail(getIncomingMetadata(ctx, metadataKeyParentEmail))
+		if validateEmail(parentEmail) != nil || strings.EqualFold(parentEmail, user.GetEmail()) {
+			logger.Error(consts.CreateUserTag, consts.ErrInvalidParentEmail.Error())
+			return nil, statusFromError(consts.ErrInvalidParentEmail)
+		}
+	}
+
+	// referral code is optional, a code that matches no user fails the request
+	var referralCode string
+	if value := getIncomingMetadata(ctx, metadataKeyReferralCode); value != "" {
+		normalized, err := normalizeReferralCode(value)
+		if err != nil {
+			logger.Error(consts.CreateUserTag, err.Error())
+			return nil, statusFromError(err)
+		}
+		referralCode = normalized
 	}
 
 	// generate uuid synchronously to prevent users getting the same uuid
-	var err error
 	user.Uuid, err = generateUUID()
 	if err != nil {
 		logger.Error(consts.CreateUserTag, consts.MsgErrGeneratingUUID, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	// each uuid string gets its own lock, released from uuidMapLocker on unlock
+	unlock := uuidMapLocker.writeLock(user.GetUuid())
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
 	}
 
-	// sync.Map equivalent to map[string](&sync.RWMutex{}) = each uuid string gets its own lock
-	// LoadOrStore = LOAD: get the lock for uuid or if not exist,
-	// 				 STORE: make uuid key and store lock type &sync.RWMutex{}
-	lock, _ := uuidMapLocker.LoadOrStore(user.GetUuid(), &sync.RWMutex{})
-	lock.(*sync.RWMutex).Lock()
-	defer lock.(*sync.RWMutex).Unlock()
+	// create identification for email token, it is inserted with the user so no account lacks one
+	emailID, err := auth.GenerateEmailIdentification(user.GetUuid(), auth.PermissionStringMap[auth.NoPermission])
+	if err != nil {
+		logger.Error(consts.CreateUserTag, consts.MsgErrGeneratingEmailToken, err.Error())
+		return nil, statusFromError(err)
+	}
 
-	// insert user into DB
-	if err := insertNewUser(user); err != nil {
-		// remove unstored/invaid uuid from cache uuidMapLocker b/c
-		// Mutex was allocated (saves resources/memory and prevent security issues)
-		uuidMapLocker.Delete(user.GetUuid())
+	// insert user and email token into DB
+	ownReferralCode, err := insertNewUser(ctx, user, names, birthdate, referralCode, emailID)
+	if err != nil {
 		logger.Error(consts.CreateUserTag, consts.MsgErrInsertUser, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
 	logger.Info("Inserted new user:", user.GetUuid(), user.GetFirstName(), user.GetLastName())
 
+	// the user stays opted out if this fails, which is the safe side for marketing consent
+	if marketingOptIn {
+		if _, err := updateNotificationPreferences(ctx, user.GetUuid(),
+			map[string]bool{emailCategoryMarketing: true}); err != nil {
+			logger.Error(consts.CreateUserTag, consts.MsgErrUpdateMarketingOptIn, err.Error())
+		}
+	}
+
 	user.Password = ""
 	user.IsVerified = false
 	user.PermissionLevel = auth.PermissionStringMap[auth.NoPermission]
-
-	userCreatedResponse := &pbsvc.UserResponse{
-		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
-		Message: codes.OK.String(),
-		User:    user,
+	publishUserEvent(eventTypeUserCreated, user)
+	recordAudit(ctx, callerUUID(ctx), auditActionCreateUser, user.GetUuid())
+
+	if userView == userViewFull {
+		// the user is already created, fall back to the basic view rather than failing the request
+		storedUser, err := getUserRow(ctx, user.GetUuid())
+		if err != nil {
+			logger.Error(consts.CreateUserTag, consts.MsgErrGetUserRow, err.Error())
+		} else {
+			storedUser.Password = ""
+			user = storedUser
+		}
 	}
 
 	// from here on: do not return an error because we can always regenerate tokens and resend verification emails
 
-	// create identification for email token
-	emailID, err := auth.GenerateEmailIdentification(user.GetUuid(), user.PermissionLevel)
-	if err != nil {
-		logger.Error(consts.CreateUserTag, consts.MsgErrGeneratingEmailToken, err.Error())
-		return userCreatedResponse, nil
-	}
-
-	// insert token into db, if nondb error returns, token will simply expire, so no need to remove
-	if err := insertEmailToken(user.GetUuid(), emailID.GetToken(), emailID.GetSecret()); err != nil {
-		logger.Error(consts.CreateUserTag, consts.MsgErrInsertEmailToken, err.Error())
-		return userCreatedResponse, nil
-	}
-
-	// generate verification link for emails
-	verificationLink, err := generateEmailVerifyLink(emailID.GetToken())
-	if err != nil {
-		logger.Error(consts.CreateUserTag, consts.MsgErrGeneratingEmailVerifyLink, err.Error())
-		return userCreatedResponse, nil
+	// the code can be looked up again with GetReferralStats
+	if err := setResponseHeader(ctx, metadataKeyReferralCode, ownReferralCode); err != nil {
+		logger.Error(consts.CreateUserTag, consts.MsgErrSetResponseHeader, err.Error())
 	}
-
-	// send email
-	emailData := make(map[string]string)
-	if verificationLink == "" {
-		return userCreatedResponse, nil
+	if err := setUserNameHeaders(ctx, user, names); err != nil {
+		logger.Error(consts.CreateUserTag, consts.MsgErrSetResponseHeader, err.Error())
 	}
-	emailData[verificationLinkKey] = verificationLink
 
-	emailReq, err := newEmailRequest(emailData, []string{user.GetEmail()}, conf.EmailHost.Username, subjectVerifyEmail)
-	if err != nil {
-		logger.Error(consts.CreateUserTag, consts.MsgErrEmailRequest, err.Error())
-		return userCreatedResponse, nil
+	// the account stays unable to sign in until a parent consents, even if the request cannot be sent
+	if parentEmail != "" {
+		if err := setResponseHeader(ctx, metadataKeyParentalConsent, parentalConsentPending); err != nil {
+			logger.Error(consts.CreateUserTag, consts.MsgErrSetResponseHeader, err.Error())
+		}
+		if err := requestParentalConsent(ctx, user, parentEmail); err != nil {
+			logger.Error(consts.ParentalConsentTag, consts.MsgErrParentalConsent, err.Error())
+		}
 	}
 
-	if err := emailReq.sendEmail(templateVerifyEmail); err != nil {
-		logger.Error(consts.CreateUserTag, consts.MsgErrSendEmail, err.Error())
-	}
+	sendVerificationEmail(ctx, consts.CreateUserTag, user, emailID.GetToken())
 
 	return &pbsvc.UserResponse{
 		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
@@ -184,8 +310,13 @@ func (s *Service) CreateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 }
 
 // DeleteUser deletes a user row in accounts table.
-// Releases mutex resource stored in uuidMapLocker by deleting the uuid.
-// Method is idempotent, returns OK regardless of user not existing in accounts table and uuidMapLocker.
+// Method is idempotent, returns OK regardless of user not existing in accounts table,
+// unless the x-hwsc-missing-user metadata is "notfound", then a missing user returns NotFound.
+// Only the user itself or an admin may delete a user, see AuthInterceptor.
+// While hosts_retention_softdeletedusers is set the user is only marked deleted, it can no longer sign in and is
+// restored with RestoreUser until the retention job purges it, which publishes its deletion event. Its email stays
+// taken until then.
+// On success, the number of deleted rows is returned in the x-hwsc-rows-affected response header.
 func (s *Service) DeleteUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
 	logger.RequestService("DeleteUser")
 
@@ -194,38 +325,266 @@ func (s *Service) DeleteUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 		return nil, consts.ErrStatusServiceUnavailable
 	}
 
-	if req == nil {
-		return nil, consts.ErrStatusNilRequestUser
+	if err := refreshDBConnection(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	user := req.GetUser()
+
+	if err := validation.ValidateUserUUID(user.GetUuid()); err != nil {
+		logger.Error(consts.DeleteUserTag, authconst.ErrInvalidUUID.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	missingUserMode := strings.ToLower(getIncomingMetadata(ctx, metadataKeyMissingUser))
+	if missingUserMode != "" && missingUserMode != missingUserOK && missingUserMode != missingUserNotFound {
+		logger.Error(consts.DeleteUserTag, consts.ErrInvalidMissingUserMode.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidMissingUserMode.Error())
+	}
+
+	if err := authorizeCaller(ctx, user.GetUuid()); err != nil {
+		logger.Error(consts.DeleteUserTag, consts.ErrCallerNotAllowed.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(user.GetUuid())
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	// delete from db, or mark deleted until the retention job purges the user
+	var deletedRows int64
+	var err error
+	if softDeleteUsers {
+		deletedRows, err = softDeleteUserRow(ctx, user.GetUuid(), time.Now())
+	} else {
+		deletedRows, err = deleteUserRow(ctx, user.GetUuid())
+	}
+	if err != nil {
+		logger.Error(consts.DeleteUserTag, consts.MsgErrDeleteUser, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if deletedRows == 0 && missingUserMode == missingUserNotFound {
+		logger.Error(consts.DeleteUserTag, consts.ErrUUIDNotFound.Error())
+		return nil, consts.ErrStatusUUIDNotFound
+	}
+
+	invalidateCachedUser(user.GetUuid())
+
+	// revoke tokens so the deleted user can no longer authenticate
+	if err := revokeAuthTokens(ctx, user.GetUuid()); err != nil {
+		logger.Error(consts.DeleteUserTag, consts.MsgErrRevokeAuthTokens, err.Error())
+		return nil, statusFromError(err)
+	}
+	authTokenCache.invalidateUUID(user.GetUuid())
+	authTokenVerifier.revoke(user.GetUuid())
+
+	if !softDeleteUsers {
+		publishUserEvent(eventTypeUserDeleted, &pblib.User{Uuid: user.GetUuid()})
+	}
+	recordAudit(ctx, callerUUID(ctx), auditActionDeleteUser, user.GetUuid())
+
+	// the header is informational, the user is deleted even if it cannot be set
+	if err := setResponseHeader(ctx, metadataKeyRowsAffected, strconv.FormatInt(deletedRows, 10)); err != nil {
+		logger.Error(consts.DeleteUserTag, consts.MsgErrSetResponseHeader, err.Error())
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User:    &pblib.User{Uuid: user.GetUuid()},
+	}, nil
+}
+
+// RestoreUser undoes DeleteUser while hosts_retention_softdeletedusers is set and the user was not purged yet.
+// It requires an admin auth token, the restored user signs in again, its auth tokens were revoked on deletion.
+// Returns NotFound if the user is not soft deleted.
+func (s *Service) RestoreUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("RestoreUser")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.RestoreUserTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.RestoreUserTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	user := req.GetUser()
+
+	if err := validation.ValidateUserUUID(user.GetUuid()); err != nil {
+		logger.Error(consts.RestoreUserTag, authconst.ErrInvalidUUID.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	if err := authorizeAdmin(ctx, req.GetIdentification().GetToken(), "RestoreUser", user.GetUuid()); err != nil {
+		logger.Error(consts.RestoreUserTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(user.GetUuid())
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if err := restoreUserRow(ctx, user.GetUuid()); err != nil {
+		logger.Error(consts.RestoreUserTag, consts.MsgErrRestoreUser, err.Error())
+		return nil, statusFromError(err)
+	}
+	invalidateCachedUser(user.GetUuid())
+	recordAudit(ctx, callerUUID(ctx), auditActionRestoreUser, user.GetUuid())
+
+	logger.Info(consts.RestoreUserTag, "Restored user:", user.GetUuid())
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User:    &pblib.User{Uuid: user.GetUuid()},
+	}, nil
+}
+
+// VerifyUser marks a user verified without the link of its verification email, for support staff when emails
+// bounce. It requires an admin auth token. Pending verification links stop working, the user is given user
+// permission like VerifyEmailToken gives, and the action is recorded in the audit log.
+// Verifying a verified user succeeds without publishing another verified event.
+// Returns NotFound if the user does not exist.
+func (s *Service) VerifyUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("VerifyUser")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.VerifyUserTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
 	}
 
 	if err := refreshDBConnection(); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		logger.Error(consts.VerifyUserTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
 	}
 
-	// get User Object
 	user := req.GetUser()
-	if user == nil {
-		logger.Error(consts.ErrNilRequestUser.Error())
-		return nil, consts.ErrStatusNilRequestUser
+
+	if err := validation.ValidateUserUUID(user.GetUuid()); err != nil {
+		logger.Error(consts.VerifyUserTag, authconst.ErrInvalidUUID.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	if err := authorizeAdmin(ctx, req.GetIdentification().GetToken(), "VerifyUser", user.GetUuid()); err != nil {
+		logger.Error(consts.VerifyUserTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(user.GetUuid())
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	retrievedUser, err := forceVerifyUserRow(ctx, user.GetUuid())
+	if err != nil {
+		logger.Error(consts.VerifyUserTag, consts.MsgErrVerifyUser, err.Error())
+		return nil, statusFromError(err)
+	}
+	invalidateCachedUser(user.GetUuid())
+	recordAudit(ctx, callerUUID(ctx), auditActionVerifyUser, user.GetUuid())
+
+	if !retrievedUser.GetIsVerified() {
+		if retrievedUser.GetPermissionLevel() == auth.PermissionStringMap[auth.NoPermission] {
+			retrievedUser.PermissionLevel = auth.PermissionStringMap[auth.User]
+		}
+		retrievedUser.IsVerified = true
+		retrievedUser.Password = ""
+		publishUserEvent(eventTypeUserVerified, retrievedUser)
+
+		// mailing-list sync runs in the background, verification does not wait on the provider
+		go subscribeVerifiedUser(retrievedUser)
+	}
+
+	logger.Info(consts.VerifyUserTag, "Verified user:", user.GetUuid())
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User:    &pblib.User{Uuid: user.GetUuid()},
+	}, nil
+}
+
+// ForgetUser irreversibly anonymizes a user for erasure requests, an alternative to DeleteUser that keeps the uuid
+// so records referring to the user stay intact. It requires an admin auth token.
+// The names, emails, password, organization, birthdate and referral code of the user are scrubbed, its pending
+// tokens, linked auth methods, login countries, profile history, events and queued emails are deleted, and its
+// auth tokens are revoked. The account is marked deleted, it cannot sign in and is never restored or purged.
+// The erasure is registered in user_svc.erasures chained to the erasures before, its hash is recorded with the
+// audit entry and returned in the x-hwsc-erasure-hash response header.
+// Returns NotFound if the user does not exist or was already forgotten.
+func (s *Service) ForgetUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ForgetUser")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ForgetUserTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
 	}
 
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.ForgetUserTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	user := req.GetUser()
+
 	if err := validation.ValidateUserUUID(user.GetUuid()); err != nil {
-		logger.Error(consts.DeleteUserTag, authconst.ErrInvalidUUID.Error())
+		logger.Error(consts.ForgetUserTag, authconst.ErrInvalidUUID.Error())
 		return nil, consts.ErrStatusUUIDInvalid
 	}
 
-	lock, _ := uuidMapLocker.LoadOrStore(user.GetUuid(), &sync.RWMutex{})
-	lock.(*sync.RWMutex).Lock()
-	defer lock.(*sync.RWMutex).Unlock()
+	if err := authorizeAdmin(ctx, req.GetIdentification().GetToken(), "ForgetUser", user.GetUuid()); err != nil {
+		logger.Error(consts.ForgetUserTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(user.GetUuid())
+	defer unlock()
 
-	// delete from db
-	if err := deleteUserRow(user.GetUuid()); err != nil {
-		logger.Error(consts.DeleteUserTag, consts.MsgErrDeleteUser, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	actor := callerUUID(ctx)
+	now := time.Now()
+	hash, err := forgetUserRow(ctx, user.GetUuid(), actor, now)
+	if err != nil {
+		logger.Error(consts.ForgetUserTag, consts.MsgErrForgetUser, err.Error())
+		return nil, statusFromError(err)
+	}
+	invalidateCachedUser(user.GetUuid())
+	authTokenCache.invalidateUUID(user.GetUuid())
+	authTokenVerifier.revoke(user.GetUuid())
+
+	// the erasure is registered with the user's data, the audit entry carries its hash to cross-check the register
+	recorded := auditMetadata(ctx)
+	recorded[metadataKeyErasureHash] = hash
+	if err := insertAuditEntry(ctx, actor, auditActionForgetUser, user.GetUuid(), recorded, now); err != nil {
+		logger.Error(consts.AuditTag, consts.MsgErrRecordAudit, auditActionForgetUser, user.GetUuid(), err.Error())
+	}
+	publishUserEvent(eventTypeUserDeleted, &pblib.User{Uuid: user.GetUuid()})
+
+	// the header is informational, the user is forgotten even if it cannot be set
+	if err := setResponseHeader(ctx, metadataKeyErasureHash, hash); err != nil {
+		logger.Error(consts.ForgetUserTag, consts.MsgErrSetResponseHeader, err.Error())
 	}
 
-	// release mutex resource
-	uuidMapLocker.Delete(user.GetUuid())
+	logger.Info(consts.ForgetUserTag, "Forgot user:", user.GetUuid())
 
 	return &pbsvc.UserResponse{
 		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
@@ -237,6 +596,15 @@ func (s *Service) DeleteUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 // UpdateUser performs a partial update to a user row in accounts table.
 // Method is idempotent, will perform a partial update regardless of any changes or not.
 // If no changes are present, it will rewrite the selected columns with existing values.
+// Empty fields mean no change, optional fields listed in the x-hwsc-clear-fields metadata
+// (comma separated, "organization", "middle_name" or "display_name") are blanked out.
+// The x-hwsc-middle-name-bin and x-hwsc-display-name-bin metadata change the names the User has no fields for,
+// the names after the update are returned in the headers of the same name.
+// A new email is kept as the prospective email and a confirmation link is sent to it, the user keeps signing in
+// with its current email until the change is confirmed with ConfirmEmailChange.
+// Only the user itself or an admin may update a user, see AuthInterceptor.
+// Changing the permission level requires an admin auth token in the identification or the authorization metadata,
+// the user's auth tokens are revoked so tokens with the old permission level stop working.
 // On success, returns user object regardless of change or not.
 func (s *Service) UpdateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
 	logger.RequestService("UpdateUser")
@@ -246,19 +614,14 @@ func (s *Service) UpdateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 		return nil, consts.ErrStatusServiceUnavailable
 	}
 
-	if req == nil {
-		return nil, consts.ErrStatusNilRequestUser
-	}
-
 	if err := refreshDBConnection(); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
-	// get User Object
 	svcDerivedUser := req.GetUser()
-	if svcDerivedUser == nil {
-		logger.Error(consts.ErrNilRequestUser.Error())
-		return nil, consts.ErrStatusNilRequestUser
+
+	if svcDerivedUser.GetEmail() != "" {
+		svcDerivedUser.Email = normalizeEmail(svcDerivedUser.GetEmail())
 	}
 
 	if err := validation.ValidateUserUUID(svcDerivedUser.GetUuid()); err != nil {
@@ -266,15 +629,44 @@ func (s *Service) UpdateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 		return nil, consts.ErrStatusUUIDInvalid
 	}
 
-	lock, _ := uuidMapLocker.LoadOrStore(svcDerivedUser.GetUuid(), &sync.RWMutex{})
-	lock.(*sync.RWMutex).Lock()
-	defer lock.(*sync.RWMutex).Unlock()
+	clearFields, err := parseClearFields(getIncomingMetadataList(ctx, metadataKeyClearFields))
+	if err != nil {
+		logger.Error(consts.UpdateUserTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	names, err := parseUserNames(ctx)
+	if err != nil {
+		logger.Error(consts.UpdateUserTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := authorizeCaller(ctx, svcDerivedUser.GetUuid()); err != nil {
+		logger.Error(consts.UpdateUserTag, consts.ErrCallerNotAllowed.Error())
+		return nil, err
+	}
+
+	// looked up before taking the lock, DNS may be slow
+	if svcDerivedUser.GetEmail() != "" {
+		if err := checkEmailDomain(ctx, consts.UpdateUserTag, svcDerivedUser.GetEmail()); err != nil {
+			logger.Error(consts.UpdateUserTag, err.Error())
+			return nil, badRequestStatus(appendViolation(nil, fieldUserEmail, err))
+		}
+	}
+
+	unlock := uuidMapLocker.writeLock(svcDerivedUser.GetUuid())
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
 
 	// retrieve users row from database
-	dbDerivedUser, err := getUserRow(svcDerivedUser.GetUuid())
+	dbDerivedUser, err := getUserRow(ctx, svcDerivedUser.GetUuid())
 	if err != nil {
 		logger.Error(consts.UpdateUserTag, consts.MsgErrGetUserRow, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
 	if dbDerivedUser == nil {
@@ -282,18 +674,64 @@ func (s *Service) UpdateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 		return nil, consts.ErrStatusUUIDNotFound
 	}
 
+	// users may send back the permission level GetUser returned, only changing it needs an admin
+	permissionChanged := svcDerivedUser.GetPermissionLevel() != "" &&
+		svcDerivedUser.GetPermissionLevel() != dbDerivedUser.GetPermissionLevel()
+	if permissionChanged {
+		adminToken := req.GetIdentification().GetToken()
+		if c, ok := callerFromContext(ctx); ok && adminToken == "" {
+			adminToken = c.token
+		}
+		if adminToken == "" {
+			logger.Error(consts.UpdateUserTag, consts.ErrPermissionChangeDenied.Error())
+			return nil, statusFromError(consts.ErrPermissionChangeDenied)
+		}
+		if err := authorizeAdmin(ctx, adminToken, "UpdateUser", svcDerivedUser.GetUuid()); err != nil {
+			logger.Error(consts.UpdateUserTag, consts.ErrPermissionChangeDenied.Error(), err.Error())
+			return nil, err
+		}
+	}
+
 	// update user
 	var updatedUser *pblib.User
-	updatedUser, err = updateUserRow(svcDerivedUser.GetUuid(), svcDerivedUser, dbDerivedUser)
+	updatedUser, err = updateUserRow(ctx, svcDerivedUser.GetUuid(), svcDerivedUser, dbDerivedUser, names,
+		clearFields)
 	if err != nil {
 		logger.Error(consts.UpdateUserTag, consts.MsgErrUpdateUserRow, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
+	}
+	invalidateCachedUser(svcDerivedUser.GetUuid())
+
+	// the user can change the email again to resend the confirmation
+	if updatedUser.GetProspectiveEmail() != "" {
+		if err := requestEmailChange(ctx, dbDerivedUser, updatedUser.GetProspectiveEmail()); err != nil {
+			logger.Error(consts.UpdateUserTag, consts.MsgErrRequestEmailChange, err.Error())
+		}
+	}
+
+	// auth tokens carry the permission level they were issued with, the user signs in again to get the new one
+	if permissionChanged {
+		if err := revokeAuthTokens(ctx, svcDerivedUser.GetUuid()); err != nil {
+			logger.Error(consts.UpdateUserTag, consts.MsgErrRevokeAuthTokens, err.Error())
+			return nil, statusFromError(err)
+		}
+		authTokenCache.invalidateUUID(svcDerivedUser.GetUuid())
+		authTokenVerifier.revoke(svcDerivedUser.GetUuid())
 	}
 
 	logger.Info("Updated user:", updatedUser.GetUuid(),
 		updatedUser.GetFirstName(), updatedUser.GetLastName())
 
+	// the user is already updated, the names can be looked up again with GetUser
+	if storedNames, err := getUserNames(ctx, updatedUser.GetUuid()); err != nil {
+		logger.Error(consts.UpdateUserTag, consts.MsgErrGetUserNames, err.Error())
+	} else if err := setUserNameHeaders(ctx, updatedUser, storedNames); err != nil {
+		logger.Error(consts.UpdateUserTag, consts.MsgErrSetResponseHeader, err.Error())
+	}
+
 	updatedUser.Password = ""
+	publishUserEvent(eventTypeUserUpdated, updatedUser)
+	recordAudit(ctx, callerUUID(ctx), auditActionUpdateUser, updatedUser.GetUuid())
 	return &pbsvc.UserResponse{
 		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
 		Message: codes.OK.String(),
@@ -302,7 +740,12 @@ func (s *Service) UpdateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsv
 }
 
 // AuthenticateUser goes through accounts table and find matching email and password.
+// If verified emails are required, users that have not verified their email get FailedPrecondition,
+// as do users under 13 at signup whose parent has not yet consented.
+// Users with two-factor authentication enabled also send a TOTP code or a backup code in the x-hwsc-totp-code
+// metadata, Unauthenticated is returned without a valid one.
 // On success, returns the identification, and matched row as user object with password set to empty string.
+// A refresh token for RefreshAuthToken is returned in the x-hwsc-refresh-token response header.
 func (s *Service) AuthenticateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
 	logger.RequestService("AuthenticateUser")
 
@@ -311,53 +754,94 @@ func (s *Service) AuthenticateUser(ctx context.Context, req *pbsvc.UserRequest)
 		return nil, consts.ErrStatusServiceUnavailable
 	}
 
-	if req == nil {
-		logger.Error(consts.AuthenticateUserTag, consts.ErrNilRequest.Error())
-		return nil, consts.ErrStatusNilRequestUser
-	}
-
 	user := req.GetUser()
-	if user == nil {
-		logger.Error(consts.AuthenticateUserTag, consts.ErrNilRequestUser.Error())
-		return nil, consts.ErrStatusNilRequestUser
-	}
 
 	if err := refreshDBConnection(); err != nil {
 		logger.Error(consts.AuthenticateUserTag, consts.ErrDBConnectionError.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
 	// email, password
+	user.Email = normalizeEmail(user.GetEmail())
 	if err := validateEmail(user.GetEmail()); err != nil {
 		logger.Error(consts.AuthenticateUserTag, consts.ErrInvalidUserEmail.Error())
 		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidUserEmail.Error())
 	}
 	if err := validatePassword(user.GetPassword()); err != nil {
-		logger.Error(consts.AuthenticateUserTag, consts.ErrInvalidPassword.Error())
-		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidPassword.Error())
+		logger.Error(consts.AuthenticateUserTag, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	lock, _ := uuidMapLocker.LoadOrStore(user.GetUuid(), &sync.RWMutex{})
-	lock.(*sync.RWMutex).RLock()
-	defer lock.(*sync.RWMutex).RUnlock()
+	unlock := uuidMapLocker.readLock(user.GetUuid())
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
 
 	// match email and password
-	matchedUser, err := matchEmailAndPassword(user.GetEmail(), user.GetPassword())
+	matchedUser, err := matchEmailAndPassword(ctx, user.GetEmail(), user.GetPassword())
 	if err != nil {
 		logger.Error(consts.AuthenticateUserTag, consts.MsgErrMatchEmailPassword, err.Error())
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, statusFromError(ctxErr)
+		}
 		return nil, status.Error(codes.Unauthenticated, err.Error())
 	}
 
+	// the second factor is checked before anything else about the account is revealed
+	code := getIncomingMetadata(ctx, metadataKeyTOTPCode)
+	if err := checkTwoFactor(ctx, matchedUser.GetUuid(), code, time.Now()); err != nil {
+		logger.Error(consts.AuthenticateUserTag, consts.MsgErrCheckTwoFactor, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := checkPasswordExpiry(ctx, matchedUser, time.Now()); err != nil {
+		logger.Error(consts.AuthenticateUserTag, consts.MsgErrCheckPasswordExpiry, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := checkEmailVerified(matchedUser); err != nil {
+		logger.Error(consts.AuthenticateUserTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	consentPending, err := isParentalConsentPending(ctx, matchedUser.GetUuid())
+	if err != nil {
+		logger.Error(consts.AuthenticateUserTag, consts.MsgErrGetUserRow, err.Error())
+		return nil, statusFromError(err)
+	}
+	if consentPending {
+		logger.Error(consts.AuthenticateUserTag, consts.ErrParentalConsentRequired.Error())
+		return nil, statusFromError(consts.ErrParentalConsentRequired)
+	}
+
+	if err := checkLoginCountry(ctx, geoIP, matchedUser, time.Now()); err != nil {
+		logger.Error(consts.AuthenticateUserTag, consts.MsgErrRecordLoginCountry, err.Error())
+		return nil, statusFromError(err)
+	}
+
 	if auth.PermissionEnumMap[matchedUser.GetPermissionLevel()] < auth.UserRegistration {
 		logger.Error(consts.AuthenticateUserTag, consts.MsgErrGeneratingAuthToken)
 		return nil, status.Error(codes.Unauthenticated, consts.MsgErrGeneratingAuthToken)
 	}
-	identification, err := getAuthIdentification(matchedUser)
+	identification, err := getAuthIdentification(ctx, matchedUser)
 	if err != nil {
 		logger.Error(consts.AuthenticateUserTag, err.Error())
 		return nil, err
 	}
 
+	refreshToken, err := issueRefreshToken(ctx, matchedUser.GetUuid(), time.Now())
+	if err != nil {
+		logger.Error(consts.AuthenticateUserTag, consts.MsgErrIssueRefreshToken, err.Error())
+		return nil, statusFromError(err)
+	}
+	// without the header the client signs in again once the auth token expires
+	if err := setResponseHeader(ctx, metadataKeyRefreshToken, refreshToken); err != nil {
+		logger.Error(consts.AuthenticateUserTag, consts.MsgErrSetResponseHeader, err.Error())
+	}
+
 	logger.Info("Authenticated user:", matchedUser.GetUuid(),
 		matchedUser.GetFirstName(), matchedUser.GetLastName())
 
@@ -370,16 +854,53 @@ func (s *Service) AuthenticateUser(ctx context.Context, req *pbsvc.UserRequest)
 	}, nil
 }
 
-// ListUsers returns the user DB collection
-// TODO write return values after implementing
+// ListUsers returns a page of the accounts table in the order users signed up, for admin clients browsing users.
+// It requires an admin auth token. At most x-hwsc-limit users (defaults to 100, up to 1000) are returned per page,
+// the x-hwsc-page-token metadata continues from the x-hwsc-next-page-token header of the previous page.
+// Users may be filtered by the x-hwsc-organization-bin, x-hwsc-is-verified ("true" or "false"), and the
+// x-hwsc-from-date and x-hwsc-to-date (YYYY-MM-DD, both included) metadata of the day they signed up.
+// On success, returns the users in the user collection with passwords set to empty, the x-hwsc-next-page-token
+// response header unless it is the last page, and x-hwsc-users-last-seen, see GetUser.
 func (s *Service) ListUsers(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
-	//TODO
 	logger.RequestService("ListUsers")
-	return &pbsvc.UserResponse{}, nil
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ListUsersTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	filter, err := parseUserListFilter(ctx)
+	if err != nil {
+		logger.Error(consts.ListUsersTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	afterUUID, limit, err := parseUserListPage(ctx)
+	if err != nil {
+		logger.Error(consts.ListUsersTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.ListUsersTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// listing spans every user, only admins may read it
+	if err := authorizeAdmin(ctx, req.GetIdentification().GetToken(), "ListUsers", filter.organization); err != nil {
+		logger.Error(consts.ListUsersTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	// the admin is authorized against the primary, the page may lag it
+	return usersPageResponse(withReplicaReads(ctx), consts.ListUsersTag, filter, afterUUID, limit)
 }
 
 // GetUser looks up a user by their uuid in accounts table.
-// On success, returns the matched row as user object, setting password to empty.
+// On success, returns the matched row as user object, setting password to empty, and when the user last used
+// an auth token, rounded down to 5 minutes, in the x-hwsc-last-seen response header (RFC 3339) if it ever did.
+// The middle name, if any, and display name are returned in the x-hwsc-middle-name-bin and x-hwsc-display-name-bin
+// headers, a user that did not choose a display name goes by its first and last names.
 func (s *Service) GetUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
 	logger.RequestService("GetUser")
 
@@ -388,20 +909,11 @@ func (s *Service) GetUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.U
 		return nil, consts.ErrStatusServiceUnavailable
 	}
 
-	if req == nil {
-		return nil, consts.ErrStatusNilRequestUser
-	}
-
 	if err := refreshDBConnection(); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
-	// get User Object
 	user := req.GetUser()
-	if user == nil {
-		logger.Error(consts.ErrNilRequestUser.Error())
-		return nil, consts.ErrStatusNilRequestUser
-	}
 
 	if err := validation.ValidateUserUUID(user.GetUuid()); err != nil {
 		logger.Error(consts.GetUserTag, authconst.ErrInvalidUUID.Error())
@@ -409,15 +921,19 @@ func (s *Service) GetUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.U
 	}
 
 	// read lock, b/c we are only retrieving/reading from the DB
-	lock, _ := uuidMapLocker.LoadOrStore(user.GetUuid(), &sync.RWMutex{})
-	lock.(*sync.RWMutex).RLock()
-	defer lock.(*sync.RWMutex).RUnlock()
+	unlock := uuidMapLocker.readLock(user.GetUuid())
+	defer unlock()
 
-	// retrieve users row from database
-	retrievedUser, err := getUserRow(user.GetUuid())
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	// retrieve users row from cache or database, the request writes nothing so a replica may serve it
+	retrievedUser, err := getCachedUserRow(withReplicaReads(ctx), user.GetUuid())
 	if err != nil {
 		logger.Error(consts.GetUserTag, consts.MsgErrGetUserRow, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
 	if retrievedUser == nil {
@@ -427,6 +943,28 @@ func (s *Service) GetUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.U
 
 	logger.Info("Retrieved user:", user.GetUuid(), user.GetFirstName(), user.GetLastName())
 
+	lastSeen, err := getLastSeen(ctx, user.GetUuid())
+	if err != nil {
+		logger.Error(consts.GetUserTag, consts.MsgErrGetLastSeen, err.Error())
+		return nil, statusFromError(err)
+	}
+	if !lastSeen.IsZero() {
+		if err := setResponseHeader(ctx, metadataKeyLastSeen, lastSeen.UTC().Format(time.RFC3339)); err != nil {
+			logger.Error(consts.GetUserTag, consts.MsgErrSetResponseHeader, err.Error())
+			return nil, statusFromError(err)
+		}
+	}
+
+	names, err := getUserNames(ctx, user.GetUuid())
+	if err != nil {
+		logger.Error(consts.GetUserTag, consts.MsgErrGetUserNames, err.Error())
+		return nil, statusFromError(err)
+	}
+	if err := setUserNameHeaders(ctx, retrievedUser, names); err != nil {
+		logger.Error(consts.GetUserTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
 	retrievedUser.Password = ""
 	return &pbsvc.UserResponse{
 		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
@@ -435,12 +973,188 @@ func (s *Service) GetUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.U
 	}, nil
 }
 
-// ShareDocument updates user/s documents shared_to_me field in user DB
-// TODO write return values after implementation
+// ShareDocument shares req.Duid, a document owned by the auth token's user, read-only with the users of
+// req.UuidsToShareDuid, up to 100 per call. The document is shared with all of them or none, users it is already
+// shared with are skipped.
+// On success, returns message and status marked with OK.
+// Returns NotFound if the user does not own the document or a user to share it with does not exist.
 func (s *Service) ShareDocument(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
-	//TODO
 	logger.RequestService("ShareDocument")
-	return &pbsvc.UserResponse{}, nil
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ShareDocumentTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := validateDuid(req.GetDuid()); err != nil {
+		logger.Error(consts.ShareDocumentTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := validateShareRecipients(req.GetUuidsToShareDuid()); err != nil {
+		logger.Error(consts.ShareDocumentTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.ShareDocumentTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.ShareDocumentTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if err := insertSharedDocuments(ctx, uuid, req.GetDuid(), req.GetUuidsToShareDuid()); err != nil {
+		logger.Error(consts.ShareDocumentTag, consts.MsgErrShareDocument, err.Error())
+		return nil, statusFromError(err)
+	}
+	recordAudit(ctx, uuid, auditActionShareDocument, req.GetDuid())
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// UnshareDocument stops sharing req.Duid, a document owned by the auth token's user, with the users of
+// req.UuidsToShareDuid, up to 100 per call. Users it is not shared with are skipped.
+// On success, returns message and status marked with OK, and the number of users the document was unshared from
+// in the x-hwsc-rows-affected response header.
+// Returns NotFound if the user does not own the document.
+func (s *Service) UnshareDocument(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("UnshareDocument")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ShareDocumentTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := validateDuid(req.GetDuid()); err != nil {
+		logger.Error(consts.ShareDocumentTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := validateShareRecipients(req.GetUuidsToShareDuid()); err != nil {
+		logger.Error(consts.ShareDocumentTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.ShareDocumentTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.ShareDocumentTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	unshared, err := deleteSharedDocuments(ctx, uuid, req.GetDuid(), req.GetUuidsToShareDuid())
+	if err != nil {
+		logger.Error(consts.ShareDocumentTag, consts.MsgErrUnshareDocument, err.Error())
+		return nil, statusFromError(err)
+	}
+	if unshared > 0 {
+		recordAudit(ctx, uuid, auditActionUnshareDocument, req.GetDuid())
+	}
+
+	if err := setResponseHeader(ctx, metadataKeyRowsAffected, strconv.FormatInt(unshared, 10)); err != nil {
+		logger.Error(consts.ShareDocumentTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// ListSharedWithMe returns the documents shared with the auth token's user, leaving out those of deleted owners.
+// Documents are paged like ListPublicDocuments pages them.
+// On success, the x-hwsc-shared-documents response header lists the documents in duid order, as duid=uuid of
+// their owner.
+func (s *Service) ListSharedWithMe(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ListSharedWithMe")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ShareDocumentTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	fromDuid, err := parseFromDuid(getIncomingMetadata(ctx, metadataKeyFromDuid))
+	if err != nil {
+		logger.Error(consts.ShareDocumentTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	limit, err := getIncomingMetadataInt64(ctx, metadataKeyLimit, defaultDocumentsLimit)
+	if err != nil || limit <= 0 || limit > maxDocumentsLimit {
+		logger.Error(consts.ShareDocumentTag, consts.ErrInvalidReplayLimit.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidReplayLimit.Error())
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.ShareDocumentTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.ShareDocumentTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	// read lock, b/c we are only retrieving/reading from the DB
+	unlock := uuidMapLocker.readLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	documents, err := getSharedDocuments(ctx, uuid, fromDuid, int(limit))
+	if err != nil {
+		logger.Error(consts.ShareDocumentTag, consts.MsgErrListSharedWithMe, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	values := make([]string, 0, len(documents))
+	for _, document := range documents {
+		values = append(values, document.duid+"="+document.owner)
+	}
+	if err := setResponseHeader(ctx, metadataKeySharedDocuments, values...); err != nil {
+		logger.Error(consts.ShareDocumentTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
 }
 
 // GetAuthSecret looks up active secret (marked with true boolean) from secrets table.
@@ -455,7 +1169,7 @@ func (s *Service) GetAuthSecret(ctx context.Context, req *pbsvc.UserRequest) (*p
 	}
 
 	if err := refreshDBConnection(); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
 	// the chance of creating a new secret is very slim thus the usage of read lock
@@ -464,24 +1178,29 @@ func (s *Service) GetAuthSecret(ctx context.Context, req *pbsvc.UserRequest) (*p
 	defer authSecretLocker.RUnlock()
 
 	// check for any active secret
-	exists, err := hasActiveAuthSecret()
+	exists, err := hasActiveAuthSecret(ctx)
 	if err != nil {
 		logger.Error(consts.GetAuthSecret, consts.MsgErrLookUpActiveSecret, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
-	// no active key was found in DB, create and insert new secret
+	// no active key was found in DB, create and insert new secret, a standby waits for the primary to create it
+	if !exists && isStandby {
+		logger.Error(consts.GetAuthSecret, consts.ErrNoActiveSecretKeyFound.Error())
+		return nil, statusFromError(consts.ErrNoActiveSecretKeyFound)
+	}
 	if !exists {
-		if err := insertNewAuthSecret(); err != nil {
+		if err := insertNewAuthSecret(ctx); err != nil {
 			logger.Error(consts.GetAuthSecret, consts.MsgErrSecret, err.Error())
-			return nil, status.Error(codes.Internal, err.Error())
+			return nil, statusFromError(err)
 		}
+		recordAudit(ctx, callerUUID(ctx), auditActionRotateSecret, "")
 	}
 
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := getActiveSecretRow(ctx)
 	if err != nil {
 		logger.Error(consts.GetAuthSecret, consts.MsgErrGetActiveSecret, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
 	return &pbsvc.UserResponse{
@@ -495,6 +1214,7 @@ func (s *Service) GetAuthSecret(ctx context.Context, req *pbsvc.UserRequest) (*p
 
 // GetNewAuthToken returns a new auth token and secret based on the following criterias:
 // If current auth token is valid, returns new auth token and matching secret.
+// If verified emails are required and the user's email is not verified, returns FailedPrecondition.
 // Else return error code deadline exceeded.
 func (s *Service) GetNewAuthToken(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
 	logger.RequestService("GetNewAuthToken")
@@ -504,24 +1224,15 @@ func (s *Service) GetNewAuthToken(ctx context.Context, req *pbsvc.UserRequest) (
 		return nil, consts.ErrStatusServiceUnavailable
 	}
 
-	if req == nil {
-		logger.Error(consts.GetNewAuthTokenTag, consts.ErrNilRequest.Error())
-		return nil, consts.ErrStatusNilRequestUser
-	}
-
 	if err := refreshDBConnection(); err != nil {
 		logger.Error(consts.GetNewAuthTokenTag, consts.ErrDBConnectionError.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 	// get identification object
 	identity := req.GetIdentification()
-	if identity == nil {
-		logger.Error(consts.GetNewAuthTokenTag, consts.ErrNilRequestIdentification.Error())
-		return nil, status.Error(codes.DeadlineExceeded, consts.ErrNilRequestIdentification.Error())
-	}
 
 	// verify auth token token against database
-	retrievedIdentity, err := pairTokenWithSecret(identity.GetToken())
+	retrievedIdentity, err := pairTokenWithSecret(ctx, identity.GetToken())
 	if err != nil {
 		logger.Error(consts.GetNewAuthTokenTag, consts.MsgErrValidatingToken, err.Error())
 		return nil, status.Error(codes.DeadlineExceeded, err.Error())
@@ -536,6 +1247,12 @@ func (s *Service) GetNewAuthToken(ctx context.Context, req *pbsvc.UserRequest) (
 	// invalidate authority for security reasons
 	defer authority.Invalidate()
 
+	// an idle token is expired like one past its expiration timestamp
+	if err := sessions.touch(ctx, identity.GetToken(), time.Now()); err != nil {
+		logger.Error(consts.GetNewAuthTokenTag, consts.MsgErrValidatingToken, err.Error())
+		return nil, status.Error(codes.DeadlineExceeded, err.Error())
+	}
+
 	uuid := auth.ExtractUUID(identity.GetToken())
 	if uuid == "" {
 		logger.Error(consts.GetNewAuthTokenTag, consts.ErrStatusUUIDInvalid.Error())
@@ -543,14 +1260,36 @@ func (s *Service) GetNewAuthToken(ctx context.Context, req *pbsvc.UserRequest) (
 	}
 
 	// write lock to prevent race condition in making a new auth token
-	lock, _ := uuidMapLocker.LoadOrStore(uuid, &sync.RWMutex{})
-	lock.(*sync.RWMutex).Lock()
-	defer lock.(*sync.RWMutex).Unlock()
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
 
-	newIdentity, err := newAuthIdentification(authority.Header(), authority.Body())
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	// the user may have changed their email since the token was issued, custom claims are taken from the user
+	var retrievedUser *pblib.User
+	if requireVerifiedEmail || len(tokenCustomClaims) != 0 {
+		retrievedUser, err = getCachedUserRow(ctx, uuid)
+		if err != nil {
+			logger.Error(consts.GetNewAuthTokenTag, consts.MsgErrGetUserRow, err.Error())
+			return nil, statusFromError(err)
+		}
+		if retrievedUser == nil {
+			logger.Error(consts.GetNewAuthTokenTag, consts.ErrUUIDNotFound.Error())
+			return nil, consts.ErrStatusUUIDNotFound
+		}
+		if err := checkEmailVerified(retrievedUser); err != nil {
+			logger.Error(consts.GetNewAuthTokenTag, err.Error())
+			return nil, statusFromError(err)
+		}
+	}
+
+	newIdentity, err := newAuthIdentification(ctx, authority.Header(), authority.Body(), retrievedUser)
 	if err != nil {
 		logger.Error(consts.GetNewAuthTokenTag, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
 	return &pbsvc.UserResponse{
@@ -560,8 +1299,158 @@ func (s *Service) GetNewAuthToken(ctx context.Context, req *pbsvc.UserRequest) (
 	}, nil
 }
 
+// RefreshAuthToken exchanges the x-hwsc-refresh-token metadata, the refresh token returned by AuthenticateUser,
+// for a new auth token with the permission the user has now. Refresh tokens are used once, on success the next
+// refresh token is returned in the x-hwsc-refresh-token response header.
+// Returns Unauthenticated if the refresh token does not match or expired, the user should sign in again.
+func (s *Service) RefreshAuthToken(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("RefreshAuthToken")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.RefreshTokenTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	refreshToken := getIncomingMetadata(ctx, metadataKeyRefreshToken)
+	if refreshToken == "" {
+		logger.Error(consts.RefreshTokenTag, authconst.ErrEmptyToken.Error())
+		return nil, status.Error(codes.InvalidArgument, authconst.ErrEmptyToken.Error())
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.RefreshTokenTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	uuid, err := consumeRefreshToken(ctx, hashToken(refreshToken))
+	if err != nil {
+		logger.Error(consts.RefreshTokenTag, consts.MsgErrRefreshAuthToken, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	// write lock to prevent race condition in making a new auth token
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	retrievedUser, err := getUserRow(ctx, uuid)
+	if err != nil {
+		logger.Error(consts.RefreshTokenTag, consts.MsgErrGetUserRow, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	// the user may have changed their email since signing in
+	if err := checkEmailVerified(retrievedUser); err != nil {
+		logger.Error(consts.RefreshTokenTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if auth.PermissionEnumMap[retrievedUser.GetPermissionLevel()] < auth.UserRegistration {
+		logger.Error(consts.RefreshTokenTag, consts.MsgErrGeneratingAuthToken)
+		return nil, status.Error(codes.Unauthenticated, consts.MsgErrGeneratingAuthToken)
+	}
+
+	identification, err := refreshIdentification(ctx, retrievedUser)
+	if err != nil {
+		logger.Error(consts.RefreshTokenTag, consts.MsgErrRefreshAuthToken, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	nextRefreshToken, err := issueRefreshToken(ctx, uuid, time.Now())
+	if err != nil {
+		logger.Error(consts.RefreshTokenTag, consts.MsgErrIssueRefreshToken, err.Error())
+		return nil, statusFromError(err)
+	}
+	if err := setResponseHeader(ctx, metadataKeyRefreshToken, nextRefreshToken); err != nil {
+		logger.Error(consts.RefreshTokenTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message:        codes.OK.String(),
+		Identification: identification,
+	}, nil
+}
+
+// LogoutUser revokes the auth token in req.Identification before it expires, VerifyAuthToken refuses it from
+// then on, on every instance within the refresh interval of its verifier. The refresh token in the
+// x-hwsc-refresh-token metadata, if any, is revoked with it. Revoking a token twice succeeds.
+// To sign a user out everywhere, tokens are revoked by uuid when the password changes or the user is deleted.
+// Returns Unauthenticated if the token is not a valid auth token.
+func (s *Service) LogoutUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("LogoutUser")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.LogoutTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.LogoutTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	resp := &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}
+
+	token := req.GetIdentification().GetToken()
+	retrievedIdentity, err := pairTokenWithSecret(ctx, token)
+	if err == consts.ErrNoMatchingAuthTokenFound {
+		logger.Info(consts.LogoutTag, "Auth token is already revoked")
+		return resp, nil
+	}
+	if err != nil {
+		logger.Error(consts.LogoutTag, consts.MsgErrValidatingToken, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	claims, err := verifyAuthClaims(retrievedIdentity, time.Now())
+	if err != nil {
+		logger.Error(consts.LogoutTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	unlock := uuidMapLocker.writeLock(claims.UUID)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	var refreshTokenHash string
+	if refreshToken := getIncomingMetadata(ctx, metadataKeyRefreshToken); refreshToken != "" {
+		refreshTokenHash = hashToken(refreshToken)
+	}
+
+	// verifiers accept the token until it expired by more than the clock skew
+	expiration := time.Unix(claims.ExpirationTimestamp, 0).Add(tokenClockSkew)
+	if err := revokeAuthToken(ctx, claims.UUID, token, refreshTokenHash, expiration); err != nil {
+		logger.Error(consts.LogoutTag, consts.MsgErrLogoutUser, err.Error())
+		return nil, statusFromError(err)
+	}
+	authTokenCache.invalidateToken(token)
+	authTokenVerifier.revokeToken(hashToken(token))
+
+	logger.Info(consts.LogoutTag, "Logged out user:", claims.UUID)
+
+	return resp, nil
+}
+
 // VerifyAuthToken checks if received token and retrieved secret is valid.
-// Token is first verified against tokens table, and if token is found, secret is retrieved.
+// Token is first verified against the cached unexpired secrets without a db lookup, unless the user's
+// tokens were recently revoked. Otherwise token is verified against tokens table, and if token is found,
+// secret is retrieved. Tokens idle for longer than hosts_auth_idletimeout are not valid.
+// The token must be unexpired within hosts_auth_clockskew, carry hosts_auth_issuer and hosts_auth_audience if
+// they are set, and be signed with a secret that has not been retired, see verifyAuthClaims.
+// Verified tokens update the last seen timestamp of their user, see GetUser.
 // On success, returns identity object with token and paired secret.
 func (s *Service) VerifyAuthToken(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
 	logger.RequestService("VerifyAuthToken")
@@ -571,38 +1460,47 @@ func (s *Service) VerifyAuthToken(ctx context.Context, req *pbsvc.UserRequest) (
 		return nil, consts.ErrStatusServiceUnavailable
 	}
 
-	if req == nil {
-		logger.Error(consts.VerifyAuthToken, consts.ErrNilRequest.Error())
-		return nil, consts.ErrStatusNilRequestUser
-	}
-
 	if err := refreshDBConnection(); err != nil {
 		logger.Error(consts.VerifyAuthToken, consts.ErrDBConnectionError.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
 	// get identification object
 	identity := req.GetIdentification()
-	if identity == nil {
-		return nil, status.Error(codes.InvalidArgument, consts.ErrNilRequestIdentification.Error())
+
+	// fast path: verify token against cached secrets, which a replica may load. Revocations are only read from
+	// the primary, so a revoked token is never accepted by a lagging replica.
+	if verifiedIdentity := authTokenVerifier.verify(withReplicaReads(ctx), identity.GetToken()); verifiedIdentity != nil {
+		if err := sessions.touch(ctx, identity.GetToken(), time.Now()); err != nil {
+			logger.Error(consts.VerifyAuthToken, consts.MsgErrValidatingToken, err.Error())
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		recordPresence(identity.GetToken())
+
+		return &pbsvc.UserResponse{
+			Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+			Message:        codes.OK.String(),
+			Identification: verifiedIdentity,
+		}, nil
 	}
 
 	// verify token against database
-	retrievedIdentity, err := pairTokenWithSecret(identity.GetToken())
+	retrievedIdentity, err := pairTokenWithCachedSecret(ctx, identity.GetToken())
 	if err != nil {
 		logger.Error(consts.VerifyAuthToken, consts.MsgErrValidatingToken, err.Error())
 		return nil, status.Error(codes.Unauthenticated, err.Error())
 	}
 
-	// create authority to validate Identity containing token and retrieved secret
-	authority := auth.NewAuthority(auth.Jwt, auth.User)
-	if err := authority.Authorize(retrievedIdentity); err != nil {
+	if _, err := verifyAuthClaims(retrievedIdentity, time.Now()); err != nil {
 		logger.Error(consts.VerifyAuthToken, consts.MsgErrValidatingIdentity, err.Error())
 		return nil, status.Error(codes.Unauthenticated, err.Error())
 	}
 
-	// invalidate authority and identity's secret for security reasons
-	authority.Invalidate()
+	if err := sessions.touch(ctx, identity.GetToken(), time.Now()); err != nil {
+		logger.Error(consts.VerifyAuthToken, consts.MsgErrValidatingToken, err.Error())
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	recordPresence(identity.GetToken())
 
 	return &pbsvc.UserResponse{
 		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
@@ -624,25 +1522,28 @@ func (s *Service) MakeNewAuthSecret(ctx context.Context, req *pbsvc.UserRequest)
 
 	if err := refreshDBConnection(); err != nil {
 		logger.Error(consts.MakeNewAuthSecret, consts.ErrDBConnectionError.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 
 	authSecretLocker.Lock()
 	defer authSecretLocker.Unlock()
 
 	// insert new secret
-	if err := insertNewAuthSecret(); err != nil {
+	if err := insertNewAuthSecret(ctx); err != nil {
 		logger.Error(consts.MakeNewAuthSecret, consts.MsgErrSecret, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
+	recordAudit(ctx, callerUUID(ctx), auditActionRotateSecret, "")
 
 	// retrieve the newly updated active secret and set it as the currAuthSecret
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := getActiveSecretRow(ctx)
 	if err != nil {
 		logger.Error(consts.MakeNewAuthSecret, consts.MsgErrGetActiveSecret, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusFromError(err)
 	}
 	currAuthSecret = retrievedSecret
+	authTokenCache.purge()
+	authTokenVerifier.expire()
 
 	return &pbsvc.UserResponse{
 		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
@@ -650,90 +1551,97 @@ func (s *Service) MakeNewAuthSecret(ctx context.Context, req *pbsvc.UserRequest)
 	}, nil
 }
 
-// VerifyEmailToken checks if received token is found in the email_tokens table.
-// If found and token is NOT expired, deletes token row and returns OK.
-// If found, but token IS expired, it will return a expired token error.
-// Additionally for expired tokens, if user is new, it will delete token AND user row, else just deletes the token row.
-// If token is not found, return error with token does not exist message.
-func (s *Service) VerifyEmailToken(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
-	logger.RequestService("VerifyEmailToken")
+// ConfirmEmailChange makes the prospective email of the user of the email change token in req.Identification
+// its email, and marks it verified. The token is the one linked in the confirmation email sent by UpdateUser.
+// Returns DeadlineExceeded if the token expired, NotFound if there is no such token or the change was cancelled,
+// and AlreadyExists if another account took the email.
+// On success, returns the updated user without its password.
+func (s *Service) ConfirmEmailChange(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ConfirmEmailChange")
 
 	if ok := serviceStateLocker.isStateAvailable(); !ok {
-		logger.Error(consts.VerifyEmailToken, consts.ErrServiceUnavailable.Error())
+		logger.Error(consts.EmailChangeTag, consts.ErrServiceUnavailable.Error())
 		return nil, consts.ErrStatusServiceUnavailable
 	}
 
-	if req == nil {
-		logger.Error(consts.VerifyEmailToken, consts.ErrNilRequest.Error())
-		return nil, consts.ErrStatusNilRequestUser
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.EmailChangeTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
 	}
 
-	if req.GetIdentification() == nil {
-		logger.Error(consts.VerifyEmailToken, consts.ErrNilRequestIdentification.Error())
-		return nil, status.Error(codes.InvalidArgument, consts.ErrNilRequestIdentification.Error())
+	changeToken := req.GetIdentification().GetToken()
+	uuid := auth.ExtractUUID(changeToken)
+	if uuid == "" {
+		logger.Error(consts.EmailChangeTag, authconst.ErrInvalidUUID.Error())
+		return nil, consts.ErrStatusUUIDInvalid
 	}
 
-	emailToken := req.GetIdentification().GetToken()
-	if emailToken == "" {
-		logger.Error(consts.VerifyEmailToken, authconst.ErrEmptyToken.Error())
-		return nil, status.Error(codes.InvalidArgument, authconst.ErrEmptyToken.Error())
-	}
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
 
-	if err := refreshDBConnection(); err != nil {
-		logger.Error(consts.VerifyEmailToken, consts.ErrDBConnectionError.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
 	}
 
-	uuid := auth.ExtractUUID(emailToken)
-	if uuid == "" {
-		logger.Error(consts.VerifyEmailToken, authconst.ErrInvalidUUID.Error())
-		return nil, consts.ErrStatusUUIDInvalid
+	updatedUser, err := confirmEmailChangeRow(ctx, changeToken)
+	if err != nil {
+		logger.Error(consts.EmailChangeTag, consts.MsgErrConfirmEmailChange, err.Error())
+		return nil, statusFromError(err)
 	}
+	invalidateCachedUser(updatedUser.GetUuid())
 
-	lock, _ := uuidMapLocker.LoadOrStore(uuid, &sync.RWMutex{})
-	lock.(*sync.RWMutex).Lock()
-	defer lock.(*sync.RWMutex).Unlock()
+	updatedUser.Password = ""
+	publishUserEvent(eventTypeUserUpdated, updatedUser)
 
-	// find matching email token row
-	retrievedToken, err := getEmailTokenRow(emailToken)
-	if err != nil {
-		logger.Error(consts.VerifyEmailToken, consts.MsgErrRetrieveEmailTokenRow, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+	logger.Info(consts.EmailChangeTag, "Confirmed email change:", updatedUser.GetUuid())
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+		User:    updatedUser,
+	}, nil
+}
+
+// CancelEmailChange drops the pending email change of the auth token's user, its confirmation link stops working
+// and the prospective email is released for other accounts.
+// Method is idempotent, returns OK regardless of a change being pending.
+func (s *Service) CancelEmailChange(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("CancelEmailChange")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.EmailChangeTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
 	}
 
-	// delete token row
-	if err := deleteEmailTokenRow(retrievedToken.uuid); err != nil {
-		logger.Error(consts.VerifyEmailToken, consts.MsgErrDeletingEmailToken)
-		return nil, status.Error(codes.Internal, err.Error())
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.EmailChangeTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
 	}
 
-	// look up user to determine permission level
-	retrievedUser, err := getUserRow(retrievedToken.uuid)
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
 	if err != nil {
-		logger.Error(consts.VerifyEmailToken, consts.MsgErrGetUserRow, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		logger.Error(consts.EmailChangeTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
 	}
 
-	// if token is expired
-	if time.Now().Unix() >= retrievedToken.expirationTimestamp || retrievedToken.expirationTimestamp <= 0 {
-		// delete stale new user
-		if (retrievedUser.GetProspectiveEmail() == "" && retrievedUser.GetIsVerified() == false) &&
-			retrievedUser.GetPermissionLevel() == auth.PermissionStringMap[auth.NoPermission] {
-			if err := deleteUserRow(retrievedToken.uuid); err != nil {
-				logger.Error(consts.VerifyEmailToken, consts.MsgErrDeleteUser, " && ", consts.ErrExpiredEmailToken.Error())
-				return nil, status.Error(codes.Internal, fmt.Sprintf("%s && %s", err.Error(), consts.ErrExpiredEmailToken.Error()))
-			}
-		}
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
 
-		logger.Error(consts.VerifyEmailToken, consts.ErrExpiredEmailToken.Error())
-		return nil, status.Error(codes.DeadlineExceeded, consts.ErrExpiredEmailToken.Error())
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
 	}
 
-	// update user's permission level
-	err = updatePermissionLevel(retrievedUser.GetUuid(), auth.PermissionStringMap[auth.User])
+	cancelled, err := cancelEmailChangeRow(ctx, uuid)
 	if err != nil {
-		logger.Error(consts.VerifyEmailToken, consts.MsgErrUpdatePermLevel, err.Error())
-		return nil, status.Error(codes.Internal, err.Error())
+		logger.Error(consts.EmailChangeTag, consts.MsgErrCancelEmailChange, err.Error())
+		return nil, statusFromError(err)
+	}
+	if cancelled > 0 {
+		invalidateCachedUser(uuid)
+		logger.Info(consts.EmailChangeTag, "Cancelled email change:", uuid)
 	}
 
 	return &pbsvc.UserResponse{
@@ -741,3 +1649,2424 @@ func (s *Service) VerifyEmailToken(ctx context.Context, req *pbsvc.UserRequest)
 		Message: codes.OK.String(),
 	}, nil
 }
+
+// VerifyEmailToken checks if received token is found in the email_tokens table.
+// If found and token is NOT expired, deletes token row and returns OK.
+// If found, but token IS expired, it will return a expired token error.
+// Additionally for expired tokens, if user is new, it will delete token AND user row, else just deletes the token row.
+// If token is not found, return error with token does not exist message.
+func (s *Service) VerifyEmailToken(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("VerifyEmailToken")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.VerifyEmailToken, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	emailToken := req.GetIdentification().GetToken()
+	if emailToken == "" {
+		logger.Error(consts.VerifyEmailToken, authconst.ErrEmptyToken.Error())
+		return nil, status.Error(codes.InvalidArgument, authconst.ErrEmptyToken.Error())
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.VerifyEmailToken, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	uuid := auth.ExtractUUID(emailToken)
+	if uuid == "" {
+		logger.Error(consts.VerifyEmailToken, authconst.ErrInvalidUUID.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	// consume the token and update the user's permission level in one transaction
+	retrievedUser, err := verifyEmailTokenRow(ctx, emailToken)
+	if err == consts.ErrExpiredEmailToken {
+		// a stale new user may have been deleted with the token
+		invalidateCachedUser(retrievedUser.GetUuid())
+		logger.Error(consts.VerifyEmailToken, consts.ErrExpiredEmailToken.Error())
+		return nil, status.Error(codes.DeadlineExceeded, consts.ErrExpiredEmailToken.Error())
+	}
+	if err != nil {
+		logger.Error(consts.VerifyEmailToken, consts.MsgErrVerifyEmailToken, err.Error())
+		return nil, statusFromError(err)
+	}
+	invalidateCachedUser(retrievedUser.GetUuid())
+
+	retrievedUser.PermissionLevel = auth.PermissionStringMap[auth.User]
+	retrievedUser.IsVerified = true
+	retrievedUser.Password = ""
+	publishUserEvent(eventTypeUserVerified, retrievedUser)
+
+	// mailing-list sync runs in the background, verification does not wait on the provider
+	go subscribeVerifiedUser(retrievedUser)
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// ResendVerificationEmail emails a new verification link to the unverified account with the email of the request
+// user, the link of any previous email stops working. Nothing is sent, without error, if no account has the email
+// or the account is already verified, so the response does not reveal which emails have accounts.
+// Returns ResourceExhausted if the account was sent a verification email less than the resend cooldown ago,
+// with the seconds until another email may be sent in the x-hwsc-retry-after response header.
+func (s *Service) ResendVerificationEmail(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ResendVerificationEmail")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ResendVerifyTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.ResendVerifyTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	resp := &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}
+
+	user, err := getUserRowByEmail(ctx, normalizeEmail(req.GetUser().GetEmail()))
+	if err == consts.ErrEmailDoesNotExist {
+		logger.Info(consts.ResendVerifyTag, "No account to resend the verification email of")
+		return resp, nil
+	}
+	if err != nil {
+		logger.Error(consts.ResendVerifyTag, consts.MsgErrResendVerificationEmail, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if user.GetIsVerified() {
+		logger.Info(consts.ResendVerifyTag, "Account is already verified:", user.GetUuid())
+		return resp, nil
+	}
+
+	unlock := uuidMapLocker.writeLock(user.GetUuid())
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	next, err := resendVerificationEmail(ctx, user)
+	if err == consts.ErrVerificationResendCooldown {
+		// rounded up, a client retrying after the header is not refused again
+		wait := int64((time.Until(next) + time.Second - 1) / time.Second)
+		if wait < 1 {
+			wait = 1
+		}
+		if err := setResponseHeader(ctx, metadataKeyRetryAfter, strconv.FormatInt(wait, 10)); err != nil {
+			logger.Error(consts.ResendVerifyTag, consts.MsgErrSetResponseHeader, err.Error())
+		}
+		logger.Info(consts.ResendVerifyTag, "Verification email sent too recently:", user.GetUuid())
+		return nil, statusFromError(err)
+	}
+	if err != nil {
+		logger.Error(consts.ResendVerifyTag, consts.MsgErrResendVerificationEmail, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	logger.Info(consts.ResendVerifyTag, "Resent verification email:", user.GetUuid())
+
+	return resp, nil
+}
+
+// VerifyParentalConsent consumes the parental consent token sent to the parent of a user under 13 at signup.
+// If the token is valid, the consent is recorded and the user may sign in.
+// If the token is expired, the user is deleted and DeadlineExceeded is returned, the child can sign up again.
+// If token is not found, returns NotFound.
+func (s *Service) VerifyParentalConsent(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("VerifyParentalConsent")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ParentalConsentTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.ParentalConsentTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	consentToken := req.GetIdentification().GetToken()
+	uuid := auth.ExtractUUID(consentToken)
+	if uuid == "" {
+		logger.Error(consts.ParentalConsentTag, authconst.ErrInvalidUUID.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	consentedUUID, err := verifyParentalConsentTokenRow(ctx, consentToken)
+	if consentedUUID != "" {
+		invalidateCachedUser(consentedUUID)
+	}
+	if err != nil {
+		logger.Error(consts.ParentalConsentTag, consts.MsgErrVerifyParentalConsent, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	logger.Info(consts.ParentalConsentTag, "Recorded parental consent:", consentedUUID)
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// ConfirmLoginCountry consumes the token emailed by AuthenticateUser when the user signed in from a new country
+// with hosts_geoip_forcereverify on, the user can then sign in from that country.
+// Returns NotFound if the token does not match, DeadlineExceeded if it expired, the user should sign in again
+// to get a new one.
+func (s *Service) ConfirmLoginCountry(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ConfirmLoginCountry")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.LoginCountryTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.LoginCountryTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	confirmationToken := req.GetIdentification().GetToken()
+	uuid := auth.ExtractUUID(confirmationToken)
+	if uuid == "" {
+		logger.Error(consts.LoginCountryTag, authconst.ErrInvalidUUID.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	confirmedUUID, err := confirmLoginCountryRow(ctx, confirmationToken)
+	if err != nil {
+		logger.Error(consts.LoginCountryTag, consts.MsgErrConfirmLoginCountry, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	logger.Info(consts.LoginCountryTag, "Confirmed login country:", confirmedUUID)
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// RequestPasswordReset emails a link to choose a new password to the account with the email of the request user.
+// The response is OK whether or not an account has the email, so the rpc does not tell which emails are registered.
+func (s *Service) RequestPasswordReset(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("RequestPasswordReset")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.PasswordResetTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.PasswordResetTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	resp := &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}
+
+	user, err := getUserRowByEmail(ctx, normalizeEmail(req.GetUser().GetEmail()))
+	if err == consts.ErrEmailDoesNotExist {
+		logger.Info(consts.PasswordResetTag, "No account to reset the password of")
+		return resp, nil
+	}
+	if err != nil {
+		logger.Error(consts.PasswordResetTag, consts.MsgErrRequestPasswordReset, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	unlock := uuidMapLocker.writeLock(user.GetUuid())
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if err := requestPasswordReset(ctx, user); err != nil {
+		logger.Error(consts.PasswordResetTag, consts.MsgErrRequestPasswordReset, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	logger.Info(consts.PasswordResetTag, "Requested password reset:", user.GetUuid())
+
+	return resp, nil
+}
+
+// ResetPassword consumes the token emailed by RequestPasswordReset and sets the password of the request user
+// as the new password of its account. Every auth token of the account is revoked, other sessions sign in again.
+// Returns NotFound if the token does not match, DeadlineExceeded if it expired, the user should request a new one.
+func (s *Service) ResetPassword(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ResetPassword")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.PasswordResetTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.PasswordResetTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	resetToken := req.GetIdentification().GetToken()
+	uuid := auth.ExtractUUID(resetToken)
+	if uuid == "" {
+		logger.Error(consts.PasswordResetTag, authconst.ErrInvalidUUID.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	resetUUID, err := consumePasswordResetToken(ctx, resetToken)
+	if err != nil {
+		logger.Error(consts.PasswordResetTag, consts.MsgErrResetPassword, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	dbDerivedUser, err := getUserRow(ctx, resetUUID)
+	if err != nil {
+		logger.Error(consts.PasswordResetTag, consts.MsgErrResetPassword, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	updatedUser, err := updateUserRow(ctx, resetUUID, &pblib.User{Password: req.GetUser().GetPassword()},
+		dbDerivedUser, userNames{}, nil)
+	if err != nil {
+		logger.Error(consts.PasswordResetTag, consts.MsgErrResetPassword, err.Error())
+		return nil, statusFromError(err)
+	}
+	invalidateCachedUser(resetUUID)
+
+	// whoever knew the old password is signed out
+	if err := revokeAuthTokens(ctx, resetUUID); err != nil {
+		logger.Error(consts.PasswordResetTag, consts.MsgErrRevokeAuthTokens, err.Error())
+		return nil, statusFromError(err)
+	}
+	authTokenCache.invalidateUUID(resetUUID)
+	authTokenVerifier.revoke(resetUUID)
+
+	publishUserEvent(eventTypeUserUpdated, updatedUser)
+
+	logger.Info(consts.PasswordResetTag, "Reset password:", resetUUID)
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// ReplayEvents returns persisted lifecycle events so a consumer that lost data can rebuild its view of users.
+// Replay starts after the x-hwsc-from-sequence metadata value (defaults to 0) and optionally
+// at the x-hwsc-from-timestamp (RFC 3339) metadata value, returning at most x-hwsc-limit events.
+// On success, each CloudEvents envelope is returned in the x-hwsc-event-bin response header,
+// and the last returned sequence in x-hwsc-last-sequence to continue from.
+// Events carry the email, names and organization of users, they are only replayed to admins and service api keys
+// scoped for ReplayEvents, sent as the identification token or in the authorization metadata.
+func (s *Service) ReplayEvents(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ReplayEvents")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ReplayEventsTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	fromSequence, err := getIncomingMetadataInt64(ctx, metadataKeyFromSequence, 0)
+	if err != nil || fromSequence < 0 {
+		logger.Error(consts.ReplayEventsTag, consts.ErrInvalidReplaySequence.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidReplaySequence.Error())
+	}
+
+	fromTimestamp, err := getIncomingMetadataTime(ctx, metadataKeyFromTimestamp)
+	if err != nil {
+		logger.Error(consts.ReplayEventsTag, consts.ErrInvalidReplayTimestamp.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidReplayTimestamp.Error())
+	}
+
+	limit, err := getIncomingMetadataInt64(ctx, metadataKeyLimit, defaultReplayLimit)
+	if err != nil || limit <= 0 || limit > maxReplayLimit {
+		logger.Error(consts.ReplayEventsTag, consts.ErrInvalidReplayLimit.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidReplayLimit.Error())
+	}
+
+	token := req.GetIdentification().GetToken()
+	if token == "" {
+		token = authorizationToken(ctx)
+	}
+	if token == "" {
+		logger.Error(consts.ReplayEventsTag, consts.ErrReplayNotAllowed.Error())
+		return nil, status.Error(codes.PermissionDenied, consts.ErrReplayNotAllowed.Error())
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.ReplayEventsTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// events span every user, only admins may replay them
+	if err := authorizeAdmin(ctx, token, "ReplayEvents", ""); err != nil {
+		logger.Error(consts.ReplayEventsTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	events, err := getEventsAfter(ctx, fromSequence, fromTimestamp, int(limit))
+	if err != nil {
+		logger.Error(consts.ReplayEventsTag, consts.MsgErrReplayEvents, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	lastSequence := fromSequence
+	envelopes := make([]string, 0, len(events))
+	for _, event := range events {
+		envelope, err := json.Marshal(event)
+		if err != nil {
+			logger.Error(consts.ReplayEventsTag, consts.MsgErrReplayEvents, err.Error())
+			return nil, statusFromError(err)
+		}
+		envelopes = append(envelopes, string(envelope))
+		lastSequence = event.Sequence
+	}
+
+	if len(envelopes) > 0 {
+		if err := setResponseHeader(ctx, metadataKeyEvent, envelopes...); err != nil {
+			logger.Error(consts.ReplayEventsTag, consts.MsgErrReplayEvents, err.Error())
+			return nil, statusFromError(err)
+		}
+	}
+	if err := setResponseHeader(ctx, metadataKeyLastSequence, strconv.FormatInt(lastSequence, 10)); err != nil {
+		logger.Error(consts.ReplayEventsTag, consts.MsgErrReplayEvents, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// GetUserStats returns the admin dashboard aggregates and requires an admin auth token.
+// Aggregates cover the last x-hwsc-days metadata value days (defaults to 30), today included, in UTC.
+// On success, the aggregates are returned as response headers:
+// x-hwsc-signups lists "YYYY-MM-DD=count" for each day,
+// x-hwsc-verification-rate is the fraction of those users that verified their email,
+// x-hwsc-active-sessions counts the users holding an unexpired auth token,
+// x-hwsc-organization-users-bin lists {"organization","users"} JSON objects for all users, and
+// x-hwsc-email-failure-rate is the fraction of emails that failed to send.
+func (s *Service) GetUserStats(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetUserStats")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.GetUserStatsTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	days, err := getIncomingMetadataInt64(ctx, metadataKeyDays, defaultStatsDays)
+	if err != nil || days <= 0 || days > maxStatsDays {
+		logger.Error(consts.GetUserStatsTag, consts.ErrInvalidStatsDays.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidStatsDays.Error())
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.GetUserStatsTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// aggregates span every user, only admins may read them
+	if err := authorizeAdmin(ctx, req.GetIdentification().GetToken(), "GetUserStats", ""); err != nil {
+		logger.Error(consts.GetUserStatsTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	stats, err := getUserStats(ctx, int(days))
+	if err != nil {
+		logger.Error(consts.GetUserStatsTag, consts.MsgErrGetUserStats, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := stats.setResponseHeaders(ctx); err != nil {
+		logger.Error(consts.GetUserStatsTag, consts.MsgErrGetUserStats, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// GetUsageReport returns the recorded daily seat counts per organization and requires an admin auth token.
+// Records span the x-hwsc-from-date to x-hwsc-to-date metadata values (YYYY-MM-DD, both included),
+// defaulting to the last 30 days, and at most a year. A x-hwsc-organization-bin metadata value limits
+// the report to one organization.
+// On success, each record is returned as a {"day","organization","seats"} JSON object in the
+// x-hwsc-usage-bin response header.
+func (s *Service) GetUsageReport(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetUsageReport")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.GetUsageReportTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	from, to, err := parseUsageReportRange(getIncomingMetadata(ctx, metadataKeyFromDate),
+		getIncomingMetadata(ctx, metadataKeyToDate), time.Now().UTC())
+	if err != nil {
+		logger.Error(consts.GetUsageReportTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.GetUsageReportTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	organization := getIncomingMetadata(ctx, metadataKeyOrganization)
+
+	// usage spans every organization, only admins may read it
+	if err := authorizeAdmin(ctx, req.GetIdentification().GetToken(), "GetUsageReport", organization); err != nil {
+		logger.Error(consts.GetUsageReportTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	records, err := getUsageRecords(ctx, from, to, organization)
+	if err != nil {
+		logger.Error(consts.GetUsageReportTag, consts.MsgErrGetUsageReport, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	values := make([]string, 0, len(records))
+	for _, record := range records {
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			logger.Error(consts.GetUsageReportTag, consts.MsgErrGetUsageReport, err.Error())
+			return nil, statusFromError(err)
+		}
+		values = append(values, string(encoded))
+	}
+
+	if len(values) > 0 {
+		if err := setResponseHeader(ctx, metadataKeyUsage, values...); err != nil {
+			logger.Error(consts.GetUsageReportTag, consts.MsgErrSetResponseHeader, err.Error())
+			return nil, statusFromError(err)
+		}
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// GetReferralStats returns the referral code of the auth token's user, how many users signed up with it,
+// and how many of those verified their email. Admins may look up another user by setting User.uuid.
+// On success, the stats are returned in the x-hwsc-referral-code, x-hwsc-referrals and x-hwsc-verified-referrals
+// response headers, and the uuid of the user's own referrer, if any, in x-hwsc-referred-by.
+func (s *Service) GetReferralStats(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetReferralStats")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.GetReferralStatsTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.GetReferralStatsTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	token := req.GetIdentification().GetToken()
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, token)
+	if err != nil {
+		logger.Error(consts.GetReferralStatsTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	if requested := req.GetUser().GetUuid(); requested != "" && requested != uuid {
+		// other users' stats are only for admins
+		if err := authorizeAdmin(ctx, token, "GetReferralStats", requested); err != nil {
+			logger.Error(consts.GetReferralStatsTag, consts.MsgErrValidatingIdentity, err.Error())
+			return nil, err
+		}
+		uuid = requested
+	}
+
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		logger.Error(consts.GetReferralStatsTag, authconst.ErrInvalidUUID.Error())
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	// read lock, b/c we are only retrieving/reading from the DB
+	unlock := uuidMapLocker.readLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	stats, err := getReferralStats(ctx, uuid)
+	if err != nil {
+		logger.Error(consts.GetReferralStatsTag, consts.MsgErrGetReferralStats, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := stats.setResponseHeaders(ctx); err != nil {
+		logger.Error(consts.GetReferralStatsTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// SetOnboardingStep records progress on the onboarding checklist of the auth token's user.
+// The step is named by the x-hwsc-onboarding-step metadata value, letters and digits separated by '-' or '_'.
+// It is marked completed unless the x-hwsc-onboarding-completed metadata value is "false", which clears it.
+// Completing a step again keeps its first completion time.
+func (s *Service) SetOnboardingStep(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("SetOnboardingStep")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.OnboardingTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	step, err := normalizeOnboardingStep(getIncomingMetadata(ctx, metadataKeyOnboardingStep))
+	if err != nil {
+		logger.Error(consts.OnboardingTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	completed, err := parseOnboardingCompleted(getIncomingMetadata(ctx, metadataKeyOnboardingCompleted))
+	if err != nil {
+		logger.Error(consts.OnboardingTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.OnboardingTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.OnboardingTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	retrievedUser, err := getCachedUserRow(ctx, uuid)
+	if err != nil {
+		logger.Error(consts.OnboardingTag, consts.MsgErrGetUserRow, err.Error())
+		return nil, statusFromError(err)
+	}
+	if retrievedUser == nil {
+		logger.Error(consts.OnboardingTag, consts.ErrUUIDNotFound.Error())
+		return nil, consts.ErrStatusUUIDNotFound
+	}
+
+	if err := setOnboardingStep(ctx, uuid, step, completed, time.Now()); err != nil {
+		logger.Error(consts.OnboardingTag, consts.MsgErrSetOnboardingStep, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// GetOnboardingState returns the onboarding checklist progress of the auth token's user.
+// On success, the x-hwsc-onboarding-steps response header lists "step=completion time (RFC 3339)"
+// for each completed step, in the order they were completed.
+func (s *Service) GetOnboardingState(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetOnboardingState")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.OnboardingTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.OnboardingTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.OnboardingTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	// read lock, b/c we are only retrieving/reading from the DB
+	unlock := uuidMapLocker.readLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	steps, err := getOnboardingSteps(ctx, uuid)
+	if err != nil {
+		logger.Error(consts.OnboardingTag, consts.MsgErrGetOnboardingState, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := setOnboardingHeader(ctx, steps); err != nil {
+		logger.Error(consts.OnboardingTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// GetNotificationPreferences returns the email categories the auth token's user receives.
+// On success, the x-hwsc-share-alerts, x-hwsc-security-alerts and x-hwsc-marketing response headers
+// are each "true" or "false". Account emails, such as verification links, are always sent.
+func (s *Service) GetNotificationPreferences(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetNotificationPreferences")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.NotificationTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.NotificationTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.NotificationTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	// read lock, b/c we are only retrieving/reading from the DB
+	unlock := uuidMapLocker.readLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	preferences, err := getNotificationPreferences(ctx, uuid)
+	if err != nil {
+		logger.Error(consts.NotificationTag, consts.MsgErrNotificationPreferences, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := preferences.setResponseHeaders(ctx); err != nil {
+		logger.Error(consts.NotificationTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// UpdateNotificationPreferences switches email categories on or off for the auth token's user.
+// Each of the x-hwsc-share-alerts, x-hwsc-security-alerts and x-hwsc-marketing metadata values that is set,
+// "true" or "false", updates its category; at least one must be set.
+// On success, the resulting preferences are returned as in GetNotificationPreferences.
+func (s *Service) UpdateNotificationPreferences(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("UpdateNotificationPreferences")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.NotificationTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	updates, err := parseNotificationPreferences(ctx)
+	if err != nil {
+		logger.Error(consts.NotificationTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.NotificationTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.NotificationTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	preferences, err := updateNotificationPreferences(ctx, uuid, updates)
+	if err != nil {
+		logger.Error(consts.NotificationTag, consts.MsgErrNotificationPreferences, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := preferences.setResponseHeaders(ctx); err != nil {
+		logger.Error(consts.NotificationTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// GetProfileHistory returns the changes the user of the auth token made to its own profile, oldest first.
+// Request metadata x-hwsc-from-sequence resumes after the last change of a previous page and x-hwsc-limit
+// bounds the changes returned, defaulting to 100 and at most 1000.
+// On success, the x-hwsc-profile-history-bin response header is a CSV document with the columns
+// sequence, timestamp, field, old_hash and new_hash, and x-hwsc-last-sequence is the sequence to resume from.
+// Hashes are the hex sha-256 of the uuid, field and value separated by NUL bytes, empty for blank values.
+func (s *Service) GetProfileHistory(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetProfileHistory")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.ProfileHistoryTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	fromSequence, err := getIncomingMetadataInt64(ctx, metadataKeyFromSequence, 0)
+	if err != nil || fromSequence < 0 {
+		logger.Error(consts.ProfileHistoryTag, consts.ErrInvalidReplaySequence.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidReplaySequence.Error())
+	}
+
+	limit, err := getIncomingMetadataInt64(ctx, metadataKeyLimit, defaultProfileHistoryLimit)
+	if err != nil || limit <= 0 || limit > maxProfileHistoryLimit {
+		logger.Error(consts.ProfileHistoryTag, consts.ErrInvalidReplayLimit.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidReplayLimit.Error())
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.ProfileHistoryTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.ProfileHistoryTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	changes, err := getProfileChanges(ctx, uuid, fromSequence, int(limit))
+	if err != nil {
+		logger.Error(consts.ProfileHistoryTag, consts.MsgErrGetProfileHistory, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	document, err := writeProfileHistoryCSV(changes)
+	if err != nil {
+		logger.Error(consts.ProfileHistoryTag, consts.MsgErrGetProfileHistory, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	lastSequence := fromSequence
+	if len(changes) > 0 {
+		lastSequence = changes[len(changes)-1].sequence
+	}
+
+	if err := setResponseHeader(ctx, metadataKeyProfileHistory, document); err != nil {
+		logger.Error(consts.ProfileHistoryTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+	if err := setResponseHeader(ctx, metadataKeyLastSequence, strconv.FormatInt(lastSequence, 10)); err != nil {
+		logger.Error(consts.ProfileHistoryTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// QueryAdminActivity returns the calls authorized with an admin token as CSV, for compliance reviews.
+// It requires an admin auth token, and is itself recorded.
+// The service issues no impersonation tokens, so every action it can report was made with an admin's own token.
+// Actions recorded from the x-hwsc-from-timestamp to the x-hwsc-to-timestamp metadata values (RFC 3339) are
+// returned, defaulting to the last 92 days. At most x-hwsc-limit actions (defaults to 1000) after the
+// x-hwsc-from-sequence metadata value (defaults to 0) are returned per call.
+// On success, the x-hwsc-admin-activity-bin response header holds a CSV document with the columns
+// sequence, timestamp, actor, action and subject, and x-hwsc-last-sequence the sequence to continue from.
+func (s *Service) QueryAdminActivity(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("QueryAdminActivity")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.AdminActivityTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	fromSequence, err := getIncomingMetadataInt64(ctx, metadataKeyFromSequence, 0)
+	if err != nil || fromSequence < 0 {
+		logger.Error(consts.AdminActivityTag, consts.ErrInvalidReplaySequence.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidReplaySequence.Error())
+	}
+
+	fromTimestamp, fromErr := getIncomingMetadataTime(ctx, metadataKeyFromTimestamp)
+	toTimestamp, toErr := getIncomingMetadataTime(ctx, metadataKeyToTimestamp)
+	if fromErr != nil || toErr != nil {
+		logger.Error(consts.AdminActivityTag, consts.ErrInvalidActivityRange.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidActivityRange.Error())
+	}
+	fromTimestamp, toTimestamp, err = parseActivityRange(fromTimestamp, toTimestamp, time.Now())
+	if err != nil {
+		logger.Error(consts.AdminActivityTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	limit, err := getIncomingMetadataInt64(ctx, metadataKeyLimit, defaultActivityLimit)
+	if err != nil || limit <= 0 || limit > maxActivityLimit {
+		logger.Error(consts.AdminActivityTag, consts.ErrInvalidReplayLimit.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidReplayLimit.Error())
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.AdminActivityTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// the audit trail covers every admin, only admins may read it
+	if err := authorizeAdmin(ctx, req.GetIdentification().GetToken(), "QueryAdminActivity", ""); err != nil {
+		logger.Error(consts.AdminActivityTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	actions, err := getAdminActions(ctx, fromSequence, fromTimestamp, toTimestamp, int(limit))
+	if err != nil {
+		logger.Error(consts.AdminActivityTag, consts.MsgErrQueryAdminActivity, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	document, err := writeAdminActivityCSV(actions)
+	if err != nil {
+		logger.Error(consts.AdminActivityTag, consts.MsgErrQueryAdminActivity, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	lastSequence := fromSequence
+	if len(actions) > 0 {
+		lastSequence = actions[len(actions)-1].sequence
+	}
+
+	if err := setResponseHeader(ctx, metadataKeyAdminActivity, document); err != nil {
+		logger.Error(consts.AdminActivityTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+	if err := setResponseHeader(ctx, metadataKeyLastSequence, strconv.FormatInt(lastSequence, 10)); err != nil {
+		logger.Error(consts.AdminActivityTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// GetAuditLog returns the recorded mutations as CSV: users created, updated and deleted, documents shared
+// and auth secrets rotated. It requires an admin auth token, and is itself recorded as an admin action.
+// Entries recorded from the x-hwsc-from-timestamp to the x-hwsc-to-timestamp metadata values (RFC 3339) are
+// returned, defaulting to the last 92 days. At most x-hwsc-limit entries (defaults to 1000) after the
+// x-hwsc-from-sequence metadata value (defaults to 0) are returned per call.
+// On success, the x-hwsc-audit-log-bin response header holds a CSV document with the columns
+// sequence, timestamp, actor, action, target and metadata, and x-hwsc-last-sequence the sequence to continue from.
+// The actor is empty for anonymous signups and secrets the service rotated itself, metadata is a JSON object of
+// the request's x-hwsc, x-forwarded-for and user-agent metadata.
+func (s *Service) GetAuditLog(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetAuditLog")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.AuditTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	fromSequence, err := getIncomingMetadataInt64(ctx, metadataKeyFromSequence, 0)
+	if err != nil || fromSequence < 0 {
+		logger.Error(consts.AuditTag, consts.ErrInvalidReplaySequence.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidReplaySequence.Error())
+	}
+
+	fromTimestamp, fromErr := getIncomingMetadataTime(ctx, metadataKeyFromTimestamp)
+	toTimestamp, toErr := getIncomingMetadataTime(ctx, metadataKeyToTimestamp)
+	if fromErr != nil || toErr != nil {
+		logger.Error(consts.AuditTag, consts.ErrInvalidActivityRange.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidActivityRange.Error())
+	}
+	fromTimestamp, toTimestamp, err = parseActivityRange(fromTimestamp, toTimestamp, time.Now())
+	if err != nil {
+		logger.Error(consts.AuditTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	limit, err := getIncomingMetadataInt64(ctx, metadataKeyLimit, defaultActivityLimit)
+	if err != nil || limit <= 0 || limit > maxActivityLimit {
+		logger.Error(consts.AuditTag, consts.ErrInvalidReplayLimit.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidReplayLimit.Error())
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.AuditTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// the audit log covers every user, only admins may read it
+	if err := authorizeAdmin(ctx, req.GetIdentification().GetToken(), "GetAuditLog", ""); err != nil {
+		logger.Error(consts.AuditTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	entries, err := getAuditEntries(ctx, fromSequence, fromTimestamp, toTimestamp, int(limit))
+	if err != nil {
+		logger.Error(consts.AuditTag, consts.MsgErrGetAuditLog, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	document, err := writeAuditLogCSV(entries)
+	if err != nil {
+		logger.Error(consts.AuditTag, consts.MsgErrGetAuditLog, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	lastSequence := fromSequence
+	if len(entries) > 0 {
+		lastSequence = entries[len(entries)-1].sequence
+	}
+
+	if err := setResponseHeader(ctx, metadataKeyAuditLog, document); err != nil {
+		logger.Error(consts.AuditTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+	if err := setResponseHeader(ctx, metadataKeyLastSequence, strconv.FormatInt(lastSequence, 10)); err != nil {
+		logger.Error(consts.AuditTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// LinkAuthMethod links a sign in method to the auth token's user, an account can have several of each method.
+// The x-hwsc-auth-method metadata value is "google", "webauthn" or "apikey", passwords are set with UpdateUser.
+// For google and webauthn, x-hwsc-credential-id is the google subject or webauthn credential id the caller
+// verified. For apikey, a key is generated and returned once in the x-hwsc-api-key response header, and
+// x-hwsc-credential-id identifies it. A credential can only be linked to one account.
+// On success, the linked methods are returned as in ListAuthMethods.
+func (s *Service) LinkAuthMethod(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("LinkAuthMethod")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.AuthMethodTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	method, err := parseAuthMethod(ctx, true)
+	if err != nil {
+		logger.Error(consts.AuthMethodTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	var apiKey, hashedAPIKey string
+	if method.method == authMethodAPIKey {
+		method.credentialID, apiKey, err = generateAPIKey()
+		if err == nil {
+			hashedAPIKey, err = hashPassword(apiKey)
+		}
+		if err != nil {
+			logger.Error(consts.AuthMethodTag, consts.MsgErrLinkAuthMethod, err.Error())
+			return nil, statusFromError(err)
+		}
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.AuthMethodTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.AuthMethodTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if err := insertAuthMethod(ctx, uuid, method, hashedAPIKey, time.Now()); err != nil {
+		logger.Error(consts.AuthMethodTag, consts.MsgErrLinkAuthMethod, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if apiKey != "" {
+		if err := setResponseHeader(ctx, metadataKeyCredentialID, method.credentialID); err != nil {
+			logger.Error(consts.AuthMethodTag, consts.MsgErrSetResponseHeader, err.Error())
+			return nil, statusFromError(err)
+		}
+		if err := setResponseHeader(ctx, metadataKeyAPIKey, apiKey); err != nil {
+			logger.Error(consts.AuthMethodTag, consts.MsgErrSetResponseHeader, err.Error())
+			return nil, statusFromError(err)
+		}
+	}
+
+	return authMethodsResponse(ctx, uuid)
+}
+
+// ListAuthMethods returns the sign in methods of the auth token's user.
+// On success, the x-hwsc-auth-methods response header has a value per credential, "password" or
+// the method and credential id separated by a colon, such as "webauthn:Z3Vlc3Q".
+func (s *Service) ListAuthMethods(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ListAuthMethods")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.AuthMethodTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.AuthMethodTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.AuthMethodTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	// read lock, b/c we are only retrieving/reading from the DB
+	unlock := uuidMapLocker.readLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	return authMethodsResponse(ctx, uuid)
+}
+
+// UnlinkAuthMethod unlinks the sign in method named by the x-hwsc-auth-method and x-hwsc-credential-id metadata
+// from the auth token's user, "password" needs no credential id. The last method of an account cannot be unlinked,
+// nor can the password while no linked method signs in.
+// On success, the remaining methods are returned as in ListAuthMethods.
+func (s *Service) UnlinkAuthMethod(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("UnlinkAuthMethod")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.AuthMethodTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	method, err := parseAuthMethod(ctx, false)
+	if err != nil {
+		logger.Error(consts.AuthMethodTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.AuthMethodTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.AuthMethodTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if err := deleteAuthMethod(ctx, uuid, method); err != nil {
+		logger.Error(consts.AuthMethodTag, consts.MsgErrUnlinkAuthMethod, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return authMethodsResponse(ctx, uuid)
+}
+
+// authMethodsResponse lists the auth methods of uuid in the x-hwsc-auth-methods response header.
+func authMethodsResponse(ctx context.Context, uuid string) (*pbsvc.UserResponse, error) {
+	methods, err := getAuthMethods(ctx, uuid)
+	if err != nil {
+		logger.Error(consts.AuthMethodTag, consts.MsgErrListAuthMethods, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := setAuthMethodsHeader(ctx, methods); err != nil {
+		logger.Error(consts.AuthMethodTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// Enable2FA starts the two-factor authentication enrollment of the auth token's user, which is enabled once
+// Verify2FA confirms a code of the new TOTP secret. Enabling again before then replaces the pending secret.
+// The secret is stored encrypted with hosts_auth_totpkey, FailedPrecondition is returned while it is not set.
+// On success, the secret is returned once, base32 encoded in the x-hwsc-totp-secret response header and as an
+// otpauth uri for QR codes in x-hwsc-totp-uri.
+func (s *Service) Enable2FA(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("Enable2FA")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.TwoFactorTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if totpKey == nil {
+		logger.Error(consts.TwoFactorTag, consts.ErrTwoFactorUnavailable.Error())
+		return nil, statusFromError(consts.ErrTwoFactorUnavailable)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.TwoFactorTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	retrievedUser, err := getCachedUserRow(ctx, uuid)
+	if err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrGetUserRow, err.Error())
+		return nil, statusFromError(err)
+	}
+	if retrievedUser == nil {
+		logger.Error(consts.TwoFactorTag, consts.ErrUUIDNotFound.Error())
+		return nil, consts.ErrStatusUUIDNotFound
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrEnableTwoFactor, err.Error())
+		return nil, statusFromError(err)
+	}
+	sealedSecret, err := sealTOTPSecret(secret, uuid)
+	if err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrEnableTwoFactor, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := insertTOTPSecret(ctx, uuid, sealedSecret, time.Now()); err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrEnableTwoFactor, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := setResponseHeader(ctx, metadataKeyTOTPSecret, totpEncoding.EncodeToString(secret)); err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+	if err := setResponseHeader(ctx, metadataKeyTOTPURI, totpURI(secret, retrievedUser.GetEmail())); err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// Verify2FA enables the pending two-factor authentication of the auth token's user, the x-hwsc-totp-code metadata
+// is a current code of the secret returned by Enable2FA. AuthenticateUser then requires a code as well.
+// On success, one-time backup codes are returned once in the x-hwsc-backup-codes response header, one value per
+// code, each can be sent in place of a TOTP code if the authenticator is lost.
+func (s *Service) Verify2FA(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("Verify2FA")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.TwoFactorTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	code := getIncomingMetadata(ctx, metadataKeyTOTPCode)
+	if code == "" {
+		logger.Error(consts.TwoFactorTag, consts.ErrInvalidTwoFactorCode.Error())
+		return nil, statusFromError(consts.ErrInvalidTwoFactorCode)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.TwoFactorTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	enrollment, err := getTwoFactor(ctx, uuid)
+	if err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrVerifyTwoFactor, err.Error())
+		return nil, statusFromError(err)
+	}
+	if enrollment == nil || enrollment.enabled {
+		logger.Error(consts.TwoFactorTag, consts.ErrTwoFactorNotPending.Error())
+		return nil, statusFromError(consts.ErrTwoFactorNotPending)
+	}
+
+	secret, err := openTOTPSecret(enrollment.sealedSecret, uuid)
+	if err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrVerifyTwoFactor, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	// backup codes are not issued yet, only a TOTP code confirms the authenticator has the secret
+	now := time.Now()
+	step, ok := matchTOTPCode(secret, code, now, enrollment.lastUsedStep)
+	if !ok {
+		logger.Error(consts.TwoFactorTag, consts.ErrInvalidTwoFactorCode.Error())
+		return nil, statusFromError(consts.ErrInvalidTwoFactorCode)
+	}
+
+	backupCodes, codeHashes, err := generateBackupCodes()
+	if err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrVerifyTwoFactor, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := enableTwoFactor(ctx, uuid, step, codeHashes, now); err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrVerifyTwoFactor, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	// the codes are not stored, without the header they can only be replaced by disabling and enabling again
+	if err := setResponseHeader(ctx, metadataKeyBackupCodes, backupCodes...); err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrSetResponseHeader, err.Error())
+	}
+
+	recordAudit(ctx, uuid, auditActionVerify2FA, uuid)
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// Disable2FA turns off two-factor authentication of the auth token's user, or cancels a pending enrollment, and
+// deletes its secret and backup codes. An enabled one is only turned off with a current TOTP code or an unused
+// backup code in the x-hwsc-totp-code metadata, so an auth token alone cannot turn it off.
+func (s *Service) Disable2FA(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("Disable2FA")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.TwoFactorTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.TwoFactorTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	enrollment, err := getTwoFactor(ctx, uuid)
+	if err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrDisableTwoFactor, err.Error())
+		return nil, statusFromError(err)
+	}
+	if enrollment == nil {
+		logger.Error(consts.TwoFactorTag, consts.ErrTwoFactorNotEnabled.Error())
+		return nil, statusFromError(consts.ErrTwoFactorNotEnabled)
+	}
+	if enrollment.enabled {
+		code := getIncomingMetadata(ctx, metadataKeyTOTPCode)
+		if err := useTwoFactorCode(ctx, uuid, enrollment, code, time.Now()); err != nil {
+			logger.Error(consts.TwoFactorTag, consts.MsgErrDisableTwoFactor, err.Error())
+			return nil, statusFromError(err)
+		}
+	}
+
+	if err := deleteTwoFactor(ctx, uuid); err != nil {
+		logger.Error(consts.TwoFactorTag, consts.MsgErrDisableTwoFactor, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if enrollment.enabled {
+		recordAudit(ctx, uuid, auditActionDisable2FA, uuid)
+	}
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// CreateAPIKey issues an api key to another hwsc service, named by the x-hwsc-api-key-name-bin metadata and
+// allowed to call the rpc methods listed in x-hwsc-api-key-scopes. Services send the key in the authorization
+// metadata, and as the identification token of rpcs that take one, where an admin token would be required it
+// authorizes the methods of its scopes. Keys cannot be scoped for the api key rpcs.
+// On success, the key id is returned in the x-hwsc-api-key-id response header and the key, which is not
+// stored, once in x-hwsc-api-key.
+func (s *Service) CreateAPIKey(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("CreateAPIKey")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.APIKeyTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	name := getIncomingMetadata(ctx, metadataKeyAPIKeyName)
+	if err := validateAPIKeyName(name); err != nil {
+		logger.Error(consts.APIKeyTag, err.Error())
+		return nil, statusFromError(err)
+	}
+	scopes, err := parseAPIKeyScopes(getIncomingMetadataList(ctx, metadataKeyAPIKeyScopes))
+	if err != nil {
+		logger.Error(consts.APIKeyTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.APIKeyTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	token := req.GetIdentification().GetToken()
+	if err := authorizeAdmin(ctx, token, "CreateAPIKey", ""); err != nil {
+		logger.Error(consts.APIKeyTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	keyID, key, err := generateServiceAPIKey()
+	if err != nil {
+		logger.Error(consts.APIKeyTag, consts.MsgErrCreateAPIKey, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := insertServiceAPIKey(ctx, &serviceAPIKey{
+		keyID:     keyID,
+		name:      name,
+		keyHash:   hashToken(key),
+		scopes:    scopes,
+		createdBy: auth.ExtractUUID(token),
+		created:   time.Now(),
+	}); err != nil {
+		logger.Error(consts.APIKeyTag, consts.MsgErrCreateAPIKey, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := setResponseHeader(ctx, metadataKeyAPIKeyID, keyID); err != nil {
+		logger.Error(consts.APIKeyTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+	if err := setResponseHeader(ctx, metadataKeyAPIKey, key); err != nil {
+		logger.Error(consts.APIKeyTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	logger.Info("Created api key:", keyID, name, strings.Join(scopes, " "))
+
+	recordAudit(ctx, auth.ExtractUUID(token), auditActionCreateAPIKey, keyID)
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// RevokeAPIKey revokes the service api key with the x-hwsc-api-key-id metadata, it is refused from the next
+// request on. Revoked keys stay listed by ListAPIKeys.
+func (s *Service) RevokeAPIKey(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("RevokeAPIKey")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.APIKeyTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	keyID := getIncomingMetadata(ctx, metadataKeyAPIKeyID)
+	if err := validation.ValidateUserUUID(keyID); err != nil {
+		logger.Error(consts.APIKeyTag, consts.ErrInvalidAPIKeyID.Error())
+		return nil, statusFromError(consts.ErrInvalidAPIKeyID)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.APIKeyTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	token := req.GetIdentification().GetToken()
+	if err := authorizeAdmin(ctx, token, "RevokeAPIKey", keyID); err != nil {
+		logger.Error(consts.APIKeyTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	if err := revokeServiceAPIKey(ctx, keyID, time.Now()); err != nil {
+		logger.Error(consts.APIKeyTag, consts.MsgErrRevokeAPIKey, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	logger.Info("Revoked api key:", keyID)
+
+	recordAudit(ctx, auth.ExtractUUID(token), auditActionRevokeAPIKey, keyID)
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// ListAPIKeys returns every service api key, revoked keys included, in the order they were created.
+// On success, the x-hwsc-api-keys-bin response header is a CSV document with a header row and the key id,
+// name, space separated scopes, creator, creation and revocation time of each key. The keys are never returned.
+func (s *Service) ListAPIKeys(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ListAPIKeys")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.APIKeyTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.APIKeyTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := authorizeAdmin(ctx, req.GetIdentification().GetToken(), "ListAPIKeys", ""); err != nil {
+		logger.Error(consts.APIKeyTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	keys, err := listServiceAPIKeys(ctx)
+	if err != nil {
+		logger.Error(consts.APIKeyTag, consts.MsgErrListAPIKeys, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	document, err := writeServiceAPIKeysCSV(keys)
+	if err != nil {
+		logger.Error(consts.APIKeyTag, consts.MsgErrListAPIKeys, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := setResponseHeader(ctx, metadataKeyAPIKeys, document); err != nil {
+		logger.Error(consts.APIKeyTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// FavoriteDocument pins req.Duid for the auth token's user, who must own the document, or the document
+// must be public or shared with the user. Favoriting a document twice is not an error.
+// On success, the x-hwsc-favorites response header lists every favorite, see ListFavorites.
+// Returns NotFound if the document does not exist or is not shared with the user,
+// ResourceExhausted if the user already has 500 favorites.
+func (s *Service) FavoriteDocument(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("FavoriteDocument")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.FavoritesTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := validateDuid(req.GetDuid()); err != nil {
+		logger.Error(consts.FavoritesTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.FavoritesTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.FavoritesTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if err := insertFavoriteDocument(ctx, uuid, req.GetDuid(), time.Now()); err != nil {
+		logger.Error(consts.FavoritesTag, consts.MsgErrFavoriteDocument, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return favoritesResponse(ctx, uuid)
+}
+
+// ListFavorites returns the documents the auth token's user pinned, for the gateway's pinned documents view.
+// On success, the x-hwsc-favorites response header lists the duids in the order they were favorited,
+// favorites that are no longer shared with the user are left out.
+func (s *Service) ListFavorites(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ListFavorites")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.FavoritesTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.FavoritesTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.FavoritesTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	// read lock, b/c we are only retrieving/reading from the DB
+	unlock := uuidMapLocker.readLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	return favoritesResponse(ctx, uuid)
+}
+
+// UnfavoriteDocument unpins req.Duid for the auth token's user.
+// On success, the x-hwsc-favorites response header lists the remaining favorites, see ListFavorites.
+// Returns NotFound if the document is not a favorite of the user.
+func (s *Service) UnfavoriteDocument(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("UnfavoriteDocument")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.FavoritesTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := validateDuid(req.GetDuid()); err != nil {
+		logger.Error(consts.FavoritesTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.FavoritesTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.FavoritesTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if err := deleteFavoriteDocument(ctx, uuid, req.GetDuid()); err != nil {
+		logger.Error(consts.FavoritesTag, consts.MsgErrUnfavoriteDocument, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return favoritesResponse(ctx, uuid)
+}
+
+// RegisterDocument records req.Duid as a document owned by the auth token's user, the document service registers
+// every upload before storing it. The x-hwsc-public metadata makes the document public, it defaults to "false".
+// Registering a document of the user again is not an error. New documents are shared as the share policy of the
+// user's organization says, see SetSharePolicy.
+// On success, the x-hwsc-document-count and x-hwsc-document-quota response headers are set, see GetDocumentQuota.
+// Returns AlreadyExists if another user owns the document, ResourceExhausted if the user already owns
+// hosts_documents_quota documents.
+func (s *Service) RegisterDocument(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("RegisterDocument")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.DocumentsTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := validateDuid(req.GetDuid()); err != nil {
+		logger.Error(consts.DocumentsTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	isPublic, err := parseDocumentPublic(getIncomingMetadata(ctx, metadataKeyPublic))
+	if err != nil {
+		logger.Error(consts.DocumentsTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.DocumentsTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if err := insertDocument(ctx, uuid, req.GetDuid(), isPublic, documentQuota); err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrRegisterDocument, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return documentQuotaResponse(ctx, uuid)
+}
+
+// UnregisterDocument removes req.Duid, a document owned by the auth token's user, with its shares and favorites.
+// The document service unregisters documents it deleted, which no longer count against the quota.
+// On success, the x-hwsc-document-count and x-hwsc-document-quota response headers are set, see GetDocumentQuota.
+// Returns NotFound if the user does not own the document.
+func (s *Service) UnregisterDocument(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("UnregisterDocument")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.DocumentsTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := validateDuid(req.GetDuid()); err != nil {
+		logger.Error(consts.DocumentsTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.DocumentsTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if err := deleteDocument(ctx, uuid, req.GetDuid()); err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrUnregisterDocument, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return documentQuotaResponse(ctx, uuid)
+}
+
+// GetDocumentQuota returns how many documents the auth token's user owns, so the document service can reject
+// uploads of users over quota before transferring them.
+// On success, the x-hwsc-document-count response header is the number of documents the user owns and
+// x-hwsc-document-quota the number it may own, which is not set while hosts_documents_quota is unlimited.
+func (s *Service) GetDocumentQuota(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetDocumentQuota")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.DocumentsTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.DocumentsTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	// read lock, b/c we are only retrieving/reading from the DB
+	unlock := uuidMapLocker.readLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	return documentQuotaResponse(ctx, uuid)
+}
+
+// SetDocumentPublic makes req.Duid, a document owned by the auth token's user, public or private as set by the
+// x-hwsc-public metadata, "true" or "false". Every change is recorded in user_svc.document_visibility_changes
+// with the flag, in one transaction.
+// On success, the x-hwsc-public response header is the visibility of the document.
+// Returns NotFound if the user does not own the document.
+func (s *Service) SetDocumentPublic(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("SetDocumentPublic")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.DocumentsTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := validateDuid(req.GetDuid()); err != nil {
+		logger.Error(consts.DocumentsTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	// unlike RegisterDocument, the visibility has no default
+	value := getIncomingMetadata(ctx, metadataKeyPublic)
+	if value == "" {
+		logger.Error(consts.DocumentsTag, consts.ErrInvalidDocumentVisibility.Error())
+		return nil, statusFromError(consts.ErrInvalidDocumentVisibility)
+	}
+	isPublic, err := parseDocumentPublic(value)
+	if err != nil {
+		logger.Error(consts.DocumentsTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.DocumentsTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	unlock := uuidMapLocker.writeLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	if err := updateDocumentPublic(ctx, uuid, req.GetDuid(), isPublic, time.Now()); err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrSetDocumentPublic, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := setResponseHeader(ctx, metadataKeyPublic, strconv.FormatBool(isPublic)); err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// ListPublicDocuments returns the public documents the auth token's user owns.
+// At most x-hwsc-limit documents (defaults to 100, up to 500) after the x-hwsc-from-duid metadata value are
+// returned per call, continue from the last duid returned until fewer than the limit come back.
+// On success, the x-hwsc-public-documents response header lists the duids in order.
+func (s *Service) ListPublicDocuments(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ListPublicDocuments")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.DocumentsTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	fromDuid, err := parseFromDuid(getIncomingMetadata(ctx, metadataKeyFromDuid))
+	if err != nil {
+		logger.Error(consts.DocumentsTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	limit, err := getIncomingMetadataInt64(ctx, metadataKeyLimit, defaultDocumentsLimit)
+	if err != nil || limit <= 0 || limit > maxDocumentsLimit {
+		logger.Error(consts.DocumentsTag, consts.ErrInvalidReplayLimit.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidReplayLimit.Error())
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.DocumentsTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	// read lock, b/c we are only retrieving/reading from the DB
+	unlock := uuidMapLocker.readLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	duids, err := getPublicDocuments(ctx, uuid, fromDuid, int(limit))
+	if err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrListPublicDocuments, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := setResponseHeader(ctx, metadataKeyPublicDocuments, duids...); err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// ListUserDocuments returns every document the auth token's user owns, public or not.
+// Documents are paged like ListPublicDocuments pages them.
+// On success, the x-hwsc-user-documents response header lists the documents in duid order, as duid=true for
+// public documents and duid=false for the others.
+func (s *Service) ListUserDocuments(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ListUserDocuments")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.DocumentsTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	fromDuid, err := parseFromDuid(getIncomingMetadata(ctx, metadataKeyFromDuid))
+	if err != nil {
+		logger.Error(consts.DocumentsTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	limit, err := getIncomingMetadataInt64(ctx, metadataKeyLimit, defaultDocumentsLimit)
+	if err != nil || limit <= 0 || limit > maxDocumentsLimit {
+		logger.Error(consts.DocumentsTag, consts.ErrInvalidReplayLimit.Error())
+		return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidReplayLimit.Error())
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.DocumentsTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// auth token requires user level permission to use this service
+	uuid, err := authorizeUser(ctx, req.GetIdentification().GetToken())
+	if err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	// read lock, b/c we are only retrieving/reading from the DB
+	unlock := uuidMapLocker.readLock(uuid)
+	defer unlock()
+
+	// stop early if the client gave up while waiting on the lock
+	if err := ctx.Err(); err != nil {
+		return nil, statusFromError(err)
+	}
+
+	documents, err := getUserDocuments(ctx, uuid, fromDuid, int(limit))
+	if err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrListUserDocuments, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	values := make([]string, 0, len(documents))
+	for _, document := range documents {
+		values = append(values, document.duid+"="+strconv.FormatBool(document.isPublic))
+	}
+	if err := setResponseHeader(ctx, metadataKeyUserDocuments, values...); err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// SetSharePolicy sets how documents registered by members of the x-hwsc-organization-bin organization are shared
+// by default, as set by the x-hwsc-share-policy metadata: "organization" shares them read-only with every other
+// member, "none" shares them with nobody. Documents registered before the change keep their shares.
+// It requires an admin auth token, or the auth token of an admin of the organization.
+// On success, the x-hwsc-share-policy response header is the organization's policy.
+func (s *Service) SetSharePolicy(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("SetSharePolicy")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.DocumentsTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	organization := getIncomingMetadata(ctx, metadataKeyOrganization)
+	if err := validateOrganization(organization); err != nil {
+		logger.Error(consts.DocumentsTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	rule, err := parseSharePolicy(getIncomingMetadata(ctx, metadataKeySharePolicy))
+	if err != nil {
+		logger.Error(consts.DocumentsTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.DocumentsTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	// policies apply to every member of the organization, only its admins may set them
+	token := req.GetIdentification().GetToken()
+	if err := authorizeOrganizationAdmin(ctx, token, "SetSharePolicy", organization); err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	if err := upsertSharePolicy(ctx, organization, rule, auth.ExtractUUID(token), time.Now()); err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrSetSharePolicy, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := setResponseHeader(ctx, metadataKeySharePolicy, rule); err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// GetSharePolicy returns how documents registered by members of the x-hwsc-organization-bin organization are
+// shared by default, see SetSharePolicy. It requires an admin auth token, or the auth token of an admin of the
+// organization.
+// On success, the x-hwsc-share-policy response header is the organization's policy.
+func (s *Service) GetSharePolicy(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetSharePolicy")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.DocumentsTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	organization := getIncomingMetadata(ctx, metadataKeyOrganization)
+	if organization == "" {
+		logger.Error(consts.DocumentsTag, consts.ErrInvalidUserOrganization.Error())
+		return nil, statusFromError(consts.ErrInvalidUserOrganization)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.DocumentsTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	token := req.GetIdentification().GetToken()
+	if err := authorizeOrganizationAdmin(ctx, token, "GetSharePolicy", organization); err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	rule, err := getSharePolicy(ctx, organization)
+	if err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrGetSharePolicy, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := setResponseHeader(ctx, metadataKeySharePolicy, rule); err != nil {
+		logger.Error(consts.DocumentsTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
+
+// CreateOrganization makes the x-hwsc-organization-bin organization, which accounts may then name.
+// It requires an admin auth token.
+// On success, returns the organization like GetOrganization.
+func (s *Service) CreateOrganization(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("CreateOrganization")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.OrganizationTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	organization := getIncomingMetadata(ctx, metadataKeyOrganization)
+	if err := validateOrganization(organization); err != nil {
+		logger.Error(consts.OrganizationTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.OrganizationTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	token := req.GetIdentification().GetToken()
+	if err := authorizeAdmin(ctx, token, "CreateOrganization", organization); err != nil {
+		logger.Error(consts.OrganizationTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	if err := insertOrganization(ctx, organization, auth.ExtractUUID(token), time.Now()); err != nil {
+		logger.Error(consts.OrganizationTag, consts.MsgErrCreateOrganization, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	recordAudit(ctx, auth.ExtractUUID(token), auditActionCreateOrganization, organization)
+
+	return organizationResponse(ctx, organization)
+}
+
+// GetOrganization returns the x-hwsc-organization-bin organization.
+// It requires an admin auth token, or the auth token of an admin of the organization.
+// On success, returns when the organization was made in the x-hwsc-organization-created response header
+// (RFC 3339), the admin that made it in x-hwsc-organization-created-by unless an account did, its member count in
+// x-hwsc-organization-members and the uuids of its admins in x-hwsc-organization-admins.
+func (s *Service) GetOrganization(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetOrganization")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.OrganizationTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	organization := getIncomingMetadata(ctx, metadataKeyOrganization)
+	if organization == "" {
+		logger.Error(consts.OrganizationTag, consts.ErrInvalidUserOrganization.Error())
+		return nil, statusFromError(consts.ErrInvalidUserOrganization)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.OrganizationTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	token := req.GetIdentification().GetToken()
+	if err := authorizeOrganizationAdmin(ctx, token, "GetOrganization", organization); err != nil {
+		logger.Error(consts.OrganizationTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	return organizationResponse(ctx, organization)
+}
+
+// ListOrganizationUsers returns a page of the members of the x-hwsc-organization-bin organization, like ListUsers
+// returns them. It requires an admin auth token, or the auth token of an admin of the organization.
+// Members may be filtered and paged with the metadata of ListUsers.
+// On success, returns the members like ListUsers.
+func (s *Service) ListOrganizationUsers(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("ListOrganizationUsers")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.OrganizationTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	filter, err := parseUserListFilter(ctx)
+	if err != nil {
+		logger.Error(consts.OrganizationTag, err.Error())
+		return nil, statusFromError(err)
+	}
+	if filter.organization == "" {
+		logger.Error(consts.OrganizationTag, consts.ErrInvalidUserOrganization.Error())
+		return nil, statusFromError(consts.ErrInvalidUserOrganization)
+	}
+
+	afterUUID, limit, err := parseUserListPage(ctx)
+	if err != nil {
+		logger.Error(consts.OrganizationTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.OrganizationTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	token := req.GetIdentification().GetToken()
+	if err := authorizeOrganizationAdmin(ctx, token, "ListOrganizationUsers", filter.organization); err != nil {
+		logger.Error(consts.OrganizationTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	// admins may ask for an organization that does not exist
+	if _, err := getOrganizationRow(ctx, filter.organization); err != nil {
+		logger.Error(consts.OrganizationTag, consts.MsgErrListOrganizationUsers, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return usersPageResponse(ctx, consts.OrganizationTag, filter, afterUUID, limit)
+}
+
+// SetOrganizationAdmin makes the user with the uuid of the request user an admin of the x-hwsc-organization-bin
+// organization, or stops them being one if the x-hwsc-organization-admin metadata is "false". Only members are
+// made admins, and members that leave the organization stop being admins.
+// It requires an admin auth token, or the auth token of an admin of the organization.
+// On success, returns the organization like GetOrganization.
+func (s *Service) SetOrganizationAdmin(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("SetOrganizationAdmin")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.OrganizationTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	organization := getIncomingMetadata(ctx, metadataKeyOrganization)
+	if organization == "" {
+		logger.Error(consts.OrganizationTag, consts.ErrInvalidUserOrganization.Error())
+		return nil, statusFromError(consts.ErrInvalidUserOrganization)
+	}
+
+	isAdmin, err := parseOrganizationAdmin(getIncomingMetadata(ctx, metadataKeyOrganizationAdmin))
+	if err != nil {
+		logger.Error(consts.OrganizationTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.OrganizationTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	token := req.GetIdentification().GetToken()
+	if err := authorizeOrganizationAdmin(ctx, token, "SetOrganizationAdmin", organization); err != nil {
+		logger.Error(consts.OrganizationTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	uuid := req.GetUser().GetUuid()
+	if err := setOrganizationAdmin(ctx, organization, uuid, isAdmin, auth.ExtractUUID(token),
+		time.Now()); err != nil {
+		logger.Error(consts.OrganizationTag, consts.MsgErrSetOrganizationAdmin, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	recordAudit(ctx, auth.ExtractUUID(token), auditActionSetOrganizationAdmin, uuid)
+
+	return organizationResponse(ctx, organization)
+}
+
+// DeleteUsersByOrganization deletes every user of the x-hwsc-organization-bin organization in one transaction,
+// for customers offboarding. It requires an admin auth token. Users are deleted like DeleteUser deletes them,
+// soft deleted while hosts_retention_softdeletedusers is set, and their auth tokens are revoked.
+// If the x-hwsc-dry-run metadata is "true", nothing is deleted and the response lists the users that would be.
+// On success, the response has one user per deleted uuid and their number is in the x-hwsc-rows-affected
+// response header.
+func (s *Service) DeleteUsersByOrganization(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse,
+	error) {
+	logger.RequestService("DeleteUsersByOrganization")
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.OrganizationTag, consts.ErrServiceUnavailable.Error())
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	organization := getIncomingMetadata(ctx, metadataKeyOrganization)
+	if organization == "" {
+		logger.Error(consts.OrganizationTag, consts.ErrInvalidUserOrganization.Error())
+		return nil, statusFromError(consts.ErrInvalidUserOrganization)
+	}
+
+	dryRun, err := parseDryRun(getIncomingMetadata(ctx, metadataKeyDryRun))
+	if err != nil {
+		logger.Error(consts.OrganizationTag, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.OrganizationTag, consts.ErrDBConnectionError.Error())
+		return nil, statusFromError(err)
+	}
+
+	if err := authorizeAdmin(ctx, req.GetIdentification().GetToken(), "DeleteUsersByOrganization",
+		organization); err != nil {
+		logger.Error(consts.OrganizationTag, consts.MsgErrValidatingIdentity, err.Error())
+		return nil, err
+	}
+
+	uuids, err := deleteOrganizationUsers(ctx, organization, softDeleteUsers, dryRun, time.Now())
+	if err != nil {
+		logger.Error(consts.OrganizationTag, consts.MsgErrDeleteOrganizationUsers, organization, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	users := make([]*pblib.User, 0, len(uuids))
+	for _, uuid := range uuids {
+		users = append(users, &pblib.User{Uuid: uuid})
+		if dryRun {
+			continue
+		}
+
+		invalidateCachedUser(uuid)
+		authTokenCache.invalidateUUID(uuid)
+		authTokenVerifier.revoke(uuid)
+		if !softDeleteUsers {
+			publishUserEvent(eventTypeUserDeleted, &pblib.User{Uuid: uuid})
+		}
+	}
+
+	if dryRun {
+		logger.Info(consts.OrganizationTag, "Dry run would delete", strconv.Itoa(len(uuids)), "users of", organization)
+	} else {
+		recordAudit(ctx, auth.ExtractUUID(req.GetIdentification().GetToken()), auditActionDeleteOrgUsers, organization)
+		logger.Info(consts.OrganizationTag, "Deleted", strconv.Itoa(len(uuids)), "users of", organization)
+	}
+
+	// the header is informational, the users are deleted even if it cannot be set
+	if err := setResponseHeader(ctx, metadataKeyRowsAffected, strconv.Itoa(len(uuids))); err != nil {
+		logger.Error(consts.OrganizationTag, consts.MsgErrSetResponseHeader, err.Error())
+	}
+
+	return &pbsvc.UserResponse{
+		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message:        codes.OK.String(),
+		UserCollection: users,
+	}, nil
+}
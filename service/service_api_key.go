@@ -0,0 +1,292 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-lib/validation"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// serviceAPIKey is the api key of another hwsc service, a long-lived credential of machines rather than users.
+// Unlike the api keys users link with LinkAuthMethod, they are managed by admins and scoped to rpc methods.
+type serviceAPIKey struct {
+	keyID     string
+	name      string
+	keyHash   string
+	scopes    []string
+	createdBy string
+	created   time.Time
+	revoked   time.Time
+}
+
+// serviceCallerKey is the context key of the service api key verified by APIKeyInterceptor
+type serviceCallerKey struct{}
+
+const (
+	// serviceAPIKeyPrefix starts every service api key, followed by the key id, an underscore and the base64url
+	// of serviceAPIKeySecretByteSize random bytes. The prefix tells keys apart from auth tokens in logs and
+	// secret scanners.
+	serviceAPIKeyPrefix         = "hwsc_sk_"
+	serviceAPIKeySecretByteSize = 32
+
+	maxAPIKeyNameLength = 64
+)
+
+var (
+	// apiKeyManagementMethods cannot be granted to keys, or a key could create keys of any scope
+	apiKeyManagementMethods = map[string]bool{
+		"CreateAPIKey": true,
+		"RevokeAPIKey": true,
+		"ListAPIKeys":  true,
+	}
+
+	// scopableMethods are the rpc methods keys may be granted, every method served but apiKeyManagementMethods.
+	// It is filled by init, userMethodsV2 refers to the handlers parsing scopes.
+	scopableMethods = make(map[string]bool)
+
+	// serviceAPIKeysCSVHeader names the columns written by writeServiceAPIKeysCSV
+	serviceAPIKeysCSVHeader = []string{"key_id", "name", "scopes", "created_by", "created", "revoked"}
+)
+
+func init() {
+	for method := range userMethodsV2 {
+		if !apiKeyManagementMethods[method] {
+			scopableMethods[method] = true
+		}
+	}
+	for _, stream := range userStreamsV2 {
+		scopableMethods[stream.StreamName] = true
+	}
+}
+
+// generateServiceAPIKey returns the key id and key of a new service api key, the key is shown once to the admin.
+func generateServiceAPIKey() (string, string, error) {
+	keyID, err := generateUUID()
+	if err != nil {
+		return "", "", err
+	}
+
+	random := make([]byte, serviceAPIKeySecretByteSize)
+	if _, err := rand.Read(random); err != nil {
+		return "", "", err
+	}
+
+	return keyID, serviceAPIKeyPrefix + keyID + "_" + base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// isServiceAPIKey returns true if token has the prefix of service api keys, auth tokens never do.
+func isServiceAPIKey(token string) bool {
+	return strings.HasPrefix(token, serviceAPIKeyPrefix)
+}
+
+// parseServiceAPIKeyID returns the key id of key.
+// Returns ErrInvalidAPIKey if key is not shaped like a service api key.
+func parseServiceAPIKeyID(key string) (string, error) {
+	if !isServiceAPIKey(key) {
+		return "", consts.ErrInvalidAPIKey
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(key, serviceAPIKeyPrefix), "_", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", consts.ErrInvalidAPIKey
+	}
+	if err := validation.ValidateUserUUID(parts[0]); err != nil {
+		return "", consts.ErrInvalidAPIKey
+	}
+
+	return parts[0], nil
+}
+
+// validateAPIKeyName accepts printable names of at most maxAPIKeyNameLength characters, such as the name of the
+// service using the key.
+func validateAPIKeyName(name string) error {
+	if name == "" || !utf8.ValidString(name) || utf8.RuneCountInString(name) > maxAPIKeyNameLength {
+		return consts.ErrInvalidAPIKeyName
+	}
+
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return consts.ErrInvalidAPIKeyName
+		}
+	}
+
+	return nil
+}
+
+// parseAPIKeyScopes returns the sorted, distinct rpc methods of scopes.
+// Returns ErrInvalidAPIKeyScope if scopes is empty or names a method that is not served or cannot be granted.
+func parseAPIKeyScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, consts.ErrInvalidAPIKeyScope
+	}
+
+	distinct := make(map[string]bool)
+	for _, scope := range scopes {
+		if !isScopableMethod(scope) {
+			return nil, consts.ErrInvalidAPIKeyScope
+		}
+		distinct[scope] = true
+	}
+
+	parsed := make([]string, 0, len(distinct))
+	for scope := range distinct {
+		parsed = append(parsed, scope)
+	}
+	sort.Strings(parsed)
+
+	return parsed, nil
+}
+
+// isScopableMethod returns true if method is an rpc method a key may be granted.
+func isScopableMethod(method string) bool {
+	return scopableMethods[method]
+}
+
+// allows returns true if k is scoped for method.
+func (k *serviceAPIKey) allows(method string) bool {
+	for _, scope := range k.scopes {
+		if scope == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// APIKeyInterceptor verifies the service api key of a request and puts it in the context, keys are sent in the
+// authorization metadata or as the identification token of rpcs that take one. Keys are refused methods outside
+// their scopes, requests without a key are passed through.
+// Returns an Unauthenticated status error if the key is not valid or revoked, PermissionDenied if it is not
+// scoped for the method.
+func APIKeyInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	key := authorizationToken(ctx)
+	if !isServiceAPIKey(key) {
+		key = ""
+		if userReq, ok := req.(*pbsvc.UserRequest); ok && isServiceAPIKey(userReq.GetIdentification().GetToken()) {
+			key = userReq.GetIdentification().GetToken()
+		}
+	}
+	if key == "" {
+		return handler(ctx, req)
+	}
+
+	apiKey, err := verifyServiceAPIKey(ctx, key)
+	if err != nil {
+		logger.Error(consts.APIKeyTag, info.FullMethod, consts.MsgErrVerifyAPIKey, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	if !apiKey.allows(path.Base(info.FullMethod)) {
+		logger.Error(consts.APIKeyTag, info.FullMethod, consts.ErrAPIKeyScopeDenied.Error(), apiKey.keyID)
+		return nil, statusFromError(consts.ErrAPIKeyScopeDenied)
+	}
+
+	return handler(withServiceCaller(ctx, apiKey), req)
+}
+
+// verifyServiceAPIKey looks up key and checks it is not revoked.
+// Returns the key, ErrInvalidAPIKey if key is not an active service api key, or any db error.
+func verifyServiceAPIKey(ctx context.Context, key string) (*serviceAPIKey, error) {
+	keyID, err := parseServiceAPIKeyID(key)
+	if err != nil {
+		return nil, err
+	}
+
+	apiKey, err := getServiceAPIKey(ctx, keyID)
+	if err == consts.ErrAPIKeyNotFound {
+		return nil, consts.ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !apiKey.revoked.IsZero() || subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(apiKey.keyHash)) != 1 {
+		return nil, consts.ErrInvalidAPIKey
+	}
+
+	return apiKey, nil
+}
+
+// withServiceCaller returns a copy of ctx carrying the service api key k.
+func withServiceCaller(ctx context.Context, k *serviceAPIKey) context.Context {
+	return context.WithValue(ctx, serviceCallerKey{}, k)
+}
+
+// serviceCallerFromContext returns the service api key put in ctx by APIKeyInterceptor, if any.
+func serviceCallerFromContext(ctx context.Context) (*serviceAPIKey, bool) {
+	k, ok := ctx.Value(serviceCallerKey{}).(*serviceAPIKey)
+	return k, ok && k != nil
+}
+
+// authorizeServiceCaller authorizes an admin rpc called with the service api key token, which APIKeyInterceptor
+// verified and checked is scoped for the rpc. The call is recorded in user_svc.admin_actions with the key id as
+// actor, and is refused if it cannot be recorded, like recordAdminCall.
+// Returns an Unauthenticated status error if token is not the key verified for the request.
+func authorizeServiceCaller(ctx context.Context, token string, action string, subject string) error {
+	apiKey, ok := serviceCallerFromContext(ctx)
+	keyID, err := parseServiceAPIKeyID(token)
+	if !ok || err != nil || apiKey.keyID != keyID {
+		return statusFromError(consts.ErrInvalidAPIKey)
+	}
+
+	// a standby cannot record the call
+	if isStandby {
+		return standbyStatus(ctx)
+	}
+
+	if err := insertAdminAction(ctx, apiKey.keyID, action, subject, time.Now()); err != nil {
+		logger.Error(consts.AdminActivityTag, consts.MsgErrRecordAdminAction, err.Error())
+		return statusFromError(err)
+	}
+
+	return nil
+}
+
+// writeServiceAPIKeysCSV returns keys as a CSV document with a header row, scopes are space separated and
+// timestamps are RFC 3339 in UTC, revoked is empty for active keys.
+func writeServiceAPIKeysCSV(keys []*serviceAPIKey) (string, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+
+	if err := writer.Write(serviceAPIKeysCSVHeader); err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		revoked := ""
+		if !key.revoked.IsZero() {
+			revoked = key.revoked.UTC().Format(time.RFC3339)
+		}
+		record := []string{
+			key.keyID,
+			key.name,
+			strings.Join(key.scopes, " "),
+			key.createdBy,
+			key.created.UTC().Format(time.RFC3339),
+			revoked,
+		}
+		if err := writer.Write(record); err != nil {
+			return "", err
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
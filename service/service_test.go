@@ -2,11 +2,9 @@ package service
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/Pallinder/go-randomdata"
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
 	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
 	"github.com/hwsc-org/hwsc-lib/auth"
@@ -18,8 +16,14 @@ import (
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"io/ioutil"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -27,8 +31,25 @@ import (
 const (
 	psqlVersion = "alpine"
 	unitTestTag = "Unit Test -"
+
+	// unitTestStoreMemory set in hosts_test_store skips the postgres container, and the tests that need it
+	// or the smtp host, for a fast edit-test loop. Integration runs leave it unset.
+	unitTestStoreMemory = "memory"
+
+	// unitTestSeedFile is the test data inserted after the migrations, it is never embedded in the service
+	unitTestSeedFile = "test_fixtures/psql/dummy_user.sql"
 )
 
+// unitTestPostgres is false when hosts_test_store is "memory"
+var unitTestPostgres = !strings.EqualFold(os.Getenv("hosts_test_store"), unitTestStoreMemory)
+
+// unitTestRequireIntegration skips t when the suite runs without the postgres container.
+func unitTestRequireIntegration(t *testing.T) {
+	if !unitTestPostgres {
+		t.Skip("requires postgres and smtp, hosts_test_store is", unitTestStoreMemory)
+	}
+}
+
 // spin up docker containers for psql
 // run schema migrations
 // seed test data in db if necessary
@@ -36,7 +57,10 @@ const (
 func TestMain(m *testing.M) {
 	logger.Info(unitTestTag, "Initializing Unit Test Setup")
 
-	templateDirectory = "../tmpl"
+	if !unitTestPostgres {
+		logger.Info(unitTestTag, "Skipping postgres, hosts_test_store is", unitTestStoreMemory)
+		os.Exit(m.Run())
+	}
 
 	// uses a sensible default on windows (tcp/http) and linux/osx (socket)
 	pool, err := dockertest.NewPool("")
@@ -73,17 +97,8 @@ func TestMain(m *testing.M) {
 		logger.Fatal(unitTestTag, "Could not connect to docker:", err.Error())
 	}
 
-	// create a postgres driver for migration
-	driver, err := postgres.WithInstance(postgresDB, &postgres.Config{})
-	if err != nil {
-		logger.Fatal(unitTestTag, "Failed to start postgres Instance:", err.Error())
-	}
-
-	// create a migration instance
-	migration, err := migrate.NewWithDatabaseInstance(
-		"file://test_fixtures/psql",
-		"postgres", driver,
-	)
+	// create a migration instance of the migrations embedded in the service
+	migration, err := newMigration(postgresDB)
 	if err != nil {
 		logger.Fatal(unitTestTag, "Failed to create a migration instance:", err.Error())
 	}
@@ -92,7 +107,15 @@ func TestMain(m *testing.M) {
 	if err := migration.Up(); err != nil {
 		logger.Fatal(unitTestTag, "Failed to load active migration files:", err.Error())
 	}
-	// seed data if necessary
+
+	// seed the test data the migrations do not ship
+	seed, err := ioutil.ReadFile(unitTestSeedFile)
+	if err != nil {
+		logger.Fatal(unitTestTag, "Failed to read seed data:", err.Error())
+	}
+	if _, err := postgresDB.Exec(string(seed)); err != nil {
+		logger.Fatal(unitTestTag, "Failed to seed data:", err.Error())
+	}
 
 	// start the tests
 	code := m.Run()
@@ -107,6 +130,8 @@ func TestMain(m *testing.M) {
 }
 
 func TestGetStatus(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// test service state locker
 	cases := []struct {
 		request     *pbsvc.UserRequest
@@ -127,8 +152,20 @@ func TestGetStatus(t *testing.T) {
 	serviceStateLocker.currentServiceState = available
 	s := Service{}
 
+	// test planned secret rotation
+	assert.Nil(t, insertNewAuthSecret(context.TODO()))
+	active, err := getActiveSecretRow(context.TODO())
+	assert.Nil(t, err)
+	ctx, stream := unitTestServerContext()
+	_, err = s.GetStatus(ctx, &pbsvc.UserRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{nextSecretRotation(active).Format(time.RFC3339)},
+		stream.header.Get(metadataKeySecretRotation))
+	assert.Equal(t, []string{strconv.FormatInt(atomic.LoadInt64(&dbRetries), 10)},
+		stream.header.Get(metadataKeyDBRetries))
+
 	// test refreshDBConnection
-	err := postgresDB.Close()
+	err = postgresDB.Close()
 	assert.Nil(t, err)
 
 	response, _ := s.GetStatus(context.TODO(), &pbsvc.UserRequest{})
@@ -140,6 +177,8 @@ func TestGetStatus(t *testing.T) {
 }
 
 func TestCreateUser(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// valid
 	testUser1 := unitTestUserGenerator("CreateUser-One")
 
@@ -195,23 +234,20 @@ func TestCreateUser(t *testing.T) {
 		isExpErr bool
 		expMsg   string
 	}{
-		{nil, true, "rpc error: code = InvalidArgument desc = nil request User"},
-		{&pbsvc.UserRequest{}, true, "rpc error: code = InvalidArgument " +
-			"desc = nil request User"},
 		{&pbsvc.UserRequest{User: testUser1}, false, codes.OK.String()},
 		{&pbsvc.UserRequest{User: testUser2}, false, codes.OK.String()},
 		{&pbsvc.UserRequest{User: testUser3}, true, "rpc error: code = " +
-			"Internal desc = pq: duplicate key value violates unique constraint \"accounts_email_key\""},
+			"AlreadyExists desc = email already exists"},
 		{&pbsvc.UserRequest{User: testUser4}, true, "rpc error: code = " +
-			"Internal desc = invalid User first name"},
+			"InvalidArgument desc = invalid User first name"},
 		{&pbsvc.UserRequest{User: testUser5}, true, "rpc error: code = " +
-			"Internal desc = invalid User password"},
+			"InvalidArgument desc = invalid User password"},
 		{&pbsvc.UserRequest{User: testUser7}, true, "rpc error: code = " +
-			"Internal desc = invalid User email"},
+			"InvalidArgument desc = invalid User email"},
 		{&pbsvc.UserRequest{User: testUser8}, true, "rpc error: code = " +
-			"Internal desc = invalid User organization"},
+			"InvalidArgument desc = invalid User organization"},
 		{&pbsvc.UserRequest{User: testUser9}, true, "rpc error: code = " +
-			"Internal desc = invalid User last name"},
+			"InvalidArgument desc = invalid User last name"},
 	}
 
 	for _, c := range cases {
@@ -225,14 +261,72 @@ func TestCreateUser(t *testing.T) {
 			assert.Equal(t, c.request.GetUser().GetEmail(), response.GetUser().GetEmail())
 			assert.Equal(t, false, response.GetUser().GetIsVerified())
 
-			retrievedUser, err := getUserRow(response.GetUser().GetUuid())
+			retrievedUser, err := getUserRow(context.TODO(), response.GetUser().GetUuid())
 			assert.Nil(t, err)
 			assert.Equal(t, auth.PermissionStringMap[auth.NoPermission], retrievedUser.GetPermissionLevel())
 		}
 	}
+
+	s := Service{}
+
+	desc := "test invalid user view"
+	ctx, _ := unitTestServerContext(metadataKeyUserView, "everything")
+	response, err := s.CreateUser(ctx, &pbsvc.UserRequest{User: unitTestUserGenerator("CreateUser-Three")})
+	assert.EqualError(t, err, "rpc error: code = InvalidArgument desc = invalid user view", desc)
+	assert.Nil(t, response, desc)
+
+	desc = "test full user view"
+	ctx, _ = unitTestServerContext(metadataKeyUserView, "Full")
+	response, err = s.CreateUser(ctx, &pbsvc.UserRequest{User: unitTestUserGenerator("CreateUser-Four")})
+	assert.Nil(t, err, desc)
+	retrievedUser, err := getUserRow(context.TODO(), response.GetUser().GetUuid())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "", response.GetUser().GetPassword(), desc)
+	assert.NotZero(t, response.GetUser().GetCreatedTimestamp(), desc)
+	assert.Equal(t, retrievedUser.GetCreatedTimestamp(), response.GetUser().GetCreatedTimestamp(), desc)
+	assert.Equal(t, retrievedUser.GetEmail(), response.GetUser().GetEmail(), desc)
+	assert.Equal(t, auth.PermissionStringMap[auth.NoPermission], response.GetUser().GetPermissionLevel(), desc)
+}
+
+func TestCreateUserMarketingOptIn(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	s := Service{}
+	cases := []struct {
+		desc     string
+		lastName string
+		value    string
+		expOptIn bool
+		isExpErr bool
+	}{
+		{"test opted out by default", "CreateUser-Marketing-Default", "", false, false},
+		{"test opted in", "CreateUser-Marketing-In", "true", true, false},
+		{"test opted out", "CreateUser-Marketing-Out", "false", false, false},
+		{"test invalid value", "CreateUser-Marketing-Invalid", "maybe", false, true},
+	}
+
+	for _, c := range cases {
+		ctx := context.TODO()
+		if c.value != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(metadataKeyMarketing, c.value))
+		}
+		response, err := s.CreateUser(ctx, &pbsvc.UserRequest{User: unitTestUserGenerator(c.lastName)})
+		if c.isExpErr {
+			assert.EqualError(t, err, status.Error(codes.InvalidArgument,
+				consts.ErrInvalidMarketingOptIn.Error()).Error(), c.desc)
+			continue
+		}
+		assert.Nil(t, err, c.desc)
+
+		optIn, _, err := getMarketingPreference(context.TODO(), response.GetUser().GetUuid())
+		assert.Nil(t, err, c.desc)
+		assert.Equal(t, c.expOptIn, optIn, c.desc)
+	}
 }
 
 func TestDeleteUser(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// insert valid user
 	response, err := unitTestInsertUser("DeleteUser-One")
 	assert.Nil(t, err)
@@ -272,9 +366,6 @@ func TestDeleteUser(t *testing.T) {
 			"rpc error: code = InvalidArgument desc = invalid uuid"},
 		{&pbsvc.UserRequest{User: test4}, true,
 			"rpc error: code = InvalidArgument desc = invalid uuid"},
-		{&pbsvc.UserRequest{User: nil}, true,
-			"rpc error: code = InvalidArgument desc = nil request User"},
-		{nil, true, "rpc error: code = InvalidArgument desc = nil request User"},
 	}
 
 	for _, c := range cases {
@@ -288,9 +379,43 @@ func TestDeleteUser(t *testing.T) {
 			assert.Nil(t, err)
 		}
 	}
+
+	s := Service{}
+	response, err = unitTestInsertUser("DeleteUser-Two")
+	assert.Nil(t, err)
+	existingRequest := &pbsvc.UserRequest{User: &pblib.User{Uuid: response.GetUser().GetUuid()}}
+
+	desc := "test invalid missing user mode"
+	ctx, _ := unitTestServerContext(metadataKeyMissingUser, "ignore")
+	response, err = s.DeleteUser(ctx, existingRequest)
+	assert.EqualError(t, err, "rpc error: code = InvalidArgument desc = invalid missing user mode", desc)
+	assert.Nil(t, response, desc)
+
+	desc = "test deleted rows are reported"
+	ctx, stream := unitTestServerContext(metadataKeyMissingUser, missingUserNotFound)
+	response, err = s.DeleteUser(ctx, existingRequest)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), response.GetMessage(), desc)
+	assert.Equal(t, []string{"1"}, stream.header.Get(metadataKeyRowsAffected), desc)
+
+	desc = "test missing user returns NotFound"
+	ctx, stream = unitTestServerContext(metadataKeyMissingUser, "NotFound")
+	response, err = s.DeleteUser(ctx, existingRequest)
+	assert.EqualError(t, err, consts.ErrStatusUUIDNotFound.Error(), desc)
+	assert.Nil(t, response, desc)
+	assert.Empty(t, stream.header.Get(metadataKeyRowsAffected), desc)
+
+	desc = "test missing user is OK by default"
+	ctx, stream = unitTestServerContext(metadataKeyMissingUser, missingUserOK)
+	response, err = s.DeleteUser(ctx, existingRequest)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), response.GetMessage(), desc)
+	assert.Equal(t, []string{"0"}, stream.header.Get(metadataKeyRowsAffected), desc)
 }
 
 func TestGetUser(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// insert valid user
 	response, err := unitTestInsertUser("GetUser-One")
 	assert.Nil(t, err)
@@ -318,10 +443,7 @@ func TestGetUser(t *testing.T) {
 	}{
 		{&pbsvc.UserRequest{User: test1}, false, ""},
 		{&pbsvc.UserRequest{User: test2}, true,
-			"rpc error: code = Internal desc = user is not found in database"},
-		{&pbsvc.UserRequest{User: nil}, true,
-			"rpc error: code = InvalidArgument desc = nil request User"},
-		{nil, true, "rpc error: code = InvalidArgument desc = nil request User"},
+			"rpc error: code = NotFound desc = user is not found in database"},
 	}
 
 	for _, c := range cases {
@@ -339,6 +461,8 @@ func TestGetUser(t *testing.T) {
 }
 
 func TestUpdateUser(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// insert valid user 1
 	response1, err := unitTestInsertUser("UpdateUser-One")
 	assert.Nil(t, err)
@@ -349,7 +473,7 @@ func TestUpdateUser(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, codes.OK.String(), response2.GetMessage())
 
-	err = deleteEmailTokenRow(response2.GetUser().GetUuid())
+	err = deleteEmailTokenRow(context.TODO(), response2.GetUser().GetUuid())
 	assert.Nil(t, err)
 
 	nonExistingUUID, err := generateUUID()
@@ -427,23 +551,20 @@ func TestUpdateUser(t *testing.T) {
 	}{
 		{&pbsvc.UserRequest{User: updateUser}, false, ""},
 		{&pbsvc.UserRequest{User: updateUser2}, false, ""},
-		{nil, true, "rpc error: code = InvalidArgument desc = nil request User"},
 		{&pbsvc.UserRequest{User: updateUser3}, true,
 			"rpc error: code = InvalidArgument desc = invalid uuid"},
 		{&pbsvc.UserRequest{User: updateUser4}, true,
-			"rpc error: code = Internal desc = user is not found in database"},
+			"rpc error: code = NotFound desc = user is not found in database"},
 		{&pbsvc.UserRequest{User: updateUser5}, true,
-			"rpc error: code = Internal desc = invalid User email"},
+			"rpc error: code = InvalidArgument desc = invalid User email"},
 		{&pbsvc.UserRequest{User: updateUser6}, true,
-			"rpc error: code = Internal desc = invalid User first name"},
+			"rpc error: code = InvalidArgument desc = invalid User first name"},
 		{&pbsvc.UserRequest{User: updateUser7}, true,
-			"rpc error: code = Internal desc = invalid User last name"},
-		{&pbsvc.UserRequest{User: nil}, true,
-			"rpc error: code = InvalidArgument desc = nil request User"},
+			"rpc error: code = InvalidArgument desc = invalid User last name"},
 		{&pbsvc.UserRequest{User: updateUser8}, true,
-			"rpc error: code = Internal desc = email already exists"},
+			"rpc error: code = AlreadyExists desc = email already exists"},
 		{&pbsvc.UserRequest{User: updateUser9}, true,
-			"rpc error: code = Internal desc = email already exists"},
+			"rpc error: code = AlreadyExists desc = email already exists"},
 	}
 
 	for _, c := range cases {
@@ -458,9 +579,31 @@ func TestUpdateUser(t *testing.T) {
 			assert.Equal(t, codes.OK.String(), response.GetMessage())
 		}
 	}
+
+	s := Service{}
+	clearRequest := &pbsvc.UserRequest{User: &pblib.User{Uuid: response1.GetUser().GetUuid()}}
+
+	desc := "test unknown field to clear"
+	ctx, _ := unitTestServerContext(metadataKeyClearFields, "organization,email")
+	response, err := s.UpdateUser(ctx, clearRequest)
+	assert.EqualError(t, err, "rpc error: code = InvalidArgument desc = field cannot be cleared", desc)
+	assert.Nil(t, response, desc)
+
+	desc = "test clear organization"
+	ctx, _ = unitTestServerContext(metadataKeyClearFields, "Organization")
+	response, err = s.UpdateUser(ctx, clearRequest)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "", response.GetUser().GetOrganization(), desc)
+
+	retrievedUser, err := getUserRow(context.TODO(), response1.GetUser().GetUuid())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "", retrievedUser.GetOrganization(), desc)
+	assert.Equal(t, updateUser.GetLastName(), retrievedUser.GetLastName(), desc)
 }
 
 func TestAuthenticateUser(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	validPassword := "AuthenticateUser-One"
 
 	validResponse, err := unitTestInsertUser(validPassword)
@@ -518,9 +661,6 @@ func TestAuthenticateUser(t *testing.T) {
 		expMsg   string
 	}{
 		{&pbsvc.UserRequest{User: validUser}, true, "rpc error: code = Unauthenticated desc = error in generating auth token"},
-		{nil, true, "rpc error: code = InvalidArgument desc = nil request User"},
-		{&pbsvc.UserRequest{User: nil}, true,
-			"rpc error: code = InvalidArgument desc = nil request User"},
 		{&pbsvc.UserRequest{User: invalidUser2}, true,
 			"rpc error: code = Unauthenticated desc = email does not exist in db"},
 		{&pbsvc.UserRequest{User: invalidUser3}, true,
@@ -563,9 +703,30 @@ func TestAuthenticateUser(t *testing.T) {
 	response, err := s.AuthenticateUser(context.TODO(), dummyReq)
 	assert.Nil(t, err, caseDummyUser)
 	assert.Equal(t, conf.DummyAccount.Email, response.User.Email, caseDummyUser)
+
+	requireVerifiedEmail = true
+	defer func() { requireVerifiedEmail = false }()
+
+	desc := "test verified user when verified emails are required"
+	response, err = s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{User: validUser})
+	assert.Nil(t, err, desc)
+	assert.NotNil(t, response.GetIdentification(), desc)
+
+	desc = "test unverified user is refused when verified emails are required"
+	unverifiedPassword := "AuthenticateUser-Two"
+	unverifiedResponse, err := unitTestInsertUser(unverifiedPassword)
+	assert.Nil(t, err, desc)
+	response, err = s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{
+		Email:    unverifiedResponse.GetUser().GetEmail(),
+		Password: unverifiedPassword,
+	}})
+	assert.EqualError(t, err, "rpc error: code = FailedPrecondition desc = "+consts.ErrEmailNotVerified.Error(), desc)
+	assert.Nil(t, response, desc)
 }
 
 func TestMakeAuthNewSecret(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// no need to perform a check in the db here using a DAO,
 	// b/c this func is meant to be called by a client
 
@@ -573,7 +734,7 @@ func TestMakeAuthNewSecret(t *testing.T) {
 	assert.Nil(t, err)
 
 	// test for no active secret
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := getActiveSecretRow(context.TODO())
 	assert.EqualError(t, err, consts.ErrNoActiveSecretKeyFound.Error())
 	assert.Nil(t, retrievedSecret)
 
@@ -585,7 +746,7 @@ func TestMakeAuthNewSecret(t *testing.T) {
 	assert.Equal(t, codes.OK.String(), response.Message)
 
 	// test for the active secret
-	retrievedSecret, err = getActiveSecretRow()
+	retrievedSecret, err = getActiveSecretRow(context.TODO())
 	assert.Nil(t, err)
 	assert.NotNil(t, retrievedSecret)
 
@@ -595,7 +756,7 @@ func TestMakeAuthNewSecret(t *testing.T) {
 	assert.Equal(t, codes.OK.String(), response.Message)
 
 	// retrieve the newest secret
-	retrievedNewestSecret, err := getActiveSecretRow()
+	retrievedNewestSecret, err := getActiveSecretRow(context.TODO())
 	assert.Nil(t, err)
 	assert.NotNil(t, retrievedNewestSecret)
 
@@ -604,6 +765,8 @@ func TestMakeAuthNewSecret(t *testing.T) {
 }
 
 func TestGetAuthSecret(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	err := unitTestDeleteAuthSecretTable()
 	assert.Nil(t, err)
 
@@ -616,12 +779,12 @@ func TestGetAuthSecret(t *testing.T) {
 	assert.NotEmpty(t, response.GetIdentification().GetSecret())
 
 	// test it got inserted by retrieving the secret key
-	secretKey, err := getLatestSecret(2)
+	secretKey, err := getLatestSecret(context.TODO(), 2)
 	assert.Nil(t, err)
 	assert.NotEmpty(t, secretKey)
 
 	// retrieve the secret from active_secret table
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := getActiveSecretRow(context.TODO())
 	assert.Nil(t, err)
 	assert.Equal(t, secretKey, retrievedSecret.GetKey())
 
@@ -633,6 +796,8 @@ func TestGetAuthSecret(t *testing.T) {
 }
 
 func TestGetNewAuthToken(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// test registration -> authenticate -> new auth token -> authenticate
 	// register
 	validCase := "test registration -> authenticate -> new auth token -> authenticate"
@@ -702,12 +867,6 @@ func TestGetNewAuthToken(t *testing.T) {
 		req    *pbsvc.UserRequest
 		expMsg string
 	}{
-		{"test nil request object", nil,
-			"rpc error: code = InvalidArgument desc = nil request User",
-		},
-		{"test nil identity object", &pbsvc.UserRequest{Identification: nil},
-			"rpc error: code = DeadlineExceeded desc = nil request identification",
-		},
 		{"test non-existent token", &pbsvc.UserRequest{Identification: nonExistingToken},
 			"rpc error: code = DeadlineExceeded desc = no matching auth token were found with given token",
 		},
@@ -722,7 +881,116 @@ func TestGetNewAuthToken(t *testing.T) {
 
 }
 
+func TestRefreshAuthToken(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	userResp, err := unitTestInsertUser("TestRefreshAuthToken")
+	assert.Nil(t, err)
+	validUser := userResp.GetUser()
+
+	s := Service{}
+	_, err = s.VerifyEmailToken(context.TODO(), &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: userResp.GetIdentification().GetToken()},
+	})
+	assert.Nil(t, err)
+
+	desc := "test sign in returns a refresh token"
+	ctx, stream := unitTestServerContext()
+	_, err = s.AuthenticateUser(ctx, &pbsvc.UserRequest{
+		User: &pblib.User{Email: validUser.GetEmail(), Password: validUser.GetLastName()},
+	})
+	assert.Nil(t, err, desc)
+	refreshToken := stream.header.Get(metadataKeyRefreshToken)
+	assert.Len(t, refreshToken, 1, desc)
+
+	desc = "test refresh returns a new auth token and refresh token"
+	ctx, stream = unitTestServerContext(metadataKeyRefreshToken, refreshToken[0])
+	resp, err := s.RefreshAuthToken(ctx, &pbsvc.UserRequest{})
+	assert.Nil(t, err, desc)
+	assert.NotEmpty(t, resp.GetIdentification().GetToken(), desc)
+	nextRefreshToken := stream.header.Get(metadataKeyRefreshToken)
+	assert.Len(t, nextRefreshToken, 1, desc)
+	assert.NotEqual(t, refreshToken, nextRefreshToken, desc)
+
+	_, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: resp.GetIdentification()})
+	assert.Nil(t, err, desc)
+
+	desc = "test refresh tokens are used once"
+	ctx, _ = unitTestServerContext(metadataKeyRefreshToken, refreshToken[0])
+	_, err = s.RefreshAuthToken(ctx, &pbsvc.UserRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+
+	desc = "test a new password revokes refresh tokens"
+	_, err = s.UpdateUser(context.TODO(), &pbsvc.UserRequest{
+		User: &pblib.User{Uuid: validUser.GetUuid(), Password: "TestRefreshAuthToken-New"},
+	})
+	assert.Nil(t, err, desc)
+	ctx, _ = unitTestServerContext(metadataKeyRefreshToken, nextRefreshToken[0])
+	_, err = s.RefreshAuthToken(ctx, &pbsvc.UserRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+
+	desc = "test missing refresh token"
+	ctx, _ = unitTestServerContext()
+	_, err = s.RefreshAuthToken(ctx, &pbsvc.UserRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), desc)
+}
+
+func TestLogoutUser(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	userResp, err := unitTestInsertUser("TestLogoutUser")
+	assert.Nil(t, err)
+	validUser := userResp.GetUser()
+
+	s := Service{}
+	_, err = s.VerifyEmailToken(context.TODO(), &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: userResp.GetIdentification().GetToken()},
+	})
+	assert.Nil(t, err)
+
+	ctx, stream := unitTestServerContext()
+	authResp, err := s.AuthenticateUser(ctx, &pbsvc.UserRequest{
+		User: &pblib.User{Email: validUser.GetEmail(), Password: validUser.GetLastName()},
+	})
+	assert.Nil(t, err)
+	refreshToken := stream.header.Get(metadataKeyRefreshToken)
+	assert.Len(t, refreshToken, 1)
+	token := authResp.GetIdentification().GetToken()
+
+	desc := "test logout revokes the auth token and the refresh token"
+	_, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: authResp.GetIdentification()})
+	assert.Nil(t, err, desc)
+	ctx, _ = unitTestServerContext(metadataKeyRefreshToken, refreshToken[0])
+	resp, err := s.LogoutUser(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: token}})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), resp.GetMessage(), desc)
+	_, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: authResp.GetIdentification()})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+	ctx, _ = unitTestServerContext(metadataKeyRefreshToken, refreshToken[0])
+	_, err = s.RefreshAuthToken(ctx, &pbsvc.UserRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+
+	desc = "test revoked token is refused by an instance verifying without the db"
+	verifier := &statelessVerifier{refreshInterval: time.Minute}
+	assert.Nil(t, verifier.verify(context.TODO(), token), desc)
+
+	desc = "test logging out twice succeeds"
+	_, err = s.LogoutUser(context.TODO(), &pbsvc.UserRequest{Identification: &pblib.Identification{Token: token}})
+	assert.Nil(t, err, desc)
+
+	desc = "test signing in again issues a new auth token"
+	authResp, err = s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{
+		User: &pblib.User{Email: validUser.GetEmail(), Password: validUser.GetLastName()},
+	})
+	assert.Nil(t, err, desc)
+	assert.NotEqual(t, token, authResp.GetIdentification().GetToken(), desc)
+	_, err = s.VerifyAuthToken(context.TODO(), &pbsvc.UserRequest{Identification: authResp.GetIdentification()})
+	assert.Nil(t, err, desc)
+}
+
 func TestVerifyAuthToken(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	nonExistingToken := &pblib.Identification{
 		Token: "TestVerifyAuthToken-DoesNotExist",
 	}
@@ -732,12 +1000,6 @@ func TestVerifyAuthToken(t *testing.T) {
 		req    *pbsvc.UserRequest
 		expMsg string
 	}{
-		{"test nil request object", nil,
-			"rpc error: code = InvalidArgument desc = nil request User",
-		},
-		{"test nil identity object", &pbsvc.UserRequest{Identification: nil},
-			"rpc error: code = InvalidArgument desc = nil request identification",
-		},
 		{"test non-existent token", &pbsvc.UserRequest{Identification: nonExistingToken},
 			"rpc error: code = Unauthenticated desc = no matching auth token were found with given token",
 		},
@@ -771,7 +1033,199 @@ func TestVerifyAuthToken(t *testing.T) {
 	assert.Equal(t, newSecret.GetExpirationTimestamp(), responseSecret.GetExpirationTimestamp(), desc)
 }
 
+func TestResendVerificationEmail(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	cooldown := verificationResendCooldown
+	defer func() { verificationResendCooldown = cooldown }()
+	verificationResendCooldown = time.Hour
+
+	response, err := unitTestInsertUser("ResendVerificationEmail")
+	assert.Nil(t, err)
+	user := response.GetUser()
+	s := Service{}
+
+	desc := "test unknown email"
+	resp, err := s.ResendVerificationEmail(context.TODO(), &pbsvc.UserRequest{
+		User: &pblib.User{Email: "nonexistent-resend@hwsc.com"},
+	})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), resp.GetMessage(), desc)
+
+	desc = "test email sent less than the cooldown ago"
+	ctx, stream := unitTestServerContext()
+	_, err = s.ResendVerificationEmail(ctx, &pbsvc.UserRequest{User: &pblib.User{Email: user.GetEmail()}})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), desc)
+	if assert.Len(t, stream.header.Get(metadataKeyRetryAfter), 1, desc) {
+		wait, err := strconv.Atoi(stream.header.Get(metadataKeyRetryAfter)[0])
+		assert.Nil(t, err, desc)
+		assert.True(t, wait > 0 && wait <= 3600, desc)
+	}
+	_, err = getEmailTokenRow(context.TODO(), response.GetIdentification().GetToken())
+	assert.Nil(t, err, desc)
+
+	desc = "test resend replaces the previous token"
+	verificationResendCooldown = 0
+	resp, err = s.ResendVerificationEmail(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Email: user.GetEmail()}})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), resp.GetMessage(), desc)
+	_, err = getEmailTokenRow(context.TODO(), response.GetIdentification().GetToken())
+	assert.NotNil(t, err, desc)
+}
+
+func TestVerifyUser(t *testing.T) {
+	unitTestRequireIntegration(t)
+	defer func() { serviceStateLocker.currentServiceState = available }()
+
+	s := Service{}
+	user, err := unitTestInsertUser("VerifyUser")
+	assert.Nil(t, err)
+	uuid := user.GetUser().GetUuid()
+
+	newSecret, userToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err)
+	header := &auth.Header{Alg: auth.Hs512, TokenTyp: auth.Jwt}
+	body := &auth.Body{
+		UUID:                auth.ExtractUUID(userToken),
+		Permission:          auth.Admin,
+		ExpirationTimestamp: validNoUUIDAuthTokenBody.ExpirationTimestamp,
+	}
+	adminToken, err := auth.NewToken(header, body, newSecret)
+	assert.Nil(t, err)
+	assert.Nil(t, insertAuthToken(context.TODO(), adminToken, header, body, newSecret))
+
+	desc := "test unavailable service"
+	serviceStateLocker.currentServiceState = unavailable
+	_, err = s.VerifyUser(context.TODO(), &pbsvc.UserRequest{User: &pblib.User{Uuid: uuid}})
+	assert.Equal(t, codes.Unavailable, status.Code(err), desc)
+	serviceStateLocker.currentServiceState = available
+
+	desc = "test invalid uuid"
+	_, err = s.VerifyUser(context.TODO(), &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: adminToken},
+		User:           &pblib.User{Uuid: "1234"},
+	})
+	assert.Equal(t, consts.ErrStatusUUIDInvalid, err, desc)
+
+	desc = "test user token cannot verify users"
+	_, err = s.VerifyUser(context.TODO(), &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: userToken},
+		User:           &pblib.User{Uuid: uuid},
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+
+	desc = "test admin verifies user"
+	resp, err := s.VerifyUser(context.TODO(), &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: adminToken},
+		User:           &pblib.User{Uuid: uuid},
+	})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuid, resp.GetUser().GetUuid(), desc)
+	retrievedUser, err := getUserRow(context.TODO(), uuid)
+	assert.Nil(t, err, desc)
+	assert.True(t, retrievedUser.GetIsVerified(), desc)
+
+	desc = "test verification is audited"
+	entries, err := getAuditEntries(context.TODO(), 0, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), 1000)
+	assert.Nil(t, err, desc)
+	audited := false
+	for _, entry := range entries {
+		audited = audited || (entry.action == auditActionVerifyUser && entry.target == uuid)
+	}
+	assert.True(t, audited, desc)
+
+	desc = "test nonexistent user"
+	nonexistent, err := generateUUID()
+	assert.Nil(t, err, desc)
+	_, err = s.VerifyUser(context.TODO(), &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: adminToken},
+		User:           &pblib.User{Uuid: nonexistent},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err), desc)
+}
+
+func TestForgetUser(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	s := Service{}
+	user, err := unitTestInsertUser("ForgetUser")
+	assert.Nil(t, err)
+	uuid := user.GetUser().GetUuid()
+	email := user.GetUser().GetEmail()
+	var referralCode string
+	assert.Nil(t, postgresDB.QueryRow(`SELECT referral_code FROM user_svc.accounts WHERE uuid = $1`, uuid).
+		Scan(&referralCode))
+
+	newSecret, userToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err)
+	header := &auth.Header{Alg: auth.Hs512, TokenTyp: auth.Jwt}
+	body := &auth.Body{
+		UUID:                auth.ExtractUUID(userToken),
+		Permission:          auth.Admin,
+		ExpirationTimestamp: validNoUUIDAuthTokenBody.ExpirationTimestamp,
+	}
+	adminToken, err := auth.NewToken(header, body, newSecret)
+	assert.Nil(t, err)
+	assert.Nil(t, insertAuthToken(context.TODO(), adminToken, header, body, newSecret))
+
+	desc := "test user token cannot forget users"
+	_, err = s.ForgetUser(context.TODO(), &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: userToken},
+		User:           &pblib.User{Uuid: uuid},
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+
+	desc = "test admin forgets user"
+	ctx, stream := unitTestServerContext()
+	resp, err := s.ForgetUser(ctx, &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: adminToken},
+		User:           &pblib.User{Uuid: uuid},
+	})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuid, resp.GetUser().GetUuid(), desc)
+	hashes := stream.header.Get(metadataKeyErasureHash)
+	assert.Len(t, hashes, 1, desc)
+
+	desc = "test forgotten user is anonymized and deleted"
+	_, err = getUserRow(context.TODO(), uuid)
+	assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+	var firstName, storedEmail, password, storedCode string
+	var forgotten sql.NullTime
+	assert.Nil(t, postgresDB.QueryRow(`SELECT first_name, email, password, referral_code, forgotten_timestamp
+		FROM user_svc.accounts WHERE uuid = $1`, uuid).
+		Scan(&firstName, &storedEmail, &password, &storedCode, &forgotten), desc)
+	assert.Equal(t, forgottenFirstName, firstName, desc)
+	assert.Equal(t, uuid+forgottenEmailDomain, storedEmail, desc)
+	assert.Empty(t, password, desc)
+	assert.NotEqual(t, referralCode, storedCode, desc)
+	assert.True(t, forgotten.Valid, desc)
+	_, err = getUserRowByEmail(context.TODO(), email)
+	assert.EqualError(t, err, consts.ErrEmailDoesNotExist.Error(), desc)
+
+	desc = "test erasure is registered and chained"
+	var actor, previous, hash string
+	var created time.Time
+	assert.Nil(t, postgresDB.QueryRow(`SELECT actor, previous_hash, hash, created_timestamp FROM user_svc.erasures
+		WHERE uuid = $1`, uuid).Scan(&actor, &previous, &hash, &created), desc)
+	if assert.Len(t, hashes, 1, desc) {
+		assert.Equal(t, hashes[0], hash, desc)
+	}
+	assert.Equal(t, erasureHash(previous, uuid, actor, created), hash, desc)
+
+	desc = "test forgotten user cannot be restored"
+	assert.EqualError(t, restoreUserRow(context.TODO(), uuid), consts.ErrUserNotFound.Error(), desc)
+
+	desc = "test forgotten user cannot be forgotten again"
+	_, err = s.ForgetUser(context.TODO(), &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: adminToken},
+		User:           &pblib.User{Uuid: uuid},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err), desc)
+}
+
 func TestVerifyEmailToken(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	// create user 1 to emulate new user
 	user1, err := unitTestInsertUser("VerifyEmailToken-NewUser")
 	assert.Nil(t, err)
@@ -785,16 +1239,17 @@ func TestVerifyEmailToken(t *testing.T) {
 		Email: unitTestEmailGenerator(),
 		Uuid:  user2.GetUser().GetUuid(),
 	}
-	updatedUser2, err := updateUserRow(updateData.GetUuid(), updateData, user2.GetUser())
+	updatedUser2, err := updateUserRow(context.TODO(), updateData.GetUuid(), updateData, user2.GetUser(),
+		userNames{}, nil)
 	assert.Nil(t, err)
 	assert.Equal(t, user2.GetUser().GetUuid(), updatedUser2.GetUuid())
 	assert.Equal(t, false, updatedUser2.GetIsVerified())
 	assert.NotEmpty(t, updatedUser2.GetProspectiveEmail())
 
 	// remove the existing tokens so we can manually create, insert and reference this token
-	err = deleteEmailTokenRow(user1.GetUser().GetUuid())
+	err = deleteEmailTokenRow(context.TODO(), user1.GetUser().GetUuid())
 	assert.Nil(t, err)
-	err = deleteEmailTokenRow(user2.GetUser().GetUuid())
+	err = deleteEmailTokenRow(context.TODO(), user2.GetUser().GetUuid())
 	assert.Nil(t, err)
 
 	user1EmailID, err := auth.GenerateEmailIdentification(user1.GetUser().GetUuid(), user1.GetUser().GetPermissionLevel())
@@ -806,9 +1261,9 @@ func TestVerifyEmailToken(t *testing.T) {
 	assert.NotNil(t, user2EmailID)
 
 	// insert this token to test against
-	err = insertEmailToken(user1.GetUser().GetUuid(), user1EmailID.GetToken(), user1EmailID.GetSecret())
+	err = insertEmailToken(context.TODO(), user1.GetUser().GetUuid(), user1EmailID.GetToken(), user1EmailID.GetSecret())
 	assert.Nil(t, err)
-	err = insertEmailToken(user2.GetUser().GetUuid(), user2EmailID.GetToken(), user2EmailID.GetSecret())
+	err = insertEmailToken(context.TODO(), user2.GetUser().GetUuid(), user2EmailID.GetToken(), user2EmailID.GetSecret())
 	assert.Nil(t, err)
 
 	// define test cases to test against non expired tokens
@@ -818,10 +1273,6 @@ func TestVerifyEmailToken(t *testing.T) {
 		isExpErr bool
 		expMsg   string
 	}{
-		{"test nil req object", nil, true, consts.ErrStatusNilRequestUser.Error()},
-		{"test nil identification object", &pbsvc.UserRequest{Identification: nil}, true,
-			status.Error(codes.InvalidArgument, consts.ErrNilRequestIdentification.Error()).Error(),
-		},
 		{"test empty token string", &pbsvc.UserRequest{Identification: &pblib.Identification{Token: ""}},
 			true, status.Error(codes.InvalidArgument, authconst.ErrEmptyToken.Error()).Error(),
 		},
@@ -849,9 +1300,9 @@ func TestVerifyEmailToken(t *testing.T) {
 			var retrievedUser *pblib.User
 			var err error
 			if c.req.Identification.GetToken() == user1EmailID.GetToken() {
-				retrievedUser, err = getUserRow(user1.GetUser().GetUuid())
+				retrievedUser, err = getUserRow(context.TODO(), user1.GetUser().GetUuid())
 			} else {
-				retrievedUser, err = getUserRow(user2.GetUser().GetUuid())
+				retrievedUser, err = getUserRow(context.TODO(), user2.GetUser().GetUuid())
 			}
 			assert.Nil(t, err)
 			assert.Equal(t, auth.PermissionStringMap[auth.User], retrievedUser.GetPermissionLevel())
@@ -873,9 +1324,9 @@ func TestVerifyEmailToken(t *testing.T) {
 	assert.Nil(t, err)
 
 	// reset permissionLevel
-	err = updatePermissionLevel(user1.GetUser().GetUuid(), auth.PermissionStringMap[auth.NoPermission])
+	err = updatePermissionLevel(context.TODO(), user1.GetUser().GetUuid(), auth.PermissionStringMap[auth.NoPermission])
 	assert.Nil(t, err)
-	err = updatePermissionLevel(user2.GetUser().GetUuid(), auth.PermissionStringMap[auth.NoPermission])
+	err = updatePermissionLevel(context.TODO(), user2.GetUser().GetUuid(), auth.PermissionStringMap[auth.NoPermission])
 	assert.Nil(t, err)
 
 	expiredTestCase := []struct {
@@ -898,13 +1349,854 @@ func TestVerifyEmailToken(t *testing.T) {
 		assert.EqualError(t, err, status.Error(codes.DeadlineExceeded, consts.ErrExpiredEmailToken.Error()).Error(), c.desc)
 
 		if c.deleteUser {
-			retrievedUser, err := getUserRow(user1.GetUser().GetUuid())
+			retrievedUser, err := getUserRow(context.TODO(), user1.GetUser().GetUuid())
 			assert.EqualError(t, err, consts.ErrUserNotFound.Error())
 			assert.Nil(t, retrievedUser, c.desc)
 		} else {
-			retrievedUser, err := getUserRow(user2.GetUser().GetUuid())
+			retrievedUser, err := getUserRow(context.TODO(), user2.GetUser().GetUuid())
 			assert.Nil(t, err)
 			assert.Equal(t, user2.GetUser().GetUuid(), retrievedUser.GetUuid(), c.desc)
 		}
 	}
 }
+
+func TestReplayEvents(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	// creating a user publishes a created event
+	response, err := unitTestInsertUser("ReplayEvents-One")
+	assert.Nil(t, err)
+	createdUUID := response.GetUser().GetUuid()
+
+	desc := "test user token is denied"
+	s := Service{}
+	newSecret, userToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err, desc)
+	ctx, _ := unitTestServerContext()
+	response, err = s.ReplayEvents(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: userToken}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+	assert.Nil(t, response, desc)
+
+	adminHeader := &auth.Header{Alg: auth.Hs512, TokenTyp: auth.Jwt}
+	adminBody := &auth.Body{
+		UUID:                auth.ExtractUUID(userToken),
+		Permission:          auth.Admin,
+		ExpirationTimestamp: validNoUUIDAuthTokenBody.ExpirationTimestamp,
+	}
+	adminToken, err := auth.NewToken(adminHeader, adminBody, newSecret)
+	assert.Nil(t, err)
+	assert.Nil(t, insertAuthToken(context.TODO(), adminToken, adminHeader, adminBody, newSecret))
+	admin := &pbsvc.UserRequest{Identification: &pblib.Identification{Token: adminToken}}
+
+	desc = "test replay contains created event"
+	ctx, stream := unitTestServerContext(metadataKeyLimit, strconv.Itoa(maxReplayLimit))
+	response, err = s.ReplayEvents(ctx, admin)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), response.GetMessage(), desc)
+	assert.NotEmpty(t, stream.header.Get(metadataKeyLastSequence), desc)
+
+	found := false
+	for _, envelope := range stream.header.Get(metadataKeyEvent) {
+		event := &cloudEvent{}
+		assert.Nil(t, json.Unmarshal([]byte(envelope), event), desc)
+		assert.NotZero(t, event.Sequence, desc)
+		if event.Subject == createdUUID && event.Type == eventTypeUserCreated {
+			found = true
+		}
+	}
+	assert.True(t, found, desc)
+
+	desc = "test replay from last sequence is empty, with the admin token as authorization metadata"
+	lastSequence := stream.header.Get(metadataKeyLastSequence)[0]
+	ctx, stream = unitTestServerContext(metadataKeyFromSequence, lastSequence,
+		metadataKeyAuthorization, "Bearer "+adminToken)
+	response, err = s.ReplayEvents(ctx, &pbsvc.UserRequest{})
+	assert.Nil(t, err, desc)
+	assert.Empty(t, stream.header.Get(metadataKeyEvent), desc)
+	assert.Equal(t, []string{lastSequence}, stream.header.Get(metadataKeyLastSequence), desc)
+
+	cases := []struct {
+		desc   string
+		pairs  []string
+		expMsg string
+	}{
+		{"test invalid sequence", []string{metadataKeyFromSequence, "-1"},
+			status.Error(codes.InvalidArgument, consts.ErrInvalidReplaySequence.Error()).Error()},
+		{"test invalid timestamp", []string{metadataKeyFromTimestamp, "yesterday"},
+			status.Error(codes.InvalidArgument, consts.ErrInvalidReplayTimestamp.Error()).Error()},
+		{"test limit too large", []string{metadataKeyLimit, strconv.Itoa(maxReplayLimit + 1)},
+			status.Error(codes.InvalidArgument, consts.ErrInvalidReplayLimit.Error()).Error()},
+	}
+
+	for _, c := range cases {
+		ctx, _ := unitTestServerContext(c.pairs...)
+		response, err := s.ReplayEvents(ctx, admin)
+		assert.EqualError(t, err, c.expMsg, c.desc)
+		assert.Nil(t, response, c.desc)
+	}
+}
+
+func TestReplayEventsWithoutToken(t *testing.T) {
+	s := Service{}
+	ctx, stream := unitTestServerContext()
+	response, err := s.ReplayEvents(ctx, &pbsvc.UserRequest{})
+	assert.EqualError(t, err, status.Error(codes.PermissionDenied, consts.ErrReplayNotAllowed.Error()).Error())
+	assert.Nil(t, response)
+	assert.Empty(t, stream.header.Get(metadataKeyEvent))
+}
+
+func TestParentalConsent(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	s := Service{}
+	childBirthdate := time.Now().UTC().AddDate(-10, 0, 0).Format(birthdateLayout)
+
+	cases := []struct {
+		desc   string
+		pairs  []string
+		expMsg string
+	}{
+		{"test invalid birthdate", []string{metadataKeyBirthdate, "2010-13-01"},
+			status.Error(codes.InvalidArgument, consts.ErrInvalidBirthdate.Error()).Error()},
+		{"test child without parent email", []string{metadataKeyBirthdate, childBirthdate},
+			status.Error(codes.InvalidArgument, consts.ErrInvalidParentEmail.Error()).Error()},
+	}
+
+	for _, c := range cases {
+		ctx, _ := unitTestServerContext(c.pairs...)
+		response, err := s.CreateUser(ctx, &pbsvc.UserRequest{User: unitTestUserGenerator("ParentalConsent-Invalid")})
+		assert.EqualError(t, err, c.expMsg, c.desc)
+		assert.Nil(t, response, c.desc)
+	}
+
+	desc := "test child's own email is not a parent email"
+	child := unitTestUserGenerator("ParentalConsent-One")
+	ctx, _ := unitTestServerContext(metadataKeyBirthdate, childBirthdate, metadataKeyParentEmail, child.GetEmail())
+	_, err := s.CreateUser(ctx, &pbsvc.UserRequest{User: child})
+	assert.EqualError(t, err, status.Error(codes.InvalidArgument, consts.ErrInvalidParentEmail.Error()).Error(), desc)
+
+	desc = "test child is created pending consent"
+	child = unitTestUserGenerator("ParentalConsent-One")
+	password := child.GetPassword()
+	ctx, stream := unitTestServerContext(metadataKeyBirthdate, childBirthdate,
+		metadataKeyParentEmail, unitTestEmailGenerator())
+	response, err := s.CreateUser(ctx, &pbsvc.UserRequest{User: child})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{parentalConsentPending}, stream.header.Get(metadataKeyParentalConsent), desc)
+	uuid := response.GetUser().GetUuid()
+
+	// verify the child's email so only the missing consent blocks sign in
+	_, err = verifyEmailTokenRow(context.TODO(), response.GetIdentification().GetToken())
+	assert.Nil(t, err, desc)
+
+	desc = "test child cannot sign in before consent"
+	signIn := &pbsvc.UserRequest{User: &pblib.User{Email: child.GetEmail(), Password: password}}
+	_, err = s.AuthenticateUser(context.TODO(), signIn)
+	assert.EqualError(t, err,
+		status.Error(codes.FailedPrecondition, consts.ErrParentalConsentRequired.Error()).Error(), desc)
+
+	desc = "test unknown consent token"
+	unknownID, err := auth.GenerateEmailIdentification(uuid, auth.PermissionStringMap[auth.NoPermission])
+	assert.Nil(t, err, desc)
+	_, err = s.VerifyParentalConsent(context.TODO(), &pbsvc.UserRequest{Identification: unknownID})
+	assert.EqualError(t, err,
+		status.Error(codes.NotFound, consts.ErrNoMatchingParentalConsent.Error()).Error(), desc)
+
+	desc = "test child can sign in after consent"
+	var consentToken string
+	err = postgresDB.QueryRow(`SELECT token FROM user_svc.parental_consent_tokens WHERE uuid = $1`, uuid).
+		Scan(&consentToken)
+	assert.Nil(t, err, desc)
+	consentResponse, err := s.VerifyParentalConsent(context.TODO(),
+		&pbsvc.UserRequest{Identification: &pblib.Identification{Token: consentToken}})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), consentResponse.GetMessage(), desc)
+
+	_, err = s.AuthenticateUser(context.TODO(), signIn)
+	assert.Nil(t, err, desc)
+}
+
+func TestGetUserStats(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	s := Service{}
+
+	desc := "test invalid days"
+	ctx, _ := unitTestServerContext(metadataKeyDays, strconv.Itoa(maxStatsDays+1))
+	response, err := s.GetUserStats(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: "unused"}})
+	assert.EqualError(t, err, status.Error(codes.InvalidArgument, consts.ErrInvalidStatsDays.Error()).Error(), desc)
+	assert.Nil(t, response, desc)
+
+	desc = "test user token is denied"
+	newSecret, userToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err, desc)
+	ctx, _ = unitTestServerContext()
+	response, err = s.GetUserStats(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: userToken}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+	assert.Nil(t, response, desc)
+
+	desc = "test admin token returns aggregates"
+	adminHeader := &auth.Header{Alg: auth.Hs512, TokenTyp: auth.Jwt}
+	adminBody := &auth.Body{
+		UUID:                auth.ExtractUUID(userToken),
+		Permission:          auth.Admin,
+		ExpirationTimestamp: validNoUUIDAuthTokenBody.ExpirationTimestamp,
+	}
+	adminToken, err := auth.NewToken(adminHeader, adminBody, newSecret)
+	assert.Nil(t, err, desc)
+	assert.Nil(t, insertAuthToken(context.TODO(), adminToken, adminHeader, adminBody, newSecret), desc)
+
+	ctx, stream := unitTestServerContext(metadataKeyDays, "3")
+	response, err = s.GetUserStats(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: adminToken}})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), response.GetMessage(), desc)
+	assert.Equal(t, 3, len(stream.header.Get(metadataKeySignups)), desc)
+	assert.Equal(t, []string{"1"}, stream.header.Get(metadataKeyActiveSessions), desc)
+	assert.NotEmpty(t, stream.header.Get(metadataKeyVerificationRate), desc)
+	assert.NotEmpty(t, stream.header.Get(metadataKeyOrganizationUsers), desc)
+	assert.NotEmpty(t, stream.header.Get(metadataKeyEmailFailureRate), desc)
+}
+
+func TestUpdateUserPermissionLevel(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	s := Service{}
+	response, err := unitTestInsertUser("TestUpdateUserPermissionLevel")
+	assert.Nil(t, err)
+	user := response.GetUser()
+	promotion := &pblib.User{Uuid: user.GetUuid(), PermissionLevel: auth.PermissionStringMap[auth.Admin]}
+
+	desc := "test the stored permission level is accepted without a token"
+	_, err = s.UpdateUser(context.TODO(), &pbsvc.UserRequest{
+		User: &pblib.User{Uuid: user.GetUuid(), PermissionLevel: user.GetPermissionLevel()},
+	})
+	assert.Nil(t, err, desc)
+
+	desc = "test changes without a token are denied"
+	_, err = s.UpdateUser(context.TODO(), &pbsvc.UserRequest{User: promotion})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+
+	desc = "test user tokens are denied"
+	newSecret, userToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err, desc)
+	_, err = s.UpdateUser(context.TODO(), &pbsvc.UserRequest{
+		User:           promotion,
+		Identification: &pblib.Identification{Token: userToken},
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+
+	desc = "test admin tokens change the permission level"
+	adminHeader := &auth.Header{Alg: auth.Hs512, TokenTyp: auth.Jwt}
+	adminBody := &auth.Body{
+		UUID:                auth.ExtractUUID(userToken),
+		Permission:          auth.Admin,
+		ExpirationTimestamp: validNoUUIDAuthTokenBody.ExpirationTimestamp,
+	}
+	adminToken, err := auth.NewToken(adminHeader, adminBody, newSecret)
+	assert.Nil(t, err, desc)
+	assert.Nil(t, insertAuthToken(context.TODO(), adminToken, adminHeader, adminBody, newSecret), desc)
+	updated, err := s.UpdateUser(context.TODO(), &pbsvc.UserRequest{
+		User:           promotion,
+		Identification: &pblib.Identification{Token: adminToken},
+	})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, auth.PermissionStringMap[auth.Admin], updated.GetUser().GetPermissionLevel(), desc)
+	stored, err := getUserRow(context.TODO(), user.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, auth.PermissionStringMap[auth.Admin], stored.GetPermissionLevel(), desc)
+}
+
+func TestHandlersHonorCanceledContext(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	response, err := unitTestInsertUser("CanceledContext-One")
+	assert.Nil(t, err)
+	user := response.GetUser()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	s := Service{}
+	expMsg := "rpc error: code = Canceled desc = context canceled"
+	cases := []struct {
+		desc    string
+		handler func(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+		request *pbsvc.UserRequest
+	}{
+		{"test CreateUser", s.CreateUser,
+			&pbsvc.UserRequest{User: unitTestUserGenerator("CanceledContext-Two")}},
+		{"test UpdateUser", s.UpdateUser,
+			&pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid(), FirstName: "Canceled"}}},
+		{"test DeleteUser", s.DeleteUser, &pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()}}},
+		{"test AuthenticateUser", s.AuthenticateUser,
+			&pbsvc.UserRequest{User: &pblib.User{Email: user.GetEmail(), Password: "CanceledContext-One"}}},
+	}
+
+	for _, c := range cases {
+		response, err := c.handler(ctx, c.request)
+		assert.EqualError(t, err, expMsg, c.desc)
+		assert.Nil(t, response, c.desc)
+	}
+
+	desc := "test canceled requests left the user untouched"
+	retrievedUser, err := getUserRow(context.TODO(), user.GetUuid())
+	assert.Nil(t, err, desc)
+	assert.Equal(t, user.GetFirstName(), retrievedUser.GetFirstName(), desc)
+}
+
+func BenchmarkCreateUser(b *testing.B) {
+	// skip verification emails, they would dominate the measurement
+	emailHost := conf.EmailHost
+	conf.EmailHost.Username = ""
+	defer func() { conf.EmailHost = emailHost }()
+
+	s := Service{}
+	for i := 0; i < b.N; i++ {
+		req := &pbsvc.UserRequest{User: unitTestUserGenerator("BenchmarkCreateUser")}
+		if _, err := s.CreateUser(context.TODO(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetUser(b *testing.B) {
+	response, err := unitTestInsertUser("BenchmarkGetUser")
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := &pbsvc.UserRequest{User: &pblib.User{Uuid: response.GetUser().GetUuid()}}
+
+	s := Service{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.GetUser(context.TODO(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAuthenticateUser(b *testing.B) {
+	req := &pbsvc.UserRequest{User: &pblib.User{
+		Email:    conf.DummyAccount.GetEmail(),
+		Password: conf.DummyAccount.GetPassword(),
+	}}
+
+	s := Service{}
+	for i := 0; i < b.N; i++ {
+		if _, err := s.AuthenticateUser(context.TODO(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVerifyAuthToken(b *testing.B) {
+	_, newToken, err := unitTestInsertNewAuthToken()
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := &pbsvc.UserRequest{Identification: &pblib.Identification{Token: newToken}}
+
+	s := Service{}
+	b.Run("stateless", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.VerifyAuthToken(context.TODO(), req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// a revoked uuid skips the stateless fast path
+	authTokenVerifier.revoke(auth.ExtractUUID(newToken))
+	defer authTokenVerifier.expire()
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.VerifyAuthToken(context.TODO(), req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			authTokenCache.purge()
+			if _, err := s.VerifyAuthToken(context.TODO(), req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestGetUsageReport(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	s := Service{}
+
+	desc := "test invalid range"
+	ctx, _ := unitTestServerContext(metadataKeyFromDate, "2019-07-02", metadataKeyToDate, "2019-07-01")
+	response, err := s.GetUsageReport(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: "unused"}})
+	assert.EqualError(t, err, status.Error(codes.InvalidArgument, consts.ErrInvalidUsageReportRange.Error()).Error(), desc)
+	assert.Nil(t, response, desc)
+
+	desc = "test user token is denied"
+	_, userToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err, desc)
+	ctx, _ = unitTestServerContext()
+	response, err = s.GetUsageReport(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: userToken}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+	assert.Nil(t, response, desc)
+}
+
+func TestGetReferralStats(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	s := Service{}
+
+	desc := "test CreateUser returns a referral code"
+	ctx, stream := unitTestServerContext()
+	response, err := s.CreateUser(ctx, &pbsvc.UserRequest{User: unitTestUserGenerator("TestGetReferralStats-One")})
+	assert.Nil(t, err, desc)
+	referrer := response.GetUser()
+	referralCodes := stream.header.Get(metadataKeyReferralCode)
+	assert.Len(t, referralCodes, 1, desc)
+
+	desc = "test malformed referral code"
+	ctx, _ = unitTestServerContext(metadataKeyReferralCode, "not a code")
+	response, err = s.CreateUser(ctx, &pbsvc.UserRequest{User: unitTestUserGenerator("TestGetReferralStats-Two")})
+	assert.EqualError(t, err, status.Error(codes.InvalidArgument, consts.ErrInvalidReferralCode.Error()).Error(), desc)
+	assert.Nil(t, response, desc)
+
+	desc = "test referral code in any case"
+	ctx, _ = unitTestServerContext(metadataKeyReferralCode, strings.ToLower(referralCodes[0]))
+	response, err = s.CreateUser(ctx, &pbsvc.UserRequest{User: unitTestUserGenerator("TestGetReferralStats-Two")})
+	assert.Nil(t, err, desc)
+	referee := response.GetUser()
+
+	desc = "test user reads its own stats"
+	referrerToken, err := unitTestInsertUUIDAuthToken(referrer.GetUuid())
+	assert.Nil(t, err, desc)
+
+	ctx, stream = unitTestServerContext()
+	response, err = s.GetReferralStats(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: referrerToken}})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), response.GetMessage(), desc)
+	assert.Equal(t, referralCodes, stream.header.Get(metadataKeyReferralCode), desc)
+	assert.Equal(t, []string{"1"}, stream.header.Get(metadataKeyReferrals), desc)
+	assert.Equal(t, []string{"0"}, stream.header.Get(metadataKeyVerifiedReferrals), desc)
+	assert.Empty(t, stream.header.Get(metadataKeyReferredBy), desc)
+
+	desc = "test user cannot read another user's stats"
+	ctx, _ = unitTestServerContext()
+	response, err = s.GetReferralStats(ctx, &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: referrerToken},
+		User:           &pblib.User{Uuid: referee.GetUuid()},
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+	assert.Nil(t, response, desc)
+}
+
+func TestOnboarding(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	s := Service{}
+
+	desc := "test invalid step"
+	ctx, _ := unitTestServerContext(metadataKeyOnboardingStep, "not a step")
+	response, err := s.SetOnboardingStep(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: "unused"}})
+	assert.EqualError(t, err, status.Error(codes.InvalidArgument, consts.ErrInvalidOnboardingStep.Error()).Error(), desc)
+	assert.Nil(t, response, desc)
+
+	response, err = unitTestInsertUser("TestOnboarding-One")
+	assert.Nil(t, err)
+	token, err := unitTestInsertUUIDAuthToken(response.GetUser().GetUuid())
+	assert.Nil(t, err)
+	identification := &pblib.Identification{Token: token}
+
+	desc = "test step is persisted"
+	ctx, _ = unitTestServerContext(metadataKeyOnboardingStep, "Profile")
+	response, err = s.SetOnboardingStep(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), response.GetMessage(), desc)
+
+	ctx, stream := unitTestServerContext()
+	_, err = s.GetOnboardingState(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.Nil(t, err, desc)
+	steps := stream.header.Get(metadataKeyOnboardingSteps)
+	assert.Equal(t, 1, len(steps), desc)
+	assert.True(t, strings.HasPrefix(steps[0], "profile="), desc)
+
+	desc = "test step is cleared"
+	ctx, _ = unitTestServerContext(metadataKeyOnboardingStep, "profile", metadataKeyOnboardingCompleted, "false")
+	_, err = s.SetOnboardingStep(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.Nil(t, err, desc)
+
+	ctx, stream = unitTestServerContext()
+	_, err = s.GetOnboardingState(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.Nil(t, err, desc)
+	assert.Empty(t, stream.header.Get(metadataKeyOnboardingSteps), desc)
+}
+
+func TestNotificationPreferencesHandlers(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	s := Service{}
+
+	desc := "test update without categories"
+	ctx, _ := unitTestServerContext()
+	response, err := s.UpdateNotificationPreferences(ctx,
+		&pbsvc.UserRequest{Identification: &pblib.Identification{Token: "unused"}})
+	assert.EqualError(t, err,
+		status.Error(codes.InvalidArgument, consts.ErrInvalidNotificationSetting.Error()).Error(), desc)
+	assert.Nil(t, response, desc)
+
+	response, err = unitTestInsertUser("TestNotificationPreferencesHandlers-One")
+	assert.Nil(t, err)
+	token, err := unitTestInsertUUIDAuthToken(response.GetUser().GetUuid())
+	assert.Nil(t, err)
+	identification := &pblib.Identification{Token: token}
+
+	desc = "test update returns the resulting preferences"
+	ctx, stream := unitTestServerContext(metadataKeySecurityAlerts, "false")
+	response, err = s.UpdateNotificationPreferences(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), response.GetMessage(), desc)
+	assert.Equal(t, []string{"false"}, stream.header.Get(metadataKeySecurityAlerts), desc)
+	assert.Equal(t, []string{"true"}, stream.header.Get(metadataKeyShareAlerts), desc)
+
+	desc = "test get"
+	ctx, stream = unitTestServerContext()
+	_, err = s.GetNotificationPreferences(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{"false"}, stream.header.Get(metadataKeySecurityAlerts), desc)
+	assert.Equal(t, []string{"false"}, stream.header.Get(metadataKeyMarketing), desc)
+}
+
+func TestTwoFactor(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	key := totpKey
+	defer func() { totpKey = key }()
+
+	s := Service{}
+	password := "TestTwoFactor-One"
+	response, err := unitTestInsertUser(password)
+	assert.Nil(t, err)
+	_, err = s.VerifyEmailToken(context.TODO(), &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: response.GetIdentification().GetToken()},
+	})
+	assert.Nil(t, err)
+	user := &pblib.User{Email: response.GetUser().GetEmail(), Password: password}
+	token, err := unitTestInsertUUIDAuthToken(response.GetUser().GetUuid())
+	assert.Nil(t, err)
+	identification := &pblib.Identification{Token: token}
+
+	desc := "test enable without a totp key"
+	totpKey = nil
+	ctx, _ := unitTestServerContext()
+	_, err = s.Enable2FA(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), desc)
+
+	desc = "test verify without enable"
+	totpKey = make([]byte, totpKeyByteSize)
+	ctx, _ = unitTestServerContext(metadataKeyTOTPCode, "123456")
+	_, err = s.Verify2FA(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.EqualError(t, err, statusFromError(consts.ErrTwoFactorNotPending).Error(), desc)
+
+	desc = "test enable returns the secret"
+	ctx, stream := unitTestServerContext()
+	_, err = s.Enable2FA(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.Nil(t, err, desc)
+	secret, err := totpEncoding.DecodeString(stream.header.Get(metadataKeyTOTPSecret)[0])
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{totpURI(secret, user.GetEmail())}, stream.header.Get(metadataKeyTOTPURI), desc)
+
+	desc = "test pending two-factor authentication is not required"
+	_, err = s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{User: user})
+	assert.Nil(t, err, desc)
+
+	desc = "test verify with a wrong code"
+	step := time.Now().Unix() / int64(totpPeriod/time.Second)
+	ctx, _ = unitTestServerContext(metadataKeyTOTPCode, totpCode(secret, step-5))
+	_, err = s.Verify2FA(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.EqualError(t, err, statusFromError(consts.ErrInvalidTwoFactorCode).Error(), desc)
+
+	desc = "test verify returns backup codes"
+	code := totpCode(secret, step)
+	ctx, stream = unitTestServerContext(metadataKeyTOTPCode, code)
+	_, err = s.Verify2FA(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.Nil(t, err, desc)
+	backupCodes := stream.header.Get(metadataKeyBackupCodes)
+	assert.Len(t, backupCodes, backupCodeCount, desc)
+
+	desc = "test enable again once enabled"
+	ctx, _ = unitTestServerContext()
+	_, err = s.Enable2FA(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.EqualError(t, err, statusFromError(consts.ErrTwoFactorEnabled).Error(), desc)
+
+	desc = "test sign in without a code"
+	_, err = s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{User: user})
+	assert.EqualError(t, err, statusFromError(consts.ErrTwoFactorRequired).Error(), desc)
+
+	desc = "test sign in with the used verification code"
+	ctx, _ = unitTestServerContext(metadataKeyTOTPCode, code)
+	_, err = s.AuthenticateUser(ctx, &pbsvc.UserRequest{User: user})
+	assert.EqualError(t, err, statusFromError(consts.ErrInvalidTwoFactorCode).Error(), desc)
+
+	desc = "test sign in with a backup code"
+	ctx, _ = unitTestServerContext(metadataKeyTOTPCode, strings.ToLower(backupCodes[0]))
+	response, err = s.AuthenticateUser(ctx, &pbsvc.UserRequest{User: user})
+	assert.Nil(t, err, desc)
+	assert.NotNil(t, response.GetIdentification(), desc)
+
+	desc = "test backup codes are used once"
+	ctx, _ = unitTestServerContext(metadataKeyTOTPCode, backupCodes[0])
+	_, err = s.AuthenticateUser(ctx, &pbsvc.UserRequest{User: user})
+	assert.EqualError(t, err, statusFromError(consts.ErrInvalidTwoFactorCode).Error(), desc)
+
+	desc = "test disable without a code"
+	ctx, _ = unitTestServerContext()
+	_, err = s.Disable2FA(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.EqualError(t, err, statusFromError(consts.ErrTwoFactorRequired).Error(), desc)
+
+	desc = "test disable with a backup code"
+	ctx, _ = unitTestServerContext(metadataKeyTOTPCode, backupCodes[1])
+	_, err = s.Disable2FA(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.Nil(t, err, desc)
+
+	var remaining int
+	assert.Nil(t, postgresDB.QueryRow(`SELECT COUNT(*) FROM user_security.backup_codes WHERE uuid = $1`,
+		response.GetUser().GetUuid()).Scan(&remaining), desc)
+	assert.Zero(t, remaining, desc)
+	_, err = s.AuthenticateUser(context.TODO(), &pbsvc.UserRequest{User: user})
+	assert.Nil(t, err, desc)
+
+	desc = "test disable once disabled"
+	ctx, _ = unitTestServerContext()
+	_, err = s.Disable2FA(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.EqualError(t, err, statusFromError(consts.ErrTwoFactorNotEnabled).Error(), desc)
+}
+
+func TestQueryAdminActivity(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	s := Service{}
+
+	desc := "test invalid range"
+	ctx, _ := unitTestServerContext(metadataKeyFromTimestamp, "2019-07-02T00:00:00Z",
+		metadataKeyToTimestamp, "2019-07-01T00:00:00Z")
+	response, err := s.QueryAdminActivity(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: "unused"}})
+	assert.EqualError(t, err, status.Error(codes.InvalidArgument, consts.ErrInvalidActivityRange.Error()).Error(), desc)
+	assert.Nil(t, response, desc)
+
+	desc = "test user token is denied"
+	newSecret, userToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err, desc)
+	ctx, _ = unitTestServerContext()
+	response, err = s.QueryAdminActivity(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: userToken}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+	assert.Nil(t, response, desc)
+
+	desc = "test admin calls are reported"
+	adminHeader := &auth.Header{Alg: auth.Hs512, TokenTyp: auth.Jwt}
+	adminBody := &auth.Body{
+		UUID:                auth.ExtractUUID(userToken),
+		Permission:          auth.Admin,
+		ExpirationTimestamp: validNoUUIDAuthTokenBody.ExpirationTimestamp,
+	}
+	adminToken, err := auth.NewToken(adminHeader, adminBody, newSecret)
+	assert.Nil(t, err, desc)
+	assert.Nil(t, insertAuthToken(context.TODO(), adminToken, adminHeader, adminBody, newSecret), desc)
+	identification := &pblib.Identification{Token: adminToken}
+
+	ctx, _ = unitTestServerContext(metadataKeyOrganization, "TestQueryAdminActivity")
+	_, err = s.GetUsageReport(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.Nil(t, err, desc)
+
+	ctx, stream := unitTestServerContext()
+	response, err = s.QueryAdminActivity(ctx, &pbsvc.UserRequest{Identification: identification})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), response.GetMessage(), desc)
+	documents := stream.header.Get(metadataKeyAdminActivity)
+	assert.Equal(t, 1, len(documents), desc)
+	assert.Contains(t, documents[0], adminBody.UUID+",GetUsageReport,TestQueryAdminActivity", desc)
+	assert.NotEqual(t, []string{"0"}, stream.header.Get(metadataKeyLastSequence), desc)
+}
+
+func TestOrganizations(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	const organization = "TestOrganizations"
+	s := Service{}
+
+	newSecret, userToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err)
+	signToken := func(header *auth.Header, uuid string, permission auth.Permission) *pblib.Identification {
+		body := &auth.Body{
+			UUID:                uuid,
+			Permission:          permission,
+			ExpirationTimestamp: validNoUUIDAuthTokenBody.ExpirationTimestamp,
+		}
+		token, err := auth.NewToken(header, body, newSecret)
+		assert.Nil(t, err)
+		assert.Nil(t, insertAuthToken(context.TODO(), token, header, body, newSecret))
+		return &pblib.Identification{Token: token}
+	}
+	admin := signToken(&auth.Header{Alg: auth.Hs512, TokenTyp: auth.Jwt}, auth.ExtractUUID(userToken), auth.Admin)
+
+	desc := "test user token cannot create organizations"
+	ctx, _ := unitTestServerContext(metadataKeyOrganization, organization)
+	_, err = s.CreateOrganization(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: userToken}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+
+	desc = "test admin creates organization"
+	ctx, stream := unitTestServerContext(metadataKeyOrganization, organization)
+	response, err := s.CreateOrganization(ctx, &pbsvc.UserRequest{Identification: admin})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), response.GetMessage(), desc)
+	assert.Equal(t, []string{auth.ExtractUUID(admin.GetToken())},
+		stream.header.Get(metadataKeyOrganizationCreatedBy), desc)
+	assert.Equal(t, []string{"0"}, stream.header.Get(metadataKeyOrganizationMembers), desc)
+	ctx, _ = unitTestServerContext(metadataKeyOrganization, organization)
+	_, err = s.CreateOrganization(ctx, &pbsvc.UserRequest{Identification: admin})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), desc)
+
+	var uuids []string
+	for _, lastName := range []string{"TestOrganizations-Admin", "TestOrganizations-Member"} {
+		user := unitTestUserGenerator(lastName)
+		user.Organization = organization
+		resp, err := s.CreateUser(context.TODO(), &pbsvc.UserRequest{User: user})
+		assert.Nil(t, err)
+		uuids = append(uuids, resp.GetUser().GetUuid())
+	}
+	orgAdmin := signToken(validAuthTokenHeader, uuids[0], auth.User)
+	member := signToken(validAuthTokenHeader, uuids[1], auth.User)
+
+	desc = "test members cannot manage the organization"
+	ctx, _ = unitTestServerContext(metadataKeyOrganization, organization)
+	_, err = s.ListOrganizationUsers(ctx, &pbsvc.UserRequest{Identification: member})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+
+	desc = "test admin makes a member an organization admin"
+	ctx, stream = unitTestServerContext(metadataKeyOrganization, organization)
+	_, err = s.SetOrganizationAdmin(ctx, &pbsvc.UserRequest{Identification: admin, User: &pblib.User{Uuid: uuids[0]}})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuids[:1], stream.header.Get(metadataKeyOrganizationAdmins), desc)
+
+	desc = "test organization admin lists members"
+	ctx, stream = unitTestServerContext(metadataKeyOrganization, organization, metadataKeyLimit, "1")
+	response, err = s.ListOrganizationUsers(ctx, &pbsvc.UserRequest{Identification: orgAdmin})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, 1, len(response.GetUserCollection()), desc)
+	assert.Equal(t, uuids[0], response.GetUserCollection()[0].GetUuid(), desc)
+	assert.Empty(t, response.GetUserCollection()[0].GetPassword(), desc)
+	assert.Equal(t, []string{encodePageToken(uuids[0])}, stream.header.Get(metadataKeyNextPageToken), desc)
+
+	desc = "test organization admin sets the share policy"
+	ctx, _ = unitTestServerContext(metadataKeyOrganization, organization,
+		metadataKeySharePolicy, sharePolicyOrganization)
+	_, err = s.SetSharePolicy(ctx, &pbsvc.UserRequest{Identification: orgAdmin})
+	assert.Nil(t, err, desc)
+
+	desc = "test organization admin cannot manage other organizations"
+	ctx, _ = unitTestServerContext(metadataKeyOrganization, "TestOrganizations-Other")
+	_, err = s.GetOrganization(ctx, &pbsvc.UserRequest{Identification: orgAdmin})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+
+	desc = "test unknown organization"
+	ctx, _ = unitTestServerContext(metadataKeyOrganization, "TestOrganizations-Other")
+	_, err = s.GetOrganization(ctx, &pbsvc.UserRequest{Identification: admin})
+	assert.Equal(t, codes.NotFound, status.Code(err), desc)
+
+	desc = "test get organization"
+	ctx, stream = unitTestServerContext(metadataKeyOrganization, organization)
+	_, err = s.GetOrganization(ctx, &pbsvc.UserRequest{Identification: orgAdmin})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, []string{"2"}, stream.header.Get(metadataKeyOrganizationMembers), desc)
+}
+
+func TestDeleteUsersByOrganization(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	const organization = "TestDeleteUsersByOrganization"
+	s := Service{}
+
+	var uuids []string
+	for _, lastName := range []string{"DeleteUsersByOrganization-One", "DeleteUsersByOrganization-Two"} {
+		user := unitTestUserGenerator(lastName)
+		user.Organization = organization
+		resp, err := s.CreateUser(context.TODO(), &pbsvc.UserRequest{User: user})
+		assert.Nil(t, err)
+		uuids = append(uuids, resp.GetUser().GetUuid())
+	}
+	sort.Strings(uuids)
+	memberToken, err := unitTestInsertUUIDAuthToken(uuids[0])
+	assert.Nil(t, err)
+
+	newSecret, userToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err)
+	header := &auth.Header{Alg: auth.Hs512, TokenTyp: auth.Jwt}
+	body := &auth.Body{
+		UUID:                auth.ExtractUUID(userToken),
+		Permission:          auth.Admin,
+		ExpirationTimestamp: validNoUUIDAuthTokenBody.ExpirationTimestamp,
+	}
+	adminToken, err := auth.NewToken(header, body, newSecret)
+	assert.Nil(t, err)
+	assert.Nil(t, insertAuthToken(context.TODO(), adminToken, header, body, newSecret))
+	admin := &pblib.Identification{Token: adminToken}
+
+	responseUUIDs := func(response *pbsvc.UserResponse) []string {
+		var found []string
+		for _, user := range response.GetUserCollection() {
+			found = append(found, user.GetUuid())
+		}
+		return found
+	}
+
+	desc := "test missing organization"
+	_, err = s.DeleteUsersByOrganization(context.TODO(), &pbsvc.UserRequest{Identification: admin})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), desc)
+
+	desc = "test invalid dry run"
+	ctx, _ := unitTestServerContext(metadataKeyOrganization, organization, metadataKeyDryRun, "maybe")
+	_, err = s.DeleteUsersByOrganization(ctx, &pbsvc.UserRequest{Identification: admin})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), desc)
+
+	desc = "test user token cannot delete organization users"
+	ctx, _ = unitTestServerContext(metadataKeyOrganization, organization)
+	_, err = s.DeleteUsersByOrganization(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: userToken}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+
+	desc = "test dry run deletes nothing"
+	ctx, stream := unitTestServerContext(metadataKeyOrganization, organization, metadataKeyDryRun, "true")
+	response, err := s.DeleteUsersByOrganization(ctx, &pbsvc.UserRequest{Identification: admin})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuids, responseUUIDs(response), desc)
+	assert.Equal(t, []string{"2"}, stream.header.Get(metadataKeyRowsAffected), desc)
+	for _, uuid := range uuids {
+		_, err = getUserRow(context.TODO(), uuid)
+		assert.Nil(t, err, desc)
+	}
+	_, err = pairTokenWithSecret(context.TODO(), memberToken)
+	assert.Nil(t, err, desc)
+
+	desc = "test users are deleted and their tokens revoked"
+	ctx, stream = unitTestServerContext(metadataKeyOrganization, organization)
+	response, err = s.DeleteUsersByOrganization(ctx, &pbsvc.UserRequest{Identification: admin})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uuids, responseUUIDs(response), desc)
+	assert.Equal(t, []string{"2"}, stream.header.Get(metadataKeyRowsAffected), desc)
+	for _, uuid := range uuids {
+		_, err = getUserRow(context.TODO(), uuid)
+		assert.EqualError(t, err, consts.ErrUserNotFound.Error(), desc)
+	}
+	_, err = pairTokenWithSecret(context.TODO(), memberToken)
+	assert.NotNil(t, err, desc)
+
+	desc = "test organization without users"
+	ctx, stream = unitTestServerContext(metadataKeyOrganization, organization)
+	response, err = s.DeleteUsersByOrganization(ctx, &pbsvc.UserRequest{Identification: admin})
+	assert.Nil(t, err, desc)
+	assert.Empty(t, response.GetUserCollection(), desc)
+	assert.Equal(t, []string{"0"}, stream.header.Get(metadataKeyRowsAffected), desc)
+}
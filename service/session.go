@@ -0,0 +1,114 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+// sessionTracker expires auth tokens that were not used within idle. Activity is recorded in
+// user_security.auth_tokens so every instance sees it, at most once per touchInterval per token and instance.
+type sessionTracker struct {
+	idle          time.Duration
+	touchInterval time.Duration
+	store         func(ctx context.Context, token string, now time.Time, idle time.Duration) (bool, error)
+
+	lock    sync.Mutex
+	touched map[string]time.Time
+}
+
+const (
+	// maxSessionTouchInterval bounds how much activity an instance that crashed may not have recorded
+	maxSessionTouchInterval = time.Minute
+
+	// maxTrackedSessions bounds the tokens an instance remembers recording activity for
+	maxTrackedSessions = 100000
+)
+
+var (
+	// sessions is nil unless hosts_auth_idletimeout is set
+	sessions *sessionTracker
+)
+
+func init() {
+	if conf.Auth.IdleTimeout == "" {
+		return
+	}
+
+	idle, err := time.ParseDuration(conf.Auth.IdleTimeout)
+	if err != nil || idle <= 0 {
+		reportStartupProblem("Invalid auth idle timeout:", conf.Auth.IdleTimeout)
+		return
+	}
+
+	sessions = newSessionTracker(idle)
+	logger.Info(consts.UserServiceTag, "Expiring auth tokens idle for", idle.String())
+}
+
+func newSessionTracker(idle time.Duration) *sessionTracker {
+	// an activity seen touchInterval ago is still within idle
+	touchInterval := idle / 4
+	if touchInterval > maxSessionTouchInterval {
+		touchInterval = maxSessionTouchInterval
+	}
+
+	return &sessionTracker{
+		idle:          idle,
+		touchInterval: touchInterval,
+		store:         touchAuthToken,
+		touched:       make(map[string]time.Time),
+	}
+}
+
+// touch records activity of token, a verified auth token, at now. A nil tracker never expires tokens.
+// Returns ErrSessionIdle if token was not used within idle, or any db error.
+func (t *sessionTracker) touch(ctx context.Context, token string, now time.Time) error {
+	if t == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	last, ok := t.touched[token]
+	t.lock.Unlock()
+	if ok && now.Sub(last) < t.touchInterval {
+		return nil
+	}
+
+	active, err := t.store(ctx, token, now, t.idle)
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !active {
+		delete(t.touched, token)
+		return consts.ErrSessionIdle
+	}
+
+	if len(t.touched) >= maxTrackedSessions {
+		for tracked, touched := range t.touched {
+			if now.Sub(touched) >= t.touchInterval {
+				delete(t.touched, tracked)
+			}
+		}
+	}
+	t.touched[token] = now
+
+	return nil
+}
+
+// touchSession records activity of token for authorizeUser and authorizeAdmin, and the presence of its user.
+// Returns an Unauthenticated status error if token is idle, or the status of any db error.
+func touchSession(ctx context.Context, token string) error {
+	if err := sessions.touch(ctx, token, time.Now()); err != nil {
+		return statusFromError(err)
+	}
+
+	recordPresence(token)
+	return nil
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestSessionTracker(t *testing.T) {
+	activity := make(map[string]time.Time)
+	var stored int
+	var storeErr error
+	tracker := newSessionTracker(30 * time.Minute)
+	tracker.store = func(ctx context.Context, token string, now time.Time, idle time.Duration) (bool, error) {
+		stored++
+		if storeErr != nil {
+			return false, storeErr
+		}
+		last, ok := activity[token]
+		if ok && now.Sub(last) >= idle {
+			return false, nil
+		}
+		activity[token] = now
+		return true, nil
+	}
+	start := time.Now()
+
+	desc := "test touch interval is capped"
+	assert.Equal(t, maxSessionTouchInterval, tracker.touchInterval, desc)
+	assert.Equal(t, time.Second, newSessionTracker(4*time.Second).touchInterval, desc)
+
+	desc = "test first use is recorded"
+	assert.Nil(t, tracker.touch(context.TODO(), "token", start), desc)
+	assert.Equal(t, 1, stored, desc)
+
+	desc = "test activity within the touch interval is not recorded again"
+	assert.Nil(t, tracker.touch(context.TODO(), "token", start.Add(30*time.Second)), desc)
+	assert.Equal(t, 1, stored, desc)
+
+	desc = "test activity after the touch interval is recorded"
+	assert.Nil(t, tracker.touch(context.TODO(), "token", start.Add(20*time.Minute)), desc)
+	assert.Equal(t, 2, stored, desc)
+
+	desc = "test idle token expires"
+	err := tracker.touch(context.TODO(), "token", start.Add(50*time.Minute))
+	assert.Equal(t, consts.ErrSessionIdle, err, desc)
+	err = tracker.touch(context.TODO(), "token", start.Add(50*time.Minute+time.Second))
+	assert.Equal(t, consts.ErrSessionIdle, err, desc)
+	assert.Equal(t, 4, stored, desc)
+
+	desc = "test db errors are returned"
+	storeErr = errors.New("connection refused")
+	assert.Equal(t, storeErr, tracker.touch(context.TODO(), "other", start), desc)
+
+	desc = "test nil tracker never expires tokens"
+	var disabled *sessionTracker
+	assert.Nil(t, disabled.touch(context.TODO(), "token", start), desc)
+
+	desc = "test idle tokens are unauthenticated"
+	tracked := sessions
+	defer func() { sessions = tracked }()
+	sessions = tracker
+	storeErr = nil
+	activity["stale"] = time.Now().Add(-time.Hour)
+	assert.Equal(t, codes.Unauthenticated, status.Code(touchSession(context.TODO(), "stale")), desc)
+}
@@ -0,0 +1,35 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-lib/validation"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+)
+
+// sharedDocument is a document of user_svc.shared_documents listed by ListSharedWithMe
+type sharedDocument struct {
+	duid  string
+	owner string
+}
+
+const (
+	// maxShareRecipients bounds the users a document is shared with or unshared from per ShareDocument and
+	// UnshareDocument call
+	maxShareRecipients = 100
+)
+
+// validateShareRecipients checks uuids, the users a document is shared with, are between 1 and
+// maxShareRecipients valid uuids.
+// Returns ErrInvalidShareRecipients.
+func validateShareRecipients(uuids []string) error {
+	if len(uuids) == 0 || len(uuids) > maxShareRecipients {
+		return consts.ErrInvalidShareRecipients
+	}
+
+	for _, uuid := range uuids {
+		if err := validation.ValidateUserUUID(uuid); err != nil {
+			return consts.ErrInvalidShareRecipients
+		}
+	}
+
+	return nil
+}
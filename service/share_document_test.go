@@ -0,0 +1,35 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValidateShareRecipients(t *testing.T) {
+	uuid, _ := generateUUID()
+	tooMany := make([]string, maxShareRecipients+1)
+	for i := range tooMany {
+		tooMany[i] = uuid
+	}
+
+	cases := []struct {
+		desc     string
+		uuids    []string
+		isExpErr bool
+	}{
+		{"test valid recipients", []string{uuid}, false},
+		{"test no recipients", nil, true},
+		{"test invalid uuid", []string{uuid, "not a uuid"}, true},
+		{"test too many recipients", tooMany, true},
+	}
+
+	for _, c := range cases {
+		err := validateShareRecipients(c.uuids)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidShareRecipients.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+	}
+}
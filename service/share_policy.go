@@ -0,0 +1,27 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"strings"
+)
+
+const (
+	// sharePolicyNone shares new documents with nobody, organizations without a policy have it
+	sharePolicyNone = "none"
+
+	// sharePolicyOrganization shares new documents with every other member of the owner's organization.
+	// Shares are read-only, only owners change their documents. Members that join later are not shared
+	// documents registered before they joined.
+	sharePolicyOrganization = "organization"
+)
+
+// parseSharePolicy parses the x-hwsc-share-policy metadata value, case insensitive.
+// Returns ErrInvalidSharePolicy if value is not a policy.
+func parseSharePolicy(value string) (string, error) {
+	switch rule := strings.ToLower(value); rule {
+	case sharePolicyNone, sharePolicyOrganization:
+		return rule, nil
+	}
+
+	return "", consts.ErrInvalidSharePolicy
+}
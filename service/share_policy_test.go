@@ -0,0 +1,32 @@
+package service
+
+import (
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseSharePolicy(t *testing.T) {
+	cases := []struct {
+		desc     string
+		value    string
+		expRule  string
+		isExpErr bool
+	}{
+		{"test organization", "organization", sharePolicyOrganization, false},
+		{"test none", "none", sharePolicyNone, false},
+		{"test case insensitive", "Organization", sharePolicyOrganization, false},
+		{"test empty", "", "", true},
+		{"test unknown policy", "public", "", true},
+	}
+
+	for _, c := range cases {
+		rule, err := parseSharePolicy(c.value)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidSharePolicy.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.expRule, rule, c.desc)
+		}
+	}
+}
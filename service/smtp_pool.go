@@ -0,0 +1,161 @@
+package service
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// smtpPool keeps authenticated smtp connections alive between emails.
+// A connection is handed to one caller at a time, idle connections are closed after idleTimeout.
+type smtpPool struct {
+	lock        sync.Mutex
+	idle        []*pooledSMTPClient
+	maxIdle     int
+	idleTimeout time.Duration
+	dial        func() (*smtp.Client, error)
+}
+
+type pooledSMTPClient struct {
+	client   *smtp.Client
+	lastUsed time.Time
+}
+
+const (
+	maxIdleSMTPConnections = 4
+
+	// most smtp servers drop idle sessions after a few minutes
+	smtpIdleTimeout = 30 * time.Second
+)
+
+var (
+	emailPool = newSMTPPool(maxIdleSMTPConnections, smtpIdleTimeout, dialEmailHost)
+)
+
+func newSMTPPool(maxIdle int, idleTimeout time.Duration, dial func() (*smtp.Client, error)) *smtpPool {
+	return &smtpPool{
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+		dial:        dial,
+	}
+}
+
+// dialEmailHost connects and authenticates to conf.EmailHost the same way smtp.SendMail does.
+func dialEmailHost() (*smtp.Client, error) {
+	addr := fmt.Sprintf("%s:%s", conf.EmailHost.Host, conf.EmailHost.Port)
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: conf.EmailHost.Host}); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+
+	if ok, _ := client.Extension("AUTH"); ok && conf.EmailHost.Username != "" {
+		auth := smtp.PlainAuth("", conf.EmailHost.Username, conf.EmailHost.Password, conf.EmailHost.Host)
+		if err := client.Auth(auth); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// get returns an idle connection that still answers NOOP, or dials a new one.
+func (p *smtpPool) get() (*smtp.Client, error) {
+	for {
+		p.lock.Lock()
+		if len(p.idle) == 0 {
+			p.lock.Unlock()
+			return p.dial()
+		}
+		pooled := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.lock.Unlock()
+
+		if time.Since(pooled.lastUsed) < p.idleTimeout && pooled.client.Noop() == nil {
+			return pooled.client, nil
+		}
+		_ = pooled.client.Close()
+	}
+}
+
+// put returns a healthy connection to the pool, or closes it if the pool is full.
+func (p *smtpPool) put(client *smtp.Client) {
+	p.lock.Lock()
+	if len(p.idle) < p.maxIdle {
+		p.idle = append(p.idle, &pooledSMTPClient{client: client, lastUsed: time.Now()})
+		p.lock.Unlock()
+		return
+	}
+	p.lock.Unlock()
+
+	_ = client.Quit()
+}
+
+// discard closes a connection that hit an error, it is never reused.
+func (p *smtpPool) discard(client *smtp.Client) {
+	_ = client.Close()
+}
+
+// len returns the number of idle connections.
+func (p *smtpPool) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.idle)
+}
+
+// sendMails sends one message per recipient over a single pooled connection.
+// The connection is reset after a rejected recipient so the remaining mails can still be sent,
+// the first error is returned.
+func (p *smtpPool) sendMails(from string, recipients []string, msg func(recipient string) []byte) error {
+	client, err := p.get()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, recipient := range recipients {
+		if err := sendMail(client, from, recipient, msg(recipient)); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if client.Reset() != nil {
+				p.discard(client)
+				return firstErr
+			}
+		}
+	}
+
+	p.put(client)
+	return firstErr
+}
+
+func sendMail(client *smtp.Client, from string, recipient string, msg []byte) error {
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(recipient); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	return w.Close()
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// unitTestSMTPServer accepts mail for everyone except recipients starting with "reject"
+type unitTestSMTPServer struct {
+	lock        sync.Mutex
+	listener    net.Listener
+	connections int
+	messages    []string
+}
+
+func newUnitTestSMTPServer(t *testing.T) *unitTestSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	server := &unitTestSMTPServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.lock.Lock()
+			server.connections++
+			server.lock.Unlock()
+			go server.handle(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s *unitTestSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case strings.HasPrefix(command, "AUTH"):
+			reply("235 2.7.0 Authentication successful")
+		case strings.HasPrefix(command, "RCPT") && strings.Contains(command, "<REJECT"):
+			reply("550 5.1.1 No such user")
+		case strings.HasPrefix(command, "DATA"):
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			s.lock.Lock()
+			s.messages = append(s.messages, data.String())
+			s.lock.Unlock()
+			reply("250 2.0.0 Ok")
+		case strings.HasPrefix(command, "QUIT"):
+			reply("221 2.0.0 Bye")
+			return
+		default:
+			// MAIL, RCPT, RSET, NOOP
+			reply("250 2.0.0 Ok")
+		}
+	}
+}
+
+func (s *unitTestSMTPServer) stats() (int, []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.connections, append([]string(nil), s.messages...)
+}
+
+func TestSMTPPoolSendMails(t *testing.T) {
+	server := newUnitTestSMTPServer(t)
+	defer server.listener.Close()
+
+	dial := func() (*smtp.Client, error) {
+		client, err := smtp.Dial(server.listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		if err := client.Auth(smtp.PlainAuth("", "user", "password", "127.0.0.1")); err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	msg := func(recipient string) []byte {
+		return []byte("To: " + recipient + "\r\n\r\nHello World\r\n")
+	}
+
+	pool := newSMTPPool(1, time.Minute, dial)
+
+	desc := "test recipients share one connection"
+	err := pool.sendMails("hwsc@test.com", []string{"a@test.com", "b@test.com"}, msg)
+	assert.Nil(t, err, desc)
+	connections, messages := server.stats()
+	assert.Equal(t, 1, connections, desc)
+	assert.Equal(t, 2, len(messages), desc)
+	assert.Contains(t, messages[1], "To: b@test.com", desc)
+	assert.Equal(t, 1, pool.len(), desc)
+
+	desc = "test connection is reused across emails"
+	err = pool.sendMails("hwsc@test.com", []string{"c@test.com"}, msg)
+	assert.Nil(t, err, desc)
+	connections, messages = server.stats()
+	assert.Equal(t, 1, connections, desc)
+	assert.Equal(t, 3, len(messages), desc)
+
+	desc = "test rejected recipient does not stop remaining recipients"
+	err = pool.sendMails("hwsc@test.com", []string{"reject@test.com", "d@test.com"}, msg)
+	assert.NotNil(t, err, desc)
+	assert.Contains(t, err.Error(), "No such user", desc)
+	connections, messages = server.stats()
+	assert.Equal(t, 1, connections, desc)
+	assert.Equal(t, 4, len(messages), desc)
+	assert.Equal(t, 1, pool.len(), desc)
+
+	desc = "test pool over capacity closes the extra connection"
+	first, err := pool.get()
+	assert.Nil(t, err, desc)
+	second, err := pool.get()
+	assert.Nil(t, err, desc)
+	pool.put(first)
+	pool.put(second)
+	assert.Equal(t, 1, pool.len(), desc)
+
+	desc = "test expired idle connection is replaced"
+	pool.idle[0].lastUsed = time.Now().Add(-2 * time.Minute)
+	err = pool.sendMails("hwsc@test.com", []string{"e@test.com"}, msg)
+	assert.Nil(t, err, desc)
+	connections, _ = server.stats()
+	assert.Equal(t, 3, connections, desc)
+
+	desc = "test dial error"
+	server.listener.Close()
+	pool = newSMTPPool(1, time.Minute, dial)
+	err = pool.sendMails("hwsc@test.com", []string{"f@test.com"}, msg)
+	assert.NotNil(t, err, desc)
+}
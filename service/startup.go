@@ -0,0 +1,280 @@
+package service
+
+import (
+	"fmt"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"io/fs"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+var (
+	// templateDataKeys are the keys of the data every email template is executed with
+	templateDataKeys = map[string][]string{
+		templateVerifyEmail:        {verificationLinkKey, firstNameKey},
+		templateConfirmEmailChange: {verificationLinkKey},
+		templateParentalConsent:    {verificationLinkKey, childNameKey},
+		templateSecurityAlert:      {countryKey, loginTimeKey},
+		templateVerifyLoginCountry: {verificationLinkKey, countryKey, loginTimeKey},
+		templatePasswordExpiry:     {expirationDateKey},
+		templatePasswordReset:      {verificationLinkKey},
+	}
+
+	// sslModes are the sslmode values accepted by lib/pq
+	sslModes = map[string]bool{
+		"disable":     true,
+		"require":     true,
+		"verify-ca":   true,
+		"verify-full": true,
+	}
+
+	// listenNetworks are the networks the grpc listener may bind, addresses are ip and port
+	listenNetworks = map[string]bool{
+		"tcp":  true,
+		"tcp4": true,
+		"tcp6": true,
+	}
+
+	// hostNameRegex matches RFC 1123 host names such as "localhost" or "user-svc.hwsc.com"
+	hostNameRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+	// startupProblems are recorded by init functions, so a misconfigured instance reports every problem at once
+	startupProblems []string
+)
+
+// reportStartupProblem records a configuration problem found by an init function, the config value is left at
+// its default. CheckStartup fails with every problem recorded.
+func reportStartupProblem(problem ...string) {
+	startupProblems = append(startupProblems, strings.Join(problem, " "))
+}
+
+// CheckStartup parses every email template, verifies the variables they reference are set when they are sent,
+// and validates the configuration read from env vars and the config file. Every problem found is logged before returning.
+// Returns ErrInvalidStartup if there is any problem, the service should not start.
+func CheckStartup() error {
+	problems := append([]string{}, conf.LoadProblems...)
+	problems = append(problems, startupProblems...)
+	problems = append(problems, checkTemplates(templateFiles)...)
+	problems = append(problems, checkHosts()...)
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	for _, problem := range problems {
+		logger.Error(consts.UserServiceTag, problem)
+	}
+
+	return consts.ErrInvalidStartup
+}
+
+// checkTemplates returns a problem for every email template of templateDataKeys missing from fsys,
+// failing to parse, or referencing a variable it is not sent with, and for every unknown template.
+// Plain text templates are checked against the variables of the html template of the same name.
+func checkTemplates(fsys fs.FS) []string {
+	files, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return []string{fmt.Sprintf("Failed to read email templates: %s", err.Error())}
+	}
+
+	var problems []string
+	partials := []string{}
+	found := make(map[string]bool)
+	var texts []string
+	for _, file := range files {
+		switch {
+		case strings.HasSuffix(file.Name(), ".tmpl"):
+			partials = append(partials, file.Name())
+		case strings.HasSuffix(file.Name(), ".html"):
+			found[file.Name()] = true
+			if _, ok := templateDataKeys[file.Name()]; !ok {
+				problems = append(problems, fmt.Sprintf("Unknown email template %s", file.Name()))
+			}
+		case strings.HasSuffix(file.Name(), ".txt"):
+			// a plain text template is executed with the data of its html template
+			if _, ok := templateDataKeys[htmlTemplateName(file.Name())]; !ok {
+				problems = append(problems, fmt.Sprintf("Unknown email template %s", file.Name()))
+				continue
+			}
+			texts = append(texts, file.Name())
+		}
+	}
+
+	names := make([]string, 0, len(templateDataKeys))
+	for name := range templateDataKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !found[name] {
+			problems = append(problems, fmt.Sprintf("Missing email template %s", name))
+			continue
+		}
+
+		problems = append(problems, checkTemplateFields(fsys, append([]string{name}, partials...),
+			templateDataKeys[name])...)
+	}
+
+	for _, name := range texts {
+		problems = append(problems, checkTemplateFields(fsys, []string{name},
+			templateDataKeys[htmlTemplateName(name)])...)
+	}
+
+	return problems
+}
+
+// checkTemplateFields returns a problem if the email template of files, the first file, fails to parse,
+// or for every variable it references that is not one of keys.
+func checkTemplateFields(fsys fs.FS, files []string, keys []string) []string {
+	name := files[0]
+	parsed, err := template.ParseFS(fsys, files...)
+	if err != nil {
+		return []string{fmt.Sprintf("Invalid email template %s: %s", name, err.Error())}
+	}
+
+	allowed := make(map[string]bool)
+	for _, key := range keys {
+		allowed[key] = true
+	}
+
+	referenced := make(map[string]bool)
+	for _, t := range parsed.Templates() {
+		if t.Tree != nil {
+			templateFields(t.Tree.Root, referenced)
+		}
+	}
+
+	var problems []string
+	for _, field := range sortedKeys(referenced) {
+		if !allowed[field] {
+			problems = append(problems, fmt.Sprintf("Email template %s references unknown variable %s", name, field))
+		}
+	}
+
+	return problems
+}
+
+// templateFields adds the top level fields referenced by node and its children to fields.
+func templateFields(node parse.Node, fields map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			templateFields(child, fields)
+		}
+	case *parse.ActionNode:
+		templateFields(n.Pipe, fields)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			templateFields(cmd, fields)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			templateFields(arg, fields)
+		}
+	case *parse.FieldNode:
+		fields[n.Ident[0]] = true
+	case *parse.IfNode:
+		templateFields(n.Pipe, fields)
+		templateFields(n.List, fields)
+		templateFields(n.ElseList, fields)
+	case *parse.RangeNode:
+		templateFields(n.Pipe, fields)
+		templateFields(n.List, fields)
+		templateFields(n.ElseList, fields)
+	case *parse.WithNode:
+		templateFields(n.Pipe, fields)
+		templateFields(n.List, fields)
+		templateFields(n.ElseList, fields)
+	case *parse.TemplateNode:
+		templateFields(n.Pipe, fields)
+	}
+}
+
+// checkHosts returns a problem for every invalid port, postgres setting or endpoint url of conf.
+func checkHosts() []string {
+	var problems []string
+
+	ports := []struct {
+		name  string
+		value string
+	}{
+		{"grpc", conf.GRPCHost.Port},
+		{"postgres", conf.UserDB.Port},
+		{"smtp", conf.EmailHost.Port},
+	}
+	for _, p := range ports {
+		if port, err := strconv.Atoi(p.value); err != nil || port < 1 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("Invalid %s port: %q", p.name, p.value))
+		}
+	}
+
+	problems = append(problems, checkListenAddress(conf.GRPCHost.Network, conf.GRPCHost.Address)...)
+
+	if conf.UserDB.Host == "" || conf.UserDB.User == "" || conf.UserDB.Name == "" {
+		problems = append(problems, "Postgres host, user and db are required")
+	}
+	if !sslModes[conf.UserDB.SSLMode] {
+		problems = append(problems, fmt.Sprintf("Invalid postgres sslmode: %q", conf.UserDB.SSLMode))
+	}
+
+	endpoints := []struct {
+		name  string
+		value string
+	}{
+		{"mailing list", conf.MailingListHost.Address},
+		{"event sink", conf.EventSinkHost.Address},
+		{"billing", conf.BillingHost.Address},
+		{"analytics", conf.AnalyticsHost.Address},
+		{"geoip", conf.GeoIPHost.Address},
+	}
+	for _, e := range endpoints {
+		if e.value == "" {
+			continue
+		}
+		if parsed, err := url.Parse(e.value); err != nil || parsed.Host == "" ||
+			(parsed.Scheme != "http" && parsed.Scheme != "https") {
+			problems = append(problems, fmt.Sprintf("Invalid %s address: %q", e.name, e.value))
+		}
+	}
+
+	return problems
+}
+
+// checkListenAddress returns a problem if the grpc listener cannot bind address on network.
+// The address is an ip or a host name, empty binds every interface.
+func checkListenAddress(network string, address string) []string {
+	var problems []string
+	if !listenNetworks[network] {
+		problems = append(problems, fmt.Sprintf("Invalid grpc network: %q", network))
+	}
+	if address != "" && net.ParseIP(address) == nil && !hostNameRegex.MatchString(address) {
+		problems = append(problems, fmt.Sprintf("Invalid grpc address: %q", address))
+	}
+
+	return problems
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"fmt"
+	"github.com/hwsc-org/hwsc-user-svc/tmpl"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCheckTemplates(t *testing.T) {
+	desc := "test shipped templates"
+	assert.Empty(t, checkTemplates(tmpl.Files), desc)
+
+	dir, err := ioutil.TempDir("", "templates")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"header.tmpl":              `{{ define "header" }}<html>{{ end }}`,
+		templateVerifyEmail:        `{{ template "header" }}<a href="{{.VERIFICATION_LINK}}">{{ if .CHILD_NAME }}{{.CHILD_NAME}}{{ end }}</a>`,
+		templateConfirmEmailChange: `{{ template "header" }}{{ .VERIFICATION_LINK`,
+		templateParentalConsent:    `{{ template "header" }}{{.CHILD_NAME}} {{.VERIFICATION_LINK}}`,
+		templateSecurityAlert:      `{{ template "header" }}{{.COUNTRY}} {{.LOGIN_TIME}}`,
+		templateVerifyLoginCountry: `{{ template "header" }}{{.COUNTRY}} {{.LOGIN_TIME}} {{.VERIFICATION_LINK}}`,
+		templatePasswordExpiry:     `{{ template "header" }}{{.EXPIRATION_DATE}}`,
+		templatePasswordReset:      `{{ template "header" }}{{.VERIFICATION_LINK}}`,
+		"welcome.html":             `{{ template "header" }}`,
+		"welcome.txt":              `Welcome`,
+
+		textTemplateName(templateVerifyEmail): `{{.FIRST_NAME}} {{.CHILD_NAME}}`,
+	}
+	for name, content := range files {
+		assert.Nil(t, ioutil.WriteFile(fmt.Sprintf("%s/%s", dir, name), []byte(content), 0600))
+	}
+
+	desc = "test every problem is reported"
+	problems := checkTemplates(os.DirFS(dir))
+	assert.Len(t, problems, 5, desc)
+	assert.Contains(t, problems, "Unknown email template welcome.html", desc)
+	assert.Contains(t, problems, "Unknown email template welcome.txt", desc)
+	assert.Contains(t, problems, fmt.Sprintf("Email template %s references unknown variable CHILD_NAME",
+		templateVerifyEmail), desc)
+	assert.Contains(t, problems, fmt.Sprintf("Email template %s references unknown variable CHILD_NAME",
+		textTemplateName(templateVerifyEmail)), desc)
+	assert.Contains(t, problems[2], fmt.Sprintf("Invalid email template %s", templateConfirmEmailChange), desc)
+
+	desc = "test missing template"
+	assert.Nil(t, os.Remove(fmt.Sprintf("%s/%s", dir, templateParentalConsent)))
+	assert.Contains(t, checkTemplates(os.DirFS(dir)), fmt.Sprintf("Missing email template %s", templateParentalConsent), desc)
+
+	desc = "test missing directory"
+	assert.Len(t, checkTemplates(os.DirFS(fmt.Sprintf("%s/missing", dir))), 1, desc)
+}
+
+func TestCheckListenAddress(t *testing.T) {
+	cases := []struct {
+		desc     string
+		network  string
+		address  string
+		problems int
+	}{
+		{"test every interface", "tcp", "", 0},
+		{"test ipv4 wildcard", "tcp", "0.0.0.0", 0},
+		{"test ipv6 address", "tcp6", "::1", 0},
+		{"test host name", "tcp4", "user-svc.hwsc.com", 0},
+		{"test address with port", "tcp", "localhost:50052", 1},
+		{"test invalid host name", "tcp", "-user svc", 1},
+		{"test invalid network", "udp", "localhost", 1},
+		{"test every problem is reported", "", "host/name", 2},
+	}
+
+	for _, c := range cases {
+		assert.Len(t, checkListenAddress(c.network, c.address), c.problems, c.desc)
+	}
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"encoding/json"
+	"golang.org/x/net/context"
+	"strconv"
+	"time"
+)
+
+// userStats are the aggregates returned by GetUserStats
+type userStats struct {
+	signups        []dailySignups
+	activeSessions int64
+	organizations  []organizationUsers
+	emailsSent     int64
+	emailsFailed   int64
+}
+
+// dailySignups counts the users created on day (UTC), and how many of them have since verified their email
+type dailySignups struct {
+	day      time.Time
+	users    int64
+	verified int64
+}
+
+// organizationUsers is returned as JSON in the x-hwsc-organization-users-bin response header
+type organizationUsers struct {
+	Organization string `json:"organization"`
+	Users        int64  `json:"users"`
+}
+
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+
+	statsDayLayout = "2006-01-02"
+)
+
+// verificationRate is the fraction of users created in the window that verified their email.
+func (s *userStats) verificationRate() float64 {
+	var users, verified int64
+	for _, signups := range s.signups {
+		users += signups.users
+		verified += signups.verified
+	}
+
+	return ratio(verified, users)
+}
+
+// emailFailureRate is the fraction of email sends in the window that failed.
+func (s *userStats) emailFailureRate() float64 {
+	return ratio(s.emailsFailed, s.emailsSent)
+}
+
+// setResponseHeaders returns the aggregates as response headers, see Service.GetUserStats.
+func (s *userStats) setResponseHeaders(ctx context.Context) error {
+	signups := make([]string, 0, len(s.signups))
+	for _, day := range s.signups {
+		signups = append(signups, day.day.Format(statsDayLayout)+"="+strconv.FormatInt(day.users, 10))
+	}
+	if len(signups) > 0 {
+		if err := setResponseHeader(ctx, metadataKeySignups, signups...); err != nil {
+			return err
+		}
+	}
+
+	organizations := make([]string, 0, len(s.organizations))
+	for _, users := range s.organizations {
+		encoded, err := json.Marshal(users)
+		if err != nil {
+			return err
+		}
+		organizations = append(organizations, string(encoded))
+	}
+	if len(organizations) > 0 {
+		if err := setResponseHeader(ctx, metadataKeyOrganizationUsers, organizations...); err != nil {
+			return err
+		}
+	}
+
+	if err := setResponseHeader(ctx, metadataKeyVerificationRate, formatRate(s.verificationRate())); err != nil {
+		return err
+	}
+	if err := setResponseHeader(ctx, metadataKeyActiveSessions, strconv.FormatInt(s.activeSessions, 10)); err != nil {
+		return err
+	}
+
+	return setResponseHeader(ctx, metadataKeyEmailFailureRate, formatRate(s.emailFailureRate()))
+}
+
+// ratio returns part/whole, or 0 if whole is 0.
+func ratio(part int64, whole int64) float64 {
+	if whole == 0 {
+		return 0
+	}
+
+	return float64(part) / float64(whole)
+}
+
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'f', 4, 64)
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestUserStats(t *testing.T) {
+	day := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	stats := &userStats{
+		signups: []dailySignups{
+			{day: day, users: 3, verified: 1},
+			{day: day.AddDate(0, 0, 1), users: 0, verified: 0},
+			{day: day.AddDate(0, 0, 2), users: 1, verified: 1},
+		},
+		activeSessions: 5,
+		organizations: []organizationUsers{
+			{Organization: "Ünïcode Org", Users: 3},
+			{Organization: "", Users: 1},
+		},
+		emailsSent:   8,
+		emailsFailed: 2,
+	}
+
+	desc := "test rates"
+	assert.Equal(t, 0.5, stats.verificationRate(), desc)
+	assert.Equal(t, 0.25, stats.emailFailureRate(), desc)
+
+	desc = "test response headers"
+	ctx, stream := unitTestServerContext()
+	assert.Nil(t, stats.setResponseHeaders(ctx), desc)
+	assert.Equal(t, []string{"2019-07-01=3", "2019-07-02=0", "2019-07-03=1"},
+		stream.header.Get(metadataKeySignups), desc)
+	assert.Equal(t, []string{"0.5000"}, stream.header.Get(metadataKeyVerificationRate), desc)
+	assert.Equal(t, []string{"5"}, stream.header.Get(metadataKeyActiveSessions), desc)
+	assert.Equal(t, []string{"0.2500"}, stream.header.Get(metadataKeyEmailFailureRate), desc)
+
+	var organizations []organizationUsers
+	for _, value := range stream.header.Get(metadataKeyOrganizationUsers) {
+		users := organizationUsers{}
+		assert.Nil(t, json.Unmarshal([]byte(value), &users), desc)
+		organizations = append(organizations, users)
+	}
+	assert.Equal(t, stats.organizations, organizations, desc)
+
+	desc = "test empty stats"
+	ctx, stream = unitTestServerContext()
+	assert.Nil(t, (&userStats{}).setResponseHeaders(ctx), desc)
+	assert.Empty(t, stream.header.Get(metadataKeySignups), desc)
+	assert.Equal(t, []string{"0.0000"}, stream.header.Get(metadataKeyVerificationRate), desc)
+	assert.Equal(t, []string{"0"}, stream.header.Get(metadataKeyActiveSessions), desc)
+	assert.Equal(t, []string{"0.0000"}, stream.header.Get(metadataKeyEmailFailureRate), desc)
+}
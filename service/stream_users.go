@@ -0,0 +1,145 @@
+package service
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"strconv"
+)
+
+// streamUsersServer is the server side of a StreamUsers stream, the users are sent in UserResponses of up to
+// a chunk of users each.
+type streamUsersServer interface {
+	Context() context.Context
+	Send(*pbsvc.UserResponse) error
+}
+
+// streamUsersStream adapts a grpc.ServerStream to streamUsersServer
+type streamUsersStream struct {
+	grpc.ServerStream
+}
+
+const (
+	defaultStreamUsersChunkSize = 500
+	maxStreamUsersChunkSize     = 5000
+)
+
+var (
+	// streamUsersStreamDesc is the StreamUsers rpc of the v2 service, StreamInterceptor runs before it,
+	// the unary interceptors do not
+	streamUsersStreamDesc = grpc.StreamDesc{
+		StreamName:    "StreamUsers",
+		Handler:       streamUsersHandler,
+		ServerStreams: true,
+	}
+
+	// streamUsersChunkSize is set with hosts_export_chunksize
+	streamUsersChunkSize = defaultStreamUsersChunkSize
+)
+
+func init() {
+	chunkSize, err := parseChunkSize(conf.Export.ChunkSize, defaultStreamUsersChunkSize)
+	if err != nil {
+		reportStartupProblem("Invalid export chunk size:", conf.Export.ChunkSize)
+		return
+	}
+	streamUsersChunkSize = chunkSize
+}
+
+func (s *streamUsersStream) Send(response *pbsvc.UserResponse) error {
+	return s.ServerStream.SendMsg(response)
+}
+
+func streamUsersHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := &pbsvc.UserRequest{}
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+
+	return srv.(*Service).StreamUsers(req, &streamUsersStream{stream})
+}
+
+// parseChunkSize parses the number of users per StreamUsers response, empty defaults to def.
+// Returns ErrInvalidChunkSize if value is not a number from 1 to maxStreamUsersChunkSize.
+func parseChunkSize(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	chunkSize, err := strconv.Atoi(value)
+	if err != nil || chunkSize <= 0 || chunkSize > maxStreamUsersChunkSize {
+		return 0, consts.ErrInvalidChunkSize
+	}
+
+	return chunkSize, nil
+}
+
+// StreamUsers streams every user matching the ListUsers filters, for admin exports too large to page through.
+// It requires an admin auth token. The users are read off a database cursor and sent in uuid order,
+// x-hwsc-chunk-size users (defaults to hosts_export_chunksize, up to 5000) per UserResponse, with passwords
+// left out. The stream ends with an OK status after the last user, and the cursor is closed as soon as the
+// client disconnects or cancels.
+// Returns an error status, ending the stream, if the request is not valid, the service is unavailable,
+// or reading or sending the users fails.
+func (s *Service) StreamUsers(req *pbsvc.UserRequest, stream streamUsersServer) error {
+	logger.RequestService("StreamUsers")
+
+	ctx := stream.Context()
+
+	if ok := serviceStateLocker.isStateAvailable(); !ok {
+		logger.Error(consts.StreamUsersTag, consts.ErrServiceUnavailable.Error())
+		return consts.ErrStatusServiceUnavailable
+	}
+
+	// the stream skips ValidationInterceptor
+	if violations := validateTokenRequest(req); len(violations) > 0 {
+		for _, violation := range violations {
+			logger.Error(consts.ValidationTag, "StreamUsers", violation.GetField(), violation.GetDescription())
+		}
+		return badRequestStatus(violations)
+	}
+
+	filter, err := parseUserListFilter(ctx)
+	if err != nil {
+		logger.Error(consts.StreamUsersTag, err.Error())
+		return statusFromError(err)
+	}
+
+	chunkSize, err := parseChunkSize(getIncomingMetadata(ctx, metadataKeyChunkSize), streamUsersChunkSize)
+	if err != nil {
+		logger.Error(consts.StreamUsersTag, err.Error())
+		return statusFromError(err)
+	}
+
+	if err := refreshDBConnection(); err != nil {
+		logger.Error(consts.StreamUsersTag, consts.ErrDBConnectionError.Error())
+		return statusFromError(err)
+	}
+
+	// the export spans every user, only admins may read it
+	if err := authorizeAdmin(ctx, req.GetIdentification().GetToken(), "StreamUsers", filter.organization); err != nil {
+		logger.Error(consts.StreamUsersTag, consts.MsgErrValidatingIdentity, err.Error())
+		return err
+	}
+
+	sent, err := streamUsers(ctx, filter, chunkSize, func(users []*pblib.User) error {
+		return stream.Send(&pbsvc.UserResponse{
+			Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+			Message:        codes.OK.String(),
+			UserCollection: users,
+		})
+	})
+	if err != nil {
+		logger.Error(consts.StreamUsersTag, consts.MsgErrStreamUsers, strconv.FormatInt(sent, 10), "users sent",
+			err.Error())
+		return statusFromError(err)
+	}
+
+	logger.Info(consts.StreamUsersTag, "Streamed", strconv.FormatInt(sent, 10), "users")
+	return nil
+}
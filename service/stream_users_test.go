@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+// unitTestStreamUsersStream collects the responses of a StreamUsers stream
+type unitTestStreamUsersStream struct {
+	ctx       context.Context
+	responses []*pbsvc.UserResponse
+}
+
+func (s *unitTestStreamUsersStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *unitTestStreamUsersStream) Send(response *pbsvc.UserResponse) error {
+	s.responses = append(s.responses, response)
+	return nil
+}
+
+func TestParseChunkSize(t *testing.T) {
+	cases := []struct {
+		value        string
+		expChunkSize int
+		expErr       error
+	}{
+		{"", defaultStreamUsersChunkSize, nil},
+		{"1", 1, nil},
+		{"5000", maxStreamUsersChunkSize, nil},
+		{"5001", 0, consts.ErrInvalidChunkSize},
+		{"0", 0, consts.ErrInvalidChunkSize},
+		{"-1", 0, consts.ErrInvalidChunkSize},
+		{"many", 0, consts.ErrInvalidChunkSize},
+	}
+
+	for _, c := range cases {
+		chunkSize, err := parseChunkSize(c.value, defaultStreamUsersChunkSize)
+		assert.Equal(t, c.expErr, err, c.value)
+		assert.Equal(t, c.expChunkSize, chunkSize, c.value)
+	}
+}
+
+func TestStreamUsersRefused(t *testing.T) {
+	defer func() { serviceStateLocker.currentServiceState = available }()
+
+	s := Service{}
+	token := &pblib.Identification{Token: "TestStreamUsersRefused"}
+
+	desc := "test unavailable service"
+	serviceStateLocker.currentServiceState = unavailable
+	err := s.StreamUsers(&pbsvc.UserRequest{Identification: token}, &unitTestStreamUsersStream{ctx: context.TODO()})
+	assert.Equal(t, codes.Unavailable, status.Code(err), desc)
+	serviceStateLocker.currentServiceState = available
+
+	desc = "test missing token"
+	err = s.StreamUsers(&pbsvc.UserRequest{}, &unitTestStreamUsersStream{ctx: context.TODO()})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), desc)
+
+	desc = "test invalid chunk size"
+	ctx, _ := unitTestServerContext(metadataKeyChunkSize, "0")
+	stream := &unitTestStreamUsersStream{ctx: ctx}
+	err = s.StreamUsers(&pbsvc.UserRequest{Identification: token}, stream)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), desc)
+	assert.Empty(t, stream.responses, desc)
+}
+
+func TestStreamUsers(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	const organization = "TestStreamUsers"
+	s := Service{}
+
+	var uuids []string
+	for _, lastName := range []string{"StreamUsers-One", "StreamUsers-Two", "StreamUsers-Three"} {
+		user := unitTestUserGenerator(lastName)
+		user.Organization = organization
+		resp, err := s.CreateUser(context.TODO(), &pbsvc.UserRequest{User: user})
+		assert.Nil(t, err)
+		uuids = append(uuids, resp.GetUser().GetUuid())
+	}
+
+	newSecret, userToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err)
+	header := &auth.Header{Alg: auth.Hs512, TokenTyp: auth.Jwt}
+	body := &auth.Body{
+		UUID:                auth.ExtractUUID(userToken),
+		Permission:          auth.Admin,
+		ExpirationTimestamp: validNoUUIDAuthTokenBody.ExpirationTimestamp,
+	}
+	adminToken, err := auth.NewToken(header, body, newSecret)
+	assert.Nil(t, err)
+	assert.Nil(t, insertAuthToken(context.TODO(), adminToken, header, body, newSecret))
+	admin := &pblib.Identification{Token: adminToken}
+
+	desc := "test user token cannot stream users"
+	ctx, _ := unitTestServerContext(metadataKeyOrganization, organization)
+	stream := &unitTestStreamUsersStream{ctx: ctx}
+	err = s.StreamUsers(&pbsvc.UserRequest{Identification: &pblib.Identification{Token: userToken}}, stream)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+	assert.Empty(t, stream.responses, desc)
+
+	desc = "test users are streamed in chunks"
+	ctx, _ = unitTestServerContext(metadataKeyOrganization, organization, metadataKeyChunkSize, "2")
+	stream = &unitTestStreamUsersStream{ctx: ctx}
+	assert.Nil(t, s.StreamUsers(&pbsvc.UserRequest{Identification: admin}, stream), desc)
+	if assert.Equal(t, 2, len(stream.responses), desc) {
+		assert.Equal(t, 2, len(stream.responses[0].GetUserCollection()), desc)
+		assert.Equal(t, 1, len(stream.responses[1].GetUserCollection()), desc)
+	}
+	var streamed []string
+	for _, response := range stream.responses {
+		assert.Equal(t, uint32(codes.OK), response.GetCode(), desc)
+		for _, user := range response.GetUserCollection() {
+			assert.Empty(t, user.GetPassword(), desc)
+			streamed = append(streamed, user.GetUuid())
+		}
+	}
+	assert.ElementsMatch(t, uuids, streamed, desc)
+
+	desc = "test canceled stream"
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	stream = &unitTestStreamUsersStream{ctx: canceled}
+	err = s.StreamUsers(&pbsvc.UserRequest{Identification: admin}, stream)
+	assert.NotNil(t, err, desc)
+	assert.Empty(t, stream.responses, desc)
+}
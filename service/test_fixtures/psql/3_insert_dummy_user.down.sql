@@ -1,3 +0,0 @@
-DELETE
-FROM user_svc.accounts
-WHERE uuid = '01d793kwwv8ncaamd1b3yr5w48';
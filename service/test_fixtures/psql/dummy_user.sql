@@ -1,6 +1,11 @@
+-- accounts may only name existing organizations since migration 37
+INSERT INTO user_svc.organizations(name, created_timestamp)
+VALUES ('HWSC', '2019-03-31 05:45:17.266119 +0000')
+ON CONFLICT DO NOTHING;
+
 INSERT INTO user_svc.accounts(uuid, first_name, last_name, email,
                               password,
-                              organization, created_timestamp, is_verified, permission_level)
+                              organization, created_timestamp, is_verified, permission_level, referral_code)
 VALUES ('01d793kwwv8ncaamd1b3yr5w48', 'DummyFirstName', 'DummyLastName', 'hwss2018@outlook.com',
         '$2a$04$2fjictug3Q6Q1AHY1BnhA.45VqX2q39VrL0w36X1ucvARqR/NuH3y',
-        'HWSC', '2019-03-31 05:45:17.266119 +0000', true, 'USER_REGISTRATION');
+        'HWSC', '2019-03-31 05:45:17.266119 +0000', true, 'USER_REGISTRATION', 'HWSC000000');
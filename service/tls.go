@@ -0,0 +1,128 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"google.golang.org/grpc/credentials"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// tlsFiles serves the certificate of the grpc listener and, with mutual TLS, the CAs client certificates must be
+// signed by. Handshakes read the files last loaded, so reloading them does not drop open connections.
+type tlsFiles struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	lock        sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+var (
+	// listenerTLS is nil when the listener is plaintext
+	listenerTLS *tlsFiles
+)
+
+func init() {
+	if conf.TLS.CertFile == "" && conf.TLS.KeyFile == "" && conf.TLS.ClientCAFile == "" {
+		return
+	}
+
+	if conf.TLS.CertFile == "" || conf.TLS.KeyFile == "" {
+		reportStartupProblem("TLS requires both a certificate and a key file")
+		return
+	}
+
+	files := &tlsFiles{
+		certFile:     conf.TLS.CertFile,
+		keyFile:      conf.TLS.KeyFile,
+		clientCAFile: conf.TLS.ClientCAFile,
+	}
+	if err := files.load(); err != nil {
+		reportStartupProblem("Invalid TLS files:", err.Error())
+		return
+	}
+	listenerTLS = files
+
+	// renew certificates on SIGHUP, a failed reload keeps serving the files loaded before
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			if err := listenerTLS.load(); err != nil {
+				logger.Error(consts.TLSTag, "Failed to reload TLS files:", err.Error())
+				continue
+			}
+			logger.Info(consts.TLSTag, "Reloaded TLS files")
+		}
+	}()
+
+	logger.Info(consts.TLSTag, "Serving TLS, client certificates required:", fmt.Sprint(files.clientCAFile != ""))
+}
+
+// TransportCredentials returns the credentials of the grpc listener, or nil if it is plaintext.
+func TransportCredentials() credentials.TransportCredentials {
+	if listenerTLS == nil {
+		return nil
+	}
+
+	return credentials.NewTLS(&tls.Config{GetConfigForClient: listenerTLS.config})
+}
+
+// load reads the certificate, key and client CA files and replaces the files served to new handshakes.
+// Returns error if a file cannot be read, the key does not match the certificate or the client CA file has
+// no certificates, the files served before are kept.
+func (f *tlsFiles) load() error {
+	certificate, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if f.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(f.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return consts.ErrInvalidClientCA
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.certificate = &certificate
+	f.clientCAs = clientCAs
+
+	return nil
+}
+
+// config returns the tls.Config of a handshake, with the files last loaded.
+func (f *tlsFiles) config(*tls.ClientHelloInfo) (*tls.Config, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*f.certificate},
+		MinVersion:   tls.VersionTLS12,
+		// grpc requires http/2
+		NextProtos: []string{"h2"},
+	}
+	if f.clientCAs != nil {
+		config.ClientCAs = f.clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
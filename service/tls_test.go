@@ -0,0 +1,101 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+// unitTestWriteCertificate writes a self-signed certificate for commonName and its key to dir.
+// Returns the paths of the certificate and key files.
+func unitTestWriteCertificate(t *testing.T, dir string, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certFile := fmt.Sprintf("%s/%s.crt", dir, commonName)
+	keyFile := fmt.Sprintf("%s/%s.key", dir, commonName)
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	return certFile, keyFile
+}
+
+func TestTLSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := unitTestWriteCertificate(t, dir, "first")
+	servedName := func(files *tlsFiles) string {
+		config, err := files.config(&tls.ClientHelloInfo{})
+		assert.Nil(t, err)
+		leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		assert.Nil(t, err)
+		return leaf.Subject.CommonName
+	}
+
+	desc := "test load without client ca"
+	files := &tlsFiles{certFile: certFile, keyFile: keyFile}
+	assert.Nil(t, files.load(), desc)
+	config, err := files.config(&tls.ClientHelloInfo{})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth, desc)
+	assert.Equal(t, "first", servedName(files), desc)
+
+	desc = "test mutual tls"
+	clientCAFile, _ := unitTestWriteCertificate(t, dir, "clients")
+	files.clientCAFile = clientCAFile
+	assert.Nil(t, files.load(), desc)
+	config, err = files.config(&tls.ClientHelloInfo{})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth, desc)
+	assert.NotNil(t, config.ClientCAs, desc)
+
+	desc = "test reload serves the renewed certificate"
+	renewedCert, renewedKey := unitTestWriteCertificate(t, dir, "renewed")
+	assert.Nil(t, os.Rename(renewedCert, certFile), desc)
+	assert.Nil(t, os.Rename(renewedKey, keyFile), desc)
+	assert.Nil(t, files.load(), desc)
+	assert.Equal(t, "renewed", servedName(files), desc)
+
+	desc = "test failed reload keeps the loaded files"
+	assert.Nil(t, ioutil.WriteFile(clientCAFile, []byte("not a certificate"), 0600), desc)
+	assert.EqualError(t, files.load(), consts.ErrInvalidClientCA.Error(), desc)
+	assert.Equal(t, "renewed", servedName(files), desc)
+
+	desc = "test key not matching the certificate"
+	_, otherKey := unitTestWriteCertificate(t, dir, "other")
+	files = &tlsFiles{certFile: certFile, keyFile: otherKey}
+	assert.NotNil(t, files.load(), desc)
+
+	desc = "test missing files"
+	files = &tlsFiles{certFile: dir + "/missing.crt", keyFile: keyFile}
+	assert.NotNil(t, files.load(), desc)
+}
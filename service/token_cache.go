@@ -0,0 +1,171 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"github.com/golang/protobuf/proto"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"sync"
+	"time"
+)
+
+// tokenCache is a bounded LRU of token to identification (token and secret) lookups.
+// Entries expire after ttl so a revoked token is honored for at most ttl on other instances.
+type tokenCache struct {
+	lock     sync.Mutex
+	capacity int
+	ttl      time.Duration
+	entries  *list.List
+	byToken  map[string]*list.Element
+}
+
+type tokenCacheEntry struct {
+	token      string
+	uuid       string
+	identity   *pblib.Identification
+	expiration time.Time
+}
+
+const (
+	defaultTokenCacheSize = 10000
+	defaultTokenCacheTTL  = 30 * time.Second
+)
+
+var (
+	// authTokenCache takes postgres off VerifyAuthToken's hot path, sized with hosts_cache_tokensize and
+	// hosts_cache_tokenttl
+	authTokenCache = newTokenCache(defaultTokenCacheSize, defaultTokenCacheTTL)
+)
+
+func init() {
+	size, ttl, ok := parseMemoryCache(conf.Caches.TokenSize, conf.Caches.TokenTTL, defaultTokenCacheSize)
+	if !ok {
+		reportStartupProblem("Invalid token cache:", "tokensize="+conf.Caches.TokenSize,
+			"tokenttl="+conf.Caches.TokenTTL)
+		return
+	}
+	authTokenCache = newTokenCache(size, ttl)
+}
+
+func newTokenCache(capacity int, ttl time.Duration) *tokenCache {
+	return &tokenCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  list.New(),
+		byToken:  make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of the cached identification, expired entries are removed and reported as a miss.
+func (c *tokenCache) get(token string) (*pblib.Identification, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.byToken[token]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*tokenCacheEntry)
+	if time.Now().After(entry.expiration) {
+		c.remove(element)
+		return nil, false
+	}
+
+	c.entries.MoveToFront(element)
+	return proto.Clone(entry.identity).(*pblib.Identification), true
+}
+
+// set caches a copy of the identification, evicting the least recently used entry when full.
+func (c *tokenCache) set(token string, identity *pblib.Identification) {
+	if token == "" || identity == nil || c.capacity <= 0 {
+		return
+	}
+
+	entry := &tokenCacheEntry{
+		token:      token,
+		uuid:       auth.ExtractUUID(token),
+		identity:   proto.Clone(identity).(*pblib.Identification),
+		expiration: time.Now().Add(c.ttl),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.byToken[token]; ok {
+		element.Value = entry
+		c.entries.MoveToFront(element)
+		return
+	}
+
+	c.byToken[token] = c.entries.PushFront(entry)
+	for c.entries.Len() > c.capacity {
+		c.remove(c.entries.Back())
+	}
+}
+
+// invalidateToken drops a single revoked token.
+func (c *tokenCache) invalidateToken(token string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.byToken[token]; ok {
+		c.remove(element)
+	}
+}
+
+// invalidateUUID drops every token issued to uuid.
+func (c *tokenCache) invalidateUUID(uuid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for element := c.entries.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*tokenCacheEntry).uuid == uuid {
+			c.remove(element)
+		}
+		element = next
+	}
+}
+
+// purge drops every entry, used when secrets are rotated.
+func (c *tokenCache) purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries.Init()
+	c.byToken = make(map[string]*list.Element)
+}
+
+func (c *tokenCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.entries.Len()
+}
+
+// remove must be called while holding lock.
+func (c *tokenCache) remove(element *list.Element) {
+	c.entries.Remove(element)
+	delete(c.byToken, element.Value.(*tokenCacheEntry).token)
+}
+
+// pairTokenWithCachedSecret is a read-through wrapper around pairTokenWithSecret.
+// Callers must still authorize the returned identification, the cache does not check token expiration.
+func pairTokenWithCachedSecret(ctx context.Context, token string) (*pblib.Identification, error) {
+	identity, ok := authTokenCache.get(token)
+	tokenCacheCounters.record(ok)
+	if ok {
+		return identity, nil
+	}
+
+	identity, err := pairTokenWithSecret(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	authTokenCache.set(token, identity)
+
+	return identity, nil
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTokenCache(t *testing.T) {
+	secret := &pblib.Secret{
+		Key:                 "TestTokenCache-Secret",
+		CreatedTimestamp:    time.Now().Unix(),
+		ExpirationTimestamp: time.Now().Add(time.Hour).Unix(),
+	}
+	token, err := auth.NewToken(validAuthTokenHeader, validAuthTokenBody, secret)
+	assert.Nil(t, err)
+	identity := &pblib.Identification{Token: token, Secret: secret}
+
+	cases := []struct {
+		desc      string
+		populate  func(c *tokenCache)
+		token     string
+		isExpHit  bool
+		expLength int
+	}{
+		{"test miss", func(c *tokenCache) {}, token, false, 0},
+		{"test hit", func(c *tokenCache) {
+			c.set(token, identity)
+		}, token, true, 1},
+		{"test nil identity is not cached", func(c *tokenCache) {
+			c.set(token, nil)
+		}, token, false, 0},
+		{"test least recently used is evicted", func(c *tokenCache) {
+			c.set(token, identity)
+			c.set("b", identity)
+			c.get(token)
+			c.set("c", identity)
+		}, "b", false, 2},
+		{"test recently used survives eviction", func(c *tokenCache) {
+			c.set(token, identity)
+			c.set("b", identity)
+			c.get(token)
+			c.set("c", identity)
+		}, token, true, 2},
+		{"test invalidate token", func(c *tokenCache) {
+			c.set(token, identity)
+			c.set("b", identity)
+			c.invalidateToken(token)
+		}, token, false, 1},
+		{"test invalidate uuid", func(c *tokenCache) {
+			c.set(token, identity)
+			c.set("b", identity)
+			c.invalidateUUID(validUUID)
+		}, token, false, 1},
+		{"test purge", func(c *tokenCache) {
+			c.set(token, identity)
+			c.set("b", identity)
+			c.purge()
+		}, token, false, 0},
+	}
+
+	for _, c := range cases {
+		cache := newTokenCache(2, time.Minute)
+		c.populate(cache)
+		retrievedIdentity, ok := cache.get(c.token)
+		assert.Equal(t, c.isExpHit, ok, c.desc)
+		assert.Equal(t, c.expLength, cache.len(), c.desc)
+		if c.isExpHit {
+			assert.Equal(t, identity.GetSecret().GetKey(), retrievedIdentity.GetSecret().GetKey(), c.desc)
+		}
+	}
+
+	desc := "test returned identification is a copy"
+	cache := newTokenCache(2, time.Minute)
+	cache.set(token, identity)
+	retrievedIdentity, _ := cache.get(token)
+	retrievedIdentity.Secret = nil
+	retrievedIdentity, ok := cache.get(token)
+	assert.True(t, ok, desc)
+	assert.NotNil(t, retrievedIdentity.GetSecret(), desc)
+
+	desc = "test expired entry is removed"
+	cache = newTokenCache(2, -time.Second)
+	cache.set(token, identity)
+	_, ok = cache.get(token)
+	assert.False(t, ok, desc)
+	assert.Equal(t, 0, cache.len(), desc)
+}
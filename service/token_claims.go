@@ -0,0 +1,239 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-lib/validation"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"hash"
+	"strings"
+	"time"
+)
+
+// authClaims is the body of the auth tokens the service issues. Its first fields are those of auth.Body, in
+// the same order, so hwsc-lib keeps authorizing the tokens and ignores the other claims.
+type authClaims struct {
+	UUID                string
+	Permission          auth.Permission
+	ExpirationTimestamp int64
+	Issuer              string `json:"iss,omitempty"`
+	Audience            string `json:"aud,omitempty"`
+	IssuedAt            int64  `json:"iat,omitempty"`
+	Role                string `json:"role,omitempty"`
+	Organization        string `json:"organization,omitempty"`
+	EmailVerified       *bool  `json:"email_verified,omitempty"`
+}
+
+const (
+	claimRole          = "role"
+	claimOrganization  = "organization"
+	claimEmailVerified = "email_verified"
+
+	// defaultTokenClockSkew is how far the clocks of the instances issuing and verifying a token may drift
+	defaultTokenClockSkew = 30 * time.Second
+)
+
+var (
+	// tokenIssuer and tokenAudience are set with hosts_auth_issuer and hosts_auth_audience
+	tokenIssuer   string
+	tokenAudience string
+
+	// tokenClockSkew is set with hosts_auth_clockskew
+	tokenClockSkew = defaultTokenClockSkew
+
+	// tokenCustomClaims are the custom claims set with hosts_auth_claims
+	tokenCustomClaims = make(map[string]bool)
+)
+
+func init() {
+	tokenIssuer = strings.TrimSpace(conf.Auth.Issuer)
+	tokenAudience = strings.TrimSpace(conf.Auth.Audience)
+
+	if value := conf.Auth.ClockSkew; value != "" {
+		skew, err := time.ParseDuration(value)
+		if err != nil || skew < 0 {
+			reportStartupProblem("Invalid auth clock skew:", value)
+		} else {
+			tokenClockSkew = skew
+		}
+	}
+
+	for _, claim := range strings.Split(conf.Auth.Claims, ",") {
+		switch claim = strings.ToLower(strings.TrimSpace(claim)); claim {
+		case "":
+		case claimRole, claimOrganization, claimEmailVerified:
+			tokenCustomClaims[claim] = true
+		default:
+			reportStartupProblem("Invalid auth token claim:", claim)
+		}
+	}
+}
+
+// newAuthClaims returns the claims of a token with body, issued at now. The custom claims are taken from user,
+// they are left out if user is nil.
+func newAuthClaims(body *auth.Body, user *pblib.User, now time.Time) *authClaims {
+	claims := &authClaims{
+		UUID:                body.UUID,
+		Permission:          body.Permission,
+		ExpirationTimestamp: body.ExpirationTimestamp,
+		Issuer:              tokenIssuer,
+		Audience:            tokenAudience,
+		IssuedAt:            now.UTC().Unix(),
+	}
+	if user == nil {
+		return claims
+	}
+
+	if tokenCustomClaims[claimRole] {
+		claims.Role = auth.PermissionStringMap[body.Permission]
+	}
+	if tokenCustomClaims[claimOrganization] {
+		claims.Organization = user.GetOrganization()
+	}
+	if tokenCustomClaims[claimEmailVerified] {
+		verified := user.GetIsVerified()
+		claims.EmailVerified = &verified
+	}
+
+	return claims
+}
+
+// body returns the part of c hwsc-lib reads.
+func (c *authClaims) body() *auth.Body {
+	return &auth.Body{
+		UUID:                c.UUID,
+		Permission:          c.Permission,
+		ExpirationTimestamp: c.ExpirationTimestamp,
+	}
+}
+
+// signAuthToken signs a token of header and claims with secret, the way auth.NewToken does.
+// Returns error if header, claims or secret are not valid.
+func signAuthToken(header *auth.Header, claims *authClaims, secret *pblib.Secret) (string, error) {
+	// auth.NewToken validates header, body and secret like the verifiers of the token
+	token, err := auth.NewToken(header, claims.body(), secret)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := strings.SplitN(token, ".", 2)[0] + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := authTokenSignature(header.Alg, signingInput, secret.GetKey())
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + signature, nil
+}
+
+// verifyAuthClaims checks that the token of identity is a user auth token signed with its secret, that it has
+// not expired at now, and that it was issued for tokenIssuer and tokenAudience if they are set. The expiration
+// and issue times are checked with tokenClockSkew of tolerance, the expiration of the secret is not.
+// Returns the claims of the token, or the first check it fails.
+func verifyAuthClaims(identity *pblib.Identification, now time.Time) (*authClaims, error) {
+	secret := identity.GetSecret()
+	if secret == nil {
+		return nil, authconst.ErrNilSecret
+	}
+	if secret.GetExpirationTimestamp() <= now.UTC().Unix() {
+		return nil, consts.ErrRetiredAuthSecret
+	}
+	if err := auth.ValidateSecret(secret); err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(identity.GetToken(), ".")
+	if len(parts) != 3 {
+		return nil, authconst.ErrIncompleteToken
+	}
+
+	header := &auth.Header{}
+	if err := decodeTokenPart(parts[0], header); err != nil {
+		return nil, err
+	}
+	if err := auth.ValidateHeader(header); err != nil {
+		return nil, err
+	}
+	if header.TokenTyp != auth.Jwt {
+		return nil, authconst.ErrInvalidRequiredTokenType
+	}
+
+	claims := &authClaims{}
+	if err := decodeTokenPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+	if err := validation.ValidateUserUUID(claims.UUID); err != nil {
+		return nil, err
+	}
+	if claims.Permission > auth.Admin {
+		return nil, authconst.ErrUnknownPermission
+	}
+	if claims.Permission < auth.User || (claims.Permission == auth.Admin && header.Alg != auth.Hs512) {
+		return nil, authconst.ErrInvalidPermission
+	}
+
+	signature, err := authTokenSignature(header.Alg, parts[0]+"."+parts[1], secret.GetKey())
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(signature), []byte(parts[2])) {
+		return nil, authconst.ErrInvalidSignature
+	}
+
+	skew := int64(tokenClockSkew / time.Second)
+	if claims.ExpirationTimestamp <= 0 || now.UTC().Unix() >= claims.ExpirationTimestamp+skew {
+		return nil, authconst.ErrExpiredBody
+	}
+	if claims.IssuedAt > now.UTC().Unix()+skew {
+		return nil, consts.ErrTokenNotYetValid
+	}
+
+	// tokens issued before the issuer or audience were set are refused
+	if tokenIssuer != "" && claims.Issuer != tokenIssuer {
+		return nil, consts.ErrTokenIssuerMismatch
+	}
+	if tokenAudience != "" && claims.Audience != tokenAudience {
+		return nil, consts.ErrTokenAudienceMismatch
+	}
+
+	return claims, nil
+}
+
+// decodeTokenPart decodes the unpadded base64url json of a token part into v.
+func decodeTokenPart(part string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(decoded, v)
+}
+
+// authTokenSignature returns the padded base64url HMAC of signingInput with key, as hwsc-lib signs tokens.
+func authTokenSignature(alg auth.Algorithm, signingInput string, key string) (string, error) {
+	var h func() hash.Hash
+	switch alg {
+	case auth.Hs256:
+		h = sha256.New
+	case auth.Hs512:
+		h = sha512.New
+	default:
+		return "", authconst.ErrNoHashAlgorithm
+	}
+
+	mac := hmac.New(h, []byte(key))
+	mac.Write([]byte(signingInput))
+
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
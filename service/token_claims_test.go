@@ -0,0 +1,163 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSignAuthToken(t *testing.T) {
+	now := time.Now()
+	secret := &pblib.Secret{
+		Key:                 "TestSignAuthToken-Secret",
+		CreatedTimestamp:    now.Add(-time.Minute).Unix(),
+		ExpirationTimestamp: now.Add(time.Hour).Unix(),
+	}
+	user := &pblib.User{Organization: "uwb", IsVerified: true}
+
+	defer func(claims map[string]bool) { tokenCustomClaims = claims }(tokenCustomClaims)
+	tokenCustomClaims = map[string]bool{claimRole: true, claimOrganization: true, claimEmailVerified: true}
+
+	desc := "test token with custom claims is authorized by hwsc-lib"
+	token, err := signAuthToken(validAuthTokenHeader, newAuthClaims(validAuthTokenBody, user, now), secret)
+	assert.Nil(t, err, desc)
+	authority := auth.NewAuthority(auth.Jwt, auth.User)
+	assert.Nil(t, authority.Authorize(&pblib.Identification{Token: token, Secret: secret}), desc)
+	assert.Equal(t, validAuthTokenBody, authority.Body(), desc)
+	authority.Invalidate()
+	assert.Equal(t, validAuthTokenBody.UUID, auth.ExtractUUID(token), desc)
+
+	desc = "test custom claims"
+	claims, err := verifyAuthClaims(&pblib.Identification{Token: token, Secret: secret}, now)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, auth.PermissionStringMap[auth.User], claims.Role, desc)
+	assert.Equal(t, "uwb", claims.Organization, desc)
+	assert.True(t, *claims.EmailVerified, desc)
+	assert.Equal(t, now.UTC().Unix(), claims.IssuedAt, desc)
+
+	desc = "test custom claims are left out without user"
+	token, err = signAuthToken(validAuthTokenHeader, newAuthClaims(validAuthTokenBody, nil, now), secret)
+	assert.Nil(t, err, desc)
+	claims, err = verifyAuthClaims(&pblib.Identification{Token: token, Secret: secret}, now)
+	assert.Nil(t, err, desc)
+	assert.Empty(t, claims.Role, desc)
+	assert.Nil(t, claims.EmailVerified, desc)
+
+	desc = "test admin token requires hs512"
+	adminBody := &auth.Body{
+		UUID:                validUUID,
+		Permission:          auth.Admin,
+		ExpirationTimestamp: validAuthTokenBody.ExpirationTimestamp,
+	}
+	_, err = signAuthToken(validAuthTokenHeader, newAuthClaims(adminBody, nil, now), secret)
+	assert.EqualError(t, err, authconst.ErrInvalidPermission.Error(), desc)
+}
+
+func TestVerifyAuthClaims(t *testing.T) {
+	now := time.Now()
+	secret := &pblib.Secret{
+		Key:                 "TestVerifyAuthClaims-Secret",
+		CreatedTimestamp:    now.Add(-time.Hour).Unix(),
+		ExpirationTimestamp: now.Add(time.Hour).Unix(),
+	}
+	retiredSecret := &pblib.Secret{
+		Key:                 secret.GetKey(),
+		CreatedTimestamp:    now.Add(-time.Hour).Unix(),
+		ExpirationTimestamp: now.Add(-time.Second).Unix(),
+	}
+	otherSecret := &pblib.Secret{
+		Key:                 "TestVerifyAuthClaims-Other",
+		CreatedTimestamp:    secret.GetCreatedTimestamp(),
+		ExpirationTimestamp: secret.GetExpirationTimestamp(),
+	}
+
+	defer func(issuer string, audience string, skew time.Duration) {
+		tokenIssuer, tokenAudience, tokenClockSkew = issuer, audience, skew
+	}(tokenIssuer, tokenAudience, tokenClockSkew)
+	tokenIssuer, tokenAudience, tokenClockSkew = "", "", 30*time.Second
+
+	sign := func(header *auth.Header, permission auth.Permission, expiration time.Time, issuer string,
+		audience string, issuedAt time.Time) string {
+		claims := &authClaims{
+			UUID:                validUUID,
+			Permission:          permission,
+			ExpirationTimestamp: expiration.Unix(),
+			Issuer:              issuer,
+			Audience:            audience,
+			IssuedAt:            issuedAt.Unix(),
+		}
+		payload, err := json.Marshal(claims)
+		assert.Nil(t, err)
+		encodedHeader, err := json.Marshal(header)
+		assert.Nil(t, err)
+
+		signingInput := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." +
+			base64.RawURLEncoding.EncodeToString(payload)
+		signature, err := authTokenSignature(header.Alg, signingInput, secret.GetKey())
+		assert.Nil(t, err)
+
+		return signingInput + "." + signature
+	}
+	hour := now.Add(time.Hour)
+	valid := sign(validAuthTokenHeader, auth.User, hour, "hwsc", "hwsc-app", now)
+	jetHeader := &auth.Header{Alg: auth.Hs256, TokenTyp: auth.Jet}
+
+	cases := []struct {
+		desc     string
+		issuer   string
+		audience string
+		token    string
+		secret   *pblib.Secret
+		expErr   error
+	}{
+		{"test valid token", "", "", valid, secret, nil},
+		{"test token of hwsc-lib", "", "", func() string {
+			token, _ := auth.NewToken(validAuthTokenHeader, validAuthTokenBody, secret)
+			return token
+		}(), secret, nil},
+		{"test matching issuer and audience", "hwsc", "hwsc-app", valid, secret, nil},
+		{"test other issuer", "other", "", valid, secret, consts.ErrTokenIssuerMismatch},
+		{"test other audience", "", "other", valid, secret, consts.ErrTokenAudienceMismatch},
+		{"test token without issuer", "hwsc", "",
+			sign(validAuthTokenHeader, auth.User, hour, "", "", now), secret, consts.ErrTokenIssuerMismatch},
+		{"test expired within clock skew", "", "",
+			sign(validAuthTokenHeader, auth.User, now.Add(-10*time.Second), "", "", now), secret, nil},
+		{"test expired past clock skew", "", "",
+			sign(validAuthTokenHeader, auth.User, now.Add(-time.Minute), "", "", now), secret,
+			authconst.ErrExpiredBody},
+		{"test issued in the future within clock skew", "", "",
+			sign(validAuthTokenHeader, auth.User, hour, "", "", now.Add(10*time.Second)), secret, nil},
+		{"test issued in the future past clock skew", "", "",
+			sign(validAuthTokenHeader, auth.User, hour, "", "", now.Add(time.Minute)), secret,
+			consts.ErrTokenNotYetValid},
+		{"test retired secret", "", "", valid, retiredSecret, consts.ErrRetiredAuthSecret},
+		{"test other secret", "", "", valid, otherSecret, authconst.ErrInvalidSignature},
+		{"test nil secret", "", "", valid, nil, authconst.ErrNilSecret},
+		{"test registration permission", "", "",
+			sign(validAuthTokenHeader, auth.UserRegistration, hour, "", "", now), secret,
+			authconst.ErrInvalidPermission},
+		{"test admin permission with hs256", "", "",
+			sign(validAuthTokenHeader, auth.Admin, hour, "", "", now), secret, authconst.ErrInvalidPermission},
+		{"test email token", "", "", sign(jetHeader, auth.User, hour, "", "", now), secret,
+			authconst.ErrInvalidRequiredTokenType},
+		{"test incomplete token", "", "", "TestVerifyAuthClaims", secret, authconst.ErrIncompleteToken},
+	}
+
+	for _, c := range cases {
+		tokenIssuer, tokenAudience = c.issuer, c.audience
+		claims, err := verifyAuthClaims(&pblib.Identification{Token: c.token, Secret: c.secret}, now)
+		if c.expErr != nil {
+			assert.EqualError(t, err, c.expErr.Error(), c.desc)
+			assert.Nil(t, claims, c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, validUUID, claims.UUID, c.desc)
+		}
+	}
+}
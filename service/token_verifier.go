@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"github.com/golang/protobuf/proto"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"sync"
+	"time"
+)
+
+// statelessVerifier validates auth tokens against an in-memory copy of the unexpired secrets.
+// Tokens of users revoked within the token lifetime are left to the db backed verification,
+// tokens revoked by LogoutUser are refused.
+type statelessVerifier struct {
+	lock            sync.RWMutex
+	secrets         []*pblib.Secret
+	revocations     map[string]time.Time
+	revokedTokens   map[string]bool
+	refreshed       time.Time
+	refreshInterval time.Duration
+}
+
+const (
+	// statelessRefreshInterval bounds how long a revocation on another instance goes unnoticed
+	statelessRefreshInterval = 10 * time.Second
+)
+
+var (
+	authTokenVerifier = &statelessVerifier{refreshInterval: statelessRefreshInterval}
+)
+
+// refresh reloads secrets, recent revocations and revoked tokens from the db once refreshInterval has passed.
+func (v *statelessVerifier) refresh(ctx context.Context) error {
+	v.lock.RLock()
+	fresh := time.Since(v.refreshed) < v.refreshInterval
+	v.lock.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if time.Since(v.refreshed) < v.refreshInterval {
+		return nil
+	}
+
+	secrets, err := getValidSecrets(ctx)
+	if err != nil {
+		return err
+	}
+
+	// tokens issued before an older revocation have expired by now
+	since := time.Now().UTC().Add(-time.Hour * time.Duration(authTokenExpirationTime))
+	revocations, err := getRevocationsSince(ctx, since)
+	if err != nil {
+		return err
+	}
+
+	revokedTokens, err := getTokenRevocations(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	v.secrets = secrets
+	v.revocations = revocations
+	v.revokedTokens = revokedTokens
+	v.refreshed = time.Now()
+
+	return nil
+}
+
+// verify checks the token with each cached secret, see verifyAuthClaims.
+// Returns the token paired with its secret, or nil if the token must be verified against the db, which refuses
+// revoked tokens.
+func (v *statelessVerifier) verify(ctx context.Context, token string) *pblib.Identification {
+	if err := v.refresh(ctx); err != nil {
+		logger.Error(consts.VerifyAuthToken, consts.MsgErrRefreshVerifier, err.Error())
+		return nil
+	}
+
+	uuid := auth.ExtractUUID(token)
+	if uuid == "" {
+		return nil
+	}
+
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	if _, ok := v.revocations[uuid]; ok {
+		return nil
+	}
+	if v.revokedTokens[hashToken(token)] {
+		return nil
+	}
+
+	now := time.Now()
+	for _, secret := range v.secrets {
+		identity := &pblib.Identification{
+			Token:  token,
+			Secret: proto.Clone(secret).(*pblib.Secret),
+		}
+
+		if _, err := verifyAuthClaims(identity, now); err == nil {
+			return identity
+		}
+	}
+
+	return nil
+}
+
+// revoke stops verifying the uuid's tokens locally until the next refresh reloads revocations from the db.
+func (v *statelessVerifier) revoke(uuid string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.revocations == nil {
+		v.revocations = make(map[string]time.Time)
+	}
+	v.revocations[uuid] = time.Now().UTC()
+}
+
+// revokeToken stops verifying the token of tokenHash locally, the revocation is kept by the next refresh.
+func (v *statelessVerifier) revokeToken(tokenHash string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.revokedTokens == nil {
+		v.revokedTokens = make(map[string]bool)
+	}
+	v.revokedTokens[tokenHash] = true
+}
+
+// expire forces the next verify to reload from the db, used when secrets change.
+func (v *statelessVerifier) expire() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.refreshed = time.Time{}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestStatelessVerifier(t *testing.T) {
+	unitTestRequireIntegration(t)
+
+	newSecret, newToken, err := unitTestInsertNewAuthToken()
+	assert.Nil(t, err)
+	uuid := auth.ExtractUUID(newToken)
+
+	verifier := &statelessVerifier{refreshInterval: time.Minute}
+
+	desc := "test valid token is verified without the tokens table"
+	_, err = postgresDB.Exec("DELETE FROM user_security.auth_tokens")
+	assert.Nil(t, err, desc)
+	identity := verifier.verify(context.TODO(), newToken)
+	assert.NotNil(t, identity, desc)
+	assert.Equal(t, newToken, identity.GetToken(), desc)
+	assert.Equal(t, newSecret.GetKey(), identity.GetSecret().GetKey(), desc)
+
+	desc = "test malformed token"
+	assert.Nil(t, verifier.verify(context.TODO(), "TestStatelessVerifier-Malformed"), desc)
+
+	desc = "test token signed by an unknown secret"
+	unknownSecret := &pblib.Secret{
+		Key:                 "TestStatelessVerifier-Unknown",
+		CreatedTimestamp:    time.Now().Unix(),
+		ExpirationTimestamp: time.Now().Add(time.Hour).Unix(),
+	}
+	unknownToken, err := auth.NewToken(validAuthTokenHeader, validNoUUIDAuthTokenBody, unknownSecret)
+	assert.Nil(t, err, desc)
+	assert.Nil(t, verifier.verify(context.TODO(), unknownToken), desc)
+
+	desc = "test locally revoked uuid"
+	verifier.revoke(uuid)
+	assert.Nil(t, verifier.verify(context.TODO(), newToken), desc)
+
+	desc = "test revocation made by another instance is loaded on refresh"
+	verifier = &statelessVerifier{refreshInterval: time.Minute}
+	assert.NotNil(t, verifier.verify(context.TODO(), newToken), desc)
+	assert.Nil(t, revokeAuthTokens(context.TODO(), uuid), desc)
+	assert.NotNil(t, verifier.verify(context.TODO(), newToken), desc)
+	verifier.expire()
+	assert.Nil(t, verifier.verify(context.TODO(), newToken), desc)
+
+	desc = "test new secret is loaded after expire"
+	newSecret, newToken, err = unitTestInsertNewAuthToken()
+	assert.Nil(t, err, desc)
+	assert.Nil(t, verifier.verify(context.TODO(), newToken), desc)
+	verifier.expire()
+	identity = verifier.verify(context.TODO(), newToken)
+	assert.NotNil(t, identity, desc)
+	assert.Equal(t, newSecret.GetKey(), identity.GetSecret().GetKey(), desc)
+}
+
+func TestStatelessVerifierRevokeToken(t *testing.T) {
+	secret := &pblib.Secret{
+		Key:                 "TestStatelessVerifierRevokeToken-Secret",
+		CreatedTimestamp:    time.Now().Add(-time.Minute).Unix(),
+		ExpirationTimestamp: time.Now().Add(time.Hour).Unix(),
+	}
+	token, err := auth.NewToken(validAuthTokenHeader, validAuthTokenBody, secret)
+	assert.Nil(t, err)
+
+	// a fresh verifier does not reload from the db
+	verifier := &statelessVerifier{
+		secrets:         []*pblib.Secret{secret},
+		refreshed:       time.Now(),
+		refreshInterval: time.Minute,
+	}
+
+	desc := "test token is verified"
+	assert.NotNil(t, verifier.verify(context.TODO(), token), desc)
+
+	desc = "test revoked token is refused"
+	verifier.revokeToken(hashToken(token))
+	assert.Nil(t, verifier.verify(context.TODO(), token), desc)
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// twoFactor is the TOTP enrollment of a user, pending until Verify2FA enables it
+type twoFactor struct {
+	sealedSecret []byte
+	lastUsedStep int64
+	enabled      bool
+}
+
+const (
+	// totpPeriod, totpDigits and the SHA-1 hmac are the RFC 6238 defaults every authenticator app supports
+	totpPeriod  = 30 * time.Second
+	totpDigits  = 6
+	totpModulus = 1000000
+
+	// totpSkew steps before and after the current one are accepted, for clocks that drifted apart
+	totpSkew = 1
+
+	// totpSecretByteSize is the size of the SHA-1 hmac key RFC 4226 recommends
+	totpSecretByteSize = 20
+	totpKeyByteSize    = 32
+
+	// totpIssuer names the service in authenticator apps
+	totpIssuer = "hwsc"
+
+	// backupCodeCount codes of backupCodeByteSize random bytes, 8 base32 characters, are generated by Verify2FA
+	backupCodeCount    = 10
+	backupCodeByteSize = 5
+)
+
+var (
+	// totpKey is set with hosts_auth_totpkey, two-factor authentication cannot be enabled without it
+	totpKey []byte
+
+	// totpEncoding encodes secrets and backup codes the way authenticator apps expect secrets
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+func init() {
+	if conf.Auth.TOTPKey == "" {
+		return
+	}
+
+	key, err := parseTOTPKey(conf.Auth.TOTPKey)
+	if err != nil {
+		// the key is a secret, it is not logged
+		reportStartupProblem("Invalid totp key, expected the base64 encoding of 32 bytes")
+		return
+	}
+	totpKey = key
+}
+
+// parseTOTPKey decodes the base64 encoded AES-256 key of value.
+// Returns ErrInvalidTOTPKey if value is not the base64 encoding of totpKeyByteSize bytes.
+func parseTOTPKey(value string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(key) != totpKeyByteSize {
+		return nil, consts.ErrInvalidTOTPKey
+	}
+
+	return key, nil
+}
+
+// generateTOTPSecret returns a new random TOTP secret.
+func generateTOTPSecret() ([]byte, error) {
+	secret := make([]byte, totpSecretByteSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// totpCode returns the code of secret for step, the number of totpPeriods since the unix epoch, see RFC 6238.
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	_, _ = mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation of RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus)
+}
+
+// matchTOTPCode returns the step code was generated for, checking the steps within totpSkew of now.
+// Steps up to lastUsedStep are skipped, their codes were already used.
+// Returns false if code matches none of them.
+func matchTOTPCode(secret []byte, code string, now time.Time, lastUsedStep int64) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// newTOTPCipher returns the AES-GCM cipher of totpKey.
+// Returns ErrTwoFactorUnavailable if hosts_auth_totpkey is not set.
+func newTOTPCipher() (cipher.AEAD, error) {
+	if totpKey == nil {
+		return nil, consts.ErrTwoFactorUnavailable
+	}
+
+	block, err := aes.NewCipher(totpKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealTOTPSecret encrypts the secret of uuid with totpKey, the nonce is prepended to the sealed secret.
+// The uuid is authenticated with the secret, a sealed secret copied to another account does not open.
+func sealTOTPSecret(secret []byte, uuid string) ([]byte, error) {
+	aead, err := newTOTPCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, secret, []byte(uuid)), nil
+}
+
+// openTOTPSecret decrypts a secret of uuid sealed with sealTOTPSecret.
+// Returns ErrTwoFactorUnavailable if hosts_auth_totpkey is not set, or error if sealed was not sealed for uuid
+// with totpKey.
+func openTOTPSecret(sealed []byte, uuid string) ([]byte, error) {
+	aead, err := newTOTPCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, consts.ErrInvalidTOTPKey
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(uuid))
+}
+
+// totpURI returns the otpauth uri of the secret of the account with email, authenticator apps add accounts
+// by scanning it as a QR code.
+func totpURI(secret []byte, email string) string {
+	values := url.Values{
+		"secret":    {totpEncoding.EncodeToString(secret)},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(int(totpPeriod / time.Second))},
+	}
+
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + values.Encode()
+}
+
+// generateBackupCodes returns backupCodeCount new backup codes, formatted like "ABCD-EFGH", and the hashes they
+// are stored as. Backup codes are random like refresh tokens, so they are hashed with hashToken.
+func generateBackupCodes() ([]string, []string, error) {
+	codes := make([]string, 0, backupCodeCount)
+	hashes := make([]string, 0, backupCodeCount)
+	for i := 0; i < backupCodeCount; i++ {
+		random := make([]byte, backupCodeByteSize)
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+
+		code := totpEncoding.EncodeToString(random)
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, hashToken(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// normalizeBackupCode removes the dashes and spaces users may type and upper cases code, as it was hashed.
+func normalizeBackupCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// checkTwoFactor checks the second factor of uuid signing in, users without two-factor authentication enabled
+// pass without a code. See useTwoFactorCode.
+// Returns ErrTwoFactorRequired if code is empty, ErrInvalidTwoFactorCode if code does not match, or any db or
+// decryption error.
+func checkTwoFactor(ctx context.Context, uuid string, code string, now time.Time) error {
+	enrollment, err := getTwoFactor(ctx, uuid)
+	if err != nil {
+		return err
+	}
+	if enrollment == nil || !enrollment.enabled {
+		return nil
+	}
+
+	return useTwoFactorCode(ctx, uuid, enrollment, code, now)
+}
+
+// useTwoFactorCode accepts code as the second factor of the enabled enrollment of uuid, a TOTP code of a step after
+// the last one used, or an unused backup code. The code is used up.
+// Returns ErrTwoFactorRequired if code is empty, ErrInvalidTwoFactorCode if code does not match, or any db or
+// decryption error.
+func useTwoFactorCode(ctx context.Context, uuid string, enrollment *twoFactor, code string, now time.Time) error {
+	if code == "" {
+		return consts.ErrTwoFactorRequired
+	}
+
+	secret, err := openTOTPSecret(enrollment.sealedSecret, uuid)
+	if err != nil {
+		return err
+	}
+
+	if step, ok := matchTOTPCode(secret, code, now, enrollment.lastUsedStep); ok {
+		return useTOTPStep(ctx, uuid, step)
+	}
+
+	return useBackupCode(ctx, uuid, hashToken(normalizeBackupCode(code)), now)
+}
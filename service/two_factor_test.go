@@ -0,0 +1,146 @@
+package service
+
+import (
+	"encoding/base64"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTOTPKey(t *testing.T) {
+	key := make([]byte, totpKeyByteSize)
+
+	desc := "test base64 of 32 bytes"
+	parsed, err := parseTOTPKey(" " + base64.StdEncoding.EncodeToString(key) + " ")
+	assert.Nil(t, err, desc)
+	assert.Equal(t, key, parsed, desc)
+
+	for _, value := range []string{"not base64!", base64.StdEncoding.EncodeToString(key[:16])} {
+		_, err := parseTOTPKey(value)
+		assert.Equal(t, consts.ErrInvalidTOTPKey, err, value)
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	// the SHA-1 test vectors of RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	cases := []struct {
+		unix    int64
+		expCode string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expCode, totpCode(secret, c.unix/30), c.expCode)
+	}
+}
+
+func TestMatchTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111109, 0)
+	current := now.Unix() / 30
+
+	desc := "test current code"
+	step, ok := matchTOTPCode(secret, "081804", now, 0)
+	assert.True(t, ok, desc)
+	assert.Equal(t, current, step, desc)
+
+	desc = "test codes of neighbouring steps"
+	step, ok = matchTOTPCode(secret, totpCode(secret, current-1), now, 0)
+	assert.True(t, ok, desc)
+	assert.Equal(t, current-1, step, desc)
+	step, ok = matchTOTPCode(secret, totpCode(secret, current+1), now, 0)
+	assert.True(t, ok, desc)
+	assert.Equal(t, current+1, step, desc)
+
+	desc = "test codes outside the skew"
+	_, ok = matchTOTPCode(secret, totpCode(secret, current-2), now, 0)
+	assert.False(t, ok, desc)
+	_, ok = matchTOTPCode(secret, totpCode(secret, current+2), now, 0)
+	assert.False(t, ok, desc)
+
+	desc = "test used steps"
+	_, ok = matchTOTPCode(secret, "081804", now, current)
+	assert.False(t, ok, desc)
+	_, ok = matchTOTPCode(secret, totpCode(secret, current+1), now, current)
+	assert.True(t, ok, desc)
+
+	desc = "test malformed codes"
+	for _, code := range []string{"", "81804", "0818040", "ABCD-EFGH"} {
+		_, ok = matchTOTPCode(secret, code, now, 0)
+		assert.False(t, ok, desc)
+	}
+}
+
+func TestSealTOTPSecret(t *testing.T) {
+	key := totpKey
+	defer func() { totpKey = key }()
+
+	desc := "test without a key"
+	totpKey = nil
+	_, err := sealTOTPSecret([]byte("secret"), "0000xsnjg0mqjhbf4qx1efd6y3")
+	assert.Equal(t, consts.ErrTwoFactorUnavailable, err, desc)
+
+	desc = "test secret opens for its uuid"
+	totpKey = make([]byte, totpKeyByteSize)
+	secret, err := generateTOTPSecret()
+	assert.Nil(t, err, desc)
+	sealed, err := sealTOTPSecret(secret, "0000xsnjg0mqjhbf4qx1efd6y3")
+	assert.Nil(t, err, desc)
+	assert.NotContains(t, string(sealed), string(secret), desc)
+	opened, err := openTOTPSecret(sealed, "0000xsnjg0mqjhbf4qx1efd6y3")
+	assert.Nil(t, err, desc)
+	assert.Equal(t, secret, opened, desc)
+
+	desc = "test secret does not open for another uuid"
+	_, err = openTOTPSecret(sealed, "0000xsnjg0mqjhbf4qx1efd6y4")
+	assert.NotNil(t, err, desc)
+
+	desc = "test secret does not open with another key"
+	totpKey = []byte(strings.Repeat("k", totpKeyByteSize))
+	_, err = openTOTPSecret(sealed, "0000xsnjg0mqjhbf4qx1efd6y3")
+	assert.NotNil(t, err, desc)
+
+	desc = "test truncated secret"
+	_, err = openTOTPSecret(sealed[:4], "0000xsnjg0mqjhbf4qx1efd6y3")
+	assert.Equal(t, consts.ErrInvalidTOTPKey, err, desc)
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri, err := url.Parse(totpURI([]byte("12345678901234567890"), "lisa@kim.com"))
+	assert.Nil(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/hwsc:lisa@kim.com", uri.Path)
+	assert.Equal(t, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", uri.Query().Get("secret"))
+	assert.Equal(t, totpIssuer, uri.Query().Get("issuer"))
+	assert.Equal(t, "6", uri.Query().Get("digits"))
+	assert.Equal(t, "30", uri.Query().Get("period"))
+}
+
+func TestGenerateBackupCodes(t *testing.T) {
+	codes, hashes, err := generateBackupCodes()
+	assert.Nil(t, err)
+	assert.Len(t, codes, backupCodeCount)
+	assert.Len(t, hashes, backupCodeCount)
+
+	seen := make(map[string]bool)
+	for i, code := range codes {
+		assert.Regexp(t, `^[A-Z2-7]{4}-[A-Z2-7]{4}$`, code)
+		assert.False(t, seen[code], code)
+		seen[code] = true
+
+		// codes are accepted however users type them
+		assert.Equal(t, hashes[i], hashToken(normalizeBackupCode(strings.ToLower(code))), code)
+		assert.Equal(t, hashes[i], hashToken(normalizeBackupCode(strings.Replace(code, "-", " ", 1))), code)
+	}
+}
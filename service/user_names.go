@@ -0,0 +1,99 @@
+package service
+
+import (
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// userNames are the optional names of a user the User message has no fields for, passed as metadata.
+// An empty displayName is derived from the first and last names, see deriveDisplayName.
+type userNames struct {
+	middleName  string
+	displayName string
+}
+
+// parseUserNames reads the x-hwsc-middle-name-bin and x-hwsc-display-name-bin metadata of ctx,
+// names that are not sent are empty.
+// Returns ErrInvalidUserMiddleName or ErrInvalidUserDisplayName if a name is sent but invalid.
+func parseUserNames(ctx context.Context) (userNames, error) {
+	names := userNames{
+		middleName:  getIncomingMetadata(ctx, metadataKeyMiddleName),
+		displayName: getIncomingMetadata(ctx, metadataKeyDisplayName),
+	}
+
+	if names.middleName != "" {
+		if err := validateMiddleName(names.middleName); err != nil {
+			return userNames{}, err
+		}
+	}
+	if names.displayName != "" {
+		if err := validateDisplayName(names.displayName); err != nil {
+			return userNames{}, err
+		}
+	}
+
+	return names, nil
+}
+
+// validateMiddleName checks name like validateFirstName does.
+func validateMiddleName(name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" || !isValidName(name, maxMiddleNameLength) {
+		return consts.ErrInvalidUserMiddleName
+	}
+
+	return nil
+}
+
+// validateDisplayName accepts any printable name of at most maxDisplayNameLength characters, display names are
+// what users go by and need not be made of letters.
+func validateDisplayName(name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" || !utf8.ValidString(name) || utf8.RuneCountInString(name) > maxDisplayNameLength {
+		return consts.ErrInvalidUserDisplayName
+	}
+
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return consts.ErrInvalidUserDisplayName
+		}
+	}
+
+	return nil
+}
+
+// deriveDisplayName returns the display name of a user that did not choose one, its first and last names.
+// Users with a single name fill both fields with it, a last name repeating the first name is left out.
+func deriveDisplayName(user *pblib.User) string {
+	first := strings.TrimSpace(user.GetFirstName())
+	last := strings.TrimSpace(user.GetLastName())
+	if last == "" || strings.EqualFold(first, last) {
+		return first
+	}
+	if first == "" {
+		return last
+	}
+
+	return first + " " + last
+}
+
+// setUserNameHeaders returns the names of user in the x-hwsc-middle-name-bin header, if it has one, and the
+// x-hwsc-display-name-bin header, derived if names has none.
+func setUserNameHeaders(ctx context.Context, user *pblib.User, names userNames) error {
+	if names.middleName != "" {
+		if err := setResponseHeader(ctx, metadataKeyMiddleName, names.middleName); err != nil {
+			return err
+		}
+	}
+
+	displayName := names.displayName
+	if displayName == "" {
+		displayName = deriveDisplayName(user)
+	}
+
+	return setResponseHeader(ctx, metadataKeyDisplayName, displayName)
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestParseUserNames(t *testing.T) {
+	cases := []struct {
+		desc     string
+		pairs    []string
+		expNames userNames
+		expErr   error
+	}{
+		{"test no names", nil, userNames{}, nil},
+		{"test both names", []string{metadataKeyMiddleName, " Mary ", metadataKeyDisplayName, "Lisa K. 🐋"},
+			userNames{middleName: "Mary", displayName: "Lisa K. 🐋"}, nil},
+		{"test unicode middle name", []string{metadataKeyMiddleName, "Ünal"}, userNames{middleName: "Ünal"}, nil},
+		{"test middle name with digits", []string{metadataKeyMiddleName, "M4ry"}, userNames{},
+			consts.ErrInvalidUserMiddleName},
+		{"test long middle name", []string{metadataKeyMiddleName, strings.Repeat("a", maxMiddleNameLength+1)},
+			userNames{}, consts.ErrInvalidUserMiddleName},
+		{"test display name with control characters", []string{metadataKeyDisplayName, "Lisa\u0007"}, userNames{},
+			consts.ErrInvalidUserDisplayName},
+		{"test long display name", []string{metadataKeyDisplayName, strings.Repeat("ü", maxDisplayNameLength+1)},
+			userNames{}, consts.ErrInvalidUserDisplayName},
+	}
+
+	for _, c := range cases {
+		ctx, _ := unitTestServerContext(c.pairs...)
+		names, err := parseUserNames(ctx)
+		assert.Equal(t, c.expErr, err, c.desc)
+		assert.Equal(t, c.expNames, names, c.desc)
+	}
+}
+
+func TestDeriveDisplayName(t *testing.T) {
+	cases := []struct {
+		desc           string
+		user           *pblib.User
+		expDisplayName string
+	}{
+		{"test first and last names", &pblib.User{FirstName: "Lisa", LastName: "Keem"}, "Lisa Keem"},
+		{"test mononym in both names", &pblib.User{FirstName: "Teller", LastName: "teller"}, "Teller"},
+		{"test missing last name", &pblib.User{FirstName: "Teller"}, "Teller"},
+		{"test missing first name", &pblib.User{LastName: "Teller"}, "Teller"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expDisplayName, deriveDisplayName(c.user), c.desc)
+	}
+}
+
+func TestSetUserNameHeaders(t *testing.T) {
+	user := &pblib.User{FirstName: "Lisa", LastName: "Keem"}
+
+	desc := "test display name is derived without a middle name header"
+	ctx, stream := unitTestServerContext()
+	assert.Nil(t, setUserNameHeaders(ctx, user, userNames{}), desc)
+	assert.Empty(t, stream.header.Get(metadataKeyMiddleName), desc)
+	assert.Equal(t, []string{"Lisa Keem"}, stream.header.Get(metadataKeyDisplayName), desc)
+
+	desc = "test chosen names are returned"
+	ctx, stream = unitTestServerContext()
+	assert.Nil(t, setUserNameHeaders(ctx, user, userNames{middleName: "Mary", displayName: "LK"}), desc)
+	assert.Equal(t, []string{"Mary"}, stream.header.Get(metadataKeyMiddleName), desc)
+	assert.Equal(t, []string{"LK"}, stream.header.Get(metadataKeyDisplayName), desc)
+}
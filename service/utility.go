@@ -1,37 +1,167 @@
 package service
 
 import (
+	"context"
+	"crypto/rand"
 	"fmt"
 	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
 	"github.com/hwsc-org/hwsc-lib/auth"
 	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/conf"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
 	"github.com/oklog/ulid"
 	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"math/rand"
+	"hash/fnv"
+	"io"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 const (
+	// uuidLockStripes is the number of mutexes shared by all uuids in uuidMapLocker
+	uuidLockStripes = 256
+
+	// bcrypt ignores every byte after the 72nd, longer passwords are rejected instead of silently truncated
+	maxPasswordLength = 72
+
 	maxFirstNameLength  = 32
+	maxMiddleNameLength = 32
 	maxLastNameLength   = 32
-	daysInOneWeek       = 7
 	domainName          = "localhost"
 	verifyEmailLinkStub = "verify-email?token"
+
+	// maxDisplayNameLength counts characters, display names are not limited to letters like the other names
+	maxDisplayNameLength = 64
+
+	// verifyParentalConsentLinkStub is the page a parent opens to give consent for a user under parentalConsentAge
+	verifyParentalConsentLinkStub = "verify-parental-consent?token"
+
+	// confirmLoginCountryLinkStub is the page a user opens to confirm a sign in from a new country
+	confirmLoginCountryLinkStub = "confirm-login-country?token"
+
+	// resetPasswordLinkStub is the page a user opens to choose a new password
+	resetPasswordLinkStub = "reset-password?token"
+
+	// confirmEmailChangeLinkStub is the page a user opens from its new email to confirm an email change
+	confirmEmailChangeLinkStub = "confirm-email-change?token"
+
+	// birthdateLayout is the x-hwsc-birthdate metadata format
+	birthdateLayout = "2006-01-02"
+
+	// users younger than parentalConsentAge at signup need a parent's consent (COPPA)
+	parentalConsentAge = 13
+	maxAge             = 150
+
+	// userFieldOrganization names User.organization in the x-hwsc-clear-fields metadata
+	userFieldOrganization = "organization"
+
+	// userFieldMiddleName and userFieldDisplayName name the x-hwsc-middle-name-bin and x-hwsc-display-name-bin
+	// metadata in the x-hwsc-clear-fields metadata, a cleared display name is derived again
+	userFieldMiddleName  = "middle_name"
+	userFieldDisplayName = "display_name"
+
+	// defaultProspectiveEmailHold matches the lifetime of email verification tokens
+	defaultProspectiveEmailHold = 14 * 24 * time.Hour
 )
 
 var (
-	keyGenLocker        sync.Mutex
-	uuidLocker          sync.Mutex
+	// clearableUserFields are the optional User fields UpdateUser can blank out
+	clearableUserFields = map[string]bool{
+		userFieldOrganization: true,
+		userFieldMiddleName:   true,
+		userFieldDisplayName:  true,
+	}
+
+	uuidEntropyPool = sync.Pool{
+		New: func() interface{} {
+			// a MonotonicEntropy is not safe for concurrent use, the pool hands each one to a single goroutine
+			return ulid.Monotonic(rand.Reader, 0)
+		},
+	}
 	multiSpaceRegex     = regexp.MustCompile(`[\s\p{Zs}]{2,}`)
-	nameValidCharsRegex = regexp.MustCompile(`^[[:alpha:]]+((['.\s-][[:alpha:]\s])?[[:alpha:]]*)*$`)
+	nameValidCharsRegex = regexp.MustCompile(`^[\p{L}\p{M}]+((['’.\s-][\p{L}\p{M}\s])?[\p{L}\p{M}]*)*$`)
+
+	// legacyNameValidCharsRegex only accepts ASCII letters
+	legacyNameValidCharsRegex = regexp.MustCompile(`^[[:alpha:]]+((['.\s-][[:alpha:]\s])?[[:alpha:]]*)*$`)
+
+	// legacyNameValidation is set with hosts_validation_legacynames
+	legacyNameValidation bool
+
+	// stripEmailPlusTags is set with hosts_validation_stripplustags
+	stripEmailPlusTags bool
+
+	// foldGmailDots is set with hosts_validation_foldgmaildots
+	foldGmailDots bool
+
+	// organizationAllowlist is set with hosts_validation_organizations, nil accepts any organization
+	organizationAllowlist map[string]bool
+
+	// prospectiveEmailHold is set with hosts_emailchange_hold
+	prospectiveEmailHold = defaultProspectiveEmailHold
+
+	// requireVerifiedEmail is set with hosts_auth_requireverifiedemail
+	requireVerifiedEmail bool
 )
 
+func init() {
+	legacyNameValidation = parseValidationSwitch("legacy names", conf.Validation.LegacyNames)
+	stripEmailPlusTags = parseValidationSwitch("strip plus tags", conf.Validation.StripPlusTags)
+	foldGmailDots = parseValidationSwitch("fold gmail dots", conf.Validation.FoldGmailDots)
+	if parseValidationSwitch("verify email domains", conf.Validation.VerifyEmailDomains) {
+		emailDomainResolver = net.DefaultResolver
+	}
+	organizationAllowlist = parseAllowlist(conf.Validation.Organizations)
+	requireVerifiedEmail = parseValidationSwitch("require verified email", conf.Auth.RequireVerifiedEmail)
+
+	if conf.EmailChange.Hold != "" {
+		hold, err := time.ParseDuration(conf.EmailChange.Hold)
+		if err != nil || hold <= 0 {
+			reportStartupProblem("Invalid prospective email hold:", conf.EmailChange.Hold)
+			return
+		}
+		prospectiveEmailHold = hold
+	}
+}
+
+// parseValidationSwitch parses a boolean config value, empty values are false.
+func parseValidationSwitch(name string, value string) bool {
+	if value == "" {
+		return false
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		reportStartupProblem("Invalid", name, "switch:", value)
+		return false
+	}
+
+	return enabled
+}
+
+// parseAllowlist parses a comma separated config value, returns nil if it lists nothing.
+func parseAllowlist(value string) map[string]bool {
+	var allowlist map[string]bool
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if allowlist == nil {
+			allowlist = make(map[string]bool)
+		}
+		allowlist[item] = true
+	}
+
+	return allowlist
+}
+
 func (s *stateLocker) isStateAvailable() bool {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
@@ -43,6 +173,30 @@ func (s *stateLocker) isStateAvailable() bool {
 	return true
 }
 
+// writeLock locks the uuid's stripe, returns the func to unlock it.
+func (t *uuidLockTable) writeLock(uuid string) func() {
+	l := t.stripe(uuid)
+	l.Lock()
+
+	return l.Unlock
+}
+
+// readLock read locks the uuid's stripe, returns the func to unlock it.
+func (t *uuidLockTable) readLock(uuid string) func() {
+	l := t.stripe(uuid)
+	l.RLock()
+
+	return l.RUnlock
+}
+
+// stripe returns the mutex guarding uuid.
+func (t *uuidLockTable) stripe(uuid string) *sync.RWMutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(uuid))
+
+	return &t.stripes[h.Sum32()%uuidLockStripes]
+}
+
 func validateUser(user *pblib.User) error {
 	if user == nil {
 		return consts.ErrNilRequestUser
@@ -57,8 +211,8 @@ func validateUser(user *pblib.User) error {
 	if err := validateEmail(user.GetEmail()); err != nil {
 		return err
 	}
-	if err := validatePassword(user.GetPassword()); err != nil {
-		return consts.ErrInvalidPassword
+	if err := validateNewPassword(user.GetPassword()); err != nil {
+		return err
 	}
 	if err := validateOrganization(user.GetOrganization()); err != nil {
 		return err
@@ -66,10 +220,15 @@ func validateUser(user *pblib.User) error {
 	return nil
 }
 
+// validatePassword checks password is not blank and fits in maxPasswordLength bytes.
+// Passwords being set are also checked against the password policy, see validateNewPassword.
 func validatePassword(password string) error {
 	if strings.TrimSpace(password) == "" {
 		return consts.ErrInvalidPassword
 	}
+	if len(password) > maxPasswordLength {
+		return consts.ErrPasswordTooLong
+	}
 	return nil
 }
 
@@ -79,8 +238,7 @@ func validateFirstName(name string) error {
 		return consts.ErrInvalidUserFirstName
 	}
 
-	name = multiSpaceRegex.ReplaceAllString(name, " ")
-	if len(name) > maxFirstNameLength || !nameValidCharsRegex.MatchString(name) {
+	if !isValidName(name, maxFirstNameLength) {
 		return consts.ErrInvalidUserFirstName
 	}
 
@@ -93,31 +251,102 @@ func validateLastName(name string) error {
 		return consts.ErrInvalidUserLastName
 	}
 
-	name = multiSpaceRegex.ReplaceAllString(name, " ")
-	if len(name) > maxLastNameLength || !nameValidCharsRegex.MatchString(name) {
+	if !isValidName(name, maxLastNameLength) {
 		return consts.ErrInvalidUserLastName
 	}
 
 	return nil
 }
 
+// isValidName collapses repeated spaces and checks name's length in runes and its characters.
+// Any unicode letter is accepted unless legacy validation is switched on.
+func isValidName(name string, maxLength int) bool {
+	name = multiSpaceRegex.ReplaceAllString(name, " ")
+
+	if legacyNameValidation {
+		return len(name) <= maxLength && legacyNameValidCharsRegex.MatchString(name)
+	}
+
+	return utf8.RuneCountInString(name) <= maxLength && nameValidCharsRegex.MatchString(name)
+}
+
+// parseClearFields checks every field name can be cleared.
+// Returns the set of fields to clear, error if a field is unknown or required.
+func parseClearFields(fields []string) (map[string]bool, error) {
+	clearFields := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		field = strings.ToLower(field)
+		if !clearableUserFields[field] {
+			return nil, consts.ErrInvalidClearField
+		}
+		clearFields[field] = true
+	}
+
+	return clearFields, nil
+}
+
+// validateOrganization checks name is not empty and, if an allowlist is configured, one of the allowed organizations.
 func validateOrganization(name string) error {
 	if name == "" {
 		return consts.ErrInvalidUserOrganization
 	}
+	if organizationAllowlist != nil && !organizationAllowlist[name] {
+		return consts.ErrOrganizationNotAllowed
+	}
+	return nil
+}
+
+// validatePermissionLevel checks level is a permission level of hwsc-lib auth, such as "USER" or "ADMIN".
+func validatePermissionLevel(level string) error {
+	if _, ok := auth.PermissionEnumMap[level]; !ok {
+		return consts.ErrInvalidPermissionLevel
+	}
 	return nil
 }
 
+// parseBirthdate parses a YYYY-MM-DD birthdate that is not after now and at most maxAge years before it.
+// Returns error if birthdate is malformed or out of range.
+func parseBirthdate(birthdate string, now time.Time) (time.Time, error) {
+	parsed, err := time.Parse(birthdateLayout, birthdate)
+	if err != nil {
+		return time.Time{}, consts.ErrInvalidBirthdate
+	}
+
+	if parsed.After(now) || ageOn(parsed, now) > maxAge {
+		return time.Time{}, consts.ErrInvalidBirthdate
+	}
+
+	return parsed, nil
+}
+
+// ageOn returns the age in whole years of someone born on birthdate, on the day of now.
+// Both dates are compared in UTC, a February 29 birthday is reached on March 1 in common years.
+func ageOn(birthdate time.Time, now time.Time) int {
+	birthdate = birthdate.UTC()
+	now = now.UTC()
+
+	age := now.Year() - birthdate.Year()
+	if now.Month() < birthdate.Month() || (now.Month() == birthdate.Month() && now.Day() < birthdate.Day()) {
+		age--
+	}
+
+	return age
+}
+
+// requiresParentalConsent reports whether a user born on birthdate and signing up at signup is under
+// parentalConsentAge. Users without a birthdate do not require consent.
+func requiresParentalConsent(birthdate time.Time, signup time.Time) bool {
+	return !birthdate.IsZero() && ageOn(birthdate, signup) < parentalConsentAge
+}
+
 // generateUUID generates a unique user ID using ulid package based on currentTime.
+// Entropy comes from a pool of monotonic crypto/rand readers so concurrent callers do not contend on a lock.
 // Returns a lower cased string type of generated ulid.ULID.
 func generateUUID() (string, error) {
-	uuidLocker.Lock()
-	defer uuidLocker.Unlock()
+	entropy := uuidEntropyPool.Get().(io.Reader)
+	defer uuidEntropyPool.Put(entropy)
 
-	t := time.Now().UTC()
-	entropy := rand.New(rand.NewSource(t.UnixNano()))
-
-	id, err := ulid.New(ulid.Timestamp(t), entropy)
+	id, err := ulid.New(ulid.Timestamp(time.Now().UTC()), entropy)
 	if err != nil {
 		return "", err
 	}
@@ -126,11 +355,14 @@ func generateUUID() (string, error) {
 }
 
 // hashPassword hashes and salts provided password.
-// Returns string hashed password.
+// Returns string hashed password, error if password is blank, padded with spaces or longer than maxPasswordLength.
 func hashPassword(password string) (string, error) {
 	if password == "" || strings.TrimSpace(password) != password {
 		return "", consts.ErrInvalidPassword
 	}
+	if len(password) > maxPasswordLength {
+		return "", consts.ErrPasswordTooLong
+	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
 	if err != nil {
@@ -158,13 +390,13 @@ func comparePassword(hashedPassword string, password string) error {
 // setCurrentSecretOnce checks if currAuthSecret is set, if not,
 // retrieves the active secret key found in secrets table.
 // Returns any db encountered error, or nil if secret is already set or no error.
-func setCurrentSecretOnce() error {
+func setCurrentSecretOnce(ctx context.Context) error {
 	if currAuthSecret != nil {
 		return nil
 	}
 
 	var err error
-	currAuthSecret, err = getActiveSecretRow()
+	currAuthSecret, err = getActiveSecretRow(ctx)
 	if err != nil {
 		return err
 	}
@@ -185,15 +417,133 @@ func generateEmailVerifyLink(token string) (string, error) {
 	return link, nil
 }
 
+// generateParentalConsentLink generates the link sent to a parent to consent to their child's account.
+// Returns error if token string is empty.
+func generateParentalConsentLink(token string) (string, error) {
+	if token == "" {
+		return "", authconst.ErrEmptyToken
+	}
+
+	return fmt.Sprintf("%s/%s=%s", domainName, verifyParentalConsentLinkStub, token), nil
+}
+
+// generateLoginCountryLink generates the link sent to a user to confirm a sign in from a new country.
+// Returns error if token string is empty.
+func generateLoginCountryLink(token string) (string, error) {
+	if token == "" {
+		return "", authconst.ErrEmptyToken
+	}
+
+	return fmt.Sprintf("%s/%s=%s", domainName, confirmLoginCountryLinkStub, token), nil
+}
+
+// generatePasswordResetLink generates the link sent to a user to choose a new password.
+// Returns error if token string is empty.
+func generatePasswordResetLink(token string) (string, error) {
+	if token == "" {
+		return "", authconst.ErrEmptyToken
+	}
+
+	return fmt.Sprintf("%s/%s=%s", domainName, resetPasswordLinkStub, token), nil
+}
+
+// generateEmailChangeLink generates the link sent to the new email of a user to confirm the change.
+// Returns error if token string is empty.
+func generateEmailChangeLink(token string) (string, error) {
+	if token == "" {
+		return "", authconst.ErrEmptyToken
+	}
+
+	return fmt.Sprintf("%s/%s=%s", domainName, confirmEmailChangeLinkStub, token), nil
+}
+
+// authorizeUser verifies token against the database and checks it carries at least user permission.
+// Tokens idle for longer than hosts_auth_idletimeout are not valid.
+// Returns the uuid of the token's user, an Unauthenticated status error if token is not valid,
+// PermissionDenied if its permission is too low.
+func authorizeUser(ctx context.Context, token string) (string, error) {
+	retrievedIdentity, err := pairTokenWithCachedSecret(ctx, token)
+	if err != nil {
+		return "", status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	authority := auth.NewAuthority(auth.Jwt, auth.User)
+	defer authority.Invalidate()
+
+	if err := authority.Authorize(retrievedIdentity); err != nil {
+		return "", status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	if err := touchSession(ctx, token); err != nil {
+		return "", err
+	}
+
+	return auth.ExtractUUID(token), nil
+}
+
+// authorizeAdmin verifies token against the database and checks it carries admin permission.
+// Every authorized call is recorded in user_svc.admin_actions as action on subject, see QueryAdminActivity,
+// and is refused if it cannot be recorded, which a standby instance never can.
+// token may also be a service api key scoped for the rpc, see authorizeServiceCaller.
+// Returns an Unauthenticated status error if token is not valid, PermissionDenied if it is not an admin's.
+func authorizeAdmin(ctx context.Context, token string, action string, subject string) error {
+	if isServiceAPIKey(token) {
+		return authorizeServiceCaller(ctx, token, action, subject)
+	}
+
+	retrievedIdentity, err := pairTokenWithCachedSecret(ctx, token)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	authority := auth.NewAuthority(auth.Jwt, auth.Admin)
+	defer authority.Invalidate()
+
+	if err := authority.Authorize(retrievedIdentity); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	return recordAdminCall(ctx, token, action, subject)
+}
+
+// recordAdminCall records the authorized call of token in user_svc.admin_actions as action on subject.
+// Returns a status error if the session of token is idle or the call cannot be recorded.
+func recordAdminCall(ctx context.Context, token string, action string, subject string) error {
+	if err := touchSession(ctx, token); err != nil {
+		return err
+	}
+
+	// a standby cannot record the call
+	if isStandby {
+		return standbyStatus(ctx)
+	}
+
+	if err := insertAdminAction(ctx, auth.ExtractUUID(token), action, subject, time.Now()); err != nil {
+		logger.Error(consts.AdminActivityTag, consts.MsgErrRecordAdminAction, err.Error())
+		return statusFromError(err)
+	}
+
+	return nil
+}
+
+// checkEmailVerified returns ErrEmailNotVerified if verified emails are required and user has not verified theirs.
+func checkEmailVerified(user *pblib.User) error {
+	if requireVerifiedEmail && !user.GetIsVerified() {
+		return consts.ErrEmailNotVerified
+	}
+
+	return nil
+}
+
 // getAuthIdentification gets or generates the latest AuthToken for the User.
 // Returns the identification or error.
-func getAuthIdentification(retrievedUser *pblib.User) (*pblib.Identification, error) {
+func getAuthIdentification(ctx context.Context, retrievedUser *pblib.User) (*pblib.Identification, error) {
 	if retrievedUser == nil {
 		return nil, consts.ErrStatusNilRequestUser
 	}
 	var identification *pblib.Identification
 
-	existingToken, err := getAuthTokenRow(retrievedUser.GetUuid())
+	existingToken, err := getAuthTokenRow(ctx, retrievedUser.GetUuid())
 	if err == nil {
 		if existingToken.permission != retrievedUser.PermissionLevel {
 			return nil, consts.ErrStatusPermissionMismatch
@@ -216,16 +566,16 @@ func getAuthIdentification(retrievedUser *pblib.User) (*pblib.Identification, er
 			ExpirationTimestamp: time.Now().UTC().Add(time.Hour * time.Duration(authTokenExpirationTime)).Unix(),
 		}
 
-		if err := setCurrentSecretOnce(); err != nil {
+		if err := setCurrentSecretOnce(ctx); err != nil {
 			return nil, status.Error(codes.Unauthenticated, err.Error())
 		}
-		newToken, err := auth.NewToken(header, body, currAuthSecret)
+		newToken, err := signAuthToken(header, newAuthClaims(body, retrievedUser, time.Now()), currAuthSecret)
 		if err != nil {
 			return nil, status.Error(codes.Unauthenticated, err.Error())
 		}
 
 		// insert token into db for auditing
-		if err := insertAuthToken(newToken, header, body, currAuthSecret); err != nil {
+		if err := insertAuthToken(ctx, newToken, header, body, currAuthSecret); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 
@@ -238,9 +588,11 @@ func getAuthIdentification(retrievedUser *pblib.User) (*pblib.Identification, er
 	return identification, nil
 }
 
-// newAuthIdentification generates a new AuthToken for user.
+// newAuthIdentification generates a new AuthToken for the user of oldBody, with the custom claims of user,
+// or none if user is nil.
 // Returns the new identification or error.
-func newAuthIdentification(oldHeader *auth.Header, oldBody *auth.Body) (*pblib.Identification, error) {
+func newAuthIdentification(ctx context.Context, oldHeader *auth.Header, oldBody *auth.Body,
+	user *pblib.User) (*pblib.Identification, error) {
 	if err := auth.ValidateHeader(oldHeader); err != nil {
 		return nil, err
 	}
@@ -259,17 +611,17 @@ func newAuthIdentification(oldHeader *auth.Header, oldBody *auth.Body) (*pblib.I
 		ExpirationTimestamp: time.Now().UTC().Add(time.Hour * time.Duration(authTokenExpirationTime)).Unix(),
 	}
 
-	if err := setCurrentSecretOnce(); err != nil {
+	if err := setCurrentSecretOnce(ctx); err != nil {
 		return nil, err
 	}
 
-	newToken, err := auth.NewToken(header, body, currAuthSecret)
+	newToken, err := signAuthToken(header, newAuthClaims(body, user, time.Now()), currAuthSecret)
 	if err != nil {
 		return nil, err
 	}
 
 	// insert token into db for auditing
-	if err := insertAuthToken(newToken, header, body, currAuthSecret); err != nil {
+	if err := insertAuthToken(ctx, newToken, header, body, currAuthSecret); err != nil {
 		return nil, err
 	}
 
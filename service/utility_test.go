@@ -1,12 +1,14 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
 	"github.com/hwsc-org/hwsc-lib/auth"
 	authconst "github.com/hwsc-org/hwsc-lib/consts"
 	"github.com/hwsc-org/hwsc-user-svc/consts"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -55,13 +57,64 @@ func TestIsStateAvailable(t *testing.T) {
 	wg.Wait() // wait until all goroutines finish executing
 }
 
+func TestUUIDLockTable(t *testing.T) {
+	var table uuidLockTable
+
+	// same uuid always maps to the same stripe
+	assert.Equal(t, table.stripe(validUUID), table.stripe(validUUID))
+
+	// uuids are spread over the stripes
+	stripes := make(map[*sync.RWMutex]bool)
+	for i := 0; i < 1000; i++ {
+		stripes[table.stripe(fmt.Sprintf("uuid-%d", i))] = true
+	}
+	assert.True(t, len(stripes) > uuidLockStripes/2)
+
+	// readers share the stripe
+	unlockFirst := table.readLock(validUUID)
+	unlockSecond := table.readLock(validUUID)
+	unlockFirst()
+	unlockSecond()
+
+	// writer blocks readers of the same uuid
+	unlockWriter := table.writeLock(validUUID)
+	acquired := make(chan struct{})
+	go func() {
+		unlock := table.readLock(validUUID)
+		close(acquired)
+		unlock()
+	}()
+
+	select {
+	case <-acquired:
+		t.Error("read lock acquired while write locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlockWriter()
+	<-acquired
+
+	// test race conditions
+	const count = 50
+	var wg sync.WaitGroup
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			defer wg.Done()
+			unlock := table.writeLock(fmt.Sprintf("uuid-%d", i%5))
+			unlock()
+		}(i)
+	}
+	wg.Wait()
+}
+
 func TestValidateUser(t *testing.T) {
 	// valid
 	validTest := pblib.User{
 		FirstName:    "Lisa",
 		LastName:     "Kim",
 		Email:        "lisa@test.com",
-		Password:     "12345678",
+		Password:     "kim-lisa-uwb",
 		Organization: "uwb",
 	}
 
@@ -70,7 +123,7 @@ func TestValidateUser(t *testing.T) {
 		FirstName:    "",
 		LastName:     "Kim",
 		Email:        "lisa@test.com",
-		Password:     "12345678",
+		Password:     "kim-lisa-uwb",
 		Organization: "uwb",
 	}
 
@@ -79,7 +132,7 @@ func TestValidateUser(t *testing.T) {
 		FirstName:    "Lisa",
 		LastName:     "",
 		Email:        "lisa@test.com",
-		Password:     "12345678",
+		Password:     "kim-lisa-uwb",
 		Organization: "uwb",
 	}
 
@@ -88,7 +141,7 @@ func TestValidateUser(t *testing.T) {
 		FirstName:    "Lisa",
 		LastName:     "Kim",
 		Email:        "@",
-		Password:     "12345678",
+		Password:     "kim-lisa-uwb",
 		Organization: "uwb",
 	}
 
@@ -106,7 +159,7 @@ func TestValidateUser(t *testing.T) {
 		FirstName:    "Lisa",
 		LastName:     "Kim",
 		Email:        "lisa@test.com",
-		Password:     "12345678",
+		Password:     "kim-lisa-uwb",
 		Organization: "",
 	}
 
@@ -144,6 +197,16 @@ func TestValidatePassword(t *testing.T) {
 
 	err = validatePassword("1234l2k3jalkj;skdfj")
 	assert.Nil(t, err)
+
+	err = validatePassword(strings.Repeat("a", maxPasswordLength))
+	assert.Nil(t, err)
+
+	err = validatePassword(strings.Repeat("a", maxPasswordLength+1))
+	assert.EqualError(t, err, consts.ErrPasswordTooLong.Error())
+
+	// multi-byte characters count by byte
+	err = validatePassword(strings.Repeat("é", maxPasswordLength/2+1))
+	assert.EqualError(t, err, consts.ErrPasswordTooLong.Error())
 }
 
 func TestValidateFirstName(t *testing.T) {
@@ -168,6 +231,14 @@ func TestValidateFirstName(t *testing.T) {
 		{"Hell'o World", false},
 		{reachMaxLengthTrailingSpaces, false},
 		{reachMaxLengthSpacesBetween, false},
+		{"José", false},
+		{"Zoë Ørsted", false},
+		{"O’Brien", false},
+		{"李小龍", false},
+		{"Ђорђе", false},
+		{strings.Repeat("é", 32), false},
+		{strings.Repeat("é", 33), true},
+		{"José!", true},
 	}
 
 	for _, c := range cases {
@@ -203,6 +274,14 @@ func TestValidateLastName(t *testing.T) {
 		{"Hell'o World", false},
 		{reachMaxLengthTrailingSpaces, false},
 		{reachMaxLengthSpacesBetween, false},
+		{"José", false},
+		{"Zoë Ørsted", false},
+		{"O’Brien", false},
+		{"李小龍", false},
+		{"Ђорђе", false},
+		{strings.Repeat("é", 32), false},
+		{strings.Repeat("é", 33), true},
+		{"José!", true},
 	}
 
 	for _, c := range cases {
@@ -216,6 +295,53 @@ func TestValidateLastName(t *testing.T) {
 	}
 }
 
+func TestValidateNameLegacy(t *testing.T) {
+	legacyNameValidation = true
+	defer func() { legacyNameValidation = false }()
+
+	cases := []struct {
+		name     string
+		isExpErr bool
+	}{
+		{"Hello", false},
+		{"Hell'o World", false},
+		{"José", true},
+		{"李小龍", true},
+		{strings.Repeat("é", 16), true},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.isExpErr, validateFirstName(c.name) != nil, c.name)
+		assert.Equal(t, c.isExpErr, validateLastName(c.name) != nil, c.name)
+	}
+}
+
+func TestParseClearFields(t *testing.T) {
+	cases := []struct {
+		desc     string
+		fields   []string
+		expected map[string]bool
+		isExpErr bool
+	}{
+		{"test no fields", nil, map[string]bool{}, false},
+		{"test organization", []string{"organization"}, map[string]bool{userFieldOrganization: true}, false},
+		{"test case insensitive", []string{"Organization", "ORGANIZATION"},
+			map[string]bool{userFieldOrganization: true}, false},
+		{"test required field", []string{"organization", "email"}, nil, true},
+		{"test unknown field", []string{"nickname"}, nil, true},
+	}
+
+	for _, c := range cases {
+		clearFields, err := parseClearFields(c.fields)
+		if c.isExpErr {
+			assert.EqualError(t, err, consts.ErrInvalidClearField.Error(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+		}
+		assert.Equal(t, c.expected, clearFields, c.desc)
+	}
+}
+
 func TestValidateOrganization(t *testing.T) {
 	err := validateOrganization("")
 	assert.NotNil(t, err)
@@ -224,8 +350,102 @@ func TestValidateOrganization(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestValidateOrganizationAllowlist(t *testing.T) {
+	organizationAllowlist = parseAllowlist(" Unit Testing,hwsc ,, ")
+	defer func() { organizationAllowlist = nil }()
+
+	cases := []struct {
+		desc   string
+		name   string
+		expErr error
+	}{
+		{"test allowed organization", "Unit Testing", nil},
+		{"test allowed organization trimmed from config", "hwsc", nil},
+		{"test typo", "Unit Tesing", consts.ErrOrganizationNotAllowed},
+		{"test case must match", "HWSC", consts.ErrOrganizationNotAllowed},
+		{"test empty organization", "", consts.ErrInvalidUserOrganization},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expErr, validateOrganization(c.name), c.desc)
+	}
+
+	assert.Nil(t, parseAllowlist(""), "test empty allowlist accepts any organization")
+	assert.Nil(t, parseAllowlist(" , "), "test blank allowlist accepts any organization")
+}
+
+func TestCheckEmailVerified(t *testing.T) {
+	verified := &pblib.User{IsVerified: true}
+	unverified := &pblib.User{IsVerified: false}
+
+	desc := "test enforcement off accepts unverified users"
+	assert.Nil(t, checkEmailVerified(unverified), desc)
+
+	requireVerifiedEmail = true
+	defer func() { requireVerifiedEmail = false }()
+
+	desc = "test enforcement on"
+	assert.Nil(t, checkEmailVerified(verified), desc)
+	assert.Equal(t, consts.ErrEmailNotVerified, checkEmailVerified(unverified), desc)
+	assert.EqualError(t, statusFromError(checkEmailVerified(unverified)),
+		"rpc error: code = FailedPrecondition desc = "+consts.ErrEmailNotVerified.Error(), desc)
+}
+
+func TestParseBirthdate(t *testing.T) {
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		desc      string
+		birthdate string
+		isExpErr  bool
+	}{
+		{"test valid birthdate", "2010-02-28", false},
+		{"test born today", "2019-07-01", false},
+		{"test oldest birthdate", "1868-07-02", false},
+		{"test future birthdate", "2019-07-02", true},
+		{"test too old", "1868-07-01", true},
+		{"test wrong layout", "07/01/2010", true},
+		{"test invalid date", "2010-02-30", true},
+	}
+
+	for _, c := range cases {
+		birthdate, err := parseBirthdate(c.birthdate, now)
+		if c.isExpErr {
+			assert.Equal(t, consts.ErrInvalidBirthdate, err, c.desc)
+			assert.True(t, birthdate.IsZero(), c.desc)
+		} else {
+			assert.Nil(t, err, c.desc)
+			assert.Equal(t, c.birthdate, birthdate.Format(birthdateLayout), c.desc)
+		}
+	}
+}
+
+func TestAgeOn(t *testing.T) {
+	birthdate := time.Date(2006, 7, 1, 0, 0, 0, 0, time.UTC)
+	leapBirthdate := time.Date(2004, 2, 29, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		desc      string
+		birthdate time.Time
+		now       time.Time
+		expAge    int
+		isExpGate bool
+	}{
+		{"test day before 13th birthday", birthdate, time.Date(2019, 6, 30, 23, 59, 0, 0, time.UTC), 12, true},
+		{"test 13th birthday", birthdate, time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), 13, false},
+		{"test leap birthday in common year", leapBirthdate, time.Date(2017, 2, 28, 0, 0, 0, 0, time.UTC), 12, true},
+		{"test day after leap birthday in common year", leapBirthdate, time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), 13, false},
+		{"test no birthdate", time.Time{}, time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC), 2018, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expAge, ageOn(c.birthdate, c.now), c.desc)
+		assert.Equal(t, c.isExpGate, requiresParentalConsent(c.birthdate, c.now), c.desc)
+	}
+}
+
 func TestGenerateUUID(t *testing.T) {
-	// NOTE: force a race condition by commenting out the locks inside generateUUID()
+	// NOTE: run with -race, generateUUID() shares pooled entropy readers between goroutines
 
 	const count = 100
 	var tokens sync.Map
@@ -282,6 +502,11 @@ func TestHashPassword(t *testing.T) {
 	assert.EqualError(t, err, consts.ErrInvalidPassword.Error())
 	assert.Equal(t, "", hashed)
 
+	// test password longer than bcrypt accepts
+	hashed, err = hashPassword(strings.Repeat("a", maxPasswordLength+1))
+	assert.EqualError(t, err, consts.ErrPasswordTooLong.Error())
+	assert.Equal(t, "", hashed)
+
 	// test password and hash password !=
 	start := "@#$Sdadf?><;?/`~+-=alskfjwi23xcv"
 	for i := 0; i < 30; i++ {
@@ -317,11 +542,13 @@ func TestComparePassword(t *testing.T) {
 }
 
 func TestSetCurrentSecretOnce(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	err := unitTestDeleteAuthSecretTable()
 	assert.Nil(t, err)
 
 	desc := "test no active key in db error"
-	err = setCurrentSecretOnce()
+	err = setCurrentSecretOnce(context.TODO())
 	assert.EqualError(t, err, consts.ErrNoActiveSecretKeyFound.Error(), desc)
 
 	desc = "test nil return when currAuthSecret is already set"
@@ -330,16 +557,16 @@ func TestSetCurrentSecretOnce(t *testing.T) {
 		CreatedTimestamp:    time.Now().Unix(),
 		ExpirationTimestamp: time.Now().Unix(), // TODO fix expiration in 1 week
 	}
-	err = setCurrentSecretOnce()
+	err = setCurrentSecretOnce(context.TODO())
 	assert.Nil(t, err, desc)
 
 	desc = "test retrieval and setting of an existing active key in db"
 	currAuthSecret = nil
-	err = insertNewAuthSecret()
+	err = insertNewAuthSecret(context.TODO())
 	assert.Nil(t, err)
-	err = setCurrentSecretOnce()
+	err = setCurrentSecretOnce(context.TODO())
 	assert.Nil(t, err, desc)
-	retrievedSecret, err := getActiveSecretRow()
+	retrievedSecret, err := getActiveSecretRow(context.TODO())
 	assert.Nil(t, err)
 	assert.Equal(t, currAuthSecret.GetKey(), retrievedSecret.GetKey())
 }
@@ -358,7 +585,23 @@ func TestGenerateEmailVerifyLink(t *testing.T) {
 	assert.Nil(t, err, desc)
 }
 
+func TestGenerateEmailChangeLink(t *testing.T) {
+	desc := "test empty string"
+	link, err := generateEmailChangeLink("")
+	assert.Empty(t, link, desc)
+	assert.EqualError(t, err, authconst.ErrEmptyToken.Error(), desc)
+
+	desc = "test valid token"
+	token := "someRandomTokenString123"
+	manuallyBuiltLink := fmt.Sprintf("%s/%s=%s", domainName, confirmEmailChangeLinkStub, token)
+	link, err = generateEmailChangeLink(token)
+	assert.Equal(t, manuallyBuiltLink, link, desc)
+	assert.Nil(t, err, desc)
+}
+
 func TestGetAuthIdentification(t *testing.T) {
+	unitTestRequireIntegration(t)
+
 	lastName1 := "GetToken-One"
 	lastName2 := "GetToken-Two"
 
@@ -392,7 +635,7 @@ func TestGetAuthIdentification(t *testing.T) {
 		{nil, true, consts.ErrStatusNilRequestUser.Error()},
 	}
 	for _, c := range cases {
-		identification, err := getAuthIdentification(c.user)
+		identification, err := getAuthIdentification(context.TODO(), c.user)
 
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg)
@@ -405,9 +648,11 @@ func TestGetAuthIdentification(t *testing.T) {
 }
 
 func TestNewAuthIdentification(t *testing.T) {
-	err := insertNewAuthSecret()
+	unitTestRequireIntegration(t)
+
+	err := insertNewAuthSecret(context.TODO())
 	assert.Nil(t, err, "generate auth secret")
-	err = setCurrentSecretOnce()
+	err = setCurrentSecretOnce(context.TODO())
 	assert.Nil(t, err, "set auth secret")
 	cases := []struct {
 		desc     string
@@ -421,7 +666,7 @@ func TestNewAuthIdentification(t *testing.T) {
 		{"test for valid input", validAuthTokenHeader, validAuthTokenBody, false, ""},
 	}
 	for _, c := range cases {
-		identification, err := newAuthIdentification(c.header, c.body)
+		identification, err := newAuthIdentification(context.TODO(), c.header, c.body, nil)
 		if c.isExpErr {
 			assert.EqualError(t, err, c.expMsg, c.desc)
 			assert.Nil(t, identification, c.desc)
@@ -434,11 +679,11 @@ func TestNewAuthIdentification(t *testing.T) {
 	// sleep is needed to ensure expiration timestamps are different
 	time.Sleep(2 * time.Second)
 	caseNewAuthToken := "test to generate new auth token"
-	validID1, err := newAuthIdentification(validAuthTokenHeader, validAuthTokenBody)
+	validID1, err := newAuthIdentification(context.TODO(), validAuthTokenHeader, validAuthTokenBody, nil)
 	assert.NotNil(t, validID1, caseNewAuthToken)
 	assert.Nil(t, err, caseNewAuthToken)
 	time.Sleep(2 * time.Second)
-	validID2, err := newAuthIdentification(validAuthTokenHeader, validAuthTokenBody)
+	validID2, err := newAuthIdentification(context.TODO(), validAuthTokenHeader, validAuthTokenBody, nil)
 	assert.NotNil(t, validID1, caseNewAuthToken)
 	assert.Nil(t, err, caseNewAuthToken)
 
@@ -446,14 +691,64 @@ func TestNewAuthIdentification(t *testing.T) {
 	assert.NotEqual(t, validID1.Token, validID2.Token, caseNewAuthToken)
 
 	// ensure we get the new auth token and not the old auth token
-	retrievedToken, err := getAuthTokenRow(validAuthTokenBody.UUID)
+	retrievedToken, err := getAuthTokenRow(context.TODO(), validAuthTokenBody.UUID)
 	assert.Nil(t, err, caseNewAuthToken)
 	assert.Equal(t, validID2.Token, retrievedToken.token, caseNewAuthToken)
 
 	caseNewAuthSecret := "test new auth secret"
-	err = insertNewAuthSecret()
+	err = insertNewAuthSecret(context.TODO())
 	assert.Nil(t, err, caseNewAuthSecret)
-	retrievedToken, err = getAuthTokenRow(validAuthTokenBody.UUID)
+	retrievedToken, err = getAuthTokenRow(context.TODO(), validAuthTokenBody.UUID)
 	assert.Nil(t, err, caseNewAuthSecret)
 	assert.Equal(t, validID2.Token, retrievedToken.token, caseNewAuthSecret)
 }
+
+func BenchmarkValidateUser(b *testing.B) {
+	user := unitTestUserGenerator("BenchmarkValidateUser")
+	for i := 0; i < b.N; i++ {
+		_ = validateUser(user)
+	}
+}
+
+func BenchmarkHashPassword(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, _ = hashPassword("BenchmarkHashPassword")
+	}
+}
+
+func BenchmarkComparePassword(b *testing.B) {
+	hashedPassword, err := hashPassword("BenchmarkComparePassword")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = comparePassword(hashedPassword, "BenchmarkComparePassword")
+	}
+}
+
+func BenchmarkGenerateUUID(b *testing.B) {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, _ = generateUUID()
+		}
+	})
+}
+
+func BenchmarkNewToken(b *testing.B) {
+	secret, err := auth.GenerateSecretKey(auth.SecretByteSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	pbSecret := &pblib.Secret{
+		Key:                 secret,
+		CreatedTimestamp:    time.Now().Unix(),
+		ExpirationTimestamp: time.Now().Add(time.Hour).Unix(),
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = auth.NewToken(validAuthTokenHeader, validAuthTokenBody, pbSecret)
+	}
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	"github.com/hwsc-org/hwsc-lib/logger"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"strings"
+)
+
+// The service is registered once per API version, every version is served by the same Service handlers.
+// Breaking changes, such as FieldMask updates or a new error model, are made for the version returned by
+// apiVersion, so v1 clients keep their behavior until they upgrade. Clients negotiate by calling
+// GetApiVersions on the newest service they know, an Unimplemented status means the instance only serves v1.
+
+// userMethod is a Service handler, as a method expression such as (*Service).GetUser
+type userMethod func(s *Service, ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+
+// apiVersionKey is the context key of the API version a request was made to
+type apiVersionKey struct{}
+
+const (
+	apiVersion1 = "v1"
+	apiVersion2 = "v2"
+
+	// userServiceV2 is the fully qualified name of the v2 service, v1 is "user.UserService"
+	userServiceV2 = "user.v2.UserService"
+)
+
+var (
+	// apiVersions are the API versions served, oldest first
+	apiVersions = []string{apiVersion1, apiVersion2}
+
+	// userStreamsV2 are the streaming rpc methods of the v2 service, which the v1 proto has none of
+	userStreamsV2 = []grpc.StreamDesc{createUsersStreamDesc, streamUsersStreamDesc}
+
+	// userMethodsV2 are the unary rpc methods of the v2 service, every Service handler. Rpcs added after the
+	// generated v1 proto are only served by v2, a handler missing here cannot be called.
+	userMethodsV2 = map[string]userMethod{
+		"GetStatus":                     (*Service).GetStatus,
+		"CreateUser":                    (*Service).CreateUser,
+		"DeleteUser":                    (*Service).DeleteUser,
+		"UpdateUser":                    (*Service).UpdateUser,
+		"AuthenticateUser":              (*Service).AuthenticateUser,
+		"ListUsers":                     (*Service).ListUsers,
+		"GetUser":                       (*Service).GetUser,
+		"ShareDocument":                 (*Service).ShareDocument,
+		"GetAuthSecret":                 (*Service).GetAuthSecret,
+		"GetNewAuthToken":               (*Service).GetNewAuthToken,
+		"VerifyAuthToken":               (*Service).VerifyAuthToken,
+		"MakeNewAuthSecret":             (*Service).MakeNewAuthSecret,
+		"VerifyEmailToken":              (*Service).VerifyEmailToken,
+		"GetApiVersions":                (*Service).GetApiVersions,
+		"ReplayEvents":                  (*Service).ReplayEvents,
+		"GetUserStats":                  (*Service).GetUserStats,
+		"VerifyParentalConsent":         (*Service).VerifyParentalConsent,
+		"GetUsageReport":                (*Service).GetUsageReport,
+		"GetReferralStats":              (*Service).GetReferralStats,
+		"SetOnboardingStep":             (*Service).SetOnboardingStep,
+		"GetOnboardingState":            (*Service).GetOnboardingState,
+		"GetNotificationPreferences":    (*Service).GetNotificationPreferences,
+		"UpdateNotificationPreferences": (*Service).UpdateNotificationPreferences,
+		"QueryAdminActivity":            (*Service).QueryAdminActivity,
+		"LinkAuthMethod":                (*Service).LinkAuthMethod,
+		"ListAuthMethods":               (*Service).ListAuthMethods,
+		"UnlinkAuthMethod":              (*Service).UnlinkAuthMethod,
+		"ConfirmLoginCountry":           (*Service).ConfirmLoginCountry,
+		"GetProfileHistory":             (*Service).GetProfileHistory,
+		"FavoriteDocument":              (*Service).FavoriteDocument,
+		"UnfavoriteDocument":            (*Service).UnfavoriteDocument,
+		"ListFavorites":                 (*Service).ListFavorites,
+		"RegisterDocument":              (*Service).RegisterDocument,
+		"UnregisterDocument":            (*Service).UnregisterDocument,
+		"GetDocumentQuota":              (*Service).GetDocumentQuota,
+		"SetDocumentPublic":             (*Service).SetDocumentPublic,
+		"ListPublicDocuments":           (*Service).ListPublicDocuments,
+		"SetSharePolicy":                (*Service).SetSharePolicy,
+		"GetSharePolicy":                (*Service).GetSharePolicy,
+		"RequestPasswordReset":          (*Service).RequestPasswordReset,
+		"ResetPassword":                 (*Service).ResetPassword,
+		"RefreshAuthToken":              (*Service).RefreshAuthToken,
+		"GetAuditLog":                   (*Service).GetAuditLog,
+		"RestoreUser":                   (*Service).RestoreUser,
+		"ConfirmEmailChange":            (*Service).ConfirmEmailChange,
+		"CancelEmailChange":             (*Service).CancelEmailChange,
+		"ResendVerificationEmail":       (*Service).ResendVerificationEmail,
+		"LogoutUser":                    (*Service).LogoutUser,
+		"CreateOrganization":            (*Service).CreateOrganization,
+		"GetOrganization":               (*Service).GetOrganization,
+		"ListOrganizationUsers":         (*Service).ListOrganizationUsers,
+		"SetOrganizationAdmin":          (*Service).SetOrganizationAdmin,
+		"ListUserDocuments":             (*Service).ListUserDocuments,
+		"UnshareDocument":               (*Service).UnshareDocument,
+		"ListSharedWithMe":              (*Service).ListSharedWithMe,
+		"VerifyUser":                    (*Service).VerifyUser,
+		"DeleteUsersByOrganization":     (*Service).DeleteUsersByOrganization,
+		"ForgetUser":                    (*Service).ForgetUser,
+		"Enable2FA":                     (*Service).Enable2FA,
+		"Verify2FA":                     (*Service).Verify2FA,
+		"Disable2FA":                    (*Service).Disable2FA,
+		"CreateAPIKey":                  (*Service).CreateAPIKey,
+		"RevokeAPIKey":                  (*Service).RevokeAPIKey,
+		"ListAPIKeys":                   (*Service).ListAPIKeys,
+	}
+)
+
+// RegisterUserServiceV2 registers s as the v2 service of server, next to the v1 service registered
+// with pbsvc.RegisterUserServiceServer.
+func RegisterUserServiceV2(server *grpc.Server, s *Service) {
+	server.RegisterService(userServiceV2Desc(), s)
+}
+
+// userServiceV2Desc describes the v2 service, whose requests and responses are still the v1 messages.
+func userServiceV2Desc() *grpc.ServiceDesc {
+	desc := &grpc.ServiceDesc{
+		ServiceName: userServiceV2,
+		HandlerType: (*pbsvc.UserServiceServer)(nil),
+		Streams:     userStreamsV2,
+		Metadata:    "hwsc-user-svc/user/v2/user.proto",
+	}
+	for name, method := range userMethodsV2 {
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{
+			MethodName: name,
+			Handler:    versionedHandler(apiVersion2, userServiceV2, name, method),
+		})
+	}
+
+	return desc
+}
+
+// versionedHandler returns the grpc handler of method, which sees version as the apiVersion of its requests.
+func versionedHandler(version string, service string, name string, method userMethod) func(interface{},
+	context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+		interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := &pbsvc.UserRequest{}
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+
+		ctx = context.WithValue(ctx, apiVersionKey{}, version)
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return method(srv.(*Service), ctx, req.(*pbsvc.UserRequest))
+		}
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: "/" + service + "/" + name,
+		}
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
+// apiVersion returns the API version the request of ctx was made to, v1 unless it was made to a newer service.
+func apiVersion(ctx context.Context) string {
+	if version, ok := ctx.Value(apiVersionKey{}).(string); ok {
+		return version
+	}
+
+	return apiVersion1
+}
+
+// GetApiVersions returns the API versions served by this instance.
+// On success, the x-hwsc-api-versions response header lists every version, oldest first,
+// and the x-hwsc-api-version response header is the version the request was made to.
+func (s *Service) GetApiVersions(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	logger.RequestService("GetApiVersions")
+
+	if err := setResponseHeader(ctx, metadataKeyAPIVersions, strings.Join(apiVersions, ",")); err != nil {
+		logger.Error(consts.UserServiceTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+	if err := setResponseHeader(ctx, metadataKeyAPIVersion, apiVersion(ctx)); err != nil {
+		logger.Error(consts.UserServiceTag, consts.MsgErrSetResponseHeader, err.Error())
+		return nil, statusFromError(err)
+	}
+
+	return &pbsvc.UserResponse{
+		Status:  &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message: codes.OK.String(),
+	}, nil
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestUserServiceV2(t *testing.T) {
+	var fullMethods []string
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		fullMethods = append(fullMethods, info.FullMethod)
+		return handler(ctx, req)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(interceptor))
+	userService := &Service{}
+	pbsvc.RegisterUserServiceServer(server, userService)
+	RegisterUserServiceV2(server, userService)
+	go func() { _ = server.Serve(lis) }()
+	defer server.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	desc := "test v2 GetApiVersions"
+	var header metadata.MD
+	resp := &pbsvc.UserResponse{}
+	err = conn.Invoke(context.TODO(), "/user.v2.UserService/GetApiVersions", &pbsvc.UserRequest{}, resp,
+		grpc.Header(&header))
+	assert.Nil(t, err, desc)
+	assert.Equal(t, codes.OK.String(), resp.GetMessage(), desc)
+	assert.Equal(t, []string{"v1,v2"}, header.Get(metadataKeyAPIVersions), desc)
+	assert.Equal(t, []string{apiVersion2}, header.Get(metadataKeyAPIVersion), desc)
+	assert.Equal(t, []string{"/user.v2.UserService/GetApiVersions"}, fullMethods, desc)
+
+	desc = "test v2 shares the v1 handlers and interceptors"
+	err = conn.Invoke(context.TODO(), "/user.v2.UserService/ListUsers", &pbsvc.UserRequest{}, resp)
+	_, v1Err := pbsvc.NewUserServiceClient(conn).ListUsers(context.TODO(), &pbsvc.UserRequest{})
+	assert.Equal(t, status.Code(v1Err), status.Code(err), desc)
+	assert.Equal(t, "/user.UserService/ListUsers", fullMethods[2], desc)
+
+	desc = "test GetApiVersions is not part of v1"
+	err = conn.Invoke(context.TODO(), "/user.UserService/GetApiVersions", &pbsvc.UserRequest{}, resp)
+	assert.Equal(t, codes.Unimplemented, status.Code(err), desc)
+}
+
+func TestUserServiceV2Methods(t *testing.T) {
+	methods := []string{
+		"GetStatus",
+		"CreateUser",
+		"DeleteUser",
+		"UpdateUser",
+		"AuthenticateUser",
+		"ListUsers",
+		"GetUser",
+		"ShareDocument",
+		"GetAuthSecret",
+		"GetNewAuthToken",
+		"VerifyAuthToken",
+		"MakeNewAuthSecret",
+		"VerifyEmailToken",
+		"GetApiVersions",
+		"ReplayEvents",
+		"GetUserStats",
+		"VerifyParentalConsent",
+		"GetUsageReport",
+		"GetReferralStats",
+		"SetOnboardingStep",
+		"GetOnboardingState",
+		"GetNotificationPreferences",
+		"UpdateNotificationPreferences",
+		"QueryAdminActivity",
+		"LinkAuthMethod",
+		"ListAuthMethods",
+		"UnlinkAuthMethod",
+		"ConfirmLoginCountry",
+		"GetProfileHistory",
+		"FavoriteDocument",
+		"UnfavoriteDocument",
+		"ListFavorites",
+		"RegisterDocument",
+		"UnregisterDocument",
+		"GetDocumentQuota",
+		"SetDocumentPublic",
+		"ListPublicDocuments",
+		"SetSharePolicy",
+		"GetSharePolicy",
+		"RequestPasswordReset",
+		"ResetPassword",
+		"RefreshAuthToken",
+		"GetAuditLog",
+		"RestoreUser",
+		"ConfirmEmailChange",
+		"CancelEmailChange",
+		"ResendVerificationEmail",
+		"LogoutUser",
+		"CreateOrganization",
+		"GetOrganization",
+		"ListOrganizationUsers",
+		"SetOrganizationAdmin",
+		"ListUserDocuments",
+		"UnshareDocument",
+		"ListSharedWithMe",
+		"VerifyUser",
+		"DeleteUsersByOrganization",
+		"ForgetUser",
+		"Enable2FA",
+		"Verify2FA",
+		"Disable2FA",
+		"CreateAPIKey",
+		"RevokeAPIKey",
+		"ListAPIKeys",
+	}
+
+	// the interceptor answers instead of the handlers, the test is about routing and needs no db
+	var fullMethods []string
+	interceptor := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		fullMethods = append(fullMethods, info.FullMethod)
+		return &pbsvc.UserResponse{Message: codes.OK.String()}, nil
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(interceptor))
+	RegisterUserServiceV2(server, &Service{})
+	go func() { _ = server.Serve(lis) }()
+	defer server.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	for _, method := range methods {
+		desc := "test " + method + " is served by v2"
+		fullMethod := "/" + userServiceV2 + "/" + method
+		resp := &pbsvc.UserResponse{}
+		err := conn.Invoke(context.TODO(), fullMethod, &pbsvc.UserRequest{}, resp)
+		assert.Nil(t, err, desc)
+		assert.Equal(t, codes.OK.String(), resp.GetMessage(), desc)
+		assert.Equal(t, fullMethod, fullMethods[len(fullMethods)-1], desc)
+	}
+
+	// every unary handler of Service is an rpc, the v1 proto cannot grow so they are served by v2
+	desc := "test every Service handler is served by v2"
+	handlerType := reflect.TypeOf((*Service).GetStatus)
+	serviceType := reflect.TypeOf(&Service{})
+	var handlers []string
+	for i := 0; i < serviceType.NumMethod(); i++ {
+		if serviceType.Method(i).Type == handlerType {
+			handlers = append(handlers, serviceType.Method(i).Name)
+		}
+	}
+	assert.ElementsMatch(t, methods, handlers, desc)
+	assert.Equal(t, len(methods), len(userMethodsV2), desc)
+}
+
+func TestAPIVersion(t *testing.T) {
+	desc := "test requests default to v1"
+	assert.Equal(t, apiVersion1, apiVersion(context.TODO()), desc)
+
+	desc = "test v2 handlers see v2"
+	var version string
+	handler := versionedHandler(apiVersion2, userServiceV2, "GetStatus",
+		func(s *Service, ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+			version = apiVersion(ctx)
+			return &pbsvc.UserResponse{}, nil
+		})
+	_, err := handler(&Service{}, context.TODO(), func(interface{}) error { return nil }, nil)
+	assert.Nil(t, err, desc)
+	assert.Equal(t, apiVersion2, version, desc)
+}
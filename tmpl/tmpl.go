@@ -0,0 +1,10 @@
+// Package tmpl embeds the email templates in the binary, html files are the emails, .txt files their plain
+// text alternatives and .tmpl files the partials the html files share.
+package tmpl
+
+import "embed"
+
+// Files holds every email template, at the root of the file system
+//
+//go:embed *.html *.tmpl *.txt
+var Files embed.FS
@@ -0,0 +1,534 @@
+package usersvctest
+
+import (
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	authconst "github.com/hwsc-org/hwsc-lib/consts"
+	"github.com/hwsc-org/hwsc-lib/validation"
+	"github.com/hwsc-org/hwsc-user-svc/consts"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errInvalidRequest is what the validation interceptor of the real service answers to missing fields
+var errInvalidRequest = status.Error(codes.InvalidArgument, consts.ErrInvalidRequestFields.Error())
+
+// GetStatus answers OK, or Unavailable in the response code while the server is unavailable.
+func (s *Server) GetStatus(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	if handler := s.record("GetStatus", req); handler != nil {
+		return handler(ctx, req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.unavailable {
+		return consts.ResponseServiceUnavailable, nil
+	}
+
+	return okResponse(nil, nil), nil
+}
+
+// CreateUser stores a new unverified user and issues its email verification token.
+func (s *Server) CreateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	if handler := s.record("CreateUser", req); handler != nil {
+		return handler(ctx, req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.unavailable {
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	user := req.GetUser()
+	if user.GetFirstName() == "" || user.GetLastName() == "" || user.GetEmail() == "" || user.GetPassword() == "" {
+		return nil, errInvalidRequest
+	}
+	if s.findEmail(user.GetEmail()) != nil {
+		return nil, status.Error(codes.AlreadyExists, consts.ErrEmailExists.Error())
+	}
+
+	stored := &pblib.User{
+		Uuid:             s.newUUID(),
+		FirstName:        user.GetFirstName(),
+		LastName:         user.GetLastName(),
+		Email:            strings.ToLower(strings.TrimSpace(user.GetEmail())),
+		Password:         user.GetPassword(),
+		Organization:     user.GetOrganization(),
+		CreatedTimestamp: time.Now().UTC().Unix(),
+		PermissionLevel:  auth.PermissionStringMap[auth.UserRegistration],
+	}
+	s.users[stored.GetUuid()] = stored
+
+	token, err := s.issueEmailToken(stored.GetUuid())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return okResponse(withoutPassword(stored), &pblib.Identification{Token: token}), nil
+}
+
+// DeleteUser removes the user and its tokens, deleting a missing user succeeds.
+func (s *Server) DeleteUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	if handler := s.record("DeleteUser", req); handler != nil {
+		return handler(ctx, req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.unavailable {
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	uuid := req.GetUser().GetUuid()
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+
+	delete(s.users, uuid)
+	s.revoke(uuid)
+
+	return okResponse(&pblib.User{Uuid: uuid}, nil), nil
+}
+
+// UpdateUser changes the fields that are set, a new email is held as prospective until it is verified.
+// A different permission level is only set for admin auth tokens.
+func (s *Server) UpdateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	if handler := s.record("UpdateUser", req); handler != nil {
+		return handler(ctx, req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.unavailable {
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	update := req.GetUser()
+	if err := validation.ValidateUserUUID(update.GetUuid()); err != nil {
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+	stored, ok := s.users[update.GetUuid()]
+	if !ok {
+		return nil, consts.ErrStatusUUIDNotFound
+	}
+
+	// changing the permission level needs an admin token and signs the user out
+	permission := update.GetPermissionLevel()
+	if permission != "" && permission != stored.GetPermissionLevel() {
+		if _, ok := auth.PermissionEnumMap[permission]; !ok {
+			return nil, status.Error(codes.InvalidArgument, consts.ErrInvalidPermissionLevel.Error())
+		}
+		if req.GetIdentification().GetToken() == "" {
+			return nil, status.Error(codes.PermissionDenied, consts.ErrPermissionChangeDenied.Error())
+		}
+		if err := s.authorizeAdmin(req.GetIdentification().GetToken()); err != nil {
+			return nil, err
+		}
+		stored.PermissionLevel = permission
+		s.revokeAuthTokens(stored.GetUuid())
+	}
+
+	email := strings.ToLower(strings.TrimSpace(update.GetEmail()))
+	if email != "" && email != stored.GetEmail() {
+		if owner := s.findEmail(email); owner != nil {
+			return nil, status.Error(codes.AlreadyExists, consts.ErrEmailExists.Error())
+		}
+		if _, err := s.issueEmailToken(stored.GetUuid()); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		stored.ProspectiveEmail = email
+	}
+	if update.GetFirstName() != "" {
+		stored.FirstName = update.GetFirstName()
+	}
+	if update.GetLastName() != "" {
+		stored.LastName = update.GetLastName()
+	}
+	if update.GetPassword() != "" {
+		stored.Password = update.GetPassword()
+	}
+	if update.GetOrganization() != "" {
+		stored.Organization = update.GetOrganization()
+	}
+
+	return okResponse(withoutPassword(stored), nil), nil
+}
+
+// AuthenticateUser matches email and password and returns the user's auth token, the existing one if still valid.
+func (s *Server) AuthenticateUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	if handler := s.record("AuthenticateUser", req); handler != nil {
+		return handler(ctx, req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.unavailable {
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	user := req.GetUser()
+	if user.GetEmail() == "" || user.GetPassword() == "" {
+		return nil, errInvalidRequest
+	}
+
+	stored := s.findEmail(user.GetEmail())
+	if stored == nil || stored.GetPassword() != user.GetPassword() {
+		return nil, status.Error(codes.Unauthenticated, consts.ErrEmailDoesNotExist.Error())
+	}
+
+	identification, err := s.issueAuthToken(stored)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, consts.MsgErrGeneratingAuthToken)
+	}
+
+	return okResponse(withoutPassword(stored), identification), nil
+}
+
+// ListUsers returns every user without its password in uuid order, as a single page, to admin auth tokens.
+// The page size, page token and filter metadata of the real service are ignored.
+func (s *Server) ListUsers(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	if handler := s.record("ListUsers", req); handler != nil {
+		return handler(ctx, req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.unavailable {
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if err := s.authorizeAdmin(req.GetIdentification().GetToken()); err != nil {
+		return nil, err
+	}
+
+	uuids := make([]string, 0, len(s.users))
+	for uuid := range s.users {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	users := make([]*pblib.User, 0, len(uuids))
+	for _, uuid := range uuids {
+		users = append(users, withoutPassword(s.users[uuid]))
+	}
+
+	resp := okResponse(nil, nil)
+	resp.UserCollection = users
+	return resp, nil
+}
+
+// GetUser returns the user without its password.
+func (s *Server) GetUser(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	if handler := s.record("GetUser", req); handler != nil {
+		return handler(ctx, req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.unavailable {
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	uuid := req.GetUser().GetUuid()
+	if err := validation.ValidateUserUUID(uuid); err != nil {
+		return nil, consts.ErrStatusUUIDInvalid
+	}
+	stored, ok := s.users[uuid]
+	if !ok {
+		return nil, consts.ErrStatusUUIDNotFound
+	}
+
+	return okResponse(withoutPassword(stored), nil), nil
+}
+
+// ShareDocument answers OK to a valid auth token when every user to share with exists. Documents are not kept
+// in memory, so any duid is shared as if the token's user owned it.
+func (s *Server) ShareDocument(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	if handler := s.record("ShareDocument", req); handler != nil {
+		return handler(ctx, req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.unavailable {
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	if req.GetDuid() == "" || len(req.GetUuidsToShareDuid()) == 0 {
+		return nil, errInvalidRequest
+	}
+	if _, err := s.verifyAuthToken(req.GetIdentification().GetToken()); err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	for _, uuid := range req.GetUuidsToShareDuid() {
+		if _, ok := s.users[uuid]; !ok {
+			return nil, status.Error(codes.NotFound, consts.ErrUserNotFound.Error())
+		}
+	}
+
+	return okResponse(nil, nil), nil
+}
+
+// GetNewAuthToken replaces a valid auth token with a new one, an invalid token returns DeadlineExceeded.
+func (s *Server) GetNewAuthToken(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	if handler := s.record("GetNewAuthToken", req); handler != nil {
+		return handler(ctx, req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.unavailable {
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	identification, err := s.verifyAuthToken(req.GetIdentification().GetToken())
+	if err != nil {
+		return nil, status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	stored, ok := s.users[auth.ExtractUUID(identification.GetToken())]
+	if !ok {
+		return nil, consts.ErrStatusUUIDNotFound
+	}
+
+	delete(s.authTokens, identification.GetToken())
+	newIdentification, err := s.issueAuthToken(stored)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return okResponse(nil, newIdentification), nil
+}
+
+// VerifyAuthToken returns the token paired with the secret it was signed with, an invalid token is Unauthenticated.
+func (s *Server) VerifyAuthToken(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	if handler := s.record("VerifyAuthToken", req); handler != nil {
+		return handler(ctx, req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.unavailable {
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	identification, err := s.verifyAuthToken(req.GetIdentification().GetToken())
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	return okResponse(nil, identification), nil
+}
+
+// VerifyEmailToken consumes an email token, verifying the user or confirming its prospective email.
+func (s *Server) VerifyEmailToken(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	if handler := s.record("VerifyEmailToken", req); handler != nil {
+		return handler(ctx, req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.unavailable {
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	token := req.GetIdentification().GetToken()
+	if token == "" {
+		return nil, status.Error(codes.InvalidArgument, authconst.ErrEmptyToken.Error())
+	}
+	uuid, ok := s.emailTokens[token]
+	if !ok {
+		return nil, status.Error(codes.NotFound, consts.ErrNoMatchingEmailTokenFound.Error())
+	}
+	delete(s.emailTokens, token)
+
+	if stored, ok := s.users[uuid]; ok {
+		stored.IsVerified = true
+		stored.PermissionLevel = auth.PermissionStringMap[auth.User]
+		if stored.GetProspectiveEmail() != "" {
+			stored.Email = stored.GetProspectiveEmail()
+			stored.ProspectiveEmail = ""
+		}
+	}
+
+	return okResponse(nil, nil), nil
+}
+
+// GetAuthSecret returns the active secret.
+func (s *Server) GetAuthSecret(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	if handler := s.record("GetAuthSecret", req); handler != nil {
+		return handler(ctx, req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.unavailable {
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	return okResponse(nil, &pblib.Identification{Secret: s.secret}), nil
+}
+
+// MakeNewAuthSecret rotates the active secret, tokens already issued stay paired with their own secret.
+func (s *Server) MakeNewAuthSecret(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+	if handler := s.record("MakeNewAuthSecret", req); handler != nil {
+		return handler(ctx, req)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.unavailable {
+		return nil, consts.ErrStatusServiceUnavailable
+	}
+
+	s.secret = newSecret()
+
+	return okResponse(nil, nil), nil
+}
+
+// findEmail returns the user with email, nil if there is none. Callers hold the lock.
+func (s *Server) findEmail(email string) *pblib.User {
+	email = strings.ToLower(strings.TrimSpace(email))
+	for _, user := range s.users {
+		if user.GetEmail() == email {
+			return user
+		}
+	}
+
+	return nil
+}
+
+// issueEmailToken replaces the pending email token of uuid. Callers hold the lock.
+func (s *Server) issueEmailToken(uuid string) (string, error) {
+	for token, owner := range s.emailTokens {
+		if owner == uuid {
+			delete(s.emailTokens, token)
+		}
+	}
+
+	identification, err := auth.GenerateEmailIdentification(uuid, auth.PermissionStringMap[auth.UserRegistration])
+	if err != nil {
+		return "", err
+	}
+	s.emailTokens[identification.GetToken()] = uuid
+
+	return identification.GetToken(), nil
+}
+
+// issueAuthToken returns the valid auth token of user, or signs a new one with the active secret.
+// Callers hold the lock.
+func (s *Server) issueAuthToken(user *pblib.User) (*pblib.Identification, error) {
+	permission := auth.PermissionEnumMap[user.GetPermissionLevel()]
+	if permission < auth.UserRegistration {
+		return nil, consts.ErrStatusPermissionMismatch
+	}
+
+	for token, identification := range s.authTokens {
+		if auth.ExtractUUID(token) == user.GetUuid() {
+			if _, err := s.verifyAuthToken(token); err == nil {
+				return identification, nil
+			}
+			delete(s.authTokens, token)
+		}
+	}
+
+	header := &auth.Header{
+		Alg:      auth.AlgorithmMap[permission],
+		TokenTyp: auth.Jwt,
+	}
+	body := &auth.Body{
+		UUID:                user.GetUuid(),
+		Permission:          permission,
+		ExpirationTimestamp: time.Now().UTC().Add(authTokenLifetime).Unix(),
+	}
+	token, err := auth.NewToken(header, body, s.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	identification := &pblib.Identification{Token: token, Secret: s.secret}
+	s.authTokens[token] = identification
+
+	return identification, nil
+}
+
+// verifyAuthToken returns the identification of an issued, unexpired token of user permission.
+// Callers hold the lock.
+func (s *Server) verifyAuthToken(token string) (*pblib.Identification, error) {
+	if token == "" {
+		return nil, authconst.ErrEmptyToken
+	}
+	identification, ok := s.authTokens[token]
+	if !ok {
+		return nil, consts.ErrStatusPermissionMismatch
+	}
+
+	authority := auth.NewAuthority(auth.Jwt, auth.User)
+	defer authority.Invalidate()
+	if err := authority.Authorize(&pblib.Identification{Token: token, Secret: identification.GetSecret()}); err != nil {
+		return nil, err
+	}
+
+	return identification, nil
+}
+
+// authorizeAdmin returns an Unauthenticated status error if token is not a valid auth token,
+// or PermissionDenied if its user is not an admin. Callers hold the lock.
+func (s *Server) authorizeAdmin(token string) error {
+	identification, err := s.verifyAuthToken(token)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	admin, ok := s.users[auth.ExtractUUID(identification.GetToken())]
+	if !ok || auth.PermissionEnumMap[admin.GetPermissionLevel()] < auth.Admin {
+		return status.Error(codes.PermissionDenied, consts.MsgErrPermissionMismatch)
+	}
+
+	return nil
+}
+
+// revoke forgets every token of uuid. Callers hold the lock.
+func (s *Server) revoke(uuid string) {
+	s.revokeAuthTokens(uuid)
+	for token, owner := range s.emailTokens {
+		if owner == uuid {
+			delete(s.emailTokens, token)
+		}
+	}
+}
+
+// revokeAuthTokens forgets every auth token of uuid. Callers hold the lock.
+func (s *Server) revokeAuthTokens(uuid string) {
+	for token := range s.authTokens {
+		if auth.ExtractUUID(token) == uuid {
+			delete(s.authTokens, token)
+		}
+	}
+}
+
+func okResponse(user *pblib.User, identification *pblib.Identification) *pbsvc.UserResponse {
+	return &pbsvc.UserResponse{
+		Status:         &pbsvc.UserResponse_Code{Code: uint32(codes.OK)},
+		Message:        codes.OK.String(),
+		User:           user,
+		Identification: identification,
+	}
+}
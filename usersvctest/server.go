@@ -0,0 +1,202 @@
+// Package usersvctest provides an in-memory UserService for the contract tests of services that depend on
+// hwsc-user-svc, such as the gateway and document-svc, without Postgres, Docker or an smtp host.
+//
+// Server keeps users, email tokens, auth tokens and the auth secret in memory, and answers with the same
+// codes and messages as the real service for the cases clients have to handle. Auth tokens are signed with
+// hwsc-lib, so they verify like real ones. Any method can be made to return a fixed response or error.
+//
+//	server := usersvctest.NewServer()
+//	addr, stop, err := server.Start()
+//	defer stop()
+//	server.SetError("AuthenticateUser", status.Error(codes.Unavailable, "down for maintenance"))
+//
+// Server does not send emails, EmailToken returns the token the verification email would link to.
+package usersvctest
+
+import (
+	"github.com/golang/protobuf/proto"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/oklog/ulid"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HandlerFunc answers a request in place of the in-memory implementation
+type HandlerFunc func(ctx context.Context, req *pbsvc.UserRequest) (*pbsvc.UserResponse, error)
+
+// Server is an in-memory pbsvc.UserServiceServer, safe for concurrent use
+type Server struct {
+	lock sync.Mutex
+
+	users       map[string]*pblib.User
+	emailTokens map[string]string
+	authTokens  map[string]*pblib.Identification
+	secret      *pblib.Secret
+
+	handlers    map[string]HandlerFunc
+	requests    map[string][]*pbsvc.UserRequest
+	unavailable bool
+	entropy     *rand.Rand
+}
+
+const (
+	// authTokenLifetime matches the 2 hours auth tokens of the real service are valid for
+	authTokenLifetime = 2 * time.Hour
+
+	secretLifetime = 7 * 24 * time.Hour
+)
+
+// NewServer returns a Server without users and with a fresh auth secret.
+func NewServer() *Server {
+	s := &Server{
+		users:       make(map[string]*pblib.User),
+		emailTokens: make(map[string]string),
+		authTokens:  make(map[string]*pblib.Identification),
+		handlers:    make(map[string]HandlerFunc),
+		requests:    make(map[string][]*pbsvc.UserRequest),
+		entropy:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.secret = newSecret()
+
+	return s
+}
+
+// Start serves s on a random local port.
+// Returns the address to dial and a function stopping the server.
+func (s *Server) Start() (string, func(), error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+
+	grpcServer := grpc.NewServer()
+	pbsvc.RegisterUserServiceServer(grpcServer, s)
+	go func() { _ = grpcServer.Serve(lis) }()
+
+	return lis.Addr().String(), grpcServer.Stop, nil
+}
+
+// SetHandler answers every request to method, such as "CreateUser", with handler instead of the in-memory state.
+// A nil handler restores the in-memory implementation.
+func (s *Server) SetHandler(method string, handler HandlerFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if handler == nil {
+		delete(s.handlers, method)
+		return
+	}
+	s.handlers[method] = handler
+}
+
+// SetError fails every request to method with err, which should be a grpc status error.
+func (s *Server) SetError(method string, err error) {
+	s.SetHandler(method, func(context.Context, *pbsvc.UserRequest) (*pbsvc.UserResponse, error) {
+		return nil, err
+	})
+}
+
+// SetUnavailable makes every method answer as the real service does while it is unavailable.
+func (s *Server) SetUnavailable(unavailable bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.unavailable = unavailable
+}
+
+// Requests returns copies of the requests received by method, in the order they arrived.
+func (s *Server) Requests(method string) []*pbsvc.UserRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	requests := make([]*pbsvc.UserRequest, 0, len(s.requests[method]))
+	for _, req := range s.requests[method] {
+		requests = append(requests, proto.Clone(req).(*pbsvc.UserRequest))
+	}
+
+	return requests
+}
+
+// AddUser stores a copy of user as if it had signed up, verified users may sign in right away.
+// A missing uuid is generated. Returns the stored user without its password.
+func (s *Server) AddUser(user *pblib.User, verified bool) *pblib.User {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stored := proto.Clone(user).(*pblib.User)
+	if stored.GetUuid() == "" {
+		stored.Uuid = s.newUUID()
+	}
+	stored.Email = strings.ToLower(strings.TrimSpace(stored.GetEmail()))
+	stored.IsVerified = verified
+	stored.PermissionLevel = auth.PermissionStringMap[auth.UserRegistration]
+	if verified {
+		stored.PermissionLevel = auth.PermissionStringMap[auth.User]
+	}
+	if stored.GetCreatedTimestamp() == 0 {
+		stored.CreatedTimestamp = time.Now().UTC().Unix()
+	}
+	s.users[stored.GetUuid()] = stored
+
+	return withoutPassword(stored)
+}
+
+// EmailToken returns the pending email verification token of uuid, empty if there is none.
+func (s *Server) EmailToken(uuid string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for token, owner := range s.emailTokens {
+		if owner == uuid {
+			return token
+		}
+	}
+
+	return ""
+}
+
+// record keeps a copy of req and returns the handler set for method, nil if the in-memory implementation answers.
+func (s *Server) record(method string, req *pbsvc.UserRequest) HandlerFunc {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if req != nil {
+		s.requests[method] = append(s.requests[method], proto.Clone(req).(*pbsvc.UserRequest))
+	}
+
+	return s.handlers[method]
+}
+
+// newUUID returns a lower case ulid, like the uuids of the real service. Callers hold the lock.
+func (s *Server) newUUID() string {
+	return strings.ToLower(ulid.MustNew(ulid.Timestamp(time.Now().UTC()), s.entropy).String())
+}
+
+func newSecret() *pblib.Secret {
+	key, err := auth.GenerateSecretKey(auth.SecretByteSize)
+	if err != nil {
+		// crypto/rand failing leaves nothing to test with
+		panic(err)
+	}
+
+	now := time.Now().UTC()
+	return &pblib.Secret{
+		Key:                 key,
+		CreatedTimestamp:    now.Unix(),
+		ExpirationTimestamp: now.Add(secretLifetime).Unix(),
+	}
+}
+
+func withoutPassword(user *pblib.User) *pblib.User {
+	copied := proto.Clone(user).(*pblib.User)
+	copied.Password = ""
+
+	return copied
+}
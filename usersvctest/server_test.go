@@ -0,0 +1,310 @@
+package usersvctest
+
+import (
+	"context"
+	pbsvc "github.com/hwsc-org/hwsc-api-blocks/protobuf/hwsc-user-svc/user"
+	pblib "github.com/hwsc-org/hwsc-api-blocks/protobuf/lib"
+	"github.com/hwsc-org/hwsc-lib/auth"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"testing"
+)
+
+func unitTestClient(t *testing.T, server *Server) (pbsvc.UserServiceClient, func()) {
+	addr, stop, err := server.Start()
+	assert.Nil(t, err)
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	assert.Nil(t, err)
+
+	return pbsvc.NewUserServiceClient(conn), func() {
+		_ = conn.Close()
+		stop()
+	}
+}
+
+func TestUserLifecycle(t *testing.T) {
+	server := NewServer()
+	client, stop := unitTestClient(t, server)
+	defer stop()
+	ctx := context.Background()
+
+	user := &pblib.User{
+		FirstName:    "Lisa",
+		LastName:     "Kim",
+		Email:        "Lisa.Kim@Hwsc.com",
+		Password:     "12345678",
+		Organization: "hwsc",
+	}
+
+	desc := "test create user"
+	created, err := client.CreateUser(ctx, &pbsvc.UserRequest{User: user})
+	assert.Nil(t, err, desc)
+	assert.NotEmpty(t, created.GetUser().GetUuid(), desc)
+	assert.Equal(t, "lisa.kim@hwsc.com", created.GetUser().GetEmail(), desc)
+	assert.Empty(t, created.GetUser().GetPassword(), desc)
+	assert.False(t, created.GetUser().GetIsVerified(), desc)
+	assert.Equal(t, server.EmailToken(created.GetUser().GetUuid()), created.GetIdentification().GetToken(), desc)
+
+	desc = "test duplicate email"
+	_, err = client.CreateUser(ctx, &pbsvc.UserRequest{User: user})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), desc)
+
+	desc = "test missing fields"
+	_, err = client.CreateUser(ctx, &pbsvc.UserRequest{User: &pblib.User{Email: "a@hwsc.com"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), desc)
+
+	desc = "test unknown email token"
+	_, err = client.VerifyEmailToken(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: "x"}})
+	assert.Equal(t, codes.NotFound, status.Code(err), desc)
+
+	desc = "test verify email token"
+	_, err = client.VerifyEmailToken(ctx, &pbsvc.UserRequest{Identification: created.GetIdentification()})
+	assert.Nil(t, err, desc)
+	assert.Empty(t, server.EmailToken(created.GetUser().GetUuid()), desc)
+
+	desc = "test wrong password"
+	_, err = client.AuthenticateUser(ctx, &pbsvc.UserRequest{
+		User: &pblib.User{Email: user.GetEmail(), Password: "wrong"},
+	})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+
+	desc = "test authenticate user"
+	authenticated, err := client.AuthenticateUser(ctx, &pbsvc.UserRequest{
+		User: &pblib.User{Email: user.GetEmail(), Password: user.GetPassword()},
+	})
+	assert.Nil(t, err, desc)
+	assert.True(t, authenticated.GetUser().GetIsVerified(), desc)
+	assert.NotEmpty(t, authenticated.GetIdentification().GetToken(), desc)
+
+	desc = "test authenticate again reuses the token"
+	again, err := client.AuthenticateUser(ctx, &pbsvc.UserRequest{
+		User: &pblib.User{Email: user.GetEmail(), Password: user.GetPassword()},
+	})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, authenticated.GetIdentification().GetToken(), again.GetIdentification().GetToken(), desc)
+
+	desc = "test verify auth token"
+	verified, err := client.VerifyAuthToken(ctx, &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: authenticated.GetIdentification().GetToken()},
+	})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, authenticated.GetIdentification().GetSecret().GetKey(), verified.GetIdentification().GetSecret().GetKey(), desc)
+
+	desc = "test token survives a secret rotation"
+	_, err = client.MakeNewAuthSecret(ctx, &pbsvc.UserRequest{})
+	assert.Nil(t, err, desc)
+	_, err = client.VerifyAuthToken(ctx, &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: authenticated.GetIdentification().GetToken()},
+	})
+	assert.Nil(t, err, desc)
+
+	desc = "test get new auth token"
+	renewed, err := client.GetNewAuthToken(ctx, &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: authenticated.GetIdentification().GetToken()},
+	})
+	assert.Nil(t, err, desc)
+	assert.NotEqual(t, authenticated.GetIdentification().GetToken(), renewed.GetIdentification().GetToken(), desc)
+
+	desc = "test replaced token is invalid"
+	_, err = client.VerifyAuthToken(ctx, &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: authenticated.GetIdentification().GetToken()},
+	})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+
+	desc = "test update email waits for verification"
+	updated, err := client.UpdateUser(ctx, &pbsvc.UserRequest{
+		User: &pblib.User{Uuid: created.GetUser().GetUuid(), Email: "lisa@hwsc.com"},
+	})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "lisa.kim@hwsc.com", updated.GetUser().GetEmail(), desc)
+	assert.Equal(t, "lisa@hwsc.com", updated.GetUser().GetProspectiveEmail(), desc)
+	_, err = client.VerifyEmailToken(ctx, &pbsvc.UserRequest{
+		Identification: &pblib.Identification{Token: server.EmailToken(created.GetUser().GetUuid())},
+	})
+	assert.Nil(t, err, desc)
+	got, err := client.GetUser(ctx, &pbsvc.UserRequest{User: &pblib.User{Uuid: created.GetUser().GetUuid()}})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, "lisa@hwsc.com", got.GetUser().GetEmail(), desc)
+
+	desc = "test delete user"
+	_, err = client.DeleteUser(ctx, &pbsvc.UserRequest{User: &pblib.User{Uuid: created.GetUser().GetUuid()}})
+	assert.Nil(t, err, desc)
+	_, err = client.GetUser(ctx, &pbsvc.UserRequest{User: &pblib.User{Uuid: created.GetUser().GetUuid()}})
+	assert.Equal(t, codes.NotFound, status.Code(err), desc)
+	_, err = client.VerifyAuthToken(ctx, &pbsvc.UserRequest{Identification: renewed.GetIdentification()})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+}
+
+func TestConfiguredBehaviors(t *testing.T) {
+	server := NewServer()
+	client, stop := unitTestClient(t, server)
+	defer stop()
+	ctx := context.Background()
+
+	user := server.AddUser(&pblib.User{FirstName: "Kate", LastName: "Lee", Email: "kate@hwsc.com", Password: "12345678"}, true)
+
+	desc := "test added verified user can authenticate"
+	_, err := client.AuthenticateUser(ctx, &pbsvc.UserRequest{
+		User: &pblib.User{Email: "kate@hwsc.com", Password: "12345678"},
+	})
+	assert.Nil(t, err, desc)
+
+	desc = "test set error"
+	server.SetError("GetUser", status.Error(codes.Internal, "boom"))
+	_, err = client.GetUser(ctx, &pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()}})
+	assert.Equal(t, codes.Internal, status.Code(err), desc)
+
+	desc = "test nil handler restores the in-memory implementation"
+	server.SetHandler("GetUser", nil)
+	_, err = client.GetUser(ctx, &pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()}})
+	assert.Nil(t, err, desc)
+
+	desc = "test unavailable"
+	server.SetUnavailable(true)
+	_, err = client.GetUser(ctx, &pbsvc.UserRequest{User: &pblib.User{Uuid: user.GetUuid()}})
+	assert.Equal(t, codes.Unavailable, status.Code(err), desc)
+	resp, err := client.GetStatus(ctx, &pbsvc.UserRequest{})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, uint32(codes.Unavailable), resp.GetCode(), desc)
+	server.SetUnavailable(false)
+
+	desc = "test requests are recorded in order"
+	requests := server.Requests("GetUser")
+	assert.Len(t, requests, 3, desc)
+	assert.Equal(t, user.GetUuid(), requests[0].GetUser().GetUuid(), desc)
+}
+
+func TestListUsers(t *testing.T) {
+	server := NewServer()
+	client, stop := unitTestClient(t, server)
+	defer stop()
+	ctx := context.Background()
+
+	first := server.AddUser(&pblib.User{FirstName: "Kate", LastName: "Lee", Email: "kate@hwsc.com", Password: "12345678"}, true)
+	second := server.AddUser(&pblib.User{FirstName: "Ana", LastName: "Diaz", Email: "ana@hwsc.com", Password: "12345678"}, true)
+
+	authenticated, err := client.AuthenticateUser(ctx, &pbsvc.UserRequest{
+		User: &pblib.User{Email: "kate@hwsc.com", Password: "12345678"},
+	})
+	assert.Nil(t, err)
+
+	desc := "test users are refused"
+	_, err = client.ListUsers(ctx, &pbsvc.UserRequest{Identification: authenticated.GetIdentification()})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+
+	desc = "test admins list every user"
+	server.lock.Lock()
+	server.users[first.GetUuid()].PermissionLevel = auth.PermissionStringMap[auth.Admin]
+	server.revoke(first.GetUuid())
+	server.lock.Unlock()
+	authenticated, err = client.AuthenticateUser(ctx, &pbsvc.UserRequest{
+		User: &pblib.User{Email: "kate@hwsc.com", Password: "12345678"},
+	})
+	assert.Nil(t, err, desc)
+	resp, err := client.ListUsers(ctx, &pbsvc.UserRequest{Identification: authenticated.GetIdentification()})
+	assert.Nil(t, err, desc)
+	var uuids []string
+	for _, user := range resp.GetUserCollection() {
+		uuids = append(uuids, user.GetUuid())
+		assert.Empty(t, user.GetPassword(), desc)
+	}
+	assert.ElementsMatch(t, []string{first.GetUuid(), second.GetUuid()}, uuids, desc)
+	assert.True(t, sort.StringsAreSorted(uuids), desc)
+
+	desc = "test invalid token"
+	_, err = client.ListUsers(ctx, &pbsvc.UserRequest{Identification: &pblib.Identification{Token: "x"}})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+}
+
+func TestUpdatePermissionLevel(t *testing.T) {
+	server := NewServer()
+	client, stop := unitTestClient(t, server)
+	defer stop()
+	ctx := context.Background()
+
+	admin := server.AddUser(&pblib.User{FirstName: "Kate", LastName: "Lee", Email: "kate@hwsc.com", Password: "12345678"}, true)
+	user := server.AddUser(&pblib.User{FirstName: "Ana", LastName: "Diaz", Email: "ana@hwsc.com", Password: "12345678"}, true)
+	server.lock.Lock()
+	server.users[admin.GetUuid()].PermissionLevel = auth.PermissionStringMap[auth.Admin]
+	server.lock.Unlock()
+
+	signIn := func(email string) *pblib.Identification {
+		resp, err := client.AuthenticateUser(ctx, &pbsvc.UserRequest{
+			User: &pblib.User{Email: email, Password: "12345678"},
+		})
+		assert.Nil(t, err)
+		return resp.GetIdentification()
+	}
+	adminID := signIn("kate@hwsc.com")
+	userID := signIn("ana@hwsc.com")
+	promotion := &pblib.User{Uuid: user.GetUuid(), PermissionLevel: auth.PermissionStringMap[auth.Admin]}
+
+	desc := "test the unchanged permission level is accepted"
+	_, err := client.UpdateUser(ctx, &pbsvc.UserRequest{
+		User: &pblib.User{Uuid: user.GetUuid(), PermissionLevel: user.GetPermissionLevel(), LastName: "Cruz"},
+	})
+	assert.Nil(t, err, desc)
+
+	desc = "test changes without a token are refused"
+	_, err = client.UpdateUser(ctx, &pbsvc.UserRequest{User: promotion})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+
+	desc = "test users cannot promote themselves"
+	_, err = client.UpdateUser(ctx, &pbsvc.UserRequest{User: promotion, Identification: userID})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), desc)
+
+	desc = "test admins change permission levels"
+	resp, err := client.UpdateUser(ctx, &pbsvc.UserRequest{User: promotion, Identification: adminID})
+	assert.Nil(t, err, desc)
+	assert.Equal(t, auth.PermissionStringMap[auth.Admin], resp.GetUser().GetPermissionLevel(), desc)
+	_, err = client.VerifyAuthToken(ctx, &pbsvc.UserRequest{Identification: userID})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), desc)
+
+	desc = "test invalid permission level"
+	_, err = client.UpdateUser(ctx, &pbsvc.UserRequest{
+		User:           &pblib.User{Uuid: user.GetUuid(), PermissionLevel: "ROOT"},
+		Identification: adminID,
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), desc)
+}
+
+func TestShareDocument(t *testing.T) {
+	server := NewServer()
+	client, stop := unitTestClient(t, server)
+	defer stop()
+	ctx := context.Background()
+
+	server.AddUser(&pblib.User{FirstName: "Kate", LastName: "Lee", Email: "kate@hwsc.com", Password: "12345678"}, true)
+	recipient := server.AddUser(&pblib.User{FirstName: "Ana", LastName: "Diaz", Email: "ana@hwsc.com", Password: "12345678"}, true)
+	authenticated, err := client.AuthenticateUser(ctx, &pbsvc.UserRequest{
+		User: &pblib.User{Email: "kate@hwsc.com", Password: "12345678"},
+	})
+	assert.Nil(t, err)
+
+	desc := "test share document"
+	_, err = client.ShareDocument(ctx, &pbsvc.UserRequest{
+		Identification:   authenticated.GetIdentification(),
+		Duid:             "1IYmSxWbCLM1cLM2eqbcZ1wlbbv",
+		UuidsToShareDuid: []string{recipient.GetUuid()},
+	})
+	assert.Nil(t, err, desc)
+
+	desc = "test missing recipient"
+	_, err = client.ShareDocument(ctx, &pbsvc.UserRequest{
+		Identification:   authenticated.GetIdentification(),
+		Duid:             "1IYmSxWbCLM1cLM2eqbcZ1wlbbv",
+		UuidsToShareDuid: []string{"01d1na5ekzr7p98hragv5fmvx5"},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err), desc)
+
+	desc = "test no recipients"
+	_, err = client.ShareDocument(ctx, &pbsvc.UserRequest{
+		Identification: authenticated.GetIdentification(),
+		Duid:           "1IYmSxWbCLM1cLM2eqbcZ1wlbbv",
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), desc)
+}